@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Strike reasons
+const (
+	StrikeAuthFailure   = "auth_failure"
+	StrikeInvalidUpload = "invalid_upload"
+	StrikeHoneypot      = "honeypot"
+)
+
+// AbuseGuard counts suspicious requests (failed auth, invalid uploads,
+// honeypot hits) per client IP in a sliding window and bans IPs that cross
+// the threshold. Banned IPs are tarpitted and then dropped. State is kept in
+// memory, so each instance bans independently. All methods are safe on a nil
+// guard.
+type AbuseGuard struct {
+	threshold   int
+	window      time.Duration
+	banDuration time.Duration
+	tarpit      time.Duration
+	exempt      []string // ALLOWED_IPS entries are never banned
+
+	mu      sync.Mutex
+	strikes map[string][]time.Time // client IP -> strikes in the window
+	bans    map[string]time.Time   // client IP -> ban expiry
+}
+
+// abuseGuard is the process-wide guard; nil when abuse detection is disabled
+var abuseGuard *AbuseGuard
+
+// NewAbuseGuard creates a guard from config
+func NewAbuseGuard(cfg AbuseConfig, exempt []string) *AbuseGuard {
+	return &AbuseGuard{
+		threshold:   cfg.Threshold,
+		window:      cfg.Window,
+		banDuration: cfg.BanDuration,
+		tarpit:      cfg.TarpitDelay,
+		exempt:      exempt,
+		strikes:     map[string][]time.Time{},
+		bans:        map[string]time.Time{},
+	}
+}
+
+// RecordStrike adds weight strikes for an IP and bans it once the threshold
+// is reached within the window
+func (g *AbuseGuard) RecordStrike(clientIP, reason string, weight int) {
+	if g == nil || clientIP == "" || (len(g.exempt) > 0 && isIPAllowed(clientIP, g.exempt)) {
+		return
+	}
+	// Strikes and bans are kept by the minimized IP, which in truncate mode
+	// bans the whole network
+	clientIP = ipPrivacy.Anonymize(clientIP)
+	abuseStrikesTotal.WithLabelValues(reason).Add(float64(weight))
+
+	now := time.Now()
+	g.mu.Lock()
+	strikes := g.strikes[clientIP]
+	kept := strikes[:0]
+	for _, t := range strikes {
+		if now.Sub(t) < g.window {
+			kept = append(kept, t)
+		}
+	}
+	for range weight {
+		kept = append(kept, now)
+	}
+	count := len(kept)
+
+	banned := false
+	if count >= g.threshold {
+		if _, already := g.bans[clientIP]; !already {
+			banned = true
+		}
+		g.bans[clientIP] = now.Add(g.banDuration)
+		delete(g.strikes, clientIP)
+	} else {
+		g.strikes[clientIP] = kept
+	}
+	g.prune(now)
+	g.mu.Unlock()
+
+	if banned {
+		abuseBansTotal.WithLabelValues(reason).Inc()
+		log.Printf("🚫 Banned %s for %s after %d strikes (last: %s)", clientIP, g.banDuration, count, reason)
+		notifier.Send(NotifyAbuse, clientIP,
+			fmt.Sprintf("🚫 Banned %s for %s after %d suspicious requests in %s (last: %s)", clientIP, g.banDuration, count, g.window, reason),
+			g.banDuration)
+	}
+}
+
+// Banned reports whether an IP is currently banned
+func (g *AbuseGuard) Banned(clientIP string) bool {
+	if g == nil {
+		return false
+	}
+	clientIP = ipPrivacy.Anonymize(clientIP)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	until, ok := g.bans[clientIP]
+	if ok && time.Now().After(until) {
+		delete(g.bans, clientIP)
+		return false
+	}
+	return ok
+}
+
+// prune forgets idle IPs and expired bans so the maps don't grow forever
+// under scanning. Called with mu held.
+func (g *AbuseGuard) prune(now time.Time) {
+	if len(g.strikes)+len(g.bans) <= 10000 {
+		return
+	}
+	for ip, times := range g.strikes {
+		if len(times) == 0 || now.Sub(times[len(times)-1]) > g.window {
+			delete(g.strikes, ip)
+		}
+	}
+	for ip, until := range g.bans {
+		if now.After(until) {
+			delete(g.bans, ip)
+		}
+	}
+}
+
+// AbuseMiddleware tarpits requests from banned IPs and then drops the
+// connection without a response, like the stealth mode of AuthMiddleware
+func AbuseMiddleware(guard *AbuseGuard) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if guard == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !guard.Banned(trustedClientIP(r)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			abuseBlockedRequestsTotal.Inc()
+			guard.stall(r)
+			if hj, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hj.Hijack(); err == nil {
+					conn.Close()
+					return
+				}
+			}
+			w.WriteHeader(http.StatusTooManyRequests)
+		})
+	}
+}
+
+// stall waits for the tarpit delay or until the client gives up
+func (g *AbuseGuard) stall(r *http.Request) {
+	if g.tarpit <= 0 {
+		return
+	}
+	timer := time.NewTimer(g.tarpit)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+}
+
+// HandleHoneypot answers paths that only scanners request (/wp-login.php,
+// /.env, ...). A hit bans the IP immediately.
+func HandleHoneypot(guard *AbuseGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clientIP := trustedClientIP(r)
+		log.Printf("🍯 Honeypot hit from %s: %s %s", ipPrivacy.Anonymize(clientIP), r.Method, r.URL.Path)
+		guard.RecordStrike(clientIP, StrikeHoneypot, guard.threshold)
+		guard.stall(r)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
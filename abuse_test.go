@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testAbuseGuard(banDuration time.Duration) *AbuseGuard {
+	return NewAbuseGuard(AbuseConfig{Threshold: 3, Window: time.Minute, BanDuration: banDuration}, []string{"192.0.2.0/24"})
+}
+
+func TestAbuseGuardStrikes(t *testing.T) {
+	guard := testAbuseGuard(time.Hour)
+
+	guard.RecordStrike("203.0.113.7", StrikeAuthFailure, 1)
+	guard.RecordStrike("203.0.113.7", StrikeInvalidUpload, 1)
+	if guard.Banned("203.0.113.7") {
+		t.Fatal("banned after 2 of 3 strikes")
+	}
+	guard.RecordStrike("203.0.113.8", StrikeAuthFailure, 1)
+	if guard.Banned("203.0.113.8") {
+		t.Fatal("strikes of another IP counted")
+	}
+	guard.RecordStrike("203.0.113.7", StrikeAuthFailure, 1)
+	if !guard.Banned("203.0.113.7") {
+		t.Error("not banned after 3 strikes")
+	}
+
+	for range 5 {
+		guard.RecordStrike("192.0.2.10", StrikeAuthFailure, 1)
+	}
+	if guard.Banned("192.0.2.10") {
+		t.Error("allowed IP banned")
+	}
+}
+
+func TestAbuseGuardStrikesLeaveWindow(t *testing.T) {
+	guard := testAbuseGuard(time.Hour)
+	guard.strikes["203.0.113.7"] = []time.Time{time.Now().Add(-2 * time.Minute), time.Now().Add(-90 * time.Second)}
+
+	guard.RecordStrike("203.0.113.7", StrikeAuthFailure, 1)
+	if guard.Banned("203.0.113.7") {
+		t.Error("strikes older than the window counted")
+	}
+}
+
+func TestAbuseGuardBanExpires(t *testing.T) {
+	guard := testAbuseGuard(time.Hour)
+	guard.RecordStrike("203.0.113.7", StrikeAuthFailure, 3)
+	if !guard.Banned("203.0.113.7") {
+		t.Fatal("not banned after 3 strikes")
+	}
+
+	guard.bans["203.0.113.7"] = time.Now().Add(-time.Second)
+	if guard.Banned("203.0.113.7") {
+		t.Error("still banned after the ban expired")
+	}
+	if _, ok := guard.bans["203.0.113.7"]; ok {
+		t.Error("expired ban kept")
+	}
+}
+
+func TestAbuseHoneypot(t *testing.T) {
+	guard := testAbuseGuard(time.Hour)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/wp-login.php", HandleHoneypot(guard))
+	mux.HandleFunc("/.git/", HandleHoneypot(guard))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler := AbuseMiddleware(guard)(mux)
+
+	get := func(path, remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if status := get("/images/wp-login.php.jpg", "203.0.113.7:1234"); status != http.StatusNoContent || guard.Banned("203.0.113.7") {
+		t.Fatalf("ordinary path: status %d, banned %v", status, guard.Banned("203.0.113.7"))
+	}
+	if status := get("/.git/config", "203.0.113.8:1234"); status != http.StatusNotFound || !guard.Banned("203.0.113.8") {
+		t.Fatalf("honeypot path: status %d, banned %v, want 404 and a ban", status, guard.Banned("203.0.113.8"))
+	}
+	if status := get("/", "203.0.113.8:1234"); status != http.StatusTooManyRequests {
+		t.Errorf("request after a honeypot hit: status %d, want it refused", status)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+// startedAt is when the process started, reported by /admin/config
+var startedAt = time.Now()
+
+// secretFieldPattern matches config field names holding credentials. Their
+// values are replaced by fingerprints, so two pods can be compared without
+// revealing the secrets.
+var secretFieldPattern = regexp.MustCompile(`(?i)key|secret|token|password|webhook`)
+
+// BucketSummary describes a registered bucket
+type BucketSummary struct {
+	Name     string `json:"name"`
+	Driver   string `json:"driver"`
+	Mirror   string `json:"mirror,omitempty"`   // secondary bucket of a mirrored backend
+	Failover string `json:"failover,omitempty"` // bucket taking writes while the primary is failing
+	State    string `json:"state,omitempty"`    // "primary" or "failover to <bucket>"
+}
+
+// AdminConfigResponse is the effective configuration of the running process
+type AdminConfigResponse struct {
+	Hostname  string          `json:"hostname"`
+	StartedAt time.Time       `json:"startedAt"`
+	GoVersion string          `json:"goVersion"`
+	Revision  string          `json:"revision,omitempty"` // VCS revision the binary was built from
+	Buckets   []BucketSummary `json:"buckets"`
+	Features  map[string]bool `json:"features"`
+	Config    any             `json:"config"`
+}
+
+// HandleAdminConfig serves GET /admin/config: the effective configuration
+// with secrets redacted to fingerprints, the registered buckets and the
+// enabled features
+func HandleAdminConfig(config *Config, backends map[string]Backend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "Method not allowed. Use GET.",
+			})
+			return
+		}
+
+		hostname, _ := os.Hostname()
+		response := AdminConfigResponse{
+			Hostname:  hostname,
+			StartedAt: startedAt,
+			GoVersion: runtime.Version(),
+			Revision:  buildRevision(),
+			Buckets:   []BucketSummary{},
+			Features:  enabledFeatures(config),
+			Config:    redactConfig(reflect.ValueOf(*config)),
+		}
+		for _, backend := range backends {
+			response.Buckets = append(response.Buckets, summarizeBackend(backend))
+		}
+		sort.Slice(response.Buckets, func(i, j int) bool { return response.Buckets[i].Name < response.Buckets[j].Name })
+
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// summarizeBackend describes the driver behind a backend
+func summarizeBackend(backend Backend) BucketSummary {
+	summary := BucketSummary{Name: backend.Bucket()}
+	switch b := backend.(type) {
+	case *GCSClient:
+		summary.Driver = "gcs"
+	case *R2Client:
+		summary.Driver = "r2"
+	case *FSBackend:
+		summary.Driver = "fs"
+	case *TeeBackend:
+		summary = summarizeBackend(b.Backend)
+		summary.Mirror = b.secondary.Bucket()
+	case *FailoverBackend:
+		summary = summarizeBackend(b.Backend)
+		summary.Failover = b.failover.Bucket()
+		summary.State = b.FailoverState()
+	default:
+		summary.Driver = "unknown"
+	}
+	return summary
+}
+
+// enabledFeatures reports which optional features the configuration turns on
+func enabledFeatures(config *Config) map[string]bool {
+	return map[string]bool{
+		"auth":             config.APIKey1 != "",
+		"readKey":          config.ReadAPIKey != "",
+		"adminKey":         config.AdminAPIKey != "",
+		"oidc":             config.OIDC.Enabled(),
+		"bigquery":         config.BigQuery.Enabled(),
+		"notifications":    config.Notify.WebhookURL != "",
+		"emailAlerts":      config.SMTP.Enabled(),
+		"cloudTasks":       config.CloudTasks.Queue != "",
+		"abuseDetection":   config.Abuse.Threshold > 0,
+		"signedDownloads":  len(config.DownloadSigning.Keys) > 0,
+		"uploadReceipts":   len(config.Receipts.Keys) > 0,
+		"paranoid":         config.Paranoid,
+		"serverless":       config.Serverless,
+		"workloadIdentity": config.WorkloadIdentity.Enabled(),
+		"perceptualHash":   config.PerceptualHash,
+		"autoOrient":       config.AutoOrient,
+		"sRGBConversion":   config.Color.ConvertSRGB,
+		"iccStripping":     config.Color.MaxICCSize > 0,
+		"animationPoster":  config.Animation.Poster,
+		"signedURLCache":   config.SignedURLCacheSize > 0,
+		"contentScanning":  config.Quarantine.ScanURL != "",
+		"metricsPush":      config.MetricsPush.URL != "",
+		"mirror1":          config.MirrorDriver1 != "",
+		"mirror2":          config.MirrorDriver2 != "",
+		"failover1":        config.FailoverBucketName1 != "",
+		"failover2":        config.FailoverBucketName2 != "",
+		"storageReports":   config.Report.Interval > 0 && config.Report.Prefix != "",
+	}
+}
+
+// redactConfig converts a config struct to JSON-friendly values, replacing
+// secret fields with fingerprints and durations with their string form
+func redactConfig(v reflect.Value) any {
+	fields := map[string]any{}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		value := v.Field(i)
+		switch {
+		case secretFieldPattern.MatchString(field.Name):
+			fields[field.Name] = redactSecret(value)
+		case value.Type() == reflect.TypeOf(time.Duration(0)):
+			fields[field.Name] = time.Duration(value.Int()).String()
+		case value.Kind() == reflect.Struct:
+			fields[field.Name] = redactConfig(value)
+		default:
+			fields[field.Name] = value.Interface()
+		}
+	}
+	return fields
+}
+
+// redactSecret returns the fingerprint of a secret string, or of each
+// element of a list of secrets
+func redactSecret(v reflect.Value) any {
+	switch v.Kind() {
+	case reflect.String:
+		return secretFingerprint(v.String())
+	case reflect.Slice:
+		prints := make([]string, v.Len())
+		for i := range prints {
+			prints[i] = secretFingerprint(v.Index(i).String())
+		}
+		return prints
+	}
+	return "redacted"
+}
+
+// secretFingerprint identifies a secret without revealing it: the first 8
+// hex digits of its SHA-256, or "" when it is not set
+func secretFingerprint(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return "sha256:" + hex.EncodeToString(sum[:4])
+}
+
+// buildRevision returns the VCS revision embedded by go build, if any
+func buildRevision() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Metadata keys of the accessibility text stored with an image
+const (
+	altMetadataKey     = "alt"
+	captionMetadataKey = "caption"
+)
+
+// accessibilityFields are form fields accepted by every upload, whatever
+// UPLOAD_METADATA_FIELDS lists, so alt text and captions stay attached to the
+// asset. UPLOAD_METADATA_FIELDS can still store them under another key.
+var accessibilityFields = []string{altMetadataKey, captionMetadataKey}
+
+// AssetMetadataResponse is the descriptive metadata of one object
+type AssetMetadataResponse struct {
+	Success     bool              `json:"success"`
+	Object      string            `json:"object,omitempty"`
+	URL         string            `json:"url,omitempty"`
+	Alt         string            `json:"alt,omitempty"`
+	Caption     string            `json:"caption,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Size        int64             `json:"size,omitempty"`
+	Uploaded    time.Time         `json:"uploaded,omitzero"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// HandleAssetMetadata serves GET /objects/{name}/metadata: the alt text,
+// caption and other metadata of an object. The metadata store is consulted
+// first; objects it doesn't know (signed URL uploads) are read from storage.
+func HandleAssetMetadata(backend Backend, mountPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(AssetMetadataResponse{
+				Success: false,
+				Error:   "Method not allowed. Use GET.",
+			})
+			return
+		}
+
+		name, ok := objectPathName(r, mountPath, "/metadata")
+		if !ok || name == "" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(AssetMetadataResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Not found. Use %s{name}/metadata", mountPath),
+			})
+			return
+		}
+
+		response := AssetMetadataResponse{Success: true, Object: name, URL: backend.PublicURL(name)}
+		if record, ok := metadataStore.Get(backend.Bucket(), name); ok && !isQuarantineRecord(record) {
+			response.ContentType, response.Size, response.Uploaded, response.Metadata = record.ContentType, record.Size, record.CreatedAt, record.Metadata
+			response.Tags = record.Tags
+		} else {
+			info, err := backend.Stat(r.Context(), name)
+			if errors.Is(err, ErrObjectNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(AssetMetadataResponse{
+					Success: false,
+					Error:   "Object not found",
+				})
+				return
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(AssetMetadataResponse{
+					Success: false,
+					Error:   fmt.Sprintf("Failed to read object metadata: %v", err),
+				})
+				return
+			}
+			response.ContentType, response.Size, response.Uploaded, response.Metadata = info.ContentType, info.Size, info.Updated, info.Metadata
+		}
+		response.Alt = response.Metadata[altMetadataKey]
+		response.Caption = response.Metadata[captionMetadataKey]
+
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// HandleObjectRoutes dispatches /objects/{name}/{resource} requests on the
+// last path segment, e.g. "similar" or "metadata"
+func HandleObjectRoutes(routes map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slash := strings.LastIndex(r.URL.Path, "/"); slash >= 0 {
+			if handler, ok := routes[r.URL.Path[slash+1:]]; ok {
+				handler.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: false,
+			Error:   "Not found",
+		})
+	})
+}
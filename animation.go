@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"strings"
+	"time"
+)
+
+// AnimationLimits limits animated GIF/WebP uploads and controls posters
+type AnimationLimits struct {
+	MaxFrames   int           // 0 for no limit
+	MaxDuration time.Duration // total play time of one loop, 0 for no limit
+	Poster      bool          // store a static PNG of the first frame next to animated GIFs
+}
+
+// maxPosterPixels bounds the canvas of a poster, which GIFs declare
+// independently of their frames
+const maxPosterPixels = 50_000_000
+
+// animationInfo describes the frames of an image
+type animationInfo struct {
+	Frames   int
+	Duration time.Duration
+}
+
+// inspectAnimation counts the frames of a GIF or WebP without decoding pixel
+// data, so frame limits are enforced before any frame is decompressed.
+// Other formats report a single frame.
+func inspectAnimation(data []byte, ext string) (animationInfo, error) {
+	switch ext {
+	case ".gif":
+		return inspectGIF(data)
+	case ".webp":
+		return inspectWebP(data)
+	}
+	return animationInfo{Frames: 1}, nil
+}
+
+// inspectGIF walks the GIF block structure, counting image descriptors and
+// summing the delays of their graphic control extensions
+func inspectGIF(data []byte) (animationInfo, error) {
+	var info animationInfo
+	invalid := fmt.Errorf("%w: malformed GIF", errInvalidImage)
+
+	if len(data) < 13 || !bytes.HasPrefix(data, []byte("GIF8")) {
+		return info, invalid
+	}
+	pos := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << ((flags & 0x07) + 1) // global color table
+	}
+
+	// skipSubBlocks skips a sequence of length-prefixed sub-blocks
+	skipSubBlocks := func() bool {
+		for pos < len(data) {
+			size := int(data[pos])
+			pos++
+			if size == 0 {
+				return true
+			}
+			pos += size
+		}
+		return false
+	}
+
+	var delay time.Duration
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // extension
+			if pos+2 > len(data) {
+				return info, invalid
+			}
+			label := data[pos+1]
+			pos += 2
+			if label == 0xF9 && pos+5 <= len(data) && data[pos] == 4 {
+				// Graphic control extension: delay in 1/100 s
+				delay = time.Duration(binary.LittleEndian.Uint16(data[pos+2:pos+4])) * 10 * time.Millisecond
+			}
+			if !skipSubBlocks() {
+				return info, invalid
+			}
+		case 0x2C: // image descriptor
+			if pos+10 > len(data) {
+				return info, invalid
+			}
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << ((flags & 0x07) + 1) // local color table
+			}
+			pos++ // LZW minimum code size
+			if !skipSubBlocks() {
+				return info, invalid
+			}
+			info.Frames++
+			info.Duration += delay
+			delay = 0
+		case 0x3B: // trailer
+			return info, nil
+		default:
+			return info, invalid
+		}
+	}
+	// Truncated files without a trailer still decode in browsers
+	return info, nil
+}
+
+// inspectWebP walks the RIFF chunks, counting ANMF frames and summing their durations
+func inspectWebP(data []byte) (animationInfo, error) {
+	var info animationInfo
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return info, fmt.Errorf("%w: malformed WebP", errInvalidImage)
+	}
+
+	for pos := 12; pos+8 <= len(data); {
+		fourCC := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		pos += 8
+		if size < 0 || pos+size > len(data) {
+			return info, fmt.Errorf("%w: malformed WebP", errInvalidImage)
+		}
+		if fourCC == "ANMF" && size >= 16 {
+			payload := data[pos : pos+size]
+			duration := int(payload[12]) | int(payload[13])<<8 | int(payload[14])<<16
+			info.Frames++
+			info.Duration += time.Duration(duration) * time.Millisecond
+		}
+		pos += size + size%2 // chunks are padded to an even size
+	}
+
+	if info.Frames == 0 {
+		info.Frames = 1
+	}
+	return info, nil
+}
+
+// checkAnimation enforces the frame and duration limits
+func checkAnimation(info animationInfo, opts AnimationLimits) error {
+	if opts.MaxFrames > 0 && info.Frames > opts.MaxFrames {
+		return fmt.Errorf("%w: animation has %d frames, the limit is %d", errInvalidImage, info.Frames, opts.MaxFrames)
+	}
+	if opts.MaxDuration > 0 && info.Duration > opts.MaxDuration {
+		return fmt.Errorf("%w: animation runs for %s, the limit is %s", errInvalidImage, info.Duration, opts.MaxDuration)
+	}
+	return nil
+}
+
+// gifPoster renders the first frame of a GIF onto its full canvas as a PNG
+func gifPoster(data []byte) ([]byte, error) {
+	config, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxPosterPixels {
+		return nil, fmt.Errorf("canvas of %dx%d is too large for a poster", config.Width, config.Height)
+	}
+	// Decode stops after the first frame
+	frame, err := gif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, config.Width, config.Height))
+	draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, canvas); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// posterName returns the object name of the poster of an animated object
+func posterName(name string) string {
+	return strings.TrimSuffix(name, ".gif") + ".poster.png"
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"testing"
+	"time"
+)
+
+// testGIF encodes an animated GIF with one frame per delay (in 1/100 s)
+func testGIF(t *testing.T, delays ...int) []byte {
+	t.Helper()
+	anim := &gif.GIF{}
+	for i, delay := range delays {
+		frame := image.NewPaletted(image.Rect(0, 0, 8, 8), palette.Plan9)
+		frame.Set(i%8, i%8, color.White)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, delay)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testWebP builds an animated WebP container with one ANMF chunk per
+// duration (in ms); the frame payloads are not valid image data
+func testWebP(durations ...int) []byte {
+	chunk := func(fourCC string, payload []byte) []byte {
+		out := append([]byte(fourCC), 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(out[4:], uint32(len(payload)))
+		out = append(out, payload...)
+		if len(payload)%2 == 1 {
+			out = append(out, 0)
+		}
+		return out
+	}
+	body := []byte("WEBP")
+	body = append(body, chunk("VP8X", make([]byte, 10))...)
+	body = append(body, chunk("ANIM", make([]byte, 6))...)
+	for _, duration := range durations {
+		frame := make([]byte, 17) // odd, so the chunk is padded
+		frame[12], frame[13], frame[14] = byte(duration), byte(duration>>8), byte(duration>>16)
+		body = append(body, chunk("ANMF", frame)...)
+	}
+	out := append([]byte("RIFF"), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(body)))
+	return append(out, body...)
+}
+
+func TestInspectGIF(t *testing.T) {
+	data := testGIF(t, 10, 20, 30)
+	info, err := inspectAnimation(data, ".gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Frames != 3 || info.Duration != 600*time.Millisecond {
+		t.Errorf("inspectAnimation() = %+v, want 3 frames and 600ms", info)
+	}
+}
+
+func TestInspectGIFTruncated(t *testing.T) {
+	data := testGIF(t, 10, 20, 30)
+	for n := range len(data) {
+		info, err := inspectGIF(data[:n])
+		if n < 13 && !errors.Is(err, errInvalidImage) {
+			t.Errorf("%d bytes: err = %v, want errInvalidImage", n, err)
+		}
+		if info.Frames > 3 {
+			t.Errorf("%d bytes: %d frames", n, info.Frames)
+		}
+		// The poster is decoded by the standard library; it must fail, not panic
+		gifPoster(data[:n])
+	}
+}
+
+func TestInspectGIFMalformed(t *testing.T) {
+	valid := testGIF(t, 10)
+	tests := map[string][]byte{
+		"not a GIF":             append([]byte("PNG8"), valid[4:]...),
+		"unknown block":         append(bytes.Clone(valid[:len(valid)-1]), 0x99),
+		"extension without end": append(bytes.Clone(valid[:len(valid)-1]), 0x21, 0xF9, 4, 0, 10),
+		"descriptor cut off":    append(bytes.Clone(valid[:len(valid)-1]), 0x2C, 0, 0),
+	}
+	for name, data := range tests {
+		if _, err := inspectGIF(data); !errors.Is(err, errInvalidImage) {
+			t.Errorf("%s: err = %v, want errInvalidImage", name, err)
+		}
+	}
+
+	// A color table larger than the file ends the walk instead of indexing past it
+	huge := bytes.Clone(valid)
+	huge[10] |= 0x87
+	if _, err := inspectGIF(huge); err != nil && !errors.Is(err, errInvalidImage) {
+		t.Errorf("huge color table: err = %v", err)
+	}
+}
+
+func TestInspectWebP(t *testing.T) {
+	info, err := inspectAnimation(testWebP(100, 250, 70000), ".webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Frames != 3 || info.Duration != 70350*time.Millisecond {
+		t.Errorf("inspectAnimation() = %+v, want 3 frames and 70.35s", info)
+	}
+
+	// Still images count as one frame
+	info, err = inspectWebP(testWebP())
+	if err != nil || info.Frames != 1 {
+		t.Errorf("still WebP = %+v, %v, want 1 frame", info, err)
+	}
+}
+
+func TestInspectWebPTruncated(t *testing.T) {
+	data := testWebP(100, 250)
+	for n := range len(data) {
+		info, err := inspectWebP(data[:n])
+		if n < 12 && !errors.Is(err, errInvalidImage) {
+			t.Errorf("%d bytes: err = %v, want errInvalidImage", n, err)
+		}
+		if info.Frames > 2 {
+			t.Errorf("%d bytes: %d frames", n, info.Frames)
+		}
+	}
+}
+
+func TestInspectWebPMalformed(t *testing.T) {
+	data := testWebP(100)
+	// Chunk sizes past the end of the file, up to the largest uint32
+	for _, size := range []uint32{1 << 20, 1<<31 - 1, 1 << 31, 1<<32 - 1} {
+		bad := bytes.Clone(data)
+		binary.LittleEndian.PutUint32(bad[16:], size)
+		if _, err := inspectWebP(bad); !errors.Is(err, errInvalidImage) {
+			t.Errorf("chunk size %d: err = %v, want errInvalidImage", size, err)
+		}
+	}
+
+	bad := bytes.Clone(data)
+	copy(bad[8:], "WEBX")
+	if _, err := inspectWebP(bad); !errors.Is(err, errInvalidImage) {
+		t.Errorf("wrong form type: err = %v, want errInvalidImage", err)
+	}
+}
+
+func TestCheckAnimation(t *testing.T) {
+	limits := AnimationLimits{MaxFrames: 10, MaxDuration: time.Second}
+	tests := []struct {
+		info animationInfo
+		ok   bool
+	}{
+		{animationInfo{Frames: 10, Duration: time.Second}, true},
+		{animationInfo{Frames: 11}, false},
+		{animationInfo{Frames: 2, Duration: 1001 * time.Millisecond}, false},
+	}
+	for _, tt := range tests {
+		if err := checkAnimation(tt.info, limits); (err == nil) != tt.ok {
+			t.Errorf("checkAnimation(%+v) = %v, want ok %v", tt.info, err, tt.ok)
+		}
+	}
+	if err := checkAnimation(animationInfo{Frames: 1000, Duration: time.Hour}, AnimationLimits{}); err != nil {
+		t.Errorf("no limits: %v", err)
+	}
+}
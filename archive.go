@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// ArchiveRequest selects the objects to download: explicit names, a prefix, or both
+type ArchiveRequest struct {
+	Objects  []string `json:"objects"`
+	Prefix   string   `json:"prefix"`
+	Filename string   `json:"filename"`
+}
+
+// HandleArchive streams a zip of the requested objects. Sizes are resolved
+// before anything is written so requests over the cap fail with a clean 413.
+func HandleArchive(backend Backend, maxBytes int64, maxObjects int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "Method not allowed. Use POST.",
+			})
+			return
+		}
+
+		var req ArchiveRequest
+		if err := decodeJSONBody(w, r, &req, 0); err != nil {
+			writeArchiveError(w, err.Status, err.Message)
+			return
+		}
+		if len(req.Objects) == 0 && req.Prefix == "" {
+			writeArchiveError(w, http.StatusBadRequest, "objects or prefix is required")
+			return
+		}
+
+		objects, status, err := resolveArchiveObjects(r, backend, req, maxBytes, maxObjects)
+		if err != nil {
+			writeArchiveError(w, status, err.Error())
+			return
+		}
+
+		filename := fmt.Sprintf("%s-%d", backend.Bucket(), time.Now().Unix())
+		if req.Filename != "" {
+			filename = strings.ReplaceAll(sanitizeFilename(strings.TrimSuffix(req.Filename, ".zip")), `"`, "")
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".zip"))
+		w.WriteHeader(http.StatusOK)
+
+		// Headers are sent, so failures from here on can only abort the stream
+		zw := zip.NewWriter(w)
+		for _, obj := range objects {
+			if err := r.Context().Err(); err != nil {
+				log.Printf("⚠️  Archive of %d objects from %s aborted, client disconnected", len(objects), backend.Bucket())
+				return
+			}
+			if err := writeArchiveEntry(r, zw, backend, obj); err != nil {
+				log.Printf("⚠️  Archive of %d objects from %s aborted at %s: %v", len(objects), backend.Bucket(), obj.Name, err)
+				return
+			}
+		}
+		if err := zw.Close(); err != nil {
+			log.Printf("⚠️  Failed to finish archive: %v", err)
+		}
+	}
+}
+
+// resolveArchiveObjects looks up the requested objects and enforces the caps.
+// It returns the HTTP status to use on error.
+func resolveArchiveObjects(r *http.Request, backend Backend, req ArchiveRequest, maxBytes int64, maxObjects int) ([]ObjectInfo, int, error) {
+	var objects []ObjectInfo
+	var total int64
+	seen := map[string]bool{}
+	errTooLarge := errors.New("archive too large")
+
+	add := func(obj ObjectInfo) error {
+		if seen[obj.Name] || hiddenObject(obj.Name) {
+			return nil
+		}
+		seen[obj.Name] = true
+		objects = append(objects, obj)
+		total += obj.Size
+		if len(objects) > maxObjects || total > maxBytes {
+			return errTooLarge
+		}
+		return nil
+	}
+
+	for _, name := range req.Objects {
+		info, err := backend.Stat(r.Context(), name)
+		if errors.Is(err, ErrObjectNotFound) || hiddenObject(name) {
+			return nil, http.StatusNotFound, fmt.Errorf("object not found: %s", name)
+		}
+		if err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("failed to stat %s: %v", name, err)
+		}
+		if err := add(*info); err != nil {
+			break
+		}
+	}
+
+	if req.Prefix != "" && len(objects) <= maxObjects && total <= maxBytes {
+		err := backend.List(r.Context(), req.Prefix, add)
+		if err != nil && !errors.Is(err, errTooLarge) {
+			return nil, http.StatusInternalServerError, fmt.Errorf("failed to list objects: %v", err)
+		}
+	}
+
+	if len(objects) > maxObjects || total > maxBytes {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("archive exceeds the limit of %d objects or %d MB", maxObjects, maxBytes/(1024*1024))
+	}
+	if len(objects) == 0 {
+		return nil, http.StatusNotFound, errors.New("no objects match the request")
+	}
+	return objects, http.StatusOK, nil
+}
+
+// writeArchiveEntry copies one object into the zip. Images are already
+// compressed, so entries are stored rather than deflated.
+func writeArchiveEntry(r *http.Request, zw *zip.Writer, backend Backend, obj ObjectInfo) error {
+	reader, _, err := backend.Open(r.Context(), obj.Name)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	entry, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     archiveEntryName(obj.Name),
+		Method:   zip.Store,
+		Modified: obj.Updated,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, reader)
+	return err
+}
+
+// archiveEntryName turns an object name into a relative path that cannot
+// escape the extraction directory
+func archiveEntryName(name string) string {
+	cleaned := path.Clean("/" + name)
+	return strings.TrimPrefix(cleaned, "/")
+}
+
+func writeArchiveError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(UploadResponse{
+		Success: false,
+		Error:   message,
+	})
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrObjectNotFound is returned by backends when the requested object does not exist
+var ErrObjectNotFound = errors.New("object not found")
+
+// ErrObjectExists is returned by Put with IfNotExists when the name is taken
+var ErrObjectExists = errors.New("object already exists")
+
+// ErrInvalidRange is returned by OpenRange when the range starts past the end of the object
+var ErrInvalidRange = errors.New("requested range not satisfiable")
+
+// ErrObjectHeld is returned when an object can't be deleted because of a
+// hold or the bucket retention policy
+var ErrObjectHeld = errors.New("object is under a hold or retention period")
+
+// ObjectInfo describes a stored object independently of the backend
+type ObjectInfo struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType,omitempty"`
+	// ContentDisposition is sent with downloads (inline or attachment and the filename)
+	ContentDisposition string            `json:"contentDisposition,omitempty"`
+	ETag               string            `json:"etag,omitempty"`
+	Updated            time.Time         `json:"updated"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	// CRC32C is the Castagnoli checksum reported by the storage service, 0 if it reports none
+	CRC32C uint32 `json:"-"`
+	// Encrypted is set for objects written with a customer-supplied key, see csek.go
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// PutOptions controls how an object is written
+type PutOptions struct {
+	ContentType        string
+	ContentDisposition string
+	Metadata           map[string]string
+	IfNotExists        bool  // fail with ErrObjectExists instead of replacing an existing object
+	Size               int64 // content length when known, 0 otherwise
+}
+
+// SignOptions controls signed URL generation
+type SignOptions struct {
+	ContentType string
+	Expires     time.Duration
+	MaxSize     int64 // upper bound for uploads, enforced by the storage service where supported
+	// Custom metadata and Cache-Control signed into upload URLs, stored with the object
+	Metadata     map[string]string
+	CacheControl string
+}
+
+// Backend is implemented by every object storage driver (GCS, R2/S3, ...)
+type Backend interface {
+	// Bucket returns the bucket (or root) the backend writes to
+	Bucket() string
+	// Put writes the object, replacing any existing object with the same name
+	// unless opts.IfNotExists is set. The check is atomic with the write.
+	Put(ctx context.Context, name string, r io.Reader, opts PutOptions) (*ObjectInfo, error)
+	// Open returns a reader for the object content
+	Open(ctx context.Context, name string) (io.ReadCloser, *ObjectInfo, error)
+	// Stat returns object attributes or ErrObjectNotFound
+	Stat(ctx context.Context, name string) (*ObjectInfo, error)
+	// Delete removes the object
+	Delete(ctx context.Context, name string) error
+	// List calls fn for every object whose name starts with prefix
+	List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+	// SignedURL returns a time-limited URL for the given HTTP method
+	SignedURL(method, name string, opts SignOptions) (string, error)
+	// PublicURL returns the URL an object is served from
+	PublicURL(name string) string
+	// Close releases backend resources
+	Close() error
+}
+
+// bucketSettingsManager is implemented by backends that can manage bucket
+// CORS rules, lifecycle rules and labels
+type bucketSettingsManager interface {
+	// BucketSettings returns the current settings of the bucket
+	BucketSettings(ctx context.Context) (*BucketSettings, error)
+	// UpdateBucketSettings applies the non-nil settings
+	UpdateBucketSettings(ctx context.Context, settings BucketSettings) error
+}
+
+// retentionManager is implemented by backends that support bucket retention
+// policies and object holds (write-once-read-many storage)
+type retentionManager interface {
+	// RetentionPolicy returns the bucket retention policy, nil when there is none
+	RetentionPolicy(ctx context.Context) (*RetentionPolicy, error)
+	// SetRetentionPolicy sets the minimum age of objects before they can be
+	// deleted or replaced; 0 removes the policy
+	SetRetentionPolicy(ctx context.Context, period time.Duration) error
+	// LockRetentionPolicy makes the policy permanent, which can't be undone
+	LockRetentionPolicy(ctx context.Context) error
+	// ObjectRetention returns the holds and retention expiry of an object
+	ObjectRetention(ctx context.Context, name string) (*ObjectRetention, error)
+	// SetTemporaryHold places or releases the temporary hold of an object
+	SetTemporaryHold(ctx context.Context, name string, held bool) error
+}
+
+// rangeOpener is implemented by backends that can read part of an object.
+// A negative offset reads the last -offset bytes and a negative length reads
+// to the end. The returned ObjectInfo.Size is the size of the whole object.
+type rangeOpener interface {
+	OpenRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, *ObjectInfo, error)
+}
+
+// uploadHeaderSigner is implemented by backends whose signed upload URLs
+// require extra headers that the client has to send with the upload
+type uploadHeaderSigner interface {
+	UploadHeaders(opts SignOptions) map[string]string
+}
+
+// signedUploadHeaders returns the headers a client must send when uploading
+// with a URL signed using opts
+func signedUploadHeaders(backend Backend, opts SignOptions) map[string]string {
+	if signer, ok := backend.(uploadHeaderSigner); ok {
+		return signer.UploadHeaders(opts)
+	}
+	if opts.ContentType == "" {
+		return nil
+	}
+	return map[string]string{"Content-Type": opts.ContentType}
+}
+
+// BucketConfig describes a bucket and the driver that serves it
+type BucketConfig struct {
+	Name            string
+	Driver          string
+	CredentialsPath string
+	SigningAccount  string        // gcs: service account impersonated to sign URLs, see signer.go
+	PublicBaseURL   string        // used by drivers served through the download endpoint
+	Mirror          *BucketConfig // optional secondary that receives asynchronous copies
+	Failover        *BucketConfig // optional bucket taking writes while the primary is failing
+}
+
+// NewBackend creates the storage backend for the bucket, wrapping it in a
+// FailoverBackend when a failover bucket is configured and in a TeeBackend
+// when a mirror is configured
+func NewBackend(ctx context.Context, config *Config, bucket BucketConfig) (Backend, error) {
+	primary, err := newDriver(ctx, config, bucket)
+	if err != nil {
+		return nil, err
+	}
+	if bucket.Failover != nil {
+		failover, err := newDriver(ctx, config, *bucket.Failover)
+		if err != nil {
+			primary.Close()
+			return nil, fmt.Errorf("failed to initialize failover backend: %w", err)
+		}
+		primary = NewFailoverBackend(primary, failover, config.Failover)
+	}
+	if bucket.Mirror == nil {
+		return primary, nil
+	}
+
+	secondary, err := newDriver(ctx, config, *bucket.Mirror)
+	if err != nil {
+		primary.Close()
+		return nil, fmt.Errorf("failed to initialize mirror backend: %w", err)
+	}
+	return NewTeeBackend(primary, secondary, filepath.Join(config.MirrorQueueDir, bucket.Name))
+}
+
+// newDriver creates a single backend for the bucket's driver
+func newDriver(ctx context.Context, config *Config, bucket BucketConfig) (Backend, error) {
+	switch bucket.Driver {
+	case "", "gcs":
+		return NewGCSClient(ctx, bucket.Name, bucket.CredentialsPath, bucket.SigningAccount, config.GCSUpload)
+	case "r2", "s3":
+		return NewR2Client(config.R2, bucket.Name)
+	case "fs":
+		return NewFSBackend(config.FS, bucket.Name, bucket.PublicBaseURL, NewDownloadSigner(config.DownloadSigning))
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", bucket.Driver)
+	}
+}
+
+// objectName builds the stored name of an upload: <unix>-<sanitized name><ext>
+func objectName(originalName string) string {
+	name, ext := splitFilename(originalName)
+	return fmt.Sprintf("%d-%s%s", time.Now().Unix(), name, ext)
+}
+
+// objectURLPath escapes an object name for use in a URL path, keeping the
+// slashes between folders. Spaces, '#', '?', '%' and non-ASCII characters
+// would otherwise end or corrupt the URL.
+func objectURLPath(name string) string {
+	return (&url.URL{Path: name}).EscapedPath()
+}
+
+// uniqueObjectName is objectName under prefix with a random token, for names
+// handed out before the upload happens (signed URLs) so two clients signing
+// the same filename in the same second never overwrite each other
+func uniqueObjectName(prefix, originalName string) string {
+	var token [6]byte
+	rand.Read(token[:])
+	name, ext := splitFilename(originalName)
+	return prefix + strconv.FormatInt(time.Now().Unix(), 10) + "-" + hex.EncodeToString(token[:]) + "-" + name + ext
+}
+
+// cleanObjectPrefix validates a client-supplied prefix ("products/2024") and
+// returns it with a trailing slash
+func cleanObjectPrefix(prefix string) (string, error) {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return "", nil
+	}
+	for _, segment := range strings.Split(prefix, "/") {
+		if !objectPrefixSegment.MatchString(segment) {
+			return "", fmt.Errorf("invalid prefix segment %q", segment)
+		}
+	}
+	return prefix + "/", nil
+}
+
+var objectPrefixSegment = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,62}$`)
+
+// UploadImage uploads an image file to the backend under prefix (as returned
+// by cleanObjectPrefix) with optional custom metadata and returns the stored
+// object. collision decides what happens when the generated name is already
+// taken. disposition is stored as the object's Content-Disposition, and size,
+// when known, lets the backend pick how to upload. Under the suffix policy,
+// a file that implements rewinder is written again under the next free name
+// when another upload takes the one picked first.
+func UploadImage(ctx context.Context, backend Backend, file io.Reader, size int64, prefix, originalName string, metadata map[string]string, disposition, collision string) (*ObjectInfo, error) {
+	// Generate unique filename with timestamp
+	filename := prefix + objectName(originalName)
+	put := func(name string) (*ObjectInfo, error) {
+		return backend.Put(ctx, name, file, PutOptions{
+			ContentType:        getContentType(strings.ToLower(filepath.Ext(originalName))),
+			ContentDisposition: disposition,
+			Metadata:           metadata,
+			IfNotExists:        collision == CollisionSuffix || collision == CollisionReject,
+			Size:               size,
+		})
+	}
+	var info *ObjectInfo
+	var err error
+	if collision == CollisionSuffix {
+		// A lost race for the name is retried when the content can be read again
+		var rewind func() error
+		if r, ok := file.(rewinder); ok {
+			rewind = r.Rewind
+		}
+		filename, info, err = writeFreeObjectName(ctx, backend, filename, put, rewind)
+	} else {
+		info, err = put(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.Name == "" {
+		info.Name = filename
+	}
+	return info, nil
+}
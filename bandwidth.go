@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BandwidthLimit caps the transfer rate of one API key, in bytes per second;
+// 0 means no cap
+type BandwidthLimit struct {
+	Upload   int64
+	Download int64
+}
+
+// BandwidthConfig holds the per-key bandwidth caps
+type BandwidthConfig struct {
+	Default BandwidthLimit // cap of every key not listed in KeyRates
+	// KeyRates overrides the default per key: "name=upload:download", where
+	// name is api1, api2, read or admin
+	KeyRates []string
+}
+
+// bandwidthKeyNames names the configured API keys in BANDWIDTH_KEY_RATES
+var bandwidthKeyNames = []string{"api1", "api2", "read", "admin"}
+
+// parseKeyRates parses BANDWIDTH_KEY_RATES entries into caps per key name
+func parseKeyRates(entries []string) (map[string]BandwidthLimit, error) {
+	limits := map[string]BandwidthLimit{}
+	for _, entry := range entries {
+		name, rates, ok := strings.Cut(entry, "=")
+		upload, download, ok2 := strings.Cut(rates, ":")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("%q is not name=upload:download", entry)
+		}
+		name = strings.TrimSpace(name)
+		if !slices.Contains(bandwidthKeyNames, name) {
+			return nil, fmt.Errorf("unknown key %q, use one of %s", name, strings.Join(bandwidthKeyNames, ", "))
+		}
+		var limit BandwidthLimit
+		var err error
+		if limit.Upload, err = strconv.ParseInt(strings.TrimSpace(upload), 10, 64); err != nil || limit.Upload < 0 {
+			return nil, fmt.Errorf("upload rate of %q must be a number of bytes per second", name)
+		}
+		if limit.Download, err = strconv.ParseInt(strings.TrimSpace(download), 10, 64); err != nil || limit.Download < 0 {
+			return nil, fmt.Errorf("download rate of %q must be a number of bytes per second", name)
+		}
+		limits[name] = limit
+	}
+	return limits, nil
+}
+
+// tokenBucket is a byte rate limiter holding up to one second of tokens, so
+// an idle key may burst that much before being slowed down
+type tokenBucket struct {
+	rate float64 // bytes per second
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// chunk is the most bytes that should be transferred between two waits
+func (b *tokenBucket) chunk() int {
+	return max(int(b.rate), 1)
+}
+
+// wait takes n tokens, sleeping until they are available. Tokens may go
+// negative, so concurrent transfers of the same key queue behind each other.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	deficit := -b.tokens
+	b.mu.Unlock()
+	if deficit <= 0 {
+		return nil
+	}
+
+	delay := time.Duration(deficit / b.rate * float64(time.Second))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// keyBuckets are the upload and download buckets of one key; nil when not capped
+type keyBuckets struct {
+	upload   *tokenBucket
+	download *tokenBucket
+}
+
+// BandwidthLimiter throttles request and response bodies per API key. The
+// caps are shared by all requests made with a key, however many connections
+// or instances of a client they come from.
+type BandwidthLimiter struct {
+	keys    []string // configured key values, in the order of buckets
+	buckets []keyBuckets
+}
+
+// NewBandwidthLimiter creates the buckets of the configured keys; it returns
+// nil when no key is capped
+func NewBandwidthLimiter(cfg BandwidthConfig, keys map[string]string) (*BandwidthLimiter, error) {
+	overrides, err := parseKeyRates(cfg.KeyRates)
+	if err != nil {
+		return nil, err
+	}
+	limiter := &BandwidthLimiter{}
+	for _, name := range bandwidthKeyNames {
+		if keys[name] == "" {
+			continue
+		}
+		limit, ok := overrides[name]
+		if !ok {
+			limit = cfg.Default
+		}
+		if limit.Upload <= 0 && limit.Download <= 0 {
+			continue
+		}
+		limiter.keys = append(limiter.keys, keys[name])
+		limiter.buckets = append(limiter.buckets, keyBuckets{
+			upload:   newTokenBucket(limit.Upload),
+			download: newTokenBucket(limit.Download),
+		})
+	}
+	if len(limiter.keys) == 0 {
+		return nil, nil
+	}
+	return limiter, nil
+}
+
+// bucketsFor returns the buckets of the key the request was made with
+func (l *BandwidthLimiter) bucketsFor(r *http.Request) (keyBuckets, bool) {
+	provided := r.Header.Get("X-API-Key")
+	for i, key := range l.keys {
+		if isKeyAccepted(provided, []string{key}) {
+			return l.buckets[i], true
+		}
+	}
+	return keyBuckets{}, false
+}
+
+// throttledBody reads a request body no faster than its bucket allows
+type throttledBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	bucket *tokenBucket
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if len(p) > b.bucket.chunk() {
+		p = p[:b.bucket.chunk()]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		start := time.Now()
+		if waitErr := b.bucket.wait(b.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+		bandwidthThrottleSeconds.WithLabelValues("upload").Add(time.Since(start).Seconds())
+	}
+	return n, err
+}
+
+// throttledWriter writes a response no faster than its bucket allows
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	bucket *tokenBucket
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), w.bucket.chunk())]
+		start := time.Now()
+		err := w.bucket.wait(w.ctx, len(chunk))
+		bandwidthThrottleSeconds.WithLabelValues("download").Add(time.Since(start).Seconds())
+		if err != nil {
+			return written, err
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// BandwidthMiddleware throttles uploads and downloads made with a capped API
+// key. Requests without one of the configured keys are not throttled.
+func BandwidthMiddleware(limiter *BandwidthLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limiter == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			buckets, ok := limiter.bucketsFor(r)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if buckets.upload != nil && r.Body != nil && r.Body != http.NoBody {
+				r.Body = &throttledBody{ReadCloser: r.Body, ctx: r.Context(), bucket: buckets.upload}
+			}
+			if buckets.download != nil {
+				w = &throttledWriter{ResponseWriter: w, ctx: r.Context(), bucket: buckets.download}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxManifestSize caps the manifest part of a batch upload
+const maxManifestSize = 1 << 20
+
+// manifestField is the multipart field of the checksum manifest
+const manifestField = "manifest"
+
+// BatchUploadResult is the outcome for one file of a batch upload
+type BatchUploadResult struct {
+	Filename     string `json:"filename"`
+	Object       string `json:"object,omitempty"`
+	URL          string `json:"url,omitempty"`
+	SHA256       string `json:"sha256,omitempty"`   // checksum of the received bytes
+	Expected     string `json:"expected,omitempty"` // checksum from the manifest
+	Verified     bool   `json:"verified"`           // the checksum matched the manifest
+	Stored       bool   `json:"stored"`
+	Deduplicated bool   `json:"deduplicated,omitempty"`
+	Staged       bool   `json:"staged,omitempty"` // waits for a publish, see staging.go
+	Receipt      string `json:"receipt,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// BatchUploadResponse lists the results in upload order, then the manifest
+// entries that had no file
+type BatchUploadResponse struct {
+	Success bool                `json:"success"`
+	Stored  int                 `json:"stored"`
+	Failed  int                 `json:"failed"`
+	Results []BatchUploadResult `json:"results"`
+	Error   string              `json:"error,omitempty"`
+}
+
+// parseUploadManifest reads the filename → sha256 manifest of a batch upload
+func parseUploadManifest(r io.Reader, maxFiles int) (map[string]string, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxManifestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxManifestSize {
+		return nil, fmt.Errorf("manifest exceeds %d bytes", maxManifestSize)
+	}
+	var manifest map[string]string
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, errors.New(`manifest must be a JSON object of filename to sha256, e.g. {"cat.jpg": "9f86d0..."}`)
+	}
+	if len(manifest) == 0 || len(manifest) > maxFiles {
+		return nil, fmt.Errorf("manifest must list between 1 and %d files", maxFiles)
+	}
+	for filename, sum := range manifest {
+		sum = strings.ToLower(strings.TrimSpace(sum))
+		if decoded, err := hex.DecodeString(sum); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("checksum of %q is not a hex sha256", filename)
+		}
+		manifest[filename] = sum
+	}
+	return manifest, nil
+}
+
+// spoolVerified copies a file part to a temp file, hashing it on the way,
+// and returns the file rewound along with its size and checksum. The caller
+// removes the file.
+func spoolVerified(part io.Reader, maxSize int64) (*os.File, int64, string, error) {
+	tmp, err := os.CreateTemp("", "batch-*")
+	if err != nil {
+		return nil, 0, "", err
+	}
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), io.LimitReader(part, maxSize+1))
+	if err == nil && size > maxSize {
+		err = errUploadTooLarge
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, 0, "", err
+	}
+	return tmp, size, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// HandleBatchUpload handles POST /upload/batch: a multipart body whose first
+// part is the manifest, a JSON object of filename to sha256, followed by the
+// files. Each file is hashed while it is received and only stored when its
+// checksum matches the manifest, so a batch needs no second verification
+// pass. Files failing verification get a per-file error instead of failing
+// the batch.
+func HandleBatchUpload(backend Backend, config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(BatchUploadResponse{
+				Success: false,
+				Error:   "Method not allowed. Use POST.",
+			})
+			return
+		}
+
+		reader, err := r.MultipartReader()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(BatchUploadResponse{
+				Success: false,
+				Error:   "Expected a multipart/form-data body",
+			})
+			return
+		}
+
+		// The manifest comes first so files can be checked as they stream in
+		part, err := reader.NextPart()
+		if err != nil || part.FormName() != manifestField {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(BatchUploadResponse{
+				Success: false,
+				Error:   fmt.Sprintf("The first part must be the %q field", manifestField),
+			})
+			return
+		}
+		manifest, err := parseUploadManifest(part, config.UploadBatchMax)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(BatchUploadResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Invalid manifest: %v", err),
+			})
+			return
+		}
+
+		// The form isn't parsed, so options come from the query string
+		query := r.URL.Query()
+		uploader, err := uploaderID(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(BatchUploadResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+		collision, err := parseCollisionPolicy(query.Get("collision"), config.CollisionPolicy)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(BatchUploadResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+		tags, err := parseTags(query.Get("tags"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(BatchUploadResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+
+		// Large editorial batches outlive the server timeouts, see the route policies
+		ctx, cancel := context.WithTimeout(r.Context(), routeTimeout(r, serverWriteTimeout))
+		defer cancel()
+
+		opts := IngestOptions{
+			MaxSize:   config.MaxFileSize,
+			Tenant:    r.Header.Get("X-Tenant-ID"),
+			Uploader:  uploader,
+			Origin:    requestOrigin(r),
+			Source:    SourceUpload,
+			Reencode:  config.reencodeOptions(),
+			PHash:     config.PerceptualHash,
+			PHashMax:  config.PHashMaxPixels,
+			Animated:  &config.Animation,
+			Color:     config.colorOptions(),
+			Orient:    config.orientOptions(),
+			Collision: collision,
+			Dedupe:    config.Dedupe,
+			Tags:      tags,
+		}
+
+		response := BatchUploadResponse{Success: true}
+		seen := map[string]bool{}
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				if uploadAborted(ctx, backend, "reading the batch") {
+					return
+				}
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(BatchUploadResponse{
+					Success: false,
+					Results: response.Results,
+					Error:   fmt.Sprintf("Failed to read the batch after %d files: %v", len(response.Results), err),
+				})
+				return
+			}
+			filename := part.FileName()
+			if filename == "" {
+				continue // text fields have no place after the manifest
+			}
+			result := storeBatchFile(ctx, r, backend, part, filename, manifest, seen, opts)
+			part.Close()
+			if result.Stored {
+				response.Stored++
+			} else {
+				response.Failed++
+				response.Success = false
+			}
+			response.Results = append(response.Results, result)
+		}
+
+		for _, filename := range slices.Sorted(maps.Keys(manifest)) {
+			if !seen[filename] {
+				response.Failed++
+				response.Success = false
+				response.Results = append(response.Results, BatchUploadResult{
+					Filename: filename,
+					Expected: manifest[filename],
+					Error:    "Listed in the manifest but not uploaded",
+				})
+			}
+		}
+
+		traceLogf(ctx, "📦 Batch upload to %s: %d stored, %d failed", backend.Bucket(), response.Stored, response.Failed)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// storeBatchFile verifies one file of a batch against the manifest and
+// stores it when its checksum matches
+func storeBatchFile(ctx context.Context, r *http.Request, backend Backend, part io.Reader, filename string, manifest map[string]string, seen map[string]bool, opts IngestOptions) BatchUploadResult {
+	result := BatchUploadResult{Filename: filename}
+	expected, listed := manifest[filename]
+	if !listed {
+		result.Error = "Not listed in the manifest"
+		return result
+	}
+	if seen[filename] {
+		result.Error = "Uploaded more than once in the batch"
+		return result
+	}
+	seen[filename] = true
+	result.Expected = expected
+
+	if err := validateUpload(filename, 0, opts.MaxSize); err != nil {
+		if errors.Is(err, errInvalidImageType) {
+			abuseGuard.RecordStrike(trustedClientIP(r), StrikeInvalidUpload, 1)
+		}
+		result.Error = err.Error()
+		return result
+	}
+
+	file, size, sum, err := spoolVerified(part, opts.MaxSize)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	result.SHA256 = sum
+	if sum != expected {
+		result.Error = "Checksum mismatch: the file was not stored"
+		return result
+	}
+	result.Verified = true
+
+	opts.Filename, opts.Size, opts.Started = filename, size, time.Now()
+	stored, err := IngestImage(ctx, backend, file, opts)
+	if err != nil {
+		if errors.Is(err, ErrObjectExists) {
+			result.Error = "An object with this name already exists"
+		} else {
+			result.Error = err.Error()
+		}
+		return result
+	}
+	result.Stored = true
+	result.Object = stored.Name
+	result.URL = backend.PublicURL(stored.Name)
+	result.Deduplicated = stored.Deduplicated
+	if stored.Staged {
+		result.URL, result.Staged = "", true
+	}
+	if receipt, err := receiptSigner.Sign(stored.Record); err != nil {
+		traceLogf(ctx, "⚠️  Failed to sign the receipt of %s: %v", stored.Name, err)
+	} else {
+		result.Receipt = receipt
+	}
+	return result
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/option"
+	gtransport "google.golang.org/api/transport/grpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const (
+	bigQueryBatchSize     = 500
+	bigQueryFlushInterval = 5 * time.Second
+	bigQueryMaxAttempts   = 5     // flushes a row is tried in before it is dropped
+	bigQueryMaxPending    = 10000 // rows kept while BigQuery is unreachable
+
+	bigQueryWriteEndpoint    = "bigquerystorage.googleapis.com:443"
+	bigQueryScope            = "https://www.googleapis.com/auth/bigquery"
+	bigQueryAppendRowsMethod = "/google.cloud.bigquery.storage.v1.BigQueryWrite/AppendRows"
+)
+
+// Field numbers of the row message, see bigQueryRowDescriptor
+const (
+	bigQueryFieldType protowire.Number = iota + 1
+	bigQueryFieldBucket
+	bigQueryFieldObject
+	bigQueryFieldSize
+	bigQueryFieldContentType
+	bigQueryFieldTenant
+	bigQueryFieldLatencyMs
+	bigQueryFieldTimestamp
+	bigQueryFieldUploader
+)
+
+// BigQuerySink streams asset events into a BigQuery table. The table is
+// expected to have the columns type, bucket, object, size, content_type,
+// tenant, latency_ms and timestamp, plus a nullable uploader.
+//
+// Rows are batched and appended to the table's default stream with the
+// Storage Write API (BigQueryWrite.AppendRows over gRPC). The generated
+// storage client isn't a dependency of the service, so the few messages of
+// the call are encoded with protowire and rows are sent as proto2 messages
+// described by bigQueryRowDescriptor. The default stream is at-least-once:
+// a row whose append succeeded but whose response was lost is written again
+// by the retry.
+//
+// Rows of a failed append are queued again and retried with the next flush,
+// up to bigQueryMaxAttempts times; rows BigQuery rejects as invalid are
+// dropped at once.
+type BigQuerySink struct {
+	conn   *grpc.ClientConn
+	stream string // projects/{project}/datasets/{dataset}/tables/{table}/streams/_default
+	schema []byte // encoded DescriptorProto of the rows
+
+	mu      sync.Mutex
+	pending []bigQueryRow
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// bigQueryRow is a queued, encoded row and the number of appends it failed in
+type bigQueryRow struct {
+	data     []byte
+	attempts int
+}
+
+// NewBigQuerySink creates a sink writing to project.dataset.table
+func NewBigQuerySink(ctx context.Context, cfg BigQueryConfig, credentialsPath string) (*BigQuerySink, error) {
+	opts, err := clientOptions(credentialsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create BigQuery client: %w", err)
+	}
+	opts = append(opts, option.WithEndpoint(bigQueryWriteEndpoint), option.WithScopes(bigQueryScope))
+	conn, err := gtransport.Dial(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create BigQuery client: %w", err)
+	}
+	return newBigQuerySink(conn, cfg)
+}
+
+// newBigQuerySink creates a sink appending rows over conn
+func newBigQuerySink(conn *grpc.ClientConn, cfg BigQueryConfig) (*BigQuerySink, error) {
+	schema, err := proto.Marshal(bigQueryRowDescriptor())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode BigQuery row descriptor: %w", err)
+	}
+
+	sink := &BigQuerySink{
+		conn:   conn,
+		stream: fmt.Sprintf("projects/%s/datasets/%s/tables/%s/streams/_default", cfg.Project, cfg.Dataset, cfg.Table),
+		schema: schema,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go sink.flushLoop()
+	return sink, nil
+}
+
+// Name identifies the sink in logs and metrics
+func (s *BigQuerySink) Name() string {
+	return "bigquery"
+}
+
+// Publish buffers the event and flushes once a full batch is collected
+func (s *BigQuerySink) Publish(ctx context.Context, event AssetEvent) error {
+	row := encodeBigQueryRow(event)
+
+	s.mu.Lock()
+	s.pending = append(s.pending, bigQueryRow{data: row})
+	// Rows waiting for a retry don't make every event flush
+	full := len(s.pending)%bigQueryBatchSize == 0
+	s.mu.Unlock()
+
+	if full {
+		return s.flush(ctx)
+	}
+	return nil
+}
+
+// Close flushes the remaining rows and closes the connection
+func (s *BigQuerySink) Close() error {
+	close(s.stop)
+	<-s.done
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := s.flush(ctx)
+	if closeErr := s.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *BigQuerySink) flushLoop() {
+	defer close(s.done)
+	ticker := time.NewTicker(bigQueryFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := s.flush(ctx); err != nil {
+				eventSinkErrorsTotal.WithLabelValues(s.Name()).Inc()
+				log.Printf("⚠️  BigQuery flush failed: %v", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// flush appends all pending rows in one AppendRows request. BigQuery commits
+// none of the rows of a request with row errors, so the rows without one are
+// queued again, as are all rows of a failed request, unless out of attempts.
+func (s *BigQuerySink) flush(ctx context.Context) error {
+	s.mu.Lock()
+	queued := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	if len(queued) == 0 {
+		return nil
+	}
+
+	rows := make([][]byte, len(queued))
+	for i, queuedRow := range queued {
+		rows[i] = queuedRow.data
+	}
+	result, err := s.appendRows(ctx, rows)
+	if err != nil {
+		s.requeue(queued)
+		return fmt.Errorf("appending rows to %s: %w", s.stream, err)
+	}
+
+	if len(result.rowErrors) > 0 {
+		var retry []bigQueryRow
+		var messages []string
+		for i, queuedRow := range queued {
+			message, invalid := result.rowErrors[i]
+			if !invalid {
+				retry = append(retry, queuedRow)
+				continue
+			}
+			bigQueryRowsDroppedTotal.WithLabelValues("invalid").Inc()
+			messages = append(messages, fmt.Sprintf("row %d: %s", i, message))
+		}
+		s.requeue(retry)
+		return fmt.Errorf("%d rows rejected: %s", len(messages), strings.Join(messages, "; "))
+	}
+	if result.code != 0 {
+		s.requeue(queued)
+		return fmt.Errorf("appending rows to %s: %s (code %d)", s.stream, result.message, result.code)
+	}
+	return nil
+}
+
+// requeue puts rows of a failed append back in front of the queue, dropping
+// those out of attempts and the oldest once the queue is full
+func (s *BigQuerySink) requeue(rows []bigQueryRow) {
+	retry := make([]bigQueryRow, 0, len(rows))
+	for _, row := range rows {
+		row.attempts++
+		if row.attempts >= bigQueryMaxAttempts {
+			bigQueryRowsDroppedTotal.WithLabelValues("retries").Inc()
+			continue
+		}
+		retry = append(retry, row)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(retry, s.pending...)
+	if excess := len(s.pending) - bigQueryMaxPending; excess > 0 {
+		bigQueryRowsDroppedTotal.WithLabelValues("backlog").Add(float64(excess))
+		s.pending = s.pending[excess:]
+	}
+}
+
+// appendRowsResult is the part of an AppendRowsResponse the sink acts on
+type appendRowsResult struct {
+	code      int32          // google.rpc.Status code of the request, 0 on success
+	message   string         // and its message
+	rowErrors map[int]string // messages of rejected rows by index
+}
+
+// appendRows sends rows in a single request on a new AppendRows stream of
+// the default stream and waits for its response
+func (s *BigQuerySink) appendRows(ctx context.Context, rows [][]byte) (*appendRowsResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Routing header the generated client sets for the stream
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-goog-request-params", "write_stream="+url.QueryEscape(s.stream))
+
+	stream, err := s.conn.NewStream(ctx, &grpc.StreamDesc{
+		StreamName:    "AppendRows",
+		ServerStreams: true,
+		ClientStreams: true,
+	}, bigQueryAppendRowsMethod, grpc.ForceCodec(bigQueryWireCodec{}))
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(encodeAppendRowsRequest(s.stream, s.schema, rows)); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	var resp []byte
+	if err := stream.RecvMsg(&resp); err != nil {
+		return nil, err
+	}
+	return decodeAppendRowsResponse(resp)
+}
+
+// bigQueryWireCodec passes messages encoded with protowire through gRPC
+// unchanged: requests are []byte, responses are read into *[]byte
+type bigQueryWireCodec struct{}
+
+func (bigQueryWireCodec) Marshal(v any) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("bigquery codec: cannot marshal %T", v)
+	}
+	return b, nil
+}
+
+func (bigQueryWireCodec) Unmarshal(data []byte, v any) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("bigquery codec: cannot unmarshal into %T", v)
+	}
+	*b = append([]byte(nil), data...)
+	return nil
+}
+
+// Name keeps the content type of the generated client, application/grpc+proto
+func (bigQueryWireCodec) Name() string {
+	return "proto"
+}
+
+// bigQueryRowDescriptor describes the rows sent to BigQuery. Fields map to
+// the columns by name; timestamp holds microseconds since the epoch, which
+// BigQuery converts into a TIMESTAMP.
+func bigQueryRowDescriptor() *descriptorpb.DescriptorProto {
+	field := func(name string, number protowire.Number, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(int32(number)),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:   typ.Enum(),
+		}
+	}
+	return &descriptorpb.DescriptorProto{
+		Name: proto.String("AssetEventRow"),
+		Field: []*descriptorpb.FieldDescriptorProto{
+			field("type", bigQueryFieldType, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			field("bucket", bigQueryFieldBucket, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			field("object", bigQueryFieldObject, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			field("size", bigQueryFieldSize, descriptorpb.FieldDescriptorProto_TYPE_INT64),
+			field("content_type", bigQueryFieldContentType, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			field("tenant", bigQueryFieldTenant, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			field("latency_ms", bigQueryFieldLatencyMs, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE),
+			field("timestamp", bigQueryFieldTimestamp, descriptorpb.FieldDescriptorProto_TYPE_INT64),
+			field("uploader", bigQueryFieldUploader, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+		},
+	}
+}
+
+// encodeBigQueryRow encodes event as a row of bigQueryRowDescriptor. An
+// empty uploader is left out so the column stays NULL.
+func encodeBigQueryRow(event AssetEvent) []byte {
+	var b []byte
+	b = appendProtoString(b, bigQueryFieldType, event.Type)
+	b = appendProtoString(b, bigQueryFieldBucket, event.Bucket)
+	b = appendProtoString(b, bigQueryFieldObject, event.Object)
+	b = protowire.AppendTag(b, bigQueryFieldSize, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(event.Size))
+	b = appendProtoString(b, bigQueryFieldContentType, event.ContentType)
+	b = appendProtoString(b, bigQueryFieldTenant, event.Tenant)
+	b = protowire.AppendTag(b, bigQueryFieldLatencyMs, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(event.LatencyMs))
+	b = protowire.AppendTag(b, bigQueryFieldTimestamp, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(event.Timestamp.UnixMicro()))
+	if event.Uploader != "" {
+		b = appendProtoString(b, bigQueryFieldUploader, event.Uploader)
+	}
+	return b
+}
+
+// encodeAppendRowsRequest encodes an AppendRowsRequest carrying rows in
+// proto_rows, with the writer schema every new connection needs:
+//
+//	AppendRowsRequest { string write_stream = 1; ProtoData proto_rows = 4; }
+//	ProtoData { ProtoSchema writer_schema = 1; ProtoRows rows = 2; }
+//	ProtoSchema { google.protobuf.DescriptorProto proto_descriptor = 1; }
+//	ProtoRows { repeated bytes serialized_rows = 1; }
+func encodeAppendRowsRequest(stream string, schema []byte, rows [][]byte) []byte {
+	var protoRows []byte
+	for _, row := range rows {
+		protoRows = appendProtoBytes(protoRows, 1, row)
+	}
+	var protoData []byte
+	protoData = appendProtoBytes(protoData, 1, appendProtoBytes(nil, 1, schema))
+	protoData = appendProtoBytes(protoData, 2, protoRows)
+
+	var req []byte
+	req = appendProtoString(req, 1, stream)
+	req = appendProtoBytes(req, 4, protoData)
+	return req
+}
+
+// decodeAppendRowsResponse reads the error and row errors of an
+// AppendRowsResponse; the append result itself carries nothing of use on
+// the default stream:
+//
+//	AppendRowsResponse { google.rpc.Status error = 2; repeated RowError row_errors = 4; }
+//	google.rpc.Status { int32 code = 1; string message = 2; }
+//	RowError { int64 index = 1; RowErrorCode code = 2; string message = 3; }
+func decodeAppendRowsResponse(b []byte) (*appendRowsResult, error) {
+	result := &appendRowsResult{rowErrors: map[int]string{}}
+	err := rangeProtoFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch {
+		case num == 2 && typ == protowire.BytesType:
+			return rangeProtoFields(v, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+				switch {
+				case num == 1 && typ == protowire.VarintType:
+					result.code = int32(n)
+				case num == 2 && typ == protowire.BytesType:
+					result.message = string(v)
+				}
+				return nil
+			})
+		case num == 4 && typ == protowire.BytesType:
+			index := -1
+			var message string
+			err := rangeProtoFields(v, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+				switch {
+				case num == 1 && typ == protowire.VarintType:
+					index = int(n)
+				case num == 3 && typ == protowire.BytesType:
+					message = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if index >= 0 {
+				result.rowErrors[index] = message
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decoding AppendRows response: %w", err)
+	}
+	return result, nil
+}
+
+func appendProtoString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendProtoBytes(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// rangeProtoFields calls fn with each field of the encoded message b: the
+// contents of length-delimited fields in v, varints and fixed values in n
+func rangeProtoFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		num, typ, tagLen := protowire.ConsumeTag(b)
+		if tagLen < 0 {
+			return protowire.ParseError(tagLen)
+		}
+		b = b[tagLen:]
+
+		var v []byte
+		var n uint64
+		var valueLen int
+		switch typ {
+		case protowire.VarintType:
+			n, valueLen = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var n32 uint32
+			n32, valueLen = protowire.ConsumeFixed32(b)
+			n = uint64(n32)
+		case protowire.Fixed64Type:
+			n, valueLen = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			v, valueLen = protowire.ConsumeBytes(b)
+		default:
+			valueLen = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if valueLen < 0 {
+			return protowire.ParseError(valueLen)
+		}
+		b = b[valueLen:]
+		if err := fn(num, typ, v, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// fakeAppend is an AppendRowsRequest received by fakeBigQueryWrite
+type fakeAppend struct {
+	method  string
+	routing string
+	stream  string
+	schema  *descriptorpb.DescriptorProto
+	rows    [][]byte
+}
+
+// fakeBigQueryWrite serves AppendRows, answering each request with respond
+type fakeBigQueryWrite struct {
+	mu       sync.Mutex
+	requests []fakeAppend
+	respond  func(req fakeAppend) []byte
+}
+
+func (f *fakeBigQueryWrite) handle(_ any, stream grpc.ServerStream) error {
+	var b []byte
+	if err := stream.RecvMsg(&b); err != nil {
+		return err
+	}
+	req := fakeAppend{}
+	req.method, _ = grpc.MethodFromServerStream(stream)
+	if md, ok := metadata.FromIncomingContext(stream.Context()); ok {
+		req.routing = strings.Join(md.Get("x-goog-request-params"), ",")
+	}
+	err := rangeProtoFields(b, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			req.stream = string(v)
+		case 4:
+			return rangeProtoFields(v, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) error {
+				switch num {
+				case 1:
+					return rangeProtoFields(v, func(_ protowire.Number, _ protowire.Type, v []byte, _ uint64) error {
+						req.schema = &descriptorpb.DescriptorProto{}
+						return proto.Unmarshal(v, req.schema)
+					})
+				case 2:
+					return rangeProtoFields(v, func(_ protowire.Number, _ protowire.Type, v []byte, _ uint64) error {
+						req.rows = append(req.rows, v)
+						return nil
+					})
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	f.mu.Unlock()
+	return stream.SendMsg(f.respond(req))
+}
+
+// testBigQuerySink returns a sink connected to an in-process fake of the
+// Storage Write API
+func testBigQuerySink(t *testing.T, respond func(req fakeAppend) []byte) (*BigQuerySink, *fakeBigQueryWrite) {
+	t.Helper()
+	fake := &fakeBigQueryWrite{respond: respond}
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(grpc.UnknownServiceHandler(fake.handle), grpc.ForceServerCodec(bigQueryWireCodec{}))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bigquery",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, err := newBigQuerySink(conn, BigQueryConfig{Project: "p", Dataset: "d", Table: "t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink, fake
+}
+
+// decodeTestRow decodes a row with the descriptor sent along with it
+func decodeTestRow(t *testing.T, schema *descriptorpb.DescriptorProto, row []byte) protoreflect.Message {
+	t.Helper()
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:        proto.String("row.proto"),
+		Syntax:      proto.String("proto2"),
+		MessageType: []*descriptorpb.DescriptorProto{schema},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := dynamicpb.NewMessage(file.Messages().Get(0))
+	if err := proto.Unmarshal(row, msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func rowErrorsResponse(errors map[int]string) []byte {
+	var b []byte
+	for index, message := range errors {
+		var rowErr []byte
+		rowErr = protowire.AppendTag(rowErr, 1, protowire.VarintType)
+		rowErr = protowire.AppendVarint(rowErr, uint64(index))
+		rowErr = appendProtoString(rowErr, 3, message)
+		b = appendProtoBytes(b, 4, rowErr)
+	}
+	// BigQuery sets the request's error along with its row errors
+	return append(b, statusResponse(3, "rows rejected")...)
+}
+
+func statusResponse(code int, message string) []byte {
+	var status []byte
+	status = protowire.AppendTag(status, 1, protowire.VarintType)
+	status = protowire.AppendVarint(status, uint64(code))
+	status = appendProtoString(status, 2, message)
+	return appendProtoBytes(nil, 2, status)
+}
+
+func TestBigQuerySinkAppendsRows(t *testing.T) {
+	sink, fake := testBigQuerySink(t, func(fakeAppend) []byte { return nil })
+	ts := time.Date(2026, 3, 1, 12, 0, 0, 123456000, time.UTC)
+	events := []AssetEvent{
+		{Type: "upload", Bucket: "b", Object: "a.png", Size: 42, ContentType: "image/png", Tenant: "acme", LatencyMs: 12.5, Timestamp: ts},
+		{Type: "delete", Bucket: "b", Object: "c.png", Uploader: "u-1", Timestamp: ts},
+	}
+	for _, event := range events {
+		if err := sink.Publish(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(fake.requests))
+	}
+	req := fake.requests[0]
+	const stream = "projects/p/datasets/d/tables/t/streams/_default"
+	if req.method != bigQueryAppendRowsMethod || req.stream != stream {
+		t.Errorf("appended to %s %s, want %s %s", req.method, req.stream, bigQueryAppendRowsMethod, stream)
+	}
+	if want := "write_stream=projects%2Fp%2Fdatasets%2Fd%2Ftables%2Ft%2Fstreams%2F_default"; req.routing != want {
+		t.Errorf("x-goog-request-params = %q, want %q", req.routing, want)
+	}
+	if req.schema == nil || len(req.rows) != 2 {
+		t.Fatalf("got schema %v and %d rows, want a schema and 2 rows", req.schema, len(req.rows))
+	}
+
+	first := decodeTestRow(t, req.schema, req.rows[0])
+	fields := first.Descriptor().Fields()
+	for name, want := range map[string]any{
+		"type":         "upload",
+		"bucket":       "b",
+		"object":       "a.png",
+		"size":         int64(42),
+		"content_type": "image/png",
+		"tenant":       "acme",
+		"latency_ms":   12.5,
+		"timestamp":    ts.UnixMicro(),
+	} {
+		if got := first.Get(fields.ByName(protoreflect.Name(name))).Interface(); got != want {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+	if first.Has(fields.ByName("uploader")) {
+		t.Error("uploader set for an event without one, want NULL")
+	}
+	second := decodeTestRow(t, req.schema, req.rows[1])
+	if got := second.Get(second.Descriptor().Fields().ByName("uploader")).String(); got != "u-1" {
+		t.Errorf("uploader = %q, want u-1", got)
+	}
+}
+
+func TestBigQuerySinkRetries(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(req fakeAppend) []byte
+		retried []string // objects appended again by the next flush
+	}{
+		{
+			name: "invalid rows dropped, the others retried",
+			respond: func(req fakeAppend) []byte {
+				return rowErrorsResponse(map[int]string{1: "missing column"})
+			},
+			retried: []string{"a.png", "c.png"},
+		},
+		{
+			name: "failed request retried",
+			respond: func(fakeAppend) []byte {
+				return statusResponse(14, "unavailable")
+			},
+			retried: []string{"a.png", "b.png", "c.png"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			sink, fake := testBigQuerySink(t, func(req fakeAppend) []byte {
+				calls++
+				if calls == 1 {
+					return tt.respond(req)
+				}
+				return nil
+			})
+			defer sink.Close()
+
+			for _, object := range []string{"a.png", "b.png", "c.png"} {
+				if err := sink.Publish(context.Background(), AssetEvent{Type: "upload", Object: object, Timestamp: time.Now()}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := sink.flush(context.Background()); err == nil {
+				t.Fatal("first flush succeeded, want an error")
+			}
+			if err := sink.flush(context.Background()); err != nil {
+				t.Fatalf("second flush: %v", err)
+			}
+
+			if len(fake.requests) != 2 {
+				t.Fatalf("got %d requests, want 2", len(fake.requests))
+			}
+			var retried []string
+			for _, row := range fake.requests[1].rows {
+				msg := decodeTestRow(t, fake.requests[1].schema, row)
+				retried = append(retried, msg.Get(msg.Descriptor().Fields().ByName("object")).String())
+			}
+			if strings.Join(retried, ",") != strings.Join(tt.retried, ",") {
+				t.Errorf("retried %v, want %v", retried, tt.retried)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// How requests to non-canonical paths such as //upload or /upload/ are handled
+const (
+	CanonicalRewrite  = "rewrite"  // serve the canonical path as if it had been requested
+	CanonicalRedirect = "redirect" // answer 308 with the canonical path, which keeps the method and body
+	CanonicalOff      = "off"      // leave paths alone: ServeMux answers 301 to unclean paths, 404 to trailing slashes
+)
+
+// parseCanonicalMode validates CANONICAL_PATHS
+func parseCanonicalMode(mode string) (string, error) {
+	switch mode {
+	case CanonicalRewrite, CanonicalRedirect, CanonicalOff:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown mode %q (allowed: %s, %s, %s)", mode, CanonicalRewrite, CanonicalRedirect, CanonicalOff)
+}
+
+// canonicalPath collapses repeated slashes and dot segments of a request
+// path, and drops a trailing slash when routes serves the path without it
+// as a route of its own (/upload/ is /upload, but /upload/tus/ stays, as
+// /upload/tus would be an object named tus). Under subtree and {name...}
+// routes, the rest of the path is an object name (or upload ID) that only
+// the route prefix before it is cleaned in; a path whose name would change,
+// as with /objects/a/../b, is returned unchanged rather than serving b.
+func canonicalPath(r *http.Request, routes *http.ServeMux) string {
+	cleaned := path.Clean(r.URL.Path)
+	if cleaned == r.URL.Path || cleaned == "/" {
+		return cleaned
+	}
+
+	probe := r.Clone(r.Context())
+	probe.URL.Path = cleaned
+	_, pattern := routes.Handler(probe)
+	// Patterns are "[METHOD ][HOST]/path"
+	if i := strings.Index(pattern, "/"); i >= 0 {
+		pattern = pattern[i:]
+	}
+	prefix := objectNamePrefix(pattern)
+	if strings.HasSuffix(r.URL.Path, "/") && (pattern == "" || prefix != "") {
+		// The path without the slash would be served as something else
+		cleaned += "/"
+	}
+	if prefix == "" {
+		return cleaned
+	}
+
+	// cleaned has no empty or dot segments, so the name follows as many
+	// slashes as the prefix has
+	name := cleaned
+	for range strings.Count(prefix, "/") {
+		_, name, _ = strings.Cut(name, "/")
+	}
+	routePart, ok := strings.CutSuffix(r.URL.Path, name)
+	if !ok || !samePathSegments(routePart, prefix) {
+		return r.URL.Path
+	}
+	return cleaned
+}
+
+// objectNamePrefix returns the path of a subtree or {name...} pattern up to
+// the name it serves, or "" for other patterns and the root
+func objectNamePrefix(pattern string) string {
+	if strings.HasSuffix(pattern, "...}") {
+		pattern = pattern[:strings.LastIndex(pattern, "/")+1]
+	}
+	if !strings.HasSuffix(pattern, "/") || pattern == "/" {
+		return ""
+	}
+	return pattern
+}
+
+// samePathSegments reports whether p has the segments of pattern, apart from
+// empty and "." ones; a {wildcard} segment matches any segment
+func samePathSegments(p, pattern string) bool {
+	segments := func(s string) []string {
+		var out []string
+		for _, segment := range strings.Split(s, "/") {
+			if segment != "" && segment != "." {
+				out = append(out, segment)
+			}
+		}
+		return out
+	}
+	got, want := segments(p), segments(pattern)
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range want {
+		if got[i] != want[i] && (!strings.HasPrefix(want[i], "{") || got[i] == "..") {
+			return false
+		}
+	}
+	return true
+}
+
+// CanonicalPathMiddleware makes clients that add duplicate or trailing
+// slashes, as some frameworks do, reach the route they meant instead of an
+// opaque 404 or a 301 that turns their POST into a GET. Paths with escaped
+// characters (RawPath set, e.g. %2F in an object name) are left alone.
+func CanonicalPathMiddleware(mode string, routes *http.ServeMux) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if mode == CanonicalOff {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.RawPath != "" || r.Method == http.MethodConnect || !strings.HasPrefix(r.URL.Path, "/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			canonical := canonicalPath(r, routes)
+			if canonical == r.URL.Path {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			pathCanonicalizedTotal.WithLabelValues(mode).Inc()
+			if mode == CanonicalRedirect {
+				location := canonical
+				if r.URL.RawQuery != "" {
+					location += "?" + r.URL.RawQuery
+				}
+				http.Redirect(w, r, location, http.StatusPermanentRedirect)
+				return
+			}
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = canonical
+			r2.RequestURI = r2.URL.RequestURI()
+			next.ServeHTTP(w, r2)
+		})
+	}
+}
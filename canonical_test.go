@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testCanonicalRoutes() *http.ServeMux {
+	routes := http.NewServeMux()
+	noop := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	routes.Handle("/upload", noop)
+	routes.Handle("/upload/tus/", noop)
+	routes.Handle("GET /objects/{name...}", noop)
+	routes.Handle("/buckets/{bucket}/objects/{name...}", noop)
+	routes.Handle("/health", noop)
+	return routes
+}
+
+func TestParseCanonicalMode(t *testing.T) {
+	for _, mode := range []string{CanonicalRewrite, CanonicalRedirect, CanonicalOff} {
+		if got, err := parseCanonicalMode(mode); got != mode || err != nil {
+			t.Errorf("parseCanonicalMode(%q) = %q, %v", mode, got, err)
+		}
+	}
+	if _, err := parseCanonicalMode("Rewrite"); err == nil {
+		t.Error("parseCanonicalMode accepted an unknown mode")
+	}
+}
+
+func TestCanonicalPath(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{http.MethodPost, "/upload", "/upload"},
+		{http.MethodPost, "//upload", "/upload"},
+		{http.MethodPost, "/upload/", "/upload"},
+		{http.MethodPost, "/./upload", "/upload"},
+		{http.MethodPost, "/x/../upload//", "/upload"},
+		{http.MethodPost, "/upload/tus/", "/upload/tus/"},
+		{http.MethodPost, "/upload//tus/", "/upload/tus/"},
+		{http.MethodGet, "/objects/a/", "/objects/a/"}, // {name...} serves a/ and a as different objects
+		{http.MethodGet, "//objects/a.jpg", "/objects/a.jpg"},
+		{http.MethodGet, "/objects/./a.jpg", "/objects/a.jpg"},
+		{http.MethodGet, "/objects/a//b.jpg", "/objects/a//b.jpg"}, // object names are left alone
+		{http.MethodGet, "/objects/a/../b.jpg", "/objects/a/../b.jpg"},
+		{http.MethodGet, "/x/../objects/b.jpg", "/x/../objects/b.jpg"},
+		{http.MethodDelete, "//buckets/b/objects/a.jpg", "/buckets/b/objects/a.jpg"},
+		{http.MethodDelete, "/buckets/b/objects/a/./b.jpg", "/buckets/b/objects/a/./b.jpg"},
+		{http.MethodDelete, "/buckets/a/../b/objects/c.jpg", "/buckets/a/../b/objects/c.jpg"},
+		{http.MethodGet, "/health/", "/health"},
+		{http.MethodGet, "/unknown/", "/unknown/"},
+		{http.MethodGet, "/", "/"},
+		{http.MethodGet, "//", "/"},
+	}
+	routes := testCanonicalRoutes()
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/", nil)
+		req.URL.Path = tt.path
+		if got := canonicalPath(req, routes); got != tt.want {
+			t.Errorf("canonicalPath(%s %s) = %q, want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+// serveCanonical runs a request through the middleware and returns the
+// response and the path the next handler saw ("" when it wasn't called)
+func serveCanonical(mode, path, rawQuery string) (*httptest.ResponseRecorder, string) {
+	var seen string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.URL.Path
+		if r.RequestURI != r.URL.RequestURI() {
+			seen = "mismatched RequestURI " + r.RequestURI
+		}
+	})
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.URL.Path, req.URL.RawQuery = path, rawQuery
+	req.RequestURI = req.URL.RequestURI()
+	rec := httptest.NewRecorder()
+	CanonicalPathMiddleware(mode, testCanonicalRoutes())(next).ServeHTTP(rec, req)
+	return rec, seen
+}
+
+func TestCanonicalPathMiddleware(t *testing.T) {
+	if _, seen := serveCanonical(CanonicalRewrite, "//upload/", "a=1"); seen != "/upload" {
+		t.Errorf("rewrite: next saw %q, want /upload", seen)
+	}
+
+	rec, seen := serveCanonical(CanonicalRedirect, "//upload/", "a=1")
+	if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != "/upload?a=1" || seen != "" {
+		t.Errorf("redirect: status %d, Location %q, next saw %q", rec.Code, rec.Header().Get("Location"), seen)
+	}
+
+	if _, seen := serveCanonical(CanonicalOff, "//upload/", ""); seen != "//upload/" {
+		t.Errorf("off: next saw %q, want //upload/", seen)
+	}
+
+	// Paths whose object name would change reach the next handler as sent
+	for _, mode := range []string{CanonicalRewrite, CanonicalRedirect} {
+		if rec, seen := serveCanonical(mode, "/buckets/b/objects/a/../b.jpg", ""); rec.Code != http.StatusOK || seen != "/buckets/b/objects/a/../b.jpg" {
+			t.Errorf("%s: object path got status %d, next saw %q", mode, rec.Code, seen)
+		}
+	}
+
+	// Canonical paths pass through in every mode
+	for _, mode := range []string{CanonicalRewrite, CanonicalRedirect} {
+		if rec, seen := serveCanonical(mode, "/upload", ""); rec.Code != http.StatusOK || seen != "/upload" {
+			t.Errorf("%s: canonical path got status %d, next saw %q", mode, rec.Code, seen)
+		}
+	}
+}
+
+func TestCanonicalPathMiddlewareEscapedPath(t *testing.T) {
+	var seen string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.URL.EscapedPath()
+	})
+	req := httptest.NewRequest(http.MethodGet, "/objects//a%2F..%2Fb/", nil)
+	CanonicalPathMiddleware(CanonicalRewrite, testCanonicalRoutes())(next).ServeHTTP(httptest.NewRecorder(), req)
+	if seen != "/objects//a%2F..%2Fb/" {
+		t.Errorf("next saw %q, want the escaped path unchanged", seen)
+	}
+}
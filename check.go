@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// CheckResult is the outcome of one self-test check
+type CheckResult struct {
+	Name     string  `json:"name"`
+	OK       bool    `json:"ok"`
+	Detail   string  `json:"detail,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"durationMs"`
+}
+
+// errCheckSkipped marks a check that doesn't apply to the configuration
+var errCheckSkipped = errors.New("skipped")
+
+// selfTest runs the startup checks of `gcb check` and collects their results
+type selfTest struct {
+	ctx     context.Context
+	timeout time.Duration
+	results []CheckResult
+}
+
+// run records the outcome of fn under name; fn returns a detail on success.
+// Skipped checks are left out of the report.
+func (t *selfTest) run(name string, fn func(ctx context.Context) (string, error)) bool {
+	ctx, cancel := context.WithTimeout(t.ctx, t.timeout)
+	defer cancel()
+
+	start := time.Now()
+	detail, err := fn(ctx)
+	if errors.Is(err, errCheckSkipped) {
+		return true
+	}
+	result := CheckResult{
+		Name:     name,
+		OK:       err == nil,
+		Detail:   detail,
+		Duration: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	t.results = append(t.results, result)
+	return result.OK
+}
+
+func (t *selfTest) failed() int {
+	failed := 0
+	for _, result := range t.results {
+		if !result.OK {
+			failed++
+		}
+	}
+	return failed
+}
+
+// runCheckCommand implements the `check` CLI subcommand: it validates the
+// configuration and everything the server depends on, without serving, so a
+// broken rollout fails in an init container instead of on the first request
+func runCheckCommand(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	timeout := flags.Duration("timeout", 15*time.Second, "timeout of each check")
+	jsonOutput := flags.Bool("json", false, "print the report as JSON")
+	skipSigning := flags.Bool("skip-signing", false, "don't generate and verify signed URLs")
+	flags.Parse(args)
+
+	config := LoadConfig()
+	t := &selfTest{ctx: context.Background(), timeout: *timeout}
+
+	checkConfig(t, config)
+	credentialsOK := checkCredentials(t, config)
+	if credentialsOK {
+		checkBuckets(t, config, !*skipSigning)
+	}
+	checkSigners(t, config)
+	checkEndpoints(t, config)
+
+	failed := t.failed()
+	if *jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(map[string]any{
+			"success": failed == 0,
+			"failed":  failed,
+			"checks":  t.results,
+		})
+	} else {
+		for _, result := range t.results {
+			if result.OK {
+				fmt.Printf("✅ %-32s %s (%.0fms)\n", result.Name, result.Detail, result.Duration)
+			} else {
+				fmt.Printf("❌ %-32s %s (%.0fms)\n", result.Name, result.Error, result.Duration)
+			}
+		}
+		if failed > 0 {
+			fmt.Printf("\n%d of %d checks failed\n", failed, len(t.results))
+		} else {
+			fmt.Printf("\nAll %d checks passed\n", len(t.results))
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// checkConfig validates the settings and config files the server refuses to start without
+func checkConfig(t *selfTest, config *Config) {
+	t.run("config: settings", func(context.Context) (string, error) {
+		problems := config.Validate()
+		if len(problems) == 0 {
+			return fmt.Sprintf("%s (%s), %s (%s)", config.BucketName1, config.StorageDriver1, config.BucketName2, config.StorageDriver2), nil
+		}
+		// Warnings fail the check too: a rollout shouldn't depend on a default replacing a typo
+		lines := make([]string, len(problems))
+		for i, problem := range problems {
+			lines[i] = problem.String()
+		}
+		return "", errors.New(strings.Join(lines, "; "))
+	})
+	t.run("config: CORS rules", func(context.Context) (string, error) {
+		if _, err := LoadBucketCORSConfig(config.CORSConfigPath); err != nil {
+			return "", err
+		}
+		return "loaded", nil
+	})
+	t.run("config: bucket settings", func(context.Context) (string, error) {
+		if _, err := LoadBucketSettings(config.BucketSettingsPath); err != nil {
+			return "", err
+		}
+		return "loaded", nil
+	})
+	t.run("config: feature flags", func(context.Context) (string, error) {
+		if _, err := LoadFeatureFlags(config.FeatureFlags, config.FlagsPath); err != nil {
+			return "", err
+		}
+		return "loaded", nil
+	})
+	t.run("config: pipelines", func(context.Context) (string, error) {
+		if _, err := LoadPipelines(config.PipelinePath); err != nil {
+			return "", err
+		}
+		return "loaded", nil
+	})
+	t.run("config: origin policies", func(context.Context) (string, error) {
+		policies, err := LoadOriginPolicies(config.OriginPolicyPath)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d origin(s)", len(policies)), nil
+	})
+	t.run("config: metrics push", func(context.Context) (string, error) {
+		if config.MetricsPush.URL == "" {
+			return "", errCheckSkipped
+		}
+		if _, err := NewMetricsPusher(config.MetricsPush); err != nil {
+			return "", err
+		}
+		return "valid", nil
+	})
+	t.run("config: exec hook", func(context.Context) (string, error) {
+		if len(config.Hook.Command) == 0 {
+			return "", errCheckSkipped
+		}
+		if _, err := NewExecHook(config.Hook); err != nil {
+			return "", err
+		}
+		return config.Hook.Command[0], nil
+	})
+}
+
+// checkCredentials verifies the Google credentials can be loaded
+func checkCredentials(t *selfTest, config *Config) bool {
+	return t.run("credentials", func(context.Context) (string, error) {
+		if !usesDriver(config, "gcs") && !config.BigQuery.Enabled() && config.CloudTasks.Queue == "" {
+			return "", errCheckSkipped
+		}
+		switch {
+		case config.ServiceAccountPath1 != "":
+			if _, err := os.Stat(config.ServiceAccountPath1); err != nil {
+				return "", fmt.Errorf("service account file: %w", err)
+			}
+			return "service account key " + config.ServiceAccountPath1, nil
+		case workloadIdentity.Enabled():
+			if _, err := workloadIdentity.credentialsJSON(); err != nil {
+				return "", err
+			}
+			return "workload identity federation, token " + workloadIdentity.TokenPath, nil
+		}
+		return "Application Default Credentials", nil
+	})
+}
+
+// checkBuckets opens every configured bucket, checks that it exists and is
+// readable, and optionally that signed URLs it generates are accepted
+func checkBuckets(t *selfTest, config *Config, signing bool) {
+	buckets := []BucketConfig{
+		{
+			Name:            config.BucketName1,
+			Driver:          config.StorageDriver1,
+			CredentialsPath: config.ServiceAccountPath1,
+			PublicBaseURL:   config.PublicBaseURL1,
+			Mirror:          secondaryBucket(config.MirrorDriver1, config.MirrorBucketName1, config.ServiceAccountPath1, config.PublicBaseURL1),
+			Failover:        secondaryBucket(config.FailoverDriver1, config.FailoverBucketName1, config.ServiceAccountPath1, config.PublicBaseURL1),
+		},
+		{
+			Name:            config.BucketName2,
+			Driver:          config.StorageDriver2,
+			CredentialsPath: config.ServiceAccountPath1,
+			PublicBaseURL:   config.PublicBaseURL2,
+			Mirror:          secondaryBucket(config.MirrorDriver2, config.MirrorBucketName2, config.ServiceAccountPath1, config.PublicBaseURL2),
+			Failover:        secondaryBucket(config.FailoverDriver2, config.FailoverBucketName2, config.ServiceAccountPath1, config.PublicBaseURL2),
+		},
+	}
+	if config.Quarantine.Bucket != "" {
+		buckets = append(buckets, BucketConfig{
+			Name:            config.Quarantine.Bucket,
+			Driver:          config.Quarantine.Driver,
+			CredentialsPath: config.ServiceAccountPath1,
+		})
+	}
+
+	for i, bucket := range buckets {
+		if bucket.Name == "" {
+			continue
+		}
+		var backend Backend
+		ok := t.run("bucket "+bucket.Name, func(ctx context.Context) (string, error) {
+			var err error
+			backend, err = NewBackend(ctx, config, bucket)
+			if err != nil {
+				return "", err
+			}
+			detail, err := checkBackendAccess(ctx, backend)
+			if err != nil {
+				return "", explainAccessError(bucket.Name, credentialIdentity(config.ServiceAccountPath1), err)
+			}
+			return detail, nil
+		})
+		if !ok {
+			if backend != nil {
+				backend.Close()
+			}
+			continue
+		}
+		// Only the served buckets hand out signed URLs, not the quarantine bucket
+		if signing && i < 2 && bucket.Driver != "fs" {
+			t.run("signing "+bucket.Name, func(ctx context.Context) (string, error) {
+				return checkSignedURL(ctx, backend)
+			})
+		}
+		backend.Close()
+	}
+}
+
+// checkSignedURL generates a signed URL for an object that doesn't exist and
+// requests it: the storage service answers 404 when it accepts the signature
+// and 403 when it doesn't, so nothing is written to the bucket
+func checkSignedURL(ctx context.Context, backend Backend) (string, error) {
+	token := make([]byte, 8)
+	rand.Read(token)
+	name := "__check__/" + hex.EncodeToString(token)
+
+	signed, err := backend.SignedURL(http.MethodGet, name, SignOptions{Expires: time.Minute})
+	if err != nil {
+		return "", fmt.Errorf("failed to sign URL: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, signed, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request signed URL: %w", err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return "signed URL accepted", nil
+	case http.StatusForbidden, http.StatusUnauthorized:
+		return "", fmt.Errorf("signed URL rejected with %s", resp.Status)
+	default:
+		return "", fmt.Errorf("unexpected response to signed URL: %s", resp.Status)
+	}
+}
+
+// checkSigners signs and verifies a sample with the HMAC keys of download URLs and receipts
+func checkSigners(t *selfTest, config *Config) {
+	t.run("download signing", func(context.Context) (string, error) {
+		signer := NewDownloadSigner(config.DownloadSigning)
+		if signer == nil {
+			return "", errCheckSkipped
+		}
+		signed, err := url.Parse(signer.URL(config.BucketName1, "/images/", "__check__", time.Now().Add(time.Minute)))
+		if err != nil {
+			return "", err
+		}
+		if err := signer.Verify(config.BucketName1, "__check__", signed.Query()); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d key(s)", len(config.DownloadSigning.Keys)), nil
+	})
+	t.run("upload receipts", func(context.Context) (string, error) {
+		signer := NewReceiptSigner(config.Receipts)
+		if signer == nil {
+			return "", errCheckSkipped
+		}
+		receipt, err := signer.Sign(AssetRecord{Bucket: config.BucketName1, Name: "__check__", CreatedAt: time.Now()})
+		if err != nil {
+			return "", err
+		}
+		if _, err := signer.Verify(receipt); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d key(s)", len(config.Receipts.Keys)), nil
+	})
+}
+
+// checkEndpoints checks that the webhooks and services events are sent to can
+// be reached. Nothing is posted, so no notification goes out.
+func checkEndpoints(t *selfTest, config *Config) {
+	t.run("notification webhook", func(ctx context.Context) (string, error) {
+		if config.Notify.WebhookURL == "" {
+			return "", errCheckSkipped
+		}
+		return checkReachable(ctx, config.Notify.WebhookURL)
+	})
+	t.run("scanner", func(ctx context.Context) (string, error) {
+		if config.Quarantine.ScanURL == "" {
+			return "", errCheckSkipped
+		}
+		return checkReachable(ctx, config.Quarantine.ScanURL)
+	})
+	t.run("pushgateway", func(ctx context.Context) (string, error) {
+		if config.MetricsPush.URL == "" {
+			return "", errCheckSkipped
+		}
+		return checkReachable(ctx, config.MetricsPush.URL)
+	})
+	t.run("SMTP server", func(ctx context.Context) (string, error) {
+		if !config.SMTP.Enabled() {
+			return "", errCheckSkipped
+		}
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(config.SMTP.Host, config.SMTP.Port))
+		if err != nil {
+			return "", err
+		}
+		conn.Close()
+		return "connected", nil
+	})
+}
+
+// checkReachable sends a GET to an endpoint. Any answer short of a server
+// error counts, except 404 and 410, which is how deleted webhooks answer.
+func checkReachable(ctx context.Context, endpoint string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// Don't echo the URL, webhook URLs hold their credentials
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return "", fmt.Errorf("unreachable: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return "", fmt.Errorf("answered %s", resp.Status)
+	}
+	return "reachable (" + resp.Status + ")", nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	cloudtasks "google.golang.org/api/cloudtasks/v2"
+)
+
+const taskTokenHeader = "X-Task-Token"
+
+// CloudTasksDeferrer enqueues asset events to a Cloud Tasks queue instead of
+// processing them in-process. Each sink gets a task of its own that calls
+// back into the internal task endpoint with ?sink=; a failing sink is retried
+// by the queue without running the others again.
+type CloudTasksDeferrer struct {
+	service *cloudtasks.Service
+	cfg     CloudTasksConfig
+}
+
+// NewCloudTasksDeferrer creates a deferrer for the configured queue
+func NewCloudTasksDeferrer(ctx context.Context, cfg CloudTasksConfig, credentialsPath string) (*CloudTasksDeferrer, error) {
+	opts, err := clientOptions(credentialsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Cloud Tasks client: %w", err)
+	}
+	service, err := cloudtasks.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Cloud Tasks client: %w", err)
+	}
+	return &CloudTasksDeferrer{service: service, cfg: cfg}, nil
+}
+
+// Enqueue creates an HTTP task that delivers the event to one sink through
+// the task endpoint
+func (d *CloudTasksDeferrer) Enqueue(ctx context.Context, event AssetEvent, sink string) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	target, err := url.Parse(d.cfg.TargetURL)
+	if err != nil {
+		return fmt.Errorf("invalid task target URL: %w", err)
+	}
+	query := target.Query()
+	query.Set("sink", sink)
+	target.RawQuery = query.Encode()
+
+	request := &cloudtasks.HttpRequest{
+		HttpMethod: http.MethodPost,
+		Url:        target.String(),
+		Body:       base64.StdEncoding.EncodeToString(body),
+		Headers: map[string]string{
+			"Content-Type":  "application/json",
+			taskTokenHeader: d.cfg.Token,
+		},
+	}
+	if d.cfg.ServiceAccountEmail != "" {
+		request.OidcToken = &cloudtasks.OidcToken{ServiceAccountEmail: d.cfg.ServiceAccountEmail}
+	}
+
+	_, err = d.service.Projects.Locations.Queues.Tasks.Create(d.cfg.Queue, &cloudtasks.CreateTaskRequest{
+		Task: &cloudtasks.Task{HttpRequest: request},
+	}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to create %s task in %s: %w", sink, d.cfg.Queue, err)
+	}
+	return nil
+}
+
+// HandleTaskEvent processes an asset event delivered by Cloud Tasks for the
+// sink named by ?sink=, or for every sink when the task names none. It
+// returns 500 when the sink fails so the queue retries the task.
+func HandleTaskEvent(bus *EventBus, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "Method not allowed. Use POST.",
+			})
+			return
+		}
+
+		if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(taskTokenHeader)), []byte(token)) != 1 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var event AssetEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			// A malformed task will never succeed, so acknowledge it to stop retries
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "Invalid event body, dropping task",
+			})
+			return
+		}
+
+		var sinks []string
+		if sink := r.URL.Query().Get("sink"); sink != "" {
+			if !bus.HasSink(sink) {
+				// The sink has been disabled since, retries can't succeed
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   "Unknown sink, dropping task",
+				})
+				return
+			}
+			sinks = []string{sink}
+		}
+		if err := bus.DeliverTo(r.Context(), event, sinks); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Failed to process event: %v", err),
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: true,
+			Message: "Event processed",
+		})
+	}
+}
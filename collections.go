@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Collection visibilities
+const (
+	VisibilityPublic  = "public"  // uploads return their public URL
+	VisibilityPrivate = "private" // uploads are read through signed download URLs only
+)
+
+// collectionNamePattern restricts collection names to URL-safe slugs
+var collectionNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Collection is a named folder of a bucket with its own upload settings.
+// Uploads go to /collections/{name}/upload.
+type Collection struct {
+	Name         string   `json:"name"`
+	Bucket       string   `json:"bucket"`                 // one of the served buckets
+	Prefix       string   `json:"prefix,omitempty"`       // folder objects are stored under, e.g. "products/2024"
+	AllowedTypes []string `json:"allowedTypes,omitempty"` // content types, empty allows every image type
+	MaxSizeMB    int64    `json:"maxSizeMB,omitempty"`    // 0 uses MAX_FILE_SIZE_MB, which it can't exceed
+	Profile      string   `json:"profile,omitempty"`      // processing profile of the pipeline config
+	Visibility   string   `json:"visibility,omitempty"`   // public (the default) or private
+	BuiltIn      bool     `json:"builtIn,omitempty"`      // one of the bucket collections, prod and dev
+}
+
+// The methods below are safe on a nil collection, which stands for the
+// plain upload endpoints
+
+// maxSize returns the upload size limit of the collection in bytes
+func (c *Collection) maxSize(fallback int64) int64 {
+	if c == nil || c.MaxSizeMB == 0 {
+		return fallback
+	}
+	return min(c.MaxSizeMB*1024*1024, fallback)
+}
+
+// checkType rejects files whose type the collection doesn't allow
+func (c *Collection) checkType(filename string) error {
+	if c == nil || len(c.AllowedTypes) == 0 {
+		return nil
+	}
+	contentType := getContentType(strings.ToLower(filepath.Ext(filename)))
+	if !slices.Contains(c.AllowedTypes, contentType) {
+		return fmt.Errorf("File type %s is not allowed in collection %s. Allowed: %s", contentType, c.Name, strings.Join(c.AllowedTypes, ", "))
+	}
+	return nil
+}
+
+// prefix returns the object prefix of the collection with a trailing slash
+func (c *Collection) prefix() string {
+	if c == nil || c.Prefix == "" {
+		return ""
+	}
+	return strings.Trim(c.Prefix, "/") + "/"
+}
+
+// profile returns the processing profile of the collection
+func (c *Collection) profile() string {
+	if c == nil {
+		return ""
+	}
+	return c.Profile
+}
+
+// private reports whether the collection's objects are private
+func (c *Collection) private() bool {
+	return c != nil && c.Visibility == VisibilityPrivate
+}
+
+// Collections holds the collections defined in COLLECTIONS_FILE and through
+// the admin API, on top of the built-in prod and dev collections of the two
+// served buckets. Changes are written back to the file.
+type Collections struct {
+	path     string
+	backends map[string]Backend
+	builtIn  map[string]Collection
+
+	mu    sync.RWMutex
+	items map[string]Collection
+}
+
+// LoadCollections reads the collections file, a JSON object of collections
+// by name, e.g.
+//
+//	{"banners": {"bucket": "my-images", "prefix": "banners", "allowedTypes": ["image/jpeg", "image/webp"], "maxSizeMB": 2, "profile": "banner"}}
+//
+// A missing file is created on the first change. builtIn collections are
+// served unless the file defines one of the same name.
+func LoadCollections(path string, backends map[string]Backend, builtIn []Collection) (*Collections, error) {
+	c := &Collections{path: path, backends: backends, builtIn: map[string]Collection{}, items: map[string]Collection{}}
+	for _, collection := range builtIn {
+		collection.BuiltIn = true
+		c.builtIn[collection.Name] = collection
+	}
+	if path == "" {
+		return c, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read collections: %w", err)
+	}
+	var items map[string]Collection
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, fmt.Errorf("failed to parse collections %s: %w", path, err)
+	}
+	for name, collection := range items {
+		collection.Name = name
+		if err := c.validate(&collection); err != nil {
+			return nil, fmt.Errorf("collection %s: %w", name, err)
+		}
+		c.items[name] = collection
+	}
+	return c, nil
+}
+
+// validate checks a collection and normalizes its prefix and visibility
+func (c *Collections) validate(collection *Collection) error {
+	if !collectionNamePattern.MatchString(collection.Name) {
+		return fmt.Errorf("invalid name %q: use lowercase letters, digits, '-' or '_'", collection.Name)
+	}
+	if _, ok := c.backends[collection.Bucket]; !ok {
+		return fmt.Errorf("bucket %q is not a served bucket", collection.Bucket)
+	}
+	prefix, err := cleanObjectPrefix(collection.Prefix)
+	if err != nil {
+		return err
+	}
+	collection.Prefix = strings.TrimSuffix(prefix, "/")
+	for _, contentType := range collection.AllowedTypes {
+		if !isImageContentType(contentType) {
+			return fmt.Errorf("allowedTypes: %q is not an accepted image type", contentType)
+		}
+	}
+	if collection.MaxSizeMB < 0 {
+		return fmt.Errorf("maxSizeMB must not be negative")
+	}
+	if collection.Profile != "" && !processingPipelines.HasProfile(collection.Profile) {
+		return fmt.Errorf("profile %q is not defined in the pipeline config", collection.Profile)
+	}
+	switch collection.Visibility {
+	case "":
+		collection.Visibility = VisibilityPublic
+	case VisibilityPublic, VisibilityPrivate:
+	default:
+		return fmt.Errorf("visibility must be %s or %s", VisibilityPublic, VisibilityPrivate)
+	}
+	collection.BuiltIn = false
+	return nil
+}
+
+// isImageContentType reports whether contentType is one of the types uploads are stored with
+func isImageContentType(contentType string) bool {
+	for _, ext := range []string{".jpg", ".png", ".gif", ".webp", ".bmp", ".svg"} {
+		if getContentType(ext) == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns a collection by name
+func (c *Collections) Get(name string) (Collection, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if collection, ok := c.items[name]; ok {
+		return collection, true
+	}
+	collection, ok := c.builtIn[name]
+	return collection, ok
+}
+
+// List returns every collection in name order
+func (c *Collections) List() []Collection {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	list := make([]Collection, 0, len(c.items)+len(c.builtIn))
+	for _, collection := range c.items {
+		list = append(list, collection)
+	}
+	for name, collection := range c.builtIn {
+		if _, overridden := c.items[name]; !overridden {
+			list = append(list, collection)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Put creates or replaces a collection and saves the file
+func (c *Collections) Put(collection Collection) (Collection, error) {
+	if err := c.validate(&collection); err != nil {
+		return Collection{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous, existed := c.items[collection.Name]
+	c.items[collection.Name] = collection
+	if err := c.save(); err != nil {
+		if existed {
+			c.items[collection.Name] = previous
+		} else {
+			delete(c.items, collection.Name)
+		}
+		return Collection{}, err
+	}
+	log.Printf("🗂️  Collection %s saved (bucket %s, prefix %q)", collection.Name, collection.Bucket, collection.Prefix)
+	return collection, nil
+}
+
+// Delete removes a collection and saves the file. A built-in collection it
+// overrode is served again; built-in collections themselves can't be deleted.
+func (c *Collections) Delete(name string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous, ok := c.items[name]
+	if !ok {
+		return false, nil
+	}
+	delete(c.items, name)
+	if err := c.save(); err != nil {
+		c.items[name] = previous
+		return true, err
+	}
+	log.Printf("🗂️  Collection %s deleted", name)
+	return true, nil
+}
+
+// save writes the collections atomically; callers hold c.mu
+func (c *Collections) save() error {
+	if c.path == "" {
+		return fmt.Errorf("set COLLECTIONS_FILE to manage collections")
+	}
+	data, err := json.MarshalIndent(c.items, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create collections directory: %w", err)
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write collections: %w", err)
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// CollectionsResponse is returned by /admin/collections
+type CollectionsResponse struct {
+	Success     bool         `json:"success"`
+	Collections []Collection `json:"collections,omitempty"`
+	Collection  *Collection  `json:"collection,omitempty"`
+	Error       string       `json:"error,omitempty"`
+}
+
+// HandleCollections serves the collection admin API:
+//
+//   - GET /admin/collections lists the collections
+//   - GET /admin/collections/{name} returns one
+//   - PUT /admin/collections/{name} creates or replaces one from a JSON body
+//   - DELETE /admin/collections/{name} deletes one
+func HandleCollections(collections *Collections) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/collections"), "/")
+		if name == "" {
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				json.NewEncoder(w).Encode(CollectionsResponse{
+					Success: false,
+					Error:   "Method not allowed. Use GET.",
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(CollectionsResponse{Success: true, Collections: collections.List()})
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			collection, ok := collections.Get(name)
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(CollectionsResponse{
+					Success: false,
+					Error:   "Collection not found",
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(CollectionsResponse{Success: true, Collection: &collection})
+
+		case http.MethodPut:
+			var collection Collection
+			if err := decodeJSONBody(w, r, &collection, 0); err != nil {
+				w.WriteHeader(err.Status)
+				json.NewEncoder(w).Encode(CollectionsResponse{
+					Success: false,
+					Error:   err.Message,
+				})
+				return
+			}
+			collection.Name = name
+			collection, err := collections.Put(collection)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(CollectionsResponse{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(CollectionsResponse{Success: true, Collection: &collection})
+
+		case http.MethodDelete:
+			deleted, err := collections.Delete(name)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(CollectionsResponse{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+			if !deleted {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(CollectionsResponse{
+					Success: false,
+					Error:   "Collection not found or built in",
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(CollectionsResponse{Success: true})
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(CollectionsResponse{
+				Success: false,
+				Error:   "Method not allowed. Use GET, PUT or DELETE.",
+			})
+		}
+	}
+}
+
+// HandleCollectionUpload serves POST /collections/{name}/upload, a multipart
+// upload with the settings of the collection. Origin policies are checked
+// against the collection's bucket.
+func HandleCollectionUpload(collections *Collections, config *Config, policies OriginPolicies) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		collection, found := collections.Get(r.PathValue("name"))
+		if !found {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "Collection not found. Use /collections/{name}/upload",
+			})
+			return
+		}
+
+		backend := collections.backends[collection.Bucket]
+		policies.Require(collection.Bucket, OpUpload)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveUpload(w, r, backend, config, &collection)
+		})).ServeHTTP(w, r)
+	}
+}
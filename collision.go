@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Collision policies, deciding what an upload does when its object name is taken
+const (
+	CollisionSuffix    = "suffix"    // store as name-2.png, name-3.png, ...
+	CollisionReject    = "reject"    // fail with 409 Conflict
+	CollisionOverwrite = "overwrite" // replace the existing object
+)
+
+// maxCollisionSuffix bounds the names tried by the suffix policy
+const maxCollisionSuffix = 100
+
+// rewinder is implemented by upload content that can be read again from the
+// start, for another write after losing its name, see writeFreeObjectName
+type rewinder interface {
+	Rewind() error
+}
+
+// parseCollisionPolicy validates a policy name; empty selects fallback
+func parseCollisionPolicy(policy, fallback string) (string, error) {
+	switch policy {
+	case "":
+		return fallback, nil
+	case CollisionSuffix, CollisionReject, CollisionOverwrite:
+		return policy, nil
+	}
+	return "", fmt.Errorf("Invalid collision policy %q. Allowed: suffix, reject, overwrite", policy)
+}
+
+// freeObjectName returns name, or the first of name-2, name-3, ... (before
+// the extension) that doesn't exist. The upload still has to be made with
+// IfNotExists, as another replica may take the name in between; it then
+// fails with ErrObjectExists rather than overwriting, see writeFreeObjectName.
+func freeObjectName(ctx context.Context, backend Backend, name string) (string, error) {
+	free, _, err := freeObjectNameFrom(ctx, backend, name, 1)
+	return free, err
+}
+
+// freeObjectNameFrom is freeObjectName starting at suffix from, 1 being the
+// name itself. It also returns the suffix of the name found.
+func freeObjectNameFrom(ctx context.Context, backend Backend, name string, from int) (string, int, error) {
+	for n := from; n <= maxCollisionSuffix; n++ {
+		candidate := suffixedName(name, n)
+		_, err := backend.Stat(ctx, candidate)
+		if errors.Is(err, ErrObjectNotFound) {
+			return candidate, n, nil
+		}
+		if err != nil {
+			return "", 0, err
+		}
+	}
+	return "", 0, ErrObjectExists
+}
+
+// suffixedName inserts -n before the extension of name, n < 2 being name itself
+func suffixedName(name string, n int) string {
+	if n < 2 {
+		return name
+	}
+	base, ext := name, ""
+	if dot := strings.LastIndex(name, "."); dot > strings.LastIndex(name, "/") {
+		base, ext = name[:dot], name[dot:]
+	}
+	return fmt.Sprintf("%s-%d%s", base, n, ext)
+}
+
+// writeFreeObjectName writes an object under the name freeObjectName picks.
+// write must create it with IfNotExists: when another replica takes the name
+// first and the write fails with ErrObjectExists, rewind prepares the content
+// for another attempt under the next free name, up to maxCollisionSuffix.
+// Content that can't be read again (rewind nil or failing) gets the
+// ErrObjectExists.
+func writeFreeObjectName(ctx context.Context, backend Backend, name string, write func(name string) (*ObjectInfo, error), rewind func() error) (string, *ObjectInfo, error) {
+	for n := 1; ; n++ {
+		candidate, found, err := freeObjectNameFrom(ctx, backend, name, n)
+		if err != nil {
+			return "", nil, err
+		}
+		info, err := write(candidate)
+		if !errors.Is(err, ErrObjectExists) || rewind == nil {
+			return candidate, info, err
+		}
+		if rewindErr := rewind(); rewindErr != nil {
+			return "", nil, err
+		}
+		n = found
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// racingBackend stores another object under each name just before the
+// first races writes to it, as a replica that won the name would
+type racingBackend struct {
+	*mockBackend
+	races int
+}
+
+func (b *racingBackend) Put(ctx context.Context, name string, r io.Reader, opts PutOptions) (*ObjectInfo, error) {
+	if b.races > 0 {
+		b.races--
+		b.mockBackend.Put(ctx, name, strings.NewReader("other"), PutOptions{})
+	}
+	return b.mockBackend.Put(ctx, name, r, opts)
+}
+
+func TestSuffixedName(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		want string
+	}{
+		{"cat.png", 1, "cat.png"},
+		{"cat.png", 2, "cat-2.png"},
+		{"a.b/cat", 3, "a.b/cat-3"},
+		{"a/cat.tar.gz", 10, "a/cat.tar-10.gz"},
+	}
+	for _, tt := range tests {
+		if got := suffixedName(tt.name, tt.n); got != tt.want {
+			t.Errorf("suffixedName(%q, %d) = %q, want %q", tt.name, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestFreeObjectName(t *testing.T) {
+	backend := newMockBackend()
+	ctx := context.Background()
+	for _, name := range []string{"cat.png", "cat-2.png"} {
+		backend.Put(ctx, name, strings.NewReader("x"), PutOptions{})
+	}
+	if got, err := freeObjectName(ctx, backend, "cat.png"); got != "cat-3.png" || err != nil {
+		t.Errorf("freeObjectName() = %q, %v, want cat-3.png", got, err)
+	}
+	for n := 3; n <= maxCollisionSuffix; n++ {
+		backend.Put(ctx, suffixedName("cat.png", n), strings.NewReader("x"), PutOptions{})
+	}
+	if _, err := freeObjectName(ctx, backend, "cat.png"); !errors.Is(err, ErrObjectExists) {
+		t.Errorf("freeObjectName() with every suffix taken: %v, want ErrObjectExists", err)
+	}
+}
+
+func TestUploadImageRetriesLostName(t *testing.T) {
+	backend := &racingBackend{mockBackend: newMockBackend(), races: 2}
+	body := newUploadBody(bytes.NewReader([]byte("content")), 100)
+	info, err := UploadImage(context.Background(), backend, body, 7, "", "cat.png", nil, "", CollisionSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(info.Name, "-3.png") || info.Size != 7 {
+		t.Errorf("stored %s (%d bytes), want the third name with all of the content", info.Name, info.Size)
+	}
+	if written := body.limit + 1 - body.limited.N; written != 7 {
+		t.Errorf("%d bytes hashed after retrying, want 7", written)
+	}
+}
+
+func TestUploadImageStreamedLostName(t *testing.T) {
+	backend := &racingBackend{mockBackend: newMockBackend(), races: 1}
+	body := newUploadBody(io.MultiReader(strings.NewReader("content")), 100)
+	if _, err := UploadImage(context.Background(), backend, body, 7, "", "cat.png", nil, "", CollisionSuffix); !errors.Is(err, ErrObjectExists) {
+		t.Errorf("UploadImage() error = %v, want ErrObjectExists", err)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"sort"
+)
+
+// ColorOptions controls color normalization of JPEG and PNG uploads
+type ColorOptions struct {
+	ConvertSRGB bool // convert images with an RGB matrix profile (Display P3, Adobe RGB, ...) to sRGB
+	MaxICCSize  int  // strip embedded profiles larger than this many bytes, 0 to keep them
+	JPEGQuality int  // quality of converted JPEGs
+	MaxPixels   int  // images larger than this are stored unconverted
+}
+
+// maxICCProfileSize bounds a decompressed PNG profile; the ICC header
+// declares sizes far below this for every real profile
+const maxICCProfileSize = 4 << 20
+
+// iccSignature prefixes ICC profile chunks in JPEG APP2 segments
+var iccSignature = []byte("ICC_PROFILE\x00")
+
+// hasColorProfiles reports whether ext is a format whose embedded profiles are handled
+func hasColorProfiles(ext string) bool {
+	return ext == ".jpg" || ext == ".jpeg" || ext == ".png"
+}
+
+// normalizeColor converts an image with an embedded non-sRGB profile to sRGB,
+// or strips profiles that are too large. Images without a profile, and images
+// that can't be converted, are returned as they are.
+func normalizeColor(data []byte, ext string, opts ColorOptions) []byte {
+	if !hasColorProfiles(ext) {
+		return data
+	}
+	profile, stored := findICCProfile(data, ext)
+	if stored == 0 {
+		return data
+	}
+
+	if opts.ConvertSRGB {
+		if transform, ok := parseRGBProfile(profile); ok {
+			if transform.isSRGB() {
+				// An sRGB profile says what browsers assume anyway
+				return stripICCProfile(data, ext)
+			}
+			converted, err := convertToSRGB(data, ext, transform, opts)
+			if err == nil {
+				return converted
+			}
+			log.Printf("⚠️  Failed to convert image to sRGB: %v", err)
+		}
+	}
+
+	if opts.MaxICCSize > 0 && stored > opts.MaxICCSize {
+		log.Printf("🎨 Stripping %d byte ICC profile", stored)
+		return stripICCProfile(data, ext)
+	}
+	return data
+}
+
+// findICCProfile returns the embedded ICC profile and the number of bytes it
+// takes up in the file. PNG profiles are returned decompressed; a profile
+// that doesn't decompress is returned as nil with its stored size.
+func findICCProfile(data []byte, ext string) ([]byte, int) {
+	if ext == ".png" {
+		var profile []byte
+		stored := 0
+		walkPNGChunks(data, func(kind string, chunk, _ []byte) bool {
+			if kind != "iCCP" {
+				return true
+			}
+			stored = len(chunk)
+			// Profile name, null separator, compression method, zlib stream
+			if i := bytes.IndexByte(chunk, 0); i > 0 && i+2 <= len(chunk) {
+				if zr, err := zlib.NewReader(bytes.NewReader(chunk[i+2:])); err == nil {
+					profile, _ = io.ReadAll(io.LimitReader(zr, maxICCProfileSize))
+				}
+			}
+			return false
+		})
+		return profile, stored
+	}
+
+	// JPEG profiles may be split over several APP2 segments, numbered from 1
+	type part struct {
+		seq  byte
+		data []byte
+	}
+	var parts []part
+	stored := 0
+	walkJPEGSegments(data, func(marker byte, payload []byte) {
+		if marker == 0xE2 && bytes.HasPrefix(payload, iccSignature) && len(payload) >= len(iccSignature)+2 {
+			parts = append(parts, part{seq: payload[len(iccSignature)], data: payload[len(iccSignature)+2:]})
+			stored += len(payload)
+		}
+	})
+	sort.Slice(parts, func(i, j int) bool { return parts[i].seq < parts[j].seq })
+	var profile []byte
+	for _, p := range parts {
+		profile = append(profile, p.data...)
+	}
+	return profile, stored
+}
+
+// stripICCProfile removes the embedded profile without touching the image data
+func stripICCProfile(data []byte, ext string) []byte {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	if ext == ".png" {
+		out.Write(data[:8])
+		rest := walkPNGChunks(data, func(kind string, _, raw []byte) bool {
+			if kind != "iCCP" {
+				out.Write(raw)
+			}
+			return true
+		})
+		out.Write(rest)
+		return out.Bytes()
+	}
+
+	out.Write(data[:2])
+	rest := walkJPEGSegments(data, func(marker byte, payload []byte) {
+		if marker == 0xE2 && bytes.HasPrefix(payload, iccSignature) {
+			return
+		}
+		out.Write([]byte{0xFF, marker})
+		binary.Write(out, binary.BigEndian, uint16(len(payload)+2))
+		out.Write(payload)
+	})
+	out.Write(rest)
+	return out.Bytes()
+}
+
+// walkPNGChunks calls fn with the type, data and raw bytes (length, type,
+// data and CRC) of each chunk until fn returns false, and returns the bytes
+// after the last chunk visited
+func walkPNGChunks(data []byte, fn func(kind string, chunk, raw []byte) bool) []byte {
+	pos := min(8, len(data)) // signature
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		if length < 0 || pos+12+length > len(data) {
+			break
+		}
+		kind := string(data[pos+4 : pos+8])
+		next := pos + 12 + length
+		if !fn(kind, data[pos+8:pos+8+length], data[pos:next]) {
+			return data[next:]
+		}
+		pos = next
+	}
+	return data[pos:]
+}
+
+// walkJPEGSegments calls fn with the marker and payload of each segment
+// before the image data, and returns the bytes from the start of scan on
+func walkJPEGSegments(data []byte, fn func(marker byte, payload []byte)) []byte {
+	pos := min(2, len(data)) // SOI
+	for pos+4 <= len(data) && data[pos] == 0xFF {
+		marker := data[pos+1]
+		if marker == 0xDA || marker == 0xD9 { // start of scan, end of image
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		if length < 2 || pos+2+length > len(data) {
+			break
+		}
+		fn(marker, data[pos+4:pos+2+length])
+		pos += 2 + length
+	}
+	return data[pos:]
+}
+
+// srgbToXYZ is the sRGB primaries matrix adapted to the D50 white point of
+// the ICC profile connection space
+var srgbToXYZ = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// rgbProfile is a matrix/TRC RGB profile: per-channel tone curves to linear
+// light followed by a matrix to XYZ. Display P3, Adobe RGB, ProPhoto and the
+// common sRGB profiles all have this shape.
+type rgbProfile struct {
+	toXYZ  [3][3]float64
+	curves [3]func(float64) float64
+}
+
+// parseRGBProfile reads the colorants and tone curves of a matrix/TRC RGB
+// profile. LUT-based, CMYK and grayscale profiles are not supported.
+func parseRGBProfile(profile []byte) (*rgbProfile, bool) {
+	if len(profile) < 132 || string(profile[16:20]) != "RGB " || string(profile[20:24]) != "XYZ " {
+		return nil, false
+	}
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(profile[128:132]))
+	for i := 0; i < count && 132+12*(i+1) <= len(profile); i++ {
+		entry := profile[132+12*i:]
+		offset, size := int(binary.BigEndian.Uint32(entry[4:8])), int(binary.BigEndian.Uint32(entry[8:12]))
+		if offset < 0 || size < 0 || offset+size > len(profile) {
+			return nil, false
+		}
+		tags[string(entry[0:4])] = profile[offset : offset+size]
+	}
+
+	p := &rgbProfile{}
+	for channel, names := range [3][2]string{{"rXYZ", "rTRC"}, {"gXYZ", "gTRC"}, {"bXYZ", "bTRC"}} {
+		xyz := tags[names[0]]
+		if len(xyz) < 20 || string(xyz[0:4]) != "XYZ " {
+			return nil, false
+		}
+		for row := 0; row < 3; row++ {
+			p.toXYZ[row][channel] = s15Fixed16(xyz[8+4*row:])
+		}
+		curve, ok := parseToneCurve(tags[names[1]])
+		if !ok {
+			return nil, false
+		}
+		p.curves[channel] = curve
+	}
+	return p, true
+}
+
+// parseToneCurve reads a curv or para tag as a function from encoded to linear values
+func parseToneCurve(tag []byte) (func(float64) float64, bool) {
+	if len(tag) < 12 {
+		return nil, false
+	}
+	switch string(tag[0:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:12]))
+		switch {
+		case n == 0:
+			return func(x float64) float64 { return x }, true
+		case n == 1 && len(tag) >= 14:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:14])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, true
+		case n > 1 && len(tag) >= 12+2*n:
+			table := make([]float64, n)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+			}
+			return func(x float64) float64 {
+				f := x * float64(n-1)
+				i := min(int(f), n-2)
+				return table[i] + (table[i+1]-table[i])*(f-float64(i))
+			}, true
+		}
+	case "para":
+		counts := map[uint16]int{0: 1, 1: 3, 2: 4, 3: 5, 4: 7}
+		kind := binary.BigEndian.Uint16(tag[8:10])
+		n, ok := counts[kind]
+		if !ok || len(tag) < 12+4*n {
+			return nil, false
+		}
+		var g [7]float64
+		for i := 0; i < n; i++ {
+			g[i] = s15Fixed16(tag[12+4*i:])
+		}
+		return func(x float64) float64 {
+			switch kind {
+			case 0:
+				return math.Pow(x, g[0])
+			case 1:
+				if x >= -g[2]/g[1] {
+					return math.Pow(g[1]*x+g[2], g[0])
+				}
+				return 0
+			case 2:
+				if x >= -g[2]/g[1] {
+					return math.Pow(g[1]*x+g[2], g[0]) + g[3]
+				}
+				return g[3]
+			case 3:
+				if x >= g[4] {
+					return math.Pow(g[1]*x+g[2], g[0])
+				}
+				return g[3] * x
+			default:
+				if x >= g[4] {
+					return math.Pow(g[1]*x+g[2], g[0]) + g[5]
+				}
+				return g[3]*x + g[6]
+			}
+		}, true
+	}
+	return nil, false
+}
+
+// s15Fixed16 decodes an ICC signed 15.16 fixed-point number
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b[0:4]))) / 65536
+}
+
+// srgbDecode converts an sRGB encoded value to linear light
+func srgbDecode(x float64) float64 {
+	if x <= 0.04045 {
+		return x / 12.92
+	}
+	return math.Pow((x+0.055)/1.055, 2.4)
+}
+
+// srgbEncode converts linear light to an sRGB encoded value
+func srgbEncode(x float64) float64 {
+	if x <= 0.0031308 {
+		return 12.92 * x
+	}
+	return 1.055*math.Pow(x, 1/2.4) - 0.055
+}
+
+// isSRGB reports whether the profile describes sRGB, within the precision of
+// the fixed-point numbers profiles are stored in
+func (p *rgbProfile) isSRGB() bool {
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			if math.Abs(p.toXYZ[row][col]-srgbToXYZ[row][col]) > 0.002 {
+				return false
+			}
+		}
+	}
+	for _, curve := range p.curves {
+		for _, x := range []float64{0.1, 0.25, 0.5, 0.75, 0.9} {
+			if math.Abs(curve(x)-srgbDecode(x)) > 0.005 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// convertToSRGB decodes an image, converts its pixels from the profile to
+// sRGB and encodes it again without a profile
+func convertToSRGB(data []byte, ext string, p *rgbProfile, opts ColorOptions) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if opts.MaxPixels > 0 && config.Width*config.Height > opts.MaxPixels {
+		return nil, fmt.Errorf("%dx%d exceeds the limit of %d pixels", config.Width, config.Height, opts.MaxPixels)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := img.ColorModel().(color.Palette); ok || img.ColorModel() == color.GrayModel || img.ColorModel() == color.Gray16Model {
+		// An RGB profile on a gray or paletted image is unusual enough to leave alone
+		return nil, fmt.Errorf("unsupported color model for an RGB profile")
+	}
+
+	// Profile space to sRGB, through XYZ
+	m := multiply3x3(invert3x3(srgbToXYZ), p.toXYZ)
+
+	// Tone curves are tabulated at 12 bits, plenty for 8-bit output
+	const steps = 4096
+	var decode [3][steps]float64
+	var encode [steps]uint16
+	for i := 0; i < steps; i++ {
+		x := float64(i) / (steps - 1)
+		for c := 0; c < 3; c++ {
+			decode[c][i] = p.curves[c](x)
+		}
+		encode[i] = uint16(math.Round(srgbEncode(x) * 0xffff))
+	}
+
+	// Keep 8-bit images 8-bit, so converted PNGs don't double in size
+	bounds := img.Bounds()
+	var out draw.Image = image.NewNRGBA(bounds)
+	if model := img.ColorModel(); model == color.RGBA64Model || model == color.NRGBA64Model {
+		out = image.NewNRGBA64(bounds)
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			px := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			in := [3]float64{
+				decode[0][px.R>>4],
+				decode[1][px.G>>4],
+				decode[2][px.B>>4],
+			}
+			var rgb [3]uint16
+			for c := 0; c < 3; c++ {
+				linear := m[c][0]*in[0] + m[c][1]*in[1] + m[c][2]*in[2]
+				rgb[c] = encode[int(math.Round(math.Max(0, math.Min(1, linear))*(steps-1)))]
+			}
+			out.Set(x, y, color.NRGBA64{R: rgb[0], G: rgb[1], B: rgb[2], A: px.A})
+		}
+	}
+
+	var buf bytes.Buffer
+	if ext == ".png" {
+		err = png.Encode(&buf, out)
+	} else {
+		err = jpeg.Encode(&buf, out, &jpeg.Options{Quality: opts.JPEGQuality})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// multiply3x3 returns a×b
+func multiply3x3(a, b [3][3]float64) [3][3]float64 {
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return m
+}
+
+// invert3x3 returns the inverse of a non-singular matrix
+func invert3x3(a [3][3]float64) [3][3]float64 {
+	det := a[0][0]*(a[1][1]*a[2][2]-a[1][2]*a[2][1]) -
+		a[0][1]*(a[1][0]*a[2][2]-a[1][2]*a[2][0]) +
+		a[0][2]*(a[1][0]*a[2][1]-a[1][1]*a[2][0])
+	return [3][3]float64{
+		{(a[1][1]*a[2][2] - a[1][2]*a[2][1]) / det, (a[0][2]*a[2][1] - a[0][1]*a[2][2]) / det, (a[0][1]*a[1][2] - a[0][2]*a[1][1]) / det},
+		{(a[1][2]*a[2][0] - a[1][0]*a[2][2]) / det, (a[0][0]*a[2][2] - a[0][2]*a[2][0]) / det, (a[0][2]*a[1][0] - a[0][0]*a[1][2]) / det},
+		{(a[1][0]*a[2][1] - a[1][1]*a[2][0]) / det, (a[0][1]*a[2][0] - a[0][0]*a[2][1]) / det, (a[0][0]*a[1][1] - a[0][1]*a[1][0]) / det},
+	}
+}
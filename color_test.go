@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"testing"
+)
+
+// testICCTag is one tag of a test profile
+type testICCTag struct {
+	sig  string
+	data []byte
+}
+
+// testRGBProfile builds a matrix/TRC RGB profile with the given colorants
+// (columns of toXYZ) and one tone curve for all channels
+func testRGBProfile(toXYZ [3][3]float64, curve []byte) []byte {
+	fixed := func(v float64) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(int32(math.Round(v*65536))))
+	}
+	var tags []testICCTag
+	for channel, name := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz := []byte("XYZ \x00\x00\x00\x00")
+		for row := range 3 {
+			xyz = append(xyz, fixed(toXYZ[row][channel])...)
+		}
+		tags = append(tags, testICCTag{name, xyz})
+	}
+	for _, name := range []string{"rTRC", "gTRC", "bTRC"} {
+		tags = append(tags, testICCTag{name, curve})
+	}
+
+	profile := make([]byte, 128)
+	copy(profile[16:], "RGB ")
+	copy(profile[20:], "XYZ ")
+	profile = binary.BigEndian.AppendUint32(profile, uint32(len(tags)))
+	offset := len(profile) + 12*len(tags)
+	var data []byte
+	for _, tag := range tags {
+		profile = append(profile, tag.sig...)
+		profile = binary.BigEndian.AppendUint32(profile, uint32(offset+len(data)))
+		profile = binary.BigEndian.AppendUint32(profile, uint32(len(tag.data)))
+		data = append(data, tag.data...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+	}
+	profile = append(profile, data...)
+	binary.BigEndian.PutUint32(profile[0:], uint32(len(profile)))
+	return profile
+}
+
+// srgbParaCurve is the sRGB tone curve as a parametric curve of type 3
+func srgbParaCurve() []byte {
+	curve := []byte("para\x00\x00\x00\x00\x00\x03\x00\x00")
+	for _, v := range []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+		curve = binary.BigEndian.AppendUint32(curve, uint32(int32(math.Round(v*65536))))
+	}
+	return curve
+}
+
+// gammaCurve is a curv tag with a single gamma value
+func gammaCurve(gamma float64) []byte {
+	curve := []byte("curv\x00\x00\x00\x00\x00\x00\x00\x01")
+	return binary.BigEndian.AppendUint16(curve, uint16(gamma*256))
+}
+
+// displayP3ToXYZ are the D50-adapted Display P3 colorants
+var displayP3ToXYZ = [3][3]float64{
+	{0.5151, 0.2920, 0.1571},
+	{0.2412, 0.6922, 0.0666},
+	{-0.0011, 0.0419, 0.7841},
+}
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for x := range 16 {
+		for y := range 8 {
+			img.Set(x, y, color.RGBA{uint8(x * 16), uint8(y * 32), 128, 255})
+		}
+	}
+	return img
+}
+
+// testJPEGWithProfile encodes a JPEG with the profile split over APP2
+// segments of at most chunk bytes, written in reverse order
+func testJPEGWithProfile(t *testing.T, profile []byte, chunk int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	var parts [][]byte
+	for len(profile) > 0 {
+		n := min(chunk, len(profile))
+		parts = append(parts, profile[:n])
+		profile = profile[n:]
+	}
+	out := bytes.Clone(encoded[:2])
+	for i := len(parts) - 1; i >= 0; i-- {
+		payload := append(bytes.Clone(iccSignature), byte(i+1), byte(len(parts)))
+		payload = append(payload, parts[i]...)
+		out = append(out, 0xFF, 0xE2)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(payload)+2))
+		out = append(out, payload...)
+	}
+	return append(out, encoded[2:]...)
+}
+
+// testPNGWithProfile encodes a PNG with an iCCP chunk after IHDR
+func testPNGWithProfile(t *testing.T, profile []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(profile)
+	zw.Close()
+	chunk := append([]byte("iCCPtest\x00\x00"), compressed.Bytes()...)
+	raw := binary.BigEndian.AppendUint32(nil, uint32(len(chunk)-4))
+	raw = append(raw, chunk...)
+	raw = binary.BigEndian.AppendUint32(raw, crc32.ChecksumIEEE(chunk))
+
+	ihdrEnd := 8 + 12 + 13
+	out := bytes.Clone(encoded[:ihdrEnd])
+	out = append(out, raw...)
+	return append(out, encoded[ihdrEnd:]...)
+}
+
+func TestFindICCProfile(t *testing.T) {
+	profile := testRGBProfile(displayP3ToXYZ, gammaCurve(2.2))
+
+	found, stored := findICCProfile(testJPEGWithProfile(t, profile, 100), ".jpg")
+	if !bytes.Equal(found, profile) || stored == 0 {
+		t.Errorf("JPEG: profile of %d bytes (stored %d), want %d bytes", len(found), stored, len(profile))
+	}
+	found, stored = findICCProfile(testPNGWithProfile(t, profile), ".png")
+	if !bytes.Equal(found, profile) || stored == 0 {
+		t.Errorf("PNG: profile of %d bytes (stored %d), want %d bytes", len(found), stored, len(profile))
+	}
+}
+
+func TestStripICCProfile(t *testing.T) {
+	profile := testRGBProfile(displayP3ToXYZ, gammaCurve(2.2))
+	for ext, data := range map[string][]byte{
+		".jpg": testJPEGWithProfile(t, profile, 100),
+		".png": testPNGWithProfile(t, profile),
+	} {
+		stripped := stripICCProfile(data, ext)
+		if _, stored := findICCProfile(stripped, ext); stored != 0 {
+			t.Errorf("%s: %d profile bytes left", ext, stored)
+		}
+		if _, _, err := image.Decode(bytes.NewReader(stripped)); err != nil {
+			t.Errorf("%s: stripped image doesn't decode: %v", ext, err)
+		}
+	}
+}
+
+func TestParseRGBProfile(t *testing.T) {
+	srgb, ok := parseRGBProfile(testRGBProfile(srgbToXYZ, srgbParaCurve()))
+	if !ok || !srgb.isSRGB() {
+		t.Errorf("sRGB profile: ok %v, isSRGB %v", ok, ok && srgb.isSRGB())
+	}
+	p3, ok := parseRGBProfile(testRGBProfile(displayP3ToXYZ, srgbParaCurve()))
+	if !ok || p3.isSRGB() {
+		t.Errorf("Display P3 profile: ok %v, isSRGB %v", ok, ok && p3.isSRGB())
+	}
+	gamma, ok := parseRGBProfile(testRGBProfile(srgbToXYZ, gammaCurve(1.8)))
+	if !ok || gamma.isSRGB() {
+		t.Errorf("gamma 1.8 profile: ok %v, isSRGB %v", ok, ok && gamma.isSRGB())
+	}
+}
+
+func TestParseRGBProfileTruncated(t *testing.T) {
+	profile := testRGBProfile(displayP3ToXYZ, gammaCurve(2.2))
+	// The last tag ends 2 bytes before the padded end of the profile
+	for n := range len(profile) - 2 {
+		if _, ok := parseRGBProfile(profile[:n]); ok {
+			t.Errorf("%d of %d bytes parsed", n, len(profile))
+		}
+	}
+}
+
+func TestParseRGBProfileMalformed(t *testing.T) {
+	profile := testRGBProfile(displayP3ToXYZ, gammaCurve(2.2))
+	tests := map[string]func(p []byte){
+		"tag offset past end": func(p []byte) { binary.BigEndian.PutUint32(p[132+4:], 1<<31) },
+		"tag size past end":   func(p []byte) { binary.BigEndian.PutUint32(p[132+8:], 1<<32-1) },
+		"huge tag count":      func(p []byte) { binary.BigEndian.PutUint32(p[128:], 1<<32-1); copy(p[132:], "xxxx") },
+		"CMYK":                func(p []byte) { copy(p[16:], "CMYK") },
+		"Lab PCS":             func(p []byte) { copy(p[20:], "Lab ") },
+	}
+	for name, corrupt := range tests {
+		p := bytes.Clone(profile)
+		corrupt(p)
+		if _, ok := parseRGBProfile(p); ok {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+}
+
+func TestParseToneCurveMalformed(t *testing.T) {
+	curvTable := func(n uint32, entries int) []byte {
+		tag := binary.BigEndian.AppendUint32([]byte("curv\x00\x00\x00\x00"), n)
+		return append(tag, make([]byte, 2*entries)...)
+	}
+	para := func(kind uint16, params int) []byte {
+		tag := binary.BigEndian.AppendUint16([]byte("para\x00\x00\x00\x00"), kind)
+		return append(tag, make([]byte, 2+4*params)...)
+	}
+	tests := map[string][]byte{
+		"empty":               nil,
+		"short":               []byte("curv\x00\x00"),
+		"unknown type":        []byte("sf32\x00\x00\x00\x00\x00\x00\x00\x00"),
+		"gamma cut off":       curvTable(1, 0),
+		"table cut off":       curvTable(256, 255),
+		"huge table":          curvTable(1<<32-1, 4),
+		"unknown para":        para(5, 7),
+		"para params cut off": para(4, 6),
+	}
+	for name, tag := range tests {
+		if _, ok := parseToneCurve(tag); ok {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+
+	// Degenerate parameters must not panic when the curve is evaluated
+	for kind := range uint16(5) {
+		if curve, ok := parseToneCurve(para(kind, 7)); ok {
+			for _, x := range []float64{0, 0.5, 1} {
+				curve(x)
+			}
+		}
+	}
+}
+
+func TestNormalizeColorTruncated(t *testing.T) {
+	profile := testRGBProfile(displayP3ToXYZ, gammaCurve(2.2))
+	opts := ColorOptions{ConvertSRGB: true, MaxICCSize: 16, JPEGQuality: 90, MaxPixels: 1 << 20}
+	for ext, data := range map[string][]byte{
+		".jpg": testJPEGWithProfile(t, profile, 64),
+		".png": testPNGWithProfile(t, profile),
+	} {
+		for n := range len(data) {
+			normalizeColor(data[:n], ext, opts)
+		}
+	}
+}
+
+func TestNormalizeColorConvertsToSRGB(t *testing.T) {
+	profile := testRGBProfile(displayP3ToXYZ, srgbParaCurve())
+	opts := ColorOptions{ConvertSRGB: true, JPEGQuality: 90, MaxPixels: 1 << 20}
+	for ext, data := range map[string][]byte{
+		".jpg": testJPEGWithProfile(t, profile, 1000),
+		".png": testPNGWithProfile(t, profile),
+	} {
+		converted := normalizeColor(data, ext, opts)
+		if _, stored := findICCProfile(converted, ext); stored != 0 {
+			t.Errorf("%s: converted image still has a profile", ext)
+		}
+		if _, _, err := image.Decode(bytes.NewReader(converted)); err != nil {
+			t.Errorf("%s: converted image doesn't decode: %v", ext, err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// CompressionConfig holds the settings for response compression
+type CompressionConfig struct {
+	MinSize int      // smaller responses are sent as-is; 0 disables compression
+	Types   []string // media types that are compressed, e.g. application/json
+}
+
+// CompressionMiddleware gzip- or deflate-compresses responses of the allowed
+// types once they reach MinSize bytes. Images and archives are already
+// compressed and pass through untouched.
+func CompressionMiddleware(cfg CompressionConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if cfg.MinSize <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{
+				ResponseWriter: w,
+				cfg:            cfg,
+				encoding:       negotiateEncoding(r.Header.Get("Accept-Encoding")),
+				status:         http.StatusOK,
+			}
+			defer cw.Close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header,
+// preferring gzip on equal quality, or "" when neither is acceptable
+func negotiateEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "*" {
+			name = "gzip"
+		}
+		if name != "gzip" && name != "deflate" {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > bestQ || (q == bestQ && q > 0 && name == "gzip") {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// compressWriter buffers the start of a response until it knows whether the
+// response is worth compressing: the type is allowed and at least MinSize
+// bytes are written (or the handler flushes)
+type compressWriter struct {
+	http.ResponseWriter
+	cfg      CompressionConfig
+	encoding string // negotiated encoding, "" when the client accepts none
+
+	status  int
+	buf     []byte
+	decided bool
+	encoder io.WriteCloser // nil when the response is sent as-is
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.decided || code < http.StatusOK {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	cw.status = code
+	if code == http.StatusNoContent || code == http.StatusNotModified {
+		cw.decide()
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.decided {
+		cw.buf = append(cw.buf, p...)
+		if len(cw.buf) < cw.cfg.MinSize {
+			return len(p), nil
+		}
+		if err := cw.decide(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush sends what has been written so far, compressed if the type allows,
+// for handlers that stream progress
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.cfg.MinSize = 0
+		cw.decide()
+	}
+	if flusher, ok := cw.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// Close sends a response that stayed below MinSize and finishes the
+// compressed stream
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if err := cw.decide(); err != nil {
+			return err
+		}
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Close()
+	}
+	return nil
+}
+
+// decide writes the header, compressed or not, and the buffered body
+func (cw *compressWriter) decide() error {
+	cw.decided = true
+	header := cw.Header()
+
+	if cw.compressible(header.Get("Content-Type")) {
+		// Caches must not serve a compressed response to clients that can't read it
+		header.Add("Vary", "Accept-Encoding")
+		if cw.encoding != "" && header.Get("Content-Encoding") == "" && len(cw.buf) >= cw.cfg.MinSize &&
+			cw.status != http.StatusNoContent && cw.status != http.StatusNotModified && cw.status != http.StatusPartialContent {
+			header.Set("Content-Encoding", cw.encoding)
+			header.Del("Content-Length")
+			if cw.encoding == "gzip" {
+				cw.encoder = gzip.NewWriter(cw.ResponseWriter)
+			} else {
+				cw.encoder = zlib.NewWriter(cw.ResponseWriter)
+			}
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if cw.encoder != nil {
+		_, err := cw.encoder.Write(buf)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+// compressible reports whether the content type is on the allowlist
+func (cw *compressWriter) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return slices.Contains(cw.cfg.Types, mediaType)
+}
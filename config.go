@@ -5,6 +5,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -19,8 +20,237 @@ type Config struct {
 	MaxFileSize         int64 // in bytes
 	APIKey1              string
 	APIKey2             string
+	ReadAPIKey          string // accepted on read-only routes besides APIKey1
+	AdminAPIKey         string
 	AllowedIPs          []string
+	TrustedProxies      []string // networks whose client IP headers are believed for abuse bans
 	AllowedOrigins      []string
+	CORSConfigPath      string
+	OriginPolicyPath    string
+	RoutePolicyPath     string
+	BucketSettingsPath  string
+	BucketReconcile     time.Duration
+	BucketLabels        []string // labels of both buckets, such as "team=web"
+	BucketLabels1       []string // labels of bucket 1 only, such as "env=prod"
+	BucketLabels2       []string
+	FeatureFlags        []string // defaults such as "transcoding=false"
+	FlagsPath           string
+	PipelinePath        string
+	CollectionsPath     string
+	StorageDriver1      string
+	StorageDriver2      string
+	SigningAccount1     string // service account impersonated to sign URLs of bucket 1
+	SigningAccount2     string
+	PublicBaseURL1      string
+	PublicBaseURL2      string
+	CDNBaseURLs1        []string // CDN or custom domain URLs bucket 1 is also served under, for DELETE /objects?url=
+	CDNBaseURLs2        []string
+	MirrorDriver1       string
+	MirrorBucketName1   string
+	MirrorDriver2       string
+	MirrorBucketName2   string
+	MirrorQueueDir      string
+	FailoverDriver1     string
+	FailoverBucketName1 string
+	FailoverDriver2     string
+	FailoverBucketName2 string
+	Failover            FailoverConfig
+	CheckpointDir       string
+	StatsCacheTTL       time.Duration
+	ArchiveMaxSize      int64 // in bytes
+	ArchiveMaxObjects   int
+	ImportMaxSize       int64 // in bytes
+	MetadataPath        string
+	OperationLogPath    string // append-only history of catalog changes and events, "" disables it
+	EventSpoolDir       string
+	EventDrainTimeout   time.Duration
+	UsageMaxOrigins     int // origins labeled in upload metrics besides the configured ones
+	SignedURLCacheSize  int
+	SignedURLMinValid   time.Duration
+	SignedURLBatchMax   int
+	UploadBatchMax      int // files per batch upload
+	SignedURLContentTypes []string // content types that may be signed into upload URLs
+	SignedURLAuditPath  string // journal of issued signed URLs, "" disables the audit trail
+	SignedURLAuditMax   int
+	R2                  R2Config
+	FS                  FSConfig
+	GCSUpload           GCSUploadConfig
+	BigQuery            BigQueryConfig
+	Notify              NotifyConfig
+	Report              ReportConfig
+	Bandwidth           BandwidthConfig
+	SMTP                SMTPConfig
+	CloudTasks          CloudTasksConfig
+	Hook                HookConfig
+	OIDC                OIDCConfig
+	Compression         CompressionConfig
+	MetricsAuth         MetricsAuthConfig
+	TenantMetrics       TenantMetricsConfig
+	MetricsPush         MetricsPushConfig
+	UploadForm          UploadFormConfig
+	Quarantine          QuarantineConfig
+	Staging             StagingConfig
+	Tus                 TusConfig
+	Inbox               InboxConfig
+	EmailIn             EmailInConfig
+	ReprocessWorkers    int // objects a reprocessing job works on at once
+	Inventory           InventoryConfig
+	CustomerKey         CustomerKeyConfig
+	IPPrivacy           IPPrivacyConfig
+	Paranoid            bool // re-encode raster uploads before storing them
+	PerceptualHash      bool // hash uploads for near-duplicate search
+	PHashMaxPixels      int  // larger images aren't hashed, as decoding them takes width*height*4 bytes or more
+	Reencode            ReencodeOptions
+	Animation           AnimationLimits
+	Color               ColorOptions
+	AutoOrient          bool // rotate JPEGs upright according to their EXIF orientation
+	CollisionPolicy     string
+	ASCIIObjectNames    bool // transliterate object names to ASCII
+	Dedupe              bool // answer uploads of already stored content with the existing asset
+	Orient              OrientOptions
+	DownloadSigning     DownloadSigningConfig
+	Hotlink             HotlinkConfig
+	MissingPlaceholder  MissingPlaceholderConfig
+	Receipts            ReceiptConfig
+	Abuse               AbuseConfig
+	HealthCheckInterval time.Duration
+	StartupCheck        StartupCheckConfig
+	Verify              VerifyConfig
+	Serverless          bool // Cloud Run mode: ADC only, no bucket changes, events delivered within requests
+	WorkloadIdentity    WorkloadIdentityConfig
+	Server              ServerLimits
+	LoadShed            LoadShedConfig
+	UploadMemory        UploadMemoryConfig
+	CanonicalPaths      string // rewrite, redirect or off for //upload and /upload/
+
+	envProblems []ConfigProblem // values that didn't parse, replaced by their defaults
+}
+
+// R2Config holds the settings for the Cloudflare R2 / S3-compatible driver
+type R2Config struct {
+	AccountID       string
+	AccessKeyID     string
+	SecretAccessKey string
+	Endpoint        string // overrides the R2 endpoint, e.g. for MinIO or AWS S3
+	Jurisdiction    string // "eu" or "fedramp" for jurisdiction-restricted buckets
+	Region          string
+	PublicBaseURL   string // custom domain or r2.dev URL used for public links
+}
+
+// BigQueryConfig holds the destination table for exported asset events
+type BigQueryConfig struct {
+	Project string
+	Dataset string
+	Table   string
+}
+
+// Enabled reports whether a destination table is configured
+func (c BigQueryConfig) Enabled() bool {
+	return c.Project != "" && c.Dataset != "" && c.Table != ""
+}
+
+// NotifyConfig holds the Slack/Discord webhook notification settings
+type NotifyConfig struct {
+	WebhookURL           string
+	Events               []string
+	AuthFailureThreshold int
+	AuthFailureWindow    time.Duration
+	QuotaBytes           int64         // bucket size that triggers a quota notification, 0 for none
+	QuotaObjects         int64         // object count that triggers a quota notification, 0 for none
+	QuotaInterval        time.Duration // how often bucket statistics are computed for the quota
+}
+
+// SMTPConfig holds the email alerting settings
+type SMTPConfig struct {
+	Host               string
+	Port               string
+	Username           string
+	Password           string
+	From               string
+	To                 []string
+	ReadinessAfter     time.Duration // alert when unready for longer than this
+	ErrorRateThreshold float64       // alert when the 5xx ratio reaches this (0-1)
+	MinRequests        int           // minimum requests in the window before the error rate counts
+}
+
+// Enabled reports whether a mail server and recipients are configured
+func (c SMTPConfig) Enabled() bool {
+	return c.Host != "" && len(c.To) > 0
+}
+
+// CloudTasksConfig holds the settings for deferring event processing to Cloud Tasks
+type CloudTasksConfig struct {
+	Queue               string // projects/PROJECT/locations/LOCATION/queues/QUEUE
+	TargetURL           string // public URL of /internal/tasks/events on this service
+	Token               string // shared secret sent with every task
+	ServiceAccountEmail string // optional, adds an OIDC token to each task
+}
+
+// DownloadSigningConfig holds the settings for signed download proxy URLs
+type DownloadSigningConfig struct {
+	Keys     []string      // HMAC keys, the first one signs; older keys still verify
+	MaxTTL   time.Duration // longest validity a signed URL may be requested with
+	Required bool          // reject unsigned download requests
+	BaseURL  string        // prefix for returned URLs, e.g. https://images.example.com
+}
+
+// ReceiptConfig holds the settings for signed upload receipts
+type ReceiptConfig struct {
+	Keys   []string // HMAC keys shared with verifying services, the first one signs
+	Issuer string   // iss claim of the receipts
+}
+
+// AbuseConfig holds the abuse detection settings
+type AbuseConfig struct {
+	Threshold     int           // strikes within Window that ban an IP, 0 disables abuse detection
+	Window        time.Duration
+	BanDuration   time.Duration
+	TarpitDelay   time.Duration // how long requests from banned IPs are held before being dropped
+	HoneypotPaths []string
+}
+
+// OIDCConfig holds the OpenID Connect settings for admin logins
+type OIDCConfig struct {
+	Issuer         string // e.g. https://accounts.google.com or https://login.microsoftonline.com/TENANT/v2.0
+	ClientID       string
+	ClientSecret   string
+	RedirectURL    string // public URL of /auth/callback on this service
+	Scopes         []string
+	GroupsClaim    string   // ID token claim holding group memberships
+	AllowedGroups  []string // groups allowed to log in
+	AllowedDomains []string // email / Google Workspace domains allowed to log in
+	SessionSecret  string   // HMAC key for session cookies
+	SessionTTL     time.Duration
+}
+
+// Enabled reports whether an issuer is configured
+func (c OIDCConfig) Enabled() bool {
+	return c.Issuer != ""
+}
+
+// QuarantineConfig holds the quarantine and content scanning settings
+type QuarantineConfig struct {
+	Prefix      string // prefix quarantined objects are moved under
+	Bucket      string // dedicated quarantine bucket, empty to quarantine objects in their own bucket
+	Driver      string // storage driver of the dedicated bucket
+	ScanURL     string // scanner endpoint uploads are POSTed to, empty disables scanning
+	ScanToken   string // bearer token sent to the scanner
+	ScanMaxSize int64  // larger uploads aren't scanned, in bytes; 0 scans everything
+}
+
+// FSConfig holds the settings for the local filesystem driver
+type FSConfig struct {
+	Root  string
+	Fsync bool // fsync files and directories after every write
+}
+
+// GCSUploadConfig holds how the GCS driver writes objects
+type GCSUploadConfig struct {
+	// ResumableThreshold is the size from which uploads use a resumable
+	// session, in bytes; smaller uploads are sent in one request
+	ResumableThreshold int64
+	ChunkSize          int           // bytes per resumable chunk, a multiple of 256 KiB
+	ChunkRetryDeadline time.Duration // how long a failing chunk is retried
 }
 
 // LoadConfig loads configuration from environment variables with defaults
@@ -30,8 +260,9 @@ func LoadConfig() *Config {
 		log.Println("No .env file found, using environment variables or defaults")
 	}
 
-	maxFileSizeInt, _ := strconv.Atoi(getEnv("MAX_FILE_SIZE_MB", "10"))
-	maxFileSize := int64(maxFileSizeInt)
+	envProblems = nil
+
+	maxFileSize := int64(getEnvInt("MAX_FILE_SIZE_MB", 10))
 	
 	// Parse comma-separated IPs
 	allowedIPsStr := getEnv("ALLOWED_IPS", "")
@@ -59,13 +290,368 @@ func LoadConfig() *Config {
 		MaxFileSize:        maxFileSize * 1024 * 1024,
 		APIKey1:            getEnv("GCS_API_KEY_1", ""),
 		APIKey2:            getEnv("GCS_API_KEY_2", ""),
+		ReadAPIKey:         getEnv("GCS_READ_API_KEY", ""),
+		AdminAPIKey:        getEnv("ADMIN_API_KEY", ""),
 		AllowedIPs:         allowedIPs,
+		TrustedProxies:     getEnvList("TRUSTED_PROXIES", defaultTrustedProxies),
 		AllowedOrigins:     allowedOrigins,
+		CORSConfigPath:     getEnv("CORS_CONFIG_FILE", ""),
+		OriginPolicyPath:   getEnv("ORIGIN_POLICY_FILE", ""),
+		RoutePolicyPath:    getEnv("ROUTE_POLICY_FILE", ""),
+		BucketSettingsPath: getEnv("BUCKET_SETTINGS_FILE", ""),
+		BucketReconcile:    getEnvDuration("BUCKET_RECONCILE_INTERVAL", 10*time.Minute),
+		BucketLabels:       getEnvList("BUCKET_LABELS", ""),
+		BucketLabels1:      getEnvList("BUCKET_LABELS_1", ""),
+		BucketLabels2:      getEnvList("BUCKET_LABELS_2", ""),
+		FeatureFlags:       getEnvList("FEATURE_FLAGS", ""),
+		FlagsPath:          getEnv("FLAGS_FILE", ""),
+		PipelinePath:       getEnv("PIPELINE_FILE", ""),
+		CollectionsPath:    getEnv("COLLECTIONS_FILE", "./data/collections.json"),
+		StorageDriver1:     getEnv("STORAGE_DRIVER_1", "gcs"),
+		StorageDriver2:     getEnv("STORAGE_DRIVER_2", "gcs"),
+		SigningAccount1:    getEnv("GCS_SIGNING_SERVICE_ACCOUNT_1", ""),
+		SigningAccount2:    getEnv("GCS_SIGNING_SERVICE_ACCOUNT_2", ""),
+		PublicBaseURL1:     getEnv("PUBLIC_BASE_URL_1", "/images"),
+		PublicBaseURL2:     getEnv("PUBLIC_BASE_URL_2", "/images-dev"),
+		CDNBaseURLs1:       getEnvList("CDN_BASE_URLS_1", ""),
+		CDNBaseURLs2:       getEnvList("CDN_BASE_URLS_2", ""),
+		MirrorDriver1:      getEnv("MIRROR_DRIVER_1", ""),
+		MirrorBucketName1:  getEnv("MIRROR_BUCKET_NAME_1", ""),
+		MirrorDriver2:      getEnv("MIRROR_DRIVER_2", ""),
+		MirrorBucketName2:  getEnv("MIRROR_BUCKET_NAME_2", ""),
+		MirrorQueueDir:     getEnv("MIRROR_QUEUE_DIR", "./data/mirror-queue"),
+		FailoverDriver1:     getEnv("FAILOVER_DRIVER_1", getEnv("STORAGE_DRIVER_1", "gcs")),
+		FailoverBucketName1: getEnv("FAILOVER_BUCKET_NAME_1", ""),
+		FailoverDriver2:     getEnv("FAILOVER_DRIVER_2", getEnv("STORAGE_DRIVER_2", "gcs")),
+		FailoverBucketName2: getEnv("FAILOVER_BUCKET_NAME_2", ""),
+		Failover: FailoverConfig{
+			Threshold:         getEnvInt("FAILOVER_THRESHOLD", 5),
+			Cooldown:          getEnvDuration("FAILOVER_COOLDOWN", 30*time.Second),
+			ReconcileInterval: getEnvDuration("FAILOVER_RECONCILE_INTERVAL", time.Minute),
+		},
+		CheckpointDir:      getEnv("MIGRATION_CHECKPOINT_DIR", "./data/migrations"),
+		StatsCacheTTL:      getEnvDuration("STATS_CACHE_TTL", 5*time.Minute),
+		ArchiveMaxSize:     int64(getEnvInt("ARCHIVE_MAX_SIZE_MB", 500)) * 1024 * 1024,
+		ArchiveMaxObjects:  getEnvInt("ARCHIVE_MAX_OBJECTS", 1000),
+		ImportMaxSize:      int64(getEnvInt("IMPORT_MAX_SIZE_MB", 1024)) * 1024 * 1024,
+		MetadataPath:       getEnv("METADATA_PATH", "./data/metadata.jsonl"),
+		OperationLogPath:   getEnv("OPERATION_LOG_PATH", "./data/operations.jsonl"),
+		EventSpoolDir:      getEnv("EVENT_SPOOL_DIR", "./data/event-spool"),
+		EventDrainTimeout:  getEnvDuration("EVENT_DRAIN_TIMEOUT", defaultDrainTimeout),
+		UsageMaxOrigins:    getEnvInt("USAGE_MAX_ORIGINS", 50),
+		SignedURLCacheSize: getEnvInt("SIGNED_URL_CACHE_SIZE", 10000),
+		SignedURLMinValid:  getEnvDuration("SIGNED_URL_CACHE_MIN_VALID", 5*time.Minute),
+		SignedURLBatchMax:  getEnvInt("SIGNED_URL_BATCH_MAX", 50),
+		UploadBatchMax:     getEnvInt("UPLOAD_BATCH_MAX", 100),
+		SignedURLContentTypes: getEnvList("SIGNED_URL_CONTENT_TYPES", "image/jpeg,image/png,image/gif,image/webp,image/bmp,image/svg+xml"),
+		SignedURLAuditPath: getEnv("SIGNED_URL_AUDIT_PATH", "./data/signedurls.jsonl"),
+		SignedURLAuditMax:  getEnvInt("SIGNED_URL_AUDIT_MAX", 100000),
+		R2: R2Config{
+			AccountID:       getEnv("R2_ACCOUNT_ID", ""),
+			AccessKeyID:     getEnv("R2_ACCESS_KEY_ID", ""),
+			SecretAccessKey: getEnv("R2_SECRET_ACCESS_KEY", ""),
+			Endpoint:        getEnv("R2_ENDPOINT", ""),
+			Jurisdiction:    getEnv("R2_JURISDICTION", ""),
+			Region:          getEnv("R2_REGION", "auto"),
+			PublicBaseURL:   getEnv("R2_PUBLIC_BASE_URL", ""),
+		},
+		BigQuery: BigQueryConfig{
+			Project: getEnv("BIGQUERY_PROJECT", ""),
+			Dataset: getEnv("BIGQUERY_DATASET", ""),
+			Table:   getEnv("BIGQUERY_TABLE", ""),
+		},
+		Notify: NotifyConfig{
+			WebhookURL:           getEnv("NOTIFY_WEBHOOK_URL", ""),
+			Events:               getEnvList("NOTIFY_EVENTS", "auth_failures,quota,outage,daily_summary,abuse"),
+			AuthFailureThreshold: getEnvInt("NOTIFY_AUTH_FAILURE_THRESHOLD", 10),
+			AuthFailureWindow:    getEnvDuration("NOTIFY_AUTH_FAILURE_WINDOW", 5*time.Minute),
+			QuotaBytes:           int64(getEnvInt("NOTIFY_QUOTA_MB", 0)) * 1024 * 1024,
+			QuotaObjects:         int64(getEnvInt("NOTIFY_QUOTA_OBJECTS", 0)),
+			QuotaInterval:        getEnvDuration("NOTIFY_QUOTA_INTERVAL", time.Hour),
+		},
+		Bandwidth: BandwidthConfig{
+			Default: BandwidthLimit{
+				Upload:   int64(getEnvInt("BANDWIDTH_UPLOAD_RATE", 0)),
+				Download: int64(getEnvInt("BANDWIDTH_DOWNLOAD_RATE", 0)),
+			},
+			KeyRates: getEnvList("BANDWIDTH_KEY_RATES", ""),
+		},
+		Report: ReportConfig{
+			Interval:     getEnvDuration("REPORT_INTERVAL", 24*time.Hour),
+			Prefix:       getEnv("REPORT_PREFIX", ""),
+			TopUploaders: getEnvInt("REPORT_TOP_UPLOADERS", 10),
+		},
+		SMTP: SMTPConfig{
+			Host:               getEnv("SMTP_HOST", ""),
+			Port:               getEnv("SMTP_PORT", "587"),
+			Username:           getEnv("SMTP_USERNAME", ""),
+			Password:           getEnv("SMTP_PASSWORD", ""),
+			From:               getEnv("SMTP_FROM", "gcs-upload@localhost"),
+			To:                 getEnvList("ALERT_EMAIL_TO", ""),
+			ReadinessAfter:     getEnvDuration("ALERT_READINESS_AFTER", 5*time.Minute),
+			ErrorRateThreshold: getEnvFloat("ALERT_ERROR_RATE_THRESHOLD", 0.05),
+			MinRequests:        getEnvInt("ALERT_MIN_REQUESTS", 20),
+		},
+		CloudTasks: CloudTasksConfig{
+			Queue:               getEnv("CLOUD_TASKS_QUEUE", ""),
+			TargetURL:           getEnv("CLOUD_TASKS_TARGET_URL", ""),
+			Token:               getEnv("CLOUD_TASKS_TOKEN", ""),
+			ServiceAccountEmail: getEnv("CLOUD_TASKS_SERVICE_ACCOUNT", ""),
+		},
+		MetricsAuth: MetricsAuthConfig{
+			Username:   getEnv("METRICS_USERNAME", "prometheus"),
+			Password:   getEnv("METRICS_PASSWORD", ""),
+			Token:      getEnv("METRICS_TOKEN", ""),
+			AllowedIPs: getEnvList("METRICS_ALLOWED_IPS", ""),
+		},
+		TenantMetrics: TenantMetricsConfig{
+			Tenants:    getEnvList("METRICS_TENANTS", ""),
+			MaxTenants: getEnvInt("METRICS_MAX_TENANTS", 50),
+			Tokens:     getEnvList("METRICS_TENANT_TOKENS", ""),
+		},
+		MetricsPush: MetricsPushConfig{
+			URL:      getEnv("METRICS_PUSH_URL", ""),
+			Job:      getEnv("METRICS_PUSH_JOB", "gcb"),
+			Interval: getEnvDuration("METRICS_PUSH_INTERVAL", 15*time.Second),
+			Labels:   getEnvList("METRICS_PUSH_LABELS", ""),
+			Username: getEnv("METRICS_PUSH_USERNAME", ""),
+			Password: getEnv("METRICS_PUSH_PASSWORD", ""),
+		},
+		Hook: HookConfig{
+			Command:     strings.Fields(getEnv("HOOK_CMD", "")),
+			Events:      getEnvList("HOOK_EVENTS", ""),
+			Timeout:     getEnvDuration("HOOK_TIMEOUT", 30*time.Second),
+			Concurrency: getEnvInt("HOOK_CONCURRENCY", 4),
+			WorkDir:     getEnv("HOOK_WORKDIR", os.TempDir()+"/gcb-hook"),
+			Env:         getEnvList("HOOK_ENV", ""),
+		},
+		Abuse: AbuseConfig{
+			Threshold:     getEnvInt("ABUSE_THRESHOLD", 0),
+			Window:        getEnvDuration("ABUSE_WINDOW", 10*time.Minute),
+			BanDuration:   getEnvDuration("ABUSE_BAN_DURATION", time.Hour),
+			TarpitDelay:   getEnvDuration("ABUSE_TARPIT_DELAY", 10*time.Second),
+			HoneypotPaths: getEnvList("ABUSE_HONEYPOT_PATHS", "/wp-login.php,/wp-admin/,/xmlrpc.php,/.env,/.git/,/phpmyadmin/,/admin.php"),
+		},
+		DownloadSigning: DownloadSigningConfig{
+			Keys:     getEnvList("DOWNLOAD_SIGNING_KEYS", ""),
+			MaxTTL:   getEnvDuration("DOWNLOAD_URL_MAX_TTL", 30*24*time.Hour),
+			Required: getEnvBool("DOWNLOAD_REQUIRE_SIGNATURE", os.Getenv("DOWNLOAD_SIGNING_KEYS") != ""),
+			BaseURL:  strings.TrimSuffix(getEnv("DOWNLOAD_BASE_URL", ""), "/"),
+		},
+		Hotlink: HotlinkConfig{
+			AllowedReferrers: getEnvList("HOTLINK_ALLOWED_REFERRERS", ""),
+			AllowEmpty:       getEnvBool("HOTLINK_ALLOW_EMPTY_REFERRER", true),
+			Placeholder:      getEnv("HOTLINK_PLACEHOLDER", ""),
+		},
+		MissingPlaceholder: MissingPlaceholderConfig{
+			Source: getEnv("MISSING_PLACEHOLDER", ""),
+			MaxAge: getEnvDuration("MISSING_PLACEHOLDER_MAX_AGE", time.Minute),
+		},
+		Receipts: ReceiptConfig{
+			Keys:   getEnvList("RECEIPT_SIGNING_KEYS", ""),
+			Issuer: getEnv("RECEIPT_ISSUER", "gcb"),
+		},
+		Paranoid:       getEnvBool("PARANOID_UPLOADS", false),
+		PerceptualHash: getEnvBool("PERCEPTUAL_HASH", true),
+		PHashMaxPixels: getEnvInt("PERCEPTUAL_HASH_MAX_PIXELS", 16_000_000),
+		Reencode: ReencodeOptions{
+			MaxPixels:   getEnvInt("PARANOID_MAX_PIXELS", 50_000_000),
+			JPEGQuality: getEnvInt("PARANOID_JPEG_QUALITY", 90),
+		},
+		Animation: AnimationLimits{
+			MaxFrames:   getEnvInt("ANIMATION_MAX_FRAMES", 500),
+			MaxDuration: getEnvDuration("ANIMATION_MAX_DURATION", time.Minute),
+			Poster:      getEnvBool("ANIMATION_POSTER", true),
+		},
+		Color: ColorOptions{
+			ConvertSRGB: getEnvBool("COLOR_CONVERT_SRGB", false),
+			MaxICCSize:  getEnvInt("ICC_MAX_SIZE", 0),
+			JPEGQuality: getEnvInt("PARANOID_JPEG_QUALITY", 90),
+			MaxPixels:   getEnvInt("PARANOID_MAX_PIXELS", 50_000_000),
+		},
+		AutoOrient:       getEnvBool("AUTO_ORIENT", false),
+		CollisionPolicy:  getEnv("COLLISION_POLICY", CollisionOverwrite),
+		ASCIIObjectNames: getEnvBool("OBJECT_NAMES_ASCII", false),
+		Dedupe:           getEnvBool("DEDUPE_UPLOADS", false),
+		Orient: OrientOptions{
+			JPEGQuality: getEnvInt("PARANOID_JPEG_QUALITY", 90),
+			MaxPixels:   getEnvInt("PARANOID_MAX_PIXELS", 50_000_000),
+		},
+		OIDC: OIDCConfig{
+			Issuer:         getEnv("OIDC_ISSUER", ""),
+			ClientID:       getEnv("OIDC_CLIENT_ID", ""),
+			ClientSecret:   getEnv("OIDC_CLIENT_SECRET", ""),
+			RedirectURL:    getEnv("OIDC_REDIRECT_URL", ""),
+			Scopes:         getEnvList("OIDC_SCOPES", "openid,email,profile"),
+			GroupsClaim:    getEnv("OIDC_GROUPS_CLAIM", "groups"),
+			AllowedGroups:  getEnvList("OIDC_ALLOWED_GROUPS", ""),
+			AllowedDomains: getEnvList("OIDC_ALLOWED_DOMAINS", ""),
+			SessionSecret:  getEnv("OIDC_SESSION_SECRET", ""),
+			SessionTTL:     getEnvDuration("OIDC_SESSION_TTL", 8*time.Hour),
+		},
+		HealthCheckInterval: getEnvDuration("HEALTH_CHECK_INTERVAL", 30*time.Second),
+		Verify: VerifyConfig{
+			All:     getEnvBool("VERIFY_UPLOADS", false),
+			Tenants: getEnvList("VERIFY_UPLOADS_TENANTS", ""),
+		},
+		StartupCheck: StartupCheckConfig{
+			Enabled: getEnvBool("STARTUP_CHECK", true),
+			Timeout: getEnvDuration("STARTUP_CHECK_TIMEOUT", 10*time.Second),
+		},
+		Compression: CompressionConfig{
+			MinSize: getEnvInt("COMPRESSION_MIN_SIZE", 1024),
+			Types:   getEnvList("COMPRESSION_TYPES", "application/json,text/plain,text/csv"),
+		},
+		UploadForm: UploadFormConfig{
+			FileFields:     getEnvList("UPLOAD_FILE_FIELDS", "image,file,upload"),
+			MetadataFields: getEnvList("UPLOAD_METADATA_FIELDS", "title,alt"),
+		},
+		IPPrivacy: IPPrivacyConfig{
+			Mode: getEnv("IP_PRIVACY", IPPrivacyOff),
+			Key:  getEnv("IP_PRIVACY_KEY", ""),
+		},
+		Tus: TusConfig{
+			Dir:    getEnv("TUS_DIR", "./data/tus"),
+			Expiry: getEnvDuration("TUS_UPLOAD_EXPIRY", 24*time.Hour),
+		},
+		Inbox: InboxConfig{
+			Dir:        getEnv("INBOX_DIR", ""),
+			Bucket:     getEnv("INBOX_BUCKET", ""),
+			Tenant:     getEnv("INBOX_TENANT", ""),
+			Interval:   getEnvDuration("INBOX_POLL_INTERVAL", 30*time.Second),
+			SettleTime: getEnvDuration("INBOX_SETTLE_TIME", time.Minute),
+		},
+		ReprocessWorkers: getEnvInt("REPROCESS_CONCURRENCY", 2),
+		Inventory: InventoryConfig{
+			Interval:       getEnvDuration("INVENTORY_INTERVAL", 0),
+			Repair:         getEnvBool("INVENTORY_REPAIR", false),
+			MaxRepairs:     getEnvInt("INVENTORY_MAX_REPAIRS", 1000),
+			IgnorePrefixes: getEnvList("INVENTORY_IGNORE_PREFIXES", ""),
+		},
+		CustomerKey: CustomerKeyConfig{
+			RequiredTenants: getEnvList("CSEK_REQUIRED_TENANTS", ""),
+		},
+		EmailIn: EmailInConfig{
+			Token:             getEnv("INBOUND_EMAIL_TOKEN", ""),
+			MailgunSigningKey: getEnv("MAILGUN_SIGNING_KEY", ""),
+			AllowedSenders:    getEnvList("INBOUND_EMAIL_ALLOWED_SENDERS", ""),
+			Bucket:            getEnv("INBOUND_EMAIL_BUCKET", ""),
+			Tenant:            getEnv("INBOUND_EMAIL_TENANT", ""),
+			MaxSize:           int64(getEnvInt("INBOUND_EMAIL_MAX_SIZE_MB", 50)) * 1024 * 1024,
+		},
+		Quarantine: QuarantineConfig{
+			Prefix:      getEnv("QUARANTINE_PREFIX", "quarantine/"),
+			Bucket:      getEnv("QUARANTINE_BUCKET", ""),
+			Driver:      getEnv("QUARANTINE_DRIVER", "gcs"),
+			ScanURL:     getEnv("SCAN_URL", ""),
+			ScanToken:   getEnv("SCAN_TOKEN", ""),
+			ScanMaxSize: int64(getEnvInt("SCAN_MAX_SIZE_MB", 100)) * 1024 * 1024,
+		},
+		Staging: StagingConfig{
+			Enabled:     getEnvBool("STAGING", false),
+			Prefix:      getEnv("STAGING_PREFIX", "staging/"),
+			AutoPublish: getEnvBool("STAGING_AUTO_PUBLISH", true),
+		},
+		FS: FSConfig{
+			Root:  getEnv("FS_ROOT", "./data/objects"),
+			Fsync: getEnvBool("FS_FSYNC", false),
+		},
+		GCSUpload: GCSUploadConfig{
+			ResumableThreshold: int64(getEnvInt("GCS_RESUMABLE_THRESHOLD_MB", 8)) * 1024 * 1024,
+			ChunkSize:          getEnvInt("GCS_CHUNK_SIZE_MB", 16) * 1024 * 1024,
+			ChunkRetryDeadline: getEnvDuration("GCS_CHUNK_RETRY_DEADLINE", 2*time.Minute),
+		},
+		// Cloud Run sets K_SERVICE, so serverless mode is on there unless disabled
+		Serverless: getEnvBool("SERVERLESS", os.Getenv("K_SERVICE") != ""),
+		WorkloadIdentity: WorkloadIdentityConfig{
+			Audience:       getEnv("WIF_AUDIENCE", ""),
+			TokenPath:      getEnv("WIF_TOKEN_PATH", defaultWorkloadTokenPath),
+			ServiceAccount: getEnv("WIF_SERVICE_ACCOUNT", ""),
+		},
+		Server: ServerLimits{
+			MaxConnections:      getEnvInt("MAX_CONNECTIONS", 1024),
+			MaxConnectionsPerIP: getEnvInt("MAX_CONNECTIONS_PER_IP", 0),
+			ReadHeaderTimeout:   getEnvDuration("READ_HEADER_TIMEOUT", 5*time.Second),
+			ReadTimeout:         getEnvDuration("READ_TIMEOUT", 15*time.Second),
+			IdleTimeout:         getEnvDuration("IDLE_TIMEOUT", 60*time.Second),
+			MaxHeaderBytes:      getEnvInt("MAX_HEADER_BYTES", 64*1024),
+			MinUploadRate:       int64(getEnvInt("UPLOAD_MIN_RATE", 1024)),
+			MinUploadRateWindow: getEnvDuration("UPLOAD_MIN_RATE_WINDOW", 10*time.Second),
+		},
+		CanonicalPaths: getEnv("CANONICAL_PATHS", CanonicalRewrite),
+		UploadMemory: UploadMemoryConfig{
+			Budget:       int64(getEnvInt("UPLOAD_MEMORY_BUDGET_MB", 0)) * 1024 * 1024,
+			QueueTimeout: getEnvDuration("UPLOAD_MEMORY_QUEUE_TIMEOUT", 5*time.Second),
+			MaxQueue:     getEnvInt("UPLOAD_MEMORY_MAX_QUEUE", 32),
+		},
+		LoadShed: LoadShedConfig{
+			P99Latency:  getEnvDuration("LOAD_SHED_P99_LATENCY", 0),
+			ErrorRate:   getEnvFloat("LOAD_SHED_ERROR_RATE", 0),
+			MaxMemory:   int64(getEnvInt("LOAD_SHED_MEMORY_MB", 0)) * 1024 * 1024,
+			Window:      getEnvDuration("LOAD_SHED_WINDOW", time.Minute),
+			MinRequests: getEnvInt("LOAD_SHED_MIN_REQUESTS", 50),
+			Cooldown:    getEnvDuration("LOAD_SHED_COOLDOWN", 30*time.Second),
+			Routes:      getEnvList("LOAD_SHED_ROUTES", "GET /objects,GET /objects-dev,GET /objects/,GET /objects-dev/,GET /v1/objects,GET /v1/objects-dev,GET /v1/buckets/{bucket}/objects,GET /users/{id}/uploads,GET /stats"),
+		},
+	}
+
+	// Serverless instances authenticate as their service account through the metadata server
+	if config.Serverless {
+		config.ServiceAccountPath1 = ""
+	}
+
+	// Federated clusters exchange the projected ServiceAccount token instead of mounting a key
+	if config.WorkloadIdentity.Enabled() {
+		config.ServiceAccountPath1 = ""
 	}
+	workloadIdentity = config.WorkloadIdentity
+	asciiObjectNames = config.ASCIIObjectNames
+	config.envProblems = envProblems
 
 	return config
 }
 
+// reencodeOptions returns the re-encoding options for the upload pipeline, or
+// nil when paranoid mode is off
+func (c *Config) reencodeOptions() *ReencodeOptions {
+	if !c.Paranoid {
+		return nil
+	}
+	return &c.Reencode
+}
+
+// orientOptions returns the auto-orientation options for the upload pipeline,
+// or nil when auto-orientation is off
+func (c *Config) orientOptions() *OrientOptions {
+	if !c.AutoOrient {
+		return nil
+	}
+	return &c.Orient
+}
+
+// colorOptions returns the color normalization options for the upload
+// pipeline, or nil when neither conversion nor profile stripping is on
+func (c *Config) colorOptions() *ColorOptions {
+	if !c.Color.ConvertSRGB && c.Color.MaxICCSize <= 0 {
+		return nil
+	}
+	return &c.Color
+}
+
+// secondaryBucket returns the configuration of a bucket's mirror or failover
+// bucket, or nil when it isn't configured
+func secondaryBucket(driver, bucketName, credentialsPath, publicBaseURL string) *BucketConfig {
+	if driver == "" || bucketName == "" {
+		return nil
+	}
+	return &BucketConfig{
+		Name:            bucketName,
+		Driver:          driver,
+		CredentialsPath: credentialsPath,
+		PublicBaseURL:   publicBaseURL,
+	}
+}
+
 // getEnv gets an environment variable or returns a default value
 func getEnv(key, defaultValue string) string {
 	value := os.Getenv(key)
@@ -74,3 +660,72 @@ func getEnv(key, defaultValue string) string {
 	}
 	return value
 }
+
+// getEnvDuration parses a duration environment variable (e.g. "5m") or returns
+// a default value, recording values that don't parse for Validate
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	raw := getEnv(key, "")
+	if raw == "" {
+		return defaultValue
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil {
+		recordEnvProblem(key, raw, "not a duration", defaultValue.String())
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvInt parses an integer environment variable or returns a default value
+func getEnvInt(key string, defaultValue int) int {
+	raw := getEnv(key, "")
+	if raw == "" {
+		return defaultValue
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		recordEnvProblem(key, raw, "not an integer", strconv.Itoa(defaultValue))
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvFloat parses a float environment variable or returns a default value
+func getEnvFloat(key string, defaultValue float64) float64 {
+	raw := getEnv(key, "")
+	if raw == "" {
+		return defaultValue
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		recordEnvProblem(key, raw, "not a number", strconv.FormatFloat(defaultValue, 'g', -1, 64))
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvBool parses a boolean environment variable ("true", "false", "1", "0")
+// or returns a default value
+func getEnvBool(key string, defaultValue bool) bool {
+	raw := getEnv(key, "")
+	if raw == "" {
+		return defaultValue
+	}
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		recordEnvProblem(key, raw, "not a boolean", "true or false")
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvList parses a comma-separated environment variable into trimmed, non-empty items
+func getEnvList(key, defaultValue string) []string {
+	var items []string
+	for _, item := range strings.Split(getEnv(key, defaultValue), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
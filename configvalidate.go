@@ -0,0 +1,494 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// minSigningKeyLength is the shortest HMAC key accepted for signed URLs,
+// receipts and sessions
+const minSigningKeyLength = 32
+
+// ConfigProblem is an invalid configuration value, reported at startup
+type ConfigProblem struct {
+	Field   string // environment variable
+	Value   string
+	Problem string
+	Example string
+	Fatal   bool // the service refuses to start
+}
+
+func (p ConfigProblem) String() string {
+	value := p.Value
+	if secretFieldPattern.MatchString(p.Field) {
+		value = secretFingerprint(value)
+	}
+	s := fmt.Sprintf("%s=%q: %s", p.Field, value, p.Problem)
+	if p.Example != "" {
+		s += " (e.g. " + p.Example + ")"
+	}
+	return s
+}
+
+// securitySettings are the settings whose unparseable values are fatal
+// instead of being replaced by their defaults: a typo must not silently turn
+// off a protection or raise a limit
+var securitySettings = map[string]bool{
+	"MAX_FILE_SIZE_MB":           true,
+	"ARCHIVE_MAX_SIZE_MB":        true,
+	"ARCHIVE_MAX_OBJECTS":        true,
+	"IMPORT_MAX_SIZE_MB":         true,
+	"PARANOID_UPLOADS":           true,
+	"PARANOID_MAX_PIXELS":        true,
+	"PERCEPTUAL_HASH_MAX_PIXELS": true,
+	"DOWNLOAD_REQUIRE_SIGNATURE": true,
+	"DOWNLOAD_URL_MAX_TTL":       true,
+	"OIDC_SESSION_TTL":           true,
+	"ABUSE_THRESHOLD":            true,
+	"ABUSE_WINDOW":               true,
+	"ABUSE_BAN_DURATION":         true,
+	"MAX_CONNECTIONS":            true,
+	"MAX_CONNECTIONS_PER_IP":     true,
+	"READ_HEADER_TIMEOUT":        true,
+	"READ_TIMEOUT":               true,
+	"MAX_HEADER_BYTES":           true,
+	"UPLOAD_MIN_RATE":            true,
+	"UPLOAD_MIN_RATE_WINDOW":     true,
+	"BANDWIDTH_UPLOAD_RATE":      true,
+	"BANDWIDTH_DOWNLOAD_RATE":    true,
+}
+
+// envProblems collects the values the getEnv helpers couldn't parse while
+// LoadConfig runs
+var envProblems []ConfigProblem
+
+// recordEnvProblem notes a value that didn't parse and was replaced by its default
+func recordEnvProblem(key, value, problem, example string) {
+	// Some variables are read for several settings
+	for _, recorded := range envProblems {
+		if recorded.Field == key {
+			return
+		}
+	}
+	if !securitySettings[key] {
+		problem += ", using the default"
+	}
+	envProblems = append(envProblems, ConfigProblem{
+		Field:   key,
+		Value:   value,
+		Problem: problem,
+		Example: example,
+		Fatal:   securitySettings[key],
+	})
+}
+
+// Validate checks the configuration as a whole and returns every problem
+// found, so all of them can be fixed in one go
+func (c *Config) Validate() []ConfigProblem {
+	problems := append([]ConfigProblem{}, c.envProblems...)
+	fatal := func(field, value, problem, example string) {
+		problems = append(problems, ConfigProblem{Field: field, Value: value, Problem: problem, Example: example, Fatal: true})
+	}
+	warn := func(field, value, problem, example string) {
+		problems = append(problems, ConfigProblem{Field: field, Value: value, Problem: problem, Example: example})
+	}
+
+	// Storage
+	if c.BucketName1 == "" {
+		fatal("GCS_BUCKET_NAME_1", "", "is required", "my-images")
+	}
+	if c.Quarantine.Bucket != "" && (c.Quarantine.Bucket == c.BucketName1 || c.Quarantine.Bucket == c.BucketName2) {
+		fatal("QUARANTINE_BUCKET", c.Quarantine.Bucket, "must not be one of the served buckets", "my-images-quarantine")
+	}
+	drivers := [][2]string{
+		{"STORAGE_DRIVER_1", c.StorageDriver1},
+		{"STORAGE_DRIVER_2", c.StorageDriver2},
+		{"MIRROR_DRIVER_1", c.MirrorDriver1},
+		{"MIRROR_DRIVER_2", c.MirrorDriver2},
+	}
+	if c.FailoverBucketName1 != "" {
+		drivers = append(drivers, [2]string{"FAILOVER_DRIVER_1", c.FailoverDriver1})
+		if c.FailoverBucketName1 == c.BucketName1 && c.FailoverDriver1 == c.StorageDriver1 {
+			fatal("FAILOVER_BUCKET_NAME_1", c.FailoverBucketName1, "must differ from the primary bucket", "my-images-eu")
+		}
+	}
+	if c.FailoverBucketName2 != "" {
+		drivers = append(drivers, [2]string{"FAILOVER_DRIVER_2", c.FailoverDriver2})
+		if c.FailoverBucketName2 == c.BucketName2 && c.FailoverDriver2 == c.StorageDriver2 {
+			fatal("FAILOVER_BUCKET_NAME_2", c.FailoverBucketName2, "must differ from the primary bucket", "my-thumbnails-eu")
+		}
+	}
+	if c.FailoverBucketName1 != "" || c.FailoverBucketName2 != "" {
+		if c.Failover.Threshold < 1 {
+			fatal("FAILOVER_THRESHOLD", strconv.Itoa(c.Failover.Threshold), "must be at least 1", "5")
+		}
+		if c.Failover.Cooldown <= 0 {
+			fatal("FAILOVER_COOLDOWN", c.Failover.Cooldown.String(), "must be positive", "30s")
+		}
+	}
+	if c.Quarantine.Bucket != "" {
+		drivers = append(drivers, [2]string{"QUARANTINE_DRIVER", c.Quarantine.Driver})
+	}
+	for _, driver := range drivers {
+		switch driver[1] {
+		case "", "gcs", "r2", "s3", "fs":
+		default:
+			fatal(driver[0], driver[1], "unknown storage driver", "gcs, r2, s3 or fs")
+		}
+	}
+	for field, bases := range map[string][]string{"CDN_BASE_URLS_1": c.CDNBaseURLs1, "CDN_BASE_URLS_2": c.CDNBaseURLs2} {
+		for _, base := range bases {
+			if !validURL(base, "http", "https") {
+				fatal(field, base, "is not an absolute http(s) URL", "https://cdn.example.com/images")
+			}
+		}
+	}
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		fatal("PORT", c.Port, "must be a port number", "8080")
+	}
+
+	// Uploads
+	if c.MaxFileSize <= 0 {
+		fatal("MAX_FILE_SIZE_MB", strconv.FormatInt(c.MaxFileSize/1024/1024, 10), "must be positive", "10")
+	}
+	if _, err := parseCollisionPolicy(c.CollisionPolicy, ""); err != nil {
+		fatal("COLLISION_POLICY", c.CollisionPolicy, err.Error(), CollisionOverwrite)
+	}
+	if _, _, err := parseMetadataFields(c.UploadForm.MetadataFields); err != nil {
+		fatal("UPLOAD_METADATA_FIELDS", strings.Join(c.UploadForm.MetadataFields, ","), err.Error(), "title,alt,tags")
+	}
+	if c.Paranoid {
+		warn("PARANOID_UPLOADS", "true", "re-encodes JPEG, PNG and GIF only; WebP, BMP and SVG uploads are rejected", "")
+	}
+	if c.Reencode.JPEGQuality < 1 || c.Reencode.JPEGQuality > 100 {
+		warn("PARANOID_JPEG_QUALITY", strconv.Itoa(c.Reencode.JPEGQuality), "must be between 1 and 100", "90")
+	}
+	for _, contentType := range c.SignedURLContentTypes {
+		if contentType != strings.ToLower(contentType) || !strings.Contains(contentType, "/") {
+			warn("SIGNED_URL_CONTENT_TYPES", contentType, "is not a lowercase media type and never matches", "image/jpeg")
+		}
+	}
+	if c.SignedURLAuditPath != "" && c.SignedURLAuditMax < 1 {
+		fatal("SIGNED_URL_AUDIT_MAX", strconv.Itoa(c.SignedURLAuditMax), "must be at least 1", "100000")
+	}
+
+	// Connections
+	if c.Server.MaxConnections < 0 {
+		fatal("MAX_CONNECTIONS", strconv.Itoa(c.Server.MaxConnections), "must be 0 (no limit) or positive", "1024")
+	}
+	if c.Server.ReadHeaderTimeout <= 0 || c.Server.ReadHeaderTimeout > c.Server.ReadTimeout {
+		fatal("READ_HEADER_TIMEOUT", c.Server.ReadHeaderTimeout.String(), "must be positive and at most READ_TIMEOUT", "5s")
+	}
+	if c.Server.MinUploadRate > 0 && c.Server.MinUploadRateWindow < time.Second {
+		fatal("UPLOAD_MIN_RATE_WINDOW", c.Server.MinUploadRateWindow.String(), "must be at least 1s", "10s")
+	}
+	if c.UploadMemory.Budget < 0 {
+		fatal("UPLOAD_MEMORY_BUDGET_MB", strconv.FormatInt(c.UploadMemory.Budget/1024/1024, 10), "must be 0 (no budget) or positive", "200")
+	}
+	if c.UploadMemory.Budget > 0 {
+		if c.UploadMemory.Budget < c.MaxFileSize {
+			warn("UPLOAD_MEMORY_BUDGET_MB", strconv.FormatInt(c.UploadMemory.Budget/1024/1024, 10), "is below MAX_FILE_SIZE_MB, so the largest uploads run one at a time", strconv.FormatInt(4*c.MaxFileSize/1024/1024, 10))
+		}
+		if c.UploadMemory.QueueTimeout < 0 || c.UploadMemory.QueueTimeout >= c.Server.ReadTimeout {
+			fatal("UPLOAD_MEMORY_QUEUE_TIMEOUT", c.UploadMemory.QueueTimeout.String(), "must be 0 or positive and below READ_TIMEOUT", "5s")
+		}
+		if c.UploadMemory.MaxQueue < 0 {
+			fatal("UPLOAD_MEMORY_MAX_QUEUE", strconv.Itoa(c.UploadMemory.MaxQueue), "must be 0 (no queue) or positive", "32")
+		}
+	}
+	if _, err := parseCanonicalMode(c.CanonicalPaths); err != nil {
+		fatal("CANONICAL_PATHS", c.CanonicalPaths, err.Error(), CanonicalRewrite)
+	}
+	if c.LoadShed.Enabled() {
+		if c.LoadShed.ErrorRate < 0 || c.LoadShed.ErrorRate > 1 {
+			fatal("LOAD_SHED_ERROR_RATE", strconv.FormatFloat(c.LoadShed.ErrorRate, 'g', -1, 64), "must be between 0 and 1", "0.2")
+		}
+		if c.LoadShed.Window <= 0 {
+			fatal("LOAD_SHED_WINDOW", c.LoadShed.Window.String(), "must be positive", "1m")
+		}
+		if c.LoadShed.Cooldown < 0 {
+			fatal("LOAD_SHED_COOLDOWN", c.LoadShed.Cooldown.String(), "must be 0 or positive", "30s")
+		}
+		if _, err := parseShedRoutes(c.LoadShed.Routes); err != nil {
+			fatal("LOAD_SHED_ROUTES", strings.Join(c.LoadShed.Routes, ","), err.Error(), "GET /objects,GET /stats")
+		}
+		if len(c.LoadShed.Routes) == 0 {
+			warn("LOAD_SHED_ROUTES", "", "is empty, so no request is ever shed", "GET /objects,GET /stats")
+		}
+	}
+	if c.Bandwidth.Default.Upload < 0 {
+		fatal("BANDWIDTH_UPLOAD_RATE", strconv.FormatInt(c.Bandwidth.Default.Upload, 10), "must be 0 (no cap) or positive", "1048576")
+	}
+	if c.Bandwidth.Default.Download < 0 {
+		fatal("BANDWIDTH_DOWNLOAD_RATE", strconv.FormatInt(c.Bandwidth.Default.Download, 10), "must be 0 (no cap) or positive", "4194304")
+	}
+	keyRates, err := parseKeyRates(c.Bandwidth.KeyRates)
+	if err != nil {
+		fatal("BANDWIDTH_KEY_RATES", strings.Join(c.Bandwidth.KeyRates, ","), err.Error(), "api2=1048576:4194304")
+	}
+	// A throttled upload slower than the minimum rate would be aborted
+	uploadCaps := []int64{c.Bandwidth.Default.Upload}
+	for _, limit := range keyRates {
+		uploadCaps = append(uploadCaps, limit.Upload)
+	}
+	for _, upload := range uploadCaps {
+		if upload > 0 && upload < c.Server.MinUploadRate {
+			warn("UPLOAD_MIN_RATE", strconv.FormatInt(c.Server.MinUploadRate, 10), "is above a per-key upload cap, so throttled uploads can be aborted", strconv.FormatInt(upload/2, 10))
+			break
+		}
+	}
+
+	// Access control
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		fatal("TRUSTED_PROXIES", strings.Join(c.TrustedProxies, ","), err.Error(), "10.0.0.0/8,173.245.48.0/20")
+	}
+	for _, entry := range c.AllowedIPs {
+		if entry != "" && !validIPOrCIDR(entry) {
+			fatal("ALLOWED_IPS", entry, "is not an IP address or CIDR range", "203.0.113.7,10.0.0.0/8")
+		}
+	}
+	if c.Staging.Enabled {
+		prefix := strings.TrimSuffix(c.Staging.Prefix, "/")
+		if prefix == "" || strings.HasPrefix(prefix, "/") {
+			fatal("STAGING_PREFIX", c.Staging.Prefix, "must be a folder name", "staging/")
+		} else if c.Quarantine.Bucket == "" && prefix == strings.TrimSuffix(c.Quarantine.Prefix, "/") {
+			fatal("STAGING_PREFIX", c.Staging.Prefix, "must differ from QUARANTINE_PREFIX", "staging/")
+		}
+	}
+	switch c.IPPrivacy.Mode {
+	case IPPrivacyOff, IPPrivacyTruncate:
+	case IPPrivacyHash:
+		if len(c.IPPrivacy.Key) < minSigningKeyLength {
+			fatal("IP_PRIVACY_KEY", c.IPPrivacy.Key, fmt.Sprintf("must be at least %d characters in hash mode", minSigningKeyLength), "the output of openssl rand -hex 32")
+		}
+	default:
+		fatal("IP_PRIVACY", c.IPPrivacy.Mode, "must be off, truncate or hash", IPPrivacyTruncate)
+	}
+	if c.Tus.Expiry < 0 {
+		fatal("TUS_UPLOAD_EXPIRY", c.Tus.Expiry.String(), "must be 0 (never) or positive", "24h")
+	}
+	if c.Inbox.Dir != "" {
+		if c.Inbox.Interval <= 0 {
+			fatal("INBOX_POLL_INTERVAL", c.Inbox.Interval.String(), "must be positive", "30s")
+		}
+		if c.Inbox.SettleTime < 0 {
+			fatal("INBOX_SETTLE_TIME", c.Inbox.SettleTime.String(), "must be 0 or positive", "1m")
+		}
+		if c.Inbox.Bucket != "" && c.Inbox.Bucket != c.BucketName1 && c.Inbox.Bucket != c.BucketName2 {
+			fatal("INBOX_BUCKET", c.Inbox.Bucket, "must be GCS_BUCKET_NAME_1 or GCS_BUCKET_NAME_2", c.BucketName1)
+		}
+	}
+	if c.EmailIn.Enabled() {
+		if c.EmailIn.Token != "" && len(c.EmailIn.Token) < minSigningKeyLength {
+			fatal("INBOUND_EMAIL_TOKEN", c.EmailIn.Token, fmt.Sprintf("must be at least %d characters", minSigningKeyLength), "the output of openssl rand -hex 32")
+		}
+		if c.EmailIn.MaxSize <= 0 {
+			fatal("INBOUND_EMAIL_MAX_SIZE_MB", strconv.FormatInt(c.EmailIn.MaxSize/1024/1024, 10), "must be positive", "50")
+		}
+		if c.EmailIn.Bucket != "" && c.EmailIn.Bucket != c.BucketName1 && c.EmailIn.Bucket != c.BucketName2 {
+			fatal("INBOUND_EMAIL_BUCKET", c.EmailIn.Bucket, "must be GCS_BUCKET_NAME_1 or GCS_BUCKET_NAME_2", c.BucketName1)
+		}
+		if len(c.EmailIn.AllowedSenders) == 0 {
+			warn("INBOUND_EMAIL_ALLOWED_SENDERS", "", "is empty, so attachments from any sender are ingested", "@example.com,photos@partner.com")
+		}
+	}
+	if c.ReprocessWorkers < 1 {
+		fatal("REPROCESS_CONCURRENCY", strconv.Itoa(c.ReprocessWorkers), "must be at least 1", "2")
+	}
+	if c.Inventory.Interval < 0 {
+		fatal("INVENTORY_INTERVAL", c.Inventory.Interval.String(), "must not be negative", "24h")
+	}
+	if c.Inventory.MaxRepairs < 0 {
+		fatal("INVENTORY_MAX_REPAIRS", strconv.Itoa(c.Inventory.MaxRepairs), "must not be negative", "1000")
+	}
+	if len(c.CustomerKey.RequiredTenants) > 0 && c.StorageDriver1 != "gcs" && c.StorageDriver2 != "gcs" {
+		warn("CSEK_REQUIRED_TENANTS", strings.Join(c.CustomerKey.RequiredTenants, ","), "is set but no bucket uses the gcs driver, so their uploads will fail", "")
+	}
+	if c.GCSUpload.ResumableThreshold < 0 {
+		fatal("GCS_RESUMABLE_THRESHOLD_MB", strconv.FormatInt(c.GCSUpload.ResumableThreshold/1024/1024, 10), "must be 0 (always resumable) or positive", "8")
+	}
+	if c.GCSUpload.ChunkSize <= 0 {
+		fatal("GCS_CHUNK_SIZE_MB", strconv.Itoa(c.GCSUpload.ChunkSize/1024/1024), "must be positive", "16")
+	}
+	if c.GCSUpload.ChunkRetryDeadline <= 0 {
+		fatal("GCS_CHUNK_RETRY_DEADLINE", c.GCSUpload.ChunkRetryDeadline.String(), "must be positive", "2m")
+	}
+	for _, signing := range []struct{ field, account, driver string }{
+		{"GCS_SIGNING_SERVICE_ACCOUNT_1", c.SigningAccount1, c.StorageDriver1},
+		{"GCS_SIGNING_SERVICE_ACCOUNT_2", c.SigningAccount2, c.StorageDriver2},
+	} {
+		switch {
+		case signing.account == "":
+		case !strings.Contains(signing.account, "@"):
+			fatal(signing.field, signing.account, "must be a service account email", "url-signer@my-project.iam.gserviceaccount.com")
+		case signing.driver != "gcs":
+			warn(signing.field, signing.account, "only applies to the gcs driver", "")
+		}
+	}
+	for i, labels := range [][]string{c.BucketLabels, c.BucketLabels1, c.BucketLabels2} {
+		if _, err := parseBucketLabels(labels); err != nil {
+			field := [...]string{"BUCKET_LABELS", "BUCKET_LABELS_1", "BUCKET_LABELS_2"}[i]
+			fatal(field, strings.Join(labels, ","), err.Error(), "team=web,cost-center=cc-1234")
+		}
+	}
+	if c.StartupCheck.Enabled && c.StartupCheck.Timeout <= 0 {
+		fatal("STARTUP_CHECK_TIMEOUT", c.StartupCheck.Timeout.String(), "must be positive", "10s")
+	}
+	if _, err := parseTenantTokens(c.TenantMetrics.Tokens); err != nil {
+		fatal("METRICS_TENANT_TOKENS", "", err.Error(), "acme=<the output of openssl rand -hex 32>")
+	}
+	if c.TenantMetrics.MaxTenants < 0 {
+		fatal("METRICS_MAX_TENANTS", strconv.Itoa(c.TenantMetrics.MaxTenants), "must be 0 or positive", "50")
+	}
+	for _, entry := range c.MetricsAuth.AllowedIPs {
+		if !validIPOrCIDR(entry) {
+			fatal("METRICS_ALLOWED_IPS", entry, "is not an IP address or CIDR range", "10.0.0.0/8")
+		}
+	}
+	if len(c.MetricsAuth.AllowedIPs) > 0 && c.MetricsAuth.Password == "" && c.MetricsAuth.Token == "" &&
+		strings.Join(c.TrustedProxies, ",") == defaultTrustedProxies {
+		warn("METRICS_ALLOWED_IPS", strings.Join(c.MetricsAuth.AllowedIPs, ","), "is the only protection of /metrics, and the default TRUSTED_PROXIES lets any host in a private range claim an allowed IP; set TRUSTED_PROXIES to your proxies or add METRICS_TOKEN", "10.0.0.0/8")
+	}
+	for _, origin := range c.AllowedOrigins {
+		if origin != "" && origin != "*" && !validOrigin(origin) {
+			fatal("ALLOWED_ORIGINS", origin, "is not an origin (scheme and host, no path)", "https://shop.example.com")
+		}
+	}
+	for _, key := range c.DownloadSigning.Keys {
+		if len(key) < minSigningKeyLength {
+			fatal("DOWNLOAD_SIGNING_KEYS", key, fmt.Sprintf("keys must be at least %d characters", minSigningKeyLength), "the output of openssl rand -hex 32")
+		}
+	}
+	if c.DownloadSigning.Required && len(c.DownloadSigning.Keys) == 0 {
+		fatal("DOWNLOAD_REQUIRE_SIGNATURE", "true", "requires DOWNLOAD_SIGNING_KEYS", "")
+	}
+	for field, driver := range map[string]string{"STORAGE_DRIVER_1": c.StorageDriver1, "STORAGE_DRIVER_2": c.StorageDriver2} {
+		if driver == "fs" && len(c.DownloadSigning.Keys) == 0 {
+			warn(field, driver, "serves every object to anyone who knows its name; set DOWNLOAD_SIGNING_KEYS to require signed download links", "")
+		}
+	}
+	if !c.DownloadSigning.Required && len(c.DownloadSigning.Keys) > 0 {
+		warn("DOWNLOAD_REQUIRE_SIGNATURE", "false", "serves /images/ without a signature, so signed URLs don't restrict who can download", "true")
+	}
+	for _, entry := range c.Hotlink.AllowedReferrers {
+		if _, err := referrerHost(entry); err != nil {
+			fatal("HOTLINK_ALLOWED_REFERRERS", entry, "is not a host, *.domain or origin", "shop.example.com,*.example.com")
+		}
+	}
+	if c.Hotlink.Placeholder != "" {
+		if !isValidImageType(c.Hotlink.Placeholder) {
+			fatal("HOTLINK_PLACEHOLDER", c.Hotlink.Placeholder, "must be an image file", "./hotlink.png")
+		}
+		if len(c.Hotlink.AllowedReferrers) == 0 {
+			warn("HOTLINK_PLACEHOLDER", c.Hotlink.Placeholder, "has no effect without HOTLINK_ALLOWED_REFERRERS", "")
+		}
+	}
+	if source := c.MissingPlaceholder.Source; source != "" && source != "builtin" {
+		if !isValidImageType(strings.TrimPrefix(source, "object:")) {
+			fatal("MISSING_PLACEHOLDER", source, "must be builtin, an image file or object:<image object>", "object:placeholders/missing.png")
+		}
+	}
+	if c.MissingPlaceholder.MaxAge < 0 {
+		fatal("MISSING_PLACEHOLDER_MAX_AGE", c.MissingPlaceholder.MaxAge.String(), "must not be negative", "1m")
+	}
+	for _, key := range c.Receipts.Keys {
+		if len(key) < minSigningKeyLength {
+			fatal("RECEIPT_SIGNING_KEYS", key, fmt.Sprintf("keys must be at least %d characters", minSigningKeyLength), "the output of openssl rand -hex 32")
+		}
+	}
+	if c.OIDC.Enabled() {
+		if !validURL(c.OIDC.Issuer, "https") {
+			fatal("OIDC_ISSUER", c.OIDC.Issuer, "must be an https URL", "https://accounts.google.com")
+		}
+		if c.OIDC.ClientID == "" {
+			fatal("OIDC_CLIENT_ID", "", "is required with OIDC_ISSUER", "")
+		}
+		if !validURL(c.OIDC.RedirectURL, "http", "https") {
+			fatal("OIDC_REDIRECT_URL", c.OIDC.RedirectURL, "must be the absolute URL of /auth/callback", "https://images.example.com/auth/callback")
+		}
+		if len(c.OIDC.SessionSecret) < minSigningKeyLength {
+			fatal("OIDC_SESSION_SECRET", c.OIDC.SessionSecret, fmt.Sprintf("must be at least %d characters", minSigningKeyLength), "the output of openssl rand -hex 32")
+		}
+		if len(c.OIDC.AllowedGroups) == 0 && len(c.OIDC.AllowedDomains) == 0 {
+			fatal("OIDC_ALLOWED_GROUPS", "", "OIDC_ALLOWED_GROUPS or OIDC_ALLOWED_DOMAINS is required with OIDC_ISSUER", "admins@example.com")
+		}
+	}
+	if c.WorkloadIdentity.Enabled() && !strings.HasPrefix(c.WorkloadIdentity.Audience, "//iam.googleapis.com/") {
+		fatal("WIF_AUDIENCE", c.WorkloadIdentity.Audience, "must be the full provider name", "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/k8s/providers/my-cluster")
+	}
+	if c.CloudTasks.Queue != "" && (c.CloudTasks.TargetURL == "" || c.CloudTasks.Token == "") {
+		fatal("CLOUD_TASKS_QUEUE", c.CloudTasks.Queue, "requires CLOUD_TASKS_TARGET_URL and CLOUD_TASKS_TOKEN", "")
+	}
+
+	// Outbound endpoints
+	endpoints := [][2]string{
+		{"NOTIFY_WEBHOOK_URL", c.Notify.WebhookURL},
+		{"SCAN_URL", c.Quarantine.ScanURL},
+		{"METRICS_PUSH_URL", c.MetricsPush.URL},
+		{"CLOUD_TASKS_TARGET_URL", c.CloudTasks.TargetURL},
+	}
+	for _, endpoint := range endpoints {
+		if endpoint[1] != "" && !validURL(endpoint[1], "http", "https") {
+			fatal(endpoint[0], endpoint[1], "is not an absolute http(s) URL", "https://hooks.example.com/...")
+		}
+	}
+	if c.SMTP.ErrorRateThreshold <= 0 || c.SMTP.ErrorRateThreshold > 1 {
+		warn("ALERT_ERROR_RATE_THRESHOLD", strconv.FormatFloat(c.SMTP.ErrorRateThreshold, 'g', -1, 64), "must be between 0 and 1", "0.05")
+	}
+
+	return problems
+}
+
+// reportConfigProblems logs every configuration problem and returns an error
+// when the service must not start
+func reportConfigProblems(problems []ConfigProblem) error {
+	failed := 0
+	for _, problem := range problems {
+		if problem.Fatal {
+			failed++
+			log.Printf("❌ Invalid configuration: %s", problem)
+		} else {
+			log.Printf("⚠️  Configuration warning: %s", problem)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d configuration error(s), refusing to start", failed)
+	}
+	return nil
+}
+
+// validIPOrCIDR reports whether entry is an IP address or a CIDR range, as
+// accepted by isIPAllowed
+func validIPOrCIDR(entry string) bool {
+	if strings.Contains(entry, "/") {
+		_, _, err := net.ParseCIDR(entry)
+		return err == nil
+	}
+	return net.ParseIP(entry) != nil
+}
+
+// validOrigin reports whether origin is a browser origin such as https://example.com:8443
+func validOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" &&
+		u.Path == "" && u.RawQuery == "" && u.Fragment == "" && u.User == nil
+}
+
+// validURL reports whether raw is an absolute URL with one of the schemes
+func validURL(raw string, schemes ...string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ServerLimits protects the server from clients that hold connections open:
+// too many at once, or slowly sending headers or bodies (slowloris)
+type ServerLimits struct {
+	MaxConnections      int // open connections, 0 for no limit
+	MaxConnectionsPerIP int // open connections per remote address, 0 for no limit
+	ReadHeaderTimeout   time.Duration
+	ReadTimeout         time.Duration // whole request, headers and body
+	IdleTimeout         time.Duration
+	MaxHeaderBytes      int
+	MinUploadRate       int64 // bytes per second a request body must keep up, 0 disables
+	MinUploadRateWindow time.Duration
+}
+
+// limitListener caps the connections accepted by the server. When all slots
+// are taken, Accept waits for one to be released and new connections queue
+// in the kernel backlog; connections over the per-IP limit are closed.
+type limitListener struct {
+	net.Listener
+	slots chan struct{} // nil when the total isn't limited
+	perIP int
+	done  chan struct{}
+	once  sync.Once
+
+	mu   sync.Mutex
+	byIP map[string]int
+}
+
+// NewLimitListener wraps l with the connection limits
+func NewLimitListener(l net.Listener, limits ServerLimits) net.Listener {
+	ll := &limitListener{
+		Listener: l,
+		perIP:    limits.MaxConnectionsPerIP,
+		done:     make(chan struct{}),
+		byIP:     map[string]int{},
+	}
+	if limits.MaxConnections > 0 {
+		ll.slots = make(chan struct{}, limits.MaxConnections)
+	}
+	return ll
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		if l.slots != nil {
+			select {
+			case l.slots <- struct{}{}:
+			case <-l.done:
+				return nil, net.ErrClosed
+			}
+		}
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.releaseSlot()
+			return nil, err
+		}
+
+		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if l.perIP > 0 {
+			l.mu.Lock()
+			if l.byIP[ip] >= l.perIP {
+				l.mu.Unlock()
+				conn.Close()
+				l.releaseSlot()
+				httpRejectedConnectionsTotal.Inc()
+				continue
+			}
+			l.byIP[ip]++
+			l.mu.Unlock()
+		}
+		httpOpenConnections.Inc()
+		return &limitConn{Conn: conn, listener: l, ip: ip}, nil
+	}
+}
+
+func (l *limitListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+func (l *limitListener) releaseSlot() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// release frees the slots of a closed connection
+func (l *limitListener) release(ip string) {
+	if l.perIP > 0 {
+		l.mu.Lock()
+		if l.byIP[ip]--; l.byIP[ip] <= 0 {
+			delete(l.byIP, ip)
+		}
+		l.mu.Unlock()
+	}
+	l.releaseSlot()
+	httpOpenConnections.Dec()
+}
+
+// limitConn releases its slots once, when closed
+type limitConn struct {
+	net.Conn
+	listener *limitListener
+	ip       string
+	once     sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.listener.release(c.ip) })
+	return err
+}
+
+// errUploadTooSlow is returned to handlers reading a body that fell below the minimum rate
+var errUploadTooSlow = errors.New("request body is arriving too slowly")
+
+// minRateBody counts the bytes read from a request body
+type minRateBody struct {
+	io.ReadCloser
+	read    atomic.Int64
+	done    atomic.Bool // the body was read to the end
+	tooSlow atomic.Bool
+}
+
+func (b *minRateBody) Read(p []byte) (int, error) {
+	if b.tooSlow.Load() {
+		return 0, errUploadTooSlow
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.read.Add(int64(n))
+	if err == io.EOF {
+		b.done.Store(true)
+	} else if err != nil && b.tooSlow.Load() {
+		err = errUploadTooSlow
+	}
+	return n, err
+}
+
+// MinUploadRateMiddleware aborts requests whose body arrives slower than
+// limits.MinUploadRate bytes per second over any MinUploadRateWindow, so a
+// stalled upload frees its worker instead of holding it until ReadTimeout.
+// It must wrap the other middleware, as it needs the connection's own
+// ResponseWriter to cut the read short.
+func MinUploadRateMiddleware(limits ServerLimits) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limits.MinUploadRate <= 0 || limits.MinUploadRateWindow <= 0 {
+			return next
+		}
+		minBytes := limits.MinUploadRate * int64(limits.MinUploadRateWindow/time.Second)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			body := &minRateBody{ReadCloser: r.Body}
+			r.Body = body
+
+			// The connection is reused after the handler returns, so the
+			// deadline must not be touched once it has
+			var mu sync.Mutex
+			finished := false
+			stop := make(chan struct{})
+			go func() {
+				ticker := time.NewTicker(limits.MinUploadRateWindow)
+				defer ticker.Stop()
+				var last int64
+				for {
+					select {
+					case <-stop:
+						return
+					case <-ticker.C:
+					}
+					if body.done.Load() {
+						return
+					}
+					read := body.read.Load()
+					if read-last >= minBytes {
+						last = read
+						continue
+					}
+
+					mu.Lock()
+					if !finished {
+						body.tooSlow.Store(true)
+						// Unblock the handler's pending read
+						http.NewResponseController(w).SetReadDeadline(time.Now())
+						httpSlowUploadsTotal.Inc()
+						log.Printf("🐌 Aborted %s %s from %s: %d bytes in the last %s", r.Method, r.URL.Path, ipPrivacy.Anonymize(getClientIP(r)), read-last, limits.MinUploadRateWindow)
+					}
+					mu.Unlock()
+					return
+				}
+			}()
+
+			next.ServeHTTP(w, r)
+			mu.Lock()
+			finished = true
+			mu.Unlock()
+			close(stop)
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"time"
+)
+
+// CORSRule is one bucket CORS rule. The JSON layout matches the cors.json
+// files used by `gcloud storage buckets update --cors-file`.
+type CORSRule struct {
+	Origins         []string `json:"origin"`
+	Methods         []string `json:"method"`
+	ResponseHeaders []string `json:"responseHeader"`
+	MaxAgeSeconds   int      `json:"maxAgeSeconds"`
+}
+
+// MaxAge returns the preflight cache duration of the rule
+func (r CORSRule) MaxAge() time.Duration {
+	return time.Duration(r.MaxAgeSeconds) * time.Second
+}
+
+// BucketCORSConfig maps bucket names to their CORS rules. The "*" entry
+// applies to buckets without their own entry.
+type BucketCORSConfig map[string][]CORSRule
+
+// defaultCORSRules are applied to buckets that have no configured rules.
+// Browsers may only send the headers signed into upload URLs when the bucket
+// lists them, so they are taken from UploadHeaders, with an x-goog-meta-*
+// header for each metadata key uploads can set.
+func defaultCORSRules(origins, metadataKeys []string) []CORSRule {
+	metadata := make(map[string]string, len(metadataKeys))
+	for _, key := range metadataKeys {
+		metadata[key] = ""
+	}
+	signed := (&GCSClient{}).UploadHeaders(SignOptions{ContentType: "image/*", MaxSize: 1, CacheControl: "public", Metadata: metadata})
+	headers := append(slices.Sorted(maps.Keys(signed)), "Access-Control-Allow-Origin", "X-Requested-With")
+	return []CORSRule{{
+		Origins:         origins,
+		Methods:         []string{"GET", "HEAD", "PUT", "OPTIONS", "DELETE"},
+		ResponseHeaders: headers,
+		MaxAgeSeconds:   3600,
+	}}
+}
+
+// corsMetadataKeys returns the metadata keys uploads can set: the
+// accessibility fields and the keys of UPLOAD_METADATA_FIELDS
+func corsMetadataKeys(specs []string) []string {
+	fields, _, err := parseMetadataFields(append(slices.Clone(accessibilityFields), specs...))
+	if err != nil {
+		return slices.Clone(accessibilityFields)
+	}
+	keys := slices.Sorted(maps.Values(fields))
+	return slices.Compact(keys)
+}
+
+// LoadBucketCORSConfig reads the per-bucket CORS rules from a JSON file, e.g.
+//
+//	{"my-bucket": [{"origin": ["https://app.example.com"], "method": ["GET", "PUT"], "maxAgeSeconds": 600}]}
+//
+// An empty path returns an empty config, so every bucket gets the defaults.
+func LoadBucketCORSConfig(path string) (BucketCORSConfig, error) {
+	config := BucketCORSConfig{}
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CORS config: %w", err)
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse CORS config %s: %w", path, err)
+	}
+
+	for bucket, rules := range config {
+		for i, rule := range rules {
+			if len(rule.Methods) == 0 {
+				return nil, fmt.Errorf("CORS rule %d for bucket %s has no methods", i, bucket)
+			}
+			if rule.MaxAgeSeconds < 0 {
+				return nil, fmt.Errorf("CORS rule %d for bucket %s has a negative maxAgeSeconds", i, bucket)
+			}
+		}
+	}
+	return config, nil
+}
+
+// Rules returns the CORS rules for a bucket. Rules without origins inherit
+// the ALLOWED_ORIGINS list; metadataKeys are allowed by the default rules.
+func (c BucketCORSConfig) Rules(bucket string, defaultOrigins, metadataKeys []string) []CORSRule {
+	rules, ok := c[bucket]
+	if !ok {
+		rules, ok = c["*"]
+	}
+	if !ok {
+		return defaultCORSRules(defaultOrigins, metadataKeys)
+	}
+
+	resolved := make([]CORSRule, len(rules))
+	for i, rule := range rules {
+		if len(rule.Origins) == 0 {
+			rule.Origins = defaultOrigins
+		}
+		resolved[i] = rule
+	}
+	return resolved
+}
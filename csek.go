@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Headers carrying a customer-supplied encryption key, as GCS names them
+const (
+	customerKeyAlgorithmHeader = "X-Goog-Encryption-Algorithm"
+	customerKeyHeader          = "X-Goog-Encryption-Key"
+	customerKeySHA256Header    = "X-Goog-Encryption-Key-Sha256"
+)
+
+// ErrCustomerKeyRequired is returned when an object encrypted with a
+// customer-supplied key is read without the key, or with another one
+var ErrCustomerKeyRequired = errors.New("object is encrypted with a customer-supplied key")
+
+// ErrCustomerKeyUnsupported is returned by backends that can't encrypt
+// objects with a customer-supplied key, rather than storing them readable
+var ErrCustomerKeyUnsupported = errors.New("customer-supplied encryption keys are only supported by the gcs driver")
+
+// CustomerKeyConfig holds the settings of customer-supplied encryption keys
+type CustomerKeyConfig struct {
+	RequiredTenants []string // tenants whose uploads are rejected without a key
+}
+
+type customerKeyContextKey struct{}
+
+// withCustomerKey returns a context whose backend calls encrypt and decrypt
+// objects with the key
+func withCustomerKey(ctx context.Context, key []byte) context.Context {
+	return context.WithValue(ctx, customerKeyContextKey{}, key)
+}
+
+// customerKeyFromContext returns the customer-supplied key of the current
+// request, nil if there is none
+func customerKeyFromContext(ctx context.Context) []byte {
+	key, _ := ctx.Value(customerKeyContextKey{}).([]byte)
+	return key
+}
+
+// parseCustomerKey reads a customer-supplied AES-256 key from the request
+// headers: the algorithm (AES256), the base64 key and the base64 SHA-256 of
+// the key, which guards against keys corrupted on the way. It returns nil
+// when the request carries no key.
+func parseCustomerKey(header http.Header) ([]byte, error) {
+	algorithm := header.Get(customerKeyAlgorithmHeader)
+	encoded := header.Get(customerKeyHeader)
+	encodedSum := header.Get(customerKeySHA256Header)
+	if algorithm == "" && encoded == "" && encodedSum == "" {
+		return nil, nil
+	}
+	if algorithm == "" || encoded == "" || encodedSum == "" {
+		return nil, errors.New("customer-supplied encryption keys need all of " + customerKeyAlgorithmHeader + ", " + customerKeyHeader + " and " + customerKeySHA256Header)
+	}
+	if !strings.EqualFold(algorithm, "AES256") {
+		return nil, errors.New(customerKeyAlgorithmHeader + " must be AES256")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New(customerKeyHeader + " must be a base64 encoded 256-bit key")
+	}
+	sum, err := base64.StdEncoding.DecodeString(encodedSum)
+	expected := sha256.Sum256(key)
+	if err != nil || subtle.ConstantTimeCompare(sum, expected[:]) != 1 {
+		return nil, errors.New(customerKeySHA256Header + " doesn't match the key")
+	}
+	return key, nil
+}
+
+// CustomerKeyMiddleware makes the customer-supplied encryption key sent
+// with a request available to the backends, which encrypt uploads and
+// decrypt downloads with it. The key is only held for the request: it is
+// never logged or stored, so objects can't be read without the client
+// sending it again. Uploads of the tenants in RequiredTenants are rejected
+// without a key.
+func CustomerKeyMiddleware(cfg CustomerKeyConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, err := parseCustomerKey(r.Header)
+			if err != nil {
+				writeCustomerKeyError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if key == nil {
+				tenant := r.Header.Get("X-Tenant-ID")
+				if tenant != "" && slices.Contains(cfg.RequiredTenants, tenant) && isWriteMethod(r.Method) {
+					writeCustomerKeyError(w, http.StatusBadRequest, "Uploads of tenant "+tenant+" require a customer-supplied encryption key")
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(withCustomerKey(r.Context(), key)))
+		})
+	}
+}
+
+// isWriteMethod reports whether a request method can store content
+func isWriteMethod(method string) bool {
+	return method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch
+}
+
+// writeCustomerKeyError answers a request whose encryption key is unusable
+func writeCustomerKeyError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(UploadResponse{
+		Success: false,
+		Error:   message,
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// csekBackend remembers the customer-supplied key each object was written
+// with and, like GCS, refuses to read it without that key
+type csekBackend struct {
+	*mockBackend
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+func (b *csekBackend) Put(ctx context.Context, name string, r io.Reader, opts PutOptions) (*ObjectInfo, error) {
+	info, err := b.mockBackend.Put(ctx, name, r, opts)
+	if err == nil {
+		b.mu.Lock()
+		b.keys[name] = customerKeyFromContext(ctx)
+		b.mu.Unlock()
+	}
+	return info, err
+}
+
+func (b *csekBackend) Open(ctx context.Context, name string) (io.ReadCloser, *ObjectInfo, error) {
+	b.mu.Lock()
+	key := b.keys[name]
+	b.mu.Unlock()
+	if !bytes.Equal(key, customerKeyFromContext(ctx)) {
+		return nil, nil, ErrCustomerKeyRequired
+	}
+	return b.mockBackend.Open(ctx, name)
+}
+
+// setCustomerKey adds the X-Goog-Encryption-* headers of key to a request
+func setCustomerKey(header http.Header, key []byte) {
+	sum := sha256.Sum256(key)
+	header.Set(customerKeyAlgorithmHeader, "AES256")
+	header.Set(customerKeyHeader, base64.StdEncoding.EncodeToString(key))
+	header.Set(customerKeySHA256Header, base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+func TestParseCustomerKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	valid := http.Header{}
+	setCustomerKey(valid, key)
+	header := func(edit func(http.Header)) http.Header {
+		h := valid.Clone()
+		edit(h)
+		return h
+	}
+
+	if got, err := parseCustomerKey(valid); err != nil || !bytes.Equal(got, key) {
+		t.Fatalf("valid key: %x, %v", got, err)
+	}
+	if got, err := parseCustomerKey(http.Header{}); got != nil || err != nil {
+		t.Errorf("no key: %x, %v, want neither", got, err)
+	}
+
+	short := bytes.Repeat([]byte{7}, 16)
+	shortSum := sha256.Sum256(short)
+	for name, h := range map[string]http.Header{
+		"missing key":     header(func(h http.Header) { h.Del(customerKeyHeader) }),
+		"missing hash":    header(func(h http.Header) { h.Del(customerKeySHA256Header) }),
+		"other algorithm": header(func(h http.Header) { h.Set(customerKeyAlgorithmHeader, "AES128") }),
+		"not base64":      header(func(h http.Header) { h.Set(customerKeyHeader, "not a key!") }),
+		"128-bit key": header(func(h http.Header) {
+			h.Set(customerKeyHeader, base64.StdEncoding.EncodeToString(short))
+			h.Set(customerKeySHA256Header, base64.StdEncoding.EncodeToString(shortSum[:]))
+		}),
+		"corrupted key": header(func(h http.Header) {
+			h.Set(customerKeyHeader, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 32)))
+		}),
+		"malformed hash": header(func(h http.Header) { h.Set(customerKeySHA256Header, "%%%") }),
+	} {
+		if got, err := parseCustomerKey(h); err == nil || got != nil {
+			t.Errorf("%s: %x, %v, want an error", name, got, err)
+		}
+	}
+}
+
+func TestCustomerKeyDownload(t *testing.T) {
+	backend := &csekBackend{mockBackend: newMockBackend(), keys: map[string][]byte{}}
+	key := bytes.Repeat([]byte{7}, 32)
+	if _, err := backend.Put(withCustomerKey(context.Background(), key), "secret.jpg", bytes.NewReader([]byte("x")), PutOptions{ContentType: "image/jpeg"}); err != nil {
+		t.Fatal(err)
+	}
+	handler := CustomerKeyMiddleware(CustomerKeyConfig{})(http.StripPrefix("/images/", HandleDownload(backend, nil, nil, nil)))
+
+	tests := []struct {
+		name string
+		key  []byte
+		want int
+	}{
+		{"right key", key, http.StatusOK},
+		{"no key", nil, http.StatusForbidden},
+		{"wrong key", bytes.Repeat([]byte{8}, 32), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/images/secret.jpg", nil)
+			if tt.key != nil {
+				setCustomerKey(req.Header, tt.key)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && rec.Header().Get("Cache-Control") != "private, no-store" {
+				t.Errorf("Cache-Control %q, want decrypted content kept out of shared caches", rec.Header().Get("Cache-Control"))
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/images/secret.jpg", nil)
+	req.Header.Set(customerKeyHeader, base64.StdEncoding.EncodeToString(key))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("malformed key headers: status %d, want 400", rec.Code)
+	}
+}
+
+func TestCustomerKeyRequiredTenants(t *testing.T) {
+	handler := CustomerKeyMiddleware(CustomerKeyConfig{RequiredTenants: []string{"acme"}})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name   string
+		method string
+		tenant string
+		key    bool
+		want   int
+	}{
+		{"required tenant without a key", http.MethodPost, "acme", false, http.StatusBadRequest},
+		{"required tenant with a key", http.MethodPost, "acme", true, http.StatusNoContent},
+		{"required tenant reading without a key", http.MethodGet, "acme", false, http.StatusNoContent},
+		{"other tenant without a key", http.MethodPut, "globex", false, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/upload", nil)
+			req.Header.Set("X-Tenant-ID", tt.tenant)
+			if tt.key {
+				setCustomerKey(req.Header, bytes.Repeat([]byte{7}, 32))
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
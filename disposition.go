@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Content-Disposition types accepted at upload and by the download proxy
+const (
+	DispositionInline     = "inline"
+	DispositionAttachment = "attachment"
+)
+
+// Form fields and query parameters choosing the Content-Disposition
+const (
+	dispositionField   = "disposition"
+	downloadNameField  = "downloadName" // upload form field
+	downloadNameParam  = "filename"     // download proxy query parameter
+	maxDownloadNameLen = 255
+)
+
+var (
+	errInvalidDisposition  = errors.New("disposition must be inline or attachment")
+	errInvalidDownloadName = errors.New("download filename must be at most 255 characters without control characters")
+)
+
+// contentDisposition builds a Content-Disposition header value. An empty
+// disposition with a filename means attachment; both empty give "". Names
+// outside ASCII are encoded per RFC 2231, which all browsers understand.
+func contentDisposition(disposition, filename string) (string, error) {
+	switch disposition {
+	case "":
+		if filename == "" {
+			return "", nil
+		}
+		disposition = DispositionAttachment
+	case DispositionInline, DispositionAttachment:
+	default:
+		return "", errInvalidDisposition
+	}
+	if filename == "" {
+		return disposition, nil
+	}
+
+	// Only the last path element is kept, browsers ignore folders anyway
+	filename = path.Base(strings.ReplaceAll(filename, `\`, "/"))
+	if len(filename) > maxDownloadNameLen || strings.ContainsFunc(filename, func(r rune) bool { return r < 0x20 || r == 0x7f }) {
+		return "", errInvalidDownloadName
+	}
+	value := mime.FormatMediaType(disposition, map[string]string{"filename": filename})
+	if value == "" {
+		return "", errInvalidDownloadName
+	}
+	return value, nil
+}
+
+// uploadDisposition returns the Content-Disposition chosen by the
+// disposition and downloadName form fields (or query parameters) of an
+// upload. The download name defaults to the original filename once a
+// disposition is given.
+func uploadDisposition(disposition, downloadName, originalName string) (string, error) {
+	if disposition == "" && downloadName == "" {
+		return "", nil
+	}
+	if downloadName == "" {
+		downloadName = originalName
+	}
+	return contentDisposition(disposition, downloadName)
+}
+
+// downloadDisposition returns the Content-Disposition of a proxied download:
+// the disposition and filename query parameters override the type and name
+// stored with the object
+func downloadDisposition(stored string, query url.Values) (string, error) {
+	disposition, filename := query.Get(dispositionField), query.Get(downloadNameParam)
+	if disposition == "" && filename == "" {
+		return stored, nil
+	}
+
+	// A stored value that doesn't parse (set outside this service) is replaced
+	if storedType, params, err := mime.ParseMediaType(stored); err == nil {
+		if disposition == "" {
+			disposition = storedType
+		}
+		if filename == "" {
+			filename = params["filename"]
+		}
+	}
+	return contentDisposition(disposition, filename)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Query parameters of signed download URLs
+const (
+	downloadExpiresParam   = "expires"
+	downloadSignatureParam = "sig"
+)
+
+// defaultDownloadURLTTL is used when a signed download URL request has no expiresIn
+const defaultDownloadURLTTL = 7 * 24 * time.Hour
+
+// maxDirectDownloadTTL is the longest validity of a V4 signed storage URL
+const maxDirectDownloadTTL = 7 * 24 * time.Hour
+
+var (
+	errDownloadURLExpired = errors.New("download URL expired")
+	errDownloadURLInvalid = errors.New("invalid download URL signature")
+	errDownloadURLMissing = errors.New("download URL must be signed")
+)
+
+// DownloadSigner signs download proxy URLs with an HMAC of the bucket, object
+// and expiry, so private images can be linked (e.g. from emails) without
+// granting bucket access. The first key signs; all keys verify, which allows
+// rotating keys without breaking links already sent.
+type DownloadSigner struct {
+	keys     [][]byte
+	maxTTL   time.Duration
+	required bool
+	baseURL  string
+}
+
+// NewDownloadSigner creates a signer from config, or returns nil when no key is configured
+func NewDownloadSigner(cfg DownloadSigningConfig) *DownloadSigner {
+	if len(cfg.Keys) == 0 {
+		return nil
+	}
+	keys := make([][]byte, len(cfg.Keys))
+	for i, key := range cfg.Keys {
+		keys[i] = []byte(key)
+	}
+	return &DownloadSigner{keys: keys, maxTTL: cfg.MaxTTL, required: cfg.Required, baseURL: cfg.BaseURL}
+}
+
+// downloadSignature returns the base64url HMAC-SHA256 of bucket, name and expiry under key
+func downloadSignature(key []byte, bucket, name string, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%d", bucket, name, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// URL returns the signed proxy URL of an object mounted at mountPath (e.g. "/images/")
+func (s *DownloadSigner) URL(bucket, mountPath, name string, expires time.Time) string {
+	return s.baseURL + mountPath + objectURLPath(name) + "?" + s.query(bucket, name, expires)
+}
+
+// query returns the expires and sig parameters of a signed download URL
+func (s *DownloadSigner) query(bucket, name string, expires time.Time) string {
+	query := url.Values{
+		downloadExpiresParam:   {strconv.FormatInt(expires.Unix(), 10)},
+		downloadSignatureParam: {downloadSignature(s.keys[0], bucket, name, expires.Unix())},
+	}
+	return query.Encode()
+}
+
+// requiring returns a signer that rejects unsigned requests, for buckets
+// whose objects are only reachable through the download proxy
+func (s *DownloadSigner) requiring() *DownloadSigner {
+	if s == nil {
+		return nil
+	}
+	required := *s
+	required.required = true
+	return &required
+}
+
+// Verify checks the signature of a download request. Unsigned requests pass
+// unless signatures are required. A nil signer accepts every request.
+func (s *DownloadSigner) Verify(bucket, name string, query url.Values) error {
+	if s == nil {
+		return nil
+	}
+	sig := query.Get(downloadSignatureParam)
+	if sig == "" {
+		if s.required {
+			return errDownloadURLMissing
+		}
+		return nil
+	}
+
+	expires, err := strconv.ParseInt(query.Get(downloadExpiresParam), 10, 64)
+	if err != nil {
+		return errDownloadURLInvalid
+	}
+	for _, key := range s.keys {
+		if hmac.Equal([]byte(sig), []byte(downloadSignature(key, bucket, name, expires))) {
+			if time.Now().Unix() > expires {
+				return errDownloadURLExpired
+			}
+			return nil
+		}
+	}
+	return errDownloadURLInvalid
+}
+
+// DownloadURLRequest asks for a signed download URL
+type DownloadURLRequest struct {
+	Object    string `json:"object"`
+	ExpiresIn string `json:"expiresIn,omitempty"` // Go duration, e.g. "168h"; defaults to 7 days or the maximum
+	Direct    bool   `json:"direct,omitempty"`    // sign a storage URL instead of a download proxy URL
+}
+
+// DownloadURLResponse is a signed download URL
+type DownloadURLResponse struct {
+	Success   bool      `json:"success"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// HandleGenerateDownloadUrl signs a download proxy URL for an existing object,
+// or with direct a signed GET URL of the storage service, which is taken from
+// cache while it stays valid long enough
+func HandleGenerateDownloadUrl(backend Backend, signer *DownloadSigner, cache *signedURLCache, mountPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "Method not allowed. Use POST.",
+			})
+			return
+		}
+
+		var req DownloadURLRequest
+		if err := decodeJSONBody(w, r, &req, 0); err != nil {
+			w.WriteHeader(err.Status)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   err.Message,
+			})
+			return
+		}
+		if req.Object == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "object is required",
+			})
+			return
+		}
+
+		ttl := min(defaultDownloadURLTTL, signer.maxTTL)
+		if req.ExpiresIn != "" {
+			parsed, err := time.ParseDuration(req.ExpiresIn)
+			if err != nil || parsed <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   "expiresIn must be a positive duration, e.g. 168h",
+				})
+				return
+			}
+			ttl = parsed
+		}
+		if ttl > signer.maxTTL {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   fmt.Sprintf("expiresIn exceeds the maximum of %s", signer.maxTTL),
+			})
+			return
+		}
+
+		// Quarantined and staged objects aren't served, so they get no links either
+		_, err := backend.Stat(r.Context(), req.Object)
+		if err == nil && hiddenObject(req.Object) {
+			err = ErrObjectNotFound
+		}
+		if err != nil {
+			status, message := http.StatusInternalServerError, fmt.Sprintf("Failed to look up object: %v", err)
+			if errors.Is(err, ErrObjectNotFound) {
+				status, message = http.StatusNotFound, "Object not found"
+			}
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   message,
+			})
+			return
+		}
+
+		if req.Direct {
+			if ttl > maxDirectDownloadTTL {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   fmt.Sprintf("expiresIn exceeds the maximum of %s for direct URLs", maxDirectDownloadTTL),
+				})
+				return
+			}
+			opts := SignOptions{Expires: ttl}
+			url, expiresAt, err := cache.SignedURL(backend, http.MethodGet, req.Object, opts)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   "Failed to generate signed URL: " + err.Error(),
+				})
+				return
+			}
+			recordSignedURL(r, backend, http.MethodGet, req.Object, opts)
+			json.NewEncoder(w).Encode(DownloadURLResponse{
+				Success:   true,
+				URL:       url,
+				ExpiresAt: expiresAt.Truncate(time.Second),
+			})
+			return
+		}
+
+		expires := time.Now().Add(ttl).Truncate(time.Second)
+		json.NewEncoder(w).Encode(DownloadURLResponse{
+			Success:   true,
+			URL:       signer.URL(backend.Bucket(), mountPath, req.Object, expires),
+			ExpiresAt: expires,
+		})
+	}
+}
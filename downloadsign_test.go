@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testDownloadSigner() *DownloadSigner {
+	return NewDownloadSigner(DownloadSigningConfig{Keys: []string{"new-key", "old-key"}, MaxTTL: 30 * 24 * time.Hour})
+}
+
+// testDownloadBackend holds a published, a staged and a quarantined object
+func testDownloadBackend(t *testing.T) *mockBackend {
+	t.Helper()
+	staging, quarantine = &Staging{prefix: "staging/"}, &Quarantine{prefix: "quarantine/"}
+	t.Cleanup(func() { staging, quarantine = nil, nil })
+	backend := newMockBackend()
+	for _, name := range []string{"cat.jpg", "staging/new.jpg", "quarantine/bad.jpg"} {
+		backend.Put(context.Background(), name, strings.NewReader("x"), PutOptions{ContentType: "image/jpeg"})
+	}
+	return backend
+}
+
+// requestDownloadURL posts a /downloadurl request and decodes the response
+func requestDownloadURL(handler http.HandlerFunc, body string) (int, DownloadURLResponse) {
+	req := httptest.NewRequest(http.MethodPost, "/downloadurl", bytes.NewReader([]byte(body)))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	var resp DownloadURLResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	return rec.Code, resp
+}
+
+func TestHandleGenerateDownloadUrlDirect(t *testing.T) {
+	handler := HandleGenerateDownloadUrl(testDownloadBackend(t), testDownloadSigner(), newSignedURLCache(10, 5*time.Minute), "/images/")
+
+	status, first := requestDownloadURL(handler, `{"object":"cat.jpg","direct":true}`)
+	if status != http.StatusOK || first.URL == "" || strings.Contains(first.URL, downloadSignatureParam+"=") {
+		t.Fatalf("direct URL: status %d, %+v", status, first)
+	}
+	if _, second := requestDownloadURL(handler, `{"object":"cat.jpg","direct":true}`); second.URL != first.URL || !second.ExpiresAt.Equal(first.ExpiresAt) {
+		t.Errorf("second direct URL %+v, want the cached %+v", second, first)
+	}
+	if status, _ := requestDownloadURL(handler, `{"object":"cat.jpg","direct":true,"expiresIn":"169h"}`); status != http.StatusBadRequest {
+		t.Errorf("direct URL over 7 days: status %d, want 400", status)
+	}
+}
+
+func TestHandleGenerateDownloadUrlHiddenObjects(t *testing.T) {
+	handler := HandleGenerateDownloadUrl(testDownloadBackend(t), testDownloadSigner(), newSignedURLCache(10, 5*time.Minute), "/images/")
+	for _, object := range []string{"staging/new.jpg", "quarantine/bad.jpg", "missing.jpg"} {
+		for _, direct := range []string{"true", "false"} {
+			body := `{"object":"` + object + `","direct":` + direct + `}`
+			if status, resp := requestDownloadURL(handler, body); status != http.StatusNotFound || resp.URL != "" {
+				t.Errorf("%s: status %d, URL %q, want 404 without a URL", body, status, resp.URL)
+			}
+		}
+	}
+}
+
+func TestDownloadSignerVerify(t *testing.T) {
+	signer := testDownloadSigner()
+	expires := time.Now().Add(time.Hour)
+	signed := func(s *DownloadSigner, bucket, name string, expires time.Time) url.Values {
+		query, _ := url.ParseQuery(s.query(bucket, name, expires))
+		return query
+	}
+	tampered := func(query url.Values, param, value string) url.Values {
+		query.Set(param, value)
+		return query
+	}
+	oldKey := NewDownloadSigner(DownloadSigningConfig{Keys: []string{"old-key"}})
+	strangerKey := NewDownloadSigner(DownloadSigningConfig{Keys: []string{"stranger-key"}})
+
+	tests := []struct {
+		name   string
+		signer *DownloadSigner
+		object string
+		query  url.Values
+		want   error
+	}{
+		{"valid", signer, "cat.jpg", signed(signer, "b", "cat.jpg", expires), nil},
+		{"signed with a rotated key", signer, "cat.jpg", signed(oldKey, "b", "cat.jpg", expires), nil},
+		{"expired", signer, "cat.jpg", signed(signer, "b", "cat.jpg", time.Now().Add(-time.Second)), errDownloadURLExpired},
+		{"tampered signature", signer, "cat.jpg", tampered(signed(signer, "b", "cat.jpg", expires), downloadSignatureParam, "AAAA"), errDownloadURLInvalid},
+		{"tampered object name", signer, "dog.jpg", signed(signer, "b", "cat.jpg", expires), errDownloadURLInvalid},
+		{"extended expiry", signer, "cat.jpg", tampered(signed(signer, "b", "cat.jpg", expires), downloadExpiresParam, "99999999999"), errDownloadURLInvalid},
+		{"malformed expiry", signer, "cat.jpg", tampered(signed(signer, "b", "cat.jpg", expires), downloadExpiresParam, "soon"), errDownloadURLInvalid},
+		{"other bucket", signer, "cat.jpg", signed(signer, "other", "cat.jpg", expires), errDownloadURLInvalid},
+		{"unknown key", signer, "cat.jpg", signed(strangerKey, "b", "cat.jpg", expires), errDownloadURLInvalid},
+		{"unsigned", signer, "cat.jpg", url.Values{}, nil},
+		{"unsigned when required", signer.requiring(), "cat.jpg", url.Values{}, errDownloadURLMissing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.signer.Verify("b", tt.object, tt.query); err != tt.want {
+				t.Errorf("Verify() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleDownloadSignedHiddenObjects(t *testing.T) {
+	backend := testDownloadBackend(t)
+	signer := testDownloadSigner().requiring()
+	handler := http.StripPrefix("/images/", HandleDownload(backend, signer, nil, nil))
+	expires := time.Now().Add(time.Hour)
+
+	for name, want := range map[string]int{
+		"cat.jpg":            http.StatusOK,
+		"staging/new.jpg":    http.StatusNotFound,
+		"quarantine/bad.jpg": http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, signer.URL(backend.Bucket(), "/images/", name, expires), nil))
+		if rec.Code != want {
+			t.Errorf("signed download of %s: status %d, want %d", name, rec.Code, want)
+		}
+	}
+}
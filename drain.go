@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// defaultDrainTimeout bounds draining when the bus is closed without a deadline
+const defaultDrainTimeout = 20 * time.Second
+
+// Drain states
+const (
+	DrainRunning  = "running"
+	DrainDraining = "draining"
+	DrainDrained  = "drained"
+)
+
+// DrainStatus reports the progress of the event queue, before and during
+// shutdown. Counters are since the process started.
+type DrainStatus struct {
+	State      string    `json:"state"`
+	Queued     int64     `json:"queued"`    // waiting for or in delivery
+	Delivered  int64     `json:"delivered"` // run through the sinks in-process
+	Deferred   int64     `json:"deferred"`  // handed to Cloud Tasks
+	Spooled    int64     `json:"spooled"`   // written to the spool for the next start
+	StartedAt  time.Time `json:"startedAt,omitzero"`
+	FinishedAt time.Time `json:"finishedAt,omitzero"`
+}
+
+// eventSpool is an append-only JSONL file of events that couldn't be
+// delivered, replayed by the next process that opens it
+type eventSpool struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// spoolFile is the name of the spool in the spool directory; it is renamed
+// to replayFile while being replayed so new events don't end up in it
+const (
+	spoolFile  = "events.jsonl"
+	replayFile = "events.replay.jsonl"
+)
+
+// EnableSpool persists events that can't be delivered in time to dir and
+// republishes the events spooled by the previous process. Call it once the
+// sinks are registered.
+func (b *EventBus) EnableSpool(dir string) (int, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 0, fmt.Errorf("failed to create event spool directory: %w", err)
+	}
+
+	replay := filepath.Join(dir, replayFile)
+	path := filepath.Join(dir, spoolFile)
+	// A replay interrupted by a crash is picked up before the newer spool
+	if _, err := os.Stat(replay); os.IsNotExist(err) {
+		if err := os.Rename(path, replay); err != nil && !os.IsNotExist(err) {
+			return 0, fmt.Errorf("failed to open event spool: %w", err)
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open event spool: %w", err)
+	}
+	b.mu.Lock()
+	b.spool = &eventSpool{file: file}
+	b.mu.Unlock()
+
+	replayed, err := b.replay(replay)
+	if err != nil {
+		return replayed, err
+	}
+	if err := os.Remove(replay); err != nil && !os.IsNotExist(err) {
+		return replayed, err
+	}
+	return replayed, nil
+}
+
+// replay republishes the events of a spool file
+func (b *EventBus) replay(path string) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open event spool: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	replayed := 0
+	for scanner.Scan() {
+		var event AssetEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// A torn final write only loses that one event
+			log.Printf("⚠️  Skipping corrupt spooled event: %v", err)
+			continue
+		}
+		// Events beyond the queue size go straight back to the spool
+		b.Publish(event)
+		replayed++
+	}
+	return replayed, scanner.Err()
+}
+
+// spoolEvent writes an event to the spool, dropping it when there is none
+func (b *EventBus) spoolEvent(event AssetEvent) {
+	b.mu.RLock()
+	spool := b.spool
+	b.mu.RUnlock()
+	if spool == nil {
+		eventsDroppedTotal.Inc()
+		return
+	}
+
+	if err := spool.append(event); err != nil {
+		log.Printf("⚠️  Failed to spool %s event of %s/%s: %v", event.Type, event.Bucket, event.Object, err)
+		eventsDroppedTotal.Inc()
+		return
+	}
+	b.spooled.Add(1)
+}
+
+// persist keeps an event that can't be delivered before shutdown: Cloud Tasks
+// when a queue is configured, the spool otherwise
+func (b *EventBus) persist(event AssetEvent) {
+	b.mu.RLock()
+	deferrer := b.deferrer
+	b.mu.RUnlock()
+
+	if deferrer != nil && !b.deferDown.Load() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		_, err := b.enqueue(ctx, deferrer, event)
+		cancel()
+		if err == nil {
+			b.deferred.Add(1)
+			return
+		}
+		// Don't spend the rest of the deadline on a queue that is down. The
+		// spool replays the event to every sink, including any whose task
+		// was created.
+		b.deferDown.Store(true)
+		eventSinkErrorsTotal.WithLabelValues("deferrer").Inc()
+		log.Printf("⚠️  Failed to defer event while draining, spooling the rest: %v", err)
+	}
+	b.spoolEvent(event)
+}
+
+func (s *eventSpool) append(event AssetEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+func (s *eventSpool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// Drain stops accepting events into the queue and delivers the queued ones
+// until ctx is done; the rest are persisted. Events published from then on
+// are spooled. It returns once every queued event is delivered or persisted.
+func (b *EventBus) Drain(ctx context.Context) DrainStatus {
+	b.drained.Do(func() {
+		b.sendMu.Lock()
+		b.draining = true
+		close(b.queue)
+		b.sendMu.Unlock()
+
+		b.drainMu.Lock()
+		b.drainInfo.StartedAt = time.Now().UTC()
+		b.drainMu.Unlock()
+		log.Printf("⏳ Draining %d queued event(s)", b.pending.Load())
+
+		select {
+		case <-b.done:
+		case <-ctx.Done():
+			close(b.hurry)
+			<-b.done
+		}
+
+		b.drainMu.Lock()
+		b.drainInfo.FinishedAt = time.Now().UTC()
+		b.drainMu.Unlock()
+		status := b.Status()
+		log.Printf("✅ Event queue drained: %d delivered, %d deferred, %d spooled", status.Delivered, status.Deferred, status.Spooled)
+	})
+	<-b.done
+	return b.Status()
+}
+
+// Draining reports whether the bus stopped accepting events into its queue
+func (b *EventBus) Draining() bool {
+	b.sendMu.RLock()
+	defer b.sendMu.RUnlock()
+	return b.draining
+}
+
+// Status returns the state and counters of the event queue
+func (b *EventBus) Status() DrainStatus {
+	b.drainMu.Lock()
+	status := b.drainInfo
+	b.drainMu.Unlock()
+
+	switch {
+	case !status.FinishedAt.IsZero():
+		status.State = DrainDrained
+	case !status.StartedAt.IsZero():
+		status.State = DrainDraining
+	default:
+		status.State = DrainRunning
+	}
+	status.Queued = b.pending.Load()
+	status.Delivered = b.delivered.Load()
+	status.Deferred = b.deferred.Load()
+	status.Spooled = b.spooled.Load()
+	return status
+}
+
+// DrainResponse is returned by the drain endpoint
+type DrainResponse struct {
+	Success bool         `json:"success"`
+	Status  *DrainStatus `json:"status,omitempty"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// HandleDrain serves the event queue drain:
+//   - GET /admin/drain returns the queue status
+//   - POST /admin/drain starts draining ahead of shutdown (e.g. from a
+//     preStop hook) and returns at once; poll GET until the state is drained
+func HandleDrain(bus *EventBus, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if !bus.Draining() {
+				log.Println("⏳ Drain requested through the admin API")
+				go func() {
+					ctx, cancel := context.WithTimeout(context.Background(), timeout)
+					defer cancel()
+					bus.Drain(ctx)
+				}()
+			}
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(DrainResponse{
+				Success: false,
+				Error:   "Method not allowed. Use GET or POST.",
+			})
+			return
+		}
+
+		status := bus.Status()
+		json.NewEncoder(w).Encode(DrainResponse{
+			Success: true,
+			Status:  &status,
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// mailgunMaxSkew is how old a Mailgun webhook signature may be
+const mailgunMaxSkew = 5 * time.Minute
+
+// EmailInConfig holds the settings of the inbound email webhook
+type EmailInConfig struct {
+	Token             string   // shared secret in the webhook URL (?token=)
+	MailgunSigningKey string   // verifies Mailgun's webhook signature instead of the token
+	AllowedSenders    []string // addresses or @domains accepted, empty for any sender
+	Bucket            string   // bucket attachments are ingested into, "" for the first bucket
+	Tenant            string   // tenant recorded with the ingested assets
+	MaxSize           int64    // size limit of a whole message in bytes
+}
+
+// Enabled reports whether the webhook can authenticate requests
+func (c EmailInConfig) Enabled() bool {
+	return c.Token != "" || c.MailgunSigningKey != ""
+}
+
+// senderAllowed reports whether an address matches the allowed senders
+func (c EmailInConfig) senderAllowed(address string) bool {
+	if len(c.AllowedSenders) == 0 {
+		return true
+	}
+	address = strings.ToLower(address)
+	for _, allowed := range c.AllowedSenders {
+		allowed = strings.ToLower(allowed)
+		if address == allowed || (strings.HasPrefix(allowed, "@") && strings.HasSuffix(address, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// InboundEmailResponse is the result of an inbound email
+type InboundEmailResponse struct {
+	Success bool   `json:"success"`
+	Sender  string `json:"sender,omitempty"`
+	*ImportResult
+	Error string `json:"error,omitempty"`
+}
+
+// HandleInboundEmail ingests the image attachments of emails forwarded by
+// the Mailgun (Routes, forward) or SendGrid (Inbound Parse) webhooks. Both
+// post the parsed message as multipart form data: the sender in "sender" or
+// "from", the subject in "subject" and each attachment as a file field.
+// Attachments go through the same validation and processing as imports,
+// with the sender address recorded as their uploader.
+func HandleInboundEmail(backend Backend, config *Config) http.HandlerFunc {
+	cfg := config.EmailIn
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(InboundEmailResponse{
+				Success: false,
+				Error:   "Method not allowed. Use POST.",
+			})
+			return
+		}
+
+		// The token is checked before the body is read, so unauthenticated
+		// requests don't get a message buffered to disk. Mailgun signatures
+		// are form fields and can only be checked after parsing.
+		tokenValid := cfg.tokenValid(r)
+		if !tokenValid && cfg.MailgunSigningKey == "" {
+			inboundEmailUnauthorized(w)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxSize)
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(InboundEmailResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Invalid inbound email: %v", err),
+			})
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+
+		if !tokenValid && !cfg.mailgunSigned(r) {
+			inboundEmailUnauthorized(w)
+			return
+		}
+
+		sender, err := emailSender(r)
+		if err == nil && !senderVerified(r, sender.Address) {
+			inboundEmailsTotal.WithLabelValues("unverified").Inc()
+			log.Printf("🚫 Inbound email from %q failed SPF and DKIM", sender.Address)
+			w.WriteHeader(http.StatusNotAcceptable)
+			json.NewEncoder(w).Encode(InboundEmailResponse{
+				Success: false,
+				Error:   "Sender could not be verified with SPF or DKIM",
+			})
+			return
+		}
+		if err != nil || !cfg.senderAllowed(sender.Address) {
+			inboundEmailsTotal.WithLabelValues("rejected").Inc()
+			log.Printf("🚫 Inbound email from %q rejected", r.FormValue("from"))
+			// 406 tells Mailgun not to retry
+			w.WriteHeader(http.StatusNotAcceptable)
+			json.NewEncoder(w).Encode(InboundEmailResponse{
+				Success: false,
+				Error:   "Sender not allowed",
+			})
+			return
+		}
+
+		im := newImporter(backend, config, cfg.Tenant)
+		im.source = SourceEmail
+		if uploaderIDPattern.MatchString(sender.Address) {
+			im.uploader = sender.Address
+		}
+		im.metadata = emailMetadata(sender, r.FormValue("subject"))
+
+		for _, header := range emailAttachments(r.MultipartForm) {
+			if err := r.Context().Err(); err != nil {
+				break
+			}
+			im.importFile(r.Context(), header.Filename, header.Size, func() (io.ReadCloser, error) {
+				return header.Open()
+			})
+		}
+
+		result := im.finish()
+		inboundEmailsTotal.WithLabelValues("accepted").Inc()
+		log.Printf("📧 Inbound email from %s into %s: imported %d, deduplicated %d, skipped %d, failed %d", sender.Address, backend.Bucket(), result.Imported, result.Deduplicated, result.Skipped, result.Failed)
+		// Failed attachments are reported rather than retried: a redelivery
+		// would ingest the successful ones again
+		json.NewEncoder(w).Encode(InboundEmailResponse{
+			Success:      true,
+			Sender:       sender.Address,
+			ImportResult: result,
+		})
+	}
+}
+
+// inboundEmailUnauthorized answers a webhook request without a valid token or signature
+func inboundEmailUnauthorized(w http.ResponseWriter) {
+	inboundEmailsTotal.WithLabelValues("unauthorized").Inc()
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(InboundEmailResponse{
+		Success: false,
+		Error:   "Invalid webhook token or signature",
+	})
+}
+
+// tokenValid checks the token of the webhook URL
+func (c EmailInConfig) tokenValid(r *http.Request) bool {
+	return c.Token != "" && hmac.Equal([]byte(r.URL.Query().Get("token")), []byte(c.Token))
+}
+
+// mailgunSigned checks the Mailgun signature of a parsed webhook request
+func (c EmailInConfig) mailgunSigned(r *http.Request) bool {
+	if c.MailgunSigningKey == "" || r.FormValue("signature") == "" {
+		return false
+	}
+	timestamp := r.FormValue("timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(seconds, 0)).Abs() > mailgunMaxSkew {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(c.MailgunSigningKey))
+	mac.Write([]byte(timestamp + r.FormValue("token")))
+	return hmac.Equal([]byte(r.FormValue("signature")), []byte(hex.EncodeToString(mac.Sum(nil))))
+}
+
+// senderVerified reports whether the provider that received an email
+// verified its sender: SPF passed for the sender's domain, or a DKIM
+// signature validated. Mailgun reports the verdicts in the X-Mailgun-Spf and
+// X-Mailgun-Dkim-Check-Result headers, SendGrid in the SPF and dkim fields.
+// Without a verdict the sender is not trusted.
+func senderVerified(r *http.Request, address string) bool {
+	domain := strings.ToLower(address[strings.LastIndex(address, "@")+1:])
+
+	// Mailgun checks SPF for the envelope sender, which is the address used
+	if strings.EqualFold(mailgunHeader(r, "X-Mailgun-Spf"), "pass") ||
+		strings.EqualFold(mailgunHeader(r, "X-Mailgun-Dkim-Check-Result"), "pass") {
+		return true
+	}
+
+	// SendGrid checks SPF for the envelope sender, so it only vouches for the
+	// From address when both are of the same domain
+	if strings.EqualFold(strings.TrimSpace(r.FormValue("SPF")), "pass") {
+		var envelope struct {
+			From string `json:"from"`
+		}
+		if json.Unmarshal([]byte(r.FormValue("envelope")), &envelope) == nil &&
+			strings.HasSuffix(strings.ToLower(envelope.From), "@"+domain) {
+			return true
+		}
+	}
+	// dkim lists the signing domains with their result: "{@example.com : pass, @mailer.net : fail}"
+	for _, result := range strings.Split(strings.Trim(r.FormValue("dkim"), "{} "), ",") {
+		signer, verdict, ok := strings.Cut(result, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(verdict), "pass") &&
+			strings.EqualFold(strings.TrimPrefix(strings.TrimSpace(signer), "@"), domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// mailgunHeader returns a header Mailgun added to a forwarded message. It is
+// posted as a form field, and in the message-headers list.
+func mailgunHeader(r *http.Request, name string) string {
+	if value := r.FormValue(name); value != "" {
+		return strings.TrimSpace(value)
+	}
+	var headers [][2]string
+	if json.Unmarshal([]byte(r.FormValue("message-headers")), &headers) != nil {
+		return ""
+	}
+	for _, header := range headers {
+		if strings.EqualFold(header[0], name) {
+			return strings.TrimSpace(header[1])
+		}
+	}
+	return ""
+}
+
+// emailSender returns the sender of an inbound email: Mailgun's envelope
+// "sender", or the From header SendGrid posts as "from"
+func emailSender(r *http.Request) (*mail.Address, error) {
+	from := r.FormValue("sender")
+	if from == "" {
+		from = r.FormValue("from")
+	}
+	return mail.ParseAddress(from)
+}
+
+// emailMetadata is stored with every attachment of an email
+func emailMetadata(sender *mail.Address, subject string) map[string]string {
+	metadata := map[string]string{}
+	for key, value := range map[string]string{"sender-name": sender.Name, "email-subject": subject} {
+		value = strings.TrimSpace(strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, value))
+		if len(value) > maxFormMetadataValue {
+			value = strings.ToValidUTF8(value[:maxFormMetadataValue], "")
+		}
+		if value != "" {
+			metadata[key] = value
+		}
+	}
+	return metadata
+}
+
+// emailAttachments returns the file fields of an inbound email sorted by
+// field name ("attachment-1", ... for Mailgun, "attachment1", ... for SendGrid)
+func emailAttachments(form *multipart.Form) []*multipart.FileHeader {
+	fields := make([]string, 0, len(form.File))
+	for field := range form.File {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var attachments []*multipart.FileHeader
+	for _, field := range fields {
+		attachments = append(attachments, form.File[field]...)
+	}
+	return attachments
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// inboundEmail builds a webhook request posting fields and the attachments
+// of an email, as Mailgun and SendGrid do
+func inboundEmail(t *testing.T, target string, fields map[string]string, attachments map[string][]byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for key, value := range fields {
+		form.WriteField(key, value)
+	}
+	i := 0
+	for name, content := range attachments {
+		i++
+		part, err := form.CreateFormFile("attachment-"+strconv.Itoa(i), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(content)
+	}
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, target, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+// mailgunFields returns the signature fields Mailgun adds to a webhook
+func mailgunFields(key string, at time.Time) map[string]string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + "random-token"))
+	return map[string]string{"timestamp": timestamp, "token": "random-token", "signature": hex.EncodeToString(mac.Sum(nil))}
+}
+
+func testEmailConfig() *Config {
+	return &Config{MaxFileSize: 1 << 20, EmailIn: EmailInConfig{
+		Token:             "webhook-token",
+		MailgunSigningKey: "mailgun-key",
+		AllowedSenders:    []string{"@field.example.com"},
+		MaxSize:           5 << 20,
+	}}
+}
+
+func postInboundEmail(handler http.HandlerFunc, req *http.Request) (int, InboundEmailResponse) {
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	var resp InboundEmailResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	return rec.Code, resp
+}
+
+func TestInboundEmailMailgun(t *testing.T) {
+	backend := newMockBackend()
+	handler := HandleInboundEmail(backend, testEmailConfig())
+
+	fields := mailgunFields("mailgun-key", time.Now())
+	fields["sender"] = "ana@field.example.com"
+	fields["subject"] = "Site 12"
+	fields["X-Mailgun-Spf"] = "Pass"
+	status, resp := postInboundEmail(handler, inboundEmail(t, "/inbound/email", fields, map[string][]byte{"site.png": testPNG(t)}))
+	if status != http.StatusOK || resp.ImportResult == nil || resp.Imported != 1 {
+		t.Fatalf("signed email: status %d, %+v", status, resp)
+	}
+	for name, info := range backend.objects {
+		if info.Metadata["email-subject"] != "Site 12" {
+			t.Errorf("%s stored with metadata %v, want the subject", name, info.Metadata)
+		}
+	}
+
+	for name, fields := range map[string]map[string]string{
+		"wrong key": mailgunFields("other-key", time.Now()),
+		"replayed":  mailgunFields("mailgun-key", time.Now().Add(-time.Hour)),
+		"tampered": func() map[string]string {
+			f := mailgunFields("mailgun-key", time.Now())
+			f["token"] = "other-token"
+			return f
+		}(),
+		"not signed": {},
+	} {
+		fields["sender"] = "ana@field.example.com"
+		fields["X-Mailgun-Spf"] = "Pass"
+		if status, _ := postInboundEmail(handler, inboundEmail(t, "/inbound/email", fields, map[string][]byte{"site.png": testPNG(t)})); status != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, want 401", name, status)
+		}
+	}
+}
+
+func TestInboundEmailSendGrid(t *testing.T) {
+	backend := newMockBackend()
+	handler := HandleInboundEmail(backend, testEmailConfig())
+	email := func(target, from, envelope string) *http.Request {
+		return inboundEmail(t, target, map[string]string{
+			"from":     from,
+			"envelope": envelope,
+			"SPF":      "pass",
+			"subject":  "Photos",
+		}, map[string][]byte{"site.png": testPNG(t), "notes.exe": []byte("MZ")})
+	}
+
+	// SendGrid Inbound Parse can't sign, so it posts to a URL with the token
+	status, resp := postInboundEmail(handler, email("/inbound/email?token=webhook-token", "Ana <ana@field.example.com>", `{"from":"bounce@field.example.com"}`))
+	if status != http.StatusOK || resp.Imported != 1 || resp.Skipped != 1 || resp.Sender != "ana@field.example.com" {
+		t.Fatalf("email with token: status %d, %+v", status, resp)
+	}
+
+	tests := []struct {
+		name     string
+		target   string
+		from     string
+		envelope string
+		want     int
+	}{
+		{"wrong token", "/inbound/email?token=guess", "ana@field.example.com", `{"from":"ana@field.example.com"}`, http.StatusUnauthorized},
+		{"sender not allowed", "/inbound/email?token=webhook-token", "eve@example.net", `{"from":"eve@example.net"}`, http.StatusNotAcceptable},
+		{"SPF of another domain", "/inbound/email?token=webhook-token", "ana@field.example.com", `{"from":"eve@example.net"}`, http.StatusNotAcceptable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, resp := postInboundEmail(handler, email(tt.target, tt.from, tt.envelope)); status != tt.want {
+				t.Errorf("status %d, want %d: %+v", status, tt.want, resp)
+			}
+		})
+	}
+	if len(backend.objects) != 1 {
+		t.Errorf("%d objects stored, want only the first email's image", len(backend.objects))
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Asset event types
+const (
+	EventUpload     = "upload"
+	EventDelete     = "delete"
+	EventQuarantine = "quarantine" // moved to quarantine, see quarantine.go
+	EventRelease    = "release"    // released from quarantine
+	EventPublish    = "publish"    // staged upload moved to its final name, see staging.go
+	EventRename     = "rename"     // moved to a new name, away from a revoked signed URL
+)
+
+// AssetEvent describes an operation on a stored asset
+type AssetEvent struct {
+	Type        string    `json:"type"`
+	Bucket      string    `json:"bucket"`
+	Object      string    `json:"object"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType,omitempty"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Uploader    string    `json:"uploader,omitempty"`
+	LatencyMs   float64   `json:"latencyMs"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// EventSink receives asset events (BigQuery, notifications, ...)
+type EventSink interface {
+	Name() string
+	Publish(ctx context.Context, event AssetEvent) error
+	Close() error
+}
+
+// EventDeferrer hands events to an external queue (e.g. Cloud Tasks) which
+// later delivers them back to the named sink through DeliverTo
+type EventDeferrer interface {
+	Enqueue(ctx context.Context, event AssetEvent, sink string) error
+}
+
+// EventBus fans asset events out to the registered sinks in the background so
+// slow sinks never add latency to requests. Events that can't be delivered
+// before shutdown are persisted, see drain.go.
+type EventBus struct {
+	mu       sync.RWMutex
+	sinks    []EventSink
+	deferrer EventDeferrer
+	spool    *eventSpool
+	queue    chan AssetEvent
+	done     chan struct{}
+	closed   sync.Once
+
+	// sendMu guards sending on queue against closing it in Drain
+	sendMu   sync.RWMutex
+	draining bool
+	hurry    chan struct{} // closed when the drain deadline passes
+	drained  sync.Once
+
+	pending   atomic.Int64 // queued or being delivered
+	delivered atomic.Int64
+	deferred  atomic.Int64
+	spooled   atomic.Int64
+	deferDown atomic.Bool // Cloud Tasks failed while draining, spool the rest
+	inline    atomic.Bool // deliver in Publish instead of the background, see SetInline
+	drainMu   sync.Mutex
+	drainInfo DrainStatus
+}
+
+const eventQueueSize = 1024
+
+// assetEvents is the process-wide event bus; sinks are registered in main
+var assetEvents = NewEventBus()
+
+// NewEventBus creates an event bus and starts its delivery goroutine
+func NewEventBus() *EventBus {
+	bus := &EventBus{
+		queue: make(chan AssetEvent, eventQueueSize),
+		done:  make(chan struct{}),
+		hurry: make(chan struct{}),
+	}
+	go bus.run()
+	return bus
+}
+
+// AddSink registers a sink for all future events
+func (b *EventBus) AddSink(sink EventSink) {
+	b.mu.Lock()
+	b.sinks = append(b.sinks, sink)
+	b.mu.Unlock()
+	log.Printf("📣 Event sink enabled: %s", sink.Name())
+}
+
+// HasSink reports whether a sink with the name is registered
+func (b *EventBus) HasSink(name string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return slices.ContainsFunc(b.sinks, func(sink EventSink) bool { return sink.Name() == name })
+}
+
+// SetDeferrer routes events through an external queue instead of delivering them in-process
+func (b *EventBus) SetDeferrer(deferrer EventDeferrer) {
+	b.mu.Lock()
+	b.deferrer = deferrer
+	b.mu.Unlock()
+}
+
+// SetInline makes Publish deliver (or hand to Cloud Tasks) each event before
+// it returns, for platforms such as Cloud Run that throttle the CPU outside of
+// requests, where background delivery would stall until the next request
+func (b *EventBus) SetInline(inline bool) {
+	b.inline.Store(inline)
+}
+
+// Publish queues an event for delivery. When the queue is full or the bus
+// is draining, the event is spooled to disk, or dropped without a spool.
+func (b *EventBus) Publish(event AssetEvent) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+
+	if b.inline.Load() && !b.Draining() {
+		b.process(event)
+		return
+	}
+
+	b.sendMu.RLock()
+	if !b.draining {
+		b.pending.Add(1)
+		select {
+		case b.queue <- event:
+			b.sendMu.RUnlock()
+			return
+		default:
+			b.pending.Add(-1)
+		}
+	}
+	b.sendMu.RUnlock()
+	b.spoolEvent(event)
+}
+
+// Close drains the queue within the default drain timeout and closes all sinks
+func (b *EventBus) Close() {
+	b.closed.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultDrainTimeout)
+		b.Drain(ctx)
+		cancel()
+
+		b.mu.RLock()
+		defer b.mu.RUnlock()
+		for _, sink := range b.sinks {
+			if err := sink.Close(); err != nil {
+				log.Printf("⚠️  Failed to close event sink %s: %v", sink.Name(), err)
+			}
+		}
+		if b.spool != nil {
+			if err := b.spool.Close(); err != nil {
+				log.Printf("⚠️  Failed to close event spool: %v", err)
+			}
+		}
+	})
+}
+
+func (b *EventBus) run() {
+	defer close(b.done)
+	for event := range b.queue {
+		select {
+		case <-b.hurry:
+			// Out of time while draining: keep the rest for later
+			b.persist(event)
+			b.pending.Add(-1)
+			continue
+		default:
+		}
+
+		b.process(event)
+		b.pending.Add(-1)
+	}
+}
+
+// process hands an event to Cloud Tasks when enabled for its tenant and
+// delivers it to the sinks otherwise
+func (b *EventBus) process(event AssetEvent) {
+	b.mu.RLock()
+	deferrer := b.deferrer
+	b.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if deferrer != nil && featureFlags.Enabled(FlagAsync, event.Tenant) {
+		failed, err := b.enqueue(ctx, deferrer, event)
+		if err == nil {
+			b.deferred.Add(1)
+			return
+		}
+		// Fall back to in-process delivery rather than losing the event
+		eventSinkErrorsTotal.WithLabelValues("deferrer").Inc()
+		log.Printf("⚠️  Failed to defer event to %s, delivering in-process: %v", strings.Join(failed, ", "), err)
+		b.DeliverTo(ctx, event, failed)
+		b.delivered.Add(1)
+		return
+	}
+	b.Deliver(ctx, event)
+	b.delivered.Add(1)
+}
+
+// enqueue hands an event to the deferrer as one task per sink, so the queue
+// retries a failing sink alone instead of running the others again. It
+// returns the sinks whose task couldn't be created and the first error.
+func (b *EventBus) enqueue(ctx context.Context, deferrer EventDeferrer, event AssetEvent) ([]string, error) {
+	b.mu.RLock()
+	sinks := b.sinks
+	b.mu.RUnlock()
+
+	var failed []string
+	var firstErr error
+	for _, sink := range sinks {
+		if err := deferrer.Enqueue(ctx, event, sink.Name()); err != nil {
+			failed = append(failed, sink.Name())
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return failed, firstErr
+}
+
+// Deliver runs every sink for the event and returns the first error
+func (b *EventBus) Deliver(ctx context.Context, event AssetEvent) error {
+	return b.DeliverTo(ctx, event, nil)
+}
+
+// DeliverTo runs the named sinks, or every sink when names is empty, for the
+// event and returns the first error
+func (b *EventBus) DeliverTo(ctx context.Context, event AssetEvent, names []string) error {
+	b.mu.RLock()
+	sinks := b.sinks
+	b.mu.RUnlock()
+
+	var firstErr error
+	for _, sink := range sinks {
+		if len(names) > 0 && !slices.Contains(names, sink.Name()) {
+			continue
+		}
+		if err := sink.Publish(ctx, event); err != nil {
+			eventSinkErrorsTotal.WithLabelValues(sink.Name()).Inc()
+			log.Printf("⚠️  Event sink %s failed: %v", sink.Name(), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// PublishEvent records an asset event in the operation log and publishes it
+// on the process-wide bus
+func PublishEvent(event AssetEvent) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+	if err := operationLog.Append(OperationEntry{Op: OperationEvent, Event: &event}); err != nil {
+		log.Printf("⚠️  Failed to log %s event of %s/%s: %v", event.Type, event.Bucket, event.Object, err)
+	}
+	assetEvents.Publish(event)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exifReadLimit is how much of an object is read for its EXIF data and
+// dimensions; both come before the image data, and EXIF is capped at 64 KB
+const exifReadLimit = 256 * 1024
+
+// TIFF tags read from IFD0 and the EXIF sub-IFD
+const (
+	tagMake               = 0x010F
+	tagModel              = 0x0110
+	tagSoftware           = 0x0131
+	tagArtist             = 0x013B
+	tagCopyright          = 0x8298
+	tagExifIFD            = 0x8769
+	tagExposureTime       = 0x829A
+	tagFNumber            = 0x829D
+	tagISO                = 0x8827
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagFocalLength        = 0x920A
+	tagPixelXDimension    = 0xA002
+	tagPixelYDimension    = 0xA003
+	tagLensModel          = 0xA434
+)
+
+// exifDateLayout is the format of EXIF date tags
+const exifDateLayout = "2006:01:02 15:04:05"
+
+// ExifResponse is the camera and capture metadata of one object
+type ExifResponse struct {
+	Success     bool   `json:"success"`
+	Object      string `json:"object,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	// Orientation is the EXIF orientation (1-8); 1 is upright. Photos rotated
+	// at upload have it reset to 1.
+	Orientation int    `json:"orientation,omitempty"`
+	Make        string `json:"make,omitempty"`
+	Model       string `json:"model,omitempty"`
+	Lens        string `json:"lens,omitempty"`
+	Software    string `json:"software,omitempty"`
+	Artist      string `json:"artist,omitempty"`
+	Copyright   string `json:"copyright,omitempty"`
+	// CapturedAt is when the photo was taken, in RFC 3339 when the camera
+	// recorded its UTC offset and in local camera time without a zone otherwise
+	CapturedAt   string  `json:"capturedAt,omitempty"`
+	ExposureTime string  `json:"exposureTime,omitempty"` // e.g. "1/250"
+	FNumber      float64 `json:"fNumber,omitempty"`
+	ISO          int     `json:"iso,omitempty"`
+	FocalLength  float64 `json:"focalLength,omitempty"` // millimetres
+	Error        string  `json:"error,omitempty"`
+}
+
+// tiffReader reads tags from the TIFF structure of an EXIF payload
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// newTiffReader checks the TIFF header of an APP1 EXIF payload
+func newTiffReader(payload []byte) (*tiffReader, bool) {
+	if !bytes.HasPrefix(payload, exifSignature) {
+		return nil, false
+	}
+	tiff := payload[len(exifSignature):]
+	if len(tiff) < 8 {
+		return nil, false
+	}
+	switch string(tiff[0:2]) {
+	case "II":
+		return &tiffReader{data: tiff, order: binary.LittleEndian}, true
+	case "MM":
+		return &tiffReader{data: tiff, order: binary.BigEndian}, true
+	}
+	return nil, false
+}
+
+// tiffTypeSizes are the byte sizes of the TIFF field types
+var tiffTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+// ifd calls fn with the tag, type and value bytes of every entry of
+// the IFD at offset. Malformed entries are skipped.
+func (t *tiffReader) ifd(offset int, fn func(tag, kind uint16, value []byte)) {
+	if offset < 8 || offset+2 > len(t.data) {
+		return
+	}
+	entries := int(t.order.Uint16(t.data[offset : offset+2]))
+	for i := 0; i < entries; i++ {
+		entry := offset + 2 + 12*i
+		if entry+12 > len(t.data) {
+			return
+		}
+		tag, kind := t.order.Uint16(t.data[entry:entry+2]), t.order.Uint16(t.data[entry+2:entry+4])
+		count := int(t.order.Uint32(t.data[entry+4 : entry+8]))
+		size := tiffTypeSizes[kind] * count
+		if size == 0 || count > len(t.data) {
+			continue
+		}
+		value := t.data[entry+8 : entry+12]
+		if size > 4 {
+			start := int(t.order.Uint32(value))
+			if start < 0 || start+size > len(t.data) {
+				continue
+			}
+			value = t.data[start : start+size]
+		}
+		fn(tag, kind, value[:size])
+	}
+}
+
+// ascii returns an ASCII value without its NUL terminator and padding
+func (t *tiffReader) ascii(value []byte) string {
+	if i := bytes.IndexByte(value, 0); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(string(value))
+}
+
+// integer returns a SHORT or LONG value
+func (t *tiffReader) integer(kind uint16, value []byte) int {
+	switch kind {
+	case 3:
+		return int(t.order.Uint16(value))
+	case 4:
+		return int(t.order.Uint32(value))
+	}
+	return 0
+}
+
+// rational returns the numerator and denominator of a RATIONAL value
+func (t *tiffReader) rational(kind uint16, value []byte) (uint32, uint32, bool) {
+	if kind != 5 || len(value) < 8 {
+		return 0, 0, false
+	}
+	num, den := t.order.Uint32(value[0:4]), t.order.Uint32(value[4:8])
+	return num, den, den != 0
+}
+
+// readExif fills the EXIF fields of response from an APP1 payload
+func readExif(payload []byte, response *ExifResponse) bool {
+	t, ok := newTiffReader(payload)
+	if !ok {
+		return false
+	}
+	var captured, offset string
+	exifIFD := 0
+	visit := func(tag, kind uint16, value []byte) {
+		switch tag {
+		case tagMake:
+			response.Make = t.ascii(value)
+		case tagModel:
+			response.Model = t.ascii(value)
+		case tagSoftware:
+			response.Software = t.ascii(value)
+		case tagArtist:
+			response.Artist = t.ascii(value)
+		case tagCopyright:
+			// The photographer's notice, before the editor's after a NUL
+			response.Copyright = t.ascii(value)
+		case exifOrientationTag:
+			if orientation := t.integer(kind, value); orientation >= 1 && orientation <= 8 {
+				response.Orientation = orientation
+			}
+		case tagExifIFD:
+			exifIFD = t.integer(kind, value)
+		case tagExposureTime:
+			if num, den, ok := t.rational(kind, value); ok && num > 0 {
+				if num < den {
+					response.ExposureTime = fmt.Sprintf("1/%d", int(math.Round(float64(den)/float64(num))))
+				} else {
+					response.ExposureTime = strconv.FormatFloat(float64(num)/float64(den), 'f', -1, 64)
+				}
+			}
+		case tagFNumber:
+			if num, den, ok := t.rational(kind, value); ok {
+				response.FNumber = math.Round(float64(num)/float64(den)*10) / 10
+			}
+		case tagFocalLength:
+			if num, den, ok := t.rational(kind, value); ok {
+				response.FocalLength = math.Round(float64(num)/float64(den)*10) / 10
+			}
+		case tagISO:
+			response.ISO = t.integer(kind, value)
+		case tagDateTimeOriginal:
+			captured = t.ascii(value)
+		case tagOffsetTimeOriginal:
+			offset = t.ascii(value)
+		case tagLensModel:
+			response.Lens = t.ascii(value)
+		case tagPixelXDimension:
+			if response.Width == 0 {
+				response.Width = t.integer(kind, value)
+			}
+		case tagPixelYDimension:
+			if response.Height == 0 {
+				response.Height = t.integer(kind, value)
+			}
+		}
+	}
+	t.ifd(int(t.order.Uint32(t.data[4:8])), visit)
+	if exifIFD > 0 {
+		t.ifd(exifIFD, visit)
+	}
+	response.CapturedAt = exifCaptureTime(captured, offset)
+	return true
+}
+
+// exifCaptureTime formats DateTimeOriginal, with OffsetTimeOriginal when recorded
+func exifCaptureTime(captured, offset string) string {
+	local, err := time.Parse(exifDateLayout, captured)
+	if err != nil {
+		return ""
+	}
+	if zoned, err := time.Parse(exifDateLayout+"-07:00", captured+offset); err == nil {
+		return zoned.Format(time.RFC3339)
+	}
+	return local.Format("2006-01-02T15:04:05")
+}
+
+// readObjectHead returns the first exifReadLimit bytes of an object
+func readObjectHead(r *http.Request, backend Backend, name string) ([]byte, *ObjectInfo, error) {
+	var reader io.ReadCloser
+	var info *ObjectInfo
+	err := errors.ErrUnsupported
+	if opener, ok := backend.(rangeOpener); ok {
+		reader, info, err = opener.OpenRange(r.Context(), name, 0, exifReadLimit)
+		if errors.Is(err, ErrInvalidRange) {
+			// Empty objects have no range to read
+			reader, info, err = backend.Open(r.Context(), name)
+		}
+	}
+	if errors.Is(err, errors.ErrUnsupported) {
+		reader, info, err = backend.Open(r.Context(), name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+	head, err := io.ReadAll(io.LimitReader(reader, exifReadLimit))
+	return head, info, err
+}
+
+// HandleExif serves GET /objects/{name}/exif: the camera, dimensions,
+// orientation and capture time of a photo, read from the start of the stored
+// object. Content type and size come from the metadata store when it has the
+// object.
+func HandleExif(backend Backend, mountPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(ExifResponse{
+				Success: false,
+				Error:   "Method not allowed. Use GET.",
+			})
+			return
+		}
+
+		name, ok := objectPathName(r, mountPath, "/exif")
+		if !ok || name == "" || hiddenObject(name) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ExifResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Not found. Use %s{name}/exif", mountPath),
+			})
+			return
+		}
+
+		head, info, err := readObjectHead(r, backend, name)
+		if errors.Is(err, ErrObjectNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ExifResponse{
+				Success: false,
+				Error:   "Object not found",
+			})
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ExifResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Failed to read object: %v", err),
+			})
+			return
+		}
+
+		response := ExifResponse{Success: true, Object: name, ContentType: info.ContentType, Size: info.Size}
+		if record, ok := metadataStore.Get(backend.Bucket(), name); ok && !isQuarantineRecord(record) {
+			response.ContentType, response.Size = record.ContentType, record.Size
+		}
+		if bytes.HasPrefix(head, []byte{0xFF, 0xD8}) {
+			found := false // XMP is stored in APP1 segments too
+			walkJPEGSegments(head, func(marker byte, payload []byte) {
+				if marker == 0xE1 && !found {
+					found = readExif(payload, &response)
+				}
+			})
+		}
+		// The encoded size wins over the EXIF one, which editors often leave stale
+		if config, _, err := image.DecodeConfig(bytes.NewReader(head)); err == nil {
+			response.Width, response.Height = config.Width, config.Height
+		}
+
+		json.NewEncoder(w).Encode(response)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export formats
+const (
+	ExportJSONL = "jsonl"
+	ExportCSV   = "csv"
+)
+
+// exportFlushEvery is how many records are written between flushes
+const exportFlushEvery = 1000
+
+// exportFields are the fields of an exported record, in column order
+var exportFields = []string{"bucket", "name", "size", "contentType", "sha256", "phash", "tenant", "source", "uploader", "origin", "metadata", "tags", "createdAt"}
+
+// exportValue returns a field of a record; metadata and tags stay structured
+func exportValue(record AssetRecord, field string) any {
+	switch field {
+	case "bucket":
+		return record.Bucket
+	case "name":
+		return record.Name
+	case "size":
+		return record.Size
+	case "contentType":
+		return record.ContentType
+	case "sha256":
+		return record.SHA256
+	case "phash":
+		return record.PHash
+	case "tenant":
+		return record.Tenant
+	case "source":
+		return record.Source
+	case "uploader":
+		return record.Uploader
+	case "origin":
+		return record.Origin
+	case "metadata":
+		return record.Metadata
+	case "tags":
+		return record.Tags
+	case "createdAt":
+		return record.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}
+	return nil
+}
+
+// exportCell returns a field of a record as a CSV cell; metadata and tags
+// are JSON so values containing separators survive the round trip
+func exportCell(record AssetRecord, field string) string {
+	switch value := exportValue(record, field).(type) {
+	case string:
+		return value
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case map[string]string:
+		if len(value) == 0 {
+			return ""
+		}
+		data, _ := json.Marshal(value)
+		return string(data)
+	case []string:
+		if len(value) == 0 {
+			return ""
+		}
+		data, _ := json.Marshal(value)
+		return string(data)
+	}
+	return ""
+}
+
+// parseExportTime accepts RFC 3339 timestamps and dates (midnight UTC)
+func parseExportTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+// exportPageToken is where a page of the export continues: the bucket and
+// name of the last record exported, which can't be ambiguous since bucket
+// names have no slash
+func exportPageToken(record AssetRecord) string {
+	return encodePageToken(record.Bucket + "/" + record.Name)
+}
+
+// HandleExport streams the metadata catalog as JSON lines or CSV, for
+// backups and ingestion into other systems: GET ?format=jsonl|csv
+// &fields=name,size,...&bucket=&prefix=&since=&until=&pageSize=&pageToken=.
+// Records are sorted by bucket and name, and pages continue after the last
+// bucket and name, so records added or removed between pages don't shift
+// them. Without pageSize the whole catalog is streamed; with it, the token
+// of the next page is returned in the X-Next-Page-Token header.
+func HandleExport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeExportError(w, http.StatusMethodNotAllowed, "Method not allowed. Use GET.")
+			return
+		}
+
+		query := r.URL.Query()
+		format := query.Get("format")
+		if format == "" {
+			format = ExportJSONL
+		}
+		if format != ExportJSONL && format != ExportCSV {
+			writeExportError(w, http.StatusBadRequest, "format must be jsonl or csv")
+			return
+		}
+
+		fields := exportFields
+		if value := query.Get("fields"); value != "" {
+			fields = strings.Split(value, ",")
+			for _, field := range fields {
+				if !slices.Contains(exportFields, field) {
+					writeExportError(w, http.StatusBadRequest, fmt.Sprintf("Unknown field %q (allowed: %s)", field, strings.Join(exportFields, ",")))
+					return
+				}
+			}
+		}
+
+		var since, until time.Time
+		for name, target := range map[string]*time.Time{"since": &since, "until": &until} {
+			if value := query.Get(name); value != "" {
+				t, err := parseExportTime(value)
+				if err != nil {
+					writeExportError(w, http.StatusBadRequest, fmt.Sprintf("%s must be an RFC 3339 time or a YYYY-MM-DD date", name))
+					return
+				}
+				*target = t
+			}
+		}
+
+		pageSize := 0
+		if value := query.Get("pageSize"); value != "" {
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 1 {
+				writeExportError(w, http.StatusBadRequest, "pageSize must be a positive number")
+				return
+			}
+			pageSize = size
+		}
+		after, err := decodePageToken(query.Get("pageToken"))
+		if err != nil {
+			writeExportError(w, http.StatusBadRequest, "Invalid pageToken")
+			return
+		}
+
+		prefix := query.Get("prefix")
+		var page []AssetRecord
+		more := false
+		for _, record := range metadataStore.Records(query.Get("bucket")) {
+			if after != "" && record.Bucket+"/"+record.Name <= after {
+				continue
+			}
+			if !strings.HasPrefix(record.Name, prefix) ||
+				(!since.IsZero() && record.CreatedAt.Before(since)) ||
+				(!until.IsZero() && !record.CreatedAt.Before(until)) {
+				continue
+			}
+			if pageSize > 0 && len(page) == pageSize {
+				more = true
+				break
+			}
+			page = append(page, record)
+		}
+
+		if more {
+			w.Header().Set("X-Next-Page-Token", exportPageToken(page[len(page)-1]))
+		}
+		filename := "catalog-" + time.Now().UTC().Format("20060102-150405") + "." + format
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		if format == ExportCSV {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			writeExportCSV(w, page, fields)
+		} else {
+			w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+			writeExportJSONL(w, page, fields)
+		}
+	}
+}
+
+// writeExportJSONL writes one JSON object per record with the selected
+// fields, empty ones included so every line has the same keys
+func writeExportJSONL(w http.ResponseWriter, records []AssetRecord, fields []string) {
+	encoder := json.NewEncoder(w)
+	controller := http.NewResponseController(w)
+	for i, record := range records {
+		line := make(map[string]any, len(fields))
+		for _, field := range fields {
+			line[field] = exportValue(record, field)
+		}
+		if err := encoder.Encode(line); err != nil {
+			return
+		}
+		if (i+1)%exportFlushEvery == 0 {
+			controller.Flush()
+		}
+	}
+}
+
+// writeExportCSV writes a header row and a row per record
+func writeExportCSV(w http.ResponseWriter, records []AssetRecord, fields []string) {
+	writer := csv.NewWriter(w)
+	writer.Write(fields)
+	row := make([]string, len(fields))
+	for i, record := range records {
+		for j, field := range fields {
+			row[j] = exportCell(record, field)
+		}
+		if err := writer.Write(row); err != nil {
+			return
+		}
+		if (i+1)%exportFlushEvery == 0 {
+			writer.Flush()
+			if writer.Error() != nil {
+				return
+			}
+			http.NewResponseController(w).Flush()
+		}
+	}
+	writer.Flush()
+}
+
+// writeExportError answers an export request that can't be served
+func writeExportError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(UploadResponse{
+		Success: false,
+		Error:   message,
+	})
+}
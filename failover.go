@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// FailoverConfig holds the circuit breaker and reconciliation settings shared
+// by all failover buckets
+type FailoverConfig struct {
+	Threshold         int           // consecutive primary outage errors that open the circuit
+	Cooldown          time.Duration // time the circuit stays open before the primary is tried again
+	ReconcileInterval time.Duration
+}
+
+// errPrimaryUnavailable is returned for operations that need the primary
+// while its circuit is open
+var errPrimaryUnavailable = errors.New("primary storage is unavailable")
+
+// isStorageOutage reports whether err means the storage service is failing,
+// as opposed to the request being wrong or the object missing: 5xx and 429
+// responses, timeouts and network errors
+func isStorageOutage(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, ErrObjectNotFound) || errors.Is(err, ErrObjectExists) ||
+		errors.Is(err, ErrObjectHeld) || errors.Is(err, ErrInvalidRange) {
+		return false
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code >= 500 || apiErr.Code == http.StatusTooManyRequests
+	}
+	var s3Err *s3StatusError
+	if errors.As(err, &s3Err) {
+		return s3Err.StatusCode >= 500 || s3Err.StatusCode == http.StatusTooManyRequests
+	}
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr)
+}
+
+// Circuit breaker states
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// circuitBreaker opens after threshold consecutive outage errors. Once the
+// cooldown has passed it lets a single request through (half-open): success
+// closes the circuit, another outage error opens it again.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	onChange  func(from, to string)
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration, onChange func(from, to string)) *circuitBreaker {
+	return &circuitBreaker{threshold: max(threshold, 1), cooldown: cooldown, onChange: onChange, state: circuitClosed}
+}
+
+// allow reports whether a request may go to the primary
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(circuitHalfOpen)
+		return true
+	case circuitHalfOpen:
+		return false // the probe request is in flight
+	}
+	return true
+}
+
+// record updates the breaker with the outcome of a request allowed through
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !isStorageOutage(err) {
+		b.failures = 0
+		if b.state != circuitClosed {
+			b.setState(circuitClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		if b.state != circuitOpen {
+			b.setState(circuitOpen)
+		}
+	}
+}
+
+// State returns the current state
+func (b *circuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *circuitBreaker) setState(state string) {
+	from := b.state
+	b.state = state
+	if b.onChange != nil {
+		b.onChange(from, state)
+	}
+}
+
+// FailoverBackend serves a logical bucket from a primary backend and, while
+// the primary is failing, from a failover backend in another region. Uploads
+// and signed upload URLs go to the failover while the circuit is open; reads
+// look in both. Objects written to the failover are moved to the primary once
+// it recovers, so the failover bucket is empty in normal operation and the
+// bucket name and public URLs always are the primary's.
+type FailoverBackend struct {
+	Backend  // primary
+	failover Backend
+	breaker  *circuitBreaker
+	interval time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// NewFailoverBackend wraps primary with failover to the secondary region
+func NewFailoverBackend(primary, failover Backend, cfg FailoverConfig) *FailoverBackend {
+	f := &FailoverBackend{
+		Backend:  primary,
+		failover: failover,
+		interval: cfg.ReconcileInterval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	f.breaker = newCircuitBreaker(cfg.Threshold, cfg.Cooldown, func(from, to string) {
+		switch to {
+		case circuitOpen:
+			storageFailoverActive.WithLabelValues(primary.Bucket()).Set(1)
+			log.Printf("🔀 Primary bucket %s is failing, routing uploads to %s", primary.Bucket(), failover.Bucket())
+			// A failed probe after the cooldown reopens the circuit of the same outage
+			if from == circuitClosed {
+				notifier.Send(NotifyOutage, "failover/"+primary.Bucket(),
+					fmt.Sprintf("🔀 Primary bucket %s is failing, uploads go to %s", primary.Bucket(), failover.Bucket()), 0)
+			}
+		case circuitClosed:
+			storageFailoverActive.WithLabelValues(primary.Bucket()).Set(0)
+			log.Printf("✅ Primary bucket %s recovered", primary.Bucket())
+			notifier.Send(NotifyOutage, "recovered/"+primary.Bucket(),
+				fmt.Sprintf("✅ Primary bucket %s recovered, uploads go to it again", primary.Bucket()), 0)
+		}
+	})
+	storageFailoverActive.WithLabelValues(primary.Bucket()).Set(0)
+	go f.run()
+	return f
+}
+
+// FailoverState describes which bucket is serving writes, for /readyz
+func (f *FailoverBackend) FailoverState() string {
+	if f.breaker.State() == circuitClosed {
+		return "primary"
+	}
+	return "failover to " + f.failover.Bucket()
+}
+
+// Put writes to the primary, or to the failover while the circuit is open.
+// A write that fails on the primary isn't retried on the failover, as the
+// reader has been consumed.
+func (f *FailoverBackend) Put(ctx context.Context, name string, r io.Reader, opts PutOptions) (*ObjectInfo, error) {
+	if !f.breaker.allow() {
+		storageFailoverWritesTotal.WithLabelValues(f.Backend.Bucket()).Inc()
+		return f.failover.Put(ctx, name, r, opts)
+	}
+	info, err := f.Backend.Put(ctx, name, r, opts)
+	f.breaker.record(err)
+	return info, err
+}
+
+// fallback reports whether a read that got err from the primary should be
+// retried on the failover: the object may have been written during an outage
+// and not be reconciled yet, or the primary may be failing
+func fallback(err error) bool {
+	return errors.Is(err, ErrObjectNotFound) || errors.Is(err, errPrimaryUnavailable) || isStorageOutage(err)
+}
+
+// Open reads from the primary, falling back to the failover
+func (f *FailoverBackend) Open(ctx context.Context, name string) (io.ReadCloser, *ObjectInfo, error) {
+	err := errPrimaryUnavailable
+	if f.breaker.allow() {
+		var reader io.ReadCloser
+		var info *ObjectInfo
+		reader, info, err = f.Backend.Open(ctx, name)
+		f.breaker.record(err)
+		if !fallback(err) {
+			return reader, info, err
+		}
+	}
+	reader, info, failoverErr := f.failover.Open(ctx, name)
+	if errors.Is(failoverErr, ErrObjectNotFound) {
+		return nil, nil, err
+	}
+	return reader, info, failoverErr
+}
+
+// OpenRange reads part of an object from the primary, falling back to the failover
+func (f *FailoverBackend) OpenRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	open := func(backend Backend) (io.ReadCloser, *ObjectInfo, error) {
+		opener, ok := backend.(rangeOpener)
+		if !ok {
+			return nil, nil, errors.ErrUnsupported
+		}
+		return opener.OpenRange(ctx, name, offset, length)
+	}
+	err := errPrimaryUnavailable
+	if f.breaker.allow() {
+		var reader io.ReadCloser
+		var info *ObjectInfo
+		reader, info, err = open(f.Backend)
+		f.breaker.record(err)
+		if !fallback(err) {
+			return reader, info, err
+		}
+	}
+	reader, info, failoverErr := open(f.failover)
+	if errors.Is(failoverErr, ErrObjectNotFound) {
+		return nil, nil, err
+	}
+	return reader, info, failoverErr
+}
+
+// Stat returns the attributes from the primary, falling back to the failover
+func (f *FailoverBackend) Stat(ctx context.Context, name string) (*ObjectInfo, error) {
+	err := errPrimaryUnavailable
+	if f.breaker.allow() {
+		var info *ObjectInfo
+		info, err = f.Backend.Stat(ctx, name)
+		f.breaker.record(err)
+		if !fallback(err) {
+			return info, err
+		}
+	}
+	info, failoverErr := f.failover.Stat(ctx, name)
+	if errors.Is(failoverErr, ErrObjectNotFound) {
+		return nil, err
+	}
+	return info, failoverErr
+}
+
+// Delete removes the object from both buckets. While the circuit is open only
+// objects written during the outage can be deleted.
+func (f *FailoverBackend) Delete(ctx context.Context, name string) error {
+	failoverErr := f.failover.Delete(ctx, name)
+	if failoverErr != nil && !errors.Is(failoverErr, ErrObjectNotFound) {
+		return failoverErr
+	}
+	if !f.breaker.allow() {
+		if failoverErr == nil {
+			return nil
+		}
+		return errPrimaryUnavailable
+	}
+	err := f.Backend.Delete(ctx, name)
+	f.breaker.record(err)
+	if errors.Is(err, ErrObjectNotFound) && failoverErr == nil {
+		return nil
+	}
+	return err
+}
+
+// List lists both buckets, the failover copy of an object replacing the
+// primary's. It fails while the circuit is open, as the listing would be
+// incomplete.
+func (f *FailoverBackend) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	pending := map[string]ObjectInfo{}
+	if err := f.failover.List(ctx, prefix, func(info ObjectInfo) error {
+		pending[info.Name] = info
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to list failover bucket: %w", err)
+	}
+	if !f.breaker.allow() {
+		return errPrimaryUnavailable
+	}
+
+	err := f.Backend.List(ctx, prefix, func(info ObjectInfo) error {
+		if _, ok := pending[info.Name]; ok {
+			return nil
+		}
+		return fn(info)
+	})
+	f.breaker.record(err)
+	if err != nil {
+		return err
+	}
+	for _, info := range pending {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SignedURL signs uploads for the bucket currently taking writes. While the
+// circuit is open, downloads of objects written during the outage are signed
+// for the failover.
+func (f *FailoverBackend) SignedURL(method, name string, opts SignOptions) (string, error) {
+	if f.breaker.State() == circuitClosed {
+		return f.Backend.SignedURL(method, name, opts)
+	}
+	if method == http.MethodPut || method == http.MethodPost {
+		storageFailoverWritesTotal.WithLabelValues(f.Backend.Bucket()).Inc()
+		return f.failover.SignedURL(method, name, opts)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := f.failover.Stat(ctx, name); err == nil {
+		return f.failover.SignedURL(method, name, opts)
+	}
+	return f.Backend.SignedURL(method, name, opts)
+}
+
+// UploadHeaders returns the headers required by the signed upload URLs of the bucket taking writes
+func (f *FailoverBackend) UploadHeaders(opts SignOptions) map[string]string {
+	if f.breaker.State() != circuitClosed {
+		return signedUploadHeaders(f.failover, opts)
+	}
+	return signedUploadHeaders(f.Backend, opts)
+}
+
+// BucketSettings returns the settings of the primary bucket when supported
+func (f *FailoverBackend) BucketSettings(ctx context.Context) (*BucketSettings, error) {
+	manager, ok := f.Backend.(bucketSettingsManager)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return manager.BucketSettings(ctx)
+}
+
+// UpdateBucketSettings updates the settings of the primary bucket when supported
+func (f *FailoverBackend) UpdateBucketSettings(ctx context.Context, settings BucketSettings) error {
+	manager, ok := f.Backend.(bucketSettingsManager)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return manager.UpdateBucketSettings(ctx, settings)
+}
+
+// RetentionPolicy returns the retention policy of the primary bucket when supported
+func (f *FailoverBackend) RetentionPolicy(ctx context.Context) (*RetentionPolicy, error) {
+	manager, ok := f.Backend.(retentionManager)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return manager.RetentionPolicy(ctx)
+}
+
+// SetRetentionPolicy sets the retention policy of the primary bucket when supported
+func (f *FailoverBackend) SetRetentionPolicy(ctx context.Context, period time.Duration) error {
+	manager, ok := f.Backend.(retentionManager)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return manager.SetRetentionPolicy(ctx, period)
+}
+
+// LockRetentionPolicy locks the retention policy of the primary bucket when supported
+func (f *FailoverBackend) LockRetentionPolicy(ctx context.Context) error {
+	manager, ok := f.Backend.(retentionManager)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return manager.LockRetentionPolicy(ctx)
+}
+
+// ObjectRetention returns the holds of an object in the primary when supported
+func (f *FailoverBackend) ObjectRetention(ctx context.Context, name string) (*ObjectRetention, error) {
+	manager, ok := f.Backend.(retentionManager)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return manager.ObjectRetention(ctx, name)
+}
+
+// SetTemporaryHold holds or releases an object in the primary when supported
+func (f *FailoverBackend) SetTemporaryHold(ctx context.Context, name string, held bool) error {
+	manager, ok := f.Backend.(retentionManager)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return manager.SetTemporaryHold(ctx, name, held)
+}
+
+// Probe checks both buckets for the readiness check. The service stays ready
+// while the failover takes writes; the probe also serves as the half-open
+// request that closes the circuit once the primary is back.
+func (f *FailoverBackend) Probe(ctx context.Context) (string, error) {
+	failoverErr := f.failover.List(ctx, "__readyz__/", func(ObjectInfo) error { return nil })
+	if f.breaker.allow() {
+		err := f.Backend.List(ctx, "__readyz__/", func(ObjectInfo) error { return nil })
+		f.breaker.record(err)
+		if err == nil {
+			return "ok", nil
+		}
+		if !isStorageOutage(err) {
+			return "", err
+		}
+	}
+	if failoverErr != nil {
+		return "", fmt.Errorf("primary unavailable and failover failing: %w", failoverErr)
+	}
+	return f.FailoverState(), nil
+}
+
+// Close stops reconciliation and closes both backends
+func (f *FailoverBackend) Close() error {
+	f.once.Do(func() { close(f.stop) })
+	<-f.done
+
+	err := f.failover.Close()
+	if primaryErr := f.Backend.Close(); primaryErr != nil {
+		err = primaryErr
+	}
+	return err
+}
+
+// run reconciles the failover bucket until Close is called
+func (f *FailoverBackend) run() {
+	defer close(f.done)
+
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for {
+		if f.breaker.State() == circuitClosed {
+			f.reconcile()
+		}
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconcile moves every object in the failover bucket to the primary. An
+// object that was replaced in the primary after the failover copy was written
+// is kept as it is.
+func (f *FailoverBackend) reconcile() {
+	var objects []ObjectInfo
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	err := f.failover.List(ctx, "", func(info ObjectInfo) error {
+		objects = append(objects, info)
+		return nil
+	})
+	cancel()
+	if err != nil {
+		log.Printf("⚠️  Failed to list failover bucket %s: %v", f.failover.Bucket(), err)
+		return
+	}
+	storageFailoverPending.WithLabelValues(f.Backend.Bucket()).Set(float64(len(objects)))
+
+	for _, object := range objects {
+		select {
+		case <-f.stop:
+			return
+		default:
+		}
+		if f.breaker.State() != circuitClosed {
+			return
+		}
+		if err := f.moveToPrimary(object); err != nil {
+			f.breaker.record(err)
+			log.Printf("⚠️  Failed to move %s from failover bucket %s: %v", object.Name, f.failover.Bucket(), err)
+			continue
+		}
+		storageFailoverReconciledTotal.WithLabelValues(f.Backend.Bucket()).Inc()
+		storageFailoverPending.WithLabelValues(f.Backend.Bucket()).Dec()
+	}
+}
+
+// moveToPrimary copies one object from the failover to the primary and deletes the failover copy
+func (f *FailoverBackend) moveToPrimary(object ObjectInfo) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	existing, err := f.Backend.Stat(ctx, object.Name)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+	if existing == nil || existing.Updated.Before(object.Updated) {
+		reader, info, err := f.failover.Open(ctx, object.Name)
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil // deleted in the meantime
+		}
+		if err != nil {
+			return err
+		}
+		_, err = f.Backend.Put(ctx, object.Name, reader, PutOptions{
+			ContentType:        info.ContentType,
+			ContentDisposition: info.ContentDisposition,
+			Metadata:           info.Metadata,
+			Size:               info.Size,
+		})
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := f.failover.Delete(ctx, object.Name); err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Feature flags gating processing stages
+const (
+	FlagTranscoding = "transcoding" // re-encoding, color normalization and auto-orientation of uploads
+	FlagModeration  = "moderation"  // content scanning of uploads, see scan.go
+	FlagWebhooks    = "webhooks"    // Slack/Discord notifications and the exec hook
+	FlagAsync       = "async"       // deferring event processing to Cloud Tasks
+)
+
+var knownFlags = []string{FlagTranscoding, FlagModeration, FlagWebhooks, FlagAsync}
+
+// FlagsFile holds flag values from FLAGS_FILE, e.g.
+//
+//	{"defaults": {"transcoding": false}, "tenants": {"acme": {"transcoding": true}}}
+type FlagsFile struct {
+	Defaults map[string]bool            `json:"defaults"`
+	Tenants  map[string]map[string]bool `json:"tenants"`
+}
+
+// FeatureFlags decides per tenant whether a feature is on. A tenant entry
+// wins over the defaults; a flag set nowhere is on, so configured features
+// keep working until a flag turns them off. A nil FeatureFlags enables
+// everything.
+type FeatureFlags struct {
+	envDefaults map[string]bool
+	path        string
+
+	mu       sync.RWMutex
+	defaults map[string]bool
+	tenants  map[string]map[string]bool
+}
+
+// featureFlags is the process-wide flag set; nil enables every feature
+var featureFlags *FeatureFlags
+
+// LoadFeatureFlags parses the FEATURE_FLAGS defaults (e.g. "transcoding=false")
+// and reads the optional flags file, whose defaults take precedence
+func LoadFeatureFlags(env []string, path string) (*FeatureFlags, error) {
+	envDefaults := map[string]bool{}
+	for _, item := range env {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid feature flag %q (expected name=true|false)", item)
+		}
+		enabled, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for feature flag %s: %w", name, err)
+		}
+		envDefaults[strings.TrimSpace(name)] = enabled
+	}
+	if err := checkFlagNames(envDefaults, "FEATURE_FLAGS"); err != nil {
+		return nil, err
+	}
+
+	f := &FeatureFlags{envDefaults: envDefaults, path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload re-reads the flags file, keeping the current flags on error
+func (f *FeatureFlags) Reload() error {
+	file := FlagsFile{}
+	if f.path != "" {
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			return fmt.Errorf("failed to read feature flags: %w", err)
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return fmt.Errorf("failed to parse feature flags %s: %w", f.path, err)
+		}
+	}
+	if err := checkFlagNames(file.Defaults, "defaults"); err != nil {
+		return err
+	}
+	for tenant, flags := range file.Tenants {
+		if err := checkFlagNames(flags, "tenant "+tenant); err != nil {
+			return err
+		}
+	}
+
+	defaults := map[string]bool{}
+	for name, enabled := range f.envDefaults {
+		defaults[name] = enabled
+	}
+	for name, enabled := range file.Defaults {
+		defaults[name] = enabled
+	}
+
+	f.mu.Lock()
+	f.defaults = defaults
+	f.tenants = file.Tenants
+	f.mu.Unlock()
+	return nil
+}
+
+// checkFlagNames rejects unknown flags, which are most likely typos
+func checkFlagNames(flags map[string]bool, source string) error {
+	for name := range flags {
+		if !slices.Contains(knownFlags, name) {
+			return fmt.Errorf("%s: unknown feature flag %q (allowed: %v)", source, name, knownFlags)
+		}
+	}
+	return nil
+}
+
+// Enabled reports whether a feature is on for a tenant ("" for requests
+// without one)
+func (f *FeatureFlags) Enabled(name, tenant string) bool {
+	if f == nil {
+		return true
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if enabled, ok := f.tenants[tenant][name]; ok {
+		return enabled
+	}
+	if enabled, ok := f.defaults[name]; ok {
+		return enabled
+	}
+	return true
+}
+
+// Evaluate returns the value of every flag for a tenant
+func (f *FeatureFlags) Evaluate(tenant string) map[string]bool {
+	flags := map[string]bool{}
+	for _, name := range knownFlags {
+		flags[name] = f.Enabled(name, tenant)
+	}
+	return flags
+}
+
+// FlagsResponse is returned by /admin/flags
+type FlagsResponse struct {
+	Defaults  map[string]bool            `json:"defaults"`
+	Tenants   map[string]map[string]bool `json:"tenants"`
+	Tenant    string                     `json:"tenant,omitempty"`
+	Effective map[string]bool            `json:"effective,omitempty"` // flags of Tenant after fallbacks
+	Error     string                     `json:"error,omitempty"`
+}
+
+// HandleFlags serves /admin/flags: GET lists the configured flags, and with
+// ?tenant= the flags that tenant effectively gets; POST reloads FLAGS_FILE
+func HandleFlags(flags *FeatureFlags) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if err := flags.Reload(); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(FlagsResponse{Error: err.Error()})
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(FlagsResponse{Error: "Method not allowed. Use GET or POST."})
+			return
+		}
+
+		response := FlagsResponse{
+			Defaults: map[string]bool{},
+			Tenants:  map[string]map[string]bool{},
+		}
+		flags.mu.RLock()
+		for _, name := range knownFlags {
+			enabled, ok := flags.defaults[name]
+			response.Defaults[name] = enabled || !ok
+		}
+		for tenant, overrides := range flags.tenants {
+			response.Tenants[tenant] = overrides
+		}
+		flags.mu.RUnlock()
+		if tenant := r.URL.Query().Get("tenant"); tenant != "" {
+			response.Tenant = tenant
+			response.Effective = flags.Evaluate(tenant)
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
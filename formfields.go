@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Limits on the form fields stored as object metadata, which leave room for
+// the metadata set by the service within the 8 KiB GCS allows
+const (
+	maxFormMetadataValue = 1024
+	maxFormMetadataTotal = 4096
+)
+
+// reservedMetadataKeys are set by the service and can't come from a form or
+// a signed URL request
+var reservedMetadataKeys = append([]string{"uploader", "poster", signedURLRotatedFromKey}, quarantineKeys...)
+
+// uploadOptionFields are form fields that control the upload itself and are
+// never passed through as metadata
+var uploadOptionFields = []string{"collision", "tags", dispositionField, downloadNameField}
+
+// UploadFormConfig holds the multipart field names uploads are read from
+type UploadFormConfig struct {
+	FileFields     []string // names of the file field, tried in order
+	MetadataFields []string // text fields stored as metadata: "field", "field=key", or "*" for all
+}
+
+// parseMetadataFields resolves the metadata field specs into form field name
+// -> metadata key. all is set when "*" passes every text field through.
+func parseMetadataFields(specs []string) (fields map[string]string, all bool, err error) {
+	fields = map[string]string{}
+	for _, spec := range specs {
+		if spec == "*" {
+			all = true
+			continue
+		}
+		field, key, mapped := strings.Cut(spec, "=")
+		if !mapped {
+			key = strings.ToLower(field)
+		}
+		if field == "" || !metadataKeyPattern.MatchString(key) {
+			return nil, false, fmt.Errorf("invalid metadata field %q: keys must be lowercase letters, digits, '-' or '_'", spec)
+		}
+		if slices.Contains(reservedMetadataKeys, key) {
+			return nil, false, fmt.Errorf("invalid metadata field %q: %s is reserved", spec, key)
+		}
+		fields[field] = key
+	}
+	return fields, all, nil
+}
+
+// uploadFormFile returns the file of the first accepted file field present
+// in a parsed multipart form
+func uploadFormFile(r *http.Request, fields []string) (multipart.File, *multipart.FileHeader, error) {
+	for _, field := range fields {
+		file, header, err := r.FormFile(field)
+		if err == nil {
+			return file, header, nil
+		}
+		if err != http.ErrMissingFile {
+			return nil, nil, err
+		}
+	}
+	return nil, nil, http.ErrMissingFile
+}
+
+// uploadFormMetadata collects the configured text fields of a parsed
+// multipart form, and the alt text and caption, as object metadata. Empty fields are skipped, control
+// characters removed and oversized values rejected.
+func uploadFormMetadata(form *multipart.Form, specs []string) (map[string]string, error) {
+	if form == nil {
+		return nil, nil
+	}
+	// Configured specs come last, so they can map alt and caption to other keys
+	fields, all, err := parseMetadataFields(append(slices.Clone(accessibilityFields), specs...))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(form.Value))
+	for name := range form.Value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metadata := map[string]string{}
+	total := 0
+	for _, name := range names {
+		key, ok := fields[name]
+		if !ok {
+			// Passed-through fields keep their name when it is a valid key
+			key = strings.ToLower(name)
+			if !all || !metadataKeyPattern.MatchString(key) || slices.Contains(reservedMetadataKeys, key) || slices.Contains(uploadOptionFields, name) {
+				continue
+			}
+		}
+
+		value := strings.TrimSpace(strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, form.Value[name][0]))
+		if value == "" {
+			continue
+		}
+		if len(value) > maxFormMetadataValue {
+			return nil, fmt.Errorf("form field %s exceeds %d bytes", name, maxFormMetadataValue)
+		}
+		total += len(key) + len(value)
+		if total > maxFormMetadataTotal {
+			return nil, fmt.Errorf("form fields exceed %d bytes of metadata", maxFormMetadataTotal)
+		}
+		metadata[key] = value
+	}
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+	return metadata, nil
+}
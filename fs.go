@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FSBackend stores objects on local disk. Files are addressed by the SHA-256
+// of the object name, not of the content: an object keeps its path when it
+// is overwritten, and deleting it can't affect another object with the same
+// bytes. The hashes are fanned out into ab/cd/abcd... directories so no
+// directory grows too large; a JSON sidecar next to each file keeps the
+// original name and attributes.
+//
+// Objects are only reachable through the download proxy. With download
+// signing keys configured, PublicURL returns signed links and the proxy
+// requires them (see fsDownloadSigner).
+type FSBackend struct {
+	root          string
+	bucketName    string
+	fsync         bool
+	publicBaseURL string
+	signer        *DownloadSigner // nil when downloads aren't signed
+}
+
+// fsObjectMeta is persisted as the sidecar file of every object
+type fsObjectMeta struct {
+	Name               string            `json:"name"`
+	Size               int64             `json:"size"`
+	ContentType        string            `json:"contentType"`
+	ContentDisposition string            `json:"contentDisposition,omitempty"`
+	ETag               string            `json:"etag"`
+	Updated            time.Time         `json:"updated"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+}
+
+// NewFSBackend creates a filesystem backend rooted at cfg.Root/bucketName.
+// signer signs the links PublicURL returns; it may be nil.
+func NewFSBackend(cfg FSConfig, bucketName, publicBaseURL string, signer *DownloadSigner) (*FSBackend, error) {
+	root := filepath.Join(cfg.Root, bucketName)
+	for _, dir := range []string{root, filepath.Join(root, "tmp")} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create storage directory: %w", err)
+		}
+	}
+
+	return &FSBackend{
+		root:          root,
+		bucketName:    bucketName,
+		fsync:         cfg.Fsync,
+		publicBaseURL: strings.TrimSuffix(publicBaseURL, "/"),
+		signer:        signer,
+	}, nil
+}
+
+// Bucket returns the bucket name
+func (f *FSBackend) Bucket() string {
+	return f.bucketName
+}
+
+// objectPath returns the content path for an object name
+func (f *FSBackend) objectPath(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:])
+	return filepath.Join(f.root, hash[0:2], hash[2:4], hash)
+}
+
+// Put writes the object atomically (temp file + rename)
+func (f *FSBackend) Put(ctx context.Context, name string, r io.Reader, opts PutOptions) (*ObjectInfo, error) {
+	if customerKeyFromContext(ctx) != nil {
+		return nil, ErrCustomerKeyUnsupported
+	}
+	path := f.objectPath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create object directory: %w", err)
+	}
+
+	hasher := sha256.New()
+	size, err := f.writeAtomic(path, io.TeeReader(&contextReader{ctx: ctx, r: r}, hasher), opts.IfNotExists)
+	if errors.Is(err, fs.ErrExist) {
+		return nil, ErrObjectExists
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload file: %w", err)
+	}
+
+	meta := fsObjectMeta{
+		Name:               name,
+		Size:               size,
+		ContentType:        opts.ContentType,
+		ContentDisposition: opts.ContentDisposition,
+		ETag:               hex.EncodeToString(hasher.Sum(nil)),
+		Updated:            time.Now().UTC(),
+		Metadata:           opts.Metadata,
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.writeAtomic(path+".json", strings.NewReader(string(data)), false); err != nil {
+		return nil, fmt.Errorf("failed to write object metadata: %w", err)
+	}
+
+	return meta.info(), nil
+}
+
+// writeAtomic streams r into a temp file and renames it over path. With
+// exclusive set the temp file is hard-linked instead, which fails with
+// fs.ErrExist when path exists.
+func (f *FSBackend) writeAtomic(path string, r io.Reader, exclusive bool) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Join(f.root, "tmp"), "upload-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, r)
+	if err == nil && f.fsync {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if exclusive {
+		err = os.Link(tmp.Name(), path)
+	} else {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if f.fsync {
+		syncDir(filepath.Dir(path))
+	}
+	return size, nil
+}
+
+// readMeta loads the sidecar metadata of an object
+func (f *FSBackend) readMeta(name string) (*fsObjectMeta, error) {
+	data, err := os.ReadFile(f.objectPath(name) + ".json")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	var meta fsObjectMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("corrupt object metadata for %q: %w", name, err)
+	}
+	return &meta, nil
+}
+
+// Open returns a reader for the object content
+func (f *FSBackend) Open(ctx context.Context, name string) (io.ReadCloser, *ObjectInfo, error) {
+	meta, err := f.readMeta(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(f.objectPath(name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, ErrObjectNotFound
+		}
+		return nil, nil, fmt.Errorf("failed to open object: %w", err)
+	}
+	return file, meta.info(), nil
+}
+
+// OpenRange returns a reader for part of the object content
+func (f *FSBackend) OpenRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	meta, err := f.readMeta(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(f.objectPath(name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, ErrObjectNotFound
+		}
+		return nil, nil, fmt.Errorf("failed to open object: %w", err)
+	}
+	info := meta.info()
+
+	start := offset
+	if offset < 0 {
+		start = max(info.Size+offset, 0)
+	}
+	if start >= info.Size && info.Size > 0 {
+		file.Close()
+		return nil, nil, ErrInvalidRange
+	}
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to seek object: %w", err)
+	}
+	if offset < 0 || length < 0 {
+		return file, info, nil
+	}
+	return &limitedReadCloser{Reader: io.LimitReader(file, length), Closer: file}, info, nil
+}
+
+// limitedReadCloser closes the underlying file of a limited reader
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Stat returns the object attributes
+func (f *FSBackend) Stat(ctx context.Context, name string) (*ObjectInfo, error) {
+	meta, err := f.readMeta(name)
+	if err != nil {
+		return nil, err
+	}
+	return meta.info(), nil
+}
+
+// Delete removes the object and its sidecar
+func (f *FSBackend) Delete(ctx context.Context, name string) error {
+	path := f.objectPath(name)
+	if err := os.Remove(path + ".json"); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ErrObjectNotFound
+		}
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+	return nil
+}
+
+// List walks the sidecar files and calls fn for objects matching prefix
+func (f *FSBackend) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	return filepath.WalkDir(f.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path == filepath.Join(f.root, "tmp") {
+				return filepath.SkipDir
+			}
+			return ctx.Err()
+		}
+		if !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var meta fsObjectMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil // skip corrupt sidecars rather than failing the whole listing
+		}
+		if !strings.HasPrefix(meta.Name, prefix) {
+			return nil
+		}
+		return fn(*meta.info())
+	})
+}
+
+// SignedURL is not supported: the filesystem has no direct-upload endpoint
+func (f *FSBackend) SignedURL(method, name string, opts SignOptions) (string, error) {
+	return "", fmt.Errorf("signed URLs are not supported by the filesystem driver")
+}
+
+// PublicURL returns the download endpoint URL for an object, signed for
+// defaultDownloadURLTTL (or the maximum) when downloads are signed
+func (f *FSBackend) PublicURL(name string) string {
+	u := f.publicBaseURL + "/" + objectURLPath(name)
+	if f.signer == nil || name == "" {
+		return u
+	}
+	expires := time.Now().Add(min(defaultDownloadURLTTL, f.signer.maxTTL))
+	return u + "?" + f.signer.query(f.bucketName, name, expires)
+}
+
+// fsDownloadSigner returns the signer of the download proxy of a bucket:
+// filesystem buckets have no other way to reach their objects, so they
+// require signed links whenever keys are configured
+func fsDownloadSigner(signer *DownloadSigner, driver string) *DownloadSigner {
+	if driver == "fs" {
+		return signer.requiring()
+	}
+	return signer
+}
+
+// Close is a no-op for the filesystem backend
+func (f *FSBackend) Close() error {
+	return nil
+}
+
+func (m *fsObjectMeta) info() *ObjectInfo {
+	return &ObjectInfo{
+		Name:               m.Name,
+		Size:               m.Size,
+		ContentType:        m.ContentType,
+		ContentDisposition: m.ContentDisposition,
+		ETag:               m.ETag,
+		Updated:            m.Updated,
+		Metadata:           m.Metadata,
+	}
+}
+
+// syncDir fsyncs a directory so a rename inside it is durable
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// contextReader stops reading once ctx is cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
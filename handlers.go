@@ -1,22 +1,69 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 
-	// "path/filepath"
 	"log"
 	"strings"
+	"time"
 )
 
 // Response structures
 type UploadResponse struct {
-	Success   bool   `json:"success"`
-	URL       string `json:"url,omitempty"`
-	Message   string `json:"message,omitempty"`
-	Error     string `json:"error,omitempty"`
+	Success      bool              `json:"success"`
+	URL          string            `json:"url,omitempty"`
+	Object       string            `json:"object,omitempty"`     // stored object name
+	ObjectName   string            `json:"objectName,omitempty"` // stored object name, also when URL is set
+	Bucket       string            `json:"bucket,omitempty"`
+	Size         int64             `json:"size,omitempty"`
+	SHA256       string            `json:"sha256,omitempty"`
+	ContentType  string            `json:"contentType,omitempty"`
+	Width        int               `json:"width,omitempty"` // 0 for SVG, WebP and BMP
+	Height       int               `json:"height,omitempty"`
+	CreatedAt    *time.Time        `json:"createdAt,omitempty"`
+	Poster       string            `json:"poster,omitempty"`       // first-frame still of an animated upload
+	Headers      map[string]string `json:"headers,omitempty"`      // headers to send with a signed upload
+	Deduplicated bool              `json:"deduplicated,omitempty"` // the content was already stored as Object
+	Staged       bool              `json:"staged,omitempty"`       // Object waits for a publish, see staging.go
+	Asset        *AssetInfo        `json:"asset,omitempty"`        // the existing asset of a deduplicated upload
+	Metadata     map[string]string `json:"metadata,omitempty"`     // form fields stored with the object
+	Tags         []string          `json:"tags,omitempty"`         // tags of the asset, see tags.go
+	Receipt      string            `json:"receipt,omitempty"`      // signed proof of the upload, see receipt.go
+	Message      string            `json:"message,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// describeAsset fills in what was stored for an upload, so clients don't
+// need to look it up afterwards
+func (response *UploadResponse) describeAsset(backend Backend, result *IngestResult) {
+	createdAt := result.Record.CreatedAt
+	response.ObjectName = result.Name
+	response.Bucket = backend.Bucket()
+	response.Size = result.Size
+	response.SHA256 = result.Record.SHA256
+	response.ContentType = result.ContentType
+	response.Width, response.Height = result.Width, result.Height
+	response.CreatedAt = &createdAt
+}
+
+// AssetInfo describes a stored asset
+type AssetInfo struct {
+	Name        string            `json:"name"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"contentType,omitempty"`
+	SHA256      string            `json:"sha256,omitempty"`
+	Uploaded    time.Time         `json:"uploaded"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
 }
 
 type HealthResponse struct {
@@ -26,7 +73,7 @@ type HealthResponse struct {
 
 // HandleHealth returns a simple health check response
 func HandleHealth(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(HealthResponse{
 		Status:  "healthy",
 		Message: "GCS Image Upload Service is running",
@@ -34,165 +81,573 @@ func HandleHealth(w http.ResponseWriter, r *http.Request) {
 }
 
 // HandleUpload handles image upload requests
-func HandleUpload(gcsClient *GCSClient, config *Config) http.HandlerFunc {
+func HandleUpload(backend Backend, config *Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
+		serveUpload(w, r, backend, config, nil)
+	}
+}
 
-		// Only allow POST method
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+// serveUpload handles a multipart upload to the backend, applying the
+// settings of collection when it isn't nil
+func serveUpload(w http.ResponseWriter, r *http.Request, backend Backend, config *Config, collection *Collection) {
+	start := time.Now()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: false,
+			Error:   "Method not allowed. Use POST.",
+		})
+		return
+	}
+
+	// Backend calls stop when the client goes away or the response can no longer be written
+	ctx, cancel := context.WithTimeout(r.Context(), serverWriteTimeout)
+	defer cancel()
+
+	// Parse multipart form
+	if err := r.ParseMultipartForm(collection.maxSize(config.MaxFileSize)); err != nil {
+		if uploadAborted(ctx, backend, "reading the request") {
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Failed to parse form: %v", err),
+		})
+		return
+	}
+
+	// Get the file from the first accepted form field
+	file, header, err := uploadFormFile(r, config.UploadForm.FileFields)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: false,
+			Error:   fmt.Sprintf("No image file provided. Use one of these form field names: %s.", strings.Join(config.UploadForm.FileFields, ", ")),
+		})
+		return
+	}
+	defer file.Close()
+
+	storeUpload(ctx, w, r, backend, config, collection, file, header.Filename, header.Size, start)
+}
+
+// storeUpload validates an upload, runs it through the ingestion pipeline and
+// writes the response; shared by multipart and raw body uploads. collection,
+// when not nil, sets the size limit, allowed types, prefix, processing
+// profile and visibility.
+func storeUpload(ctx context.Context, w http.ResponseWriter, r *http.Request, backend Backend, config *Config, collection *Collection, file io.Reader, filename string, size int64, start time.Time) {
+	// Validate file size and type
+	maxSize := collection.maxSize(config.MaxFileSize)
+	if err := validateUpload(filename, size, maxSize); err != nil {
+		if errors.Is(err, errInvalidImageType) {
+			abuseGuard.RecordStrike(trustedClientIP(r), StrikeInvalidUpload, 1)
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err := collection.checkType(filename); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	uploader, err := uploaderID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	// The collision policy can be chosen per request (form field or query parameter)
+	collision, err := parseCollisionPolicy(r.FormValue("collision"), config.CollisionPolicy)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	// Text fields of multipart forms (title, alt, ...) become object metadata
+	metadata, err := uploadFormMetadata(r.MultipartForm, config.UploadForm.MetadataFields)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	// Tags come as a comma-separated form field or query parameter
+	tags, err := parseTags(r.FormValue("tags"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	// Downloads can be shown inline or saved under a readable name
+	disposition, err := uploadDisposition(r.FormValue(dispositionField), r.FormValue(downloadNameField), filename)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	// Store the image and register it in the metadata store
+	result, err := IngestImage(ctx, backend, file, IngestOptions{
+		Filename:    filename,
+		Size:        size,
+		MaxSize:     maxSize,
+		Tenant:      r.Header.Get("X-Tenant-ID"),
+		Uploader:    uploader,
+		Origin:      requestOrigin(r),
+		Source:      SourceUpload,
+		Started:     start,
+		Reencode:    config.reencodeOptions(),
+		PHash:       config.PerceptualHash,
+		PHashMax:    config.PHashMaxPixels,
+		Animated:    &config.Animation,
+		Color:       config.colorOptions(),
+		Orient:      config.orientOptions(),
+		Collision:   collision,
+		Dedupe:      config.Dedupe,
+		Metadata:    metadata,
+		Tags:        tags,
+		Prefix:      collection.prefix(),
+		Profile:     collection.profile(),
+		Disposition: disposition,
+	})
+	if err != nil {
+		if uploadAborted(ctx, backend, "storing "+filename) {
+			return
+		}
+		if errors.Is(err, ErrObjectExists) {
+			w.WriteHeader(http.StatusConflict)
 			json.NewEncoder(w).Encode(UploadResponse{
 				Success: false,
-				Error:   "Method not allowed. Use POST.",
+				Error:   "An object with this name already exists",
 			})
 			return
 		}
-
-		// Parse multipart form
-		if err := r.ParseMultipartForm(config.MaxFileSize); err != nil {
+		if errors.Is(err, errStageTimeout) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+		if errors.Is(err, ErrCustomerKeyUnsupported) {
 			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode(UploadResponse{
 				Success: false,
-				Error:   fmt.Sprintf("Failed to parse form: %v", err),
+				Error:   "This bucket can't encrypt uploads with a customer-supplied key",
 			})
 			return
 		}
-
-		// Get the file from form data
-		file, header, err := r.FormFile("image")
-		if err != nil {
+		if errors.Is(err, errInvalidImage) || errors.Is(err, errUploadTooLarge) {
+			// Files failing site rules of a plugin are not malformed
+			var rejection *PluginRejection
+			if errors.Is(err, errInvalidImage) && !errors.As(err, &rejection) {
+				abuseGuard.RecordStrike(trustedClientIP(r), StrikeInvalidUpload, 1)
+			}
 			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode(UploadResponse{
 				Success: false,
-				Error:   "No image file provided. Use 'image' as the form field name.",
+				Error:   err.Error(),
 			})
 			return
 		}
-		defer file.Close()
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Failed to upload image: %v", err),
+		})
+		return
+	}
 
-		// Validate file size
-		if header.Size > config.MaxFileSize {
-			w.WriteHeader(http.StatusBadRequest)
+	// Success response
+	response := UploadResponse{
+		Success:  true,
+		URL:      backend.PublicURL(result.Name),
+		Metadata: metadata,
+		Tags:     result.Record.Tags,
+		Message:  "Image uploaded successfully",
+	}
+	response.describeAsset(backend, result)
+	if result.Poster != "" {
+		response.Poster = backend.PublicURL(result.Poster)
+	}
+	// Private collections are read through signed download URLs only
+	if collection.private() {
+		response.URL, response.Poster, response.Object = "", "", result.Name
+	}
+	// Staged uploads have no public URL until published
+	if result.Staged {
+		response.URL, response.Poster, response.Object = "", "", result.Name
+		response.Staged = true
+		response.Message = "Image staged, publish it with POST /objects/{name}/publish"
+	}
+	// Reused content: tell the client so it can skip reprocessing
+	if result.Deduplicated {
+		response.Deduplicated = true
+		response.Object = result.Name
+		response.Message = "Identical image already stored"
+		response.Asset = &AssetInfo{
+			Name:        result.Name,
+			Size:        result.Size,
+			ContentType: result.ContentType,
+			SHA256:      result.Record.SHA256,
+			Uploaded:    result.Record.CreatedAt,
+			Metadata:    result.Metadata,
+		}
+	}
+	// A receipt failure doesn't undo the upload, the client just gets none
+	if receipt, err := receiptSigner.Sign(result.Record); err != nil {
+		traceLogf(ctx, "⚠️  Failed to sign the receipt of %s: %v", result.Name, err)
+	} else {
+		response.Receipt = receipt
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleRawUpload handles PUT /upload/{filename} with the raw image as the
+// request body, for clients where multipart is awkward (CLI tools, mobile
+// SDKs). It must be mounted behind http.StripPrefix so the path is the filename.
+func HandleRawUpload(backend Backend, config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
 			json.NewEncoder(w).Encode(UploadResponse{
 				Success: false,
-				Error:   fmt.Sprintf("File too large. Max size: %d MB", config.MaxFileSize/(1024*1024)),
+				Error:   "Method not allowed. Use PUT.",
 			})
 			return
 		}
 
-		// Validate file type
-		if !isValidImageType(header.Filename) {
+		filename := r.URL.Path
+		if filename == "" {
 			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode(UploadResponse{
 				Success: false,
-				Error:   "Invalid file type. Allowed: jpg, jpeg, png, gif, webp, bmp, svg",
+				Error:   "No filename provided. Use PUT /upload/{filename}.",
 			})
 			return
 		}
 
-		// Upload to GCS
-		url, err := gcsClient.UploadImage(r.Context(), file, header)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		// The object's content type comes from the extension, so a different
+		// declared type means the client sent something else than it named
+		if err := checkRawContentType(r.Header.Get("Content-Type"), filename); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode(UploadResponse{
 				Success: false,
-				Error:   fmt.Sprintf("Failed to upload image: %v", err),
+				Error:   err.Error(),
 			})
 			return
 		}
 
-		// Success response
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(UploadResponse{
-			Success: true,
-			URL:     url,
-			Message: "Image uploaded successfully",
-		})
+		ctx, cancel := context.WithTimeout(r.Context(), serverWriteTimeout)
+		defer cancel()
+
+		// ContentLength is -1 for chunked bodies; IngestImage still enforces the limit while streaming
+		storeUpload(ctx, w, r, backend, config, nil, r.Body, filename, r.ContentLength, start)
+	}
+}
+
+// checkRawContentType checks that a declared Content-Type matches the
+// filename's extension. A missing or generic type is accepted.
+func checkRawContentType(contentType, filename string) error {
+	if contentType == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("Invalid Content-Type: %v", err)
+	}
+	if mediaType == "application/octet-stream" {
+		return nil
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	if expected := getContentType(ext); expected != "application/octet-stream" && mediaType != expected {
+		return fmt.Errorf("Content-Type %s does not match the file extension %s (%s)", mediaType, ext, expected)
 	}
+	return nil
 }
 
+// uploadAborted reports whether an upload failed because the client
+// disconnected or the deadline passed, in which case there is nobody left to
+// answer and the abort is only counted
+func uploadAborted(ctx context.Context, backend Backend, stage string) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	uploadsAbortedTotal.WithLabelValues(backend.Bucket()).Inc()
+	traceLogf(ctx, "⚠️  Upload to %s aborted while %s: %v", backend.Bucket(), stage, context.Cause(ctx))
+	return true
+}
+
+// signedURLExpiry is how long signed upload URLs stay valid; 15 minutes is usually enough
+const signedURLExpiry = 15 * time.Minute
+
 type SignedUrlRequest struct {
-	Filename    string `json:"filename"`
-	ContentType string `json:"contentType"`
+	Filename     string            `json:"filename"`
+	ContentType  string            `json:"contentType"`
+	Prefix       string            `json:"prefix,omitempty"`       // optional folder for the object, e.g. "products/2024"
+	Metadata     map[string]string `json:"metadata,omitempty"`     // custom object metadata, e.g. alt text or owner ID
+	CacheControl string            `json:"cacheControl,omitempty"` // stored as the object's Cache-Control
+}
+
+// Limits for metadata signed into upload URLs. GCS allows 8 KiB of custom
+// metadata per object.
+const (
+	maxSignedMetadataSize = 8 * 1024
+	maxCacheControlLength = 256
+)
+
+// metadataKeyPattern restricts metadata keys to what survives as an HTTP header
+// name on every backend (S3 lowercases them)
+var metadataKeyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// signOptions returns the options for signing an upload URL for req
+func (req SignedUrlRequest) signOptions(maxSize int64) SignOptions {
+	return SignOptions{
+		ContentType:  req.ContentType,
+		Expires:      signedURLExpiry,
+		MaxSize:      maxSize,
+		Metadata:     req.Metadata,
+		CacheControl: req.CacheControl,
+	}
 }
 
 // HandleGenerateSignedUrl handles requests to generate a signed URL for direct upload
-func HandleGenerateSignedUrl(gcsClient *GCSClient) http.HandlerFunc {
+func HandleGenerateSignedUrl(backend Backend, maxSize int64, allowedTypes []string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-
 		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			json.NewEncoder(w).Encode(UploadResponse{
+			writeJSONBody(w, http.StatusMethodNotAllowed, bodyMethodNotAllowedPost)
+			return
+		}
+
+		var req SignedUrlRequest
+		if err := decodeJSONBody(w, r, &req, 0); err != nil {
+			writeJSON(w, err.Status, UploadResponse{
 				Success: false,
-				Error:   "Method not allowed. Use POST.",
+				Error:   err.Message,
 			})
 			return
 		}
 
-		var req SignedUrlRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(UploadResponse{
+		if err := validateSignedUrlRequest(req, allowedTypes); err != nil {
+			writeJSON(w, http.StatusBadRequest, UploadResponse{
 				Success: false,
-				Error:   "Invalid request body",
+				Error:   err.Error(),
 			})
 			return
 		}
 
-		if req.Filename == "" || req.ContentType == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(UploadResponse{
+		// Generate the object name server-side so clients can't overwrite existing objects
+		prefix, _ := cleanObjectPrefix(req.Prefix)
+		name := uniqueObjectName(prefix, req.Filename)
+		log.Println("Filename: " + req.Filename + " -> " + name)
+		opts := req.signOptions(maxSize)
+		url, err := backend.SignedURL(http.MethodPut, name, opts)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, UploadResponse{
 				Success: false,
-				Error:   "Filename and ContentType are required",
+				Error:   "Failed to generate signed URL: " + err.Error(),
 			})
 			return
 		}
 
-		if !isValidImageType(req.Filename) {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(UploadResponse{
+		// Increment signed URL counter with hostname and tenant
+		hostname := r.Host
+		IncrementSignedURLCounter(hostname, r.Header.Get("X-Tenant-ID"))
+		recordSignedURL(r, backend, http.MethodPut, name, opts)
+
+		writeJSON(w, http.StatusOK, UploadResponse{
+			Success: true,
+			URL:     url,
+			Object:  name,
+			Headers: signedUploadHeaders(backend, opts),
+			Message: "Signed URL generated successfully",
+		})
+	}
+}
+
+// BatchSignedUrlRequest asks for signed URLs for several files at once
+type BatchSignedUrlRequest struct {
+	Files []SignedUrlRequest `json:"files"`
+}
+
+// SignedUrlResult is the outcome for one file of a batch
+type SignedUrlResult struct {
+	Filename string            `json:"filename"`
+	Object   string            `json:"object,omitempty"`
+	URL      string            `json:"url,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// BatchSignedUrlResponse lists the results in request order
+type BatchSignedUrlResponse struct {
+	Success bool              `json:"success"`
+	Results []SignedUrlResult `json:"results"`
+}
+
+// HandleBatchSignedUrls generates signed upload URLs for up to maxFiles files
+// in one request. Invalid files get a per-file error instead of failing the batch.
+func HandleBatchSignedUrls(backend Backend, maxFiles int, maxSize int64, allowedTypes []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONBody(w, http.StatusMethodNotAllowed, bodyMethodNotAllowedPost)
+			return
+		}
+
+		var req BatchSignedUrlRequest
+		if err := decodeJSONBody(w, r, &req, 0); err != nil {
+			writeJSON(w, err.Status, UploadResponse{
 				Success: false,
-				Error:   "Invalid file type",
+				Error:   err.Message,
 			})
 			return
 		}
 
-		// Generate a unique filename effectively
-		// ext := filepath.Ext(req.Filename)
-		// filename := fmt.Sprintf("%d-%s%s", time.Now().Unix(), sanitizeFilename(req.Filename[:len(req.Filename)-len(ext)]), ext)
-		// filename := fmt.Sprintf("%s", req.Filename)
-		log.Println("Filename: " + req.Filename)
-		// Create a pipe to capture the output (since the existing method writes to io.Writer)
-		// But wait, the method returns the URL string too. The io.Writer is just for logging/debugging in the example.
-		// We can just pass io.Discard if we don't want the output, or a buffer if we do.
-		// However, looking at the previous file content, the method signature I updated is:
-		// func (g *GCSClient) GenerateV4PutObjectSignedURL(w io.Writer, object, contentType string) (string, error)
-		
-		url, err := gcsClient.GenerateV4PutObjectSignedURL(io.Discard, req.Filename, req.ContentType)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(UploadResponse{
+		if len(req.Files) == 0 || len(req.Files) > maxFiles {
+			writeJSON(w, http.StatusBadRequest, UploadResponse{
 				Success: false,
-				Error:   fmt.Sprintf("Failed to generate signed URL: %v", err),
+				Error:   fmt.Sprintf("Between 1 and %d files are required", maxFiles),
 			})
 			return
 		}
 
-		// Increment signed URL counter with hostname and client IP
 		hostname := r.Host
-		clientIP := getClientIP(r)
-		IncrementSignedURLCounter(hostname, clientIP)
+		tenant := r.Header.Get("X-Tenant-ID")
+		response := BatchSignedUrlResponse{Success: true, Results: make([]SignedUrlResult, len(req.Files))}
+		for i, file := range req.Files {
+			result := SignedUrlResult{Filename: file.Filename}
+			if err := validateSignedUrlRequest(file, allowedTypes); err != nil {
+				result.Error = err.Error()
+				response.Success = false
+				response.Results[i] = result
+				continue
+			}
 
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(UploadResponse{
-			Success: true,
-			URL:     url,
-			Message: "Signed URL generated successfully",
-		})
+			opts := file.signOptions(maxSize)
+			prefix, _ := cleanObjectPrefix(file.Prefix)
+			name := uniqueObjectName(prefix, file.Filename)
+			url, err := backend.SignedURL(http.MethodPut, name, opts)
+			if err != nil {
+				result.Error = "Failed to generate signed URL: " + err.Error()
+				response.Success = false
+			} else {
+				result.Object = name
+				result.URL = url
+				result.Headers = signedUploadHeaders(backend, opts)
+				IncrementSignedURLCounter(hostname, tenant)
+				recordSignedURL(r, backend, http.MethodPut, name, opts)
+			}
+			response.Results[i] = result
+		}
+
+		writeJSON(w, http.StatusOK, response)
 	}
 }
 
+// validateSignedUrlRequest checks a signed URL request before signing
+func validateSignedUrlRequest(req SignedUrlRequest, allowedTypes []string) error {
+	if req.Filename == "" || req.ContentType == "" {
+		return errors.New("Filename and ContentType are required")
+	}
+	if !isValidImageType(req.Filename) {
+		return errors.New("Invalid file type")
+	}
+	if err := checkSignedContentType(req.ContentType, req.Filename, allowedTypes); err != nil {
+		return err
+	}
+	if _, err := cleanObjectPrefix(req.Prefix); err != nil {
+		return fmt.Errorf("Invalid prefix: %v", err)
+	}
+	size := 0
+	for key, value := range req.Metadata {
+		if !metadataKeyPattern.MatchString(key) {
+			return fmt.Errorf("Invalid metadata key %q: use lowercase letters, digits, - and _", key)
+		}
+		if slices.Contains(reservedMetadataKeys, key) {
+			return fmt.Errorf("Invalid metadata key %q: it is set by the service", key)
+		}
+		if !isHeaderValue(value) {
+			return fmt.Errorf("Invalid metadata value for %q: only printable ASCII is allowed", key)
+		}
+		size += len(key) + len(value)
+	}
+	if size > maxSignedMetadataSize {
+		return fmt.Errorf("Metadata exceeds %d bytes", maxSignedMetadataSize)
+	}
+	if len(req.CacheControl) > maxCacheControlLength || !isHeaderValue(req.CacheControl) {
+		return errors.New("Invalid cacheControl")
+	}
+	return nil
+}
+
+// checkSignedContentType checks the content type signed into an upload URL.
+// The bucket serves the object with that type, so unlike checkRawContentType
+// it must be given, be exactly the type of the filename's extension and be
+// in the allowlist: evil.png signed as text/html would be served as a page.
+func checkSignedContentType(contentType, filename string, allowedTypes []string) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || len(params) > 0 || mediaType != contentType {
+		return fmt.Errorf("Invalid contentType %q: use a plain media type such as image/png", contentType)
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	if expected := getContentType(ext); mediaType != expected {
+		return fmt.Errorf("contentType %s does not match the file extension %s (%s)", mediaType, ext, expected)
+	}
+	if !slices.Contains(allowedTypes, mediaType) {
+		return fmt.Errorf("contentType %s is not allowed for signed uploads", mediaType)
+	}
+	return nil
+}
+
+// isHeaderValue reports whether s can be sent as a header value by browsers
+// and signed as-is: printable ASCII without leading or trailing spaces
+func isHeaderValue(s string) bool {
+	if s != strings.TrimSpace(s) {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
 // isValidImageType checks if the file has a valid image extension
 func isValidImageType(filename string) bool {
 	validExtensions := []string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".bmp", ".svg"}
@@ -205,3 +660,163 @@ func isValidImageType(filename string) bool {
 	}
 	return false
 }
+
+// HandleDownload streams objects from the backend (used by drivers without public URLs, e.g. fs).
+// Unsigned requests from sites outside the hotlink allowlist get the placeholder image,
+// and missing objects the missing placeholder when one is configured.
+func HandleDownload(backend Backend, signer *DownloadSigner, hotlink *HotlinkGuard, missing *MissingPlaceholder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeJSONBody(w, http.StatusMethodNotAllowed, bodyMethodNotAllowedGet)
+			return
+		}
+
+		name, _ := objectPathName(r, "", "")
+		if name == "" || hiddenObject(name) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if err := signer.Verify(backend.Bucket(), name, r.URL.Query()); err != nil {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+		if r.URL.Query().Has(downloadSignatureParam) {
+			// Signed links are meant for one recipient, keep them out of shared caches
+			w.Header().Set("Cache-Control", "private")
+		} else if hotlink != nil {
+			// The response depends on the embedding site, so caches must not share it
+			w.Header().Add("Vary", "Referer")
+			if !hotlink.Allowed(r) {
+				hotlink.ServePlaceholder(w, r)
+				return
+			}
+		}
+
+		if customerKeyFromContext(r.Context()) != nil {
+			// Content decrypted with the client's key must stay out of shared caches
+			w.Header().Set("Cache-Control", "private, no-store")
+		}
+
+		reader, info, partial, err := openDownload(r, backend, name)
+		if err != nil {
+			if errors.Is(err, ErrInvalidRange) {
+				if info, statErr := backend.Stat(r.Context(), name); statErr == nil {
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+				}
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			if errors.Is(err, ErrObjectNotFound) && missing.Serve(w, r, backend) {
+				return
+			}
+			if errors.Is(err, ErrObjectNotFound) {
+				writeJSONBody(w, http.StatusNotFound, bodyObjectNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			if errors.Is(err, ErrCustomerKeyRequired) {
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   "Object is encrypted with a customer-supplied key. Send the key it was uploaded with in the X-Goog-Encryption-* headers.",
+				})
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Failed to read object: %v", err),
+			})
+			return
+		}
+		defer reader.Close()
+
+		// ?disposition= and ?filename= override what was stored at upload
+		disposition, err := downloadDisposition(info.ContentDisposition, r.URL.Query())
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+
+		// Validators let browsers and CDNs revalidate without downloading again
+		if info.ETag != "" {
+			w.Header().Set("ETag", `"`+info.ETag+`"`)
+		}
+		if !info.Updated.IsZero() {
+			w.Header().Set("Last-Modified", info.Updated.UTC().Format(http.TimeFormat))
+		}
+		if notModified(r, info.ETag, info.Updated) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		if info.ContentType != "" {
+			w.Header().Set("Content-Type", info.ContentType)
+		}
+		if disposition != "" {
+			w.Header().Set("Content-Disposition", disposition)
+		}
+		if _, ok := backend.(rangeOpener); ok {
+			w.Header().Set("Accept-Ranges", "bytes")
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
+		if partial != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", partial.start, partial.end, info.Size))
+			w.Header().Set("Content-Length", strconv.FormatInt(partial.end-partial.start+1, 10))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+			w.WriteHeader(http.StatusOK)
+		}
+
+		if r.Method == http.MethodHead {
+			return
+		}
+		if _, err := io.Copy(w, reader); err != nil {
+			traceLogf(r.Context(), "⚠️  Download of %s interrupted: %v", name, err)
+		}
+	}
+}
+
+// notModified evaluates If-None-Match and If-Modified-Since. If-None-Match
+// takes precedence when present (RFC 9110 section 13.2.2).
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" {
+				return true
+			}
+			// Weak comparison: W/"x" matches "x"
+			if strings.Trim(strings.TrimPrefix(candidate, "W/"), `"`) == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		// HTTP dates have second precision
+		return !modified.Truncate(time.Second).After(since)
+	}
+	return false
+}
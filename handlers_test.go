@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// discardResponseWriter drops the response, so benchmarks only count the
+// allocations of the handler
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) WriteHeader(status int)      { w.status = status }
+func (w *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+// BenchmarkHandleGenerateSignedUrl measures a /signedurl request, with and
+// without the signed URL audit, whose journal is written in the background
+func BenchmarkHandleGenerateSignedUrl(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	body := []byte(`{"filename":"cat.jpg","contentType":"image/jpeg","prefix":"products","metadata":{"alt":"A cat"}}`)
+	run := func(b *testing.B) {
+		handler := HandleGenerateSignedUrl(newMockBackend(), 10<<20, []string{"image/jpeg"})
+		w := &discardResponseWriter{header: http.Header{}}
+		b.ReportAllocs()
+		for b.Loop() {
+			w.status = 0
+			req := httptest.NewRequest(http.MethodPost, "/signedurl", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			handler(w, req)
+			if w.status != http.StatusOK {
+				b.Fatalf("status %d", w.status)
+			}
+		}
+	}
+
+	b.Run("no audit", run)
+	b.Run("audit", func(b *testing.B) {
+		audit, err := OpenSignedURLAudit(filepath.Join(b.TempDir(), "signedurls.jsonl"), 1000)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer audit.Close()
+		signedURLAudit = audit
+		defer func() { signedURLAudit = nil }()
+		run(b)
+	})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const errorRateWindow = 5 // minutes of request history used for the error rate
+
+// healthUnreachable is the check result of a backend whose probe failed. The
+// error itself isn't served, as it can name buckets, service accounts or
+// endpoints; it is logged and passed to alerts instead.
+const healthUnreachable = "unreachable"
+
+// HealthStatus is the result of the latest readiness check
+type HealthStatus struct {
+	Ready        bool              `json:"ready"`
+	FailingSince time.Time         `json:"failingSince,omitempty"`
+	Checks       map[string]string `json:"checks"` // "ok", "unreachable" or the failover state of each backend
+	Errors       map[string]string `json:"-"`      // errors of the unreachable backends, for logs and alerts only
+	ErrorRate    float64           `json:"errorRate"`
+	Requests     int64             `json:"requests"`
+	CheckedAt    time.Time         `json:"checkedAt"`
+}
+
+// rateBucket counts responses during one minute
+type rateBucket struct {
+	minute   int64
+	requests int64
+	errors   int64
+}
+
+// HealthMonitor periodically probes every backend and tracks the 5xx rate of
+// served requests. Listeners (e.g. the SMTP alerter) are called after each check.
+type HealthMonitor struct {
+	backends map[string]Backend
+	interval time.Duration
+
+	mu        sync.Mutex
+	status    HealthStatus
+	rate      [errorRateWindow]rateBucket
+	listeners []func(HealthStatus)
+	stop      chan struct{}
+}
+
+// healthMonitor is the process-wide monitor; nil until started in main
+var healthMonitor *HealthMonitor
+
+// NewHealthMonitor creates a monitor; call Start to begin probing
+func NewHealthMonitor(backends map[string]Backend, interval time.Duration) *HealthMonitor {
+	return &HealthMonitor{
+		backends: backends,
+		interval: interval,
+		status:   HealthStatus{Ready: true, Checks: map[string]string{}},
+		stop:     make(chan struct{}),
+	}
+}
+
+// OnCheck registers a listener called with the status after every check
+func (m *HealthMonitor) OnCheck(fn func(HealthStatus)) {
+	m.mu.Lock()
+	m.listeners = append(m.listeners, fn)
+	m.mu.Unlock()
+}
+
+// Start runs the first check synchronously and then checks periodically
+func (m *HealthMonitor) Start() {
+	m.check()
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				m.check()
+			}
+		}
+	}()
+}
+
+// Stop ends the periodic checks
+func (m *HealthMonitor) Stop() {
+	close(m.stop)
+}
+
+// RecordResponse adds a served response to the error rate window
+func (m *HealthMonitor) RecordResponse(statusCode int) {
+	if m == nil {
+		return
+	}
+	minute := time.Now().Unix() / 60
+
+	m.mu.Lock()
+	bucket := &m.rate[minute%errorRateWindow]
+	if bucket.minute != minute {
+		*bucket = rateBucket{minute: minute}
+	}
+	bucket.requests++
+	if statusCode >= 500 {
+		bucket.errors++
+	}
+	m.mu.Unlock()
+}
+
+// Status returns the latest health status
+func (m *HealthMonitor) Status() HealthStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// check probes each backend with a cheap listing and updates the status
+func (m *HealthMonitor) check() {
+	checks, errs := map[string]string{}, map[string]string{}
+	ready := true
+
+	names := make([]string, 0, len(m.backends))
+	for name := range m.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		state, err := probeBackend(ctx, m.backends[name])
+		cancel()
+		if err != nil {
+			ready = false
+			checks[name], errs[name] = healthUnreachable, err.Error()
+		} else {
+			checks[name] = state
+		}
+	}
+
+	now := time.Now()
+	m.mu.Lock()
+	requests, errors := m.windowCounts(now)
+	status := HealthStatus{
+		Ready:     ready,
+		Checks:    checks,
+		Errors:    errs,
+		Requests:  requests,
+		CheckedAt: now,
+	}
+	if requests > 0 {
+		status.ErrorRate = float64(errors) / float64(requests)
+	}
+	for _, name := range names {
+		if errs[name] != "" && errs[name] != m.status.Errors[name] {
+			log.Printf("⚠️  Readiness check of %s failing: %s", name, errs[name])
+		}
+	}
+	if !ready {
+		status.FailingSince = m.status.FailingSince
+		if status.FailingSince.IsZero() {
+			status.FailingSince = now
+		}
+	} else if !m.status.Ready {
+		log.Println("✅ Readiness check recovered")
+	}
+	m.status = status
+	listeners := m.listeners
+	m.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn(status)
+	}
+}
+
+// probeBackend checks that a backend is usable. A failover backend reports
+// which bucket takes writes; any other is probed with a listing.
+func probeBackend(ctx context.Context, backend Backend) (string, error) {
+	if tee, ok := backend.(*TeeBackend); ok {
+		backend = tee.Backend
+	}
+	if failover, ok := backend.(*FailoverBackend); ok {
+		return failover.Probe(ctx)
+	}
+	// Listing a prefix that matches nothing verifies credentials and bucket access
+	if err := backend.List(ctx, "__readyz__/", func(ObjectInfo) error { return nil }); err != nil {
+		return "", err
+	}
+	return "ok", nil
+}
+
+// windowCounts sums the requests and errors of the last errorRateWindow minutes
+func (m *HealthMonitor) windowCounts(now time.Time) (int64, int64) {
+	minute := now.Unix() / 60
+	var requests, errors int64
+	for _, bucket := range m.rate {
+		if minute-bucket.minute < errorRateWindow {
+			requests += bucket.requests
+			errors += bucket.errors
+		}
+	}
+	return requests, errors
+}
+
+// HandleReadyz reports readiness: 200 when every backend is reachable or
+// failed over, 503 otherwise or once the event queue is draining for shutdown
+func HandleReadyz(monitor *HealthMonitor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		status := monitor.Status()
+		if assetEvents.Draining() {
+			checks := map[string]string{"events": DrainDraining}
+			for name, check := range status.Checks {
+				checks[name] = check
+			}
+			status.Ready, status.Checks = false, checks
+		}
+		if !status.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// unreachableBackend fails every listing with an error naming its credentials
+type unreachableBackend struct {
+	*mockBackend
+}
+
+func (b *unreachableBackend) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	return errors.New("uploader@project.iam.gserviceaccount.com does not have storage.objects.list access")
+}
+
+func TestHandleReadyzHidesBackendErrors(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	monitor := NewHealthMonitor(map[string]Backend{
+		"prod": newMockBackend(),
+		"dev":  &unreachableBackend{newMockBackend()},
+	}, 0)
+	monitor.check()
+
+	rec := httptest.NewRecorder()
+	HandleReadyz(monitor)(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "serviceaccount") {
+		t.Errorf("response leaks the backend error: %s", rec.Body)
+	}
+	var status HealthStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Checks["prod"] != "ok" || status.Checks["dev"] != healthUnreachable {
+		t.Errorf("checks = %v", status.Checks)
+	}
+	if err := monitor.Status().Errors["dev"]; !strings.Contains(err, "storage.objects.list") {
+		t.Errorf("error kept for alerts = %q", err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hook execution results, used as metric labels
+const (
+	HookSuccess = "success"
+	HookFailure = "failure"
+	HookTimeout = "timeout"
+	HookBusy    = "busy" // every slot was taken until the event's deadline
+)
+
+// HookConfig configures the exec hook
+type HookConfig struct {
+	Command     []string // program and arguments, not run through a shell
+	Events      []string // event types to run for, empty for all
+	Timeout     time.Duration
+	Concurrency int
+	WorkDir     string
+	Env         []string // names of environment variables passed to the command
+}
+
+// ExecHook runs a local command for every asset event, with the event as
+// JSON on stdin, as a simpler alternative to webhooks for on-prem setups.
+// The command runs in its own working directory with a minimal environment
+// (PATH plus the variables listed in HOOK_ENV, so the service's credentials
+// don't leak into it), is killed after the timeout and at most Concurrency
+// copies run at once.
+type ExecHook struct {
+	cfg   HookConfig
+	env   []string
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewExecHook checks the command and creates the hook
+func NewExecHook(cfg HookConfig) (*ExecHook, error) {
+	path, err := exec.LookPath(cfg.Command[0])
+	if err != nil {
+		return nil, fmt.Errorf("hook command: %w", err)
+	}
+	cfg.Command = append([]string{path}, cfg.Command[1:]...)
+	if err := os.MkdirAll(cfg.WorkDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create hook working directory: %w", err)
+	}
+
+	env := []string{"PATH=" + os.Getenv("PATH"), "HOME=" + cfg.WorkDir}
+	for _, name := range cfg.Env {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return &ExecHook{
+		cfg:   cfg,
+		env:   env,
+		slots: make(chan struct{}, max(cfg.Concurrency, 1)),
+	}, nil
+}
+
+// Name identifies the hook as an event sink
+func (h *ExecHook) Name() string {
+	return "hook"
+}
+
+// Publish waits for a free slot and starts the command in the background.
+// The event is skipped (and counted as busy) if no slot frees up before ctx
+// is done, so a stuck hook can't stall the other sinks for long.
+func (h *ExecHook) Publish(ctx context.Context, event AssetEvent) error {
+	if len(h.cfg.Events) > 0 && !slices.Contains(h.cfg.Events, event.Type) {
+		return nil
+	}
+	if !featureFlags.Enabled(FlagWebhooks, event.Tenant) {
+		return nil
+	}
+
+	select {
+	case h.slots <- struct{}{}:
+	case <-ctx.Done():
+		hookExecutionsTotal.WithLabelValues(HookBusy).Inc()
+		return fmt.Errorf("no free hook slot for %s of %s/%s", event.Type, event.Bucket, event.Object)
+	}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		defer func() { <-h.slots }()
+		h.run(event)
+	}()
+	return nil
+}
+
+// Close waits for the running commands
+func (h *ExecHook) Close() error {
+	h.wg.Wait()
+	return nil
+}
+
+// run executes the command for one event
+func (h *ExecHook) run(event AssetEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("⚠️  Failed to encode %s event for the hook: %v", event.Type, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.cfg.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.cfg.Command[0], h.cfg.Command[1:]...)
+	cmd.WaitDelay = time.Second
+	cmd.Dir = h.cfg.WorkDir
+	cmd.Env = append(slices.Clone(h.env), "GCB_EVENT_TYPE="+event.Type)
+	cmd.Stdin = bytes.NewReader(payload)
+	stderr := &limitedBuffer{max: maxPluginMessage}
+	cmd.Stderr = stderr
+
+	start := time.Now()
+	err = cmd.Run()
+	hookDuration.Observe(time.Since(start).Seconds())
+
+	result := HookSuccess
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		result = HookTimeout
+	case err != nil:
+		result = HookFailure
+	}
+	hookExecutionsTotal.WithLabelValues(result).Inc()
+	if result != HookSuccess {
+		log.Printf("⚠️  Hook %s for %s of %s/%s: %v %s", result, event.Type, event.Bucket, event.Object, err, strings.TrimSpace(stderr.String()))
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// HotlinkConfig holds the referrer check of the download proxy
+type HotlinkConfig struct {
+	// AllowedReferrers are the sites that may embed images: "example.com",
+	// "*.example.com" for its subdomains, or an origin. Empty disables the check.
+	AllowedReferrers []string
+	AllowEmpty       bool   // accept requests without a Referer (direct visits, apps, strict privacy settings)
+	Placeholder      string // image file served to hotlinkers, "" for the built-in one
+}
+
+// defaultHotlinkPlaceholder is served to hotlinkers when no placeholder file is configured
+const defaultHotlinkPlaceholder = `<svg xmlns="http://www.w3.org/2000/svg" width="320" height="180" viewBox="0 0 320 180">` +
+	`<rect width="320" height="180" fill="#e5e7eb"/>` +
+	`<text x="160" y="95" font-family="sans-serif" font-size="16" fill="#6b7280" text-anchor="middle">Image not available</text>` +
+	`</svg>`
+
+// HotlinkGuard rejects download requests embedded by sites outside the allowlist
+type HotlinkGuard struct {
+	hosts      []string // exact hosts
+	suffixes   []string // ".example.com" from "*.example.com"
+	allowEmpty bool
+
+	placeholder     []byte
+	placeholderType string
+}
+
+// NewHotlinkGuard loads the placeholder and parses the allowlist; it returns
+// nil when no referrer is configured
+func NewHotlinkGuard(cfg HotlinkConfig) (*HotlinkGuard, error) {
+	if len(cfg.AllowedReferrers) == 0 {
+		return nil, nil
+	}
+	guard := &HotlinkGuard{
+		allowEmpty:      cfg.AllowEmpty,
+		placeholder:     []byte(defaultHotlinkPlaceholder),
+		placeholderType: "image/svg+xml",
+	}
+	for _, entry := range cfg.AllowedReferrers {
+		host, err := referrerHost(entry)
+		if err != nil {
+			return nil, err
+		}
+		if suffix, ok := strings.CutPrefix(host, "*."); ok {
+			guard.suffixes = append(guard.suffixes, "."+suffix)
+		} else {
+			guard.hosts = append(guard.hosts, host)
+		}
+	}
+	if cfg.Placeholder != "" {
+		data, err := os.ReadFile(cfg.Placeholder)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read hotlink placeholder: %w", err)
+		}
+		guard.placeholder = data
+		guard.placeholderType = getContentType(strings.ToLower(filepath.Ext(cfg.Placeholder)))
+	}
+	return guard, nil
+}
+
+// referrerHost normalizes an allowlist entry to a lowercase host without port
+func referrerHost(entry string) (string, error) {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if strings.Contains(entry, "://") {
+		u, err := url.Parse(entry)
+		if err != nil || u.Host == "" {
+			return "", fmt.Errorf("invalid referrer %q", entry)
+		}
+		entry = u.Host
+	}
+	if host, _, err := net.SplitHostPort(entry); err == nil {
+		entry = host
+	}
+	if entry == "" || entry == "*." || strings.ContainsAny(entry, "/?#@ ") || strings.Contains(strings.TrimPrefix(entry, "*."), "*") {
+		return "", fmt.Errorf("invalid referrer %q", entry)
+	}
+	return entry, nil
+}
+
+// Allowed reports whether the request comes from an allowed site. Pages of
+// this service itself are always allowed. A nil guard allows every request.
+func (g *HotlinkGuard) Allowed(r *http.Request) bool {
+	if g == nil {
+		return true
+	}
+	referer := r.Header.Get("Referer")
+	if referer == "" {
+		return g.allowEmpty
+	}
+	u, err := url.Parse(referer)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if own, _, err := net.SplitHostPort(r.Host); err == nil && strings.EqualFold(host, own) || strings.EqualFold(host, r.Host) {
+		return true
+	}
+	for _, allowed := range g.hosts {
+		if host == allowed {
+			return true
+		}
+	}
+	for _, suffix := range g.suffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServePlaceholder answers a hotlinked request with the placeholder image.
+// The status is 403 but browsers still draw the image in the embedding page.
+func (g *HotlinkGuard) ServePlaceholder(w http.ResponseWriter, r *http.Request) {
+	hotlinkBlockedTotal.Inc()
+	w.Header().Set("Content-Type", g.placeholderType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(g.placeholder)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusForbidden)
+	if r.Method != http.MethodHead {
+		w.Write(g.placeholder)
+	}
+}
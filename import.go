@@ -0,0 +1,383 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// maxImportErrors caps the per-file errors returned in an import result
+const maxImportErrors = 100
+
+// ImportResult summarizes a bulk import
+type ImportResult struct {
+	Imported     int               `json:"imported"`
+	Deduplicated int               `json:"deduplicated"` // identical to an already stored asset
+	Skipped      int               `json:"skipped"`
+	Failed       int               `json:"failed"`
+	Bytes        int64             `json:"bytes"`
+	Errors       []ImportFileError `json:"errors,omitempty"`
+	StartedAt    time.Time         `json:"startedAt"`
+	Duration     string            `json:"duration"`
+}
+
+// ImportFileError explains why a file was skipped or failed
+type ImportFileError struct {
+	File  string `json:"file"`
+	Error string `json:"error"`
+}
+
+// importer feeds files from a zip archive or an existing prefix through the
+// regular upload pipeline (validation, naming, metadata registration, events)
+type importer struct {
+	dst       Backend
+	maxSize   int64
+	tenant    string
+	source    string // SourceImport, SourceInbox or SourceEmail
+	uploader  string
+	metadata  map[string]string // stored with every file
+	prefix    string            // folder the files are stored under, see cleanObjectPrefix
+	reencode  *ReencodeOptions
+	phash     bool
+	phashMax  int
+	animated  *AnimationLimits
+	color     *ColorOptions
+	orient    *OrientOptions
+	collision string
+	dedupe    bool
+	result    ImportResult
+}
+
+func newImporter(dst Backend, config *Config, tenant string) *importer {
+	return &importer{
+		dst:       dst,
+		maxSize:   config.MaxFileSize,
+		tenant:    tenant,
+		source:    SourceImport,
+		reencode:  config.reencodeOptions(),
+		phash:     config.PerceptualHash,
+		phashMax:  config.PHashMaxPixels,
+		animated:  &config.Animation,
+		color:     config.colorOptions(),
+		orient:    config.orientOptions(),
+		collision: config.CollisionPolicy,
+		dedupe:    config.Dedupe,
+		result:    ImportResult{StartedAt: time.Now()},
+	}
+}
+
+// importFile ingests one file; open is only called for files that pass
+// validation. It returns why the file was skipped or failed, if it was.
+func (im *importer) importFile(ctx context.Context, name string, size int64, open func() (io.ReadCloser, error)) error {
+	base := path.Base(name)
+	if strings.HasPrefix(base, ".") || strings.HasPrefix(name, "__MACOSX/") {
+		// OS metadata (.DS_Store, resource forks) is expected in archives, skip it quietly
+		im.result.Skipped++
+		return nil
+	}
+	if err := validateUpload(base, size, im.maxSize); err != nil {
+		im.result.Skipped++
+		im.addError(name, err)
+		return err
+	}
+
+	reader, err := open()
+	if err != nil {
+		im.result.Failed++
+		im.addError(name, err)
+		return err
+	}
+	defer reader.Close()
+
+	info, err := IngestImage(ctx, im.dst, reader, IngestOptions{
+		Filename:  base,
+		Size:      size,
+		MaxSize:   im.maxSize,
+		Tenant:    im.tenant,
+		Uploader:  im.uploader,
+		Source:    im.source,
+		Metadata:  im.metadata,
+		Prefix:    im.prefix,
+		Reencode:  im.reencode,
+		PHash:     im.phash,
+		PHashMax:  im.phashMax,
+		Animated:  im.animated,
+		Color:     im.color,
+		Orient:    im.orient,
+		Collision: im.collision,
+		Dedupe:    im.dedupe,
+	})
+	if errors.Is(err, errInvalidImage) {
+		im.result.Skipped++
+		im.addError(name, err)
+		return err
+	}
+	if err != nil {
+		im.result.Failed++
+		im.addError(name, err)
+		return err
+	}
+	if info.Deduplicated {
+		im.result.Deduplicated++
+		return nil
+	}
+	im.result.Imported++
+	im.result.Bytes += info.Size
+	return nil
+}
+
+func (im *importer) addError(name string, err error) {
+	if len(im.result.Errors) < maxImportErrors {
+		im.result.Errors = append(im.result.Errors, ImportFileError{File: name, Error: err.Error()})
+	}
+}
+
+// importZip ingests every file of a zip archive
+func (im *importer) importZip(ctx context.Context, zr *zip.Reader) error {
+	for _, f := range zr.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		im.importFile(ctx, f.Name, int64(f.UncompressedSize64), f.Open)
+	}
+	return nil
+}
+
+// importPrefix ingests every object under prefix in src. Objects are listed
+// first so importing into the same bucket doesn't disturb the listing.
+func (im *importer) importPrefix(ctx context.Context, src Backend, prefix string) error {
+	var objects []ObjectInfo
+	err := src.List(ctx, prefix, func(obj ObjectInfo) error {
+		if !strings.HasSuffix(obj.Name, "/") {
+			objects = append(objects, obj)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %w", prefix, err)
+	}
+
+	for _, obj := range objects {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := obj.Name
+		im.importFile(ctx, name, obj.Size, func() (io.ReadCloser, error) {
+			reader, _, err := src.Open(ctx, name)
+			return reader, err
+		})
+	}
+	return nil
+}
+
+// finish stamps the duration and returns the result
+func (im *importer) finish() *ImportResult {
+	im.result.Duration = time.Since(im.result.StartedAt).Round(time.Millisecond).String()
+	return &im.result
+}
+
+// HandleImport ingests a zip archive (request body or multipart "archive"
+// field) or an existing prefix (?source=bucket&prefix=p) into ?bucket=
+func HandleImport(backends map[string]Backend, config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "Method not allowed. Use POST.",
+			})
+			return
+		}
+
+		query := r.URL.Query()
+		dst, ok := backends[query.Get("bucket")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "bucket must be a registered bucket",
+			})
+			return
+		}
+
+		im := newImporter(dst, config, r.Header.Get("X-Tenant-ID"))
+
+		var err error
+		if source := query.Get("source"); source != "" {
+			src, ok := backends[source]
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   "source must be a registered bucket",
+				})
+				return
+			}
+			err = im.importPrefix(r.Context(), src, query.Get("prefix"))
+		} else {
+			var zr *zip.Reader
+			zr, err = readImportArchive(r, w, config.ImportMaxSize)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   fmt.Sprintf("Invalid zip archive: %v", err),
+				})
+				return
+			}
+			err = im.importZip(r.Context(), zr)
+		}
+
+		result := im.finish()
+		log.Printf("📥 Import into %s: imported %d, deduplicated %d, skipped %d, failed %d (%d bytes)", dst.Bucket(), result.Imported, result.Deduplicated, result.Skipped, result.Failed, result.Bytes)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Import aborted after %d files: %v", result.Imported, err),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// readImportArchive opens the uploaded zip, spooling raw bodies to a temp
+// file since zip needs random access. The temp file is removed when the
+// request finishes.
+func readImportArchive(r *http.Request, w http.ResponseWriter, maxSize int64) (*zip.Reader, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			return nil, err
+		}
+		file, header, err := r.FormFile("archive")
+		if err != nil {
+			return nil, fmt.Errorf("use 'archive' as the form field name")
+		}
+		return zip.NewReader(file, header.Size)
+	}
+
+	tmp, err := os.CreateTemp("", "import-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	context.AfterFunc(r.Context(), func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	})
+
+	size, err := io.Copy(tmp, r.Body)
+	if err != nil {
+		return nil, err
+	}
+	return zip.NewReader(tmp, size)
+}
+
+// runImportCommand implements the `import` CLI subcommand
+func runImportCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	to := flags.String("to", "", "destination backend as driver:bucket (e.g. gcs:my-bucket)")
+	zipPath := flags.String("zip", "", "zip archive to import")
+	from := flags.String("from", "", "source backend as driver:bucket to import an existing prefix from")
+	prefix := flags.String("prefix", "", "only import objects under this prefix (with -from)")
+	tenant := flags.String("tenant", "", "tenant recorded with the imported assets")
+	flags.Parse(args)
+
+	if *to == "" || (*zipPath == "") == (*from == "") {
+		fmt.Fprintln(os.Stderr, "usage: import -to driver:bucket (-zip file.zip | -from driver:bucket [-prefix p]) [-tenant t]")
+		return 2
+	}
+
+	config := LoadConfig()
+	ctx := context.Background()
+
+	closeStores, err := openCommandStores(config)
+	if err != nil {
+		log.Printf("❌ %v", err)
+		return 1
+	}
+	defer closeStores()
+
+	dst, err := NewBackend(ctx, config, parseBackendSpec(config, *to))
+	if err != nil {
+		log.Printf("❌ Failed to open destination: %v", err)
+		return 1
+	}
+	defer dst.Close()
+
+	im := newImporter(dst, config, *tenant)
+	var importErr error
+	if *zipPath != "" {
+		zr, err := zip.OpenReader(*zipPath)
+		if err != nil {
+			log.Printf("❌ Failed to open archive: %v", err)
+			return 1
+		}
+		defer zr.Close()
+		importErr = im.importZip(ctx, &zr.Reader)
+	} else {
+		src, err := NewBackend(ctx, config, parseBackendSpec(config, *from))
+		if err != nil {
+			log.Printf("❌ Failed to open source: %v", err)
+			return 1
+		}
+		defer src.Close()
+		importErr = im.importPrefix(ctx, src, *prefix)
+	}
+
+	result := im.finish()
+	for _, fileErr := range result.Errors {
+		log.Printf("   %s: %s", fileErr.File, fileErr.Error)
+	}
+	log.Printf("📥 Import finished in %s: imported %d, deduplicated %d, skipped %d, failed %d (%d bytes)", result.Duration, result.Imported, result.Deduplicated, result.Skipped, result.Failed, result.Bytes)
+	if importErr != nil {
+		log.Printf("❌ %v", importErr)
+		return 1
+	}
+	if result.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// openCommandStores opens the metadata store and operation log for a CLI
+// command that ingests files, returning a function closing them
+func openCommandStores(config *Config) (func(), error) {
+	store, err := OpenMetadataStore(config.MetadataPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open metadata store: %w", err)
+	}
+	metadataStore = store
+	if config.OperationLogPath == "" {
+		return func() { store.Close() }, nil
+	}
+	oplog, err := OpenOperationLog(config.OperationLogPath, store)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to open operation log: %w", err)
+	}
+	operationLog = oplog
+	return func() {
+		oplog.Close()
+		store.Close()
+	}, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// inboxFailedDir is the folder of the inbox failed files are moved to, each
+// with a .error file explaining why
+const inboxFailedDir = ".failed"
+
+// inboxDoneDir is the folder ingested files are moved to when they can't be
+// removed (e.g. the watcher may write but not delete in a partner's folder),
+// so they aren't ingested again by the next scan
+const inboxDoneDir = ".done"
+
+// inboxPartialSuffixes mark files an SFTP/FTP client is still writing
+var inboxPartialSuffixes = []string{".part", ".filepart", ".tmp", ".partial"}
+
+// InboxConfig holds the settings of the inbox directory watcher
+type InboxConfig struct {
+	Dir        string        // directory partners deliver files to, "" disables the inbox
+	Bucket     string        // bucket files are ingested into, "" for the first bucket
+	Tenant     string        // tenant recorded with the ingested assets
+	Interval   time.Duration // time between scans of the inbox
+	SettleTime time.Duration // files modified more recently are still being delivered
+}
+
+// Inbox ingests files delivered to a directory, typically the upload folder
+// of an SFTP/FTP server used by partners that can't call the API. Files go
+// through the same validation and processing as imports; each subdirectory
+// is a partner, recorded as the uploader of its files. Ingested files are
+// removed (or moved to .done), failed ones are moved to .failed.
+type Inbox struct {
+	cfg     InboxConfig
+	backend Backend
+	config  *Config
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewInbox creates an inbox watcher; call Start to begin scanning
+func NewInbox(cfg InboxConfig, backend Backend, config *Config) (*Inbox, error) {
+	if err := os.MkdirAll(filepath.Join(cfg.Dir, inboxFailedDir), 0o755); err != nil {
+		return nil, err
+	}
+	return &Inbox{
+		cfg:     cfg,
+		backend: backend,
+		config:  config,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Start scans the inbox now and then at every interval
+func (in *Inbox) Start() {
+	go func() {
+		defer close(in.done)
+		for {
+			in.Scan()
+			select {
+			case <-in.stop:
+				return
+			case <-time.After(in.cfg.Interval):
+			}
+		}
+	}()
+}
+
+// Stop ends the scans, waiting for the file being ingested
+func (in *Inbox) Stop() {
+	close(in.stop)
+	<-in.done
+}
+
+// Scan ingests the files of the inbox that have settled
+func (in *Inbox) Scan() {
+	settled := time.Now().Add(-in.cfg.SettleTime)
+	var files []string
+	err := filepath.WalkDir(in.cfg.Dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(entry.Name(), ".") && path != in.cfg.Dir {
+			// .failed, and hidden files clients upload under before renaming
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || hasPartialSuffix(entry.Name()) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(settled) {
+			return nil
+		}
+		files = append(files, path)
+		return nil
+	})
+	if err != nil {
+		log.Printf("⚠️  Failed to scan inbox %s: %v", in.cfg.Dir, err)
+	}
+
+	for _, path := range files {
+		select {
+		case <-in.stop:
+			return
+		default:
+		}
+		in.ingest(path)
+	}
+}
+
+// ingest feeds one file through the import pipeline, then removes it or
+// moves it to .failed
+func (in *Inbox) ingest(path string) {
+	rel, err := filepath.Rel(in.cfg.Dir, path)
+	if err != nil {
+		return
+	}
+	rel = filepath.ToSlash(rel)
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	im := newImporter(in.backend, in.config, in.cfg.Tenant)
+	im.source = SourceInbox
+	if partner, _, nested := strings.Cut(rel, "/"); nested {
+		// The folder name ends up in object metadata and log lines like any uploader ID
+		if !uploaderIDPattern.MatchString(partner) {
+			err = fmt.Errorf("invalid partner folder %q: allowed are letters, digits and ._@:|+-", partner)
+		}
+		im.uploader = partner
+	}
+	if err == nil {
+		err = im.importFile(context.Background(), rel, info.Size(), func() (io.ReadCloser, error) {
+			return os.Open(path)
+		})
+	}
+	if err != nil {
+		inboxFilesTotal.WithLabelValues("failed").Inc()
+		log.Printf("❌ Inbox file %s failed: %v", rel, err)
+		in.fail(path, rel, err)
+		return
+	}
+
+	inboxFilesTotal.WithLabelValues("ingested").Inc()
+	log.Printf("📥 Inbox file %s ingested into %s", rel, in.backend.Bucket())
+	if err := os.Remove(path); err != nil {
+		// Left in place, the file would be ingested again on every scan
+		log.Printf("⚠️  Failed to remove ingested inbox file %s, moving it to %s: %v", rel, inboxDoneDir, err)
+		if _, err := in.move(path, rel, inboxDoneDir); err != nil {
+			log.Printf("⚠️  Failed to move inbox file %s: %v", rel, err)
+		}
+	}
+}
+
+// fail moves a file to .failed, keeping its partner folder, next to a .error
+// file with the reason
+func (in *Inbox) fail(path, rel string, cause error) {
+	target, err := in.move(path, rel, inboxFailedDir)
+	if err != nil {
+		log.Printf("⚠️  Failed to move inbox file %s: %v", rel, err)
+		return
+	}
+	if err := os.WriteFile(target+".error", []byte(cause.Error()+"\n"), 0o644); err != nil {
+		log.Printf("⚠️  Failed to write the error of inbox file %s: %v", rel, err)
+	}
+}
+
+// move moves a file to the same path under dir of the inbox and returns its
+// new path
+func (in *Inbox) move(path, rel, dir string) (string, error) {
+	target := filepath.Join(in.cfg.Dir, dir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return "", err
+	}
+	return target, os.Rename(path, target)
+}
+
+// hasPartialSuffix reports whether name is a file still being uploaded
+func hasPartialSuffix(name string) bool {
+	name = strings.ToLower(name)
+	for _, suffix := range inboxPartialSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
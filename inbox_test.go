@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInboxRejectsInvalidPartnerFolder(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "acme corp", "cat.jpg")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("not stored"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	inbox, err := NewInbox(InboxConfig{Dir: dir}, newMockBackend(), &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inbox.ingest(path)
+	failed := filepath.Join(dir, inboxFailedDir, "acme corp", "cat.jpg")
+	if _, err := os.Stat(failed); err != nil {
+		t.Errorf("file not moved to %s: %v", inboxFailedDir, err)
+	}
+	if reason, _ := os.ReadFile(failed + ".error"); !strings.Contains(string(reason), "invalid partner folder") {
+		t.Errorf(".error = %q", reason)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"image"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// IngestOptions describes a file entering the upload pipeline
+type IngestOptions struct {
+	Filename  string // original client-side name, used for validation and naming
+	Size      int64  // declared size, checked against the limit before reading
+	MaxSize   int64  // upload size limit in bytes
+	Tenant    string
+	Uploader  string            // end user the upload is made for, from X-Uploader-Id
+	Origin    string            // Origin header or hostname of the request, for usage accounting
+	Source    string            // SourceUpload, SourceImport, ...
+	Started   time.Time         // start of the request, for the event latency
+	Reencode  *ReencodeOptions  // decode and re-encode raster images (paranoid mode), nil to store as-is
+	PHash     bool              // compute a perceptual hash for near-duplicate search
+	PHashMax  int               // images over this many pixels aren't decoded for the hash
+	Animated  *AnimationLimits  // frame limits and posters for animated GIF/WebP, nil to skip
+	Color     *ColorOptions     // sRGB conversion and ICC profile stripping, nil to store as-is
+	Orient    *OrientOptions    // rotate JPEGs per their EXIF orientation, nil to store as-is
+	Collision string            // CollisionSuffix, CollisionReject or CollisionOverwrite (the default)
+	Dedupe    bool              // reuse an existing asset of the tenant with identical content
+	Metadata  map[string]string // custom metadata, e.g. from form fields, stored with the object and its record
+	Tags      []string          // normalized tags of the asset, stored in its record
+	Prefix    string            // folder the object is stored under, with a trailing slash
+	// Content-Disposition stored with the object, see contentDisposition
+	Disposition string
+	Profile     string // processing profile of the collection uploaded to, see pipeline.go
+}
+
+// IngestResult describes the asset an ingested file ended up as
+type IngestResult struct {
+	*ObjectInfo
+	Record       AssetRecord // catalog entry of the asset
+	Poster       string      // object name of the first-frame poster, if any
+	Deduplicated bool        // identical content was already stored and the new copy was discarded
+	Staged       bool        // stored under the staging prefix until published, see staging.go
+	Width        int         // pixel dimensions, 0 for formats that can't be decoded (SVG, WebP, BMP)
+	Height       int
+}
+
+// errUploadTooLarge is returned when the content exceeds MaxSize while streaming
+var errUploadTooLarge = errors.New("file exceeds the maximum upload size")
+
+// errInvalidImageType is returned for files without an allowed image extension
+var errInvalidImageType = errors.New("Invalid file type. Allowed: jpg, jpeg, png, gif, webp, bmp, svg")
+
+// validateUpload applies the checks shared by every ingestion path. The
+// messages are returned to clients as-is.
+func validateUpload(filename string, size, maxSize int64) error {
+	if size > maxSize {
+		return fmt.Errorf("File too large. Max size: %d MB", maxSize/(1024*1024))
+	}
+	if !isValidImageType(filename) {
+		return errInvalidImageType
+	}
+	return nil
+}
+
+// IngestImage runs a file through the upload pipeline: validation, the
+// validate and transform stages, storage, the persist stages, registration
+// in the metadata store and the notify stages (see pipeline.go)
+func IngestImage(ctx context.Context, backend Backend, r io.Reader, opts IngestOptions) (*IngestResult, error) {
+	if err := validateUpload(opts.Filename, opts.Size, opts.MaxSize); err != nil {
+		return nil, err
+	}
+	if opts.Started.IsZero() {
+		opts.Started = time.Now()
+	}
+	// Heavy processing can be rolled out tenant by tenant
+	if !featureFlags.Enabled(FlagTranscoding, opts.Tenant) {
+		opts.Reencode, opts.Color, opts.Orient = nil, nil, nil
+	}
+	// Hashes of the content would let it be recognized without the key
+	encrypted := customerKeyFromContext(ctx) != nil
+	if encrypted {
+		opts.Dedupe, opts.PHash = false, false
+	}
+
+	job := &PipelineJob{
+		Options: opts,
+		Backend: backend,
+		Ext:     strings.ToLower(filepath.Ext(opts.Filename)),
+	}
+	stages := processingPipelines.For(backend.Bucket(), opts.Tenant, opts.Profile)
+
+	// Stages work on the whole file; files no stage reads are streamed
+	limit, size := opts.MaxSize, opts.Size
+	if needsContent(job, stages) {
+		data, err := readAllLimited(r, opts.MaxSize)
+		if err != nil {
+			return nil, err
+		}
+		job.Data = data
+		if err := runPhase(ctx, job, stages, PhaseValidate); err != nil {
+			return nil, err
+		}
+		if err := runPhase(ctx, job, stages, PhaseTransform); err != nil {
+			return nil, err
+		}
+		r, limit = bytes.NewReader(job.Data), int64(len(job.Data))
+		size = limit
+	}
+
+	// The declared size can't be trusted for every source (e.g. zip headers)
+	body := newUploadBody(r, limit)
+
+	metadata := opts.Metadata
+	if opts.Uploader != "" {
+		metadata = mergeMetadata(opts.Metadata, map[string]string{"uploader": opts.Uploader})
+	}
+	info, err := UploadImage(ctx, backend, body, size, staging.Prefix(opts.Prefix), opts.Filename, metadata, opts.Disposition, opts.Collision)
+	if body.tooLarge() {
+		// The backend aborted the write on the read error, nothing was stored
+		return nil, errUploadTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Tenants with strict integrity requirements get the object read back
+	if uploadVerification.Enabled(opts.Tenant) {
+		if err := verifyWrite(ctx, backend, info.Name, limit+1-body.limited.N, body.crc.Sum32()); err != nil {
+			return nil, err
+		}
+	}
+
+	sum := hex.EncodeToString(body.sha.Sum(nil))
+	if encrypted {
+		sum = ""
+	}
+	width, height := imageDimensions(body.head.data)
+	if opts.Dedupe {
+		if result, ok := reuseAsset(ctx, backend, info, opts.Tenant, sum); ok {
+			result.Width, result.Height = width, height
+			return result, nil
+		}
+	}
+
+	job.Info = info
+	job.Record = AssetRecord{
+		Bucket:      backend.Bucket(),
+		Name:        info.Name,
+		Size:        info.Size,
+		ContentType: info.ContentType,
+		SHA256:      sum,
+		Tenant:      opts.Tenant,
+		Source:      opts.Source,
+		Uploader:    opts.Uploader,
+		Origin:      opts.Origin,
+		Metadata:    mergeMetadata(opts.Metadata, nil),
+		Tags:        opts.Tags,
+		Encrypted:   encrypted,
+		CreatedAt:   time.Now().UTC(), // set here rather than by the store, so receipts carry it
+	}
+	// Don't leave an object behind that the pipeline rejected
+	discard := func() {
+		for _, name := range []string{job.Info.Name, job.Record.Metadata["poster"]} {
+			if name == "" {
+				continue
+			}
+			if err := backend.Delete(ctx, name); err != nil {
+				traceLogf(ctx, "⚠️  Failed to remove rejected object %s: %v", name, err)
+			}
+		}
+	}
+	if err := runPhase(ctx, job, stages, PhasePersist); err != nil {
+		discard()
+		return nil, err
+	}
+	// Staged uploads get their final name once processed, unless they wait for a publish
+	staged := staging.Hides(info.Name)
+	if staged && staging.autoPublish {
+		record, published, err := staging.publish(ctx, backend, job.Record, opts.Collision)
+		if err != nil {
+			discard()
+			return nil, err
+		}
+		job.Record, job.Info, staged = record, published, false
+	}
+	if err := metadataStore.Put(job.Record); err != nil {
+		// The object is stored, so don't fail the upload over the catalog
+		traceLogf(ctx, "⚠️  Failed to register %s in metadata store: %v", job.Info.Name, err)
+	}
+	recordUsage(backend.Bucket(), opts.Origin, opts.Tenant, info.Size)
+
+	if opts.Uploader != "" {
+		traceLogf(ctx, "📤 %s/%s uploaded by %s", backend.Bucket(), job.Info.Name, opts.Uploader)
+	}
+	// Notify stages can't fail the upload, see resolveStages
+	runPhase(ctx, job, stages, PhaseNotify)
+	return &IngestResult{
+		ObjectInfo: job.Info,
+		Record:     job.Record,
+		Poster:     job.Record.Metadata["poster"],
+		Staged:     staged,
+		Width:      width,
+		Height:     height,
+	}, nil
+}
+
+// uploadBody is the content of an upload on its way to the backend, hashed
+// as it is read. Reading past the size limit fails with errUploadTooLarge, so
+// the backend aborts the write instead of storing the oversized object.
+type uploadBody struct {
+	src   io.Reader
+	start int64 // offset of the content in src, -1 when src can't seek
+	limit int64
+
+	sha     hash.Hash
+	crc     hash.Hash32
+	head    headWriter // for the dimensions of the image
+	limited *io.LimitedReader
+	tee     io.Reader
+}
+
+func newUploadBody(src io.Reader, limit int64) *uploadBody {
+	b := &uploadBody{src: src, start: -1, limit: limit}
+	if seeker, ok := src.(io.Seeker); ok {
+		if start, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			b.start = start
+		}
+	}
+	b.reset()
+	return b
+}
+
+func (b *uploadBody) reset() {
+	b.sha, b.crc = sha256.New(), crc32.New(crc32cTable)
+	b.head = headWriter{limit: exifReadLimit}
+	b.limited = &io.LimitedReader{R: b.src, N: b.limit + 1}
+	b.tee = io.TeeReader(b.limited, io.MultiWriter(b.sha, b.crc, &b.head))
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	n, err := b.tee.Read(p)
+	if b.tooLarge() {
+		return n, errUploadTooLarge
+	}
+	return n, err
+}
+
+// tooLarge reports whether more than limit bytes were read
+func (b *uploadBody) tooLarge() bool {
+	return b.limited.N == 0
+}
+
+// Rewind starts the content over when its source can seek; streamed request
+// bodies can't be read twice
+func (b *uploadBody) Rewind() error {
+	if b.start < 0 {
+		return errors.New("upload content can't be read again")
+	}
+	if _, err := b.src.(io.Seeker).Seek(b.start, io.SeekStart); err != nil {
+		return err
+	}
+	b.reset()
+	return nil
+}
+
+// headWriter keeps the first limit bytes written to it
+type headWriter struct {
+	data  []byte
+	limit int
+}
+
+func (h *headWriter) Write(p []byte) (int, error) {
+	if n := min(len(p), h.limit-len(h.data)); n > 0 {
+		h.data = append(h.data, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// imageDimensions returns the pixel size of an image from the start of its
+// content, 0x0 when the format isn't decodable or the header is cut off
+func imageDimensions(head []byte) (int, int) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(head))
+	if err != nil {
+		return 0, 0
+	}
+	return config.Width, config.Height
+}
+
+// reuseAsset looks for an asset of the tenant with the same content as the
+// object just stored. If one still exists, the new object is deleted and the
+// existing asset returned instead. Hashing happens while storing, so the
+// duplicate is only known once it is written.
+func reuseAsset(ctx context.Context, backend Backend, info *ObjectInfo, tenant, sum string) (*IngestResult, bool) {
+	existing, ok := metadataStore.FindByContent(backend.Bucket(), tenant, sum)
+	if !ok || existing.Name == info.Name {
+		return nil, false
+	}
+	existingInfo, err := backend.Stat(ctx, existing.Name)
+	if err != nil {
+		// Deleted behind the catalog's back (or unreachable): keep the new copy
+		return nil, false
+	}
+
+	if err := backend.Delete(ctx, info.Name); err != nil {
+		traceLogf(ctx, "⚠️  Failed to remove duplicate %s of %s: %v", info.Name, existing.Name, err)
+		return nil, false
+	}
+	uploadsDeduplicatedTotal.WithLabelValues(backend.Bucket(), metricTenants.Label(tenant)).Inc()
+	return &IngestResult{
+		ObjectInfo:   existingInfo,
+		Record:       existing,
+		Poster:       existing.Metadata["poster"],
+		Deduplicated: true,
+	}, true
+}
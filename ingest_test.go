@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestUploadBodyAbortsPastLimit(t *testing.T) {
+	backend := newMockBackend()
+	body := newUploadBody(strings.NewReader("0123456789"), 5)
+	if _, err := UploadImage(context.Background(), backend, body, 0, "", "cat.png", nil, "", CollisionOverwrite); !errors.Is(err, errUploadTooLarge) {
+		t.Errorf("UploadImage() error = %v, want errUploadTooLarge", err)
+	}
+	if !body.tooLarge() || len(backend.objects) != 0 {
+		t.Errorf("tooLarge %v with %d objects stored, want true and none", body.tooLarge(), len(backend.objects))
+	}
+}
+
+func TestUploadBodyAtLimit(t *testing.T) {
+	backend := newMockBackend()
+	body := newUploadBody(strings.NewReader("01234"), 5)
+	info, err := UploadImage(context.Background(), backend, body, 0, "", "cat.png", nil, "", CollisionOverwrite)
+	if err != nil || info.Size != 5 || body.tooLarge() {
+		t.Errorf("UploadImage() = %+v, %v, tooLarge %v", info, err, body.tooLarge())
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// inventoryGrace leaves out objects and records newer than this, so uploads
+// in flight (stored but not yet registered) don't count as drift
+const inventoryGrace = 10 * time.Minute
+
+// maxInventorySamples caps the object names listed per kind of drift
+const maxInventorySamples = 100
+
+// Kinds of drift between a bucket and the catalog
+const (
+	DriftUntracked = "untracked" // object without a record
+	DriftMissing   = "missing"   // record whose object is gone
+	DriftChanged   = "changed"   // object whose size differs from its record
+)
+
+// InventoryConfig holds the settings of the bucket inventory job
+type InventoryConfig struct {
+	Interval       time.Duration // time between runs, 0 to only run on demand
+	Repair         bool          // fix the drift found by scheduled runs
+	MaxRepairs     int           // drift per bucket above which nothing is repaired
+	IgnorePrefixes []string      // objects that are never catalogued, e.g. reports
+}
+
+// BucketInventory is the drift found in one bucket
+type BucketInventory struct {
+	Bucket    string   `json:"bucket"`
+	Objects   int      `json:"objects"` // listed objects, renditions and ignored prefixes left out
+	Records   int      `json:"records"`
+	Untracked int      `json:"untracked"`
+	Missing   int      `json:"missing"`
+	Changed   int      `json:"changed"`
+	Repaired  int      `json:"repaired"`
+	Samples   []string `json:"samples,omitempty"` // "kind: name" of the first drifted objects
+	Error     string   `json:"error,omitempty"`
+}
+
+// InventoryReport is the result of an inventory run
+type InventoryReport struct {
+	StartedAt  time.Time         `json:"startedAt"`
+	FinishedAt time.Time         `json:"finishedAt"`
+	Repair     bool              `json:"repair"`
+	Buckets    []BucketInventory `json:"buckets"`
+}
+
+// Inventory compares the objects of every bucket with the metadata catalog
+// and reports, and optionally repairs, the drift: untracked objects are
+// registered, records of objects that are gone are removed and sizes are
+// updated. Listings are the truth; a bucket with more drift than MaxRepairs
+// is only reported, since that is more likely a listing problem (wrong
+// bucket, missing permission) than real drift.
+type Inventory struct {
+	cfg      InventoryConfig
+	backends map[string]Backend
+
+	mu      sync.Mutex
+	running bool
+	last    *InventoryReport
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewInventory creates the inventory job; call Start to run it on schedule
+func NewInventory(cfg InventoryConfig, backends map[string]Backend) *Inventory {
+	return &Inventory{
+		cfg:      cfg,
+		backends: backends,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start runs the inventory at every interval
+func (inv *Inventory) Start() {
+	go func() {
+		defer close(inv.done)
+		for {
+			select {
+			case <-inv.stop:
+				return
+			case <-time.After(inv.cfg.Interval):
+			}
+			inv.Run(context.Background(), inv.cfg.Repair)
+		}
+	}()
+}
+
+// Stop ends the scheduled runs
+func (inv *Inventory) Stop() {
+	close(inv.stop)
+	<-inv.done
+}
+
+// Last returns the report of the last run, nil before the first, and
+// whether a run is in progress
+func (inv *Inventory) Last() (*InventoryReport, bool) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return inv.last, inv.running
+}
+
+// Run takes the inventory of every bucket, unless a run is in progress, in
+// which case it returns nil
+func (inv *Inventory) Run(ctx context.Context, repair bool) *InventoryReport {
+	inv.mu.Lock()
+	if inv.running {
+		inv.mu.Unlock()
+		return nil
+	}
+	inv.running = true
+	inv.mu.Unlock()
+
+	report := &InventoryReport{StartedAt: time.Now().UTC(), Repair: repair}
+	for _, backend := range inv.backends {
+		result := inv.reconcile(ctx, backend, report.StartedAt.Add(-inventoryGrace), repair)
+		inventoryDriftObjects.WithLabelValues(result.Bucket, DriftUntracked).Set(float64(result.Untracked))
+		inventoryDriftObjects.WithLabelValues(result.Bucket, DriftMissing).Set(float64(result.Missing))
+		inventoryDriftObjects.WithLabelValues(result.Bucket, DriftChanged).Set(float64(result.Changed))
+		if result.Error != "" {
+			inventoryErrorsTotal.WithLabelValues(result.Bucket).Inc()
+		}
+		log.Printf("🧾 Inventory of %s: %d objects, %d records, %d untracked, %d missing, %d changed, %d repaired", result.Bucket, result.Objects, result.Records, result.Untracked, result.Missing, result.Changed, result.Repaired)
+		report.Buckets = append(report.Buckets, result)
+	}
+	report.FinishedAt = time.Now().UTC()
+	inventoryLastRunTimestamp.Set(float64(report.FinishedAt.Unix()))
+
+	inv.mu.Lock()
+	inv.last = report
+	inv.running = false
+	inv.mu.Unlock()
+	return report
+}
+
+// ignored reports whether an object is left out of the inventory: posters
+// are renditions without a record of their own
+func (inv *Inventory) ignored(name string) bool {
+	if strings.HasSuffix(name, "/") || strings.HasSuffix(name, ".poster.png") {
+		return true
+	}
+	for _, prefix := range inv.cfg.IgnorePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcile compares one bucket with its records. Objects updated and
+// records created after cutoff are left out.
+func (inv *Inventory) reconcile(ctx context.Context, backend Backend, cutoff time.Time, repair bool) BucketInventory {
+	result := BucketInventory{Bucket: backend.Bucket()}
+
+	objects := map[string]ObjectInfo{}
+	err := backend.List(ctx, "", func(obj ObjectInfo) error {
+		if !inv.ignored(obj.Name) {
+			objects[obj.Name] = obj
+		}
+		return nil
+	})
+	if err != nil {
+		// A partial listing would report every unlisted object as missing
+		result.Error = fmt.Sprintf("failed to list: %v", err)
+		return result
+	}
+	result.Objects = len(objects)
+
+	var untracked, changed []ObjectInfo
+	var missing []AssetRecord
+	records := metadataStore.Records(backend.Bucket())
+	result.Records = len(records)
+	registered := make(map[string]bool, len(records))
+	for _, record := range records {
+		registered[record.Name] = true
+		obj, ok := objects[record.Name]
+		switch {
+		case inv.ignored(record.Name) || record.CreatedAt.After(cutoff):
+		case !ok:
+			missing = append(missing, record)
+		case obj.Size != record.Size:
+			changed = append(changed, obj)
+		}
+	}
+	for name, obj := range objects {
+		if !registered[name] && obj.Updated.Before(cutoff) {
+			untracked = append(untracked, obj)
+		}
+	}
+	result.Untracked, result.Missing, result.Changed = len(untracked), len(missing), len(changed)
+
+	addSample := func(kind, name string) {
+		if len(result.Samples) < maxInventorySamples {
+			result.Samples = append(result.Samples, kind+": "+name)
+		}
+	}
+	for _, obj := range untracked {
+		addSample(DriftUntracked, obj.Name)
+	}
+	for _, record := range missing {
+		addSample(DriftMissing, record.Name)
+	}
+	for _, obj := range changed {
+		addSample(DriftChanged, obj.Name)
+	}
+
+	if !repair {
+		return result
+	}
+	if drift := len(untracked) + len(missing) + len(changed); drift > inv.cfg.MaxRepairs {
+		result.Error = fmt.Sprintf("%d drifted objects exceed INVENTORY_MAX_REPAIRS (%d), nothing repaired", drift, inv.cfg.MaxRepairs)
+		log.Printf("⚠️  Inventory of %s: %s", result.Bucket, result.Error)
+		return result
+	}
+
+	repaired := func(kind string, err error) {
+		if err != nil {
+			log.Printf("⚠️  Inventory of %s: failed to repair %s object: %v", result.Bucket, kind, err)
+			return
+		}
+		result.Repaired++
+		inventoryRepairsTotal.WithLabelValues(result.Bucket, kind).Inc()
+	}
+	for _, obj := range untracked {
+		repaired(DriftUntracked, metadataStore.Put(AssetRecord{
+			Bucket:      result.Bucket,
+			Name:        obj.Name,
+			Size:        obj.Size,
+			ContentType: obj.ContentType,
+			Source:      SourceInventory,
+			Uploader:    obj.Metadata["uploader"],
+			Metadata:    mergeMetadata(obj.Metadata, nil, reservedMetadataKeys...),
+			Encrypted:   obj.Encrypted,
+			CreatedAt:   obj.Updated.UTC(),
+		}))
+	}
+	for _, record := range missing {
+		repaired(DriftMissing, metadataStore.Delete(record.Bucket, record.Name))
+	}
+	for _, obj := range changed {
+		_, _, err := metadataStore.Update(result.Bucket, obj.Name, func(record *AssetRecord) error {
+			// The content changed behind the catalog's back, so its hashes no longer apply
+			record.Size, record.ContentType, record.SHA256, record.PHash = obj.Size, obj.ContentType, "", ""
+			return nil
+		})
+		repaired(DriftChanged, err)
+	}
+	return result
+}
+
+// HandleInventory reports the last inventory (GET) and starts a run (POST,
+// ?repair=true to repair regardless of INVENTORY_REPAIR)
+func HandleInventory(inventory *Inventory) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		switch r.Method {
+		case http.MethodGet:
+			report, running := inventory.Last()
+			if report == nil {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   "No inventory has run yet. POST to start one.",
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(struct {
+				*InventoryReport
+				Running bool `json:"running"`
+			}{report, running})
+
+		case http.MethodPost:
+			repair := inventory.cfg.Repair
+			if value := r.URL.Query().Get("repair"); value != "" {
+				repair = value == "true"
+			}
+			if _, running := inventory.Last(); running {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   "An inventory is already running",
+				})
+				return
+			}
+			go inventory.Run(context.Background(), repair)
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: true,
+				Message: "Inventory started. GET this endpoint for the report.",
+			})
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "Method not allowed. Use GET or POST.",
+			})
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// maxJSONBody is the size limit of JSON request bodies unless an endpoint
+// sets its own
+const maxJSONBody = 1 << 20
+
+// maxJSONDepth is how deeply JSON request bodies may nest; no request type
+// comes close, so deeper bodies are malicious or broken
+const maxJSONDepth = 32
+
+// RequestError is a request body that can't be used, with the status to
+// answer it with:
+//
+//   - 415 when the Content-Type isn't JSON
+//   - 413 when the body is over the size limit
+//   - 400 when the body is missing or isn't well-formed JSON
+//   - 422 when it is JSON but doesn't fit the request: unknown fields,
+//     values of the wrong type or nesting deeper than maxJSONDepth
+type RequestError struct {
+	Status  int
+	Message string
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
+
+// decodeJSONBody decodes the JSON body of a request into v, strictly: the
+// Content-Type must be application/json (or a +json type) in UTF-8, the body
+// at most maxBytes (maxJSONBody when 0) and a single value whose fields all
+// exist in v. Handlers answer a non-nil error with its status and message,
+// in their own response type.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v any, maxBytes int64) *RequestError {
+	if err := checkJSONContentType(r.Header.Get("Content-Type")); err != nil {
+		return err
+	}
+	if maxBytes <= 0 {
+		maxBytes = maxJSONBody
+	}
+
+	// Decoding copies what it keeps, so the body can be read into a pooled buffer
+	buf := getJSONBuffer()
+	defer putJSONBuffer(buf)
+	if _, err := buf.ReadFrom(http.MaxBytesReader(w, r.Body, maxBytes)); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return &RequestError{http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes", maxBytes)}
+		}
+		return &RequestError{http.StatusBadRequest, "Failed to read request body"}
+	}
+	data := buf.Bytes()
+	if len(bytes.TrimSpace(data)) == 0 {
+		return &RequestError{http.StatusBadRequest, "Request body is required"}
+	}
+	if jsonDepth(data) > maxJSONDepth {
+		return &RequestError{http.StatusUnprocessableEntity, fmt.Sprintf("Request body nests deeper than %d levels", maxJSONDepth)}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return jsonDecodeError(err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return &RequestError{http.StatusBadRequest, "Request body must be a single JSON value"}
+	}
+	return nil
+}
+
+// checkJSONContentType rejects bodies not declared as JSON, e.g. text/plain
+// or the form encoding curl -d sends by default
+func checkJSONContentType(contentType string) *RequestError {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+		return &RequestError{http.StatusUnsupportedMediaType, "Content-Type must be application/json"}
+	}
+	if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") {
+		return &RequestError{http.StatusUnsupportedMediaType, "JSON request bodies must be UTF-8"}
+	}
+	return nil
+}
+
+// jsonDecodeError explains why a body didn't decode
+func jsonDecodeError(err error) *RequestError {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return &RequestError{http.StatusBadRequest, fmt.Sprintf("Malformed JSON at byte %d", syntaxErr.Offset)}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &RequestError{http.StatusBadRequest, "Malformed JSON: the body ends early"}
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return &RequestError{http.StatusUnprocessableEntity, fmt.Sprintf("Request body must be a JSON object, not %s", typeErr.Value)}
+		}
+		return &RequestError{http.StatusUnprocessableEntity, fmt.Sprintf("Field %q must be %s, not %s", typeErr.Field, jsonTypeName(typeErr.Type.Kind().String()), typeErr.Value)}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// The decoder has no error type for unknown fields
+		return &RequestError{http.StatusUnprocessableEntity, "Unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field ")}
+	}
+	return &RequestError{http.StatusBadRequest, "Invalid JSON body"}
+}
+
+// jsonTypeName names a Go kind the way a JSON client knows it
+func jsonTypeName(kind string) string {
+	switch kind {
+	case "string":
+		return "a string"
+	case "bool":
+		return "a boolean"
+	case "slice", "array":
+		return "an array"
+	case "map", "struct":
+		return "an object"
+	case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64", "float32", "float64":
+		return "a number"
+	}
+	return "a " + kind
+}
+
+// jsonDepth returns the deepest nesting of objects and arrays in a JSON
+// document, without decoding it
+func jsonDepth(data []byte) int {
+	depth, deepest := 0, 0
+	inString, escaped := false, false
+	for _, c := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			depth++
+			deepest = max(deepest, depth)
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return deepest
+}
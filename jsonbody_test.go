@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testJSONRequest struct {
+	Name  string   `json:"name"`
+	Count int      `json:"count"`
+	Tags  []string `json:"tags,omitempty"`
+}
+
+func TestDecodeJSONBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int // 0 for a decoded body
+	}{
+		{"valid", "application/json", `{"name":"cat","count":2,"tags":["a"]}`, 0},
+		{"charset", "application/json; charset=UTF-8", `{"name":"cat"}`, 0},
+		{"+json type", "application/merge-patch+json", `{"name":"cat"}`, 0},
+		{"text/plain", "text/plain", `{"name":"cat"}`, http.StatusUnsupportedMediaType},
+		{"form", "application/x-www-form-urlencoded", `name=cat`, http.StatusUnsupportedMediaType},
+		{"no content type", "", `{"name":"cat"}`, http.StatusUnsupportedMediaType},
+		{"latin-1", "application/json; charset=ISO-8859-1", `{"name":"cat"}`, http.StatusUnsupportedMediaType},
+		{"too large", "application/json", `{"name":"` + strings.Repeat("x", 200) + `"}`, http.StatusRequestEntityTooLarge},
+		{"empty", "application/json", "  ", http.StatusBadRequest},
+		{"malformed", "application/json", `{"name":}`, http.StatusBadRequest},
+		{"truncated", "application/json", `{"name":"cat"`, http.StatusBadRequest},
+		{"two values", "application/json", `{"name":"cat"}{"name":"dog"}`, http.StatusBadRequest},
+		{"unknown field", "application/json", `{"name":"cat","colour":"black"}`, http.StatusUnprocessableEntity},
+		{"wrong type", "application/json", `{"count":"two"}`, http.StatusUnprocessableEntity},
+		{"not an object", "application/json", `["cat"]`, http.StatusUnprocessableEntity},
+		{"too deep", "application/json", strings.Repeat("[", maxJSONDepth+1) + strings.Repeat("]", maxJSONDepth+1), http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			var v testJSONRequest
+			err := decodeJSONBody(httptest.NewRecorder(), req, &v, 128)
+			switch {
+			case tt.want == 0 && err != nil:
+				t.Errorf("decodeJSONBody() = %d %s, want the body decoded", err.Status, err.Message)
+			case tt.want == 0 && v.Name != "cat":
+				t.Errorf("decoded %+v", v)
+			case tt.want != 0 && (err == nil || err.Status != tt.want):
+				t.Errorf("decodeJSONBody() = %v, want status %d", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONDepthIgnoresStrings(t *testing.T) {
+	if depth := jsonDepth([]byte(`{"a":[{"b":"[[[{{{\"]]]"}]}`)); depth != 3 {
+		t.Errorf("jsonDepth() = %d, want 3", depth)
+	}
+}
+
+func TestHandlerRejectsPlainTextJSON(t *testing.T) {
+	// Handlers answer a rejected body in their own response type
+	req := httptest.NewRequest(http.MethodPost, "/receipts/verify", strings.NewReader(`{"receipt":"x"}`))
+	req.Header.Set("Content-Type", "text/plain")
+	rec := httptest.NewRecorder()
+	HandleVerifyReceipt(NewReceiptSigner(ReceiptConfig{Keys: []string{"k"}}))(rec, req)
+	if rec.Code != http.StatusUnsupportedMediaType || !strings.Contains(rec.Body.String(), `"success":false`) {
+		t.Errorf("status %d, body %s, want 415 with an error response", rec.Code, rec.Body)
+	}
+}
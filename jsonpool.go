@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// maxPooledJSONBuffer keeps buffers grown by large responses (listings,
+// archives manifests) out of the pool, so it doesn't pin their memory
+const maxPooledJSONBuffer = 64 << 10
+
+// jsonBuffer is a reusable buffer with an encoder writing into it
+type jsonBuffer struct {
+	bytes.Buffer
+	enc *json.Encoder
+}
+
+// jsonBuffers recycles the buffers responses are encoded into and request
+// bodies are read into, which the handlers of busy routes such as /signedurl
+// would otherwise allocate on every request
+var jsonBuffers = sync.Pool{
+	New: func() any {
+		buf := &jsonBuffer{}
+		buf.enc = json.NewEncoder(&buf.Buffer)
+		return buf
+	},
+}
+
+// getJSONBuffer returns an empty buffer from the pool
+func getJSONBuffer() *jsonBuffer {
+	buf := jsonBuffers.Get().(*jsonBuffer)
+	buf.Reset()
+	return buf
+}
+
+// putJSONBuffer returns a buffer to the pool; its bytes must no longer be used
+func putJSONBuffer(buf *jsonBuffer) {
+	if buf.Cap() <= maxPooledJSONBuffer {
+		jsonBuffers.Put(buf)
+	}
+}
+
+// writeJSON answers with v as JSON. The body is encoded into a pooled buffer
+// and written at once.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	buf := getJSONBuffer()
+	defer putJSONBuffer(buf)
+	if err := buf.enc.Encode(v); err != nil {
+		writeJSONBody(w, http.StatusInternalServerError, bodyEncodingFailed)
+		return
+	}
+	writeJSONBody(w, status, buf.Bytes())
+}
+
+// writeJSONBody answers with a JSON body that is already encoded
+func writeJSONBody(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// mustMarshalJSON encodes a static response body once, at startup, with the
+// trailing newline json.Encoder writes
+func mustMarshalJSON(v any) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return append(data, '\n')
+}
+
+// Static error bodies of the busiest routes and middleware, encoded once
+var (
+	bodyEncodingFailed       = mustMarshalJSON(UploadResponse{Success: false, Error: "Failed to encode response"})
+	bodyMethodNotAllowedPost = mustMarshalJSON(UploadResponse{Success: false, Error: "Method not allowed. Use POST."})
+	bodyMethodNotAllowedGet  = mustMarshalJSON(UploadResponse{Success: false, Error: "Method not allowed. Use GET."})
+	bodyObjectNotFound       = mustMarshalJSON(UploadResponse{Success: false, Error: "Object not found"})
+	bodyTooManyRequests      = mustMarshalJSON(UploadResponse{Success: false, Error: "Too many requests, retry later"})
+	bodyServiceBusy          = mustMarshalJSON(UploadResponse{Success: false, Error: "Service is busy, retry later"})
+	bodyTooManyUploads       = mustMarshalJSON(UploadResponse{Success: false, Error: "Too many uploads in progress, retry later"})
+)
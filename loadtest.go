@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"math/rand/v2"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Load test modes
+const (
+	loadModeUpload = "upload" // multipart POST to the upload endpoint
+	loadModeSigned = "signed" // signed URL request, then PUT to the returned URL
+)
+
+// loadTestMockPath is where the mock backend's signed URLs point to
+const loadTestMockPath = "/__loadtest/objects/"
+
+// LoadTestOptions configures `gcb loadtest`
+type LoadTestOptions struct {
+	Target      string // base URL of a running instance, "" for the in-process mock
+	APIKey      string
+	Modes       []string
+	Requests    int // per mode
+	Concurrency int
+	Size        int // approximate bytes per uploaded image
+	Field       string
+}
+
+// LoadTestReport summarizes one mode of a load test. Allocations are those
+// of the whole process, so with the mock they include the server side.
+type LoadTestReport struct {
+	Mode        string         `json:"mode"`
+	Target      string         `json:"target"`
+	Requests    int            `json:"requests"`
+	Failed      int            `json:"failed"`
+	Errors      map[string]int `json:"errors,omitempty"` // failures by status or error
+	Duration    float64        `json:"durationSeconds"`
+	Throughput  float64        `json:"requestsPerSecond"`
+	MBPerSecond float64        `json:"mbPerSecond"`
+	P50         float64        `json:"p50Ms"`
+	P90         float64        `json:"p90Ms"`
+	P99         float64        `json:"p99Ms"`
+	Max         float64        `json:"maxMs"`
+	AllocsPerOp uint64         `json:"allocsPerOp"`
+	BytesPerOp  uint64         `json:"allocBytesPerOp"`
+}
+
+// mockBackend stands in for object storage in load tests: content is read
+// and discarded, only the attributes are kept so names and collisions
+// behave as on a real bucket
+type mockBackend struct {
+	baseURL string // of the in-process server, for signed URLs
+
+	mu      sync.Mutex
+	objects map[string]ObjectInfo
+}
+
+func newMockBackend() *mockBackend {
+	return &mockBackend{objects: map[string]ObjectInfo{}}
+}
+
+func (m *mockBackend) Bucket() string {
+	return "loadtest"
+}
+
+func (m *mockBackend) Put(ctx context.Context, name string, r io.Reader, opts PutOptions) (*ObjectInfo, error) {
+	size, err := io.Copy(io.Discard, &contextReader{ctx: ctx, r: r})
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload file: %w", err)
+	}
+	info := ObjectInfo{Name: name, Size: size, ContentType: opts.ContentType, ContentDisposition: opts.ContentDisposition, Updated: time.Now(), Metadata: opts.Metadata}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.objects[name]; exists && opts.IfNotExists {
+		return nil, ErrObjectExists
+	}
+	m.objects[name] = info
+	return &info, nil
+}
+
+func (m *mockBackend) Open(ctx context.Context, name string) (io.ReadCloser, *ObjectInfo, error) {
+	info, err := m.Stat(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Content isn't kept; readers get zeros of the right length
+	return io.NopCloser(io.LimitReader(zeroReader{}, info.Size)), info, nil
+}
+
+func (m *mockBackend) Stat(ctx context.Context, name string) (*ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	info, ok := m.objects[name]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return &info, nil
+}
+
+func (m *mockBackend) Delete(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.objects[name]; !ok {
+		return ErrObjectNotFound
+	}
+	delete(m.objects, name)
+	return nil
+}
+
+func (m *mockBackend) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	m.mu.Lock()
+	var objects []ObjectInfo
+	for name, info := range m.objects {
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, info)
+		}
+	}
+	m.mu.Unlock()
+	slices.SortFunc(objects, func(a, b ObjectInfo) int { return strings.Compare(a.Name, b.Name) })
+	for _, info := range objects {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mockBackend) SignedURL(method, name string, opts SignOptions) (string, error) {
+	return m.baseURL + loadTestMockPath + objectURLPath(name), nil
+}
+
+func (m *mockBackend) PublicURL(name string) string {
+	return m.baseURL + loadTestMockPath + objectURLPath(name)
+}
+
+func (m *mockBackend) Close() error {
+	return nil
+}
+
+// handlePut accepts PUTs to the mock backend's signed URLs
+func (m *mockBackend) handlePut(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, loadTestMockPath)
+	if _, err := m.Put(r.Context(), name, r.Body, PutOptions{ContentType: r.Header.Get("Content-Type")}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// startMockServer serves the upload and signed URL handlers over the mock
+// backend, with the metadata store in a temporary directory
+func startMockServer(config *Config, dir string) (*httptest.Server, error) {
+	store, err := OpenMetadataStore(filepath.Join(dir, "metadata.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	metadataStore = store
+
+	backend := newMockBackend()
+	mux := http.NewServeMux()
+	mux.Handle("/upload", HandleUpload(backend, config))
+	mux.Handle("/signedurl", HandleGenerateSignedUrl(backend, config.MaxFileSize, config.SignedURLContentTypes))
+	mux.HandleFunc(loadTestMockPath, backend.handlePut)
+	server := httptest.NewServer(mux)
+	backend.baseURL = server.URL
+	return server, nil
+}
+
+// loadTestImage returns a PNG of noise, which doesn't compress, of about size bytes
+func loadTestImage(size int) ([]byte, error) {
+	side := max(int(math.Sqrt(float64(size)/4)), 1)
+	img := image.NewNRGBA(image.Rect(0, 0, side, side))
+	for i := range img.Pix {
+		img.Pix[i] = byte(rand.IntN(256))
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// loadTester sends the requests of one load test
+type loadTester struct {
+	opts   LoadTestOptions
+	client *http.Client
+	image  []byte
+	seq    atomic.Int64
+}
+
+// upload sends one multipart upload
+func (t *loadTester) upload(ctx context.Context) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile(t.opts.Field, fmt.Sprintf("loadtest-%d.png", t.seq.Add(1)))
+	if err != nil {
+		return err
+	}
+	part.Write(t.image)
+	form.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.opts.Target+"/upload", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return t.do(req, nil)
+}
+
+// signedUpload requests a signed URL and uploads to it
+func (t *loadTester) signedUpload(ctx context.Context) error {
+	payload, _ := json.Marshal(SignedUrlRequest{
+		Filename:    fmt.Sprintf("loadtest-%d.png", t.seq.Add(1)),
+		ContentType: "image/png",
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.opts.Target+"/signedurl", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var signed UploadResponse
+	if err := t.do(req, &signed); err != nil {
+		return err
+	}
+
+	put, err := http.NewRequestWithContext(ctx, http.MethodPut, signed.URL, bytes.NewReader(t.image))
+	if err != nil {
+		return err
+	}
+	put.Header.Set("Content-Type", "image/png")
+	for key, value := range signed.Headers {
+		put.Header.Set(key, value)
+	}
+	// The storage service doesn't know the API key
+	return t.send(put, nil)
+}
+
+// do sends a request to the service, with the API key
+func (t *loadTester) do(req *http.Request, out any) error {
+	if t.opts.APIKey != "" {
+		req.Header.Set("X-API-Key", t.opts.APIKey)
+	}
+	return t.send(req, out)
+}
+
+// send sends a request and decodes the JSON response into out, if given
+func (t *loadTester) send(req *http.Request, out any) error {
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		io.Copy(io.Discard, resp.Body)
+		return fmt.Errorf("%s %s", req.Method, resp.Status)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+// run sends opts.Requests requests of mode with opts.Concurrency workers
+func (t *loadTester) run(mode string) LoadTestReport {
+	send := t.upload
+	if mode == loadModeSigned {
+		send = t.signedUpload
+	}
+
+	var mu sync.Mutex
+	latencies := make([]time.Duration, 0, t.opts.Requests)
+	errs := map[string]int{}
+
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	jobs := make(chan struct{})
+	var wg sync.WaitGroup
+	for range t.opts.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				requestStart := time.Now()
+				err := send(context.Background())
+				elapsed := time.Since(requestStart)
+
+				mu.Lock()
+				if err != nil {
+					errs[err.Error()]++
+				} else {
+					latencies = append(latencies, elapsed)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for range t.opts.Requests {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	report := LoadTestReport{
+		Mode:     mode,
+		Target:   t.opts.Target,
+		Requests: t.opts.Requests,
+		Failed:   t.opts.Requests - len(latencies),
+		Duration: elapsed.Seconds(),
+	}
+	if len(errs) > 0 {
+		report.Errors = errs
+	}
+	report.Throughput = float64(len(latencies)) / elapsed.Seconds()
+	report.MBPerSecond = report.Throughput * float64(len(t.image)) / (1024 * 1024)
+	report.AllocsPerOp = (after.Mallocs - before.Mallocs) / uint64(t.opts.Requests)
+	report.BytesPerOp = (after.TotalAlloc - before.TotalAlloc) / uint64(t.opts.Requests)
+
+	slices.Sort(latencies)
+	report.P50 = percentileMs(latencies, 0.50)
+	report.P90 = percentileMs(latencies, 0.90)
+	report.P99 = percentileMs(latencies, 0.99)
+	report.Max = percentileMs(latencies, 1)
+	return report
+}
+
+// percentileMs returns the p-th percentile of sorted latencies in milliseconds
+func percentileMs(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return float64(sorted[max(i, 0)].Microseconds()) / 1000
+}
+
+// runLoadTestCommand implements the `loadtest` CLI subcommand: it drives
+// synthetic uploads against a running instance, or against the upload
+// handlers over an in-memory mock backend, and reports latency percentiles,
+// throughput and allocations per request
+func runLoadTestCommand(args []string) int {
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	target := flags.String("url", "", "base URL of a running instance (default: in-process server over a mock backend)")
+	apiKey := flags.String("key", os.Getenv("GCS_API_KEY_1"), "API key sent with requests to -url")
+	modes := flags.String("mode", loadModeUpload, "comma-separated modes: upload (multipart), signed (signed URL + PUT)")
+	requests := flags.Int("n", 200, "requests per mode")
+	concurrency := flags.Int("c", 8, "concurrent requests")
+	size := flags.Int("size", 256*1024, "approximate size of each uploaded image in bytes")
+	field := flags.String("field", "image", "multipart file field name")
+	jsonOutput := flags.Bool("json", false, "print the reports as JSON")
+	flags.Parse(args)
+
+	opts := LoadTestOptions{
+		Target:      strings.TrimSuffix(*target, "/"),
+		APIKey:      *apiKey,
+		Modes:       strings.Split(*modes, ","),
+		Requests:    *requests,
+		Concurrency: *concurrency,
+		Size:        *size,
+		Field:       *field,
+	}
+	for _, mode := range opts.Modes {
+		if mode != loadModeUpload && mode != loadModeSigned {
+			fmt.Fprintf(os.Stderr, "unknown mode %q, use upload or signed\n", mode)
+			return 2
+		}
+	}
+	if opts.Requests < 1 || opts.Concurrency < 1 || opts.Size < 1 {
+		fmt.Fprintln(os.Stderr, "usage: loadtest [-url http://host:port] [-mode upload,signed] [-n requests] [-c concurrency] [-size bytes] [-json]")
+		return 2
+	}
+
+	payload, err := loadTestImage(opts.Size)
+	if err != nil {
+		log.Printf("❌ Failed to generate the test image: %v", err)
+		return 1
+	}
+
+	if opts.Target == "" {
+		config := LoadConfig()
+		config.MaxFileSize = max(config.MaxFileSize, int64(len(payload)))
+		dir, err := os.MkdirTemp("", "gcb-loadtest-")
+		if err != nil {
+			log.Printf("❌ Failed to create a temporary directory: %v", err)
+			return 1
+		}
+		defer os.RemoveAll(dir)
+		server, err := startMockServer(config, dir)
+		if err != nil {
+			log.Printf("❌ Failed to start the mock server: %v", err)
+			return 1
+		}
+		defer server.Close()
+		defer metadataStore.Close()
+		opts.Target = server.URL
+		opts.APIKey = ""
+		// Keep the per-upload log lines out of the measurement and the report
+		log.SetOutput(io.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+
+	tester := &loadTester{
+		opts:  opts,
+		image: payload,
+		client: &http.Client{
+			Timeout:   time.Minute,
+			Transport: &http.Transport{MaxIdleConnsPerHost: opts.Concurrency},
+		},
+	}
+	reports := make([]LoadTestReport, 0, len(opts.Modes))
+	failed := false
+	for _, mode := range opts.Modes {
+		report := tester.run(mode)
+		failed = failed || report.Failed > 0
+		reports = append(reports, report)
+	}
+
+	if *jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(reports)
+	} else {
+		fmt.Printf("%d requests per mode, %d concurrent, %d byte images, against %s\n\n", opts.Requests, opts.Concurrency, len(payload), opts.Target)
+		for _, report := range reports {
+			fmt.Printf("%-7s %6.1f req/s %7.1f MB/s  p50 %7.1fms  p90 %7.1fms  p99 %7.1fms  max %7.1fms  %6d allocs/op %9d B/op  %d failed\n",
+				report.Mode, report.Throughput, report.MBPerSecond, report.P50, report.P90, report.P99, report.Max, report.AllocsPerOp, report.BytesPerOp, report.Failed)
+			for message, count := range report.Errors {
+				fmt.Printf("        %dx %s\n", count, message)
+			}
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
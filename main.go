@@ -4,96 +4,668 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
 	"time"
-
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// serverWriteTimeout bounds regular responses; handlers use it as the deadline
+// for backend calls since no response can be written after it
+const serverWriteTimeout = 15 * time.Second
+
 func main() {
+	// Run CLI subcommands instead of the server when one is given
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			os.Exit(runMigrateCommand(os.Args[2:]))
+		case "import":
+			os.Exit(runImportCommand(os.Args[2:]))
+		case "sync":
+			os.Exit(runSyncCommand(os.Args[2:]))
+		case "check", "--self-test":
+			os.Exit(runCheckCommand(os.Args[2:]))
+		case "loadtest":
+			os.Exit(runLoadTestCommand(os.Args[2:]))
+		}
+	}
+
 	// Load configuration
 	config := LoadConfig()
 
-	// Validate bucket name
-	if config.BucketName1 == "" {
-		log.Fatal("GCS_BUCKET_NAME_1 environment variable is required")
+	// Report every configuration problem at once, and refuse to start on errors
+	if err := reportConfigProblems(config.Validate()); err != nil {
+		log.Fatal(err)
+	}
+
+	// Client IP headers are only believed from these proxies
+	trustedProxies, _ = parseTrustedProxies(config.TrustedProxies)
+
+	// Client IPs are minimized before anything records them
+	ipPrivacy = NewIPPrivacy(config.IPPrivacy)
+	if ipPrivacy != nil {
+		log.Printf("🕶️  Client IP privacy enabled (%s)", config.IPPrivacy.Mode)
 	}
 
 	// Check if service account file exists
-	if _, err := os.Stat(config.ServiceAccountPath1); os.IsNotExist(err) {
+	// Without a key file, Google clients use Application Default Credentials
+	if _, err := os.Stat(config.ServiceAccountPath1); config.ServiceAccountPath1 != "" && os.IsNotExist(err) && usesDriver(config, "gcs") {
 		log.Fatalf("Service account file not found at: %s\nPlease place your service-account-key.json file in the project root.", config.ServiceAccountPath1)
 	}
+	if config.WorkloadIdentity.Enabled() {
+		log.Printf("🪪 Authenticating with workload identity federation (token: %s)", config.WorkloadIdentity.TokenPath)
+	}
+
+	// Load the per-bucket CORS rules
+	corsConfig, err := LoadBucketCORSConfig(config.CORSConfigPath)
+	if err != nil {
+		log.Fatalf("Failed to load CORS config: %v", err)
+	}
+	bucketSettings, err := LoadBucketSettings(config.BucketSettingsPath)
+	if err != nil {
+		log.Fatalf("Failed to load bucket settings: %v", err)
+	}
+
+	// Load the feature flags gating processing stages, per tenant
+	featureFlags, err = LoadFeatureFlags(config.FeatureFlags, config.FlagsPath)
+	if err != nil {
+		log.Fatalf("Failed to load feature flags: %v", err)
+	}
+
+	// Choose and order the processing stages per bucket and tenant
+	processingPipelines, err = LoadPipelines(config.PipelinePath)
+	if err != nil {
+		log.Fatalf("Failed to load pipeline config: %v", err)
+	}
 
 	// Create context
 	ctx := context.Background()
 
-	// Initialize GCS client
-	darlingimagesClientProd, err := NewGCSClient(ctx, config.BucketName1, config.ServiceAccountPath1)
+	// Initialize storage backend
+	darlingimagesClientProd, err := NewBackend(ctx, config, BucketConfig{
+		Name:            config.BucketName1,
+		Driver:          config.StorageDriver1,
+		CredentialsPath: config.ServiceAccountPath1,
+		SigningAccount:  config.SigningAccount1,
+		PublicBaseURL:   config.PublicBaseURL1,
+		Mirror:          secondaryBucket(config.MirrorDriver1, config.MirrorBucketName1, config.ServiceAccountPath1, config.PublicBaseURL1),
+		Failover:        secondaryBucket(config.FailoverDriver1, config.FailoverBucketName1, config.ServiceAccountPath1, config.PublicBaseURL1),
+	})
 	if err != nil {
-		log.Fatalf("Failed to initialize GCS client: %v", err)
+		log.Fatalf("Failed to initialize storage backend: %v", err)
 	}
 	defer darlingimagesClientProd.Close()
 
-	// Configure CORS for the bucket
-	log.Printf("⚙️  Configuring CORS for bucket %s with origins: %v", config.BucketName1, config.AllowedOrigins)
-	if err := darlingimagesClientProd.ConfigureCORS(ctx, config.AllowedOrigins); err != nil {
-		log.Printf("⚠️  Warning: Failed to configure bucket CORS: %v", err)
-		log.Println("   Uploads from browser might fail if CORS is not already configured correctly.")
-	} else {
-		log.Println("✅ Bucket CORS configured successfully")
-	}
-	
-	// Initialize GCS client
-	darlingimagesClientDev, err := NewGCSClient(ctx, config.BucketName2, config.ServiceAccountPath1)
+	// Initialize storage backend
+	darlingimagesClientDev, err := NewBackend(ctx, config, BucketConfig{
+		Name:            config.BucketName2,
+		Driver:          config.StorageDriver2,
+		CredentialsPath: config.ServiceAccountPath1,
+		SigningAccount:  config.SigningAccount2,
+		PublicBaseURL:   config.PublicBaseURL2,
+		Mirror:          secondaryBucket(config.MirrorDriver2, config.MirrorBucketName2, config.ServiceAccountPath1, config.PublicBaseURL2),
+		Failover:        secondaryBucket(config.FailoverDriver2, config.FailoverBucketName2, config.ServiceAccountPath1, config.PublicBaseURL2),
+	})
 	if err != nil {
-		log.Fatalf("Failed to initialize GCS client: %v", err)
+		log.Fatalf("Failed to initialize storage backend: %v", err)
 	}
 	defer darlingimagesClientDev.Close()
 
-	// Configure CORS for the bucket
-	log.Printf("⚙️  Configuring CORS for bucket %s with origins: %v", config.BucketName2, config.AllowedOrigins)
-	if err := darlingimagesClientDev.ConfigureCORS(ctx, config.AllowedOrigins); err != nil {
-		log.Printf("⚠️  Warning: Failed to configure bucket CORS: %v", err)
-		log.Println("   Uploads from browser might fail if CORS is not already configured correctly.")
+	// Keep quarantined objects in a bucket of their own when one is configured
+	var quarantineStore Backend
+	if config.Quarantine.Bucket != "" {
+		quarantineStore, err = NewBackend(ctx, config, BucketConfig{
+			Name:            config.Quarantine.Bucket,
+			Driver:          config.Quarantine.Driver,
+			CredentialsPath: config.ServiceAccountPath1,
+		})
+		if err != nil {
+			log.Fatalf("Failed to initialize quarantine bucket: %v", err)
+		}
+		defer quarantineStore.Close()
+	}
+
+	// Fail fast on wrong credentials, projects or permissions, and warm up the OAuth tokens
+	if config.StartupCheck.Enabled {
+		if err := runStartupChecks(config.StartupCheck, config.ServiceAccountPath1, darlingimagesClientProd, darlingimagesClientDev, quarantineStore); err != nil {
+			log.Fatalf("Startup check failed (set STARTUP_CHECK=false to skip):\n%v", err)
+		}
+	}
+
+	// Apply the bucket CORS rules, lifecycle rules and labels, and keep fixing drift.
+	// The labels were validated with the config.
+	labels1, _ := parseBucketLabels(append(slices.Clone(config.BucketLabels), config.BucketLabels1...))
+	labels2, _ := parseBucketLabels(append(slices.Clone(config.BucketLabels), config.BucketLabels2...))
+	corsMetadata := corsMetadataKeys(config.UploadForm.MetadataFields)
+	reconciler := NewBucketReconciler([]Backend{darlingimagesClientProd, darlingimagesClientDev}, map[string]BucketSettings{
+		darlingimagesClientProd.Bucket(): bucketSettings.Settings(config.BucketName1, corsConfig.Rules(config.BucketName1, config.AllowedOrigins, corsMetadata), labels1),
+		darlingimagesClientDev.Bucket():  bucketSettings.Settings(config.BucketName2, corsConfig.Rules(config.BucketName2, config.AllowedOrigins, corsMetadata), labels2),
+	}, config.BucketReconcile)
+	if config.Serverless {
+		// Instances start on demand, often many at once: leave bucket changes to deployments
+		log.Println("☁️  Serverless mode: bucket settings are not reconciled")
 	} else {
-		log.Println("✅ Bucket CORS configured successfully")
+		reconciler.Start(ctx)
+		defer reconciler.Stop()
+	}
+
+	// Export asset events to BigQuery when a table is configured
+	if config.BigQuery.Enabled() {
+		sink, err := NewBigQuerySink(ctx, config.BigQuery, config.ServiceAccountPath1)
+		if err != nil {
+			log.Fatalf("Failed to initialize BigQuery export: %v", err)
+		}
+		assetEvents.AddSink(sink)
+	}
+
+	// Send operational notifications to Slack/Discord when a webhook is configured
+	if config.Notify.WebhookURL != "" {
+		notifier = NewNotifier(config.Notify)
+		assetEvents.AddSink(notifier)
+	}
+
+	// Run a local command for asset events when configured
+	if len(config.Hook.Command) > 0 {
+		hook, err := NewExecHook(config.Hook)
+		if err != nil {
+			log.Fatalf("Failed to initialize exec hook: %v", err)
+		}
+		assetEvents.AddSink(hook)
+	}
+
+	// Defer event processing to Cloud Tasks when a queue is configured
+	if config.CloudTasks.Queue != "" {
+		deferrer, err := NewCloudTasksDeferrer(ctx, config.CloudTasks, config.ServiceAccountPath1)
+		if err != nil {
+			log.Fatalf("Failed to initialize Cloud Tasks: %v", err)
+		}
+		assetEvents.SetDeferrer(deferrer)
+		log.Printf("⏳ Event processing deferred to Cloud Tasks queue %s", config.CloudTasks.Queue)
+	}
+	// The CPU is throttled between requests, so deliver events before responding
+	if config.Serverless {
+		assetEvents.SetInline(true)
+		log.Println("☁️  Serverless mode: events are delivered within the request")
+	}
+	defer assetEvents.Close()
+
+	// Open the asset catalog
+	metadataStore, err = OpenMetadataStore(config.MetadataPath)
+	if err != nil {
+		log.Fatalf("Failed to open metadata store: %v", err)
+	}
+	defer metadataStore.Close()
+
+	// Keep the history of asset operations for replays
+	if config.OperationLogPath != "" {
+		operationLog, err = OpenOperationLog(config.OperationLogPath, metadataStore)
+		if err != nil {
+			log.Fatalf("Failed to open operation log: %v", err)
+		}
+		defer operationLog.Close()
+	}
+
+	// Keep the audit trail of issued signed URLs
+	if config.SignedURLAuditPath != "" {
+		signedURLAudit, err = OpenSignedURLAudit(config.SignedURLAuditPath, config.SignedURLAuditMax)
+		if err != nil {
+			log.Fatalf("Failed to open signed URL audit: %v", err)
+		}
+		defer signedURLAudit.Close()
+	}
+
+	// Registered backends by bucket name, used by the admin endpoints
+	backends := map[string]Backend{
+		darlingimagesClientProd.Bucket(): darlingimagesClientProd,
+		darlingimagesClientDev.Bucket():  darlingimagesClientDev,
+	}
+
+	// Named folders with their own upload settings; prod and dev stand for the two buckets
+	collections, err := LoadCollections(config.CollectionsPath, backends, []Collection{
+		{Name: "prod", Bucket: darlingimagesClientProd.Bucket(), Visibility: VisibilityPublic},
+		{Name: "dev", Bucket: darlingimagesClientDev.Bucket(), Visibility: VisibilityPublic},
+	})
+	if err != nil {
+		log.Fatalf("Failed to load collections: %v", err)
+	}
+
+	// Move flagged content out of reach until an admin reviews it
+	quarantine = NewQuarantine(config.Quarantine.Prefix, quarantineStore, backends)
+
+	// Uploads are processed under the staging prefix and published when done
+	staging = NewStaging(config.Staging)
+	if config.Staging.Enabled {
+		log.Printf("🚧 Uploads are staged under %s (auto publish: %t)", config.Staging.Prefix, config.Staging.AutoPublish)
+	}
+
+	// Uploads of strict tenants are read back and compared after writing
+	uploadVerification = NewUploadVerification(config.Verify)
+	if config.Verify.All {
+		log.Println("🔍 Read-after-write verification enabled for all uploads")
+	} else if len(config.Verify.Tenants) > 0 {
+		log.Printf("🔍 Read-after-write verification enabled for %d tenants", len(config.Verify.Tenants))
+	}
+	if config.Quarantine.ScanURL != "" {
+		assetEvents.AddSink(NewScanSink(config.Quarantine, backends, quarantine))
+	}
+
+	// Keep events that can't be delivered before shutdown for the next start
+	if config.EventSpoolDir != "" {
+		replayed, err := assetEvents.EnableSpool(config.EventSpoolDir)
+		if err != nil {
+			log.Fatalf("Failed to open event spool: %v", err)
+		}
+		if replayed > 0 {
+			log.Printf("📣 Replayed %d spooled event(s)", replayed)
+		}
+	}
+
+	stats := newStatsCache(config.StatsCacheTTL)
+	signedURLs := newSignedURLCache(config.SignedURLCacheSize, config.SignedURLMinValid)
+
+	// Keep resumable (tus) uploads on disk until their last byte arrives
+	tusUploads, err := NewTusStore(config.Tus)
+	if err != nil {
+		log.Fatalf("Failed to initialize tus uploads: %v", err)
+	}
+
+	// Probe backends for readiness and alert operators on failures
+	healthMonitor = NewHealthMonitor(backends, config.HealthCheckInterval)
+	if config.SMTP.Enabled() {
+		log.Printf("📧 Email alerts enabled for: %v", config.SMTP.To)
+		healthMonitor.OnCheck(NewSMTPAlerter(config.SMTP).Evaluate)
+	}
+	if notifier.Enabled(NotifyOutage) {
+		healthMonitor.OnCheck(notifier.HealthChanged)
+	}
+	healthMonitor.Start()
+	defer healthMonitor.Stop()
+
+	// Compare bucket sizes with the quota periodically, not only when /stats is asked for
+	if notifier.Enabled(NotifyQuota) && (config.Notify.QuotaBytes > 0 || config.Notify.QuotaObjects > 0) && config.Notify.QuotaInterval > 0 {
+		stats.StartQuotaChecks(backends, config.Notify.QuotaInterval)
+		defer stats.Stop()
+	}
+
+	// Shed listings and searches while the instance is unhealthy, so uploads keep going
+	loadShedder, err := NewLoadShedder(config.LoadShed)
+	if err != nil {
+		log.Fatalf("Invalid load shedding routes: %v", err)
+	}
+	if loadShedder != nil {
+		loadShedder.Start()
+		defer loadShedder.Stop()
+		log.Printf("🚦 Load shedding enabled for %d low-priority route(s)", len(config.LoadShed.Routes))
 	}
 
+	// Report storage growth, top uploaders and failure rates to chat and/or the bucket
+	if config.Report.Interval > 0 && (notifier.Enabled(NotifyReport) || config.Report.Prefix != "") {
+		storageReporter = NewReporter(config.Report, backends, darlingimagesClientProd)
+		storageReporter.Start()
+		defer storageReporter.Stop()
+		log.Printf("📊 Storage reports every %s", config.Report.Interval)
+	}
+
+	// Compare the buckets with the metadata catalog; generated reports are never catalogued
+	inventoryConfig := config.Inventory
+	if config.Report.Prefix != "" {
+		inventoryConfig.IgnorePrefixes = append(inventoryConfig.IgnorePrefixes, config.Report.Prefix)
+	}
+	inventory := NewInventory(inventoryConfig, backends)
+	if inventoryConfig.Interval > 0 {
+		inventory.Start()
+		defer inventory.Stop()
+		log.Printf("🧾 Bucket inventory every %s (repair: %t)", inventoryConfig.Interval, inventoryConfig.Repair)
+	}
+
+	// Move objects away from the names of revoked signed URLs
+	signedURLEnforcer := NewSignedURLEnforcer(backends)
+	signedURLEnforcer.Start()
+	defer signedURLEnforcer.Stop()
+
+	// Regenerate derivatives of stored originals after the pipeline changed
+	reprocessor := NewReprocessor(config, config.ReprocessWorkers)
+	reprocessor.Start()
+	defer reprocessor.Stop()
+
+	// Ingest files partners deliver to the inbox directory (e.g. over SFTP)
+	if config.Inbox.Dir != "" {
+		inboxBackend := darlingimagesClientProd
+		if backend, ok := backends[config.Inbox.Bucket]; ok {
+			inboxBackend = backend
+		}
+		inbox, err := NewInbox(config.Inbox, inboxBackend, config)
+		if err != nil {
+			log.Fatalf("Failed to open inbox %s: %v", config.Inbox.Dir, err)
+		}
+		inbox.Start()
+		defer inbox.Stop()
+		log.Printf("📬 Watching inbox %s every %s for %s", config.Inbox.Dir, config.Inbox.Interval, inboxBackend.Bucket())
+	}
+
+	// Sign download proxy URLs when a key is configured
+	downloadSigner := NewDownloadSigner(config.DownloadSigning)
+	if downloadSigner != nil && config.DownloadSigning.Required {
+		log.Println("🔏 Download proxy requires signed URLs")
+	}
+
+	// Serve a placeholder to sites embedding downloads without permission
+	hotlinkGuard, err := NewHotlinkGuard(config.Hotlink)
+	if err != nil {
+		log.Fatalf("Failed to configure hotlink protection: %v", err)
+	}
+	if hotlinkGuard != nil {
+		log.Printf("🖼️  Hotlink protection enabled, %d allowed referrers", len(config.Hotlink.AllowedReferrers))
+	}
+
+	// Draw a placeholder instead of a broken image for missing objects
+	missingPlaceholder, err := NewMissingPlaceholder(config.MissingPlaceholder)
+	if err != nil {
+		log.Fatalf("Failed to configure the missing placeholder: %v", err)
+	}
+	if missingPlaceholder != nil {
+		log.Printf("🖼️  Missing objects are served as placeholder %s", config.MissingPlaceholder.Source)
+	}
+
+	// Sign upload receipts when a key is configured
+	receiptSigner = NewReceiptSigner(config.Receipts)
+	if receiptSigner != nil {
+		log.Println("🧾 Upload receipts enabled")
+	}
+
+	// Restrict what each browser origin may do, when configured
+	routePolicies, err := LoadRoutePolicies(config.RoutePolicyPath)
+	if err != nil {
+		log.Fatalf("Failed to load route policies: %v", err)
+	}
+	originPolicies, err := LoadOriginPolicies(config.OriginPolicyPath)
+	if err != nil {
+		log.Fatalf("Failed to load origin policies: %v", err)
+	}
+	if originPolicies != nil {
+		log.Printf("🔒 Origin policies enabled for %d origin(s)", len(originPolicies))
+	}
+
+	// Label upload metrics by origin, bounded to the configured origins and a few others
+	knownOrigins := append([]string{}, config.AllowedOrigins...)
+	for origin := range originPolicies {
+		knownOrigins = append(knownOrigins, origin)
+	}
+	usageOrigins = NewOriginLabels(knownOrigins, config.UsageMaxOrigins)
+
+	// Label business metrics by tenant; tenants that scrape their own series always get a label
+	tenantTokens, err := parseTenantTokens(config.TenantMetrics.Tokens)
+	if err != nil {
+		log.Fatalf("Invalid metrics tenant tokens: %v", err)
+	}
+	knownTenants := append([]string{}, config.TenantMetrics.Tenants...)
+	for tenant := range tenantTokens {
+		knownTenants = append(knownTenants, tenant)
+	}
+	metricTenants = NewOriginLabels(knownTenants, config.TenantMetrics.MaxTenants)
+
+	if !config.MetricsAuth.Enabled() {
+		log.Println("⚠️  /metrics is public; set METRICS_TOKEN, METRICS_PASSWORD or METRICS_ALLOWED_IPS to protect it")
+	}
+
+	// Push metrics for instances that may be gone before the next scrape
+	metricsPusher, err := NewMetricsPusher(config.MetricsPush)
+	if err != nil {
+		log.Fatalf("Invalid metrics push settings: %v", err)
+	}
+	if metricsPusher != nil {
+		metricsPusher.Start()
+	}
+
+	prodBucket, devBucket := darlingimagesClientProd.Bucket(), darlingimagesClientDev.Bucket()
+
 	// Apply authentication middleware (only to /upload endpoint)
 	authenticatedMux := http.NewServeMux()
 	authenticatedMux.HandleFunc("/health", HandleHealth)
-	authenticatedMux.Handle("/metrics", promhttp.Handler())
+	authenticatedMux.HandleFunc("/readyz", HandleReadyz(healthMonitor))
+	authenticatedMux.HandleFunc("/internal/tasks/events", HandleTaskEvent(assetEvents, config.CloudTasks.Token))
+	// OpenMetrics exposes the trace exemplars; request labels hold client IPs, so protect it when configured.
+	// Tenant tokens only see their own series.
+	authenticatedMux.Handle("/metrics", HandleMetrics(config.MetricsAuth, tenantTokens))
+	authenticatedMux.Handle("/images/", originPolicies.Require(prodBucket, OpDownload)(http.StripPrefix("/images/", HandleDownload(darlingimagesClientProd, fsDownloadSigner(downloadSigner, config.StorageDriver1), hotlinkGuard, missingPlaceholder))))
+	authenticatedMux.Handle("/images-dev/", originPolicies.Require(devBucket, OpDownload)(http.StripPrefix("/images-dev/", HandleDownload(darlingimagesClientDev, fsDownloadSigner(downloadSigner, config.StorageDriver2), hotlinkGuard, missingPlaceholder))))
+	// Email webhooks authenticate with their own token or signature
+	if config.EmailIn.Enabled() {
+		emailBackend := darlingimagesClientProd
+		if backend, ok := backends[config.EmailIn.Bucket]; ok {
+			emailBackend = backend
+		}
+		authenticatedMux.Handle("/inbound/email", HandleInboundEmail(emailBackend, config))
+		log.Printf("📧 Inbound email attachments go to %s", emailBackend.Bucket())
+	}
+
+	// Ban IPs that keep failing auth, uploading junk or probing honeypot paths
+	if config.Abuse.Threshold > 0 {
+		abuseGuard = NewAbuseGuard(config.Abuse, config.AllowedIPs)
+		for _, path := range config.Abuse.HoneypotPaths {
+			authenticatedMux.HandleFunc(path, HandleHoneypot(abuseGuard))
+		}
+		log.Printf("🍯 Abuse detection enabled: ban after %d strikes in %s", config.Abuse.Threshold, config.Abuse.Window)
+	}
 	
+	// perBucket serves routes with a {bucket} variable, which is the prod or dev bucket name
+	perBucket := func(op string, handler func(Backend) http.Handler) http.Handler {
+		return BucketRoutes(map[string]http.Handler{
+			prodBucket: originPolicies.Require(prodBucket, op)(handler(darlingimagesClientProd)),
+			devBucket:  originPolicies.Require(devBucket, op)(handler(darlingimagesClientDev)),
+		})
+	}
+
 	// Only apply auth middleware if API key is configured
 	if config.APIKey1 != "" {
 		log.Println("🔒 Authentication enabled")
 		if len(config.AllowedIPs) > 0 {
 			log.Printf("🔒 IP Whitelist enabled: %v", config.AllowedIPs)
 		}
-		authenticatedMux.Handle("/upload", AuthMiddleware(config.APIKey1, config.AllowedIPs)(http.HandlerFunc(HandleUpload(darlingimagesClientProd, config))))
-		authenticatedMux.Handle("/signedurl", AuthMiddleware(config.APIKey1, config.AllowedIPs)(http.HandlerFunc(HandleGenerateSignedUrl(darlingimagesClientProd))))
-		authenticatedMux.Handle("/upload-dev", AuthMiddleware(config.APIKey1, config.AllowedIPs)(http.HandlerFunc(HandleUpload(darlingimagesClientDev, config))))
-		authenticatedMux.Handle("/signedurl-dev", AuthMiddleware(config.APIKey1, config.AllowedIPs)(http.HandlerFunc(HandleGenerateSignedUrl(darlingimagesClientDev))))
+		// The read key only lists, searches and signs downloads; the write key does everything
+		writeAuth := AuthMiddleware([]string{config.APIKey1}, config.AllowedIPs)
+		readAuth := AuthMiddleware([]string{config.APIKey1, config.ReadAPIKey}, config.AllowedIPs)
+		if config.ReadAPIKey != "" {
+			log.Println("🔒 Read-only API key enabled")
+		}
+		authenticatedMux.Handle("/upload", writeAuth(originPolicies.Require(prodBucket, OpUpload)(http.HandlerFunc(HandleUpload(darlingimagesClientProd, config)))))
+		authenticatedMux.Handle("/signedurl", writeAuth(originPolicies.Require(prodBucket, OpSignedURL)(http.HandlerFunc(HandleGenerateSignedUrl(darlingimagesClientProd, config.MaxFileSize, config.SignedURLContentTypes)))))
+		authenticatedMux.Handle("/upload-dev", writeAuth(originPolicies.Require(devBucket, OpUpload)(http.HandlerFunc(HandleUpload(darlingimagesClientDev, config)))))
+		authenticatedMux.Handle("/upload/", writeAuth(originPolicies.Require(prodBucket, OpUpload)(http.StripPrefix("/upload/", HandleRawUpload(darlingimagesClientProd, config)))))
+		authenticatedMux.Handle("/upload-dev/", writeAuth(originPolicies.Require(devBucket, OpUpload)(http.StripPrefix("/upload-dev/", HandleRawUpload(darlingimagesClientDev, config)))))
+		authenticatedMux.Handle("/collections/{name}/upload", writeAuth(HandleCollectionUpload(collections, config, originPolicies)))
+		authenticatedMux.Handle("/upload/validate", writeAuth(originPolicies.Require(prodBucket, OpUpload)(HandleUploadValidate(darlingimagesClientProd, config))))
+		authenticatedMux.Handle("/upload-dev/validate", writeAuth(originPolicies.Require(devBucket, OpUpload)(HandleUploadValidate(darlingimagesClientDev, config))))
+		authenticatedMux.Handle("/upload/batch", writeAuth(originPolicies.Require(prodBucket, OpUpload)(HandleBatchUpload(darlingimagesClientProd, config))))
+		authenticatedMux.Handle("/upload-dev/batch", writeAuth(originPolicies.Require(devBucket, OpUpload)(HandleBatchUpload(darlingimagesClientDev, config))))
+		authenticatedMux.Handle("/upload/tus/", writeAuth(originPolicies.Require(prodBucket, OpUpload)(HandleTus(darlingimagesClientProd, config, tusUploads, "/upload/tus/"))))
+		authenticatedMux.Handle("/upload-dev/tus/", writeAuth(originPolicies.Require(devBucket, OpUpload)(HandleTus(darlingimagesClientDev, config, tusUploads, "/upload-dev/tus/"))))
+		authenticatedMux.Handle("/signedurl-dev", writeAuth(originPolicies.Require(devBucket, OpSignedURL)(http.HandlerFunc(HandleGenerateSignedUrl(darlingimagesClientDev, config.MaxFileSize, config.SignedURLContentTypes)))))
+		authenticatedMux.Handle("/signedurls/batch", writeAuth(originPolicies.Require(prodBucket, OpSignedURL)(HandleBatchSignedUrls(darlingimagesClientProd, config.SignedURLBatchMax, config.MaxFileSize, config.SignedURLContentTypes))))
+		authenticatedMux.Handle("/signedurls/batch-dev", writeAuth(originPolicies.Require(devBucket, OpSignedURL)(HandleBatchSignedUrls(darlingimagesClientDev, config.SignedURLBatchMax, config.MaxFileSize, config.SignedURLContentTypes))))
+		authenticatedMux.Handle("/stats", readAuth(originPolicies.Require("", OpStats)(HandleStats(backends, stats))))
+		if downloadSigner != nil {
+			authenticatedMux.Handle("/downloadurl", readAuth(originPolicies.Require(prodBucket, OpDownload)(HandleGenerateDownloadUrl(darlingimagesClientProd, downloadSigner, signedURLs, "/images/"))))
+			authenticatedMux.Handle("/downloadurl-dev", readAuth(originPolicies.Require(devBucket, OpDownload)(HandleGenerateDownloadUrl(darlingimagesClientDev, downloadSigner, signedURLs, "/images-dev/"))))
+		}
+		if receiptSigner != nil {
+			authenticatedMux.Handle("/receipts/verify", readAuth(HandleVerifyReceipt(receiptSigner)))
+		}
+		authenticatedMux.Handle("/objects/", readAuth(HandleObjectRoutes(map[string]http.Handler{
+			"similar":   originPolicies.Require(prodBucket, OpSimilar)(HandleSimilar(darlingimagesClientProd, "/objects/")),
+			"metadata":  originPolicies.Require(prodBucket, OpMetadata)(HandleAssetMetadata(darlingimagesClientProd, "/objects/")),
+			"exif":      originPolicies.Require(prodBucket, OpMetadata)(HandleExif(darlingimagesClientProd, "/objects/")),
+			"tags":      writeAuth(originPolicies.Require(prodBucket, OpTags)(HandleObjectTags(darlingimagesClientProd, "/objects/"))),
+			"publish":   writeAuth(originPolicies.Require(prodBucket, OpUpload)(HandlePublish(darlingimagesClientProd, config, "/objects/"))),
+			"reprocess": writeAuth(originPolicies.Require(prodBucket, OpUpload)(HandleReprocessObject(darlingimagesClientProd, reprocessor, "/objects/", "/objects/reprocess"))),
+		})))
+		authenticatedMux.Handle("/objects", readAuth(originPolicies.Require(prodBucket, OpList)(HandleListObjects(darlingimagesClientProd))))
+		authenticatedMux.Handle("/objects-dev/", readAuth(HandleObjectRoutes(map[string]http.Handler{
+			"similar":   originPolicies.Require(devBucket, OpSimilar)(HandleSimilar(darlingimagesClientDev, "/objects-dev/")),
+			"metadata":  originPolicies.Require(devBucket, OpMetadata)(HandleAssetMetadata(darlingimagesClientDev, "/objects-dev/")),
+			"exif":      originPolicies.Require(devBucket, OpMetadata)(HandleExif(darlingimagesClientDev, "/objects-dev/")),
+			"tags":      writeAuth(originPolicies.Require(devBucket, OpTags)(HandleObjectTags(darlingimagesClientDev, "/objects-dev/"))),
+			"publish":   writeAuth(originPolicies.Require(devBucket, OpUpload)(HandlePublish(darlingimagesClientDev, config, "/objects-dev/"))),
+			"reprocess": writeAuth(originPolicies.Require(devBucket, OpUpload)(HandleReprocessObject(darlingimagesClientDev, reprocessor, "/objects-dev/", "/objects/reprocess-dev"))),
+		})))
+		authenticatedMux.Handle("/objects-dev", readAuth(originPolicies.Require(devBucket, OpList)(HandleListObjects(darlingimagesClientDev))))
+		objectURLs := NewObjectURLResolver(map[string][]string{
+			prodBucket: append([]string{darlingimagesClientProd.PublicURL(""), config.PublicBaseURL1, "/images"}, config.CDNBaseURLs1...),
+			devBucket:  append([]string{darlingimagesClientDev.PublicURL(""), config.PublicBaseURL2, "/images-dev"}, config.CDNBaseURLs2...),
+		})
+		authenticatedMux.Handle("DELETE /objects", writeAuth(HandleDeleteByURL(objectURLs, map[string]http.Handler{
+			prodBucket: originPolicies.Require(prodBucket, OpDelete)(HandleDeleteObject(darlingimagesClientProd)),
+			devBucket:  originPolicies.Require(devBucket, OpDelete)(HandleDeleteObject(darlingimagesClientDev)),
+		})))
+		authenticatedMux.Handle("/users/{id}/uploads", readAuth(originPolicies.Require("", OpUploads)(http.HandlerFunc(HandleUserUploads))))
+		authenticatedMux.Handle("/objects/archive", readAuth(originPolicies.Require(prodBucket, OpArchive)(HandleArchive(darlingimagesClientProd, config.ArchiveMaxSize, config.ArchiveMaxObjects))))
+		authenticatedMux.Handle("/objects/archive-dev", readAuth(originPolicies.Require(devBucket, OpArchive)(HandleArchive(darlingimagesClientDev, config.ArchiveMaxSize, config.ArchiveMaxObjects))))
+		authenticatedMux.Handle("/objects/stat", readAuth(originPolicies.Require(prodBucket, OpList)(HandleStatObjects(darlingimagesClientProd))))
+		authenticatedMux.Handle("/objects/stat-dev", readAuth(originPolicies.Require(devBucket, OpList)(HandleStatObjects(darlingimagesClientDev))))
+		authenticatedMux.Handle("/objects/reprocess", writeAuth(originPolicies.Require(prodBucket, OpUpload)(HandleReprocess(darlingimagesClientProd, reprocessor, "/objects/reprocess"))))
+		authenticatedMux.Handle("/objects/reprocess-dev", writeAuth(originPolicies.Require(devBucket, OpUpload)(HandleReprocess(darlingimagesClientDev, reprocessor, "/objects/reprocess-dev"))))
+
+		// Versioned API: every response uses the {data, error, meta} envelope
+		authenticatedMux.Handle("/v1/upload", writeAuth(V1Envelope(originPolicies.Require(prodBucket, OpUpload)(HandleUpload(darlingimagesClientProd, config)))))
+		authenticatedMux.Handle("/v1/upload/", writeAuth(V1Envelope(originPolicies.Require(prodBucket, OpUpload)(http.StripPrefix("/v1/upload/", HandleRawUpload(darlingimagesClientProd, config))))))
+		authenticatedMux.Handle("/v1/upload/validate", writeAuth(V1Envelope(originPolicies.Require(prodBucket, OpUpload)(HandleUploadValidate(darlingimagesClientProd, config)))))
+		authenticatedMux.Handle("/v1/upload/batch", writeAuth(V1Envelope(originPolicies.Require(prodBucket, OpUpload)(HandleBatchUpload(darlingimagesClientProd, config)))))
+		authenticatedMux.Handle("/v1/signedurl", writeAuth(V1Envelope(originPolicies.Require(prodBucket, OpSignedURL)(HandleGenerateSignedUrl(darlingimagesClientProd, config.MaxFileSize, config.SignedURLContentTypes)))))
+		authenticatedMux.Handle("/v1/objects", readAuth(V1Envelope(originPolicies.Require(prodBucket, OpList)(HandleListObjects(darlingimagesClientProd)))))
+		authenticatedMux.Handle("/v1/objects/", writeAuth(V1Envelope(originPolicies.Require(prodBucket, OpDelete)(http.StripPrefix("/v1/objects/", HandleDeleteObject(darlingimagesClientProd))))))
+		authenticatedMux.Handle("/v1/upload-dev", writeAuth(V1Envelope(originPolicies.Require(devBucket, OpUpload)(HandleUpload(darlingimagesClientDev, config)))))
+		authenticatedMux.Handle("/v1/upload-dev/", writeAuth(V1Envelope(originPolicies.Require(devBucket, OpUpload)(http.StripPrefix("/v1/upload-dev/", HandleRawUpload(darlingimagesClientDev, config))))))
+		authenticatedMux.Handle("/v1/upload-dev/validate", writeAuth(V1Envelope(originPolicies.Require(devBucket, OpUpload)(HandleUploadValidate(darlingimagesClientDev, config)))))
+		authenticatedMux.Handle("/v1/upload-dev/batch", writeAuth(V1Envelope(originPolicies.Require(devBucket, OpUpload)(HandleBatchUpload(darlingimagesClientDev, config)))))
+		authenticatedMux.Handle("/v1/signedurl-dev", writeAuth(V1Envelope(originPolicies.Require(devBucket, OpSignedURL)(HandleGenerateSignedUrl(darlingimagesClientDev, config.MaxFileSize, config.SignedURLContentTypes)))))
+		authenticatedMux.Handle("/v1/objects-dev", readAuth(V1Envelope(originPolicies.Require(devBucket, OpList)(HandleListObjects(darlingimagesClientDev)))))
+		authenticatedMux.Handle("/v1/objects-dev/", writeAuth(V1Envelope(originPolicies.Require(devBucket, OpDelete)(http.StripPrefix("/v1/objects-dev/", HandleDeleteObject(darlingimagesClientDev))))))
+
+		// REST-style routes with Go 1.22 patterns
+		authenticatedMux.Handle("GET /v1/buckets/{bucket}/objects", readAuth(V1Envelope(perBucket(OpList, func(b Backend) http.Handler { return HandleListObjects(b) }))))
+		authenticatedMux.Handle("POST /v1/buckets/{bucket}/objects", writeAuth(V1Envelope(perBucket(OpUpload, func(b Backend) http.Handler { return HandleUpload(b, config) }))))
+		authenticatedMux.Handle("/v1/buckets/{bucket}/objects", V1Envelope(MethodNotAllowed(http.MethodGet, http.MethodPost)))
+		authenticatedMux.Handle("GET /v1/buckets/{bucket}/objects/{name...}", readAuth(V1Envelope(perBucket(OpMetadata, func(b Backend) http.Handler { return HandleAssetMetadata(b, "") }))))
+		authenticatedMux.Handle("DELETE /v1/buckets/{bucket}/objects/{name...}", writeAuth(V1Envelope(perBucket(OpDelete, func(b Backend) http.Handler { return HandleDeleteObject(b) }))))
+		authenticatedMux.Handle("/v1/buckets/{bucket}/objects/{name...}", V1Envelope(MethodNotAllowed(http.MethodGet, http.MethodDelete)))
 	} else {
 		log.Println("⚠️  WARNING: No API key configured - authentication disabled!")
-		authenticatedMux.HandleFunc("/upload", HandleUpload(darlingimagesClientProd, config))
+		authenticatedMux.Handle("/upload", originPolicies.Require(prodBucket, OpUpload)(HandleUpload(darlingimagesClientProd, config)))
+		authenticatedMux.Handle("/upload/", originPolicies.Require(prodBucket, OpUpload)(http.StripPrefix("/upload/", HandleRawUpload(darlingimagesClientProd, config))))
+		authenticatedMux.Handle("/collections/{name}/upload", HandleCollectionUpload(collections, config, originPolicies))
+		authenticatedMux.Handle("/upload/validate", originPolicies.Require(prodBucket, OpUpload)(HandleUploadValidate(darlingimagesClientProd, config)))
+		authenticatedMux.Handle("/upload/batch", originPolicies.Require(prodBucket, OpUpload)(HandleBatchUpload(darlingimagesClientProd, config)))
+		authenticatedMux.Handle("/upload/tus/", originPolicies.Require(prodBucket, OpUpload)(HandleTus(darlingimagesClientProd, config, tusUploads, "/upload/tus/")))
+		authenticatedMux.Handle("/stats", originPolicies.Require("", OpStats)(HandleStats(backends, stats)))
+		authenticatedMux.Handle("/objects/archive", originPolicies.Require(prodBucket, OpArchive)(HandleArchive(darlingimagesClientProd, config.ArchiveMaxSize, config.ArchiveMaxObjects)))
+		authenticatedMux.Handle("/objects/stat", originPolicies.Require(prodBucket, OpList)(HandleStatObjects(darlingimagesClientProd)))
+		authenticatedMux.Handle("/v1/upload", V1Envelope(originPolicies.Require(prodBucket, OpUpload)(HandleUpload(darlingimagesClientProd, config))))
+		authenticatedMux.Handle("/v1/upload/", V1Envelope(originPolicies.Require(prodBucket, OpUpload)(http.StripPrefix("/v1/upload/", HandleRawUpload(darlingimagesClientProd, config)))))
+		authenticatedMux.Handle("/v1/upload/validate", V1Envelope(originPolicies.Require(prodBucket, OpUpload)(HandleUploadValidate(darlingimagesClientProd, config))))
+		authenticatedMux.Handle("/v1/upload/batch", V1Envelope(originPolicies.Require(prodBucket, OpUpload)(HandleBatchUpload(darlingimagesClientProd, config))))
+		authenticatedMux.Handle("POST /v1/buckets/{bucket}/objects", V1Envelope(perBucket(OpUpload, func(b Backend) http.Handler { return HandleUpload(b, config) })))
+		authenticatedMux.Handle("/v1/buckets/{bucket}/objects", V1Envelope(MethodNotAllowed(http.MethodPost)))
 	}
 	
-	// Apply CORS and Metrics middleware
-	var handler http.Handler = MetricsMiddleware(CORSMiddleware(config.AllowedOrigins)(authenticatedMux))
+	// Humans log in to the admin endpoints with OIDC
+	var oidcAuth *OIDCAuth
+	if config.OIDC.Enabled() {
+		oidcAuth, err = NewOIDCAuth(ctx, config.OIDC)
+		if err != nil {
+			log.Fatalf("Failed to initialize OIDC: %v", err)
+		}
+		authenticatedMux.HandleFunc("/auth/login", oidcAuth.HandleLogin)
+		authenticatedMux.HandleFunc("/auth/callback", oidcAuth.HandleCallback)
+		authenticatedMux.HandleFunc("/auth/logout", oidcAuth.HandleLogout)
+		authenticatedMux.HandleFunc("/auth/me", oidcAuth.HandleMe)
+		log.Printf("🔑 OIDC admin login enabled with issuer %s", config.OIDC.Issuer)
+	}
+
+	// Admin endpoints require an OIDC session or their own key
+	if config.AdminAPIKey != "" || oidcAuth != nil {
+		adminAuth := AdminMiddleware(config.AdminAPIKey, config.AllowedIPs, oidcAuth)
+		authenticatedMux.Handle("/admin/migrate", adminAuth(HandleMigrate(backends, config.CheckpointDir)))
+		authenticatedMux.Handle("/admin/import", adminAuth(HandleImport(backends, config)))
+		authenticatedMux.Handle("/admin/export", adminAuth(HandleExport()))
+		authenticatedMux.Handle("/admin/inventory", adminAuth(HandleInventory(inventory)))
+		authenticatedMux.Handle("/admin/config", adminAuth(HandleAdminConfig(config, backends)))
+		authenticatedMux.Handle("/admin/flags", adminAuth(HandleFlags(featureFlags)))
+		authenticatedMux.Handle("/admin/collections", adminAuth(HandleCollections(collections)))
+		authenticatedMux.Handle("/admin/collections/", adminAuth(HandleCollections(collections)))
+		authenticatedMux.Handle("/admin/quarantine", adminAuth(HandleQuarantine(quarantine)))
+		authenticatedMux.Handle("/admin/quarantine/", adminAuth(HandleQuarantine(quarantine)))
+		authenticatedMux.Handle("/admin/retention", adminAuth(HandleRetention(backends)))
+		authenticatedMux.Handle("/admin/retention/lock", adminAuth(HandleRetention(backends)))
+		authenticatedMux.Handle("/admin/holds", adminAuth(HandleHolds(backends)))
+		authenticatedMux.Handle("/admin/usage", adminAuth(HandleUsage(backends)))
+		authenticatedMux.Handle("/admin/buckets/labels", adminAuth(HandleBucketLabels(reconciler)))
+		authenticatedMux.Handle("/admin/signedurls", adminAuth(HandleSignedURLAudit(signedURLEnforcer, oidcAuth)))
+		authenticatedMux.Handle("/admin/signedurls/", adminAuth(HandleSignedURLAudit(signedURLEnforcer, oidcAuth)))
+		if storageReporter != nil {
+			authenticatedMux.Handle("/admin/report", adminAuth(HandleReport(storageReporter)))
+		}
+		authenticatedMux.Handle("/admin/drain", adminAuth(HandleDrain(assetEvents, config.EventDrainTimeout)))
+		if operationLog != nil {
+			authenticatedMux.Handle("/admin/replay", adminAuth(HandleReplay(operationLog, assetEvents)))
+		}
+	}
+
+	// Cap the transfer rate of each API key
+	bandwidthLimiter, err := NewBandwidthLimiter(config.Bandwidth, map[string]string{
+		"api1":  config.APIKey1,
+		"api2":  config.APIKey2,
+		"read":  config.ReadAPIKey,
+		"admin": config.AdminAPIKey,
+	})
+	if err != nil {
+		log.Fatalf("Invalid bandwidth caps: %v", err)
+	}
+
+	// Route policies can require these on top of each route's own auth
+	policyAuth := map[string]func(http.Handler) http.Handler{}
+	if config.APIKey1 != "" {
+		policyAuth[RouteAuthWrite] = AuthMiddleware([]string{config.APIKey1}, config.AllowedIPs)
+		policyAuth[RouteAuthRead] = AuthMiddleware([]string{config.APIKey1, config.ReadAPIKey}, config.AllowedIPs)
+	}
+	if config.AdminAPIKey != "" || oidcAuth != nil {
+		policyAuth[RouteAuthAdmin] = AdminMiddleware(config.AdminAPIKey, config.AllowedIPs, oidcAuth)
+	}
+
+	// Apply CORS, abuse detection, bandwidth caps, load shedding, route policies and Metrics middleware
+	var handler http.Handler = TraceMiddleware(CustomerKeyMiddleware(config.CustomerKey)(MetricsMiddleware(AbuseMiddleware(abuseGuard)(BandwidthMiddleware(bandwidthLimiter)(CompressionMiddleware(config.Compression)(CORSMiddleware(config.AllowedOrigins)(LoadShedMiddleware(loadShedder)(routePolicies.Middleware(policyAuth)(authenticatedMux)))))))))
+	// Abort stalled uploads; outermost, as it needs the connection's ResponseWriter
+	handler = MinUploadRateMiddleware(config.Server)(handler)
+	// Queue uploads over the memory budget before their body is read
+	uploadMemory := NewUploadMemoryBudget(config.UploadMemory)
+	if uploadMemory != nil {
+		log.Printf("🧠 Upload memory budget: %d MB", config.UploadMemory.Budget/1024/1024)
+	}
+	handler = UploadMemoryMiddleware(uploadMemory, config.MaxFileSize)(handler)
+	// Route //upload and /upload/ to /upload before anything looks at the path
+	handler = CanonicalPathMiddleware(config.CanonicalPaths, authenticatedMux)(handler)
 
 	// Create HTTP server
 	server := &http.Server{
-		Addr:         fmt.Sprintf("0.0.0.0:%s", config.Port),
-		Handler:      handler,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Addr:              fmt.Sprintf("0.0.0.0:%s", config.Port),
+		Handler:           handler,
+		ReadHeaderTimeout: config.Server.ReadHeaderTimeout,
+		ReadTimeout:       config.Server.ReadTimeout,
+		WriteTimeout:      serverWriteTimeout,
+		IdleTimeout:       config.Server.IdleTimeout,
+		MaxHeaderBytes:    config.Server.MaxHeaderBytes,
 	}
 
+	// Cap the open connections, so slow clients can't take all of them
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on port %s: %v", config.Port, err)
+	}
+	listener = NewLimitListener(listener, config.Server)
+
 	// Start server in a goroutine
 	go func() {
 		log.Printf("🚀 Server starting on port %s", config.Port)
@@ -106,10 +678,17 @@ func main() {
 		}())
 		log.Printf("📝 Endpoints:")
 		log.Printf("   - GET  http://localhost:%s/health", config.Port)
+		log.Printf("   - GET  http://localhost:%s/readyz", config.Port)
 		log.Printf("   - POST http://localhost:%s/upload", config.Port)
+		log.Printf("   - PUT  http://localhost:%s/upload/{filename}", config.Port)
 		log.Printf("   - GET  http://localhost:%s/metrics", config.Port)
+		log.Printf("   - GET  http://localhost:%s/stats", config.Port)
+		log.Printf("   - POST http://localhost:%s/objects/archive", config.Port)
+		log.Printf("   - GET  http://localhost:%s/users/{id}/uploads", config.Port)
+		log.Printf("   - GET  http://localhost:%s/objects/{name}/similar", config.Port)
+		log.Printf("   - GET  http://localhost:%s/images/{object}", config.Port)
 		
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Failed to start server: %v", err)
 		}
 	}()
@@ -126,8 +705,22 @@ func main() {
 	defer cancel()
 
 	if err := server.Shutdown(shutdownCtx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+		log.Printf("Server forced to shutdown: %v", err)
+	}
+
+	// Deliver or persist the events of the last requests before exiting
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), config.EventDrainTimeout)
+	defer cancelDrain()
+	assetEvents.Drain(drainCtx)
+
+	if metricsPusher != nil {
+		metricsPusher.Stop()
 	}
 
 	log.Println("✅ Server stopped gracefully")
 }
+
+// usesDriver reports whether any configured bucket uses the given storage driver
+func usesDriver(config *Config, driver string) bool {
+	return config.StorageDriver1 == driver || config.StorageDriver2 == driver
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AssetRecord is the catalog entry of one stored object
+type AssetRecord struct {
+	Bucket      string            `json:"bucket"`
+	Name        string            `json:"name"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"contentType,omitempty"`
+	SHA256      string            `json:"sha256,omitempty"`
+	PHash       string            `json:"phash,omitempty"` // perceptual hash, see phash.go
+	Tenant      string            `json:"tenant,omitempty"`
+	Source      string            `json:"source,omitempty"` // upload, import, ...
+	Uploader    string            `json:"uploader,omitempty"`
+	Origin      string            `json:"origin,omitempty"` // Origin header or hostname of the upload request
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`      // sorted, see tags.go
+	Encrypted   bool              `json:"encrypted,omitempty"` // with a customer-supplied key, see csek.go
+	CreatedAt   time.Time         `json:"createdAt"`
+}
+
+// Record sources
+const (
+	SourceUpload = "upload"
+	SourceImport = "import"
+	SourceInbox  = "inbox"
+	SourceEmail  = "email"
+	// Registered by the inventory, found in the bucket without a record
+	SourceInventory = "inventory"
+)
+
+// metadataOp is one line of the journal
+type metadataOp struct {
+	Op     string      `json:"op"` // put or delete
+	Record AssetRecord `json:"record"`
+}
+
+// MetadataStore is the asset catalog. Records are kept in memory and every
+// change is appended to a JSONL journal, which is replayed and compacted when
+// the store is opened. All methods are safe on a nil store.
+type MetadataStore struct {
+	path string
+
+	mu      sync.RWMutex
+	records map[string]AssetRecord // bucket/name -> record
+	journal *os.File
+}
+
+// metadataStore is the process-wide catalog; nil until opened in main
+var metadataStore *MetadataStore
+
+// OpenMetadataStore loads the journal at path, compacts it and opens it for appending
+func OpenMetadataStore(path string) (*MetadataStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create metadata directory: %w", err)
+	}
+
+	s := &MetadataStore{path: path, records: map[string]AssetRecord{}}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+
+	journal, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open metadata journal: %w", err)
+	}
+	s.journal = journal
+	log.Printf("🗂️  Metadata store loaded: %d assets", len(s.records))
+	return s, nil
+}
+
+func metadataKey(bucket, name string) string {
+	return bucket + "/" + name
+}
+
+// load replays the journal into memory
+func (s *MetadataStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open metadata journal: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var op metadataOp
+		if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+			// A torn final write after a crash only loses that one change
+			log.Printf("⚠️  Skipping corrupt metadata journal line %d: %v", line, err)
+			continue
+		}
+		if op.Op == "grant" {
+			// Signed URL audit entries of earlier versions; see signedurlaudit.go
+			continue
+		}
+		key := metadataKey(op.Record.Bucket, op.Record.Name)
+		if op.Op == "delete" {
+			delete(s.records, key)
+		} else {
+			s.records[key] = op.Record
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the journal with one put per live record
+func (s *MetadataStore) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".metadata-*")
+	if err != nil {
+		return fmt.Errorf("failed to compact metadata journal: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, record := range s.records {
+		if err := enc.Encode(metadataOp{Op: "put", Record: record}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// append writes one operation to the journal; callers hold s.mu
+func (s *MetadataStore) append(op metadataOp) error {
+	line, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	if _, err := s.journal.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write metadata journal: %w", err)
+	}
+	// The journal is compacted, the operation log keeps the history
+	record := op.Record
+	if err := operationLog.Append(OperationEntry{Op: op.Op, Record: &record}); err != nil {
+		log.Printf("⚠️  Failed to log %s of %s/%s: %v", op.Op, record.Bucket, record.Name, err)
+	}
+	return nil
+}
+
+// Replace swaps the whole catalog for records, e.g. rebuilt from the
+// operation log, and rewrites the journal to match
+func (s *MetadataStore) Replace(records map[string]AssetRecord) error {
+	if s == nil {
+		return errors.New("metadata store is not open")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous := s.records
+	s.records = records
+	if err := s.compact(); err != nil {
+		s.records = previous
+		return err
+	}
+	// compact renamed a new file over the journal, so reopen it
+	journal, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open metadata journal: %w", err)
+	}
+	s.journal.Close()
+	s.journal = journal
+	log.Printf("🗂️  Metadata store replaced: %d assets", len(records))
+	return nil
+}
+
+// Put adds or replaces the record of an object
+func (s *MetadataStore) Put(record AssetRecord) error {
+	if s == nil {
+		return nil
+	}
+	if record.CreatedAt.IsZero() {
+		record.CreatedAt = time.Now().UTC()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.append(metadataOp{Op: "put", Record: record}); err != nil {
+		return err
+	}
+	s.records[metadataKey(record.Bucket, record.Name)] = record
+	return nil
+}
+
+// Update applies fn to the record of an object and stores the result, unless
+// fn fails. It returns false when the object has no record.
+func (s *MetadataStore) Update(bucket, name string, fn func(*AssetRecord) error) (AssetRecord, bool, error) {
+	if s == nil {
+		return AssetRecord{}, false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := metadataKey(bucket, name)
+	record, ok := s.records[key]
+	if !ok {
+		return AssetRecord{}, false, nil
+	}
+	if err := fn(&record); err != nil {
+		return AssetRecord{}, true, err
+	}
+	if err := s.append(metadataOp{Op: "put", Record: record}); err != nil {
+		return AssetRecord{}, true, err
+	}
+	s.records[key] = record
+	return record, true, nil
+}
+
+// Get returns the record of an object
+func (s *MetadataStore) Get(bucket, name string) (AssetRecord, bool) {
+	if s == nil {
+		return AssetRecord{}, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, ok := s.records[metadataKey(bucket, name)]
+	return record, ok
+}
+
+// Delete removes the record of an object
+func (s *MetadataStore) Delete(bucket, name string) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := metadataKey(bucket, name)
+	if _, ok := s.records[key]; !ok {
+		return nil
+	}
+	if err := s.append(metadataOp{Op: "delete", Record: AssetRecord{Bucket: bucket, Name: name}}); err != nil {
+		return err
+	}
+	delete(s.records, key)
+	return nil
+}
+
+// FindByContent returns the oldest record of a tenant in the bucket with the
+// given SHA-256, leaving out quarantined objects
+func (s *MetadataStore) FindByContent(bucket, tenant, sha256 string) (AssetRecord, bool) {
+	if s == nil || sha256 == "" {
+		return AssetRecord{}, false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var found AssetRecord
+	ok := false
+	for _, record := range s.records {
+		if record.Bucket != bucket || record.Tenant != tenant || record.SHA256 != sha256 || isQuarantineRecord(record) {
+			continue
+		}
+		if !ok || record.CreatedAt.Before(found.CreatedAt) {
+			found, ok = record, true
+		}
+	}
+	return found, ok
+}
+
+// List calls fn for every record of the bucket under prefix, in name order
+func (s *MetadataStore) List(bucket, prefix string, fn func(AssetRecord) error) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.RLock()
+	var records []AssetRecord
+	for _, record := range s.records {
+		if record.Bucket == bucket && strings.HasPrefix(record.Name, prefix) {
+			records = append(records, record)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	for _, record := range records {
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Records returns every record of a bucket ("" for every bucket), sorted
+// by bucket and name. Quarantined objects are included.
+func (s *MetadataStore) Records(bucket string) []AssetRecord {
+	records := []AssetRecord{}
+	if s == nil {
+		return records
+	}
+
+	s.mu.RLock()
+	for _, record := range s.records {
+		if bucket == "" || record.Bucket == bucket {
+			records = append(records, record)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Bucket != records[j].Bucket {
+			return records[i].Bucket < records[j].Bucket
+		}
+		return records[i].Name < records[j].Name
+	})
+	return records
+}
+
+// ListByUploader returns up to limit records of an uploader, newest first,
+// leaving out quarantined objects. An empty bucket matches every bucket.
+func (s *MetadataStore) ListByUploader(uploader, bucket string, limit int) []AssetRecord {
+	records := []AssetRecord{}
+	if s == nil {
+		return records
+	}
+
+	s.mu.RLock()
+	for _, record := range s.records {
+		if record.Uploader == uploader && (bucket == "" || record.Bucket == bucket) && !isQuarantineRecord(record) {
+			records = append(records, record)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(records, func(i, j int) bool { return records[i].CreatedAt.After(records[j].CreatedAt) })
+	if len(records) > limit {
+		records = records[:limit]
+	}
+	return records
+}
+
+// ListSince returns the records created at or after since, leaving out
+// quarantined objects. An empty bucket matches every bucket.
+func (s *MetadataStore) ListSince(since time.Time, bucket string) []AssetRecord {
+	records := []AssetRecord{}
+	if s == nil {
+		return records
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, record := range s.records {
+		if !record.CreatedAt.Before(since) && (bucket == "" || record.Bucket == bucket) && !isQuarantineRecord(record) {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// Close flushes and closes the journal
+func (s *MetadataStore) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.journal.Sync(); err != nil {
+		s.journal.Close()
+		return err
+	}
+	return s.journal.Close()
+}
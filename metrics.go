@@ -1,8 +1,11 @@
 package main
 
 import (
+	"crypto/subtle"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -15,7 +18,7 @@ var (
 			Name: "http_requests_total",
 			Help: "Total number of HTTP requests",
 		},
-		[]string{"method", "endpoint", "status_code", "hostname", "client_ip"},
+		[]string{"method", "endpoint", "status_code", "hostname", tenantMetricLabel},
 	)
 
 	// httpRequestDuration measures request latency
@@ -34,7 +37,534 @@ var (
 			Name: "signedurl_created_total",
 			Help: "Total number of signed URLs created",
 		},
-		[]string{"hostname", "client_ip"},
+		[]string{"hostname", tenantMetricLabel},
+	)
+
+	// signedURLRevokedTotal counts signed upload URLs revoked by an admin
+	signedURLRevokedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "signedurl_revoked_total",
+			Help: "Total number of signed upload URLs revoked",
+		},
+		[]string{"bucket"},
+	)
+
+	// signedURLRevokedUploadsTotal counts objects uploaded through revoked URLs and quarantined
+	signedURLRevokedUploadsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "signedurl_revoked_uploads_total",
+			Help: "Total number of objects uploaded through revoked signed URLs and moved to quarantine",
+		},
+		[]string{"bucket"},
+	)
+
+	// signedURLRotatedTotal counts objects renamed away from the name of a revoked signed URL
+	signedURLRotatedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "signedurl_rotated_objects_total",
+			Help: "Total number of objects uploaded before their signed URL was revoked and renamed",
+		},
+		[]string{"bucket"},
+	)
+
+	// signedURLAuditEvictedTotal counts audit entries dropped before they expired to stay within the cap
+	signedURLAuditEvictedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "signedurl_audit_evicted_total",
+			Help: "Total number of signed URL audit entries dropped before expiry because the audit trail was full",
+		},
+	)
+
+	// signedURLCacheTotal counts signed URL cache lookups by result (hit or miss)
+	signedURLCacheTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "signedurl_cache_requests_total",
+			Help: "Total number of signed URL cache lookups",
+		},
+		[]string{"result"},
+	)
+
+	// mirrorQueueDepth tracks pending mirror operations per secondary bucket
+	mirrorQueueDepth = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mirror_queue_depth",
+			Help: "Number of pending operations in the mirror queue",
+		},
+		[]string{"bucket"},
+	)
+
+	// mirroredObjectsTotal counts operations successfully applied to the mirror
+	mirroredObjectsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mirror_operations_total",
+			Help: "Total number of operations mirrored to the secondary backend",
+		},
+		[]string{"bucket", "op"},
+	)
+
+	// mirrorErrorsTotal counts failed mirror attempts
+	mirrorErrorsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mirror_errors_total",
+			Help: "Total number of failed mirror attempts",
+		},
+		[]string{"bucket", "op"},
+	)
+
+	// uploadsAbortedTotal counts uploads abandoned because the client disconnected
+	// or the request deadline passed
+	uploadsAbortedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "uploads_client_aborted_total",
+			Help: "Total number of uploads aborted by client disconnects or request deadlines",
+		},
+		[]string{"bucket"},
+	)
+
+	// uploadsDeduplicatedTotal counts uploads answered with an existing identical asset
+	uploadsDeduplicatedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "uploads_deduplicated_total",
+			Help: "Total number of uploads whose content was already stored",
+		},
+		[]string{"bucket", tenantMetricLabel},
+	)
+
+	// uploadedBytesTotal counts the bytes stored by uploads per bucket, origin and tenant
+	uploadedBytesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "uploaded_bytes_total",
+			Help: "Total number of bytes stored by uploads",
+		},
+		[]string{"bucket", "origin", tenantMetricLabel},
+	)
+
+	// uploadSizeBytes measures the size of stored uploads per bucket, origin and tenant
+	uploadSizeBytes = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "upload_size_bytes",
+			Help:    "Size of stored uploads in bytes",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 10), // 1 KiB to 256 MiB
+		},
+		[]string{"bucket", "origin", tenantMetricLabel},
+	)
+
+	// pipelineStageDuration measures the processing stages of ingested files
+	pipelineStageDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "pipeline_stage_duration_seconds",
+			Help:    "Duration of processing pipeline stages in seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"stage"},
+	)
+
+	// pipelineStageErrorsTotal counts failed stages by the error policy applied
+	pipelineStageErrorsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pipeline_stage_errors_total",
+			Help: "Total number of failed or timed out processing pipeline stages",
+		},
+		[]string{"stage", "policy"},
+	)
+
+	// quarantineOperationsTotal counts objects quarantined, released and purged
+	quarantineOperationsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "quarantine_operations_total",
+			Help: "Total number of quarantine operations",
+		},
+		[]string{"bucket", "op", "category"},
+	)
+
+	// quarantineObjects tracks the objects currently quarantined per source bucket
+	quarantineObjects = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "quarantine_objects",
+			Help: "Number of objects currently in quarantine",
+		},
+		[]string{"bucket"},
+	)
+
+	// quarantineBytes tracks the size of the objects currently quarantined per source bucket
+	quarantineBytes = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "quarantine_bytes",
+			Help: "Total size of the objects currently in quarantine in bytes",
+		},
+		[]string{"bucket"},
+	)
+
+	// abuseStrikesTotal counts suspicious requests per reason
+	abuseStrikesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "abuse_strikes_total",
+			Help: "Total number of suspicious requests counted towards IP bans",
+		},
+		[]string{"reason"},
+	)
+
+	// abuseBansTotal counts IP bans by the reason of the strike that triggered them
+	abuseBansTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "abuse_bans_total",
+			Help: "Total number of client IPs banned for abuse",
+		},
+		[]string{"reason"},
+	)
+
+	// abuseBlockedRequestsTotal counts requests dropped because the client IP is banned
+	abuseBlockedRequestsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "abuse_blocked_requests_total",
+			Help: "Total number of requests from banned client IPs",
+		},
+	)
+
+	// eventsDroppedTotal counts asset events dropped because the event queue was full
+	eventsDroppedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "asset_events_dropped_total",
+			Help: "Total number of asset events dropped due to a full queue",
+		},
+	)
+
+	// bigQueryRowsDroppedTotal counts rows given up on by reason (invalid, retries or backlog)
+	bigQueryRowsDroppedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bigquery_rows_dropped_total",
+			Help: "Total number of event rows not written to BigQuery by reason",
+		},
+		[]string{"reason"},
+	)
+
+	// eventSinkErrorsTotal counts failed event deliveries per sink
+	eventSinkErrorsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "asset_event_sink_errors_total",
+			Help: "Total number of failed asset event deliveries",
+		},
+		[]string{"sink"},
+	)
+
+	// hookExecutionsTotal counts exec hook runs by result
+	hookExecutionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hook_executions_total",
+			Help: "Total number of exec hook runs by result",
+		},
+		[]string{"result"},
+	)
+
+	// hookDuration measures how long exec hook commands run
+	hookDuration = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "hook_duration_seconds",
+			Help:    "Duration of exec hook commands in seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+
+	// bucketReconcileErrorsTotal counts failed bucket settings reconciliations
+	bucketReconcileErrorsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bucket_reconcile_errors_total",
+			Help: "Total number of failed bucket settings reconciliations",
+		},
+		[]string{"bucket"},
+	)
+
+	// bucketDriftTotal counts bucket settings found to differ from the desired ones
+	bucketDriftTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bucket_reconcile_drift_total",
+			Help: "Total number of drifted bucket settings corrected by reconciliation",
+		},
+		[]string{"bucket", "setting"},
+	)
+
+	// notificationErrorsTotal counts webhook notifications that could not be delivered
+	notificationErrorsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "notification_errors_total",
+			Help: "Total number of failed webhook notifications",
+		},
+		[]string{"kind"},
+	)
+
+	// metricsPushFailuresTotal counts failed pushes to (and group deletes on) the Pushgateway
+	metricsPushFailuresTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "metrics_push_failures_total",
+			Help: "Total number of failed metric pushes and group deletes on the Pushgateway",
+		},
+	)
+
+	// httpOpenConnections tracks the connections accepted by the server
+	httpOpenConnections = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "http_open_connections",
+			Help: "Number of open client connections",
+		},
+	)
+
+	// httpRejectedConnectionsTotal counts connections closed for exceeding the per-IP limit
+	httpRejectedConnectionsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "http_rejected_connections_total",
+			Help: "Total number of connections closed for exceeding the per-IP limit",
+		},
+	)
+
+	// httpSlowUploadsTotal counts requests aborted for sending their body too slowly
+	httpSlowUploadsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "http_slow_uploads_total",
+			Help: "Total number of requests aborted for sending their body below the minimum rate",
+		},
+	)
+
+	// storageFailoverActive is 1 while a bucket's writes go to its failover bucket
+	storageFailoverActive = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "storage_failover_active",
+			Help: "Whether writes to the bucket are routed to its failover bucket (1) or not (0)",
+		},
+		[]string{"bucket"},
+	)
+
+	// storageFailoverWritesTotal counts uploads and signed upload URLs routed to the failover bucket
+	storageFailoverWritesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "storage_failover_writes_total",
+			Help: "Total number of writes routed to the failover bucket",
+		},
+		[]string{"bucket"},
+	)
+
+	// storageFailoverPending tracks the objects in the failover bucket awaiting reconciliation
+	storageFailoverPending = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "storage_failover_pending_objects",
+			Help: "Number of objects in the failover bucket not yet moved to the primary",
+		},
+		[]string{"bucket"},
+	)
+
+	// storageFailoverReconciledTotal counts objects moved back from the failover bucket
+	storageFailoverReconciledTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "storage_failover_reconciled_total",
+			Help: "Total number of objects moved from the failover bucket to the primary",
+		},
+		[]string{"bucket"},
+	)
+
+	// bandwidthThrottleSeconds sums the time transfers were held back by per-key bandwidth caps
+	bandwidthThrottleSeconds = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bandwidth_throttle_seconds_total",
+			Help: "Total time request and response bodies were delayed by per-key bandwidth caps",
+		},
+		[]string{"direction"},
+	)
+
+	// hotlinkBlockedTotal counts downloads answered with the hotlink placeholder
+	hotlinkBlockedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "hotlink_blocked_total",
+			Help: "Total number of download requests from sites outside the referrer allowlist",
+		},
+	)
+
+	// downloadPlaceholderTotal counts downloads of missing objects answered with the placeholder
+	downloadPlaceholderTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "download_placeholder_total",
+			Help: "Total number of downloads of missing objects answered with the placeholder image",
+		},
+		[]string{"bucket"},
+	)
+
+	// stagingPublishedTotal counts staged uploads moved to their final name
+	stagingPublishedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "staging_published_total",
+			Help: "Total number of staged uploads published under their final name",
+		},
+		[]string{"bucket"},
+	)
+
+	// uploadVerificationFailuresTotal counts uploads that didn't read back as written
+	uploadVerificationFailuresTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upload_verification_failures_total",
+			Help: "Total number of uploads whose stored size or CRC32C didn't match what was written",
+		},
+		[]string{"bucket"},
+	)
+
+	// rateLimitedRequestsTotal counts requests rejected by a route rate class
+	rateLimitedRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rate_limited_requests_total",
+			Help: "Total number of requests rejected by the rate class of their route",
+		},
+		[]string{"class"},
+	)
+
+	// inboxFilesTotal counts files taken from the inbox directory by result
+	inboxFilesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "inbox_files_total",
+			Help: "Total number of inbox files by result (ingested or failed)",
+		},
+		[]string{"result"},
+	)
+
+	// inboundEmailsTotal counts inbound email webhooks by result
+	inboundEmailsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "inbound_emails_total",
+			Help: "Total number of inbound emails by result (accepted, rejected, unverified or unauthorized)",
+		},
+		[]string{"result"},
+	)
+
+	// reprocessedObjectsTotal counts objects run through the pipeline again by result
+	reprocessedObjectsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "reprocessed_objects_total",
+			Help: "Total number of objects reprocessed by result (success or failure)",
+		},
+		[]string{"result"},
+	)
+
+	// inventoryDriftObjects is the drift found by the last inventory by bucket and kind
+	inventoryDriftObjects = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "inventory_drift_objects",
+			Help: "Objects out of sync with the metadata catalog at the last inventory by bucket and kind (untracked, missing or changed)",
+		},
+		[]string{"bucket", "kind"},
+	)
+
+	// inventoryRepairsTotal counts records repaired by the inventory
+	inventoryRepairsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "inventory_repairs_total",
+			Help: "Total number of catalog records repaired by the inventory by bucket and kind",
+		},
+		[]string{"bucket", "kind"},
+	)
+
+	// inventoryErrorsTotal counts buckets whose inventory failed or wasn't repaired
+	inventoryErrorsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "inventory_errors_total",
+			Help: "Total number of bucket inventories that failed to list or exceeded the repair limit",
+		},
+		[]string{"bucket"},
+	)
+
+	// uploadMemoryBudgetBytes is the configured budget for request bodies in flight
+	uploadMemoryBudgetBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "upload_memory_budget_bytes",
+			Help: "Bytes of request bodies that may be in flight at once",
+		},
+	)
+
+	// uploadMemoryInUseBytes tracks the bytes reserved by the requests being served
+	uploadMemoryInUseBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "upload_memory_in_use_bytes",
+			Help: "Bytes of the upload memory budget reserved by requests being served",
+		},
+	)
+
+	// uploadMemoryQueued tracks the requests waiting for room in the budget
+	uploadMemoryQueued = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "upload_memory_queued_requests",
+			Help: "Number of requests waiting for room in the upload memory budget",
+		},
+	)
+
+	// uploadMemoryWaitSeconds measures how long queued requests waited for room
+	uploadMemoryWaitSeconds = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "upload_memory_wait_seconds",
+			Help:    "Time requests waited for room in the upload memory budget in seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+
+	// uploadMemoryRejectedTotal counts requests rejected for lack of upload memory
+	uploadMemoryRejectedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upload_memory_rejected_total",
+			Help: "Total number of requests rejected by the upload memory budget by reason (queue_full or timeout)",
+		},
+		[]string{"reason"},
+	)
+
+	// pathCanonicalizedTotal counts requests to paths with duplicate or trailing slashes
+	pathCanonicalizedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "path_canonicalized_total",
+			Help: "Total number of requests with duplicate or trailing slashes, by how they were handled (rewrite or redirect)",
+		},
+		[]string{"mode"},
+	)
+
+	// loadShedActive is 1 while low-priority requests are shed
+	loadShedActive = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "load_shed_active",
+			Help: "Whether low-priority requests are being shed (1) or not (0)",
+		},
+	)
+
+	// loadShedRequestsTotal counts low-priority requests answered with 503 by the reason for shedding
+	loadShedRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "load_shed_requests_total",
+			Help: "Total number of low-priority requests shed by reason (latency, errors or memory)",
+		},
+		[]string{"reason"},
+	)
+
+	// loadShedP99Latency is the p99 time to first byte the shedder last computed
+	loadShedP99Latency = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "load_shed_p99_latency_seconds",
+			Help: "p99 time to first byte of requests without a body over the load shedding window",
+		},
+	)
+
+	// loadShedErrorRate is the 5xx ratio the shedder last computed
+	loadShedErrorRate = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "load_shed_error_rate",
+			Help: "Ratio of 5xx responses over the load shedding window",
+		},
+	)
+
+	// loadShedMemoryBytes is the memory held by the Go runtime at the last check
+	loadShedMemoryBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "load_shed_memory_bytes",
+			Help: "Memory held by the Go runtime, as compared with the load shedding threshold",
+		},
+	)
+
+	// inventoryLastRunTimestamp is when the last inventory finished
+	inventoryLastRunTimestamp = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "inventory_last_run_timestamp_seconds",
+			Help: "Unix time the last bucket inventory finished",
+		},
 	)
 )
 
@@ -53,6 +583,11 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap exposes the underlying writer to http.ResponseController
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 // MetricsMiddleware records Prometheus metrics for each request
 func MetricsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -63,12 +598,10 @@ func MetricsMiddleware(next http.Handler) http.Handler {
 		}
 
 		// Start timer
-		timer := prometheus.NewTimer(httpRequestDuration.WithLabelValues(r.Method, r.URL.Path))
-		defer timer.ObserveDuration()
+		start := time.Now()
 
-		// Get hostname and client IP
+		// Get hostname
 		hostname := r.Host
-		clientIP := getClientIP(r)
 
 		// Wrap response writer to capture status code
 		wrapped := newResponseWriter(w)
@@ -76,18 +609,112 @@ func MetricsMiddleware(next http.Handler) http.Handler {
 		// Call next handler
 		next.ServeHTTP(wrapped, r)
 
-		// Record request metrics
-		httpRequestsTotal.WithLabelValues(
+		// Feed the error rate used for alerting (readiness probes excluded)
+		if r.URL.Path != "/readyz" {
+			healthMonitor.RecordResponse(wrapped.statusCode)
+			storageReporter.RecordResponse(r.Method, wrapped.statusCode)
+		}
+
+		// Record request metrics, with the trace as exemplar
+		exemplar := traceExemplar(r.Context())
+		observeWithExemplar(httpRequestDuration.WithLabelValues(r.Method, r.URL.Path), time.Since(start).Seconds(), exemplar)
+		requests := httpRequestsTotal.WithLabelValues(
 			r.Method,
 			r.URL.Path,
-			strconv.Itoa(wrapped.statusCode),
+			statusLabel(wrapped.statusCode),
 			hostname,
-			clientIP,
-		).Inc()
+			metricTenants.Label(r.Header.Get("X-Tenant-ID")),
+		)
+		if adder, ok := requests.(prometheus.ExemplarAdder); ok && exemplar != nil {
+			adder.AddWithExemplar(1, exemplar)
+		} else {
+			requests.Inc()
+		}
 	})
 }
 
+// statusLabels are the status codes as metric labels, formatted once
+var statusLabels = func() (labels [600]string) {
+	for code := range labels {
+		labels[code] = strconv.Itoa(code)
+	}
+	return labels
+}()
+
+// statusLabel returns the label of a status code without allocating
+func statusLabel(code int) string {
+	if code >= 0 && code < len(statusLabels) {
+		return statusLabels[code]
+	}
+	return strconv.Itoa(code)
+}
+
+// observeWithExemplar records a sample, attaching the exemplar when there is one
+func observeWithExemplar(observer prometheus.Observer, value float64, exemplar prometheus.Labels) {
+	if eo, ok := observer.(prometheus.ExemplarObserver); ok && exemplar != nil {
+		eo.ObserveWithExemplar(value, exemplar)
+		return
+	}
+	observer.Observe(value)
+}
+
 // IncrementSignedURLCounter increments the signed URL counter
-func IncrementSignedURLCounter(hostname, clientIP string) {
-	signedURLCreatedTotal.WithLabelValues(hostname, clientIP).Inc()
+func IncrementSignedURLCounter(hostname, tenant string) {
+	signedURLCreatedTotal.WithLabelValues(hostname, metricTenants.Label(tenant)).Inc()
+}
+
+// MetricsAuthConfig protects /metrics independently of the API keys. The
+// endpoint stays public when nothing is set.
+type MetricsAuthConfig struct {
+	Username   string // basic auth, together with Password
+	Password   string
+	Token      string   // bearer token
+	AllowedIPs []string // IPs or CIDR ranges that may scrape
+}
+
+// Enabled reports whether any protection is configured
+func (c MetricsAuthConfig) Enabled() bool {
+	return c.Password != "" || c.Token != "" || len(c.AllowedIPs) > 0
+}
+
+// MetricsAuthMiddleware requires the basic auth credentials or the bearer
+// token when configured (either is accepted when both are) and restricts
+// scrapers to the allowlist. The labels of the request metrics include client
+// IPs, hostnames and tenants, so they shouldn't be public.
+func MetricsAuthMiddleware(cfg MetricsAuthConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !cfg.Enabled() {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Client IP headers are only believed from trusted proxies, so a
+			// scraper can't claim an allowed IP
+			clientIP := trustedClientIP(r)
+			if len(cfg.AllowedIPs) > 0 && !isIPAllowed(clientIP, cfg.AllowedIPs) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			if cfg.Password == "" && cfg.Token == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			authorized := false
+			if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && cfg.Token != "" {
+				authorized = subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Token)) == 1
+			} else if username, password, ok := r.BasicAuth(); ok && cfg.Password != "" {
+				authorized = subtle.ConstantTimeCompare([]byte(username), []byte(cfg.Username)) == 1 &&
+					subtle.ConstantTimeCompare([]byte(password), []byte(cfg.Password)) == 1
+			}
+			if !authorized {
+				abuseGuard.RecordStrike(clientIP, StrikeAuthFailure, 1)
+				if cfg.Password != "" {
+					w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+				}
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
 }
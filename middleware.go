@@ -1,22 +1,24 @@
 package main
 
 import (
+	"crypto/subtle"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"strings"
 )
 
-// AuthMiddleware validates API key and optionally IP address
-func AuthMiddleware(apiKey string, allowedIPs []string) func(http.Handler) http.Handler {
+// AuthMiddleware validates API key and optionally IP address. Any of
+// apiKeys is accepted, so a route can take both the write key and the read key.
+func AuthMiddleware(apiKeys []string, allowedIPs []string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// Check API Key
 			providedKey := r.Header.Get("X-API-Key")
-			log.Println("Request : ", r)
-			log.Println("Provided API Key: " + providedKey)
-			log.Println("API Key: " + apiKey)
-			if providedKey == "" || providedKey != apiKey {
+			if !isKeyAccepted(providedKey, apiKeys) {
+				notifier.RecordAuthFailure(getClientIP(r))
+				abuseGuard.RecordStrike(trustedClientIP(r), StrikeAuthFailure, 1)
 				// Stealth mode: ignore request to hide server existence
 				if hj, ok := w.(http.Hijacker); ok {
 					if conn, _, err := hj.Hijack(); err == nil {
@@ -52,6 +54,20 @@ func AuthMiddleware(apiKey string, allowedIPs []string) func(http.Handler) http.
 	}
 }
 
+// isKeyAccepted reports whether the provided key matches one of the
+// configured keys; unset keys never match
+func isKeyAccepted(providedKey string, apiKeys []string) bool {
+	if providedKey == "" {
+		return false
+	}
+	for _, key := range apiKeys {
+		if key != "" && subtle.ConstantTimeCompare([]byte(providedKey), []byte(key)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
 // getClientIP extracts the client's real IP address from the request
 // Priority: CF-Connecting-IP > X-Real-IP > X-Forwarded-For > RemoteAddr
 func getClientIP(r *http.Request) string {
@@ -83,6 +99,81 @@ func getClientIP(r *http.Request) string {
 	return ip
 }
 
+// defaultTrustedProxies are the loopback, private and link-local ranges
+// reverse proxies, tunnels and the Cloud Run front end connect from; clients
+// on the internet can't have such a RemoteAddr
+const defaultTrustedProxies = "127.0.0.0/8,::1/128,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,169.254.0.0/16,fc00::/7,fe80::/10"
+
+// trustedProxies are the networks whose client IP headers are believed by
+// trustedClientIP, set from TRUSTED_PROXIES at startup
+var trustedProxies, _ = parseTrustedProxies(strings.Split(defaultTrustedProxies, ","))
+
+// parseTrustedProxies parses IPs and CIDR ranges
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP or CIDR range %q", entry)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			entry = fmt.Sprintf("%s/%d", ip, bits)
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP or CIDR range %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// isTrustedProxy reports whether ip belongs to a trusted proxy
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustedClientIP returns the client IP for decisions a forged header must
+// not sway, such as abuse bans: the connection's RemoteAddr, unless that is
+// a trusted proxy. Behind one, CF-Connecting-IP and X-Real-IP (which proxies
+// overwrite) are used, else the rightmost X-Forwarded-For entry that isn't
+// a trusted proxy, since clients can prepend whatever they like.
+func trustedClientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	if !isTrustedProxy(remote) {
+		return remote
+	}
+	if ip := strings.TrimSpace(r.Header.Get("CF-Connecting-IP")); ip != "" {
+		return ip
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hop := strings.TrimSpace(hops[i]); hop != "" && !isTrustedProxy(hop) {
+			return hop
+		}
+	}
+	return remote
+}
+
 // isIPAllowed checks if the client IP is in the whitelist
 func isIPAllowed(clientIP string, allowedIPs []string) bool {
 	parsedClientIP := net.ParseIP(clientIP)
@@ -110,6 +201,14 @@ func isIPAllowed(clientIP string, allowedIPs []string) bool {
 	return false
 }
 
+// Headers browser clients may send and read. Uppy and tus-js-client send
+// the tus headers and X-Requested-With, and read the upload state from the
+// exposed ones.
+const (
+	corsAllowHeaders  = "Content-Type, X-API-Key, X-Tenant-ID, X-Uploader-Id, X-Requested-With, X-HTTP-Method-Override, X-Goog-Encryption-Algorithm, X-Goog-Encryption-Key, X-Goog-Encryption-Key-Sha256, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset, Upload-Defer-Length, Upload-Concat"
+	corsExposeHeaders = "Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, Upload-Metadata, Upload-Expires, X-Object-URL"
+)
+
 // CORSMiddleware handles CORS headers
 func CORSMiddleware(allowedOrigins []string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -121,8 +220,9 @@ func CORSMiddleware(allowedOrigins []string) func(http.Handler) http.Handler {
 				w.Header().Set("Access-Control-Allow-Origin", origin)
 			}
 			
-			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key")
+			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, PATCH, HEAD, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
 			w.Header().Set("Access-Control-Max-Age", "3600")
 
 			// Handle preflight request
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MigrateOptions controls a bulk copy between two backends
+type MigrateOptions struct {
+	Prefix         string `json:"prefix"`
+	Concurrency    int    `json:"concurrency"`
+	CheckpointPath string `json:"checkpoint,omitempty"`
+	Overwrite      bool   `json:"overwrite"`
+}
+
+// MigrateProgress reports the state of a migration
+type MigrateProgress struct {
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Prefix      string    `json:"prefix"`
+	Listed      int64     `json:"listed"`
+	Copied      int64     `json:"copied"`
+	Skipped     int64     `json:"skipped"`
+	Failed      int64     `json:"failed"`
+	Bytes       int64     `json:"bytes"`
+	StartedAt   time.Time `json:"startedAt"`
+	FinishedAt  time.Time `json:"finishedAt,omitempty"`
+	Done        bool      `json:"done"`
+	Error       string    `json:"error,omitempty"`
+	Failures    []string  `json:"failures,omitempty"`
+}
+
+const maxReportedFailures = 100
+
+// migration tracks a running copy; progress fields are updated atomically
+type migration struct {
+	mu       sync.Mutex
+	progress MigrateProgress
+	listed   atomic.Int64
+	copied   atomic.Int64
+	skipped  atomic.Int64
+	failed   atomic.Int64
+	bytes    atomic.Int64
+}
+
+// Snapshot returns a consistent copy of the current progress
+func (m *migration) Snapshot() MigrateProgress {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := m.progress
+	p.Failures = append([]string(nil), m.progress.Failures...)
+	p.Listed = m.listed.Load()
+	p.Copied = m.copied.Load()
+	p.Skipped = m.skipped.Load()
+	p.Failed = m.failed.Load()
+	p.Bytes = m.bytes.Load()
+	return p
+}
+
+func (m *migration) fail(name string, err error) {
+	m.failed.Add(1)
+	m.mu.Lock()
+	if len(m.progress.Failures) < maxReportedFailures {
+		m.progress.Failures = append(m.progress.Failures, fmt.Sprintf("%s: %v", name, err))
+	}
+	m.mu.Unlock()
+	log.Printf("⚠️  Migration of %s failed: %v", name, err)
+}
+
+func (m *migration) finish(err error) {
+	m.mu.Lock()
+	m.progress.Done = true
+	m.progress.FinishedAt = time.Now()
+	if err != nil {
+		m.progress.Error = err.Error()
+	}
+	m.mu.Unlock()
+}
+
+// run copies every object under opts.Prefix from src to dst. Each copy is
+// verified by reading it back and comparing SHA-256 checksums. Completed
+// objects are appended to the checkpoint file so an interrupted run can be
+// resumed without copying them again.
+func (m *migration) run(ctx context.Context, src, dst Backend, opts MigrateOptions) error {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 4
+	}
+
+	done, err := loadCheckpoint(opts.CheckpointPath)
+	if err != nil {
+		return fmt.Errorf("failed to load checkpoint: %w", err)
+	}
+
+	var checkpoint *os.File
+	if opts.CheckpointPath != "" {
+		checkpoint, err = os.OpenFile(opts.CheckpointPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open checkpoint: %w", err)
+		}
+		defer checkpoint.Close()
+	}
+	var checkpointMu sync.Mutex
+
+	names := make(chan ObjectInfo)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for obj := range names {
+				if done[obj.Name] {
+					m.skipped.Add(1)
+					continue
+				}
+
+				copied, err := copyObject(ctx, src, dst, obj.Name, opts.Overwrite)
+				if err != nil {
+					m.fail(obj.Name, err)
+					continue
+				}
+				if copied {
+					m.copied.Add(1)
+					m.bytes.Add(obj.Size)
+				} else {
+					m.skipped.Add(1)
+				}
+
+				if checkpoint != nil {
+					checkpointMu.Lock()
+					fmt.Fprintln(checkpoint, obj.Name)
+					checkpointMu.Unlock()
+				}
+			}
+		}()
+	}
+
+	listErr := src.List(ctx, opts.Prefix, func(obj ObjectInfo) error {
+		m.listed.Add(1)
+		select {
+		case names <- obj:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(names)
+	wg.Wait()
+
+	if listErr != nil {
+		return fmt.Errorf("failed to list source: %w", listErr)
+	}
+	return nil
+}
+
+// copyObject copies one object and verifies the destination checksum.
+// It returns false when the object already exists and overwrite is off.
+func copyObject(ctx context.Context, src, dst Backend, name string, overwrite bool) (bool, error) {
+	if !overwrite {
+		if _, err := dst.Stat(ctx, name); err == nil {
+			return false, nil
+		} else if !errors.Is(err, ErrObjectNotFound) {
+			return false, err
+		}
+	}
+
+	reader, info, err := src.Open(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+
+	hasher := sha256.New()
+	if _, err := dst.Put(ctx, name, io.TeeReader(reader, hasher), PutOptions{
+		ContentType:        info.ContentType,
+		ContentDisposition: info.ContentDisposition,
+		Metadata:           info.Metadata,
+		Size:               info.Size,
+	}); err != nil {
+		return false, err
+	}
+
+	written, err := checksumObject(ctx, dst, name)
+	if err != nil {
+		return false, fmt.Errorf("failed to verify copy: %w", err)
+	}
+	if !bytes.Equal(written, hasher.Sum(nil)) {
+		return false, fmt.Errorf("checksum mismatch after copy")
+	}
+	return true, nil
+}
+
+// checksumObject returns the SHA-256 of an object's content
+func checksumObject(ctx context.Context, backend Backend, name string) ([]byte, error) {
+	reader, _, err := backend.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
+
+// loadCheckpoint reads the names of objects completed by a previous run
+func loadCheckpoint(path string) (map[string]bool, error) {
+	done := map[string]bool{}
+	if path == "" {
+		return done, nil
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			done[line] = true
+		}
+	}
+	return done, scanner.Err()
+}
+
+// startMigration runs a migration in the background and returns its tracker
+func startMigration(src, dst Backend, opts MigrateOptions) *migration {
+	m := &migration{progress: MigrateProgress{
+		Source:      src.Bucket(),
+		Destination: dst.Bucket(),
+		Prefix:      opts.Prefix,
+		StartedAt:   time.Now(),
+	}}
+	go func() {
+		err := m.run(context.Background(), src, dst, opts)
+		m.finish(err)
+		p := m.Snapshot()
+		log.Printf("📦 Migration %s → %s finished: %d copied, %d skipped, %d failed", p.Source, p.Destination, p.Copied, p.Skipped, p.Failed)
+	}()
+	return m
+}
+
+// MigrateRequest is the body of POST /admin/migrate
+type MigrateRequest struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	MigrateOptions
+}
+
+// HandleMigrate starts migrations (POST) and reports their progress (GET ?id=).
+// Checkpoint files requested over HTTP are confined to checkpointDir.
+func HandleMigrate(backends map[string]Backend, checkpointDir string) http.HandlerFunc {
+	var (
+		mu     sync.Mutex
+		jobs   = map[string]*migration{}
+		nextID int
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		switch r.Method {
+		case http.MethodGet:
+			mu.Lock()
+			job, ok := jobs[r.URL.Query().Get("id")]
+			mu.Unlock()
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   "Migration not found",
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(job.Snapshot())
+
+		case http.MethodPost:
+			var req MigrateRequest
+			if err := decodeJSONBody(w, r, &req, 0); err != nil {
+				w.WriteHeader(err.Status)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   err.Message,
+				})
+				return
+			}
+
+			src, srcOK := backends[req.Source]
+			dst, dstOK := backends[req.Destination]
+			if !srcOK || !dstOK || req.Source == req.Destination {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   "Source and destination must be two different registered buckets",
+				})
+				return
+			}
+
+			if req.CheckpointPath != "" {
+				if err := os.MkdirAll(checkpointDir, 0o755); err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					json.NewEncoder(w).Encode(UploadResponse{
+						Success: false,
+						Error:   fmt.Sprintf("Failed to create checkpoint directory: %v", err),
+					})
+					return
+				}
+				req.CheckpointPath = filepath.Join(checkpointDir, filepath.Base(req.CheckpointPath))
+			}
+
+			mu.Lock()
+			nextID++
+			id := fmt.Sprintf("%d", nextID)
+			jobs[id] = startMigration(src, dst, req.MigrateOptions)
+			mu.Unlock()
+
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]string{
+				"id":     id,
+				"status": fmt.Sprintf("/admin/migrate?id=%s", id),
+			})
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "Method not allowed. Use GET or POST.",
+			})
+		}
+	}
+}
+
+// runMigrateCommand implements the `migrate` CLI subcommand
+func runMigrateCommand(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := flags.String("from", "", "source backend as driver:bucket (e.g. gcs:my-bucket)")
+	to := flags.String("to", "", "destination backend as driver:bucket (e.g. r2:my-bucket)")
+	prefix := flags.String("prefix", "", "only copy objects under this prefix")
+	concurrency := flags.Int("concurrency", 4, "number of parallel copies")
+	checkpoint := flags.String("checkpoint", "", "checkpoint file used to resume interrupted runs")
+	overwrite := flags.Bool("overwrite", false, "overwrite objects that already exist in the destination")
+	flags.Parse(args)
+
+	if *from == "" || *to == "" {
+		fmt.Fprintln(os.Stderr, "usage: migrate -from driver:bucket -to driver:bucket [-prefix p] [-concurrency n] [-checkpoint file]")
+		return 2
+	}
+
+	config := LoadConfig()
+	ctx := context.Background()
+
+	src, err := NewBackend(ctx, config, parseBackendSpec(config, *from))
+	if err != nil {
+		log.Printf("❌ Failed to open source: %v", err)
+		return 1
+	}
+	defer src.Close()
+
+	dst, err := NewBackend(ctx, config, parseBackendSpec(config, *to))
+	if err != nil {
+		log.Printf("❌ Failed to open destination: %v", err)
+		return 1
+	}
+	defer dst.Close()
+
+	m := &migration{progress: MigrateProgress{Source: src.Bucket(), Destination: dst.Bucket(), Prefix: *prefix, StartedAt: time.Now()}}
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				p := m.Snapshot()
+				log.Printf("⏳ listed %d, copied %d, skipped %d, failed %d (%d bytes)", p.Listed, p.Copied, p.Skipped, p.Failed, p.Bytes)
+			}
+		}
+	}()
+
+	err = m.run(ctx, src, dst, MigrateOptions{
+		Prefix:         *prefix,
+		Concurrency:    *concurrency,
+		CheckpointPath: *checkpoint,
+		Overwrite:      *overwrite,
+	})
+	close(stop)
+
+	p := m.Snapshot()
+	log.Printf("📦 Migration finished: listed %d, copied %d, skipped %d, failed %d (%d bytes)", p.Listed, p.Copied, p.Skipped, p.Failed, p.Bytes)
+	if err != nil {
+		log.Printf("❌ %v", err)
+		return 1
+	}
+	if p.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// parseBackendSpec turns "driver:bucket" into a bucket configuration
+func parseBackendSpec(config *Config, spec string) BucketConfig {
+	driver, name, ok := strings.Cut(spec, ":")
+	if !ok {
+		driver, name = "gcs", spec
+	}
+	return BucketConfig{
+		Name:            name,
+		Driver:          driver,
+		CredentialsPath: config.ServiceAccountPath1,
+		PublicBaseURL:   config.PublicBaseURL1,
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification kinds that can be enabled with NOTIFY_EVENTS
+const (
+	NotifyAuthFailures = "auth_failures"
+	NotifyQuota        = "quota"
+	NotifyOutage       = "outage"
+	NotifyDailySummary = "daily_summary"
+	NotifyAbuse        = "abuse"
+	NotifyReport       = "report"
+)
+
+// Notifier posts operational messages to a Slack or Discord incoming webhook
+type Notifier struct {
+	webhookURL string
+	discord    bool
+	events     map[string]bool
+	httpClient *http.Client
+
+	authThreshold int
+	authWindow    time.Duration
+	quotaBytes    int64
+	quotaObjects  int64
+
+	mu           sync.Mutex
+	authFailures map[string][]time.Time // client IP -> failure timestamps in the window
+	lastSent     map[string]time.Time   // kind/key -> last notification, to avoid spamming
+	uploads      int64
+	uploadBytes  int64
+	outageSince  time.Time // when the readiness check started failing, zero while ready
+
+	stop chan struct{}
+}
+
+// notifier is the process-wide notifier; nil when notifications are disabled
+var notifier *Notifier
+
+// NewNotifier creates a notifier from config and starts the daily summary loop
+func NewNotifier(cfg NotifyConfig) *Notifier {
+	events := map[string]bool{}
+	for _, event := range cfg.Events {
+		events[event] = true
+	}
+
+	n := &Notifier{
+		webhookURL:    cfg.WebhookURL,
+		discord:       isDiscordWebhook(cfg.WebhookURL),
+		events:        events,
+		httpClient:    &http.Client{Timeout: 10 * time.Second},
+		authThreshold: cfg.AuthFailureThreshold,
+		authWindow:    cfg.AuthFailureWindow,
+		quotaBytes:    cfg.QuotaBytes,
+		quotaObjects:  cfg.QuotaObjects,
+		authFailures:  map[string][]time.Time{},
+		lastSent:      map[string]time.Time{},
+		stop:          make(chan struct{}),
+	}
+	if events[NotifyDailySummary] {
+		go n.dailySummaryLoop()
+	}
+	return n
+}
+
+// Name identifies the notifier as an event sink
+func (n *Notifier) Name() string {
+	return "notifier"
+}
+
+// Publish counts upload events for the daily summary
+func (n *Notifier) Publish(ctx context.Context, event AssetEvent) error {
+	if event.Type == EventUpload {
+		n.mu.Lock()
+		n.uploads++
+		n.uploadBytes += event.Size
+		n.mu.Unlock()
+	}
+	return nil
+}
+
+// Close stops the daily summary loop
+func (n *Notifier) Close() error {
+	close(n.stop)
+	return nil
+}
+
+// Enabled reports whether notifications of the given kind are sent
+func (n *Notifier) Enabled(kind string) bool {
+	return n != nil && n.events[kind]
+}
+
+// Send posts a message for the given kind if it is enabled. key scopes the
+// cooldown so e.g. each IP is reported at most once per window.
+func (n *Notifier) Send(kind, key, message string, cooldown time.Duration) {
+	if n == nil || !n.events[kind] || !featureFlags.Enabled(FlagWebhooks, "") {
+		return
+	}
+
+	n.mu.Lock()
+	cooldownKey := kind + "/" + key
+	if last, ok := n.lastSent[cooldownKey]; ok && time.Since(last) < cooldown {
+		n.mu.Unlock()
+		return
+	}
+	n.lastSent[cooldownKey] = time.Now()
+	n.mu.Unlock()
+
+	go func() {
+		if err := n.post(message); err != nil {
+			notificationErrorsTotal.WithLabelValues(kind).Inc()
+			log.Printf("⚠️  Failed to send %s notification: %v", kind, err)
+		}
+	}()
+}
+
+// RecordAuthFailure tracks failed authentications per IP and notifies when
+// an IP crosses the threshold within the window
+func (n *Notifier) RecordAuthFailure(clientIP string) {
+	if n == nil || !n.events[NotifyAuthFailures] {
+		return
+	}
+	clientIP = ipPrivacy.Anonymize(clientIP)
+
+	now := time.Now()
+	n.mu.Lock()
+	failures := n.authFailures[clientIP]
+	kept := failures[:0]
+	for _, t := range failures {
+		if now.Sub(t) < n.authWindow {
+			kept = append(kept, t)
+		}
+	}
+	kept = append(kept, now)
+	n.authFailures[clientIP] = kept
+	count := len(kept)
+
+	// Forget idle IPs so the map doesn't grow forever under scanning
+	if len(n.authFailures) > 10000 {
+		for ip, times := range n.authFailures {
+			if len(times) == 0 || now.Sub(times[len(times)-1]) > n.authWindow {
+				delete(n.authFailures, ip)
+			}
+		}
+	}
+	n.mu.Unlock()
+
+	if count >= n.authThreshold {
+		n.Send(NotifyAuthFailures, clientIP,
+			fmt.Sprintf("🔒 %d failed authentication attempts from %s in the last %s", count, clientIP, n.authWindow),
+			n.authWindow)
+	}
+}
+
+// CheckQuota notifies when a bucket holds more bytes or objects than the
+// quota, at most once a day per bucket
+func (n *Notifier) CheckQuota(stats *BucketStats) {
+	if n == nil || !n.events[NotifyQuota] {
+		return
+	}
+	if n.quotaBytes > 0 && stats.TotalBytes >= n.quotaBytes {
+		n.Send(NotifyQuota, stats.Bucket+"/bytes", fmt.Sprintf("📦 Bucket %s holds %.1f MB, over its quota of %.1f MB",
+			stats.Bucket, float64(stats.TotalBytes)/(1024*1024), float64(n.quotaBytes)/(1024*1024)), 24*time.Hour)
+	}
+	if n.quotaObjects > 0 && stats.Objects >= n.quotaObjects {
+		n.Send(NotifyQuota, stats.Bucket+"/objects", fmt.Sprintf("📦 Bucket %s holds %d objects, over its quota of %d",
+			stats.Bucket, stats.Objects, n.quotaObjects), 24*time.Hour)
+	}
+}
+
+// HealthChanged is a health monitor listener that notifies when the
+// readiness check starts failing and when it recovers
+func (n *Notifier) HealthChanged(status HealthStatus) {
+	if n == nil || !n.events[NotifyOutage] {
+		return
+	}
+
+	n.mu.Lock()
+	since := n.outageSince
+	n.outageSince = status.FailingSince
+	n.mu.Unlock()
+	if since.IsZero() == status.Ready {
+		return
+	}
+
+	if !status.Ready {
+		names := make([]string, 0, len(status.Checks))
+		for name := range status.Checks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		checks := make([]string, 0, len(names))
+		for _, name := range names {
+			result := status.Checks[name]
+			if err, ok := status.Errors[name]; ok {
+				result = err
+			}
+			checks = append(checks, name+": "+result)
+		}
+		n.Send(NotifyOutage, "down", "🔴 Storage outage: "+strings.Join(checks, "; "), 5*time.Minute)
+		return
+	}
+	n.Send(NotifyOutage, "up", fmt.Sprintf("🟢 Storage recovered after %s", time.Since(since).Round(time.Second)), 5*time.Minute)
+}
+
+// dailySummaryLoop posts the upload summary every day at midnight UTC
+func (n *Notifier) dailySummaryLoop() {
+	for {
+		now := time.Now().UTC()
+		next := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+		select {
+		case <-n.stop:
+			return
+		case <-time.After(next.Sub(now)):
+		}
+
+		n.mu.Lock()
+		uploads, bytes := n.uploads, n.uploadBytes
+		n.uploads, n.uploadBytes = 0, 0
+		n.mu.Unlock()
+
+		n.Send(NotifyDailySummary, "", fmt.Sprintf("📊 Daily summary for %s: %d uploads, %.1f MB",
+			now.Format("2006-01-02"), uploads, float64(bytes)/(1024*1024)), time.Hour)
+	}
+}
+
+// post sends a message using the payload format of the webhook provider
+func (n *Notifier) post(message string) error {
+	payload := map[string]string{"text": message}
+	if n.discord {
+		payload = map[string]string{"content": message}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.httpClient.Post(n.webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// isDiscordWebhook detects Discord webhook URLs, everything else is treated as Slack
+func isDiscordWebhook(webhookURL string) bool {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	return host == "discord.com" || host == "discordapp.com" || strings.HasSuffix(host, ".discord.com")
+}
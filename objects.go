@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Page sizes of object listings
+const (
+	defaultListPageSize = 100
+	maxListPageSize     = 1000
+)
+
+// ObjectSummary describes an object in a listing
+type ObjectSummary struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType,omitempty"`
+	Updated     time.Time `json:"updated"`
+	URL         string    `json:"url"`
+}
+
+// ObjectListResponse is a page of an object listing
+type ObjectListResponse struct {
+	Success       bool            `json:"success"`
+	Objects       []ObjectSummary `json:"objects"`
+	NextPageToken string          `json:"nextPageToken,omitempty"` // pass as pageToken for the next page
+	Error         string          `json:"error,omitempty"`
+}
+
+// HandleListObjects serves GET ?prefix=&pageSize=&pageToken=, listing the
+// objects of a bucket in name order, a page at a time. With ?tag= (repeated
+// for several) only assets of the metadata store carrying every tag are listed.
+func HandleListObjects(backend Backend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(ObjectListResponse{
+				Success: false,
+				Error:   "Method not allowed. Use GET.",
+			})
+			return
+		}
+
+		query := r.URL.Query()
+		pageSize := defaultListPageSize
+		if value := query.Get("pageSize"); value != "" {
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 1 || size > maxListPageSize {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(ObjectListResponse{
+					Success: false,
+					Error:   fmt.Sprintf("pageSize must be between 1 and %d", maxListPageSize),
+				})
+				return
+			}
+			pageSize = size
+		}
+		after, err := decodePageToken(query.Get("pageToken"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ObjectListResponse{
+				Success: false,
+				Error:   "Invalid pageToken",
+			})
+			return
+		}
+
+		tags, err := normalizeTags(query["tag"])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ObjectListResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), serverWriteTimeout)
+		defer cancel()
+
+		var objects []ObjectInfo
+		var more bool
+		if len(tags) > 0 {
+			objects, more = taggedPage(backend.Bucket(), query.Get("prefix"), tags, after, pageSize)
+		} else {
+			objects, more, err = listPage(ctx, backend, query.Get("prefix"), after, pageSize)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ObjectListResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Failed to list objects: %v", err),
+			})
+			return
+		}
+
+		response := ObjectListResponse{Success: true, Objects: make([]ObjectSummary, 0, len(objects))}
+		for _, object := range objects {
+			response.Objects = append(response.Objects, ObjectSummary{
+				Name:        object.Name,
+				Size:        object.Size,
+				ContentType: object.ContentType,
+				Updated:     object.Updated,
+				URL:         backend.PublicURL(object.Name),
+			})
+		}
+		if more {
+			response.NextPageToken = encodePageToken(objects[len(objects)-1].Name)
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// listPage returns the first pageSize objects under prefix whose names sort
+// after the given name, and whether more follow. Drivers don't all list in
+// name order (fs walks directories), so the page is the smallest names seen
+// rather than the first ones listed.
+func listPage(ctx context.Context, backend Backend, prefix, after string, pageSize int) ([]ObjectInfo, bool, error) {
+	page := make([]ObjectInfo, 0, pageSize+1)
+	byName := func(a ObjectInfo, name string) int { return strings.Compare(a.Name, name) }
+
+	err := backend.List(ctx, prefix, func(info ObjectInfo) error {
+		if info.Name <= after || hiddenObject(info.Name) {
+			return nil
+		}
+		if len(page) > pageSize && info.Name >= page[pageSize].Name {
+			return nil
+		}
+		i, _ := slices.BinarySearchFunc(page, info.Name, byName)
+		page = slices.Insert(page, i, info)
+		if len(page) > pageSize+1 {
+			page = page[:pageSize+1]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(page) > pageSize {
+		return page[:pageSize], true, nil
+	}
+	return page, false, nil
+}
+
+// taggedPage is listPage for the assets of the metadata store that carry
+// every one of tags
+func taggedPage(bucket, prefix string, tags []string, after string, pageSize int) ([]ObjectInfo, bool) {
+	page := make([]ObjectInfo, 0, pageSize+1)
+	errPageFull := errors.New("page full")
+	metadataStore.List(bucket, prefix, func(record AssetRecord) error {
+		if record.Name <= after || isQuarantineRecord(record) || !hasTags(record, tags) {
+			return nil
+		}
+		page = append(page, ObjectInfo{
+			Name:        record.Name,
+			Size:        record.Size,
+			ContentType: record.ContentType,
+			Updated:     record.CreatedAt,
+			Metadata:    record.Metadata,
+		})
+		if len(page) > pageSize {
+			return errPageFull
+		}
+		return nil
+	})
+
+	if len(page) > pageSize {
+		return page[:pageSize], true
+	}
+	return page, false
+}
+
+// encodePageToken returns an opaque token for the listing position after name
+func encodePageToken(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+// decodePageToken returns the name a page token continues after
+func decodePageToken(token string) (string, error) {
+	name, err := base64.RawURLEncoding.DecodeString(token)
+	return string(name), err
+}
+
+// HandleDeleteObject serves DELETE on an object; it must be mounted behind
+// http.StripPrefix so the path is the object name. The object's poster, if
+// any, is deleted along with it.
+func HandleDeleteObject(backend Backend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "Method not allowed. Use DELETE.",
+			})
+			return
+		}
+
+		name, _ := objectPathName(r, "", "")
+		if name == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "No object name provided",
+			})
+			return
+		}
+		if quarantine.Hides(name) {
+			// Quarantined objects are only purged through the admin endpoints
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "Object not found",
+			})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), serverWriteTimeout)
+		defer cancel()
+
+		err := checkDeletable(ctx, backend, name)
+		if err == nil {
+			err = backend.Delete(ctx, name)
+		}
+		if err != nil {
+			if errors.Is(err, ErrObjectNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   "Object not found",
+				})
+				return
+			}
+			if errors.Is(err, ErrObjectHeld) {
+				w.WriteHeader(http.StatusLocked)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   "Object is under a legal hold or retention period and can't be deleted",
+				})
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Failed to delete object: %v", err),
+			})
+			return
+		}
+
+		record, _ := metadataStore.Get(backend.Bucket(), name)
+		if poster := record.Metadata["poster"]; poster != "" {
+			if err := backend.Delete(ctx, poster); err != nil && !errors.Is(err, ErrObjectNotFound) {
+				traceLogf(ctx, "⚠️  Failed to delete poster %s: %v", poster, err)
+			}
+		}
+		if err := metadataStore.Delete(backend.Bucket(), name); err != nil {
+			traceLogf(ctx, "⚠️  Failed to remove %s from metadata store: %v", name, err)
+		}
+		PublishEvent(AssetEvent{
+			Type:      EventDelete,
+			Bucket:    backend.Bucket(),
+			Object:    name,
+			Size:      record.Size,
+			Tenant:    r.Header.Get("X-Tenant-ID"),
+			LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+		})
+
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: true,
+			Object:  name,
+			Message: "Object deleted",
+		})
+	}
+}
+
+// statConcurrency bounds the storage lookups of one batch stat request
+const statConcurrency = 16
+
+// StatRequest lists the objects to look up
+type StatRequest struct {
+	Objects []string `json:"objects"`
+}
+
+// ObjectStat tells whether one object exists, with its attributes if so
+type ObjectStat struct {
+	Name        string    `json:"name"`
+	Exists      bool      `json:"exists"`
+	Size        int64     `json:"size,omitempty"`
+	ContentType string    `json:"contentType,omitempty"`
+	ETag        string    `json:"etag,omitempty"`
+	Updated     time.Time `json:"updated,omitzero"`
+	URL         string    `json:"url,omitempty"`
+	Error       string    `json:"error,omitempty"` // the lookup failed, existence is unknown
+}
+
+// StatResponse lists the results in request order
+type StatResponse struct {
+	Success bool         `json:"success"`
+	Objects []ObjectStat `json:"objects"`
+	Missing int          `json:"missing"` // objects that don't exist
+	Error   string       `json:"error,omitempty"`
+}
+
+// HandleStatObjects serves POST {"objects": [...]}, looking up up to
+// maxListPageSize objects at once so references can be validated in bulk.
+// A failed lookup is reported per object instead of failing the request.
+func HandleStatObjects(backend Backend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(StatResponse{
+				Success: false,
+				Error:   "Method not allowed. Use POST.",
+			})
+			return
+		}
+
+		var req StatRequest
+		if err := decodeJSONBody(w, r, &req, 0); err != nil {
+			w.WriteHeader(err.Status)
+			json.NewEncoder(w).Encode(StatResponse{
+				Success: false,
+				Error:   err.Message,
+			})
+			return
+		}
+		if len(req.Objects) == 0 || len(req.Objects) > maxListPageSize {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(StatResponse{
+				Success: false,
+				Error:   fmt.Sprintf("objects must list 1 to %d names", maxListPageSize),
+			})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), serverWriteTimeout)
+		defer cancel()
+
+		results := make([]ObjectStat, len(req.Objects))
+		slots := make(chan struct{}, statConcurrency)
+		var wg sync.WaitGroup
+		for i, name := range req.Objects {
+			results[i].Name = name
+			if name == "" || hiddenObject(name) {
+				continue
+			}
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(result *ObjectStat) {
+				defer func() { <-slots; wg.Done() }()
+				info, err := backend.Stat(ctx, result.Name)
+				switch {
+				case errors.Is(err, ErrObjectNotFound):
+				case err != nil:
+					result.Error = err.Error()
+				default:
+					result.Exists = true
+					result.Size, result.ContentType, result.ETag, result.Updated = info.Size, info.ContentType, info.ETag, info.Updated
+					result.URL = backend.PublicURL(result.Name)
+				}
+			}(&results[i])
+		}
+		wg.Wait()
+
+		response := StatResponse{Success: true, Objects: results}
+		for _, result := range results {
+			if !result.Exists && result.Error == "" {
+				response.Missing++
+			}
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
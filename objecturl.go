@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// errUnknownObjectURL is returned for URLs that don't point into a served bucket
+var errUnknownObjectURL = errors.New("URL does not point to an object of a served bucket")
+
+// objectURLBase is a URL prefix objects of a bucket are served under. Bases
+// without a scheme are paths of this service (e.g. the /images download
+// proxy) and match relative URLs and URLs on the host the service is
+// reached at.
+type objectURLBase struct {
+	bucket string
+	prefix string // with a trailing slash; scheme and host are lowercase
+}
+
+// ObjectURLResolver maps the public URLs of objects back to their bucket and
+// name, for clients that only kept the URL (e.g. a CMS)
+type ObjectURLResolver struct {
+	bases []objectURLBase
+}
+
+// NewObjectURLResolver creates a resolver from the base URLs of each bucket.
+// The storage.googleapis.com, storage.cloud.google.com, virtual-hosted
+// (bucket.storage.googleapis.com) and gs:// forms are added for every bucket.
+func NewObjectURLResolver(bases map[string][]string) *ObjectURLResolver {
+	resolver := &ObjectURLResolver{}
+	for bucket, urls := range bases {
+		urls = append(urls,
+			"https://storage.googleapis.com/"+bucket,
+			"https://storage.cloud.google.com/"+bucket,
+			"https://"+bucket+".storage.googleapis.com",
+			"gs://"+bucket,
+		)
+		for _, base := range urls {
+			if prefix := normalizeURLBase(base); prefix != "" {
+				resolver.bases = append(resolver.bases, objectURLBase{bucket: bucket, prefix: prefix})
+			}
+		}
+	}
+	return resolver
+}
+
+// normalizeURLBase lowercases the scheme and host of a base URL and ends it
+// with a slash; it returns "" for bases that can't hold objects
+func normalizeURLBase(base string) string {
+	u, err := url.Parse(strings.TrimSuffix(base, "/") + "/")
+	if err != nil || (u.Scheme == "" && !strings.HasPrefix(u.Path, "/")) || u.Path == "/" && u.Host == "" {
+		return ""
+	}
+	if u.Scheme == "" {
+		return u.EscapedPath()
+	}
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host) + u.EscapedPath()
+}
+
+// Resolve returns the bucket and object name a public URL points to. host is
+// the host the request reached the service at; path bases only match URLs on
+// it, so /images/cat.jpg on another site isn't taken for one of ours. Query
+// strings and fragments, such as resizing parameters of a CDN, are ignored.
+// The longest matching base wins.
+func (res *ObjectURLResolver) Resolve(raw, host string) (string, string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", errUnknownObjectURL
+	}
+	// Relative URLs (/images/cat.jpg) can only match path bases
+	absolute := ""
+	if u.Host != "" {
+		absolute = strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host) + u.EscapedPath()
+	}
+	onService := u.Host == "" || strings.EqualFold(u.Host, host) && (u.Scheme == "http" || u.Scheme == "https")
+
+	var match objectURLBase
+	var rest string
+	for _, base := range res.bases {
+		candidate := absolute
+		if strings.HasPrefix(base.prefix, "/") {
+			if !onService {
+				continue
+			}
+			candidate = u.EscapedPath()
+		}
+		if candidate == "" {
+			continue
+		}
+		if remainder, ok := strings.CutPrefix(candidate, base.prefix); ok && len(base.prefix) > len(match.prefix) {
+			match, rest = base, remainder
+		}
+	}
+	if match.bucket == "" {
+		return "", "", errUnknownObjectURL
+	}
+	name, err := url.PathUnescape(rest)
+	if err != nil || name == "" {
+		return "", "", errUnknownObjectURL
+	}
+	return match.bucket, name, nil
+}
+
+// HandleDeleteByURL serves DELETE ?url=, deleting the object a public URL
+// (storage, CDN or download proxy) points to with the delete handler of its
+// bucket
+func HandleDeleteByURL(resolver *ObjectURLResolver, handlers map[string]http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		raw := r.URL.Query().Get("url")
+		bucket, name, err := resolver.Resolve(raw, r.Host)
+		handler, ok := handlers[bucket]
+		if raw == "" || err != nil || !ok {
+			message := "url must be the public URL of an object"
+			if raw != "" {
+				message = errUnknownObjectURL.Error()
+			}
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   message,
+			})
+			return
+		}
+
+		// The delete handler reads the object name from the path, as behind http.StripPrefix
+		r2 := r.Clone(r.Context())
+		r2.URL.Path, r2.URL.RawPath = name, ""
+		handler.ServeHTTP(w, r2)
+	}
+}
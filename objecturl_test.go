@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func testObjectURLResolver() *ObjectURLResolver {
+	return NewObjectURLResolver(map[string][]string{
+		"prod-bucket": {"/images", "https://CDN.example.com/img/"},
+		"dev-bucket":  {"/images-dev/", "https://cdn.example.com/img/dev"},
+	})
+}
+
+func TestObjectURLResolve(t *testing.T) {
+	const host = "api.example.com"
+	tests := []struct {
+		raw    string
+		bucket string
+		name   string
+	}{
+		{"/images/cat.jpg", "prod-bucket", "cat.jpg"},
+		{"/images/products/cat.jpg", "prod-bucket", "products/cat.jpg"},
+		{"/images-dev/cat.jpg", "dev-bucket", "cat.jpg"},
+		{"https://api.example.com/images/cat.jpg", "prod-bucket", "cat.jpg"},
+		{"http://API.example.com/images/cat.jpg", "prod-bucket", "cat.jpg"},
+		{"https://cdn.example.com/img/a%20b.jpg?w=100#top", "prod-bucket", "a b.jpg"},
+		{"HTTPS://cdn.EXAMPLE.com/img/cat.jpg", "prod-bucket", "cat.jpg"},
+		{"https://cdn.example.com/img/dev/cat.jpg", "dev-bucket", "cat.jpg"}, // longest base wins
+		{"https://cdn.example.com/img/a%2Fb.jpg", "prod-bucket", "a/b.jpg"},
+		{"https://storage.googleapis.com/prod-bucket/x/y.png", "prod-bucket", "x/y.png"},
+		{"https://storage.cloud.google.com/dev-bucket/y.png", "dev-bucket", "y.png"},
+		{"https://prod-bucket.storage.googleapis.com/y.png", "prod-bucket", "y.png"},
+		{"gs://dev-bucket/y.png", "dev-bucket", "y.png"},
+	}
+	resolver := testObjectURLResolver()
+	for _, tt := range tests {
+		bucket, name, err := resolver.Resolve(tt.raw, host)
+		if err != nil || bucket != tt.bucket || name != tt.name {
+			t.Errorf("Resolve(%q) = %q, %q, %v, want %q, %q", tt.raw, bucket, name, err, tt.bucket, tt.name)
+		}
+	}
+}
+
+func TestObjectURLResolveUnknown(t *testing.T) {
+	tests := []string{
+		"",
+		"cat.jpg",
+		"/other/cat.jpg",
+		"/images/",
+		"/imagesfoo/cat.jpg",
+		"https://other.example.com/images/cat.jpg", // path bases only match the service's host
+		"ftp://api.example.com/images/cat.jpg",
+		"https://cdn.example.com/image/cat.jpg",
+		"https://storage.googleapis.com/other-bucket/cat.jpg",
+		"https://storage.googleapis.com/prod-bucket/",
+		"https://cdn.example.com/img/%zz",
+		"://bad",
+	}
+	resolver := testObjectURLResolver()
+	for _, raw := range tests {
+		if bucket, name, err := resolver.Resolve(raw, "api.example.com"); err != errUnknownObjectURL {
+			t.Errorf("Resolve(%q) = %q, %q, %v, want errUnknownObjectURL", raw, bucket, name, err)
+		}
+	}
+}
+
+func TestNormalizeURLBase(t *testing.T) {
+	tests := []struct {
+		base string
+		want string
+	}{
+		{"/images", "/images/"},
+		{"/images/", "/images/"},
+		{"https://CDN.Example.com", "https://cdn.example.com/"},
+		{"https://cdn.example.com/Img", "https://cdn.example.com/Img/"},
+		{"gs://bucket", "gs://bucket/"},
+		{"images", ""},
+		{"/", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeURLBase(tt.base); got != tt.want {
+			t.Errorf("normalizeURLBase(%q) = %q, want %q", tt.base, got, tt.want)
+		}
+	}
+}
+
+func TestHandleDeleteByURL(t *testing.T) {
+	var gotPath string
+	handler := HandleDeleteByURL(testObjectURLResolver(), map[string]http.Handler{
+		"prod-bucket": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotPath = r.URL.Path
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	})
+
+	tests := []struct {
+		raw    string
+		status int
+		path   string
+	}{
+		{"/images/products/a%20b.jpg", http.StatusNoContent, "products/a b.jpg"},
+		{"", http.StatusBadRequest, ""},
+		{"https://elsewhere.example.com/images/cat.jpg", http.StatusBadRequest, ""},
+		{"/images-dev/cat.jpg", http.StatusBadRequest, ""}, // no handler for the bucket
+	}
+	for _, tt := range tests {
+		gotPath = ""
+		req := httptest.NewRequest(http.MethodDelete, "/objects?url="+url.QueryEscape(tt.raw), nil)
+		req.Host = "api.example.com"
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != tt.status || gotPath != tt.path {
+			t.Errorf("DELETE ?url=%s: status %d, path %q, want %d, %q", tt.raw, rec.Code, gotPath, tt.status, tt.path)
+		}
+	}
+}
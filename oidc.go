@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	adminSessionCookie = "admin_session"
+	oidcStateCookie    = "admin_oidc_state"
+	oidcStateTTL       = 10 * time.Minute
+	// jwksRefreshInterval limits how often an unknown key id triggers a JWKS fetch
+	jwksRefreshInterval = time.Minute
+)
+
+// OIDCAuth implements the OpenID Connect authorization code flow (with PKCE)
+// for humans using the admin endpoints, and issues signed session cookies.
+// It works with any compliant issuer, e.g. Google or Microsoft Entra ID.
+type OIDCAuth struct {
+	cfg        OIDCConfig
+	httpClient *http.Client
+	provider   oidcProvider
+	secure     bool // set the Secure flag on cookies (https redirect URL)
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+}
+
+// oidcProvider is the subset of the discovery document we use
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// AdminSession is the identity stored in the admin session cookie
+type AdminSession struct {
+	Subject   string   `json:"sub"`
+	Email     string   `json:"email,omitempty"`
+	Name      string   `json:"name,omitempty"`
+	Groups    []string `json:"groups,omitempty"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+// oidcState travels in a short-lived cookie between login and callback
+type oidcState struct {
+	State     string `json:"state"`
+	Nonce     string `json:"nonce"`
+	Verifier  string `json:"verifier"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// idTokenClaims are the ID token claims we check
+type idTokenClaims struct {
+	Issuer        string          `json:"iss"`
+	Subject       string          `json:"sub"`
+	Audience      json.RawMessage `json:"aud"`
+	ExpiresAt     int64           `json:"exp"`
+	Nonce         string          `json:"nonce"`
+	Email         string          `json:"email"`
+	EmailVerified *bool           `json:"email_verified"`
+	Name          string          `json:"name"`
+	HostedDomain  string          `json:"hd"`
+}
+
+// NewOIDCAuth fetches the issuer's discovery document
+func NewOIDCAuth(ctx context.Context, cfg OIDCConfig) (*OIDCAuth, error) {
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required with OIDC_ISSUER")
+	}
+	if len(cfg.SessionSecret) < 32 {
+		return nil, errors.New("OIDC_SESSION_SECRET must be at least 32 characters")
+	}
+	if len(cfg.AllowedGroups) == 0 && len(cfg.AllowedDomains) == 0 {
+		return nil, errors.New("OIDC_ALLOWED_GROUPS or OIDC_ALLOWED_DOMAINS is required with OIDC_ISSUER")
+	}
+
+	a := &OIDCAuth{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		secure:     strings.HasPrefix(cfg.RedirectURL, "https://"),
+	}
+
+	discoveryURL := strings.TrimSuffix(cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := a.getJSON(ctx, discoveryURL, &a.provider); err != nil {
+		return nil, fmt.Errorf("failed to fetch OIDC discovery document: %w", err)
+	}
+	if a.provider.Issuer != cfg.Issuer {
+		return nil, fmt.Errorf("OIDC issuer mismatch: configured %s, discovery document says %s", cfg.Issuer, a.provider.Issuer)
+	}
+	return a, nil
+}
+
+// HandleLogin redirects to the identity provider
+func (a *OIDCAuth) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	state := oidcState{
+		State:     randomToken(),
+		Nonce:     randomToken(),
+		Verifier:  randomToken() + randomToken(),
+		ExpiresAt: time.Now().Add(oidcStateTTL).Unix(),
+	}
+	a.setSignedCookie(w, oidcStateCookie, state, oidcStateTTL)
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {a.cfg.ClientID},
+		"redirect_uri":          {a.cfg.RedirectURL},
+		"scope":                 {strings.Join(a.cfg.Scopes, " ")},
+		"state":                 {state.State},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, a.provider.AuthorizationEndpoint+"?"+query.Encode(), http.StatusFound)
+}
+
+// HandleCallback completes the login and issues the session cookie
+func (a *OIDCAuth) HandleCallback(w http.ResponseWriter, r *http.Request) {
+	var state oidcState
+	if !a.readSignedCookie(r, oidcStateCookie, &state) || time.Now().Unix() > state.ExpiresAt {
+		writeAuthError(w, http.StatusBadRequest, "Login expired, start again at /auth/login")
+		return
+	}
+	a.clearCookie(w, oidcStateCookie)
+
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		writeAuthError(w, http.StatusUnauthorized, fmt.Sprintf("Login failed: %s %s", errCode, query.Get("error_description")))
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state.State)) != 1 {
+		writeAuthError(w, http.StatusBadRequest, "Invalid login state")
+		return
+	}
+
+	rawIDToken, err := a.exchangeCode(r.Context(), query.Get("code"), state.Verifier)
+	if err != nil {
+		log.Printf("❌ OIDC code exchange failed: %v", err)
+		writeAuthError(w, http.StatusBadGateway, "Failed to complete login with the identity provider")
+		return
+	}
+
+	session, err := a.verifyIDToken(r.Context(), rawIDToken, state.Nonce)
+	if err != nil {
+		log.Printf("🔒 OIDC login rejected: %v", err)
+		notifier.RecordAuthFailure(getClientIP(r))
+		abuseGuard.RecordStrike(trustedClientIP(r), StrikeAuthFailure, 1)
+		writeAuthError(w, http.StatusForbidden, "You are not allowed to use the admin endpoints")
+		return
+	}
+
+	session.ExpiresAt = time.Now().Add(a.cfg.SessionTTL).Unix()
+	a.setSignedCookie(w, adminSessionCookie, session, a.cfg.SessionTTL)
+	log.Printf("🔑 Admin login: %s (%s)", session.Email, session.Subject)
+	http.Redirect(w, r, "/auth/me", http.StatusFound)
+}
+
+// HandleLogout clears the session cookie
+func (a *OIDCAuth) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	a.clearCookie(w, adminSessionCookie)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(UploadResponse{Success: true, Message: "Logged out"})
+}
+
+// HandleMe returns the identity of the current session
+func (a *OIDCAuth) HandleMe(w http.ResponseWriter, r *http.Request) {
+	session, ok := a.Session(r)
+	if !ok {
+		writeAuthError(w, http.StatusUnauthorized, "Not logged in, use /auth/login")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(session)
+}
+
+// Session returns the valid admin session of a request, if any
+func (a *OIDCAuth) Session(r *http.Request) (*AdminSession, bool) {
+	var session AdminSession
+	if !a.readSignedCookie(r, adminSessionCookie, &session) || time.Now().Unix() > session.ExpiresAt {
+		return nil, false
+	}
+	return &session, true
+}
+
+// exchangeCode redeems the authorization code and returns the raw ID token
+func (a *OIDCAuth) exchangeCode(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {a.cfg.RedirectURL},
+		"client_id":     {a.cfg.ClientID},
+		"client_secret": {a.cfg.ClientSecret},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("invalid token response (status %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %d: %s %s", resp.StatusCode, token.Error, token.Description)
+	}
+	if token.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return token.IDToken, nil
+}
+
+// verifyIDToken checks the RS256 signature and claims of an ID token and
+// the group/domain allowlists, and returns the resulting session
+func (a *OIDCAuth) verifyIDToken(ctx context.Context, raw, nonce string) (*AdminSession, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid ID token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+	key, err := a.signingKey(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token signature encoding: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("invalid ID token signature")
+	}
+
+	var claims idTokenClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid ID token claims: %w", err)
+	}
+	var rawClaims map[string]json.RawMessage
+	decodeJWTPart(parts[1], &rawClaims)
+
+	switch {
+	case claims.Issuer != a.provider.Issuer:
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	case !audienceContains(claims.Audience, a.cfg.ClientID):
+		return nil, errors.New("ID token was not issued for this client")
+	case time.Now().Unix() > claims.ExpiresAt:
+		return nil, errors.New("ID token expired")
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, errors.New("ID token nonce mismatch")
+	}
+
+	var groups []string
+	if groupsClaim, ok := rawClaims[a.cfg.GroupsClaim]; ok {
+		json.Unmarshal(groupsClaim, &groups)
+	}
+
+	if !a.allowed(claims, groups) {
+		return nil, fmt.Errorf("%s (%s) is not in an allowed group or domain", claims.Email, claims.Subject)
+	}
+	// Only keep the allowed groups, Entra tokens can list hundreds and the cookie is limited to 4KB
+	groups = slices.DeleteFunc(groups, func(group string) bool {
+		return !slices.Contains(a.cfg.AllowedGroups, group)
+	})
+	return &AdminSession{
+		Subject: claims.Subject,
+		Email:   claims.Email,
+		Name:    claims.Name,
+		Groups:  groups,
+	}, nil
+}
+
+// allowed checks the identity against OIDC_ALLOWED_GROUPS and OIDC_ALLOWED_DOMAINS
+func (a *OIDCAuth) allowed(claims idTokenClaims, groups []string) bool {
+	for _, group := range groups {
+		if slices.Contains(a.cfg.AllowedGroups, group) {
+			return true
+		}
+	}
+
+	domain := claims.HostedDomain
+	if domain == "" && claims.EmailVerified != nil && *claims.EmailVerified {
+		if _, after, ok := strings.Cut(claims.Email, "@"); ok {
+			domain = after
+		}
+	}
+	return domain != "" && slices.ContainsFunc(a.cfg.AllowedDomains, func(allowed string) bool {
+		return strings.EqualFold(allowed, domain)
+	})
+}
+
+// signingKey returns the issuer key for kid, refetching the JWKS when the key
+// is unknown (key rotation)
+func (a *OIDCAuth) signingKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(a.keysFetched) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown ID token key %q", kid)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := a.getJSON(ctx, a.provider.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	a.keysFetched = time.Now()
+
+	a.keys = make(map[string]*rsa.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		a.keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown ID token key %q", kid)
+}
+
+func (a *OIDCAuth) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// setSignedCookie stores v as base64(JSON).base64(HMAC-SHA256) in an HttpOnly cookie
+func (a *OIDCAuth) setSignedCookie(w http.ResponseWriter, name string, v any, ttl time.Duration) {
+	payload, _ := json.Marshal(v)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    encoded + "." + a.sign(name, encoded),
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   a.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// readSignedCookie verifies and decodes a cookie written by setSignedCookie
+func (a *OIDCAuth) readSignedCookie(r *http.Request, name string, v any) bool {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return false
+	}
+	encoded, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(a.sign(name, encoded))) {
+		return false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(payload, v) == nil
+}
+
+func (a *OIDCAuth) clearCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Path: "/", MaxAge: -1, HttpOnly: true, Secure: a.secure})
+}
+
+// sign MACs the cookie name with its value so one cookie can't be replayed as another
+func (a *OIDCAuth) sign(name, value string) string {
+	mac := hmac.New(sha256.New, []byte(a.cfg.SessionSecret))
+	mac.Write([]byte(name + "=" + value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// AdminMiddleware lets a request through with a valid OIDC session or, for
+// automation, the static admin API key. oidc and apiKey may each be unset.
+// Either way the client must connect from allowedIPs, if set; forwarded
+// client IP headers only count from trusted proxies.
+func AdminMiddleware(apiKey string, allowedIPs []string, oidc *OIDCAuth) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		var keyAuth http.Handler
+		if apiKey != "" {
+			keyAuth = AuthMiddleware([]string{apiKey}, nil)(next)
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(allowedIPs) > 0 && !isIPAllowed(trustedClientIP(r), allowedIPs) {
+				writeAuthError(w, http.StatusForbidden, "IP address not allowed")
+				return
+			}
+			if oidc != nil {
+				if session, ok := oidc.Session(r); ok {
+					log.Printf("👤 Admin request %s %s by %s", r.Method, r.URL.Path, session.Email)
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			if keyAuth != nil && (r.Header.Get("X-API-Key") != "" || oidc == nil) {
+				keyAuth.ServeHTTP(w, r)
+				return
+			}
+			writeAuthError(w, http.StatusUnauthorized, "Login required, use /auth/login")
+		})
+	}
+}
+
+func writeAuthError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(UploadResponse{Success: false, Error: message})
+}
+
+// decodeJWTPart decodes a base64url JSON segment of a JWT
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// audienceContains handles both forms of the aud claim (string or array)
+func audienceContains(aud json.RawMessage, clientID string) bool {
+	var single string
+	if json.Unmarshal(aud, &single) == nil {
+		return single == clientID
+	}
+	var many []string
+	if json.Unmarshal(aud, &many) == nil {
+		return slices.Contains(many, clientID)
+	}
+	return false
+}
+
+// randomToken returns 32 random bytes, base64url encoded
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
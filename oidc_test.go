@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testOIDCAuth() *OIDCAuth {
+	return &OIDCAuth{cfg: OIDCConfig{SessionSecret: "0123456789abcdef0123456789abcdef", SessionTTL: time.Hour}}
+}
+
+// sessionCookie returns the cookie a login would set for session
+func sessionCookie(a *OIDCAuth, session AdminSession) *http.Cookie {
+	rec := httptest.NewRecorder()
+	a.setSignedCookie(rec, adminSessionCookie, session, time.Hour)
+	return rec.Result().Cookies()[0]
+}
+
+func TestAdminMiddlewareIgnoresForgedClientIP(t *testing.T) {
+	oidc := testOIDCAuth()
+	cookie := sessionCookie(oidc, AdminSession{Subject: "admin", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	handler := AdminMiddleware("admin-key", []string{"203.0.113.7"}, oidc)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		session    bool
+		want       int
+	}{
+		{"key from allowed IP", "203.0.113.7:1234", false, http.StatusNoContent},
+		{"session from allowed IP", "203.0.113.7:1234", true, http.StatusNoContent},
+		{"key with forged header", "198.51.100.9:1234", false, http.StatusForbidden},
+		{"session with forged header", "198.51.100.9:1234", true, http.StatusForbidden},
+		{"key through trusted proxy", "10.0.0.2:1234", false, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin/stats", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("X-Forwarded-For", "203.0.113.7")
+			if tt.session {
+				req.AddCookie(cookie)
+			} else {
+				req.Header.Set("X-API-Key", "admin-key")
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+// fakeIdP is an OIDC provider whose token endpoint, like a real one, only
+// redeems a code with the PKCE verifier of the login that obtained it
+type fakeIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]url.Values // code -> query of the authorization request
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIdP{key: key, codes: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcProvider{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", idp.handleToken)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *fakeIdP) handleToken(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	authorization, ok := idp.codes[r.PostFormValue("code")]
+	idp.mu.Unlock()
+	challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(challenge[:]) != authorization.Get("code_challenge") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": idp.idToken(map[string]any{
+		"iss":            idp.server.URL,
+		"sub":            "user-1",
+		"aud":            authorization.Get("client_id"),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"nonce":          authorization.Get("nonce"),
+		"email":          "admin@example.com",
+		"email_verified": true,
+	})})
+}
+
+// idToken signs claims as an RS256 JWT
+func (idp *fakeIdP) idToken(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// login starts a login and lets the user consent at the IdP. It returns the
+// state cookie and the callback query the IdP redirects back with.
+func (idp *fakeIdP) login(t *testing.T, a *OIDCAuth) (*http.Cookie, url.Values) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	a.HandleLogin(rec, httptest.NewRequest(http.MethodGet, "/auth/login", nil))
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(location.String(), idp.server.URL+"/authorize") {
+		t.Fatalf("login redirected to %q", rec.Header().Get("Location"))
+	}
+	authorization := location.Query()
+	code := randomToken()
+	idp.mu.Lock()
+	idp.codes[code] = authorization
+	idp.mu.Unlock()
+	return rec.Result().Cookies()[0], url.Values{"code": {code}, "state": {authorization.Get("state")}}
+}
+
+func newTestOIDCAuth(t *testing.T, idp *fakeIdP) *OIDCAuth {
+	t.Helper()
+	a, err := NewOIDCAuth(context.Background(), OIDCConfig{
+		Issuer:         idp.server.URL,
+		ClientID:       "gcb",
+		RedirectURL:    "https://images.example.com/auth/callback",
+		Scopes:         []string{"openid", "email"},
+		GroupsClaim:    "groups",
+		AllowedDomains: []string{"example.com"},
+		SessionSecret:  "0123456789abcdef0123456789abcdef",
+		SessionTTL:     time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// callback completes a login with the given state cookie and query
+func callback(a *OIDCAuth, cookie *http.Cookie, query url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/auth/callback?"+query.Encode(), nil)
+	req.AddCookie(cookie)
+	rec := httptest.NewRecorder()
+	a.HandleCallback(rec, req)
+	return rec
+}
+
+func TestOIDCCallback(t *testing.T) {
+	idp := newFakeIdP(t)
+	a := newTestOIDCAuth(t, idp)
+
+	t.Run("valid", func(t *testing.T) {
+		cookie, query := idp.login(t, a)
+		rec := callback(a, cookie, query)
+		if rec.Code != http.StatusFound {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		var session *http.Cookie
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == adminSessionCookie {
+				session = c
+			}
+		}
+		req := httptest.NewRequest(http.MethodGet, "/auth/me", nil)
+		req.AddCookie(session)
+		if got, ok := a.Session(req); !ok || got.Email != "admin@example.com" {
+			t.Errorf("session %+v, %v", got, ok)
+		}
+	})
+
+	t.Run("state mismatch", func(t *testing.T) {
+		cookie, query := idp.login(t, a)
+		query.Set("state", randomToken())
+		if rec := callback(a, cookie, query); rec.Code != http.StatusBadRequest {
+			t.Errorf("status %d, want 400", rec.Code)
+		}
+	})
+
+	t.Run("tampered state cookie", func(t *testing.T) {
+		cookie, query := idp.login(t, a)
+		encoded, signature, _ := strings.Cut(cookie.Value, ".")
+		payload, _ := base64.RawURLEncoding.DecodeString(encoded)
+		var state oidcState
+		json.Unmarshal(payload, &state)
+		state.State = "attacker"
+		payload, _ = json.Marshal(state)
+		cookie.Value = base64.RawURLEncoding.EncodeToString(payload) + "." + signature
+		query.Set("state", "attacker")
+		if rec := callback(a, cookie, query); rec.Code != http.StatusBadRequest {
+			t.Errorf("status %d, want 400", rec.Code)
+		}
+	})
+
+	t.Run("wrong PKCE verifier", func(t *testing.T) {
+		// A code obtained by another login, injected into this one
+		_, stolen := idp.login(t, a)
+		cookie, query := idp.login(t, a)
+		query.Set("code", stolen.Get("code"))
+		if rec := callback(a, cookie, query); rec.Code != http.StatusBadGateway {
+			t.Errorf("status %d, want 502", rec.Code)
+		}
+	})
+}
+
+func TestOIDCSession(t *testing.T) {
+	a := testOIDCAuth()
+	request := func(cookie *http.Cookie) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/auth/me", nil)
+		req.AddCookie(cookie)
+		return req
+	}
+
+	valid := sessionCookie(a, AdminSession{Subject: "admin", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	if _, ok := a.Session(request(valid)); !ok {
+		t.Fatal("valid session rejected")
+	}
+
+	expired := sessionCookie(a, AdminSession{Subject: "admin", ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+	if _, ok := a.Session(request(expired)); ok {
+		t.Error("expired session accepted")
+	}
+
+	// Extending the expiry of a valid cookie breaks its signature
+	_, signature, _ := strings.Cut(valid.Value, ".")
+	payload, _ := json.Marshal(AdminSession{Subject: "admin", ExpiresAt: time.Now().Add(24 * time.Hour).Unix()})
+	tampered := &http.Cookie{Name: adminSessionCookie, Value: base64.RawURLEncoding.EncodeToString(payload) + "." + signature}
+	if _, ok := a.Session(request(tampered)); ok {
+		t.Error("tampered session accepted")
+	}
+
+	// A state cookie can't be replayed as a session
+	rec := httptest.NewRecorder()
+	a.setSignedCookie(rec, oidcStateCookie, AdminSession{Subject: "admin", ExpiresAt: time.Now().Add(time.Hour).Unix()}, time.Hour)
+	replayed := rec.Result().Cookies()[0]
+	replayed.Name = adminSessionCookie
+	if _, ok := a.Session(request(replayed)); ok {
+		t.Error("state cookie accepted as a session")
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operation log entry kinds
+const (
+	OperationPut    = "put"    // a catalog record was added or replaced
+	OperationDelete = "delete" // a catalog record was removed
+	OperationEvent  = "event"  // an asset event was published
+)
+
+// Replay targets
+const (
+	ReplayMetadata = "metadata" // rebuild the catalog from the put and delete entries
+	ReplayEvents   = "events"   // deliver the logged events to the sinks again
+)
+
+// OperationEntry is one line of the operation log
+type OperationEntry struct {
+	Seq    int64        `json:"seq"`
+	Time   time.Time    `json:"time"`
+	Op     string       `json:"op"`
+	Record *AssetRecord `json:"record,omitempty"` // put and delete
+	Event  *AssetEvent  `json:"event,omitempty"`  // event
+}
+
+// OperationLog is an append-only JSONL history of every change to the catalog
+// and every published asset event. Unlike the metadata journal it is never
+// compacted, so the catalog can be rebuilt as of any point in time and events
+// can be delivered again after a downstream outage. All methods are safe on
+// a nil log.
+type OperationLog struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+	seq  int64
+}
+
+// operationLog is the process-wide operation log; nil when disabled
+var operationLog *OperationLog
+
+// OpenOperationLog opens the log at path for appending, continuing its
+// sequence. A new log starts with a put for every record of the catalog, so
+// it can rebuild assets stored before it existed.
+func OpenOperationLog(path string, store *MetadataStore) (*OperationLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create operation log directory: %w", err)
+	}
+
+	l := &OperationLog{path: path}
+	err := l.Scan(func(entry OperationEntry) error {
+		l.seq = max(l.seq, entry.Seq)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open operation log: %w", err)
+	}
+	l.file = file
+	if l.seq == 0 {
+		if err := l.seed(store); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to seed operation log: %w", err)
+		}
+	}
+	return l, nil
+}
+
+// Append numbers and timestamps an entry and writes it to the log
+func (l *OperationLog) Append(entry OperationEntry) error {
+	if l == nil {
+		return nil
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry.Seq = l.seq + 1
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write operation log: %w", err)
+	}
+	l.seq = entry.Seq
+	return nil
+}
+
+// seed logs a put for every record of the catalog, oldest first
+func (l *OperationLog) seed(store *MetadataStore) error {
+	if store == nil {
+		return nil
+	}
+	store.mu.RLock()
+	records := make([]AssetRecord, 0, len(store.records))
+	for _, record := range store.records {
+		records = append(records, record)
+	}
+	store.mu.RUnlock()
+
+	sort.Slice(records, func(i, j int) bool { return records[i].CreatedAt.Before(records[j].CreatedAt) })
+	for i := range records {
+		if err := l.Append(OperationEntry{Op: OperationPut, Record: &records[i], Time: records[i].CreatedAt}); err != nil {
+			return err
+		}
+	}
+	if len(records) > 0 {
+		log.Printf("🔁 Operation log started with %d existing asset(s)", len(records))
+	}
+	return nil
+}
+
+// Scan calls fn for every entry of the log, oldest first
+func (l *OperationLog) Scan(fn func(OperationEntry) error) error {
+	if l == nil {
+		return nil
+	}
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open operation log: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var entry OperationEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn final write after a crash only loses that one entry
+			log.Printf("⚠️  Skipping corrupt operation log line %d: %v", line, err)
+			continue
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Close flushes and closes the log
+func (l *OperationLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// ReplayOptions selects what a replay covers. Zero times leave the range open.
+type ReplayOptions struct {
+	Target string
+	Since  time.Time // events only
+	Until  time.Time
+	Types  []string // event types, empty for all
+	Bucket string   // events only, empty for all
+	Sinks  []string // sinks to deliver to, empty for all
+}
+
+// ReplayStatus reports the progress of a replay
+type ReplayStatus struct {
+	Target     string    `json:"target"`
+	Running    bool      `json:"running"`
+	Matched    int64     `json:"matched"`  // log entries the replay covers
+	Replayed   int64     `json:"replayed"` // records restored or events delivered
+	Failed     int64     `json:"failed"`   // events a sink failed on
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt,omitzero"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// replayer runs one replay at a time in the background
+type replayer struct {
+	mu     sync.Mutex
+	status *ReplayStatus
+}
+
+var errReplayRunning = errors.New("a replay is already running")
+
+// start begins a replay unless one is running
+func (rp *replayer) start(oplog *OperationLog, bus *EventBus, opts ReplayOptions) error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.status != nil && rp.status.Running {
+		return errReplayRunning
+	}
+	status := &ReplayStatus{Target: opts.Target, Running: true, StartedAt: time.Now().UTC()}
+	rp.status = status
+
+	go func() {
+		var err error
+		if opts.Target == ReplayMetadata {
+			err = rp.replayMetadata(oplog, opts, status)
+		} else {
+			err = rp.replayEvents(oplog, bus, opts, status)
+		}
+
+		rp.mu.Lock()
+		status.Running = false
+		status.FinishedAt = time.Now().UTC()
+		if err != nil {
+			status.Error = err.Error()
+		}
+		rp.mu.Unlock()
+		log.Printf("🔁 Replay of %s finished: %d matched, %d replayed, %d failed", opts.Target, status.Matched, status.Replayed, status.Failed)
+	}()
+	return nil
+}
+
+// snapshot returns a copy of the current or last replay's status
+func (rp *replayer) snapshot() *ReplayStatus {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.status == nil {
+		return nil
+	}
+	status := *rp.status
+	return &status
+}
+
+// replayMetadata rebuilds the catalog as of opts.Until and replaces the live one
+func (rp *replayer) replayMetadata(oplog *OperationLog, opts ReplayOptions, status *ReplayStatus) error {
+	records := map[string]AssetRecord{}
+	var matched int64
+	err := oplog.Scan(func(entry OperationEntry) error {
+		if entry.Record == nil || (!opts.Until.IsZero() && entry.Time.After(opts.Until)) {
+			return nil
+		}
+		key := metadataKey(entry.Record.Bucket, entry.Record.Name)
+		switch entry.Op {
+		case OperationPut:
+			records[key] = *entry.Record
+		case OperationDelete:
+			delete(records, key)
+		default:
+			return nil
+		}
+		matched++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := metadataStore.Replace(records); err != nil {
+		return err
+	}
+
+	rp.mu.Lock()
+	status.Matched, status.Replayed = matched, int64(len(records))
+	rp.mu.Unlock()
+	return nil
+}
+
+// replayEvents delivers the logged events in range to the selected sinks,
+// in order and in the background of the running service
+func (rp *replayer) replayEvents(oplog *OperationLog, bus *EventBus, opts ReplayOptions, status *ReplayStatus) error {
+	return oplog.Scan(func(entry OperationEntry) error {
+		event := entry.Event
+		if entry.Op != OperationEvent || event == nil ||
+			(!opts.Since.IsZero() && entry.Time.Before(opts.Since)) ||
+			(!opts.Until.IsZero() && entry.Time.After(opts.Until)) ||
+			(len(opts.Types) > 0 && !slices.Contains(opts.Types, event.Type)) ||
+			(opts.Bucket != "" && event.Bucket != opts.Bucket) {
+			return nil
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := bus.DeliverTo(ctx, *event, opts.Sinks)
+		cancel()
+
+		rp.mu.Lock()
+		status.Matched++
+		if err != nil {
+			status.Failed++
+		} else {
+			status.Replayed++
+		}
+		rp.mu.Unlock()
+		return nil
+	})
+}
+
+// ReplayResponse is returned by the replay endpoint
+type ReplayResponse struct {
+	Success bool          `json:"success"`
+	Status  *ReplayStatus `json:"status,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// HandleReplay serves the replay tool:
+//   - GET /admin/replay returns the status of the current or last replay
+//   - POST /admin/replay?target=metadata[&until=] rebuilds the catalog from
+//     the log, as of until (RFC 3339) when given
+//   - POST /admin/replay?target=events[&since=&until=&type=&bucket=&sink=]
+//     delivers the logged events again, e.g. sink=notifier after an outage
+//     of the webhook receiver; type and sink are comma-separated
+func HandleReplay(oplog *OperationLog, bus *EventBus) http.HandlerFunc {
+	rp := &replayer{}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(ReplayResponse{Success: true, Status: rp.snapshot()})
+
+		case http.MethodPost:
+			opts, err := parseReplayOptions(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(ReplayResponse{Success: false, Error: err.Error()})
+				return
+			}
+			for _, name := range opts.Sinks {
+				if !bus.HasSink(name) {
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(ReplayResponse{Success: false, Error: fmt.Sprintf("unknown event sink %q", name)})
+					return
+				}
+			}
+			if err := rp.start(oplog, bus, opts); err != nil {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(ReplayResponse{Success: false, Error: err.Error()})
+				return
+			}
+			log.Printf("🔁 Replay of %s requested through the admin API", opts.Target)
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(ReplayResponse{Success: true, Status: rp.snapshot()})
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(ReplayResponse{
+				Success: false,
+				Error:   "Method not allowed. Use GET or POST.",
+			})
+		}
+	}
+}
+
+// parseReplayOptions reads the replay parameters of a request
+func parseReplayOptions(r *http.Request) (ReplayOptions, error) {
+	query := r.URL.Query()
+	opts := ReplayOptions{
+		Target: query.Get("target"),
+		Types:  splitQueryList(query.Get("type")),
+		Bucket: query.Get("bucket"),
+		Sinks:  splitQueryList(query.Get("sink")),
+	}
+	if opts.Target != ReplayMetadata && opts.Target != ReplayEvents {
+		return opts, fmt.Errorf("target must be %s or %s", ReplayMetadata, ReplayEvents)
+	}
+	for name, dst := range map[string]*time.Time{"since": &opts.Since, "until": &opts.Until} {
+		if value := query.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return opts, fmt.Errorf("%s must be an RFC 3339 time", name)
+			}
+			*dst = t
+		}
+	}
+	if opts.Target == ReplayMetadata && (!opts.Since.IsZero() || opts.Bucket != "" || len(opts.Types) > 0 || len(opts.Sinks) > 0) {
+		return opts, errors.New("a metadata replay only takes until")
+	}
+	return opts, nil
+}
+
+// splitQueryList splits a comma-separated query parameter, dropping empty items
+func splitQueryList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"log"
+)
+
+// OrientOptions controls auto-orientation of JPEG uploads
+type OrientOptions struct {
+	JPEGQuality int // quality of rotated JPEGs
+	MaxPixels   int // photos larger than this are stored unrotated
+}
+
+// exifOrientationTag is the TIFF tag holding the EXIF orientation
+const exifOrientationTag = 0x0112
+
+// exifSignature prefixes EXIF data in JPEG APP1 segments
+var exifSignature = []byte("Exif\x00\x00")
+
+// exifOrientation returns the orientation (1-8) of an APP1 EXIF payload and
+// the offset of its value within the payload, or 0 when it has none
+func exifOrientation(payload []byte) (int, int) {
+	if !bytes.HasPrefix(payload, exifSignature) {
+		return 0, 0
+	}
+	tiff := payload[len(exifSignature):]
+	if len(tiff) < 8 {
+		return 0, 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, 0
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0, 0
+	}
+	count := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			return 0, 0
+		}
+		if order.Uint16(tiff[entry:entry+2]) != exifOrientationTag {
+			continue
+		}
+		// SHORT values are stored in the first two bytes of the value field
+		orientation := int(order.Uint16(tiff[entry+8 : entry+10]))
+		if orientation < 1 || orientation > 8 {
+			return 0, 0
+		}
+		return orientation, len(exifSignature) + entry + 8
+	}
+	return 0, 0
+}
+
+// autoOrient rotates and flips the pixels of a JPEG as its EXIF orientation
+// says and resets the tag to 1, so viewers that ignore EXIF show the photo
+// upright. EXIF and ICC segments are carried over to the rotated file. Photos
+// without an orientation, or that can't be rotated, are returned as they are.
+func autoOrient(data []byte, ext string, opts OrientOptions) []byte {
+	if ext != ".jpg" && ext != ".jpeg" {
+		return data
+	}
+
+	orientation := 0
+	var exif []byte
+	var kept [][]byte // APP1 EXIF and APP2 ICC segments, marker included
+	walkJPEGSegments(data, func(marker byte, payload []byte) {
+		if marker != 0xE1 && marker != 0xE2 {
+			return
+		}
+		segment := make([]byte, 4, 4+len(payload))
+		segment[0], segment[1] = 0xFF, marker
+		binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+		segment = append(segment, payload...)
+		if marker == 0xE1 && exif == nil {
+			if value, offset := exifOrientation(payload); value != 0 {
+				orientation, exif = value, segment
+				// Reset the tag in the copy; its byte order matches the value
+				if segment[4+len(exifSignature)] == 'I' {
+					binary.LittleEndian.PutUint16(segment[4+offset:], 1)
+				} else {
+					binary.BigEndian.PutUint16(segment[4+offset:], 1)
+				}
+			}
+		}
+		kept = append(kept, segment)
+	})
+	if orientation <= 1 {
+		return data
+	}
+
+	rotated, err := orientJPEG(data, orientation, opts)
+	if err != nil {
+		log.Printf("⚠️  Failed to auto-orient image: %v", err)
+		return data
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(rotated)+len(data)/8))
+	out.Write(rotated[:2]) // SOI
+	for _, segment := range kept {
+		out.Write(segment)
+	}
+	out.Write(rotated[2:])
+	return out.Bytes()
+}
+
+// orientJPEG decodes a JPEG, applies an EXIF orientation and encodes it again
+func orientJPEG(data []byte, orientation int, opts OrientOptions) ([]byte, error) {
+	config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.ColorModel == color.CMYKModel {
+		// The encoder only writes RGB and gray, which would lose CMYK colors
+		return nil, fmt.Errorf("CMYK JPEGs are not rotated")
+	}
+	if opts.MaxPixels > 0 && config.Width*config.Height > opts.MaxPixels {
+		return nil, fmt.Errorf("%dx%d exceeds the limit of %d pixels", config.Width, config.Height, opts.MaxPixels)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	var out draw.Image = image.NewRGBA(image.Rect(0, 0, dw, dh))
+	if _, ok := img.(*image.Gray); ok {
+		out = image.NewGray(image.Rect(0, 0, dw, dh))
+	}
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored upside down
+				sx, sy = x, h-1-y
+			case 5: // mirrored, rotated 90° counter-clockwise
+				sx, sy = y, x
+			case 6: // rotated 90° counter-clockwise, so turn clockwise
+				sx, sy = y, h-1-x
+			case 7: // mirrored, rotated 90° clockwise
+				sx, sy = w-1-y, h-1-x
+			case 8: // rotated 90° clockwise, so turn counter-clockwise
+				sx, sy = w-1-y, x
+			}
+			out.Set(x, y, img.At(bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, out, &jpeg.Options{Quality: opts.JPEGQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"log"
+	"os"
+	"testing"
+)
+
+// testEXIF builds an APP1 EXIF payload with an orientation tag in the given
+// byte order ("II" or "MM"), after one unrelated tag
+func testEXIF(byteOrder string, orientation uint16) []byte {
+	var order binary.AppendByteOrder = binary.BigEndian
+	if byteOrder == "II" {
+		order = binary.LittleEndian
+	}
+	tiff := []byte(byteOrder)
+	tiff = order.AppendUint16(tiff, 42)
+	tiff = order.AppendUint32(tiff, 8) // first IFD
+	tiff = order.AppendUint16(tiff, 2) // entries
+	// ImageDescription, ASCII, pointing nowhere in particular
+	tiff = order.AppendUint16(tiff, 0x010E)
+	tiff = order.AppendUint16(tiff, 2)
+	tiff = order.AppendUint32(tiff, 1)
+	tiff = order.AppendUint32(tiff, 0)
+	// Orientation, SHORT, 1 value
+	tiff = order.AppendUint16(tiff, exifOrientationTag)
+	tiff = order.AppendUint16(tiff, 3)
+	tiff = order.AppendUint32(tiff, 1)
+	tiff = order.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0)
+	tiff = order.AppendUint32(tiff, 0) // no next IFD
+	return append(bytes.Clone(exifSignature), tiff...)
+}
+
+// testOrientedJPEG encodes a 16x8 JPEG, red on the left half and blue on the
+// right, with an EXIF orientation
+func testOrientedJPEG(t *testing.T, orientation uint16) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for x := range 16 {
+		for y := range 8 {
+			c := color.RGBA{255, 0, 0, 255}
+			if x >= 8 {
+				c = color.RGBA{0, 0, 255, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	payload := testEXIF("MM", orientation)
+	out := append(bytes.Clone(encoded[:2]), 0xFF, 0xE1)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(payload)+2))
+	out = append(out, payload...)
+	return append(out, encoded[2:]...)
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG, 0 without one
+func jpegOrientation(data []byte) int {
+	orientation := 0
+	walkJPEGSegments(data, func(marker byte, payload []byte) {
+		if marker == 0xE1 && orientation == 0 {
+			orientation, _ = exifOrientation(payload)
+		}
+	})
+	return orientation
+}
+
+func TestEXIFOrientation(t *testing.T) {
+	for _, order := range []string{"II", "MM"} {
+		for orientation := uint16(1); orientation <= 8; orientation++ {
+			payload := testEXIF(order, orientation)
+			got, offset := exifOrientation(payload)
+			if got != int(orientation) {
+				t.Errorf("%s %d: orientation = %d", order, orientation, got)
+				continue
+			}
+			if value := payload[offset : offset+2]; binary.BigEndian.Uint16(value) != orientation && binary.LittleEndian.Uint16(value) != orientation {
+				t.Errorf("%s %d: offset %d points at % x", order, orientation, offset, value)
+			}
+		}
+	}
+}
+
+func TestEXIFOrientationMalformed(t *testing.T) {
+	valid := testEXIF("II", 6)
+	// patch returns a copy of valid with its TIFF data changed
+	patch := func(put func(tiff []byte)) []byte {
+		p := bytes.Clone(valid)
+		put(p[len(exifSignature):])
+		return p
+	}
+	tests := map[string][]byte{
+		"no signature":     valid[len(exifSignature):],
+		"unknown order":    patch(func(tiff []byte) { copy(tiff, "XX") }),
+		"orientation 0":    testEXIF("II", 0),
+		"orientation 9":    testEXIF("MM", 9),
+		"IFD before TIFF":  patch(func(tiff []byte) { binary.LittleEndian.PutUint32(tiff[4:], 4) }),
+		"IFD past the end": patch(func(tiff []byte) { binary.LittleEndian.PutUint32(tiff[4:], 1<<32-1) }),
+		"entries past end": patch(func(tiff []byte) {
+			binary.LittleEndian.PutUint16(tiff[8:], 1<<16-1)
+			binary.LittleEndian.PutUint16(tiff[22:], 0x0111) // no orientation among the real entries
+		}),
+	}
+	for name, payload := range tests {
+		if got, _ := exifOrientation(payload); got != 0 {
+			t.Errorf("%s: orientation = %d, want 0", name, got)
+		}
+	}
+
+	for n := range len(valid) {
+		got, offset := exifOrientation(valid[:n])
+		if got != 0 && offset+2 > n {
+			t.Errorf("%d bytes: offset %d past the end", n, offset)
+		}
+	}
+}
+
+func TestAutoOrient(t *testing.T) {
+	data := testOrientedJPEG(t, 6)
+	rotated := autoOrient(data, ".jpg", OrientOptions{JPEGQuality: 95, MaxPixels: 1 << 20})
+
+	img, err := jpeg.Decode(bytes.NewReader(rotated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(8, 16) {
+		t.Fatalf("rotated size = %v, want 8x16", size)
+	}
+	// Turned clockwise, the left (red) half is on top
+	if r, _, b, _ := img.At(4, 3).RGBA(); r < b {
+		t.Errorf("top is not red: r=%d b=%d", r>>8, b>>8)
+	}
+	if r, _, b, _ := img.At(4, 12).RGBA(); b < r {
+		t.Errorf("bottom is not blue: r=%d b=%d", r>>8, b>>8)
+	}
+	if got := jpegOrientation(rotated); got != 1 {
+		t.Errorf("orientation after rotating = %d, want 1", got)
+	}
+}
+
+func TestAutoOrientUnchanged(t *testing.T) {
+	opts := OrientOptions{JPEGQuality: 95, MaxPixels: 1 << 20}
+	upright := testOrientedJPEG(t, 1)
+	if got := autoOrient(upright, ".jpg", opts); !bytes.Equal(got, upright) {
+		t.Error("upright JPEG was re-encoded")
+	}
+	rotated := testOrientedJPEG(t, 6)
+	if got := autoOrient(rotated, ".png", opts); !bytes.Equal(got, rotated) {
+		t.Error("non-JPEG extension was re-encoded")
+	}
+	if got := autoOrient(rotated, ".jpg", OrientOptions{JPEGQuality: 95, MaxPixels: 100}); !bytes.Equal(got, rotated) {
+		t.Error("JPEG over MaxPixels was re-encoded")
+	}
+}
+
+func TestAutoOrientTruncated(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	data := testOrientedJPEG(t, 8)
+	opts := OrientOptions{JPEGQuality: 90, MaxPixels: 1 << 20}
+	for n := range len(data) {
+		autoOrient(data[:n], ".jpg", opts)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// defaultSimilarityThreshold is the Hamming distance (out of 64 bits) below
+// which two images count as near-duplicates. Re-encodes and resizes usually
+// stay under 5, visually different images are typically above 20.
+const defaultSimilarityThreshold = 10
+
+// maxSimilarResults caps the matches returned by the similar endpoint
+const maxSimilarResults = 100
+
+// dHashSamples bounds the pixels sampled per axis, so hashing a 50MP image
+// costs about as much as a thumbnail
+const dHashSamples = 256
+
+// perceptualHash returns the 64-bit difference hash (dHash) of an encoded
+// image as 16 hex digits, or "" when the format can't be decoded. The image is
+// reduced to 9x8 grayscale cells and each bit records whether a cell is
+// darker than its right neighbour, which survives resizing and re-encoding.
+// Decoding allocates the whole bitmap, so images over maxPixels (a small PNG
+// or GIF can declare gigapixels) aren't hashed.
+func perceptualHash(data []byte, maxPixels int) string {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || maxPixels <= 0 || config.Width*config.Height > maxPixels {
+		return ""
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return ""
+	}
+	stepX, stepY := max(1, width/dHashSamples), max(1, height/dHashSamples)
+
+	var sum [8][9]float64
+	var count [8][9]int
+	for y := 0; y < height; y += stepY {
+		cy := y * 8 / height
+		for x := 0; x < width; x += stepX {
+			cx := x * 9 / width
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			sum[cy][cx] += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			count[cy][cx]++
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := sum[y][x] / float64(max(1, count[y][x]))
+			right := sum[y][x+1] / float64(max(1, count[y][x+1]))
+			hash <<= 1
+			if left < right {
+				hash |= 1
+			}
+		}
+	}
+	return fmt.Sprintf("%016x", hash)
+}
+
+// hashDistance returns the Hamming distance between two perceptual hashes,
+// or -1 when either is missing or malformed
+func hashDistance(a, b string) int {
+	x, errA := strconv.ParseUint(a, 16, 64)
+	y, errB := strconv.ParseUint(b, 16, 64)
+	if errA != nil || errB != nil {
+		return -1
+	}
+	return bits.OnesCount64(x ^ y)
+}
+
+// SimilarObject is a near-duplicate of the requested object
+type SimilarObject struct {
+	AssetRecord
+	Distance int `json:"distance"`
+}
+
+// SimilarResponse lists the near-duplicates of an object
+type SimilarResponse struct {
+	Object    string          `json:"object"`
+	Hash      string          `json:"hash"`
+	Threshold int             `json:"threshold"`
+	Similar   []SimilarObject `json:"similar"`
+}
+
+// HandleSimilar serves GET /objects/{name}/similar?threshold= from the
+// perceptual hashes in the metadata store, closest matches first
+func HandleSimilar(backend Backend, mountPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "Method not allowed. Use GET.",
+			})
+			return
+		}
+
+		name, ok := objectPathName(r, mountPath, "/similar")
+		if !ok || name == "" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Not found. Use %s{name}/similar", mountPath),
+			})
+			return
+		}
+
+		threshold := defaultSimilarityThreshold
+		if value := r.URL.Query().Get("threshold"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || n > 64 {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   "threshold must be between 0 and 64",
+				})
+				return
+			}
+			threshold = n
+		}
+
+		record, ok := metadataStore.Get(backend.Bucket(), name)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "Object not found in the metadata store",
+			})
+			return
+		}
+		if record.PHash == "" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "Object has no perceptual hash (format not supported or uploaded before hashing was enabled)",
+			})
+			return
+		}
+
+		similar := []SimilarObject{}
+		metadataStore.List(backend.Bucket(), "", func(candidate AssetRecord) error {
+			if candidate.Name == record.Name || isQuarantineRecord(candidate) {
+				return nil
+			}
+			if distance := hashDistance(record.PHash, candidate.PHash); distance >= 0 && distance <= threshold {
+				similar = append(similar, SimilarObject{AssetRecord: candidate, Distance: distance})
+			}
+			return nil
+		})
+		sort.SliceStable(similar, func(i, j int) bool { return similar[i].Distance < similar[j].Distance })
+		if len(similar) > maxSimilarResults {
+			similar = similar[:maxSimilarResults]
+		}
+
+		json.NewEncoder(w).Encode(SimilarResponse{
+			Object:    record.Name,
+			Hash:      record.PHash,
+			Threshold: threshold,
+			Similar:   similar,
+		})
+	}
+}
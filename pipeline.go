@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// Pipeline phases, run in this order whatever the order of the stages
+const (
+	PhaseValidate  = "validate"  // inspect the file and reject it before anything is stored
+	PhaseTransform = "transform" // rewrite the content before it is stored
+	PhasePersist   = "persist"   // derive data and renditions from the stored object
+	PhaseNotify    = "notify"    // announce the registered asset
+)
+
+// Stage error policies
+const (
+	OnErrorFail     = "fail"     // reject the upload, removing what was already stored
+	OnErrorContinue = "continue" // log, count and carry on with the next stage
+)
+
+// errStageTimeout is returned when a stage that fails the upload overruns its timeout
+var errStageTimeout = errors.New("processing took too long")
+
+// Stage is one step of the processing pipeline that every ingested file goes
+// through (uploads, imports). Validate, transform and persist stages read
+// job.Data, so a file is buffered in memory when one of them applies and
+// streamed straight to storage otherwise.
+type Stage interface {
+	Name() string
+	Phase() string
+	// Applies reports whether the stage has work for the file. It is called
+	// before the content is read, so it may only look at the options.
+	Applies(job *PipelineJob) bool
+	Run(ctx context.Context, job *PipelineJob) error
+}
+
+// PipelineJob is a file moving through the pipeline. Stages work on a copy
+// that is taken over when they finish in time, so they must replace fields
+// (Data, Record.Metadata, ...) rather than modify them in place.
+type PipelineJob struct {
+	Options IngestOptions
+	Backend Backend
+	Ext     string // lowercased extension of Options.Filename
+	Data    []byte // buffered content; transform stages replace it
+	Poster  []byte // first-frame poster rendered while validating
+
+	// Set before the persist phase
+	Info   *ObjectInfo
+	Record AssetRecord
+}
+
+// StageConfig places a stage in a pipeline. The timeout and error policy
+// default to the stage's phase: validate and transform stages fail the
+// upload, persist and notify stages log and continue.
+type StageConfig struct {
+	Stage          string `json:"stage"`
+	TimeoutSeconds int    `json:"timeoutSeconds,omitempty"` // 0 runs without a timeout
+	OnError        string `json:"onError,omitempty"`        // fail or continue
+}
+
+// PipelineFile configures which stages run, in which order. A bucket entry
+// replaces the default pipeline for that bucket, a profile (chosen by a
+// collection, see collections.go) replaces both, and a tenant entry replaces
+// all of them for that tenant. Without a default, every built-in stage runs
+// in the order of builtinStages, followed by the plugins.
+type PipelineFile struct {
+	Plugins  map[string]PluginConfig  `json:"plugins,omitempty"` // external command stages by name, see plugin.go
+	Default  []StageConfig            `json:"default,omitempty"`
+	Buckets  map[string][]StageConfig `json:"buckets,omitempty"`
+	Profiles map[string][]StageConfig `json:"profiles,omitempty"`
+	Tenants  map[string][]StageConfig `json:"tenants,omitempty"`
+}
+
+// pipelineStage is a stage with its resolved settings
+type pipelineStage struct {
+	Stage
+	timeout time.Duration
+	onError string
+}
+
+// Pipelines resolves the pipeline of a bucket and tenant
+type Pipelines struct {
+	defaults []pipelineStage
+	buckets  map[string][]pipelineStage
+	profiles map[string][]pipelineStage
+	tenants  map[string][]pipelineStage
+}
+
+// processingPipelines is the process-wide pipeline configuration; nil runs
+// the built-in pipeline
+var processingPipelines *Pipelines
+
+// LoadPipelines reads the pipeline configuration from a JSON file, e.g.
+//
+//	{"default": [{"stage": "animation"}, {"stage": "reencode", "timeoutSeconds": 10}, {"stage": "event"}],
+//	 "tenants": {"acme": [{"stage": "phash", "onError": "fail"}, {"stage": "event"}]}}
+//
+// An empty path runs the built-in pipeline everywhere.
+func LoadPipelines(path string) (*Pipelines, error) {
+	var file PipelineFile
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pipeline config: %w", err)
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("failed to parse pipeline config %s: %w", path, err)
+		}
+	}
+
+	available := slices.Clone(builtinStages)
+	names := make([]string, 0, len(file.Plugins))
+	for name := range file.Plugins {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		stage, err := newCommandStage(name, file.Plugins[name])
+		if err != nil {
+			return nil, err
+		}
+		available = append(available, stage)
+	}
+
+	p := &Pipelines{buckets: map[string][]pipelineStage{}, profiles: map[string][]pipelineStage{}, tenants: map[string][]pipelineStage{}}
+	var err error
+	if file.Default == nil {
+		p.defaults = defaultPipeline(available)
+	} else if p.defaults, err = resolveStages(file.Default, available, "default"); err != nil {
+		return nil, err
+	}
+	for bucket, stages := range file.Buckets {
+		if p.buckets[bucket], err = resolveStages(stages, available, "bucket "+bucket); err != nil {
+			return nil, err
+		}
+	}
+	for profile, stages := range file.Profiles {
+		if p.profiles[profile], err = resolveStages(stages, available, "profile "+profile); err != nil {
+			return nil, err
+		}
+	}
+	for tenant, stages := range file.Tenants {
+		if p.tenants[tenant], err = resolveStages(stages, available, "tenant "+tenant); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// defaultPipeline runs every available stage with the defaults of its phase
+func defaultPipeline(available []Stage) []pipelineStage {
+	stages := make([]pipelineStage, 0, len(available))
+	for _, stage := range available {
+		stages = append(stages, pipelineStage{Stage: stage, onError: defaultOnError(stage.Phase())})
+	}
+	return stages
+}
+
+// defaultOnError returns the error policy of stages that don't set one
+func defaultOnError(phase string) string {
+	if phase == PhaseValidate || phase == PhaseTransform {
+		return OnErrorFail
+	}
+	return OnErrorContinue
+}
+
+// resolveStages checks the stage configs of one pipeline and looks up their stages
+func resolveStages(configs []StageConfig, available []Stage, scope string) ([]pipelineStage, error) {
+	stages := make([]pipelineStage, 0, len(configs))
+	var seen []string
+	for _, cfg := range configs {
+		i := slices.IndexFunc(available, func(s Stage) bool { return s.Name() == cfg.Stage })
+		if i < 0 {
+			return nil, fmt.Errorf("pipeline %s: unknown stage %q", scope, cfg.Stage)
+		}
+		if slices.Contains(seen, cfg.Stage) {
+			return nil, fmt.Errorf("pipeline %s: stage %s is listed twice", scope, cfg.Stage)
+		}
+		seen = append(seen, cfg.Stage)
+
+		stage := pipelineStage{
+			Stage:   available[i],
+			timeout: time.Duration(cfg.TimeoutSeconds) * time.Second,
+			onError: cfg.OnError,
+		}
+		switch {
+		case cfg.TimeoutSeconds < 0:
+			return nil, fmt.Errorf("pipeline %s: stage %s has a negative timeout", scope, cfg.Stage)
+		case stage.onError == "":
+			stage.onError = defaultOnError(stage.Phase())
+		case stage.onError != OnErrorFail && stage.onError != OnErrorContinue:
+			return nil, fmt.Errorf("pipeline %s: stage %s: onError must be %s or %s", scope, cfg.Stage, OnErrorFail, OnErrorContinue)
+		case stage.onError == OnErrorFail && stage.Phase() == PhaseNotify:
+			// The asset is registered by then, so there is nothing left to fail
+			return nil, fmt.Errorf("pipeline %s: notify stage %s can't fail the upload", scope, cfg.Stage)
+		}
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
+// For returns the stages that run for uploads of a tenant to a bucket, with
+// the processing profile of the collection uploaded to ("" for none)
+func (p *Pipelines) For(bucket, tenant, profile string) []pipelineStage {
+	if p == nil {
+		return defaultPipeline(builtinStages)
+	}
+	if stages, ok := p.tenants[tenant]; ok && tenant != "" {
+		return stages
+	}
+	if stages, ok := p.profiles[profile]; ok && profile != "" {
+		return stages
+	}
+	if stages, ok := p.buckets[bucket]; ok {
+		return stages
+	}
+	return p.defaults
+}
+
+// HasProfile reports whether a processing profile is configured
+func (p *Pipelines) HasProfile(profile string) bool {
+	if p == nil {
+		return false
+	}
+	_, ok := p.profiles[profile]
+	return ok
+}
+
+// needsContent reports whether a stage reading the content applies to the job
+func needsContent(job *PipelineJob, stages []pipelineStage) bool {
+	for _, stage := range stages {
+		if stage.Phase() != PhaseNotify && stage.Applies(job) {
+			return true
+		}
+	}
+	return false
+}
+
+// runPhase runs the stages of a phase that apply to the job, in order
+func runPhase(ctx context.Context, job *PipelineJob, stages []pipelineStage, phase string) error {
+	for _, stage := range stages {
+		if stage.Phase() != phase || !stage.Applies(job) {
+			continue
+		}
+		if err := runStage(ctx, job, stage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runStage runs one stage on a copy of the job within its timeout. A stage
+// that overruns is abandoned: it keeps running in the background but its
+// changes are discarded.
+func runStage(ctx context.Context, job *PipelineJob, stage pipelineStage) error {
+	parent := ctx
+	if stage.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, stage.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	work := *job
+	done := make(chan error, 1)
+	go func() { done <- stage.Run(ctx, &work) }()
+
+	var err error
+	select {
+	case err = <-done:
+		if err == nil {
+			*job = work
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+		if parent.Err() == nil {
+			err = fmt.Errorf("%w: %s stage exceeded %s", errStageTimeout, stage.Name(), stage.timeout)
+		}
+	}
+	pipelineStageDuration.WithLabelValues(stage.Name()).Observe(time.Since(start).Seconds())
+	if err == nil {
+		return nil
+	}
+
+	// A cancelled request and a plugin's verdict fail whatever the policy
+	var rejection *PluginRejection
+	if errors.As(err, &rejection) {
+		return err
+	}
+	pipelineStageErrorsTotal.WithLabelValues(stage.Name(), stage.onError).Inc()
+	if stage.onError == OnErrorFail || parent.Err() != nil {
+		return err
+	}
+	traceLogf(parent, "⚠️  Stage %s failed for %s, continuing: %v", stage.Name(), job.Options.Filename, err)
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPlaceholderSize caps placeholder images read from a bucket
+const maxPlaceholderSize = 1 << 20
+
+// placeholderRefreshInterval is how long a placeholder read from a bucket is
+// served before it is read again
+const placeholderRefreshInterval = 5 * time.Minute
+
+// defaultMissingPlaceholder is served for missing objects with MISSING_PLACEHOLDER=builtin
+const defaultMissingPlaceholder = `<svg xmlns="http://www.w3.org/2000/svg" width="320" height="180" viewBox="0 0 320 180">` +
+	`<rect width="320" height="180" fill="#f3f4f6"/>` +
+	`<text x="160" y="95" font-family="sans-serif" font-size="16" fill="#9ca3af" text-anchor="middle">Image not found</text>` +
+	`</svg>`
+
+// MissingPlaceholderConfig holds the image the download proxy serves for missing objects
+type MissingPlaceholderConfig struct {
+	// Source is "builtin", an image file, or "object:<name>" for an object of
+	// the bucket being downloaded from. Empty disables the placeholder.
+	Source string
+	MaxAge time.Duration // how long browsers and CDNs may cache the placeholder
+}
+
+// placeholderImage is a placeholder read from a bucket
+type placeholderImage struct {
+	data        []byte
+	contentType string
+	fetched     time.Time
+}
+
+// MissingPlaceholder answers downloads of missing objects with an image, so
+// broken references draw a neutral picture instead of the browser's broken
+// image icon. The status stays 404.
+type MissingPlaceholder struct {
+	data        []byte // fixed placeholder, nil when read from the bucket
+	contentType string
+	object      string
+	maxAge      time.Duration
+
+	mu      sync.Mutex
+	objects map[string]placeholderImage // by bucket
+}
+
+// NewMissingPlaceholder loads the placeholder; it returns nil when none is configured
+func NewMissingPlaceholder(cfg MissingPlaceholderConfig) (*MissingPlaceholder, error) {
+	placeholder := &MissingPlaceholder{maxAge: cfg.MaxAge}
+	switch {
+	case cfg.Source == "":
+		return nil, nil
+	case cfg.Source == "builtin":
+		placeholder.data, placeholder.contentType = []byte(defaultMissingPlaceholder), "image/svg+xml"
+	case strings.HasPrefix(cfg.Source, "object:"):
+		placeholder.object = strings.TrimPrefix(cfg.Source, "object:")
+		if placeholder.object == "" {
+			return nil, fmt.Errorf("missing placeholder %q names no object", cfg.Source)
+		}
+		placeholder.objects = make(map[string]placeholderImage)
+	default:
+		data, err := os.ReadFile(cfg.Source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read missing placeholder: %w", err)
+		}
+		placeholder.data = data
+		placeholder.contentType = getContentType(strings.ToLower(filepath.Ext(cfg.Source)))
+	}
+	return placeholder, nil
+}
+
+// image returns the placeholder for a bucket, reading it from the bucket
+// when it is an object. A placeholder that can't be read again is served
+// stale; ok is false when there is none.
+func (p *MissingPlaceholder) image(ctx context.Context, backend Backend) ([]byte, string, bool) {
+	if p.object == "" {
+		return p.data, p.contentType, true
+	}
+
+	p.mu.Lock()
+	cached, found := p.objects[backend.Bucket()]
+	p.mu.Unlock()
+	if found && time.Since(cached.fetched) < placeholderRefreshInterval {
+		return cached.data, cached.contentType, true
+	}
+
+	image, err := readPlaceholder(ctx, backend, p.object)
+	if err != nil {
+		log.Printf("⚠️  Failed to read placeholder %s/%s: %v", backend.Bucket(), p.object, err)
+		return cached.data, cached.contentType, found
+	}
+	p.mu.Lock()
+	p.objects[backend.Bucket()] = image
+	p.mu.Unlock()
+	return image.data, image.contentType, true
+}
+
+// readPlaceholder reads a placeholder object of up to maxPlaceholderSize bytes
+func readPlaceholder(ctx context.Context, backend Backend, name string) (placeholderImage, error) {
+	reader, info, err := backend.Open(ctx, name)
+	if err != nil {
+		return placeholderImage{}, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, maxPlaceholderSize+1))
+	if err != nil {
+		return placeholderImage{}, err
+	}
+	if len(data) > maxPlaceholderSize {
+		return placeholderImage{}, fmt.Errorf("larger than %d bytes", maxPlaceholderSize)
+	}
+	contentType := info.ContentType
+	if !strings.HasPrefix(contentType, "image/") {
+		contentType = getContentType(strings.ToLower(filepath.Ext(name)))
+	}
+	return placeholderImage{data: data, contentType: contentType, fetched: time.Now()}, nil
+}
+
+// Serve answers the download of a missing object with the placeholder image
+// and reports whether it did. API clients asking for JSON keep getting the
+// JSON error, as does everyone when a bucket placeholder can't be read.
+func (p *MissingPlaceholder) Serve(w http.ResponseWriter, r *http.Request, backend Backend) bool {
+	if p == nil {
+		return false
+	}
+	if accept := r.Header.Get("Accept"); strings.Contains(accept, "application/json") && !strings.Contains(accept, "image/") {
+		return false
+	}
+	data, contentType, ok := p.image(r.Context(), backend)
+	if !ok {
+		return false
+	}
+
+	downloadPlaceholderTotal.WithLabelValues(backend.Bucket()).Inc()
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	// Keep it short: the object may be uploaded any moment. Signed and
+	// customer-key downloads already set a private Cache-Control.
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(p.maxAge.Seconds())))
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusNotFound)
+	if r.Method != http.MethodHead {
+		w.Write(data)
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pluginExitReject is the exit status a plugin uses to reject a file; any
+// other failure is an error of the plugin itself
+const pluginExitReject = 1
+
+// maxPluginMessage bounds the stderr kept from a plugin
+const maxPluginMessage = 4 * 1024
+
+// PluginConfig declares an external command that runs as a pipeline stage.
+// The command gets the file on stdin and its details in GCB_* environment
+// variables (see commandStage.Run). A validate plugin accepts the file by
+// exiting 0 and rejects it by exiting 1 with the reason on stderr; a
+// transform plugin writes the new content to stdout (nothing keeps it as is).
+type PluginConfig struct {
+	Command    []string `json:"command"`              // program and arguments, not run through a shell
+	Phase      string   `json:"phase"`                // validate or transform
+	Extensions []string `json:"extensions,omitempty"` // e.g. [".jpg", ".png"]; empty for every file
+	Env        []string `json:"env,omitempty"`        // variables passed on from the service's environment
+}
+
+// PluginRejection is a file rejected by a plugin. It fails the upload with a
+// 400 whatever the stage's error policy, which only covers plugin failures.
+type PluginRejection struct {
+	Plugin string
+	Reason string
+}
+
+func (e *PluginRejection) Error() string {
+	return fmt.Sprintf("%v: %s", errInvalidImage, e.Reason)
+}
+
+func (e *PluginRejection) Unwrap() error {
+	return errInvalidImage
+}
+
+// commandStage runs a plugin command
+type commandStage struct {
+	name string
+	env  []string
+	PluginConfig
+}
+
+// newCommandStage checks a plugin declaration
+func newCommandStage(name string, cfg PluginConfig) (commandStage, error) {
+	if slices.ContainsFunc(builtinStages, func(s Stage) bool { return s.Name() == name }) {
+		return commandStage{}, fmt.Errorf("plugin %s: name is taken by a built-in stage", name)
+	}
+	if len(cfg.Command) == 0 || cfg.Command[0] == "" {
+		return commandStage{}, fmt.Errorf("plugin %s: command is required", name)
+	}
+	if cfg.Phase != PhaseValidate && cfg.Phase != PhaseTransform {
+		return commandStage{}, fmt.Errorf("plugin %s: phase must be %s or %s", name, PhaseValidate, PhaseTransform)
+	}
+	path, err := exec.LookPath(cfg.Command[0])
+	if err != nil {
+		return commandStage{}, fmt.Errorf("plugin %s: %w", name, err)
+	}
+	cfg.Command = append([]string{path}, cfg.Command[1:]...)
+	for i, ext := range cfg.Extensions {
+		cfg.Extensions[i] = strings.ToLower(ext)
+	}
+
+	// Like hooks, plugins don't inherit the environment, so credentials in
+	// it don't leak into them
+	env := []string{"PATH=" + os.Getenv("PATH"), "HOME=" + os.TempDir()}
+	for _, variable := range cfg.Env {
+		if value, ok := os.LookupEnv(variable); ok {
+			env = append(env, variable+"="+value)
+		}
+	}
+	return commandStage{name: name, env: env, PluginConfig: cfg}, nil
+}
+
+func (s commandStage) Name() string  { return s.name }
+func (s commandStage) Phase() string { return s.PluginConfig.Phase }
+
+func (s commandStage) Applies(job *PipelineJob) bool {
+	return len(s.Extensions) == 0 || slices.Contains(s.Extensions, job.Ext)
+}
+
+// Run pipes the file through the command. Besides PATH, HOME and the
+// variables listed in Env it gets GCB_PHASE, GCB_FILENAME, GCB_EXT, GCB_SIZE, GCB_BUCKET, GCB_TENANT,
+// GCB_UPLOADER and GCB_METADATA (the custom metadata as a JSON object). The
+// command is killed when the stage times out or the request is cancelled.
+func (s commandStage) Run(ctx context.Context, job *PipelineJob) error {
+	metadata, err := json.Marshal(job.Options.Metadata)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...)
+	cmd.WaitDelay = time.Second
+	cmd.Env = append(slices.Clip(s.env),
+		"GCB_PHASE="+s.Phase(),
+		"GCB_FILENAME="+job.Options.Filename,
+		"GCB_EXT="+job.Ext,
+		"GCB_SIZE="+strconv.Itoa(len(job.Data)),
+		"GCB_BUCKET="+job.Backend.Bucket(),
+		"GCB_TENANT="+job.Options.Tenant,
+		"GCB_UPLOADER="+job.Options.Uploader,
+		"GCB_METADATA="+string(metadata),
+	)
+	cmd.Stdin = bytes.NewReader(job.Data)
+	stdout := &limitedBuffer{max: job.Options.MaxSize}
+	stderr := &limitedBuffer{max: maxPluginMessage}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	err = cmd.Run()
+	message := strings.TrimSpace(stderr.String())
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == pluginExitReject:
+		if message == "" {
+			message = "rejected by " + s.name
+		}
+		return &PluginRejection{Plugin: s.name, Reason: message}
+	case err != nil:
+		if message != "" {
+			return fmt.Errorf("plugin %s failed: %w: %s", s.name, err, message)
+		}
+		return fmt.Errorf("plugin %s failed: %w", s.name, err)
+	case stdout.overflow:
+		return fmt.Errorf("plugin %s: %w", s.name, errUploadTooLarge)
+	}
+
+	if s.Phase() == PhaseTransform && stdout.Len() > 0 {
+		job.Data = stdout.Bytes()
+	}
+	return nil
+}
+
+// limitedBuffer keeps up to max bytes and notes whether more were written
+type limitedBuffer struct {
+	bytes.Buffer
+	max      int64
+	overflow bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := b.max - int64(b.Len()); int64(len(p)) > room {
+		b.overflow = true
+		p = p[:max(room, 0)]
+	}
+	b.Buffer.Write(p)
+	// Report everything as written so the command isn't killed by a broken pipe
+	return n, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+)
+
+// Operations an origin policy can allow
+const (
+	OpUpload    = "upload"
+	OpSignedURL = "signedurl"
+	OpDownload  = "download"
+	OpArchive   = "archive"
+	OpStats     = "stats"
+	OpUploads   = "uploads"
+	OpSimilar   = "similar"
+	OpList      = "list"
+	OpDelete    = "delete"
+	OpMetadata  = "metadata"
+	OpTags      = "tags"
+)
+
+var knownOperations = []string{OpUpload, OpSignedURL, OpDownload, OpArchive, OpStats, OpUploads, OpSimilar, OpList, OpDelete, OpMetadata, OpTags}
+
+// OriginPolicy lists the buckets and operations a browser origin may use.
+// "*" in either list allows everything.
+type OriginPolicy struct {
+	Buckets    []string `json:"buckets"`
+	Operations []string `json:"operations"`
+}
+
+// allows reports whether the policy permits op on bucket. An empty bucket
+// is used for operations that aren't tied to one bucket (stats).
+func (p OriginPolicy) allows(bucket, op string) bool {
+	if bucket != "" && !slices.Contains(p.Buckets, "*") && !slices.Contains(p.Buckets, bucket) {
+		return false
+	}
+	return slices.Contains(p.Operations, "*") || slices.Contains(p.Operations, op)
+}
+
+// OriginPolicies maps an Origin header value to its policy. The "*" entry
+// applies to origins without their own entry; without it they are denied.
+// A nil OriginPolicies allows everything.
+type OriginPolicies map[string]OriginPolicy
+
+// LoadOriginPolicies reads origin policies from a JSON file, e.g.
+//
+//	{"https://www.example.com": {"buckets": ["public-images"], "operations": ["signedurl", "download"]}}
+//
+// An empty path disables origin policies.
+func LoadOriginPolicies(path string) (OriginPolicies, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read origin policies: %w", err)
+	}
+	var policies OriginPolicies
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("failed to parse origin policies %s: %w", path, err)
+	}
+
+	for origin, policy := range policies {
+		for _, op := range policy.Operations {
+			if op != "*" && !slices.Contains(knownOperations, op) {
+				return nil, fmt.Errorf("origin %s: unknown operation %q (allowed: %v)", origin, op, knownOperations)
+			}
+		}
+	}
+	return policies, nil
+}
+
+// lookup returns the policy for an origin
+func (p OriginPolicies) lookup(origin string) (OriginPolicy, bool) {
+	if policy, ok := p[origin]; ok {
+		return policy, true
+	}
+	policy, ok := p["*"]
+	return policy, ok
+}
+
+// Require returns middleware that rejects browser requests whose Origin may
+// not perform op on bucket. Requests without an Origin header (server-side
+// clients) are not affected; they are covered by the API key alone.
+func (p OriginPolicies) Require(bucket, op string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if p == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			policy, ok := p.lookup(origin)
+			if !ok || !policy.allows(bucket, op) {
+				log.Printf("🚫 Origin %s denied %s on bucket %q", origin, op, bucket)
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   fmt.Sprintf("Operation %q is not allowed from origin %s", op, origin),
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
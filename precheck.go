@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// maxValidateSample is the largest content sample accepted by the pre-check;
+// the first kilobyte is enough to recognize every allowed format
+const maxValidateSample = 4 * 1024
+
+// UploadValidateRequest describes an upload a client is about to make
+type UploadValidateRequest struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType,omitempty"`
+	Size        int64  `json:"size,omitempty"`      // bytes, 0 when not known yet
+	Sample      []byte `json:"sample,omitempty"`    // base64 of the first bytes of the file
+	Collision   string `json:"collision,omitempty"` // collision policy of the upload, as for /upload
+}
+
+// UploadValidateResponse tells whether the described upload would be accepted
+type UploadValidateResponse struct {
+	Success     bool     `json:"success"`
+	Accepted    bool     `json:"accepted"`
+	Object      string   `json:"object,omitempty"`      // name the upload would be stored as if made now
+	ContentType string   `json:"contentType,omitempty"` // content type the object would be stored with
+	Problems    []string `json:"problems,omitempty"`    // why the upload would be rejected
+	Error       string   `json:"error,omitempty"`
+}
+
+// HandleUploadValidate handles POST /upload/validate: it runs the checks an
+// upload would go through on its filename, declared type and size and an
+// optional sample of the content, so UIs can fail fast before transferring
+// the file. Checks that need the whole file (decoding, animation limits,
+// plugins) only run on the upload itself.
+func HandleUploadValidate(backend Backend, config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(UploadValidateResponse{
+				Success: false,
+				Error:   "Method not allowed. Use POST.",
+			})
+			return
+		}
+
+		var req UploadValidateRequest
+		if err := decodeJSONBody(w, r, &req, 2*maxValidateSample); err != nil {
+			w.WriteHeader(err.Status)
+			json.NewEncoder(w).Encode(UploadValidateResponse{
+				Success: false,
+				Error:   err.Message,
+			})
+			return
+		}
+		if req.Filename == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(UploadValidateResponse{
+				Success: false,
+				Error:   "filename is required",
+			})
+			return
+		}
+		if len(req.Sample) > maxValidateSample {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(UploadValidateResponse{
+				Success: false,
+				Error:   fmt.Sprintf("sample must be at most %d bytes", maxValidateSample),
+			})
+			return
+		}
+		collision, err := parseCollisionPolicy(req.Collision, config.CollisionPolicy)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(UploadValidateResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+
+		ext := strings.ToLower(filepath.Ext(req.Filename))
+		response := UploadValidateResponse{Success: true, ContentType: getContentType(ext)}
+		reject := func(problem string) {
+			response.Problems = append(response.Problems, problem)
+		}
+
+		if err := validateUpload(req.Filename, req.Size, config.MaxFileSize); err != nil {
+			reject(err.Error())
+		}
+		if req.Size < 0 {
+			reject("size must not be negative")
+		}
+		if err := checkRawContentType(req.ContentType, req.Filename); err != nil {
+			reject(err.Error())
+		}
+		if _, err := uploaderID(r); err != nil {
+			reject(err.Error())
+		}
+
+		// Paranoid mode only stores formats it can re-encode
+		reencode := config.reencodeOptions()
+		if !featureFlags.Enabled(FlagTranscoding, r.Header.Get("X-Tenant-ID")) {
+			reencode = nil
+		}
+		if _, ok := reencodeFormats[ext]; reencode != nil && isValidImageType(req.Filename) && !ok {
+			reject(fmt.Sprintf("%v: %s files can't be verified and are not accepted", errInvalidImage, ext))
+		}
+		if len(req.Sample) > 0 && isValidImageType(req.Filename) {
+			if err := checkSample(req.Sample, ext, reencode); err != nil {
+				reject(err.Error())
+			}
+		}
+
+		if len(response.Problems) == 0 {
+			name := objectName(req.Filename)
+			switch collision {
+			case CollisionSuffix:
+				name, err = freeObjectName(r.Context(), backend, name)
+			case CollisionReject:
+				if _, err = backend.Stat(r.Context(), name); err == nil {
+					err = ErrObjectExists
+				} else if errors.Is(err, ErrObjectNotFound) {
+					err = nil
+				}
+			}
+			switch {
+			case errors.Is(err, ErrObjectExists):
+				reject("An object with this name already exists")
+			case err != nil:
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(UploadValidateResponse{
+					Success: false,
+					Error:   fmt.Sprintf("Failed to check the object name: %v", err),
+				})
+				return
+			default:
+				response.Object = name
+			}
+		}
+
+		response.Accepted = len(response.Problems) == 0
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// checkSample checks that the first bytes of a file match the format its
+// extension claims and, in paranoid mode, that the dimensions in the header
+// are within the pixel limit
+func checkSample(sample []byte, ext string, reencode *ReencodeOptions) error {
+	want := getContentType(ext)
+	if want == "image/svg+xml" {
+		if !bytes.HasPrefix(bytes.TrimSpace(sample), []byte("<")) {
+			return fmt.Errorf("%w: content is not an SVG document", errInvalidImage)
+		}
+		return nil
+	}
+	if got := http.DetectContentType(sample); got != want {
+		return fmt.Errorf("%w: content is %s but the file name says %s", errInvalidImage, got, ext)
+	}
+
+	// The header may not fit in the sample, in which case the upload decides
+	if reencode != nil && reencode.MaxPixels > 0 {
+		if config, _, err := image.DecodeConfig(bytes.NewReader(sample)); err == nil && config.Width*config.Height > reencode.MaxPixels {
+			return fmt.Errorf("%w: %dx%d exceeds the limit of %d pixels", errInvalidImage, config.Width, config.Height, reencode.MaxPixels)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/netip"
+)
+
+// Client IP privacy modes
+const (
+	IPPrivacyOff      = "off"
+	IPPrivacyTruncate = "truncate" // keep the /24 (IPv4) or /48 (IPv6) network
+	IPPrivacyHash     = "hash"     // keyed HMAC-SHA256, stable per IP but not reversible
+)
+
+// Networks client IPs are truncated to
+const (
+	ipv4PrivacyBits = 24
+	ipv6PrivacyBits = 48
+)
+
+// unknownIP replaces client IPs that don't parse, so arbitrary header
+// values never reach logs or labels
+const unknownIP = "unknown"
+
+// IPPrivacyConfig selects how client IPs are minimized
+type IPPrivacyConfig struct {
+	Mode string // off, truncate or hash
+	Key  string // HMAC key of the hash mode
+}
+
+// IPPrivacy minimizes client IPs before they are logged, sent in
+// notifications, recorded in the signed URL audit or kept in the abuse
+// guard. A nil IPPrivacy leaves them as they are.
+type IPPrivacy struct {
+	mode string
+	key  []byte
+}
+
+// ipPrivacy is the process-wide setting; nil (raw IPs) until set in main
+var ipPrivacy *IPPrivacy
+
+// NewIPPrivacy returns nil when the mode is off
+func NewIPPrivacy(cfg IPPrivacyConfig) *IPPrivacy {
+	if cfg.Mode == "" || cfg.Mode == IPPrivacyOff {
+		return nil
+	}
+	return &IPPrivacy{mode: cfg.Mode, key: []byte(cfg.Key)}
+}
+
+// Anonymize returns the form of a client IP that may be recorded: its
+// network, e.g. "203.0.113.0/24", or "ip-" and a keyed hash
+func (p *IPPrivacy) Anonymize(ip string) string {
+	if p == nil {
+		return ip
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return unknownIP
+	}
+	addr = addr.Unmap()
+
+	if p.mode == IPPrivacyHash {
+		mac := hmac.New(sha256.New, p.key)
+		mac.Write(addr.AsSlice())
+		return "ip-" + hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+	bits := ipv6PrivacyBits
+	if addr.Is4() {
+		bits = ipv4PrivacyBits
+	}
+	prefix, err := addr.WithZone("").Prefix(bits)
+	if err != nil {
+		return unknownIP
+	}
+	return prefix.String()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// MetricsPushConfig configures pushing metrics to a Prometheus Pushgateway
+type MetricsPushConfig struct {
+	URL      string // Pushgateway base URL, "" disables pushing
+	Job      string
+	Interval time.Duration
+	Labels   []string // extra grouping labels as name=value
+	Username string   // basic auth, together with Password
+	Password string
+}
+
+// MetricsPusher periodically pushes the process metrics to a Pushgateway, for
+// deployments where instances come and go between scrapes (e.g. Cloud Run
+// scaling to zero). Each instance pushes to its own group, keyed by an
+// instance label, so instances don't overwrite each other's counters.
+type MetricsPusher struct {
+	pusher   *push.Pusher
+	interval time.Duration
+	instance string
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewMetricsPusher creates a pusher from config, or returns nil when no URL is configured
+func NewMetricsPusher(cfg MetricsPushConfig) (*MetricsPusher, error) {
+	if cfg.URL == "" {
+		return nil, nil
+	}
+	if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("METRICS_PUSH_INTERVAL must be positive")
+	}
+
+	instance, err := metricsInstanceID()
+	if err != nil {
+		return nil, err
+	}
+	pusher := push.New(cfg.URL, cfg.Job).
+		Gatherer(prometheus.DefaultGatherer).
+		Client(&http.Client{Timeout: 10 * time.Second})
+	for _, item := range cfg.Labels {
+		name, value, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid push label %q (expected name=value)", item)
+		}
+		if name == "job" {
+			return nil, fmt.Errorf("invalid push label %q: set the job with METRICS_PUSH_JOB", item)
+		}
+		if name == "instance" {
+			instance = strings.TrimSpace(value)
+			continue
+		}
+		pusher = pusher.Grouping(name, strings.TrimSpace(value))
+	}
+	pusher = pusher.Grouping("instance", instance)
+	if cfg.Password != "" {
+		pusher = pusher.BasicAuth(cfg.Username, cfg.Password)
+	}
+
+	return &MetricsPusher{
+		pusher:   pusher,
+		interval: cfg.Interval,
+		instance: instance,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// metricsInstanceID names this process: the hostname (or the Cloud Run
+// revision, whose instances all share one hostname) plus a random suffix,
+// since a restarted instance must not resume the counters of the old one
+func metricsInstanceID() (string, error) {
+	name := os.Getenv("K_REVISION")
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("failed to generate metrics instance ID: %w", err)
+	}
+	return name + "-" + hex.EncodeToString(suffix), nil
+}
+
+// Start pushes every interval until Stop
+func (p *MetricsPusher) Start() {
+	log.Printf("📈 Pushing metrics every %s as instance %s", p.interval, p.instance)
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.push()
+			}
+		}
+	}()
+}
+
+// Stop ends the periodic pushes, pushes one last time and deletes the
+// instance's group. The Pushgateway would otherwise keep serving the group of
+// every instance that ever ran, which look like live series to Prometheus.
+func (p *MetricsPusher) Stop() {
+	close(p.stop)
+	<-p.done
+	p.push()
+	if err := p.pusher.Delete(); err != nil { // bounded by the client timeout
+		metricsPushFailuresTotal.Inc()
+		log.Printf("⚠️  Failed to delete metrics group of instance %s: %v", p.instance, err)
+	}
+}
+
+func (p *MetricsPusher) push() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := p.pusher.PushContext(ctx); err != nil {
+		metricsPushFailuresTotal.Inc()
+		log.Printf("⚠️  Failed to push metrics: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMetricsPusherStopDeletesGroup(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	pusher, err := NewMetricsPusher(MetricsPushConfig{URL: server.URL, Job: "gcb", Interval: time.Hour, Labels: []string{"instance=test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pusher.Start()
+	pusher.Stop()
+
+	const group = "/metrics/job/gcb/instance/test"
+	if want := []string{http.MethodPut + " " + group, http.MethodDelete + " " + group}; !slices.Equal(requests, want) {
+		t.Errorf("requests = %s, want %s", strings.Join(requests, ", "), strings.Join(want, ", "))
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Quarantine categories. Scanners may report others, which are recorded as
+// "other" so the metric labels stay bounded.
+const (
+	QuarantineMalware    = "malware"
+	QuarantineModeration = "moderation"
+	QuarantineManual     = "manual"
+	QuarantineOther      = "other"
+)
+
+var quarantineCategories = []string{QuarantineMalware, QuarantineModeration, QuarantineManual, QuarantineOther}
+
+// Metadata keys recording why and from where an object was quarantined, set
+// on the quarantined copy and on its catalog record
+const (
+	quarantineCategoryKey = "quarantine-category"
+	quarantineReasonKey   = "quarantine-reason"
+	quarantineSourceKey   = "quarantine-source" // bucket/name the object was moved from
+	quarantinedAtKey      = "quarantined-at"
+)
+
+var quarantineKeys = []string{quarantineCategoryKey, quarantineReasonKey, quarantineSourceKey, quarantinedAtKey}
+
+var errNotQuarantineBucket = errors.New("not a quarantine bucket")
+
+// Quarantine moves flagged objects out of reach, under a prefix of their own
+// bucket or into a dedicated bucket, until an admin releases or purges them.
+// The catalog records where each quarantined object came from, so it is the
+// source of truth for reviews. All methods are safe on a nil quarantine.
+type Quarantine struct {
+	prefix   string
+	store    Backend            // dedicated quarantine bucket, nil to quarantine objects in their own bucket
+	backends map[string]Backend // source buckets by name
+}
+
+// quarantine is the process-wide quarantine; nil until set up in main
+var quarantine *Quarantine
+
+// QuarantineEntry describes a quarantined object
+type QuarantineEntry struct {
+	Bucket        string    `json:"bucket"` // where the quarantined copy is stored
+	Name          string    `json:"name"`
+	SourceBucket  string    `json:"sourceBucket"`
+	SourceName    string    `json:"sourceName"`
+	Category      string    `json:"category"`
+	Reason        string    `json:"reason,omitempty"`
+	Size          int64     `json:"size"`
+	ContentType   string    `json:"contentType,omitempty"`
+	Tenant        string    `json:"tenant,omitempty"`
+	Uploader      string    `json:"uploader,omitempty"`
+	QuarantinedAt time.Time `json:"quarantinedAt"`
+}
+
+// NewQuarantine creates the quarantine and publishes the current volume metrics
+func NewQuarantine(prefix string, store Backend, backends map[string]Backend) *Quarantine {
+	q := &Quarantine{
+		prefix:   strings.TrimSuffix(prefix, "/") + "/",
+		store:    store,
+		backends: backends,
+	}
+	q.refreshMetrics()
+	return q
+}
+
+// Hides reports whether name lies in the quarantine prefix of a source
+// bucket, and must therefore not be listed or served
+func (q *Quarantine) Hides(name string) bool {
+	return q != nil && q.store == nil && strings.HasPrefix(name, q.prefix)
+}
+
+// isQuarantineRecord reports whether a catalog record is a quarantined copy
+func isQuarantineRecord(record AssetRecord) bool {
+	return record.Metadata[quarantineCategoryKey] != ""
+}
+
+// normalizeCategory maps a reported category to one of quarantineCategories
+func normalizeCategory(category string) string {
+	category = strings.ToLower(strings.TrimSpace(category))
+	if slices.Contains(quarantineCategories, category) {
+		return category
+	}
+	return QuarantineOther
+}
+
+// location returns the backend holding the quarantined objects of a source bucket
+func (q *Quarantine) location(bucket string) Backend {
+	if q.store != nil {
+		return q.store
+	}
+	return q.backends[bucket]
+}
+
+// Isolate moves an object of a source bucket into quarantine. The object's
+// poster shows the same content and is deleted rather than moved.
+func (q *Quarantine) Isolate(ctx context.Context, source Backend, name, category, reason string) (QuarantineEntry, error) {
+	if q == nil {
+		return QuarantineEntry{}, errors.New("quarantine is not configured")
+	}
+	if q.Hides(name) {
+		return QuarantineEntry{}, fmt.Errorf("%s is already quarantined: %w", name, ErrObjectExists)
+	}
+
+	if err := checkDeletable(ctx, source, name); err != nil {
+		return QuarantineEntry{}, err
+	}
+
+	dst := q.location(source.Bucket())
+	qname := q.prefix + source.Bucket() + "/" + name
+	category = normalizeCategory(category)
+	marks := map[string]string{
+		quarantineCategoryKey: category,
+		quarantineReasonKey:   reason,
+		quarantineSourceKey:   source.Bucket() + "/" + name,
+		quarantinedAtKey:      time.Now().UTC().Format(time.RFC3339),
+	}
+	info, err := moveObject(ctx, source, name, dst, qname, marks, nil, false)
+	if err != nil {
+		return QuarantineEntry{}, err
+	}
+
+	record, ok := metadataStore.Get(source.Bucket(), name)
+	if !ok {
+		record = AssetRecord{Source: SourceUpload}
+	}
+	if poster := record.Metadata["poster"]; poster != "" {
+		if err := source.Delete(ctx, poster); err != nil && !errors.Is(err, ErrObjectNotFound) {
+			traceLogf(ctx, "⚠️  Failed to delete poster %s of quarantined %s: %v", poster, name, err)
+		}
+	}
+	if err := metadataStore.Delete(source.Bucket(), name); err != nil {
+		traceLogf(ctx, "⚠️  Failed to remove %s from metadata store: %v", name, err)
+	}
+	record.Bucket, record.Name = dst.Bucket(), qname
+	record.Size, record.ContentType = info.Size, info.ContentType
+	record.Metadata = mergeMetadata(record.Metadata, marks, "poster")
+	if err := metadataStore.Put(record); err != nil {
+		traceLogf(ctx, "⚠️  Failed to register quarantined %s in metadata store: %v", qname, err)
+	}
+
+	quarantineOperationsTotal.WithLabelValues(source.Bucket(), "quarantine", category).Inc()
+	q.refreshMetrics()
+	traceLogf(ctx, "☣️  Quarantined %s/%s as %s/%s (%s: %s)", source.Bucket(), name, dst.Bucket(), qname, category, reason)
+	PublishEvent(AssetEvent{
+		Type:        EventQuarantine,
+		Bucket:      source.Bucket(),
+		Object:      name,
+		Size:        record.Size,
+		ContentType: record.ContentType,
+		Tenant:      record.Tenant,
+		Uploader:    record.Uploader,
+	})
+	return quarantineEntry(record), nil
+}
+
+// Release moves a quarantined object back to where it came from. It fails
+// with ErrObjectExists if an object has been stored under that name since.
+func (q *Quarantine) Release(ctx context.Context, bucket, name string) (QuarantineEntry, error) {
+	record, dst, err := q.lookup(bucket, name)
+	if err != nil {
+		return QuarantineEntry{}, err
+	}
+	entry := quarantineEntry(record)
+	source, ok := q.backends[entry.SourceBucket]
+	if !ok {
+		return QuarantineEntry{}, fmt.Errorf("source bucket %s is not registered", entry.SourceBucket)
+	}
+
+	if err := checkDeletable(ctx, dst, name); err != nil {
+		return QuarantineEntry{}, err
+	}
+	if _, err := moveObject(ctx, dst, name, source, entry.SourceName, nil, quarantineKeys, true); err != nil {
+		return QuarantineEntry{}, err
+	}
+	if err := metadataStore.Delete(bucket, name); err != nil {
+		traceLogf(ctx, "⚠️  Failed to remove %s from metadata store: %v", name, err)
+	}
+	released := record
+	released.Bucket, released.Name = entry.SourceBucket, entry.SourceName
+	released.Metadata = mergeMetadata(record.Metadata, nil, quarantineKeys...)
+	if err := metadataStore.Put(released); err != nil {
+		traceLogf(ctx, "⚠️  Failed to register released %s in metadata store: %v", entry.SourceName, err)
+	}
+
+	quarantineOperationsTotal.WithLabelValues(entry.SourceBucket, "release", entry.Category).Inc()
+	q.refreshMetrics()
+	traceLogf(ctx, "✅ Released %s/%s from quarantine", entry.SourceBucket, entry.SourceName)
+	PublishEvent(AssetEvent{
+		Type:        EventRelease,
+		Bucket:      entry.SourceBucket,
+		Object:      entry.SourceName,
+		Size:        record.Size,
+		ContentType: record.ContentType,
+		Tenant:      record.Tenant,
+		Uploader:    record.Uploader,
+	})
+	return entry, nil
+}
+
+// Purge deletes a quarantined object for good
+func (q *Quarantine) Purge(ctx context.Context, bucket, name string) (QuarantineEntry, error) {
+	record, dst, err := q.lookup(bucket, name)
+	if err != nil {
+		return QuarantineEntry{}, err
+	}
+	if err := checkDeletable(ctx, dst, name); err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return QuarantineEntry{}, err
+	}
+	if err := dst.Delete(ctx, name); err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return QuarantineEntry{}, err
+	}
+	if err := metadataStore.Delete(bucket, name); err != nil {
+		traceLogf(ctx, "⚠️  Failed to remove %s from metadata store: %v", name, err)
+	}
+
+	entry := quarantineEntry(record)
+	quarantineOperationsTotal.WithLabelValues(entry.SourceBucket, "purge", entry.Category).Inc()
+	q.refreshMetrics()
+	traceLogf(ctx, "🗑️  Purged %s/%s from quarantine", entry.SourceBucket, entry.SourceName)
+	return entry, nil
+}
+
+// List returns the quarantined objects, newest first. A non-empty bucket
+// only returns the objects quarantined from that bucket.
+func (q *Quarantine) List(bucket string) []QuarantineEntry {
+	entries := []QuarantineEntry{}
+	if q == nil {
+		return entries
+	}
+
+	var locations []string
+	if q.store != nil {
+		locations = []string{q.store.Bucket()}
+	} else {
+		locations = slices.Sorted(maps.Keys(q.backends))
+	}
+	for _, location := range locations {
+		metadataStore.List(location, q.prefix, func(record AssetRecord) error {
+			if !isQuarantineRecord(record) {
+				return nil
+			}
+			if entry := quarantineEntry(record); bucket == "" || entry.SourceBucket == bucket {
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].QuarantinedAt.After(entries[j].QuarantinedAt) })
+	return entries
+}
+
+// lookup returns the catalog record of a quarantined object and the backend holding it
+func (q *Quarantine) lookup(bucket, name string) (AssetRecord, Backend, error) {
+	if q == nil {
+		return AssetRecord{}, nil, errors.New("quarantine is not configured")
+	}
+	var dst Backend
+	if q.store != nil {
+		if bucket == q.store.Bucket() {
+			dst = q.store
+		}
+	} else {
+		dst = q.backends[bucket]
+	}
+	if dst == nil {
+		return AssetRecord{}, nil, fmt.Errorf("%w: %s", errNotQuarantineBucket, bucket)
+	}
+
+	record, ok := metadataStore.Get(bucket, name)
+	if !ok || !isQuarantineRecord(record) {
+		return AssetRecord{}, nil, ErrObjectNotFound
+	}
+	return record, dst, nil
+}
+
+// refreshMetrics recomputes the quarantine volume gauges from the catalog
+func (q *Quarantine) refreshMetrics() {
+	objects, bytes := map[string]int{}, map[string]int64{}
+	for name := range q.backends {
+		objects[name], bytes[name] = 0, 0
+	}
+	for _, entry := range q.List("") {
+		objects[entry.SourceBucket]++
+		bytes[entry.SourceBucket] += entry.Size
+	}
+	for bucket, count := range objects {
+		quarantineObjects.WithLabelValues(bucket).Set(float64(count))
+		quarantineBytes.WithLabelValues(bucket).Set(float64(bytes[bucket]))
+	}
+}
+
+// quarantineEntry describes a quarantined object from its catalog record
+func quarantineEntry(record AssetRecord) QuarantineEntry {
+	sourceBucket, sourceName, _ := strings.Cut(record.Metadata[quarantineSourceKey], "/")
+	quarantinedAt, _ := time.Parse(time.RFC3339, record.Metadata[quarantinedAtKey])
+	return QuarantineEntry{
+		Bucket:        record.Bucket,
+		Name:          record.Name,
+		SourceBucket:  sourceBucket,
+		SourceName:    sourceName,
+		Category:      record.Metadata[quarantineCategoryKey],
+		Reason:        record.Metadata[quarantineReasonKey],
+		Size:          record.Size,
+		ContentType:   record.ContentType,
+		Tenant:        record.Tenant,
+		Uploader:      record.Uploader,
+		QuarantinedAt: quarantinedAt,
+	}
+}
+
+// moveObject copies an object to dstName in dst, with the given metadata
+// keys set and unset, then deletes the original
+func moveObject(ctx context.Context, src Backend, srcName string, dst Backend, dstName string, set map[string]string, unset []string, ifNotExists bool) (*ObjectInfo, error) {
+	reader, info, err := src.Open(ctx, srcName)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	written, err := dst.Put(ctx, dstName, reader, PutOptions{
+		ContentType:        info.ContentType,
+		ContentDisposition: info.ContentDisposition,
+		Metadata:           mergeMetadata(info.Metadata, set, unset...),
+		IfNotExists:        ifNotExists,
+		Size:               info.Size,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := src.Delete(ctx, srcName); err != nil {
+		// Both copies exist now and the catalog still points at the original
+		return nil, fmt.Errorf("copied but failed to delete %s: %w", srcName, err)
+	}
+	return written, nil
+}
+
+// mergeMetadata returns a copy of base with the set keys added and the
+// unset keys removed, or nil when nothing is left
+func mergeMetadata(base, set map[string]string, unset ...string) map[string]string {
+	merged := map[string]string{}
+	maps.Copy(merged, base)
+	maps.Copy(merged, set)
+	for _, key := range unset {
+		delete(merged, key)
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+	return merged
+}
+
+// QuarantineListResponse lists the quarantined objects
+type QuarantineListResponse struct {
+	Success bool              `json:"success"`
+	Entries []QuarantineEntry `json:"entries"`
+}
+
+// QuarantineResponse is the response of the quarantine actions
+type QuarantineResponse struct {
+	Success bool             `json:"success"`
+	Entry   *QuarantineEntry `json:"entry,omitempty"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// HandleQuarantine serves the quarantine review endpoints:
+//   - GET /admin/quarantine?bucket= lists quarantined objects
+//   - POST /admin/quarantine?bucket=&name=&reason= quarantines an object by hand
+//   - POST /admin/quarantine/release?bucket=&name= restores a quarantined object
+//   - POST /admin/quarantine/purge?bucket=&name= deletes a quarantined object
+//
+// Release and purge take the bucket and name of the quarantined copy, as listed.
+func HandleQuarantine(q *Quarantine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		query := r.URL.Query()
+		action := strings.TrimPrefix(r.URL.Path, "/admin/quarantine")
+		if action == "" && r.Method == http.MethodGet {
+			json.NewEncoder(w).Encode(QuarantineListResponse{
+				Success: true,
+				Entries: q.List(query.Get("bucket")),
+			})
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(QuarantineResponse{
+				Success: false,
+				Error:   "Method not allowed. Use GET to list or POST to act.",
+			})
+			return
+		}
+		bucket, name := query.Get("bucket"), query.Get("name")
+		if bucket == "" || name == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(QuarantineResponse{
+				Success: false,
+				Error:   "bucket and name are required",
+			})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), serverWriteTimeout)
+		defer cancel()
+
+		op := "quarantine"
+		var entry QuarantineEntry
+		var err error
+		switch action {
+		case "":
+			source, ok := q.backends[bucket]
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(QuarantineResponse{
+					Success: false,
+					Error:   "bucket must be a registered bucket",
+				})
+				return
+			}
+			entry, err = q.Isolate(ctx, source, name, QuarantineManual, query.Get("reason"))
+		case "/release":
+			op = "release"
+			entry, err = q.Release(ctx, bucket, name)
+		case "/purge":
+			op = "purge"
+			entry, err = q.Purge(ctx, bucket, name)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(QuarantineResponse{
+				Success: false,
+				Error:   "Not found. Use /admin/quarantine, /admin/quarantine/release or /admin/quarantine/purge",
+			})
+			return
+		}
+
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrObjectNotFound):
+				status = http.StatusNotFound
+			case errors.Is(err, ErrObjectExists):
+				status = http.StatusConflict
+			case errors.Is(err, ErrObjectHeld):
+				status = http.StatusLocked
+			case errors.Is(err, errNotQuarantineBucket):
+				status = http.StatusBadRequest
+			}
+			log.Printf("⚠️  Failed to %s %s/%s: %v", op, bucket, name, err)
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(QuarantineResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(QuarantineResponse{
+			Success: true,
+			Entry:   &entry,
+		})
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// R2Client talks to Cloudflare R2 (or any S3-compatible endpoint) over the S3 API
+type R2Client struct {
+	httpClient    *http.Client
+	signer        *sigV4Signer
+	endpoint      *url.URL
+	bucketName    string
+	publicBaseURL string
+}
+
+// NewR2Client creates an R2/S3 client for the given bucket
+func NewR2Client(cfg R2Config, bucketName string) (*R2Client, error) {
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, fmt.Errorf("R2_ACCESS_KEY_ID and R2_SECRET_ACCESS_KEY are required for the r2 driver")
+	}
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		if cfg.AccountID == "" {
+			return nil, fmt.Errorf("R2_ACCOUNT_ID or R2_ENDPOINT is required for the r2 driver")
+		}
+		// Jurisdiction-specific buckets live on their own hostname, e.g. <account>.eu.r2.cloudflarestorage.com
+		if cfg.Jurisdiction != "" {
+			endpoint = fmt.Sprintf("https://%s.%s.r2.cloudflarestorage.com", cfg.AccountID, cfg.Jurisdiction)
+		} else {
+			endpoint = fmt.Sprintf("https://%s.r2.cloudflarestorage.com", cfg.AccountID)
+		}
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid R2 endpoint %q", endpoint)
+	}
+
+	region := cfg.Region
+	if region == "" {
+		region = "auto"
+	}
+
+	return &R2Client{
+		httpClient: &http.Client{Timeout: 5 * time.Minute},
+		signer: &sigV4Signer{
+			accessKeyID:     cfg.AccessKeyID,
+			secretAccessKey: cfg.SecretAccessKey,
+			region:          region,
+			service:         "s3",
+		},
+		endpoint:      u,
+		bucketName:    bucketName,
+		publicBaseURL: strings.TrimSuffix(cfg.PublicBaseURL, "/"),
+	}, nil
+}
+
+// Bucket returns the bucket name
+func (c *R2Client) Bucket() string {
+	return c.bucketName
+}
+
+// objectURL returns the path-style URL of an object
+func (c *R2Client) objectURL(name string) *url.URL {
+	u := *c.endpoint
+	u.Path = "/" + c.bucketName + "/" + name
+	return &u
+}
+
+// errPreconditionFailed is returned by do for 412 responses to conditional requests
+var errPreconditionFailed = errors.New("precondition failed")
+
+// s3StatusError is an error response of the S3 API
+type s3StatusError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *s3StatusError) Error() string {
+	return fmt.Sprintf("s3 %s %s: %s: %s", e.Method, e.Path, e.Status, e.Body)
+}
+
+// do signs and executes a request against the S3 API
+func (c *R2Client) do(req *http.Request) (*http.Response, error) {
+	setTraceHeaders(req)
+	c.signer.SignRequest(req, time.Now())
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrObjectNotFound
+	}
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		resp.Body.Close()
+		return nil, ErrInvalidRange
+	}
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		resp.Body.Close()
+		return nil, errPreconditionFailed
+	}
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, &s3StatusError{
+			Method:     req.Method,
+			Path:       req.URL.Path,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       strings.TrimSpace(string(body)),
+		}
+	}
+	return resp, nil
+}
+
+// Put uploads an object with a single PUT request
+func (c *R2Client) Put(ctx context.Context, name string, r io.Reader, opts PutOptions) (*ObjectInfo, error) {
+	if customerKeyFromContext(ctx) != nil {
+		return nil, ErrCustomerKeyUnsupported
+	}
+	// S3 requires a Content-Length, so buffer readers we cannot measure
+	body, size, err := sizedReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.objectURL(name).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	if opts.ContentType != "" {
+		req.Header.Set("Content-Type", opts.ContentType)
+	}
+	if opts.ContentDisposition != "" {
+		req.Header.Set("Content-Disposition", opts.ContentDisposition)
+	}
+	for key, value := range opts.Metadata {
+		// Headers only carry ASCII, S3 expects other values MIME-encoded
+		req.Header.Set("X-Amz-Meta-"+key, mime.QEncoding.Encode("utf-8", value))
+	}
+	if opts.IfNotExists {
+		// Conditional writes, answered with 412 when the object exists
+		req.Header.Set("If-None-Match", "*")
+	}
+
+	resp, err := c.do(req)
+	if errors.Is(err, errPreconditionFailed) {
+		return nil, ErrObjectExists
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload file: %w", err)
+	}
+	resp.Body.Close()
+
+	return &ObjectInfo{
+		Name:               name,
+		Size:               size,
+		ContentType:        opts.ContentType,
+		ContentDisposition: opts.ContentDisposition,
+		ETag:               strings.Trim(resp.Header.Get("ETag"), `"`),
+		Updated:            time.Now(),
+		Metadata:           opts.Metadata,
+	}, nil
+}
+
+// Open returns a reader for the object content
+func (c *R2Client) Open(ctx context.Context, name string) (io.ReadCloser, *ObjectInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.objectURL(name).String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Body, r2ObjectInfo(name, resp.Header), nil
+}
+
+// OpenRange returns a reader for part of the object content
+func (c *R2Client) OpenRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.objectURL(name).String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case offset < 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d", offset))
+	case length < 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	default:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	info := r2ObjectInfo(name, resp.Header)
+	// Content-Length is the size of the range, the total follows the slash
+	if contentRange := resp.Header.Get("Content-Range"); contentRange != "" {
+		if _, total, ok := strings.Cut(contentRange, "/"); ok {
+			if size, err := strconv.ParseInt(total, 10, 64); err == nil {
+				info.Size = size
+			}
+		}
+	}
+	return resp.Body, info, nil
+}
+
+// Stat returns the object attributes via HEAD
+func (c *R2Client) Stat(ctx context.Context, name string) (*ObjectInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.objectURL(name).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return r2ObjectInfo(name, resp.Header), nil
+}
+
+// Delete removes an object
+func (c *R2Client) Delete(ctx context.Context, name string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.objectURL(name).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// listBucketResult is the ListObjectsV2 response body
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		ETag         string    `xml:"ETag"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List pages through ListObjectsV2 calling fn for every object
+func (c *R2Client) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	token := ""
+	for {
+		u := *c.endpoint
+		u.Path = "/" + c.bucketName
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u.RawQuery = canonicalQuery(query)
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.do(req)
+		if err != nil {
+			return fmt.Errorf("failed to list objects: %w", err)
+		}
+
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to decode object listing: %w", err)
+		}
+
+		for _, obj := range result.Contents {
+			if err := fn(ObjectInfo{
+				Name:    obj.Key,
+				Size:    obj.Size,
+				ETag:    strings.Trim(obj.ETag, `"`),
+				Updated: obj.LastModified,
+			}); err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// SignedURL returns a presigned URL for the given method
+func (c *R2Client) SignedURL(method, name string, opts SignOptions) (string, error) {
+	headers := map[string]string{}
+	if method == http.MethodPut {
+		headers = c.UploadHeaders(opts)
+	}
+	return c.signer.Presign(method, c.objectURL(name), headers, opts.Expires, time.Now()), nil
+}
+
+// UploadHeaders returns the headers signed into upload URLs; metadata is
+// sent as x-amz-meta-* headers
+func (c *R2Client) UploadHeaders(opts SignOptions) map[string]string {
+	headers := map[string]string{}
+	if opts.ContentType != "" {
+		headers["Content-Type"] = opts.ContentType
+	}
+	if opts.CacheControl != "" {
+		headers["Cache-Control"] = opts.CacheControl
+	}
+	for key, value := range opts.Metadata {
+		headers["x-amz-meta-"+key] = value
+	}
+	return headers
+}
+
+// PublicURL returns the public (custom domain / r2.dev) URL of an object
+func (c *R2Client) PublicURL(name string) string {
+	if c.publicBaseURL != "" {
+		return c.publicBaseURL + "/" + objectURLPath(name)
+	}
+	return c.objectURL(name).String()
+}
+
+// Close is a no-op for the HTTP based client
+func (c *R2Client) Close() error {
+	return nil
+}
+
+// r2ObjectInfo builds an ObjectInfo from S3 response headers
+func r2ObjectInfo(name string, header http.Header) *ObjectInfo {
+	size, _ := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	updated, _ := http.ParseTime(header.Get("Last-Modified"))
+
+	metadata := map[string]string{}
+	for key := range header {
+		if strings.HasPrefix(strings.ToLower(key), "x-amz-meta-") {
+			value := header.Get(key)
+			if decoded, err := new(mime.WordDecoder).DecodeHeader(value); err == nil {
+				value = decoded
+			}
+			metadata[strings.ToLower(key[len("x-amz-meta-"):])] = value
+		}
+	}
+
+	return &ObjectInfo{
+		Name:               name,
+		Size:               size,
+		ContentType:        header.Get("Content-Type"),
+		ContentDisposition: header.Get("Content-Disposition"),
+		ETag:               strings.Trim(header.Get("ETag"), `"`),
+		Updated:            updated,
+		Metadata:           metadata,
+	}
+}
+
+// sizedReader returns r with its length, buffering it when it cannot be measured
+func sizedReader(r io.Reader) (io.Reader, int64, error) {
+	if seeker, ok := r.(io.Seeker); ok {
+		current, err := seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			end, err := seeker.Seek(0, io.SeekEnd)
+			if err == nil {
+				if _, err := seeker.Seek(current, io.SeekStart); err == nil {
+					return r, end - current, nil
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		return nil, 0, err
+	}
+	return &buf, int64(buf.Len()), nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// byteRange is an inclusive range of bytes served with 206 Partial Content
+type byteRange struct {
+	start, end int64
+}
+
+// parseByteRange parses a single-range header ("bytes=0-99", "bytes=100-",
+// "bytes=-500") into OpenRange arguments. Multiple ranges aren't supported and
+// are served as a full response, which RFC 9110 allows.
+func parseByteRange(header string) (offset, length int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	if first == "" {
+		// Suffix range: the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		return -n, -1, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	if last == "" {
+		return start, -1, true
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end - start + 1, true
+}
+
+// resolveRange turns OpenRange arguments into absolute positions for an
+// object of the given size, or nil when the range is not satisfiable
+func resolveRange(offset, length, size int64) *byteRange {
+	start, end := offset, size-1
+	if offset < 0 {
+		start = max(size+offset, 0)
+	} else if length >= 0 {
+		end = min(offset+length-1, size-1)
+	}
+	if start > end {
+		return nil
+	}
+	return &byteRange{start: start, end: end}
+}
+
+// ifRangeMatches reports whether the If-Range validator still describes the
+// object. ETags must match strongly (RFC 9110 section 13.1.5).
+func ifRangeMatches(ifRange string, info *ObjectInfo) bool {
+	if strings.HasPrefix(ifRange, `"`) {
+		return info.ETag != "" && ifRange == `"`+info.ETag+`"`
+	}
+	if strings.HasPrefix(ifRange, "W/") {
+		return false
+	}
+	since, err := http.ParseTime(ifRange)
+	return err == nil && info.Updated.Truncate(time.Second).Equal(since)
+}
+
+// openDownload opens the requested range of an object when the request has a
+// usable Range header and the backend supports range reads, and the whole
+// object otherwise. The returned range is nil for full responses.
+func openDownload(r *http.Request, backend Backend, name string) (io.ReadCloser, *ObjectInfo, *byteRange, error) {
+	opener, supported := backend.(rangeOpener)
+	offset, length, ok := parseByteRange(r.Header.Get("Range"))
+	if !supported || !ok || r.Method != http.MethodGet {
+		reader, info, err := backend.Open(r.Context(), name)
+		return reader, info, nil, err
+	}
+
+	reader, info, err := opener.OpenRange(r.Context(), name, offset, length)
+	if errors.Is(err, errors.ErrUnsupported) {
+		reader, info, err := backend.Open(r.Context(), name)
+		return reader, info, nil, err
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// A stale If-Range means the client's partial copy is outdated: send everything
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && !ifRangeMatches(ifRange, info) {
+		reader.Close()
+		reader, info, err := backend.Open(r.Context(), name)
+		return reader, info, nil, err
+	}
+
+	rng := resolveRange(offset, length, info.Size)
+	if rng == nil {
+		reader.Close()
+		return nil, nil, nil, ErrInvalidRange
+	}
+	return reader, info, rng, nil
+}
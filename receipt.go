@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var errReceiptInvalid = errors.New("invalid upload receipt")
+
+// ReceiptClaims are the facts an upload receipt vouches for
+type ReceiptClaims struct {
+	Issuer      string `json:"iss"`
+	Bucket      string `json:"bucket"`
+	Object      string `json:"object"`
+	SHA256      string `json:"sha256"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType,omitempty"`
+	Tenant      string `json:"tenant,omitempty"`
+	IssuedAt    int64  `json:"iat"` // Unix time the asset was stored
+}
+
+// receiptHeader is the JOSE header of a receipt. Kid is the fingerprint of
+// the signing key, so verifiers holding several keys know which one to use.
+type receiptHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// ReceiptSigner issues upload receipts: HS256 JWTs that other services
+// holding a shared key can verify with any JWT library, as proof that an
+// asset went through this service's validation. The first key signs; all
+// keys verify, which allows rotating keys without invalidating receipts
+// already handed out.
+type ReceiptSigner struct {
+	keys   [][]byte
+	issuer string
+}
+
+// receiptSigner is the process-wide receipt signer; nil when receipts are disabled
+var receiptSigner *ReceiptSigner
+
+// NewReceiptSigner creates a signer from config, or returns nil when no key is configured
+func NewReceiptSigner(cfg ReceiptConfig) *ReceiptSigner {
+	if len(cfg.Keys) == 0 {
+		return nil
+	}
+	keys := make([][]byte, len(cfg.Keys))
+	for i, key := range cfg.Keys {
+		keys[i] = []byte(key)
+	}
+	return &ReceiptSigner{keys: keys, issuer: cfg.Issuer}
+}
+
+// Sign returns the receipt of a stored asset. A nil signer returns "".
+func (s *ReceiptSigner) Sign(record AssetRecord) (string, error) {
+	if s == nil {
+		return "", nil
+	}
+	claims := ReceiptClaims{
+		Issuer:      s.issuer,
+		Bucket:      record.Bucket,
+		Object:      record.Name,
+		SHA256:      record.SHA256,
+		Size:        record.Size,
+		ContentType: record.ContentType,
+		Tenant:      record.Tenant,
+		IssuedAt:    record.CreatedAt.Unix(),
+	}
+	header, err := json.Marshal(receiptHeader{Alg: "HS256", Typ: "JWT", Kid: receiptKeyID(s.keys[0])})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + receiptSignature(s.keys[0], signed), nil
+}
+
+// Verify checks a receipt's signature and returns its claims
+func (s *ReceiptSigner) Verify(receipt string) (*ReceiptClaims, error) {
+	parts := strings.Split(receipt, ".")
+	if len(parts) != 3 {
+		return nil, errReceiptInvalid
+	}
+	var header receiptHeader
+	if err := decodeReceiptPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return nil, errReceiptInvalid
+	}
+
+	signed := parts[0] + "." + parts[1]
+	for _, key := range s.keys {
+		if header.Kid != "" && header.Kid != receiptKeyID(key) {
+			continue
+		}
+		if !hmac.Equal([]byte(parts[2]), []byte(receiptSignature(key, signed))) {
+			continue
+		}
+		var claims ReceiptClaims
+		if err := decodeReceiptPart(parts[1], &claims); err != nil {
+			return nil, errReceiptInvalid
+		}
+		return &claims, nil
+	}
+	return nil, errReceiptInvalid
+}
+
+// receiptSignature returns the base64url HMAC-SHA256 of the signed part under key
+func receiptSignature(key []byte, signed string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// receiptKeyID names a key without revealing it
+func receiptKeyID(key []byte) string {
+	return strings.TrimPrefix(secretFingerprint(string(key)), "sha256:")
+}
+
+func decodeReceiptPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ReceiptVerifyRequest is the body of a receipt verification
+type ReceiptVerifyRequest struct {
+	Receipt string `json:"receipt"`
+}
+
+// ReceiptVerifyResponse reports whether a receipt is genuine and what it vouches for
+type ReceiptVerifyResponse struct {
+	Success  bool           `json:"success"`
+	Valid    bool           `json:"valid"`
+	Claims   *ReceiptClaims `json:"claims,omitempty"`
+	IssuedAt *time.Time     `json:"issuedAt,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// HandleVerifyReceipt serves POST /receipts/verify for services that would
+// rather ask than hold the key. An invalid receipt is a 200 with valid false.
+func HandleVerifyReceipt(signer *ReceiptSigner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(ReceiptVerifyResponse{
+				Success: false,
+				Error:   "Method not allowed. Use POST.",
+			})
+			return
+		}
+
+		var req ReceiptVerifyRequest
+		if err := decodeJSONBody(w, r, &req, 0); err != nil {
+			w.WriteHeader(err.Status)
+			json.NewEncoder(w).Encode(ReceiptVerifyResponse{
+				Success: false,
+				Error:   err.Message,
+			})
+			return
+		}
+		if req.Receipt == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ReceiptVerifyResponse{
+				Success: false,
+				Error:   "A receipt is required",
+			})
+			return
+		}
+
+		claims, err := signer.Verify(req.Receipt)
+		if err != nil {
+			json.NewEncoder(w).Encode(ReceiptVerifyResponse{
+				Success: true,
+				Valid:   false,
+				Error:   err.Error(),
+			})
+			return
+		}
+		issuedAt := time.Unix(claims.IssuedAt, 0).UTC()
+		json.NewEncoder(w).Encode(ReceiptVerifyResponse{
+			Success:  true,
+			Valid:    true,
+			Claims:   claims,
+			IssuedAt: &issuedAt,
+		})
+	}
+}
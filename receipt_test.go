@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testReceiptRecord() AssetRecord {
+	return AssetRecord{
+		Bucket:      "images",
+		Name:        "products/cat.jpg",
+		SHA256:      "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+		Size:        1234,
+		ContentType: "image/jpeg",
+		Tenant:      "acme",
+		CreatedAt:   time.Unix(1700000000, 0),
+	}
+}
+
+func TestReceiptSignVerify(t *testing.T) {
+	signer := NewReceiptSigner(ReceiptConfig{Keys: []string{"new-key", "old-key"}, Issuer: "gcb"})
+	receipt, err := signer.Sign(testReceiptRecord())
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := signer.Verify(receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ReceiptClaims{Issuer: "gcb", Bucket: "images", Object: "products/cat.jpg", SHA256: testReceiptRecord().SHA256, Size: 1234, ContentType: "image/jpeg", Tenant: "acme", IssuedAt: 1700000000}
+	if *claims != want {
+		t.Errorf("claims %+v, want %+v", *claims, want)
+	}
+
+	// Any HS256 JWT library verifies it with the shared key
+	parts := strings.Split(receipt, ".")
+	mac := hmac.New(sha256.New, []byte("new-key"))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if parts[2] != base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) {
+		t.Error("signature isn't the HS256 of the header and claims")
+	}
+
+	// Receipts signed before a key rotation stay valid
+	old, _ := NewReceiptSigner(ReceiptConfig{Keys: []string{"old-key"}, Issuer: "gcb"}).Sign(testReceiptRecord())
+	if _, err := signer.Verify(old); err != nil {
+		t.Errorf("receipt of the previous key: %v", err)
+	}
+}
+
+func TestReceiptVerifyRejects(t *testing.T) {
+	signer := NewReceiptSigner(ReceiptConfig{Keys: []string{"new-key"}, Issuer: "gcb"})
+	receipt, _ := signer.Sign(testReceiptRecord())
+	parts := strings.Split(receipt, ".")
+
+	record := testReceiptRecord()
+	record.Size = 1
+	resized, _ := signer.Sign(record)
+	stranger, _ := NewReceiptSigner(ReceiptConfig{Keys: []string{"stranger-key"}}).Sign(testReceiptRecord())
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+
+	for name, receipt := range map[string]string{
+		"malformed":         "not-a-receipt",
+		"tampered claims":   parts[0] + "." + strings.Split(resized, ".")[1] + "." + parts[2],
+		"tampered sig":      parts[0] + "." + parts[1] + "." + strings.Repeat("A", len(parts[2])),
+		"unsigned":          none + "." + parts[1] + ".",
+		"other key":         stranger,
+		"truncated":         parts[0] + "." + parts[1],
+		"undecodable parts": "%%%." + parts[1] + "." + parts[2],
+	} {
+		if claims, err := signer.Verify(receipt); err != errReceiptInvalid {
+			t.Errorf("%s: %+v, %v, want %v", name, claims, err, errReceiptInvalid)
+		}
+	}
+}
+
+func TestHandleVerifyReceipt(t *testing.T) {
+	signer := NewReceiptSigner(ReceiptConfig{Keys: []string{"new-key"}, Issuer: "gcb"})
+	receipt, _ := signer.Sign(testReceiptRecord())
+	handler := HandleVerifyReceipt(signer)
+
+	verify := func(body string) (int, ReceiptVerifyResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/receipts/verify", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		var resp ReceiptVerifyResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp
+	}
+
+	status, resp := verify(`{"receipt":"` + receipt + `"}`)
+	if status != http.StatusOK || !resp.Valid || resp.Claims.Object != "products/cat.jpg" || !resp.IssuedAt.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("genuine receipt: status %d, %+v", status, resp)
+	}
+	status, resp = verify(`{"receipt":"` + receipt + `x"}`)
+	if status != http.StatusOK || resp.Valid || resp.Claims != nil {
+		t.Errorf("forged receipt: status %d, %+v, want valid false", status, resp)
+	}
+	if status, _ := verify(`{}`); status != http.StatusBadRequest {
+		t.Errorf("no receipt: status %d, want 400", status)
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Lifecycle rule actions
+const (
+	LifecycleDelete          = "Delete"
+	LifecycleSetStorageClass = "SetStorageClass"
+)
+
+// LifecycleRule deletes or re-classes objects once they reach an age
+type LifecycleRule struct {
+	Action        string   `json:"action"`                 // Delete or SetStorageClass
+	StorageClass  string   `json:"storageClass,omitempty"` // target class for SetStorageClass, e.g. NEARLINE
+	AgeDays       int64    `json:"ageDays"`
+	MatchesPrefix []string `json:"matchesPrefix,omitempty"`
+	MatchesSuffix []string `json:"matchesSuffix,omitempty"`
+}
+
+// BucketSettings is the managed configuration of a bucket. A nil field is
+// not managed and left as it is; an empty one is enforced as empty. Labels
+// only manage the listed keys, so labels set elsewhere (e.g. for billing)
+// survive.
+type BucketSettings struct {
+	CORS      []CORSRule        `json:"cors,omitempty"`
+	Lifecycle []LifecycleRule   `json:"lifecycle,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// BucketSettingsFile maps bucket names to their lifecycle rules and labels.
+// The "*" entry applies to buckets without their own entry.
+type BucketSettingsFile map[string]BucketSettings
+
+// labelKeyPattern and labelValuePattern match the label keys and values GCS accepts
+var (
+	labelKeyPattern   = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+	labelValuePattern = regexp.MustCompile(`^[a-z0-9_-]{0,63}$`)
+)
+
+// validateLabel checks a label against the GCS naming rules
+func validateLabel(key, value string) error {
+	if !labelKeyPattern.MatchString(key) {
+		return fmt.Errorf("invalid label key %q", key)
+	}
+	if !labelValuePattern.MatchString(value) {
+		return fmt.Errorf("invalid value %q of label %s", value, key)
+	}
+	return nil
+}
+
+// parseBucketLabels parses labels such as "team=web", e.g. from BUCKET_LABELS
+func parseBucketLabels(entries []string) (map[string]string, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	labels := map[string]string{}
+	for _, entry := range entries {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("label %q must be key=value", entry)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if err := validateLabel(key, value); err != nil {
+			return nil, err
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// LoadBucketSettings reads the per-bucket lifecycle rules and labels from a JSON file, e.g.
+//
+//	{"my-bucket": {"lifecycle": [{"action": "Delete", "ageDays": 30, "matchesPrefix": ["tmp/"]}], "labels": {"team": "web"}}}
+//
+// CORS rules stay in CORS_CONFIG_FILE. An empty path returns an empty config,
+// so only CORS is managed.
+func LoadBucketSettings(path string) (BucketSettingsFile, error) {
+	settings := BucketSettingsFile{}
+	if path == "" {
+		return settings, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bucket settings: %w", err)
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("failed to parse bucket settings %s: %w", path, err)
+	}
+
+	for bucket, s := range settings {
+		if s.CORS != nil {
+			return nil, fmt.Errorf("bucket %s: CORS rules belong in CORS_CONFIG_FILE", bucket)
+		}
+		for i, rule := range s.Lifecycle {
+			switch {
+			case rule.Action != LifecycleDelete && rule.Action != LifecycleSetStorageClass:
+				return nil, fmt.Errorf("lifecycle rule %d for bucket %s: action must be %s or %s", i, bucket, LifecycleDelete, LifecycleSetStorageClass)
+			case rule.Action == LifecycleSetStorageClass && rule.StorageClass == "":
+				return nil, fmt.Errorf("lifecycle rule %d for bucket %s: %s needs a storageClass", i, bucket, LifecycleSetStorageClass)
+			case rule.AgeDays < 0:
+				return nil, fmt.Errorf("lifecycle rule %d for bucket %s has a negative ageDays", i, bucket)
+			}
+		}
+		for key, value := range s.Labels {
+			if err := validateLabel(key, value); err != nil {
+				return nil, fmt.Errorf("bucket %s: %w", bucket, err)
+			}
+		}
+	}
+	return settings, nil
+}
+
+// Settings returns the desired settings of a bucket with the given CORS
+// rules. labels, usually from BUCKET_LABELS, are added to the labels of the
+// file, which win for keys set in both.
+func (f BucketSettingsFile) Settings(bucket string, cors []CORSRule, labels map[string]string) BucketSettings {
+	settings, ok := f[bucket]
+	if !ok {
+		settings = f["*"]
+	}
+	settings.CORS = cors
+	if len(labels) > 0 {
+		merged := maps.Clone(labels)
+		maps.Copy(merged, settings.Labels)
+		settings.Labels = merged
+	}
+	return settings
+}
+
+// diffBucketSettings returns the changes that turn actual into desired and
+// the names of the settings that drifted
+func diffBucketSettings(desired, actual BucketSettings) (BucketSettings, []string) {
+	var changes BucketSettings
+	var drifted []string
+
+	if desired.CORS != nil && !slices.EqualFunc(desired.CORS, actual.CORS, sameCORSRule) {
+		changes.CORS = desired.CORS
+		drifted = append(drifted, "cors")
+	}
+	if desired.Lifecycle != nil && !slices.EqualFunc(desired.Lifecycle, actual.Lifecycle, sameLifecycleRule) {
+		changes.Lifecycle = desired.Lifecycle
+		drifted = append(drifted, "lifecycle")
+	}
+	for key, value := range desired.Labels {
+		if current, ok := actual.Labels[key]; !ok || current != value {
+			if changes.Labels == nil {
+				changes.Labels = map[string]string{}
+				drifted = append(drifted, "labels")
+			}
+			changes.Labels[key] = value
+		}
+	}
+	return changes, drifted
+}
+
+// sameCORSRule compares rules, treating nil and empty lists alike
+func sameCORSRule(a, b CORSRule) bool {
+	return slices.Equal(a.Origins, b.Origins) &&
+		slices.Equal(a.Methods, b.Methods) &&
+		slices.Equal(a.ResponseHeaders, b.ResponseHeaders) &&
+		a.MaxAgeSeconds == b.MaxAgeSeconds
+}
+
+// sameLifecycleRule compares rules, treating nil and empty lists alike
+func sameLifecycleRule(a, b LifecycleRule) bool {
+	return a.Action == b.Action &&
+		a.StorageClass == b.StorageClass &&
+		a.AgeDays == b.AgeDays &&
+		slices.Equal(a.MatchesPrefix, b.MatchesPrefix) &&
+		slices.Equal(a.MatchesSuffix, b.MatchesSuffix)
+}
+
+// BucketReconciler periodically compares the settings of each bucket with
+// the desired ones and fixes drift, e.g. CORS rules edited in the console.
+type BucketReconciler struct {
+	backends []Backend
+	desired  map[string]BucketSettings // by bucket name
+	interval time.Duration
+	stop     chan struct{}
+}
+
+// NewBucketReconciler creates a reconciler; an interval of 0 only reconciles on Start
+func NewBucketReconciler(backends []Backend, desired map[string]BucketSettings, interval time.Duration) *BucketReconciler {
+	return &BucketReconciler{
+		backends: backends,
+		desired:  desired,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start reconciles every bucket synchronously, so the settings are in place
+// before the server accepts uploads, and then periodically
+func (b *BucketReconciler) Start(ctx context.Context) {
+	for _, backend := range b.backends {
+		if _, ok := backend.(bucketSettingsManager); !ok {
+			log.Printf("ℹ️  Skipping bucket settings for %s (not supported by driver)", backend.Bucket())
+		}
+	}
+	b.reconcileAll(ctx)
+	if b.interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.stop:
+				return
+			case <-ticker.C:
+				b.reconcileAll(ctx)
+			}
+		}
+	}()
+}
+
+// Stop ends the periodic reconciliation
+func (b *BucketReconciler) Stop() {
+	close(b.stop)
+}
+
+// reconcileAll reconciles the buckets whose driver can manage settings
+func (b *BucketReconciler) reconcileAll(ctx context.Context) {
+	for _, backend := range b.backends {
+		manager, ok := backend.(bucketSettingsManager)
+		if !ok {
+			continue
+		}
+		err := b.reconcile(ctx, backend.Bucket(), manager)
+		if errors.Is(err, errors.ErrUnsupported) {
+			continue // a mirror whose primary driver has no bucket settings
+		}
+		if err != nil {
+			bucketReconcileErrorsTotal.WithLabelValues(backend.Bucket()).Inc()
+			log.Printf("⚠️  Failed to reconcile settings of bucket %s: %v", backend.Bucket(), err)
+		}
+	}
+}
+
+// reconcile fixes the drifted settings of one bucket
+func (b *BucketReconciler) reconcile(ctx context.Context, bucket string, manager bucketSettingsManager) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	actual, err := manager.BucketSettings(ctx)
+	if err != nil {
+		return err
+	}
+	changes, drifted := diffBucketSettings(b.desired[bucket], *actual)
+	if len(drifted) == 0 {
+		return nil
+	}
+
+	for _, setting := range drifted {
+		bucketDriftTotal.WithLabelValues(bucket, setting).Inc()
+	}
+	log.Printf("⚙️  Bucket %s drifted (%s), applying desired settings", bucket, strings.Join(drifted, ", "))
+	for _, rule := range changes.CORS {
+		log.Printf("   cors origins: %v, methods: %v, max age: %s", rule.Origins, rule.Methods, rule.MaxAge())
+	}
+	if err := manager.UpdateBucketSettings(ctx, changes); err != nil {
+		return err
+	}
+	log.Printf("✅ Bucket %s settings reconciled", bucket)
+	return nil
+}
+
+// BucketLabels are the current labels of a bucket next to the managed ones
+type BucketLabels struct {
+	Bucket  string            `json:"bucket"`
+	Labels  map[string]string `json:"labels"`            // as set on the bucket now
+	Managed map[string]string `json:"managed,omitempty"` // from BUCKET_LABELS and BUCKET_SETTINGS_FILE
+	Drifted []string          `json:"drifted,omitempty"` // managed keys missing or differing on the bucket
+	Error   string            `json:"error,omitempty"`
+}
+
+// BucketLabelsResponse is the response of GET /admin/buckets/labels
+type BucketLabelsResponse struct {
+	Success bool           `json:"success"`
+	Buckets []BucketLabels `json:"buckets,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// Labels reads the current labels of a bucket, or of every bucket when
+// bucket is empty, so storage costs can be checked against their
+// attribution. Buckets whose driver has no labels report an error.
+func (b *BucketReconciler) Labels(ctx context.Context, bucket string) []BucketLabels {
+	var result []BucketLabels
+	for _, backend := range b.backends {
+		if bucket != "" && backend.Bucket() != bucket {
+			continue
+		}
+		entry := BucketLabels{Bucket: backend.Bucket(), Managed: b.desired[backend.Bucket()].Labels}
+		manager, ok := backend.(bucketSettingsManager)
+		if !ok {
+			entry.Error = "Labels are not supported by the storage driver"
+			result = append(result, entry)
+			continue
+		}
+		actual, err := manager.BucketSettings(ctx)
+		switch {
+		case errors.Is(err, errors.ErrUnsupported):
+			entry.Error = "Labels are not supported by the storage driver"
+		case err != nil:
+			entry.Error = err.Error()
+		default:
+			entry.Labels = actual.Labels
+			if entry.Labels == nil {
+				entry.Labels = map[string]string{}
+			}
+			for _, key := range slices.Sorted(maps.Keys(entry.Managed)) {
+				if current, ok := actual.Labels[key]; !ok || current != entry.Managed[key] {
+					entry.Drifted = append(entry.Drifted, key)
+				}
+			}
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// HandleBucketLabels handles GET /admin/buckets/labels, optionally for one
+// ?bucket=. Labels are set from configuration and applied by the reconciler.
+func HandleBucketLabels(reconciler *BucketReconciler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(BucketLabelsResponse{
+				Success: false,
+				Error:   "Method not allowed. Use GET.",
+			})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+
+		bucket := r.URL.Query().Get("bucket")
+		buckets := reconciler.Labels(ctx, bucket)
+		if bucket != "" && len(buckets) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(BucketLabelsResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Unknown bucket %q", bucket),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(BucketLabelsResponse{
+			Success: true,
+			Buckets: buckets,
+		})
+	}
+}
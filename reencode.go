@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// ReencodeOptions controls paranoid mode, where raster images are fully
+// decoded and re-encoded before they are stored. Re-encoding keeps only the
+// pixels, which drops metadata chunks, appended data and polyglot payloads
+// (files that are both a valid PNG and an HTML/JS document).
+type ReencodeOptions struct {
+	MaxPixels   int // decompression bomb guard, checked before decoding
+	JPEGQuality int
+}
+
+// errInvalidImage is returned when an upload fails content validation
+var errInvalidImage = errors.New("invalid image")
+
+// reencodeFormats maps the extensions paranoid mode can re-encode to the
+// format name reported by image.DecodeConfig. The standard library has no
+// WebP or BMP codec, so those are rejected in paranoid mode.
+var reencodeFormats = map[string]string{
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".png":  "png",
+	".gif":  "gif",
+}
+
+// isRasterExt reports whether ext is a raster format; SVG is the only
+// allowed format that isn't
+func isRasterExt(ext string) bool {
+	return ext != ".svg"
+}
+
+// reencodeImage decodes data and encodes it again in the format of ext.
+// Content that doesn't decode, decodes to a different format than its
+// extension claims or is of a format without an encoder (WebP, BMP, SVG) is
+// rejected with errInvalidImage.
+func reencodeImage(data []byte, ext string, opts ReencodeOptions) ([]byte, error) {
+	want, ok := reencodeFormats[ext]
+	if ext == ".svg" {
+		// SVG is markup that can carry scripts; without a sanitizer it isn't stored
+		return nil, fmt.Errorf("%w: SVG files can't be sanitized and are not accepted", errInvalidImage)
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: %s files can't be verified and are not accepted", errInvalidImage, ext)
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: file could not be decoded", errInvalidImage)
+	}
+	if format != want {
+		return nil, fmt.Errorf("%w: content is %s but the file name says %s", errInvalidImage, format, ext)
+	}
+	if opts.MaxPixels > 0 && config.Width*config.Height > opts.MaxPixels {
+		return nil, fmt.Errorf("%w: %dx%d exceeds the limit of %d pixels", errInvalidImage, config.Width, config.Height, opts.MaxPixels)
+	}
+
+	var out bytes.Buffer
+	switch format {
+	case "gif":
+		// Keep every frame of animations
+		animation, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%w: file could not be decoded", errInvalidImage)
+		}
+		err = gif.EncodeAll(&out, animation)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%w: file could not be decoded", errInvalidImage)
+		}
+		if format == "png" {
+			err = png.Encode(&out, img)
+		} else {
+			err = jpeg.Encode(&out, img, &jpeg.Options{Quality: opts.JPEGQuality})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// readAllLimited reads r fully, failing with errUploadTooLarge past maxSize bytes
+func readAllLimited(r io.Reader, maxSize int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, errUploadTooLarge
+	}
+	return data, nil
+}
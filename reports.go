@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReportConfig holds the settings of the periodic storage report
+type ReportConfig struct {
+	Interval     time.Duration // time covered by each report, 0 disables reports
+	Prefix       string        // folder of the first bucket reports are written to, "" to skip
+	TopUploaders int
+}
+
+// BucketGrowth is the storage of one bucket in a report
+type BucketGrowth struct {
+	Bucket       string `json:"bucket"`
+	Objects      int64  `json:"objects"` // catalogued objects at the end of the period
+	Bytes        int64  `json:"bytes"`
+	AddedObjects int64  `json:"addedObjects"`
+	AddedBytes   int64  `json:"addedBytes"`
+}
+
+// UploaderUsage is the storage added by one uploader in a report
+type UploaderUsage struct {
+	Uploader string `json:"uploader"`
+	Objects  int64  `json:"objects"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// StorageReport summarizes storage growth, the top uploaders and the failure
+// rates of one period
+type StorageReport struct {
+	Since        time.Time       `json:"since"`
+	Until        time.Time       `json:"until"`
+	Buckets      []BucketGrowth  `json:"buckets"`
+	TopUploaders []UploaderUsage `json:"topUploaders"`
+	Requests     int64           `json:"requests"`
+	ServerErrors int64           `json:"serverErrors"` // 5xx responses
+	Writes       int64           `json:"writes"`       // POST, PUT, PATCH and DELETE requests
+	FailedWrites int64           `json:"failedWrites"` // writes answered with 4xx or 5xx
+	ErrorRate    float64         `json:"errorRate"`    // ServerErrors / Requests
+	FailureRate  float64         `json:"failureRate"`  // FailedWrites / Writes
+}
+
+// Reporter counts responses and periodically builds a StorageReport from
+// them and the metadata store, posting it to the notifier and writing it to
+// the report prefix
+type Reporter struct {
+	cfg      ReportConfig
+	backends map[string]Backend
+	target   Backend // bucket reports are written to
+
+	mu           sync.Mutex
+	since        time.Time
+	requests     int64
+	serverErrors int64
+	writes       int64
+	failedWrites int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// storageReporter is the process-wide reporter; nil when reports are disabled
+var storageReporter *Reporter
+
+// NewReporter creates a reporter; call Start to begin reporting
+func NewReporter(cfg ReportConfig, backends map[string]Backend, target Backend) *Reporter {
+	return &Reporter{
+		cfg:      cfg,
+		backends: backends,
+		target:   target,
+		since:    time.Now().UTC(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// RecordResponse counts a served response for the failure rates
+func (r *Reporter) RecordResponse(method string, statusCode int) {
+	if r == nil {
+		return
+	}
+	write := method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch || method == http.MethodDelete
+
+	r.mu.Lock()
+	r.requests++
+	if statusCode >= 500 {
+		r.serverErrors++
+	}
+	if write {
+		r.writes++
+		if statusCode >= 400 {
+			r.failedWrites++
+		}
+	}
+	r.mu.Unlock()
+}
+
+// Start reports at every multiple of the interval (midnight UTC for 24h)
+func (r *Reporter) Start() {
+	go func() {
+		defer close(r.done)
+		for {
+			now := time.Now().UTC()
+			next := now.Truncate(r.cfg.Interval).Add(r.cfg.Interval)
+			select {
+			case <-r.stop:
+				return
+			case <-time.After(next.Sub(now)):
+			}
+			r.publish(r.Report(true))
+		}
+	}()
+}
+
+// Stop ends the periodic reports
+func (r *Reporter) Stop() {
+	close(r.stop)
+	<-r.done
+}
+
+// Report builds the report of the period so far; reset starts a new period
+func (r *Reporter) Report(reset bool) StorageReport {
+	now := time.Now().UTC()
+	r.mu.Lock()
+	report := StorageReport{
+		Since:        r.since,
+		Until:        now,
+		Requests:     r.requests,
+		ServerErrors: r.serverErrors,
+		Writes:       r.writes,
+		FailedWrites: r.failedWrites,
+	}
+	if reset {
+		r.since = now
+		r.requests, r.serverErrors, r.writes, r.failedWrites = 0, 0, 0, 0
+	}
+	r.mu.Unlock()
+
+	if report.Requests > 0 {
+		report.ErrorRate = float64(report.ServerErrors) / float64(report.Requests)
+	}
+	if report.Writes > 0 {
+		report.FailureRate = float64(report.FailedWrites) / float64(report.Writes)
+	}
+
+	names := make([]string, 0, len(r.backends))
+	for name := range r.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	report.Buckets = make([]BucketGrowth, 0, len(names))
+	for _, name := range names {
+		growth := BucketGrowth{Bucket: name}
+		metadataStore.List(name, "", func(record AssetRecord) error {
+			if isQuarantineRecord(record) {
+				return nil
+			}
+			growth.Objects++
+			growth.Bytes += record.Size
+			if !record.CreatedAt.Before(report.Since) {
+				growth.AddedObjects++
+				growth.AddedBytes += record.Size
+			}
+			return nil
+		})
+		report.Buckets = append(report.Buckets, growth)
+	}
+
+	uploaders := map[string]*UploaderUsage{}
+	for _, record := range metadataStore.ListSince(report.Since, "") {
+		uploader := record.Uploader
+		if uploader == "" {
+			uploader = usageNoOrigin
+		}
+		usage, ok := uploaders[uploader]
+		if !ok {
+			usage = &UploaderUsage{Uploader: uploader}
+			uploaders[uploader] = usage
+		}
+		usage.Objects++
+		usage.Bytes += record.Size
+	}
+	report.TopUploaders = make([]UploaderUsage, 0, len(uploaders))
+	for _, usage := range uploaders {
+		report.TopUploaders = append(report.TopUploaders, *usage)
+	}
+	sort.Slice(report.TopUploaders, func(i, j int) bool {
+		a, b := report.TopUploaders[i], report.TopUploaders[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Uploader < b.Uploader
+	})
+	if len(report.TopUploaders) > r.cfg.TopUploaders {
+		report.TopUploaders = report.TopUploaders[:r.cfg.TopUploaders]
+	}
+	return report
+}
+
+// publish posts the report to the notifier and writes it to the report prefix
+func (r *Reporter) publish(report StorageReport) {
+	notifier.Send(NotifyReport, "", report.Summary(), time.Minute)
+
+	if r.cfg.Prefix == "" || r.target == nil {
+		return
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Printf("⚠️  Failed to encode storage report: %v", err)
+		return
+	}
+	name := strings.Trim(r.cfg.Prefix, "/") + "/" + report.Since.Format("2006-01-02T1504Z") + ".json"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := r.target.Put(ctx, name, bytes.NewReader(data), PutOptions{ContentType: "application/json"}); err != nil {
+		log.Printf("⚠️  Failed to write storage report %s: %v", name, err)
+		return
+	}
+	log.Printf("📊 Storage report written to %s/%s", r.target.Bucket(), name)
+}
+
+// Summary formats the report as a chat message
+func (report StorageReport) Summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "📊 Storage report %s – %s\n", report.Since.Format("2006-01-02 15:04"), report.Until.Format("2006-01-02 15:04 UTC"))
+	for _, bucket := range report.Buckets {
+		fmt.Fprintf(&b, "• %s: +%d objects, +%.1f MB (%d objects, %.1f MB total)\n",
+			bucket.Bucket, bucket.AddedObjects, float64(bucket.AddedBytes)/(1024*1024), bucket.Objects, float64(bucket.Bytes)/(1024*1024))
+	}
+	if len(report.TopUploaders) > 0 {
+		b.WriteString("Top uploaders:\n")
+		for i, usage := range report.TopUploaders {
+			fmt.Fprintf(&b, "%d. %s: %d objects, %.1f MB\n", i+1, usage.Uploader, usage.Objects, float64(usage.Bytes)/(1024*1024))
+		}
+	}
+	fmt.Fprintf(&b, "Requests: %d, server errors %.2f%%; writes: %d, failed %.2f%%",
+		report.Requests, report.ErrorRate*100, report.Writes, report.FailureRate*100)
+	return b.String()
+}
+
+// HandleReport serves GET /admin/report, the report of the current period so far
+func HandleReport(reporter *Reporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(map[string]any{
+				"success": false,
+				"error":   "Method not allowed. Use GET.",
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(reporter.Report(false))
+	}
+}
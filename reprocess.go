@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits of the reprocessing queue
+const (
+	reprocessQueueSize = 100 // jobs waiting to run
+	maxReprocessJobs   = 100 // finished jobs kept for their progress
+)
+
+// Reprocess job statuses
+const (
+	ReprocessQueued  = "queued"
+	ReprocessRunning = "running"
+	ReprocessDone    = "done"
+	ReprocessFailed  = "failed" // the job stopped, e.g. the listing failed
+)
+
+// errReprocessQueueFull is returned when too many jobs are waiting
+var errReprocessQueueFull = errors.New("too many reprocessing jobs queued, retry later")
+
+// ReprocessProgress reports the state of a reprocessing job
+type ReprocessProgress struct {
+	ID         string    `json:"id"`
+	Bucket     string    `json:"bucket"`
+	Object     string    `json:"object,omitempty"` // single-object job
+	Prefix     string    `json:"prefix,omitempty"` // bulk job
+	Profile    string    `json:"profile,omitempty"`
+	Status     string    `json:"status"`
+	Listed     int64     `json:"listed"`
+	Processed  int64     `json:"processed"`
+	Failed     int64     `json:"failed"`
+	QueuedAt   time.Time `json:"queuedAt"`
+	StartedAt  time.Time `json:"startedAt,omitempty"`
+	FinishedAt time.Time `json:"finishedAt,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Failures   []string  `json:"failures,omitempty"`
+}
+
+// reprocessJob is a queued or running job; progress is guarded by mu
+type reprocessJob struct {
+	backend Backend
+
+	mu       sync.Mutex
+	progress ReprocessProgress
+}
+
+// Snapshot returns a consistent copy of the progress
+func (j *reprocessJob) Snapshot() ReprocessProgress {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	p := j.progress
+	p.Failures = append([]string(nil), j.progress.Failures...)
+	return p
+}
+
+// update changes the progress under the lock
+func (j *reprocessJob) update(fn func(*ReprocessProgress)) {
+	j.mu.Lock()
+	fn(&j.progress)
+	j.mu.Unlock()
+}
+
+// Reprocessor re-runs the processing pipeline on stored originals, e.g.
+// after the poster settings or a rendition plugin changed. Jobs run one at a
+// time from a queue, each working on several objects at once. Only the
+// validate and persist phases run: the original is never rewritten, and no
+// upload event is published again.
+type Reprocessor struct {
+	config      *Config
+	concurrency int
+
+	mu     sync.Mutex
+	jobs   map[string]*reprocessJob
+	order  []string // job ids, oldest first
+	nextID int
+
+	queue  chan *reprocessJob
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewReprocessor creates the reprocessing queue; call Start to run jobs
+func NewReprocessor(config *Config, concurrency int) *Reprocessor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Reprocessor{
+		config:      config,
+		concurrency: max(concurrency, 1),
+		jobs:        map[string]*reprocessJob{},
+		queue:       make(chan *reprocessJob, reprocessQueueSize),
+		ctx:         ctx,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+}
+
+// Start runs the queued jobs in order
+func (p *Reprocessor) Start() {
+	go func() {
+		defer close(p.done)
+		for {
+			select {
+			case <-p.ctx.Done():
+				return
+			case job := <-p.queue:
+				p.run(job)
+			}
+		}
+	}()
+}
+
+// Stop abandons the running job and the queued ones
+func (p *Reprocessor) Stop() {
+	p.cancel()
+	<-p.done
+}
+
+// Enqueue queues a job reprocessing one object, or every object under
+// prefix when object is empty
+func (p *Reprocessor) Enqueue(backend Backend, object, prefix, profile string) (ReprocessProgress, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.nextID++
+	job := &reprocessJob{
+		backend: backend,
+		progress: ReprocessProgress{
+			ID:       fmt.Sprintf("%d", p.nextID),
+			Bucket:   backend.Bucket(),
+			Object:   object,
+			Prefix:   prefix,
+			Profile:  profile,
+			Status:   ReprocessQueued,
+			QueuedAt: time.Now().UTC(),
+		},
+	}
+	select {
+	case p.queue <- job:
+	default:
+		return ReprocessProgress{}, errReprocessQueueFull
+	}
+
+	p.jobs[job.progress.ID] = job
+	p.order = append(p.order, job.progress.ID)
+	p.prune()
+	return job.Snapshot(), nil
+}
+
+// prune forgets the oldest finished jobs beyond maxReprocessJobs
+func (p *Reprocessor) prune() {
+	for i := 0; len(p.jobs) > maxReprocessJobs && i < len(p.order); {
+		id := p.order[i]
+		if status := p.jobs[id].Snapshot().Status; status != ReprocessDone && status != ReprocessFailed {
+			i++
+			continue
+		}
+		delete(p.jobs, id)
+		p.order = append(p.order[:i], p.order[i+1:]...)
+	}
+}
+
+// Get returns the progress of a job
+func (p *Reprocessor) Get(id string) (ReprocessProgress, bool) {
+	p.mu.Lock()
+	job, ok := p.jobs[id]
+	p.mu.Unlock()
+	if !ok {
+		return ReprocessProgress{}, false
+	}
+	return job.Snapshot(), true
+}
+
+// run reprocesses the objects of a job with the configured concurrency
+func (p *Reprocessor) run(job *reprocessJob) {
+	job.update(func(progress *ReprocessProgress) {
+		progress.Status = ReprocessRunning
+		progress.StartedAt = time.Now().UTC()
+	})
+	progress := job.Snapshot()
+	backend := job.backend
+
+	names := make(chan string)
+	var wg sync.WaitGroup
+	for range p.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				err := reprocessObject(p.ctx, backend, p.config, name, progress.Profile)
+				if err != nil {
+					reprocessedObjectsTotal.WithLabelValues("failure").Inc()
+					log.Printf("⚠️  Failed to reprocess %s/%s: %v", backend.Bucket(), name, err)
+				} else {
+					reprocessedObjectsTotal.WithLabelValues("success").Inc()
+				}
+				job.update(func(progress *ReprocessProgress) {
+					if err == nil {
+						progress.Processed++
+						return
+					}
+					progress.Failed++
+					if len(progress.Failures) < maxReportedFailures {
+						progress.Failures = append(progress.Failures, fmt.Sprintf("%s: %v", name, err))
+					}
+				})
+			}
+		}()
+	}
+
+	var err error
+	if progress.Object != "" {
+		job.update(func(progress *ReprocessProgress) { progress.Listed++ })
+		names <- progress.Object
+	} else {
+		err = backend.List(p.ctx, progress.Prefix, func(obj ObjectInfo) error {
+			// Encrypted objects can't be read without the key of their owner
+			if !reprocessable(obj.Name) || obj.Encrypted {
+				return nil
+			}
+			job.update(func(progress *ReprocessProgress) { progress.Listed++ })
+			select {
+			case names <- obj.Name:
+				return nil
+			case <-p.ctx.Done():
+				return p.ctx.Err()
+			}
+		})
+	}
+	close(names)
+	wg.Wait()
+
+	job.update(func(progress *ReprocessProgress) {
+		progress.FinishedAt = time.Now().UTC()
+		progress.Status = ReprocessDone
+		if err != nil {
+			progress.Status = ReprocessFailed
+			progress.Error = err.Error()
+		}
+	})
+	progress = job.Snapshot()
+	log.Printf("🔁 Reprocessing %s of %s/%s finished: %d processed, %d failed", progress.ID, progress.Bucket, progress.Object+progress.Prefix, progress.Processed, progress.Failed)
+}
+
+// reprocessable reports whether an object is an original the pipeline runs
+// on: not a rendition, and not hidden in quarantine or staging
+func reprocessable(name string) bool {
+	return !strings.HasSuffix(name, "/") && !strings.HasSuffix(name, ".poster.png") &&
+		!quarantine.Hides(name) && !staging.Hides(name)
+}
+
+// reprocessObject runs the validate and persist stages of the pipeline on a
+// stored object and saves the updated record. A validate stage rejecting
+// the object (e.g. after the animation limits were lowered) is reported as
+// a failure; the object is left as it is.
+func reprocessObject(ctx context.Context, backend Backend, config *Config, name, profile string) error {
+	reader, info, err := backend.Open(ctx, name)
+	if err != nil {
+		return err
+	}
+	data, err := readAllLimited(reader, max(info.Size, config.MaxFileSize))
+	reader.Close()
+	if err != nil {
+		return err
+	}
+
+	record, ok := metadataStore.Get(backend.Bucket(), name)
+	if !ok {
+		// Stored before the catalog existed, or behind its back
+		record = AssetRecord{
+			Bucket:      backend.Bucket(),
+			Name:        name,
+			Size:        info.Size,
+			ContentType: info.ContentType,
+			CreatedAt:   info.Updated,
+		}
+	}
+
+	job := &PipelineJob{
+		Options: IngestOptions{
+			Filename: name,
+			Size:     info.Size,
+			MaxSize:  max(info.Size, config.MaxFileSize),
+			Tenant:   record.Tenant,
+			Uploader: record.Uploader,
+			Origin:   record.Origin,
+			Source:   record.Source,
+			PHash:    config.PerceptualHash,
+			PHashMax: config.PHashMaxPixels,
+			Animated: &config.Animation,
+			Metadata: record.Metadata,
+			Tags:     record.Tags,
+			Profile:  profile,
+		},
+		Backend: backend,
+		Ext:     strings.ToLower(filepath.Ext(name)),
+		Data:    data,
+		Info:    info,
+		Record:  record,
+	}
+	stages := processingPipelines.For(backend.Bucket(), record.Tenant, profile)
+	if err := runPhase(ctx, job, stages, PhaseValidate); err != nil {
+		return err
+	}
+	if err := runPhase(ctx, job, stages, PhasePersist); err != nil {
+		return err
+	}
+	return metadataStore.Put(job.Record)
+}
+
+// ReprocessRequest is the body of POST /objects/reprocess
+type ReprocessRequest struct {
+	Prefix  string `json:"prefix"`
+	Profile string `json:"profile,omitempty"` // processing profile of the pipeline config
+}
+
+// ReprocessResponse is returned when a job is queued
+type ReprocessResponse struct {
+	Success bool   `json:"success"`
+	ID      string `json:"id,omitempty"`
+	Status  string `json:"status,omitempty"` // URL of the job's progress
+	Error   string `json:"error,omitempty"`
+}
+
+// HandleReprocess queues a job reprocessing every object under a prefix
+// (POST) and reports the progress of jobs (GET ?id=), at mountPath, e.g.
+// /objects/reprocess
+func HandleReprocess(backend Backend, reprocessor *Reprocessor, mountPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		switch r.Method {
+		case http.MethodGet:
+			progress, ok := reprocessor.Get(r.URL.Query().Get("id"))
+			if !ok || progress.Bucket != backend.Bucket() {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   "Reprocessing job not found",
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(progress)
+
+		case http.MethodPost:
+			var req ReprocessRequest
+			if err := decodeJSONBody(w, r, &req, 0); err != nil {
+				w.WriteHeader(err.Status)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   err.Message,
+				})
+				return
+			}
+			enqueueReprocess(w, backend, reprocessor, "", req.Prefix, req.Profile, mountPath)
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "Method not allowed. Use GET or POST.",
+			})
+		}
+	}
+}
+
+// HandleReprocessObject queues a job reprocessing one object, for
+// POST {mountPath}{name}/reprocess[?profile=]. Progress is reported by
+// HandleReprocess at statusPath.
+func HandleReprocessObject(backend Backend, reprocessor *Reprocessor, mountPath, statusPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "Method not allowed. Use POST.",
+			})
+			return
+		}
+
+		name, ok := objectPathName(r, mountPath, "/reprocess")
+		if !ok || name == "" || !reprocessable(name) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Not found. Use %s{name}/reprocess", mountPath),
+			})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), serverWriteTimeout)
+		defer cancel()
+		info, err := backend.Stat(ctx, name)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrObjectNotFound) {
+				status = http.StatusNotFound
+			}
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+		if info.Encrypted {
+			// Jobs run after the request, without the key of the owner
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "Objects encrypted with a customer-supplied key can't be reprocessed",
+			})
+			return
+		}
+		enqueueReprocess(w, backend, reprocessor, name, "", r.URL.Query().Get("profile"), statusPath)
+	}
+}
+
+// enqueueReprocess queues a job and answers 202 with its progress URL
+func enqueueReprocess(w http.ResponseWriter, backend Backend, reprocessor *Reprocessor, object, prefix, profile, statusPath string) {
+	if profile != "" && !processingPipelines.HasProfile(profile) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ReprocessResponse{
+			Success: false,
+			Error:   fmt.Sprintf("profile %q is not defined in the pipeline config", profile),
+		})
+		return
+	}
+
+	progress, err := reprocessor.Enqueue(backend, object, prefix, profile)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(ReprocessResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(ReprocessResponse{
+		Success: true,
+		ID:      progress.ID,
+		Status:  fmt.Sprintf("%s?id=%s", statusPath, progress.ID),
+	})
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxRetentionDays is the longest retention period GCS accepts (100 years)
+const maxRetentionDays = 36500
+
+// RetentionPolicy keeps every object of a bucket from being deleted or
+// replaced until it reaches the retention period
+type RetentionPolicy struct {
+	PeriodSeconds int64     `json:"periodSeconds"`
+	EffectiveTime time.Time `json:"effectiveTime"`
+	Locked        bool      `json:"locked"` // a locked policy can only be extended
+}
+
+// ObjectRetention describes what keeps an object from being deleted
+type ObjectRetention struct {
+	Name           string    `json:"name"`
+	TemporaryHold  bool      `json:"temporaryHold"`
+	EventBasedHold bool      `json:"eventBasedHold"`
+	RetainUntil    time.Time `json:"retainUntil,omitzero"` // set by the bucket retention policy
+}
+
+// Held reports whether the object can't be deleted at the given time
+func (r *ObjectRetention) Held(now time.Time) bool {
+	return r.TemporaryHold || r.EventBasedHold || now.Before(r.RetainUntil)
+}
+
+// checkDeletable returns ErrObjectHeld when a hold or the retention policy
+// keeps an object from being deleted. Objects of backends without retention
+// support are never held.
+func checkDeletable(ctx context.Context, backend Backend, name string) error {
+	manager, ok := backend.(retentionManager)
+	if !ok {
+		return nil
+	}
+	retention, err := manager.ObjectRetention(ctx, name)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if retention.Held(time.Now()) {
+		return ErrObjectHeld
+	}
+	return nil
+}
+
+// RetentionResponse is the response of the retention policy endpoints
+type RetentionResponse struct {
+	Success bool             `json:"success"`
+	Bucket  string           `json:"bucket,omitempty"`
+	Policy  *RetentionPolicy `json:"policy"` // null when the bucket has none
+	Error   string           `json:"error,omitempty"`
+}
+
+// HoldResponse is the response of the object hold endpoints
+type HoldResponse struct {
+	Success   bool             `json:"success"`
+	Retention *ObjectRetention `json:"retention,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// retentionBackend returns the retention manager of a registered bucket and
+// the HTTP status to use when there is none
+func retentionBackend(backends map[string]Backend, bucket string) (retentionManager, int, error) {
+	backend, ok := backends[bucket]
+	if !ok {
+		return nil, http.StatusBadRequest, errors.New("bucket must be a registered bucket")
+	}
+	manager, ok := backend.(retentionManager)
+	if !ok {
+		return nil, http.StatusNotImplemented, fmt.Errorf("bucket %s does not support retention", bucket)
+	}
+	return manager, 0, nil
+}
+
+// retentionStatus maps a retention manager error to an HTTP status
+func retentionStatus(err error) int {
+	switch {
+	case errors.Is(err, errors.ErrUnsupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, ErrObjectNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// HandleRetention serves the bucket retention policy:
+//   - GET /admin/retention?bucket= returns the policy
+//   - PUT /admin/retention?bucket=&days= sets the retention period, 0 removes it
+//   - POST /admin/retention/lock?bucket=&confirm={bucket} locks the policy for good
+func HandleRetention(backends map[string]Backend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		query := r.URL.Query()
+		bucket := query.Get("bucket")
+		manager, status, err := retentionBackend(backends, bucket)
+		if err != nil {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(RetentionResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), serverWriteTimeout)
+		defer cancel()
+
+		lock := r.URL.Path == "/admin/retention/lock"
+		switch {
+		case lock && r.Method == http.MethodPost:
+			// Locking can't be undone, so the bucket name has to be typed twice
+			if query.Get("confirm") != bucket {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(RetentionResponse{
+					Success: false,
+					Error:   "Locking is permanent; repeat the bucket name in confirm to proceed",
+				})
+				return
+			}
+			if err := manager.LockRetentionPolicy(ctx); err != nil {
+				w.WriteHeader(retentionStatus(err))
+				json.NewEncoder(w).Encode(RetentionResponse{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+			log.Printf("🔒 Retention policy of %s locked", bucket)
+
+		case !lock && r.Method == http.MethodPut:
+			days, err := strconv.Atoi(query.Get("days"))
+			if err != nil || days < 0 || days > maxRetentionDays {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(RetentionResponse{
+					Success: false,
+					Error:   fmt.Sprintf("days must be between 0 and %d", maxRetentionDays),
+				})
+				return
+			}
+			period := time.Duration(days) * 24 * time.Hour
+
+			current, err := manager.RetentionPolicy(ctx)
+			if err != nil {
+				w.WriteHeader(retentionStatus(err))
+				json.NewEncoder(w).Encode(RetentionResponse{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+			if current != nil && current.Locked && int64(period/time.Second) < current.PeriodSeconds {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(RetentionResponse{
+					Success: false,
+					Bucket:  bucket,
+					Policy:  current,
+					Error:   "The retention policy is locked and can only be extended",
+				})
+				return
+			}
+			if err := manager.SetRetentionPolicy(ctx, period); err != nil {
+				w.WriteHeader(retentionStatus(err))
+				json.NewEncoder(w).Encode(RetentionResponse{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+			log.Printf("🔒 Retention period of %s set to %d days", bucket, days)
+
+		case !lock && r.Method == http.MethodGet:
+			// Nothing to change, the policy is reported below
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(RetentionResponse{
+				Success: false,
+				Error:   "Method not allowed. Use GET or PUT on /admin/retention, POST on /admin/retention/lock.",
+			})
+			return
+		}
+
+		policy, err := manager.RetentionPolicy(ctx)
+		if err != nil {
+			w.WriteHeader(retentionStatus(err))
+			json.NewEncoder(w).Encode(RetentionResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(RetentionResponse{
+			Success: true,
+			Bucket:  bucket,
+			Policy:  policy,
+		})
+	}
+}
+
+// HandleHolds serves the temporary holds of objects:
+//   - GET /admin/holds?bucket=&name= returns the object's holds and retention expiry
+//   - PUT /admin/holds?bucket=&name= places a temporary hold
+//   - DELETE /admin/holds?bucket=&name= releases the temporary hold
+func HandleHolds(backends map[string]Backend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodGet && r.Method != http.MethodPut && r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(HoldResponse{
+				Success: false,
+				Error:   "Method not allowed. Use GET, PUT or DELETE.",
+			})
+			return
+		}
+
+		query := r.URL.Query()
+		bucket, name := query.Get("bucket"), query.Get("name")
+		manager, status, err := retentionBackend(backends, bucket)
+		if err == nil && name == "" {
+			status, err = http.StatusBadRequest, errors.New("name is required")
+		}
+		if err != nil {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(HoldResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), serverWriteTimeout)
+		defer cancel()
+
+		if r.Method != http.MethodGet {
+			held := r.Method == http.MethodPut
+			if err := manager.SetTemporaryHold(ctx, name, held); err != nil {
+				w.WriteHeader(retentionStatus(err))
+				json.NewEncoder(w).Encode(HoldResponse{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+			if held {
+				log.Printf("🔒 Temporary hold placed on %s/%s", bucket, name)
+			} else {
+				log.Printf("🔓 Temporary hold released from %s/%s", bucket, name)
+			}
+		}
+
+		retention, err := manager.ObjectRetention(ctx, name)
+		if err != nil {
+			w.WriteHeader(retentionStatus(err))
+			json.NewEncoder(w).Encode(HoldResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(HoldResponse{
+			Success:   true,
+			Retention: retention,
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Auth levels a route policy can require
+const (
+	RouteAuthNone  = "none"
+	RouteAuthRead  = "read"  // the write or read API key
+	RouteAuthWrite = "write" // the write API key
+	RouteAuthAdmin = "admin" // the admin API key or an OIDC session
+)
+
+var routeAuthLevels = []string{RouteAuthNone, RouteAuthRead, RouteAuthWrite, RouteAuthAdmin}
+
+// maxRateClients caps the clients tracked per rate class before idle ones are forgotten
+const maxRateClients = 10000
+
+// RoutePolicy sets the limits of the routes matching a pattern. Zero fields
+// leave the server defaults in place.
+type RoutePolicy struct {
+	Pattern        string `json:"pattern"`                  // http.ServeMux pattern, e.g. "POST /upload/batch" or "/admin/"
+	MaxBodyBytes   int64  `json:"maxBodyBytes,omitempty"`   // request bodies are cut off beyond this
+	TimeoutSeconds int64  `json:"timeoutSeconds,omitempty"` // replaces the server read/write timeouts
+	Auth           string `json:"auth,omitempty"`           // required on top of the route's own auth
+	RateClass      string `json:"rateClass,omitempty"`      // rate class shared with other routes
+}
+
+// timeout returns the timeout of the policy, 0 when it has none
+func (p RoutePolicy) timeout() time.Duration {
+	return time.Duration(p.TimeoutSeconds) * time.Second
+}
+
+// RateClass limits the requests of each client (API key, or IP without one)
+// to the routes of the class together
+type RateClass struct {
+	RequestsPerMinute int `json:"requestsPerMinute"`
+	Burst             int `json:"burst,omitempty"` // requests allowed at once, defaults to RequestsPerMinute
+}
+
+// RoutePolicyFile is the format of ROUTE_POLICY_FILE
+type RoutePolicyFile struct {
+	RateClasses map[string]RateClass `json:"rateClasses,omitempty"`
+	Routes      []RoutePolicy        `json:"routes"`
+}
+
+// defaultRoutePolicies are the limits of routes that can't live with the
+// server defaults. A policy in ROUTE_POLICY_FILE with the same pattern
+// replaces the default one.
+var defaultRoutePolicies = []RoutePolicy{
+	// Long transfers outlive the server timeouts
+	{Pattern: "/upload/batch", TimeoutSeconds: 30 * 60},
+	{Pattern: "/upload-dev/batch", TimeoutSeconds: 30 * 60},
+	{Pattern: "/v1/upload/batch", TimeoutSeconds: 30 * 60},
+	{Pattern: "/v1/upload-dev/batch", TimeoutSeconds: 30 * 60},
+	{Pattern: "/upload/tus/", TimeoutSeconds: 30 * 60},
+	{Pattern: "/upload-dev/tus/", TimeoutSeconds: 30 * 60},
+	{Pattern: "/objects/archive", TimeoutSeconds: 30 * 60},
+	{Pattern: "/objects/archive-dev", TimeoutSeconds: 30 * 60},
+	{Pattern: "/admin/import", TimeoutSeconds: 60 * 60},
+	{Pattern: "/admin/export", TimeoutSeconds: 30 * 60},
+	{Pattern: "/inbound/email", TimeoutSeconds: 5 * 60},
+	// JSON requests are small
+	{Pattern: "/admin/collections", MaxBodyBytes: 64 * 1024},
+	{Pattern: "/admin/collections/", MaxBodyBytes: 64 * 1024},
+	{Pattern: "/receipts/verify", MaxBodyBytes: 64 * 1024},
+	{Pattern: "/objects/stat", MaxBodyBytes: 1 << 20},
+	{Pattern: "/objects/stat-dev", MaxBodyBytes: 1 << 20},
+}
+
+// RoutePolicies is the route policy table: the default policies with those
+// of ROUTE_POLICY_FILE applied over them
+type RoutePolicies struct {
+	routes  []RoutePolicy
+	classes map[string]RateClass
+}
+
+// LoadRoutePolicies reads the route policy table from a JSON file, e.g.
+//
+//	{"rateClasses": {"uploads": {"requestsPerMinute": 60, "burst": 10}},
+//	 "routes": [{"pattern": "POST /upload", "maxBodyBytes": 20971520, "rateClass": "uploads"}]}
+//
+// An empty path returns the default policies.
+func LoadRoutePolicies(path string) (*RoutePolicies, error) {
+	file := RoutePolicyFile{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read route policies: %w", err)
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("failed to parse route policies %s: %w", path, err)
+		}
+	}
+
+	routes := slices.Clone(defaultRoutePolicies)
+	for _, policy := range file.Routes {
+		i := slices.IndexFunc(routes, func(p RoutePolicy) bool { return p.Pattern == policy.Pattern })
+		if i >= 0 {
+			routes[i] = policy
+		} else {
+			routes = append(routes, policy)
+		}
+	}
+
+	for name, class := range file.RateClasses {
+		if class.RequestsPerMinute <= 0 || class.Burst < 0 {
+			return nil, fmt.Errorf("rate class %s: requestsPerMinute must be positive and burst 0 or positive", name)
+		}
+	}
+	mux := http.NewServeMux()
+	for _, policy := range routes {
+		switch {
+		case policy.MaxBodyBytes < 0 || policy.TimeoutSeconds < 0:
+			return nil, fmt.Errorf("route %q: maxBodyBytes and timeoutSeconds must be 0 or positive", policy.Pattern)
+		case policy.Auth != "" && !slices.Contains(routeAuthLevels, policy.Auth):
+			return nil, fmt.Errorf("route %q: unknown auth %q (allowed: %v)", policy.Pattern, policy.Auth, routeAuthLevels)
+		case policy.RateClass != "" && file.RateClasses[policy.RateClass].RequestsPerMinute == 0:
+			return nil, fmt.Errorf("route %q: unknown rate class %q", policy.Pattern, policy.RateClass)
+		}
+		if err := registerPattern(mux, policy.Pattern); err != nil {
+			return nil, fmt.Errorf("route %q: %w", policy.Pattern, err)
+		}
+	}
+	return &RoutePolicies{routes: routes, classes: file.RateClasses}, nil
+}
+
+// registerPattern adds a pattern to mux, returning the panic of an invalid
+// or conflicting pattern as an error
+func registerPattern(mux *http.ServeMux, pattern string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	mux.Handle(pattern, http.NotFoundHandler())
+	return nil
+}
+
+// routeTimeoutKey holds the timeout of the request's route policy in its context
+type routeTimeoutKey struct{}
+
+// routeTimeout returns the timeout the route policy set for a request, or
+// fallback when it set none
+func routeTimeout(r *http.Request, fallback time.Duration) time.Duration {
+	if timeout, ok := r.Context().Value(routeTimeoutKey{}).(time.Duration); ok {
+		return timeout
+	}
+	return fallback
+}
+
+// Middleware applies the policy of the route each request matches, the most
+// specific pattern winning as in http.ServeMux. auth maps the auth levels to
+// their middleware; a level without one (e.g. no API key configured) isn't
+// enforced. Requests matching no policy pass through unchanged.
+func (p *RoutePolicies) Middleware(auth map[string]func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		limiters := map[string]*rateLimiter{}
+		for name, class := range p.classes {
+			limiters[name] = newRateLimiter(class)
+		}
+
+		mux := http.NewServeMux()
+		for _, policy := range p.routes {
+			var handler http.Handler = policy.apply(next, limiters[policy.RateClass])
+			if policy.Auth != "" && policy.Auth != RouteAuthNone {
+				if middleware, ok := auth[policy.Auth]; ok {
+					handler = middleware(handler)
+				} else {
+					log.Printf("⚠️  Route policy %q requires %s auth, which isn't configured", policy.Pattern, policy.Auth)
+				}
+			}
+			mux.Handle(policy.Pattern, handler)
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if handler, pattern := mux.Handler(r); pattern != "" {
+				handler.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// apply wraps next with the rate limit, body limit and timeout of the policy
+func (p RoutePolicy) apply(next http.Handler, limiter *rateLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limiter != nil {
+			if ok, retry := limiter.allow(rateLimitClient(r), time.Now()); !ok {
+				rateLimitedRequestsTotal.WithLabelValues(p.RateClass).Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+				writeJSONBody(w, http.StatusTooManyRequests, bodyTooManyRequests)
+				return
+			}
+		}
+
+		if p.MaxBodyBytes > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, p.MaxBodyBytes)
+		}
+
+		if timeout := p.timeout(); timeout > 0 {
+			controller := http.NewResponseController(w)
+			if err := controller.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+				log.Printf("⚠️  Could not set read deadline for %s: %v", r.URL.Path, err)
+			}
+			if err := controller.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+				log.Printf("⚠️  Could not set write deadline for %s: %v", r.URL.Path, err)
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(context.WithValue(ctx, routeTimeoutKey{}, timeout))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitClient identifies the client a request counts against: its API
+// key, or its (minimized) IP without one
+func rateLimitClient(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return "key:" + secretFingerprint(key)
+	}
+	return "ip:" + ipPrivacy.Anonymize(getClientIP(r))
+}
+
+// rateLimiter is a token bucket per client, refilled at the class rate
+type rateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu      sync.Mutex
+	clients map[string]*rateTokens
+}
+
+// rateTokens are the tokens a client has left
+type rateTokens struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(class RateClass) *rateLimiter {
+	burst := class.Burst
+	if burst == 0 {
+		burst = class.RequestsPerMinute
+	}
+	return &rateLimiter{
+		rate:    float64(class.RequestsPerMinute) / 60,
+		burst:   float64(burst),
+		clients: map[string]*rateTokens{},
+	}
+}
+
+// allow takes a token of client, or returns how long until one is available
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.clients[client]
+	if !ok {
+		if len(l.clients) >= maxRateClients {
+			l.prune(now)
+		}
+		bucket = &rateTokens{tokens: l.burst, last: now}
+		l.clients[client] = bucket
+	}
+	bucket.tokens = min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// prune forgets clients whose bucket has refilled, as they are back to a new client's state
+func (l *rateLimiter) prune(now time.Time) {
+	for client, bucket := range l.clients {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.clients, client)
+		}
+	}
+}
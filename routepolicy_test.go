@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeRoutePolicies writes a ROUTE_POLICY_FILE and loads it
+func writeRoutePolicies(t *testing.T, content string) (*RoutePolicies, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadRoutePolicies(path)
+}
+
+func TestLoadRoutePolicies(t *testing.T) {
+	policies, err := writeRoutePolicies(t, `{
+		"rateClasses": {"uploads": {"requestsPerMinute": 60, "burst": 2}},
+		"routes": [
+			{"pattern": "/receipts/verify", "maxBodyBytes": 1024},
+			{"pattern": "POST /upload", "maxBodyBytes": 2048, "rateClass": "uploads", "auth": "write"}
+		]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, policy := range policies.routes {
+		if policy.Pattern == "/receipts/verify" {
+			count++
+			if policy.MaxBodyBytes != 1024 {
+				t.Errorf("file policy of /receipts/verify has %d bytes, want it to replace the default", policy.MaxBodyBytes)
+			}
+		}
+	}
+	if count != 1 || len(policies.routes) != len(defaultRoutePolicies)+1 {
+		t.Errorf("%d routes with %d for /receipts/verify, want the defaults plus POST /upload", len(policies.routes), count)
+	}
+
+	for name, content := range map[string]string{
+		"unknown auth":        `{"routes": [{"pattern": "/upload", "auth": "root"}]}`,
+		"unknown rate class":  `{"routes": [{"pattern": "/upload", "rateClass": "uploads"}]}`,
+		"negative body":       `{"routes": [{"pattern": "/upload", "maxBodyBytes": -1}]}`,
+		"zero rate":           `{"rateClasses": {"uploads": {"requestsPerMinute": 0}}, "routes": []}`,
+		"invalid pattern":     `{"routes": [{"pattern": "FETCH"}]}`,
+		"conflicting pattern": `{"routes": [{"pattern": "GET /objects/{name}/tags"}, {"pattern": "GET /objects/stat/{field}"}]}`,
+		"not JSON":            `routes: []`,
+	} {
+		if _, err := writeRoutePolicies(t, content); err == nil {
+			t.Errorf("%s: loaded, want an error", name)
+		}
+	}
+}
+
+func TestRoutePolicyMiddleware(t *testing.T) {
+	policies, err := writeRoutePolicies(t, `{
+		"rateClasses": {"uploads": {"requestsPerMinute": 60, "burst": 2}},
+		"routes": [
+			{"pattern": "POST /upload", "maxBodyBytes": 8, "rateClass": "uploads"},
+			{"pattern": "/admin/", "auth": "admin", "timeoutSeconds": 90}
+		]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminOnly := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-API-Key") != "admin-key" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	handler := policies.Middleware(map[string]func(http.Handler) http.Handler{RouteAuthAdmin: adminOnly})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.Header().Set("X-Timeout", routeTimeout(r, 0).String())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	send := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := send(http.MethodPost, "/upload", "k1", "too long a body"); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("body over maxBodyBytes: status %d, want 413", rec.Code)
+	}
+	if rec := send(http.MethodPost, "/upload", "k1", "short"); rec.Code != http.StatusNoContent {
+		t.Errorf("second request of the burst: status %d, want 204", rec.Code)
+	}
+	if rec := send(http.MethodPost, "/upload", "k1", "short"); rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("request past the burst: status %d, Retry-After %q, want 429 after 1s", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := send(http.MethodPost, "/upload", "k2", "short"); rec.Code != http.StatusNoContent {
+		t.Errorf("another API key: status %d, want its own bucket", rec.Code)
+	}
+	if rec := send(http.MethodGet, "/upload", "k1", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("GET outside the POST policy: status %d, want 204", rec.Code)
+	}
+
+	if rec := send(http.MethodGet, "/admin/stats", "k1", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("admin route without admin auth: status %d, want 401", rec.Code)
+	}
+	if rec := send(http.MethodGet, "/admin/stats", "admin-key", ""); rec.Code != http.StatusNoContent || rec.Header().Get("X-Timeout") != "1m30s" {
+		t.Errorf("admin route: status %d, timeout %q, want 204 with 1m30s", rec.Code, rec.Header().Get("X-Timeout"))
+	}
+	if rec := send(http.MethodGet, "/stats", "", ""); rec.Code != http.StatusNoContent || rec.Header().Get("X-Timeout") != "0s" {
+		t.Errorf("route without policy: status %d, timeout %q, want it untouched", rec.Code, rec.Header().Get("X-Timeout"))
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	limiter := newRateLimiter(RateClass{RequestsPerMinute: 60, Burst: 1})
+	now := time.Now()
+	if ok, _ := limiter.allow("a", now); !ok {
+		t.Fatal("first request refused")
+	}
+	if ok, retry := limiter.allow("a", now); ok || retry != time.Second {
+		t.Errorf("second request: %v, retry %s, want refused for 1s", ok, retry)
+	}
+	if ok, _ := limiter.allow("a", now.Add(time.Second)); !ok {
+		t.Error("request after the refill refused")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// objectPathName returns the object name a request is about: the {name...}
+// variable of Go 1.22 route patterns such as
+// /v1/buckets/{bucket}/objects/{name...}, or the path between mountPath and
+// suffix on prefix routes such as /objects/{name}/metadata, which patterns
+// can't express since a {name...} wildcard has to end the pattern. ok is
+// false when the path doesn't end with suffix.
+func objectPathName(r *http.Request, mountPath, suffix string) (string, bool) {
+	if strings.Contains(r.Pattern, "{name...}") {
+		return r.PathValue("name"), true
+	}
+	return strings.CutSuffix(strings.TrimPrefix(r.URL.Path, mountPath), suffix)
+}
+
+// BucketRoutes serves the handler of the bucket named by the {bucket} route
+// variable, e.g. in /v1/buckets/{bucket}/objects. Unknown buckets get 404.
+func BucketRoutes(handlers map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler, ok := handlers[r.PathValue("bucket")]
+		if !ok {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "Bucket not found",
+			})
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// MethodNotAllowed answers requests whose method has no route on a path that
+// has routes for other methods. It is registered without a method, so the
+// more specific "GET /path" style patterns take precedence over it.
+func MethodNotAllowed(allowed ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: false,
+			Error:   "Method not allowed. Use " + strings.Join(allowed, " or ") + ".",
+		})
+	})
+}
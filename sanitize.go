@@ -0,0 +1,134 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxFilenameLength is the maximum length in bytes of a sanitized file name
+// (without extension), well below the 1024 byte object name limit of GCS and S3
+const maxFilenameLength = 100
+
+// reservedFilenames can't be used as file names on Windows, where downloaded
+// originals and zip archives end up
+var reservedFilenames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true, "com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true, "lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// asciiObjectNames makes sanitizeFilename transliterate names to ASCII
+// (OBJECT_NAMES_ASCII), for consumers that mishandle encoded URLs
+var asciiObjectNames bool
+
+// transliterations spell out letters that don't decompose into an ASCII
+// letter and a combining mark
+var transliterations = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE", 'ø': "o", 'Ø': "O",
+	'ł': "l", 'Ł': "L", 'đ': "d", 'Đ': "D", 'ð': "d", 'Ð': "D", 'þ': "th", 'Þ': "Th", 'ı': "i",
+}
+
+// transliterate reduces s to ASCII: accents are dropped ("é" -> "e"), a few
+// letters are spelled out ("ß" -> "ss") and other characters become '-'
+func transliterate(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		switch {
+		case r < utf8.RuneSelf:
+			b.WriteRune(r)
+		case unicode.Is(unicode.Mn, r):
+			// Accent split off its letter by NFD
+		case transliterations[r] != "":
+			b.WriteString(transliterations[r])
+		default:
+			b.WriteRune('-')
+		}
+	}
+	return b.String()
+}
+
+// sanitizeFilename turns a client-supplied file name (without extension) into
+// a safe object name component:
+//   - directory components are dropped (both / and \), so ".." can't escape
+//   - the name is NFC normalized so visually identical names are stored identically,
+//     or transliterated to ASCII when asciiObjectNames is set
+//   - only letters, digits, combining marks, '-', '_' and '.' are kept; control,
+//     formatting (RTL override, zero-width) and other characters are removed,
+//     whitespace and punctuation become '-'
+//   - runs of separators are collapsed and leading/trailing ones trimmed, so
+//     the result is never hidden (".x") or empty
+//   - Windows reserved device names get a '_' prefix
+//   - the result is truncated to maxFilenameLength bytes on a rune boundary
+func sanitizeFilename(filename string) string {
+	if i := strings.LastIndexAny(filename, `/\`); i >= 0 {
+		filename = filename[i+1:]
+	}
+	filename = norm.NFC.String(filename)
+	if asciiObjectNames {
+		filename = transliterate(filename)
+	}
+
+	var b strings.Builder
+	var last rune
+	for _, r := range filename {
+		var out rune
+		switch {
+		case r == utf8.RuneError:
+			continue
+		case unicode.IsControl(r) || unicode.Is(unicode.Cf, r):
+			// Control and invisible formatting characters (bidi overrides, zero-width joiners)
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.In(r, unicode.Mn, unicode.Mc):
+			out = r
+		case r == '_' || r == '.':
+			out = r
+		default:
+			out = '-'
+		}
+
+		// Collapse separator runs ("a - b" -> "a-b", "a..b" -> "a.b")
+		if isFilenameSeparator(out) && isFilenameSeparator(last) {
+			continue
+		}
+		b.WriteRune(out)
+		last = out
+	}
+
+	name := strings.TrimFunc(b.String(), isFilenameSeparator)
+	name = truncateUTF8(name, maxFilenameLength)
+	name = strings.TrimRightFunc(name, isFilenameSeparator)
+
+	if name == "" {
+		return "file"
+	}
+	if base, _, _ := strings.Cut(name, "."); reservedFilenames[strings.ToLower(base)] {
+		name = "_" + name
+	}
+	return name
+}
+
+func isFilenameSeparator(r rune) bool {
+	return r == '-' || r == '_' || r == '.'
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a rune
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// splitFilename splits a client-supplied file name into its sanitized name
+// and lowercased extension, ready to build an object name from
+func splitFilename(filename string) (name, ext string) {
+	ext = strings.ToLower(filepath.Ext(filename))
+	return sanitizeFilename(filename[:len(filename)-len(ext)]), ext
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "photo", "photo"},
+		{"spaces", "my holiday photo", "my-holiday-photo"},
+		{"separator runs", "a - b__c..d", "a-b_c.d"},
+		{"unix path", "../../etc/passwd", "passwd"},
+		{"windows path", `C:\Users\me\photo`, "photo"},
+		{"hidden", ".htaccess", "htaccess"},
+		{"only separators", "-._", "file"},
+		{"empty", "", "file"},
+		{"punctuation", "cat!@#$%^&*()", "cat"},
+		{"control characters", "ca\x00t\n\t", "cat"},
+		{"bidi override", "invoice\u202egpj.exe", "invoicegpj.exe"},
+		{"zero width", "ca\u200bt", "cat"},
+		{"invalid UTF-8", "ca\xfft", "cat"},
+		{"NFC", "cafe\u0301", "caf\u00e9"},
+		{"non-Latin", "фото", "фото"},
+		{"reserved", "con", "_con"},
+		{"reserved uppercase", "LPT1", "_LPT1"},
+		{"reserved with dot", "aux.tar", "_aux.tar"},
+		{"not reserved", "console", "console"},
+		{"truncated", strings.Repeat("a", 150), strings.Repeat("a", maxFilenameLength)},
+		{"truncated on rune boundary", "a" + strings.Repeat("é", 60), "a" + strings.Repeat("é", 49)},
+		{"truncated before separator", strings.Repeat("a", 99) + "-b", strings.Repeat("a", 99)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeFilename(tt.in); got != tt.want {
+				t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFilenameASCII(t *testing.T) {
+	asciiObjectNames = true
+	defer func() { asciiObjectNames = false }()
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"café", "cafe"},
+		{"Straße", "Strasse"},
+		{"Ærø", "AEro"},
+		{"фото", "file"},
+		{"naïve résumé", "naive-resume"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeFilename(tt.in); got != tt.want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSplitFilename(t *testing.T) {
+	tests := []struct {
+		in       string
+		wantName string
+		wantExt  string
+	}{
+		{"photo.jpg", "photo", ".jpg"},
+		{"Photo.JPG", "Photo", ".jpg"},
+		{"archive.tar.gz", "archive.tar", ".gz"},
+		{"noext", "noext", ""},
+		{".png", "file", ".png"},
+		{"../../evil.png", "evil", ".png"},
+		{"my photo (1).jpeg", "my-photo-1", ".jpeg"},
+		{"con.png", "_con", ".png"},
+	}
+	for _, tt := range tests {
+		name, ext := splitFilename(tt.in)
+		if name != tt.wantName || ext != tt.wantExt {
+			t.Errorf("splitFilename(%q) = %q, %q, want %q, %q", tt.in, name, ext, tt.wantName, tt.wantExt)
+		}
+	}
+}
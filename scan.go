@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ScanVerdict is the answer of the content scanner
+type ScanVerdict struct {
+	Flagged  bool   `json:"flagged"`
+	Category string `json:"category,omitempty"` // malware or moderation
+	Reason   string `json:"reason,omitempty"`   // e.g. the matched signature or label
+}
+
+// ScanSink sends uploaded objects to an external virus scanner or moderation
+// service and quarantines the ones it flags. The service receives the object
+// as the body of a POST and answers with a ScanVerdict, so any scanner can be
+// plugged in behind a small adapter (ClamAV REST, a vision API proxy, ...).
+// It runs as an event sink, so uploads are served until flagged; a failed
+// scan is retried by Cloud Tasks when events are deferred.
+type ScanSink struct {
+	url        string
+	token      string
+	maxSize    int64
+	httpClient *http.Client
+	backends   map[string]Backend
+	quarantine *Quarantine
+}
+
+// NewScanSink creates a scanner sink for the registered buckets
+func NewScanSink(cfg QuarantineConfig, backends map[string]Backend, q *Quarantine) *ScanSink {
+	return &ScanSink{
+		url:        cfg.ScanURL,
+		token:      cfg.ScanToken,
+		maxSize:    cfg.ScanMaxSize,
+		httpClient: &http.Client{Timeout: time.Minute},
+		backends:   backends,
+		quarantine: q,
+	}
+}
+
+// Name identifies the scanner as an event sink
+func (s *ScanSink) Name() string {
+	return "scanner"
+}
+
+// Publish scans uploaded objects of tenants with the moderation flag
+func (s *ScanSink) Publish(ctx context.Context, event AssetEvent) error {
+	if event.Type != EventUpload || !featureFlags.Enabled(FlagModeration, event.Tenant) {
+		return nil
+	}
+	backend, ok := s.backends[event.Bucket]
+	if !ok {
+		return nil
+	}
+	if s.maxSize > 0 && event.Size > s.maxSize {
+		log.Printf("⚠️  Not scanning %s/%s: %d bytes exceeds the scan limit", event.Bucket, event.Object, event.Size)
+		return nil
+	}
+
+	verdict, err := s.scan(ctx, backend, event.Object)
+	if errors.Is(err, ErrObjectNotFound) {
+		// Deleted (or replaced under a new name) before the scan
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to scan %s/%s: %w", event.Bucket, event.Object, err)
+	}
+	if !verdict.Flagged {
+		return nil
+	}
+
+	_, err = s.quarantine.Isolate(ctx, backend, event.Object, verdict.Category, verdict.Reason)
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil
+	}
+	return err
+}
+
+// Close is a no-op, the scanner holds no resources
+func (s *ScanSink) Close() error {
+	return nil
+}
+
+// scan posts an object to the scanner and returns its verdict
+func (s *ScanSink) scan(ctx context.Context, backend Backend, name string) (ScanVerdict, error) {
+	reader, info, err := backend.Open(ctx, name)
+	if err != nil {
+		return ScanVerdict{}, err
+	}
+	defer reader.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, reader)
+	if err != nil {
+		return ScanVerdict{}, err
+	}
+	req.ContentLength = info.Size
+	req.Header.Set("Content-Type", info.ContentType)
+	req.Header.Set("X-Object-Name", backend.Bucket()+"/"+name)
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return ScanVerdict{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return ScanVerdict{}, fmt.Errorf("scanner returned %s", resp.Status)
+	}
+
+	var verdict ScanVerdict
+	if err := json.NewDecoder(resp.Body).Decode(&verdict); err != nil {
+		return ScanVerdict{}, fmt.Errorf("invalid scanner response: %w", err)
+	}
+	return verdict, nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Reasons for shedding requests, as labeled in the metrics
+const (
+	ShedReasonLatency = "latency"
+	ShedReasonErrors  = "errors"
+	ShedReasonMemory  = "memory"
+)
+
+// maxShedSamples caps the requests kept for the latency percentile and error rate
+const maxShedSamples = 4096
+
+// shedCheckInterval is how often the shedder re-evaluates the instance health
+const shedCheckInterval = time.Second
+
+// LoadShedConfig holds the thresholds above which low-priority requests are
+// shed. Shedding is off while all of them are 0.
+type LoadShedConfig struct {
+	P99Latency  time.Duration // p99 time to first byte of requests without a body, 0 disables
+	ErrorRate   float64       // 5xx ratio (0-1), 0 disables
+	MaxMemory   int64         // memory held by the Go runtime in bytes, 0 disables
+	Window      time.Duration // latency and error rate cover the requests of this window
+	MinRequests int           // requests in the window before latency and error rate count
+	Cooldown    time.Duration // how long the instance stays healthy before shedding stops
+	Routes      []string      // http.ServeMux patterns of the low-priority routes
+}
+
+// Enabled reports whether any threshold is configured
+func (c LoadShedConfig) Enabled() bool {
+	return c.P99Latency > 0 || c.ErrorRate > 0 || c.MaxMemory > 0
+}
+
+// shedSample is a served request
+type shedSample struct {
+	at      time.Time
+	latency time.Duration // time to first byte, -1 when the request had a body
+	failed  bool
+}
+
+// LoadShedder tracks the latency, error rate and memory of the instance and
+// answers low-priority requests (listings, search) with 503 while one of
+// them is over its threshold, so uploads keep going when storage is slow or
+// memory runs short
+type LoadShedder struct {
+	config LoadShedConfig
+	routes *http.ServeMux
+
+	mu           sync.Mutex
+	samples      []shedSample // ring buffer of the latest requests
+	next         int
+	reason       string // why requests are shed, "" while healthy
+	healthySince time.Time
+	stop         chan struct{}
+}
+
+// NewLoadShedder parses the low-priority routes; it returns nil when no
+// threshold is configured
+func NewLoadShedder(cfg LoadShedConfig) (*LoadShedder, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+	routes, err := parseShedRoutes(cfg.Routes)
+	if err != nil {
+		return nil, err
+	}
+	return &LoadShedder{
+		config: cfg,
+		routes: routes,
+		stop:   make(chan struct{}),
+	}, nil
+}
+
+// parseShedRoutes registers the low-priority route patterns in a mux used
+// only for matching
+func parseShedRoutes(patterns []string) (*http.ServeMux, error) {
+	mux := http.NewServeMux()
+	for _, pattern := range patterns {
+		if err := registerPattern(mux, pattern); err != nil {
+			return nil, fmt.Errorf("route %q: %w", pattern, err)
+		}
+	}
+	return mux, nil
+}
+
+// Start evaluates the instance health periodically
+func (s *LoadShedder) Start() {
+	go func() {
+		ticker := time.NewTicker(shedCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.check(time.Now())
+			}
+		}
+	}()
+}
+
+// Stop ends the periodic evaluation
+func (s *LoadShedder) Stop() {
+	close(s.stop)
+}
+
+// Reason returns why low-priority requests are shed, "" when they aren't
+func (s *LoadShedder) Reason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reason
+}
+
+// record adds a served request to the window
+func (s *LoadShedder) record(sample shedSample) {
+	s.mu.Lock()
+	if len(s.samples) < maxShedSamples {
+		s.samples = append(s.samples, sample)
+	} else {
+		s.samples[s.next] = sample
+		s.next = (s.next + 1) % maxShedSamples
+	}
+	s.mu.Unlock()
+}
+
+// check computes the p99 latency and error rate of the window and the memory
+// in use, and starts or stops shedding
+func (s *LoadShedder) check(now time.Time) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	memory := int64(memStats.Sys - memStats.HeapReleased)
+
+	s.mu.Lock()
+	var latencies []time.Duration
+	requests, failures := 0, 0
+	for _, sample := range s.samples {
+		if now.Sub(sample.at) > s.config.Window {
+			continue
+		}
+		requests++
+		if sample.failed {
+			failures++
+		}
+		if sample.latency >= 0 {
+			latencies = append(latencies, sample.latency)
+		}
+	}
+	s.mu.Unlock()
+
+	var p99 time.Duration
+	if len(latencies) > 0 {
+		slices.Sort(latencies)
+		p99 = latencies[int(math.Ceil(float64(len(latencies))*0.99))-1]
+	}
+	var errorRate float64
+	if requests > 0 {
+		errorRate = float64(failures) / float64(requests)
+	}
+	loadShedP99Latency.Set(p99.Seconds())
+	loadShedErrorRate.Set(errorRate)
+	loadShedMemoryBytes.Set(float64(memory))
+
+	// Latency and error rate of a handful of requests say little
+	reason, detail := "", ""
+	switch {
+	case s.config.MaxMemory > 0 && memory >= s.config.MaxMemory:
+		reason, detail = ShedReasonMemory, fmt.Sprintf("%d MiB in use", memory/1024/1024)
+	case requests < s.config.MinRequests:
+	case s.config.ErrorRate > 0 && errorRate >= s.config.ErrorRate:
+		reason, detail = ShedReasonErrors, fmt.Sprintf("%.1f%% of %d requests failed", errorRate*100, requests)
+	case s.config.P99Latency > 0 && len(latencies) >= s.config.MinRequests && p99 >= s.config.P99Latency:
+		reason, detail = ShedReasonLatency, fmt.Sprintf("p99 latency %s", p99.Round(time.Millisecond))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case reason != "":
+		if s.reason == "" {
+			log.Printf("🚦 Shedding low-priority requests: %s", detail)
+			loadShedActive.Set(1)
+		}
+		s.reason, s.healthySince = reason, time.Time{}
+	case s.reason == "":
+	case s.healthySince.IsZero():
+		s.healthySince = now
+	case now.Sub(s.healthySince) >= s.config.Cooldown:
+		log.Printf("✅ Stopped shedding low-priority requests after %s healthy", s.config.Cooldown)
+		loadShedActive.Set(0)
+		s.reason, s.healthySince = "", time.Time{}
+	}
+}
+
+// shedRecorder captures the status and time to first byte of a response
+type shedRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	firstByte  time.Time
+}
+
+func (rw *shedRecorder) WriteHeader(code int) {
+	if rw.firstByte.IsZero() {
+		rw.statusCode, rw.firstByte = code, time.Now()
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *shedRecorder) Write(p []byte) (int, error) {
+	if rw.firstByte.IsZero() {
+		rw.firstByte = time.Now()
+	}
+	return rw.ResponseWriter.Write(p)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (rw *shedRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// LoadShedMiddleware answers requests to the low-priority routes with 503
+// while the shedder reports the instance unhealthy, and feeds it the latency
+// and status of every other request. Probes and scrapes aren't counted.
+func LoadShedMiddleware(shedder *LoadShedder) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if shedder == nil {
+			return next
+		}
+		retryAfter := strconv.Itoa(max(1, int(math.Ceil(shedder.config.Cooldown.Seconds()))))
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/health", "/readyz", "/metrics":
+				next.ServeHTTP(w, r)
+				return
+			}
+			if _, pattern := shedder.routes.Handler(r); pattern != "" {
+				if reason := shedder.Reason(); reason != "" {
+					loadShedRequestsTotal.WithLabelValues(reason).Inc()
+					w.Header().Set("Retry-After", retryAfter)
+					writeJSONBody(w, http.StatusServiceUnavailable, bodyServiceBusy)
+					return
+				}
+			}
+
+			start := time.Now()
+			recorder := &shedRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+			next.ServeHTTP(recorder, r)
+
+			// Requests with a body take as long as the client needs to send it
+			sample := shedSample{at: start, latency: -1, failed: recorder.statusCode >= 500}
+			if r.ContentLength == 0 {
+				if recorder.firstByte.IsZero() {
+					recorder.firstByte = time.Now()
+				}
+				sample.latency = recorder.firstByte.Sub(start)
+			}
+			shedder.record(sample)
+		})
+	}
+}
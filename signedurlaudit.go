@@ -0,0 +1,664 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signedURLEnforceInterval is how often objects of revoked URLs are looked
+// for, and expired grants dropped from the audit trail
+const signedURLEnforceInterval = time.Minute
+
+// signedURLEnforceGrace covers uploads started just before their URL expired,
+// which storage lets finish
+const signedURLEnforceGrace = 15 * time.Minute
+
+// signedURLAuditFlushInterval is how often issued grants are written to the journal
+const signedURLAuditFlushInterval = time.Second
+
+// signedURLAuditCompactSlack is how many journal lines beyond the live grants
+// are tolerated before the journal is rewritten
+const signedURLAuditCompactSlack = 10000
+
+// signedURLRotatedFromKey is the metadata key holding the name an object had
+// before it was renamed away from a revoked signed URL
+const signedURLRotatedFromKey = "rotated-from"
+
+// uniqueNamePrefix matches the "<unix time>-<token>-" uniqueObjectName puts
+// before a filename
+var uniqueNamePrefix = regexp.MustCompile(`^[0-9]+-[0-9a-f]{12}-`)
+
+// SignedURLGrant is the audit entry of an issued signed URL. The URL itself
+// is a bearer credential and is never stored.
+type SignedURLGrant struct {
+	ID          string     `json:"id"`
+	Bucket      string     `json:"bucket"`
+	Object      string     `json:"object"`
+	Method      string     `json:"method"`
+	ContentType string     `json:"contentType,omitempty"`
+	Issuer      string     `json:"issuer,omitempty"` // fingerprint of the API key that asked for the URL
+	Origin      string     `json:"origin,omitempty"` // Origin header or hostname of the request
+	ClientIP    string     `json:"clientIp,omitempty"`
+	Tenant      string     `json:"tenant,omitempty"`
+	IssuedAt    time.Time  `json:"issuedAt"`
+	ExpiresAt   time.Time  `json:"expiresAt"`
+	RevokedAt   *time.Time `json:"revokedAt,omitempty"`
+	RevokedBy   string     `json:"revokedBy,omitempty"`
+}
+
+// Active reports whether the URL can still be used
+func (g SignedURLGrant) Active(now time.Time) bool {
+	return g.RevokedAt == nil && now.Before(g.ExpiresAt)
+}
+
+// watched reports whether a grant was revoked while its URL could still
+// upload, so whatever lands at its object name must be moved away
+func (g SignedURLGrant) watched(now time.Time) bool {
+	return g.RevokedAt != nil && now.Before(g.ExpiresAt.Add(signedURLEnforceGrace))
+}
+
+// SignedURLAudit is the audit trail of issued signed URLs. Grants are
+// numerous and short-lived, so they are kept out of the asset catalog: up to
+// max of them are held in memory and changes are appended to a journal of
+// their own in batches, off the request path. A grant is dropped once its
+// URL expired, or after the enforcement grace when it was revoked. All
+// methods are safe on a nil trail.
+type SignedURLAudit struct {
+	path string
+	max  int
+
+	mu      sync.Mutex
+	grants  map[string]*list.Element // ID -> element holding the SignedURLGrant
+	order   *list.List               // front = most recently issued
+	pending []SignedURLGrant         // changes not yet in the journal
+	lines   int                      // lines in the journal
+	stale   bool                     // a write failed; the journal is rewritten from memory
+
+	writeMu sync.Mutex // serializes journal writes and compactions
+	journal *os.File
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// signedURLAudit is the process-wide audit trail; nil until opened in main
+var signedURLAudit *SignedURLAudit
+
+// OpenSignedURLAudit loads the journal at path, keeping up to max grants,
+// and starts writing changes to it in the background
+func OpenSignedURLAudit(path string, max int) (*SignedURLAudit, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create signed URL audit directory: %w", err)
+	}
+
+	a := &SignedURLAudit{
+		path:   path,
+		max:    max,
+		grants: map[string]*list.Element{},
+		order:  list.New(),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	a.prune(time.Now())
+	if err := a.compact(a.snapshot()); err != nil {
+		return nil, err
+	}
+	go a.run()
+	log.Printf("🔏 Signed URL audit loaded: %d grants", a.order.Len())
+	return a, nil
+}
+
+// load replays the journal into memory
+func (a *SignedURLAudit) load() error {
+	f, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open signed URL audit journal: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var grant SignedURLGrant
+		if err := json.Unmarshal(scanner.Bytes(), &grant); err != nil || grant.ID == "" {
+			log.Printf("⚠️  Skipping corrupt signed URL audit line %d: %v", line, err)
+			continue
+		}
+		a.upsert(grant)
+	}
+	return scanner.Err()
+}
+
+// upsert adds or replaces a grant and evicts the oldest ones past the cap;
+// callers hold a.mu
+func (a *SignedURLAudit) upsert(grant SignedURLGrant) {
+	if elem, ok := a.grants[grant.ID]; ok {
+		elem.Value = grant
+		return
+	}
+	a.grants[grant.ID] = a.order.PushFront(grant)
+
+	// Revoked grants are kept while enforced, unless nothing else is left to drop
+	now := time.Now()
+	for elem := a.order.Back(); a.order.Len() > a.max && elem != nil; {
+		prev := elem.Prev()
+		if !elem.Value.(SignedURLGrant).watched(now) {
+			a.remove(elem)
+			signedURLAuditEvictedTotal.Inc()
+		}
+		elem = prev
+	}
+	for a.order.Len() > a.max {
+		a.remove(a.order.Back())
+		signedURLAuditEvictedTotal.Inc()
+	}
+}
+
+// remove drops a grant; callers hold a.mu
+func (a *SignedURLAudit) remove(elem *list.Element) {
+	a.order.Remove(elem)
+	delete(a.grants, elem.Value.(SignedURLGrant).ID)
+}
+
+// prune drops the grants that can no longer upload nor need enforcing
+func (a *SignedURLAudit) prune(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for elem := a.order.Back(); elem != nil; {
+		prev := elem.Prev()
+		if grant := elem.Value.(SignedURLGrant); !grant.Active(now) && !grant.watched(now) {
+			a.remove(elem)
+		}
+		elem = prev
+	}
+}
+
+// snapshot returns every grant, oldest first, and clears the pending changes
+// they include
+func (a *SignedURLAudit) snapshot() []SignedURLGrant {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	grants := make([]SignedURLGrant, 0, a.order.Len())
+	for elem := a.order.Back(); elem != nil; elem = elem.Prev() {
+		grants = append(grants, elem.Value.(SignedURLGrant))
+	}
+	a.pending, a.stale = nil, false
+	return grants
+}
+
+// compact rewrites the journal with grants and reopens it for appending
+func (a *SignedURLAudit) compact(grants []SignedURLGrant) error {
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(a.path), ".signedurls-*")
+	if err != nil {
+		return fmt.Errorf("failed to compact signed URL audit journal: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, grant := range grants {
+		if err := enc.Encode(grant); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), a.path); err != nil {
+		return err
+	}
+
+	journal, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open signed URL audit journal: %w", err)
+	}
+	if a.journal != nil {
+		a.journal.Close()
+	}
+	a.journal = journal
+	a.mu.Lock()
+	a.lines = len(grants)
+	a.mu.Unlock()
+	return nil
+}
+
+// flush appends the pending changes to the journal, or rewrites it when it
+// grew well past the live grants or a previous write failed
+func (a *SignedURLAudit) flush() error {
+	a.mu.Lock()
+	rewrite := a.stale || a.lines > 2*a.order.Len()+signedURLAuditCompactSlack
+	a.mu.Unlock()
+	if rewrite {
+		if err := a.compact(a.snapshot()); err != nil {
+			a.mu.Lock()
+			a.stale = true
+			a.mu.Unlock()
+			return err
+		}
+		return nil
+	}
+
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	a.mu.Lock()
+	batch := a.pending
+	a.pending = nil
+	a.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	buf := getJSONBuffer()
+	defer putJSONBuffer(buf)
+	for _, grant := range batch {
+		if err := buf.enc.Encode(grant); err != nil {
+			return err
+		}
+	}
+	_, err := a.journal.Write(buf.Bytes())
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err != nil {
+		// The grants are still in memory; the next flush rewrites the journal
+		a.stale = true
+		return fmt.Errorf("failed to write signed URL audit journal: %w", err)
+	}
+	a.lines += len(batch)
+	return nil
+}
+
+// run flushes pending changes every second and prunes expired grants every minute
+func (a *SignedURLAudit) run() {
+	defer close(a.done)
+	flushTicker := time.NewTicker(signedURLAuditFlushInterval)
+	defer flushTicker.Stop()
+	pruneTicker := time.NewTicker(signedURLEnforceInterval)
+	defer pruneTicker.Stop()
+	for {
+		select {
+		case <-a.stop:
+			if err := a.flush(); err != nil {
+				log.Printf("⚠️  %v", err)
+			}
+			return
+		case now := <-pruneTicker.C:
+			a.prune(now)
+		case <-flushTicker.C:
+			if err := a.flush(); err != nil {
+				log.Printf("⚠️  %v", err)
+			}
+		}
+	}
+}
+
+// Close writes the pending changes and closes the journal
+func (a *SignedURLAudit) Close() error {
+	if a == nil {
+		return nil
+	}
+	close(a.stop)
+	<-a.done
+
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	if err := a.journal.Sync(); err != nil {
+		a.journal.Close()
+		return err
+	}
+	return a.journal.Close()
+}
+
+// Put records an issued signed URL. It is written to the journal with the
+// next batch.
+func (a *SignedURLAudit) Put(grant SignedURLGrant) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.upsert(grant)
+	a.pending = append(a.pending, grant)
+}
+
+// Grants returns the signed URLs of a bucket ("" for every bucket) for
+// objects under prefix that match, newest first
+func (a *SignedURLAudit) Grants(bucket, prefix string, match func(SignedURLGrant) bool) []SignedURLGrant {
+	grants := []SignedURLGrant{}
+	if a == nil {
+		return grants
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for elem := a.order.Front(); elem != nil; elem = elem.Next() {
+		grant := elem.Value.(SignedURLGrant)
+		if (bucket == "" || grant.Bucket == bucket) && strings.HasPrefix(grant.Object, prefix) && match(grant) {
+			grants = append(grants, grant)
+		}
+	}
+	return grants
+}
+
+// RevokeGrants marks the active signed URLs of the bucket for the object, or
+// for every object under prefix when object is empty, as revoked. Unlike
+// issued grants, revocations are written to the journal right away.
+func (a *SignedURLAudit) RevokeGrants(bucket, object, prefix, revokedBy string) ([]SignedURLGrant, error) {
+	if a == nil {
+		return nil, errors.New("signed URL audit is not enabled")
+	}
+
+	now := time.Now().UTC()
+	revoked := []SignedURLGrant{}
+	a.mu.Lock()
+	for elem := a.order.Front(); elem != nil; elem = elem.Next() {
+		grant := elem.Value.(SignedURLGrant)
+		if grant.Bucket != bucket || !grant.Active(now) {
+			continue
+		}
+		if object != "" && grant.Object != object || object == "" && !strings.HasPrefix(grant.Object, prefix) {
+			continue
+		}
+		grant.RevokedAt, grant.RevokedBy = &now, revokedBy
+		elem.Value = grant
+		a.pending = append(a.pending, grant)
+		revoked = append(revoked, grant)
+	}
+	a.mu.Unlock()
+
+	sort.Slice(revoked, func(i, j int) bool { return revoked[i].Object < revoked[j].Object })
+	if err := a.flush(); err != nil {
+		// The revocation holds in memory and the next flush rewrites the journal
+		log.Printf("⚠️  %v", err)
+	}
+	return revoked, nil
+}
+
+// recordSignedURL adds a signed upload URL handed out by a request to the audit trail
+func recordSignedURL(r *http.Request, backend Backend, method, name string, opts SignOptions) {
+	if signedURLAudit == nil {
+		return
+	}
+	id := make([]byte, 12)
+	rand.Read(id)
+	now := time.Now().UTC()
+	signedURLAudit.Put(SignedURLGrant{
+		ID:          hex.EncodeToString(id),
+		Bucket:      backend.Bucket(),
+		Object:      name,
+		Method:      method,
+		ContentType: opts.ContentType,
+		Issuer:      secretFingerprint(r.Header.Get("X-API-Key")),
+		Origin:      requestOrigin(r),
+		ClientIP:    ipPrivacy.Anonymize(getClientIP(r)),
+		Tenant:      r.Header.Get("X-Tenant-ID"),
+		IssuedAt:    now,
+		ExpiresAt:   now.Add(opts.Expires),
+	})
+}
+
+// SignedURLEnforcer keeps revoked signed URLs from placing objects. A signed
+// URL can't be invalidated before it expires, so until then (and a grace
+// period for uploads in flight) the object name it grants is watched. An
+// object that was there before the revocation is renamed, so it stays
+// available under a name the URL doesn't reach; one that lands afterwards
+// was uploaded through the revoked URL and is moved to quarantine.
+type SignedURLEnforcer struct {
+	backends map[string]Backend
+	stop     chan struct{}
+}
+
+// NewSignedURLEnforcer creates an enforcer; call Start to begin watching
+func NewSignedURLEnforcer(backends map[string]Backend) *SignedURLEnforcer {
+	return &SignedURLEnforcer{backends: backends, stop: make(chan struct{})}
+}
+
+// Start looks for objects of revoked URLs periodically
+func (e *SignedURLEnforcer) Start() {
+	go func() {
+		ticker := time.NewTicker(signedURLEnforceInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-e.stop:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), signedURLEnforceInterval)
+				now := time.Now()
+				e.enforce(ctx, signedURLAudit.Grants("", "", func(grant SignedURLGrant) bool {
+					return grant.watched(now)
+				}))
+				cancel()
+			}
+		}
+	}()
+}
+
+// Stop ends the periodic checks
+func (e *SignedURLEnforcer) Stop() {
+	close(e.stop)
+}
+
+// enforce moves the objects of revoked upload grants away from their names.
+// It returns the new names of the objects it renamed, by old name, and how
+// many objects it quarantined.
+func (e *SignedURLEnforcer) enforce(ctx context.Context, grants []SignedURLGrant) (map[string]string, int) {
+	rotated := map[string]string{}
+	quarantined := 0
+	for _, grant := range grants {
+		// Direct download URLs are cached and shared between clients, so
+		// moving their object would break every link to it; their
+		// revocation is only recorded and takes effect at expiry
+		if grant.Method == http.MethodGet {
+			continue
+		}
+		backend, ok := e.backends[grant.Bucket]
+		if !ok {
+			continue
+		}
+		info, err := backend.Stat(ctx, grant.Object)
+		if errors.Is(err, ErrObjectNotFound) {
+			continue
+		} else if err != nil {
+			log.Printf("⚠️  Failed to check %s/%s of a revoked signed URL: %v", grant.Bucket, grant.Object, err)
+			continue
+		}
+
+		if info.Updated.Before(*grant.RevokedAt) {
+			renamed, err := rotateObject(ctx, backend, grant.Object)
+			if err != nil {
+				log.Printf("⚠️  Failed to rename %s/%s away from a revoked signed URL: %v", grant.Bucket, grant.Object, err)
+				continue
+			}
+			rotated[grant.Object] = renamed
+			continue
+		}
+		reason := fmt.Sprintf("uploaded through revoked signed URL %s", grant.ID)
+		if _, err := quarantine.Isolate(ctx, backend, grant.Object, QuarantineManual, reason); err != nil {
+			log.Printf("⚠️  Failed to quarantine %s/%s of a revoked signed URL: %v", grant.Bucket, grant.Object, err)
+			continue
+		}
+		signedURLRevokedUploadsTotal.WithLabelValues(grant.Bucket).Inc()
+		quarantined++
+	}
+	return rotated, quarantined
+}
+
+// rotateObject renames an object, and its poster, to a fresh unique name in
+// the same folder and moves its catalog record along. The old name is kept
+// in the rotated-from metadata key.
+func rotateObject(ctx context.Context, backend Backend, name string) (string, error) {
+	if err := checkDeletable(ctx, backend, name); err != nil {
+		return "", err
+	}
+	dir, base := path.Split(name)
+	renamed := uniqueObjectName(dir, uniqueNamePrefix.ReplaceAllString(base, ""))
+	info, err := moveObject(ctx, backend, name, backend, renamed, map[string]string{signedURLRotatedFromKey: name}, nil, true)
+	if err != nil {
+		return "", err
+	}
+
+	record, ok := metadataStore.Get(backend.Bucket(), name)
+	if !ok {
+		record = AssetRecord{Source: SourceUpload}
+	}
+	if poster := record.Metadata["poster"]; poster != "" {
+		// A poster left behind only costs storage, so it doesn't fail the rename
+		if _, err := moveObject(ctx, backend, poster, backend, posterName(renamed), nil, nil, false); err != nil {
+			traceLogf(ctx, "⚠️  Failed to rename poster %s of %s: %v", poster, renamed, err)
+			record.Metadata = mergeMetadata(record.Metadata, nil, "poster")
+		} else {
+			record.Metadata = mergeMetadata(record.Metadata, map[string]string{"poster": posterName(renamed)})
+		}
+	}
+	if err := metadataStore.Delete(backend.Bucket(), name); err != nil {
+		traceLogf(ctx, "⚠️  Failed to remove %s from metadata store: %v", name, err)
+	}
+	record.Bucket, record.Name = backend.Bucket(), renamed
+	record.Size, record.ContentType = info.Size, info.ContentType
+	record.Metadata = mergeMetadata(record.Metadata, map[string]string{signedURLRotatedFromKey: name})
+	if err := metadataStore.Put(record); err != nil {
+		traceLogf(ctx, "⚠️  Failed to register renamed %s in metadata store: %v", renamed, err)
+	}
+
+	signedURLRotatedTotal.WithLabelValues(backend.Bucket()).Inc()
+	traceLogf(ctx, "🔏 Renamed %s/%s to %s away from a revoked signed URL", backend.Bucket(), name, renamed)
+	PublishEvent(AssetEvent{
+		Type:        EventRename,
+		Bucket:      backend.Bucket(),
+		Object:      renamed,
+		Size:        record.Size,
+		ContentType: record.ContentType,
+		Tenant:      record.Tenant,
+		Uploader:    record.Uploader,
+	})
+	return renamed, nil
+}
+
+// SignedURLAuditResponse lists signed URLs, or those a revocation affected
+type SignedURLAuditResponse struct {
+	Success     bool              `json:"success"`
+	Grants      []SignedURLGrant  `json:"grants,omitempty"`
+	Rotated     map[string]string `json:"rotated,omitempty"`     // new names of objects uploaded before the revocation, by old name
+	Quarantined int               `json:"quarantined,omitempty"` // objects uploaded through revoked URLs since
+	Error       string            `json:"error,omitempty"`
+}
+
+// HandleSignedURLAudit serves the signed URL audit trail:
+//
+//   - GET /admin/signedurls?active=true&bucket=&prefix= lists issued URLs, newest first
+//   - POST /admin/signedurls/revoke?bucket=&object= revokes the URLs of an object
+//   - POST /admin/signedurls/revoke?bucket=&prefix= revokes the URLs of every object under a prefix
+//
+// Objects already stored under a revoked name are renamed right away, and
+// objects uploaded through revoked URLs later are quarantined by the enforcer.
+func HandleSignedURLAudit(enforcer *SignedURLEnforcer, oidc *OIDCAuth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		query := r.URL.Query()
+		action := strings.TrimPrefix(r.URL.Path, "/admin/signedurls")
+		if action == "" && r.Method == http.MethodGet {
+			active := query.Get("active") == "true"
+			now := time.Now()
+			json.NewEncoder(w).Encode(SignedURLAuditResponse{
+				Success: true,
+				Grants: signedURLAudit.Grants(query.Get("bucket"), query.Get("prefix"), func(grant SignedURLGrant) bool {
+					return !active || grant.Active(now)
+				}),
+			})
+			return
+		}
+		if action != "/revoke" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(SignedURLAuditResponse{
+				Success: false,
+				Error:   "Not found. Use /admin/signedurls or /admin/signedurls/revoke",
+			})
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(SignedURLAuditResponse{
+				Success: false,
+				Error:   "Method not allowed. Use POST.",
+			})
+			return
+		}
+
+		bucket, object, prefix := query.Get("bucket"), query.Get("object"), query.Get("prefix")
+		if _, ok := enforcer.backends[bucket]; !ok || (object == "") == (prefix == "") {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(SignedURLAuditResponse{
+				Success: false,
+				Error:   "A registered bucket and either object or prefix are required",
+			})
+			return
+		}
+
+		// Record who revoked: the admin's login, or the fingerprint of the admin key
+		revokedBy := secretFingerprint(r.Header.Get("X-API-Key"))
+		if oidc != nil {
+			if session, ok := oidc.Session(r); ok {
+				revokedBy = session.Email
+			}
+		}
+		revoked, err := signedURLAudit.RevokeGrants(bucket, object, prefix, revokedBy)
+		if err != nil {
+			log.Printf("⚠️  Failed to revoke signed URLs of %s/%s%s: %v", bucket, object, prefix, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(SignedURLAuditResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+		signedURLRevokedTotal.WithLabelValues(bucket).Add(float64(len(revoked)))
+		log.Printf("🔏 Revoked %d signed URL(s) of %s/%s%s", len(revoked), bucket, object, prefix)
+
+		ctx, cancel := context.WithTimeout(r.Context(), serverWriteTimeout)
+		defer cancel()
+		rotated, quarantined := enforcer.enforce(ctx, revoked)
+		json.NewEncoder(w).Encode(SignedURLAuditResponse{
+			Success:     true,
+			Grants:      revoked,
+			Rotated:     rotated,
+			Quarantined: quarantined,
+		})
+	}
+}
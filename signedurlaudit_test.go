@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRevokeDirectDownloadKeepsObject(t *testing.T) {
+	audit, err := OpenSignedURLAudit(filepath.Join(t.TempDir(), "signedurls.jsonl"), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedURLAudit = audit
+	t.Cleanup(func() {
+		signedURLAudit = nil
+		audit.Close()
+	})
+
+	backend := newMockBackend()
+	for _, name := range []string{"shared.jpg", "uploaded.jpg"} {
+		backend.Put(context.Background(), name, strings.NewReader("x"), PutOptions{ContentType: "image/jpeg"})
+	}
+	now := time.Now().UTC()
+	audit.Put(SignedURLGrant{ID: "get", Bucket: backend.Bucket(), Object: "shared.jpg", Method: http.MethodGet, IssuedAt: now, ExpiresAt: now.Add(time.Hour)})
+	audit.Put(SignedURLGrant{ID: "put", Bucket: backend.Bucket(), Object: "uploaded.jpg", Method: http.MethodPut, IssuedAt: now, ExpiresAt: now.Add(15 * time.Minute)})
+
+	handler := HandleSignedURLAudit(NewSignedURLEnforcer(map[string]Backend{backend.Bucket(): backend}), nil)
+	revoke := func(object string) SignedURLAuditResponse {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/admin/signedurls/revoke?bucket="+backend.Bucket()+"&object="+object, nil))
+		var resp SignedURLAuditResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("revoke %s: status %d, %v", object, rec.Code, err)
+		}
+		return resp
+	}
+
+	if resp := revoke("shared.jpg"); len(resp.Grants) != 1 || len(resp.Rotated) != 0 {
+		t.Errorf("revoking the download URL: %+v, want it revoked without renaming", resp)
+	}
+	if _, err := backend.Stat(context.Background(), "shared.jpg"); err != nil {
+		t.Errorf("object of a revoked download URL: %v, want it left in place", err)
+	}
+
+	resp := revoke("uploaded.jpg")
+	if renamed := resp.Rotated["uploaded.jpg"]; renamed == "" {
+		t.Fatalf("revoking the upload URL: %+v, want its object renamed", resp)
+	}
+	if _, err := backend.Stat(context.Background(), "uploaded.jpg"); err == nil {
+		t.Error("object of a revoked upload URL is still under its name")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	iamcredentials "google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// signBlobTimeout bounds one IAM Credentials SignBlob call; SignBytes has no context
+const signBlobTimeout = 10 * time.Second
+
+// impersonatedSigner signs URLs as a service account without its private key:
+// the runtime identity impersonates the account and has it sign the URL
+// through the IAM Credentials API. The runtime identity needs Service Account
+// Token Creator on the account, and the account itself signBlob permission
+// (Token Creator on itself). A signing account per bucket keeps each one's
+// storage access, including IAM conditions on the bucket, to its own bucket.
+type impersonatedSigner struct {
+	account string
+	service *iamcredentials.Service
+}
+
+// newImpersonatedSigner creates a signer for account, impersonated with the
+// credentials in opts
+func newImpersonatedSigner(ctx context.Context, account string, opts []option.ClientOption) (*impersonatedSigner, error) {
+	tokens, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: account,
+		Scopes:          []string{iamcredentials.CloudPlatformScope},
+	}, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to impersonate %s: %w", account, err)
+	}
+	service, err := iamcredentials.NewService(ctx, option.WithTokenSource(tokens))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create IAM credentials client: %w", err)
+	}
+	return &impersonatedSigner{account: account, service: service}, nil
+}
+
+// SignBytes signs a payload as the account, for storage.SignedURLOptions
+func (s *impersonatedSigner) SignBytes(payload []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), signBlobTimeout)
+	defer cancel()
+
+	response, err := s.service.Projects.ServiceAccounts.SignBlob("projects/-/serviceAccounts/"+s.account, &iamcredentials.SignBlobRequest{
+		Payload: base64.StdEncoding.EncodeToString(payload),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign as %s: %w", s.account, err)
+	}
+	return base64.StdEncoding.DecodeString(response.SignedBlob)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm       = "AWS4-HMAC-SHA256"
+	sigV4UnsignedPayload = "UNSIGNED-PAYLOAD"
+	sigV4TimeFormat      = "20060102T150405Z"
+	sigV4DateFormat      = "20060102"
+)
+
+// sigV4Signer signs S3-compatible requests with AWS Signature Version 4
+type sigV4Signer struct {
+	accessKeyID     string
+	secretAccessKey string
+	region          string
+	service         string
+}
+
+// SignRequest adds the Authorization header to req
+func (s *sigV4Signer) SignRequest(req *http.Request, now time.Time) {
+	now = now.UTC()
+	req.URL.RawPath = canonicalURI(req.URL.Path)
+	req.Header.Set("X-Amz-Date", now.Format(sigV4TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", sigV4UnsignedPayload)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || lower == "content-md5" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+
+	signedHeaders, canonicalHeaders := canonicalizeHeaders(headers)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		sigV4UnsignedPayload,
+	}, "\n")
+
+	scope := s.scope(now)
+	signature := s.signature(now, scope, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, s.accessKeyID, scope, signedHeaders, signature))
+}
+
+// Presign returns a query-string signed URL valid for expires
+func (s *sigV4Signer) Presign(method string, u *url.URL, headers map[string]string, expires time.Duration, now time.Time) string {
+	now = now.UTC()
+
+	allHeaders := map[string]string{"host": u.Host}
+	for name, value := range headers {
+		allHeaders[strings.ToLower(name)] = strings.TrimSpace(value)
+	}
+	signedHeaders, canonicalHeaders := canonicalizeHeaders(allHeaders)
+
+	scope := s.scope(now)
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", sigV4Algorithm)
+	query.Set("X-Amz-Credential", s.accessKeyID+"/"+scope)
+	query.Set("X-Amz-Date", now.Format(sigV4TimeFormat))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	query.Set("X-Amz-SignedHeaders", signedHeaders)
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		canonicalURI(u.Path),
+		canonicalQuery(query),
+		canonicalHeaders,
+		signedHeaders,
+		sigV4UnsignedPayload,
+	}, "\n")
+
+	query.Set("X-Amz-Signature", s.signature(now, scope, canonicalRequest))
+
+	signed := *u
+	signed.RawPath = canonicalURI(u.Path)
+	signed.RawQuery = canonicalQuery(query)
+	return signed.String()
+}
+
+func (s *sigV4Signer) scope(now time.Time) string {
+	return fmt.Sprintf("%s/%s/%s/aws4_request", now.Format(sigV4DateFormat), s.region, s.service)
+}
+
+func (s *sigV4Signer) signature(now time.Time, scope, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		now.Format(sigV4TimeFormat),
+		scope,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretAccessKey), now.Format(sigV4DateFormat))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, s.service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalizeHeaders returns the signed header list and canonical header block
+func canonicalizeHeaders(headers map[string]string) (string, string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name)
+		canonical.WriteString(":")
+		canonical.WriteString(headers[name])
+		canonical.WriteString("\n")
+	}
+	return strings.Join(names, ";"), canonical.String()
+}
+
+// canonicalURI encodes each path segment as required by SigV4
+func canonicalURI(path string) string {
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = sigV4Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery encodes and sorts query parameters as required by SigV4
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, sigV4Escape(key)+"="+sigV4Escape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// sigV4Escape percent-encodes everything except RFC 3986 unreserved characters
+func sigV4Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMTPAlerter emails operators when the service stays unready for longer than
+// the configured duration or the 5xx rate crosses the threshold. Each alert is
+// sent once when it fires and once when it resolves.
+type SMTPAlerter struct {
+	cfg SMTPConfig
+
+	mu     sync.Mutex
+	firing map[string]bool
+}
+
+// Alert names
+const (
+	alertReadiness = "readiness"
+	alertErrorRate = "error_rate"
+)
+
+// NewSMTPAlerter creates an alerter from config
+func NewSMTPAlerter(cfg SMTPConfig) *SMTPAlerter {
+	return &SMTPAlerter{cfg: cfg, firing: map[string]bool{}}
+}
+
+// Evaluate checks the alert conditions against a health status
+func (a *SMTPAlerter) Evaluate(status HealthStatus) {
+	unready := !status.Ready && time.Since(status.FailingSince) >= a.cfg.ReadinessAfter
+	var details []string
+	for name, result := range status.Checks {
+		if err, ok := status.Errors[name]; ok {
+			result = err
+		}
+		if result != "ok" {
+			details = append(details, fmt.Sprintf("%s: %s", name, result))
+		}
+	}
+	a.transition(alertReadiness, unready,
+		fmt.Sprintf("Readiness check failing since %s\n\n%s", status.FailingSince.Format(time.RFC3339), strings.Join(details, "\n")),
+		"Readiness check recovered")
+
+	highErrorRate := status.Requests >= int64(a.cfg.MinRequests) && status.ErrorRate >= a.cfg.ErrorRateThreshold
+	a.transition(alertErrorRate, highErrorRate,
+		fmt.Sprintf("Error rate %.1f%% over the last %d minutes (%d requests, threshold %.1f%%)",
+			status.ErrorRate*100, errorRateWindow, status.Requests, a.cfg.ErrorRateThreshold*100),
+		fmt.Sprintf("Error rate back to %.1f%%", status.ErrorRate*100))
+}
+
+// transition sends a mail when an alert starts or stops firing
+func (a *SMTPAlerter) transition(alert string, firing bool, firingBody, resolvedBody string) {
+	a.mu.Lock()
+	changed := a.firing[alert] != firing
+	a.firing[alert] = firing
+	a.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	subject := fmt.Sprintf("[ALERT] %s", alert)
+	body := firingBody
+	if !firing {
+		subject = fmt.Sprintf("[RESOLVED] %s", alert)
+		body = resolvedBody
+	}
+
+	go func() {
+		if err := a.send(subject, body); err != nil {
+			notificationErrorsTotal.WithLabelValues("smtp").Inc()
+			log.Printf("⚠️  Failed to send alert email: %v", err)
+		}
+	}()
+}
+
+// send delivers one email to all recipients
+func (a *SMTPAlerter) send(subject, body string) error {
+	var auth smtp.Auth
+	if a.cfg.Username != "" {
+		auth = smtp.PlainAuth("", a.cfg.Username, a.cfg.Password, a.cfg.Host)
+	}
+
+	message := strings.Join([]string{
+		"From: " + a.cfg.From,
+		"To: " + strings.Join(a.cfg.To, ", "),
+		"Subject: GCS Image Upload Service " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")
+
+	addr := net.JoinHostPort(a.cfg.Host, a.cfg.Port)
+	return smtp.SendMail(addr, auth, a.cfg.From, a.cfg.To, []byte(message))
+}
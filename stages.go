@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+)
+
+// builtinStages are the stages a pipeline can be built from, in the order
+// of the default pipeline
+var builtinStages = []Stage{
+	animationStage{},
+	orientStage{},
+	colorStage{},
+	reencodeStage{},
+	posterStage{},
+	phashStage{},
+	eventStage{},
+}
+
+// animationStage enforces the frame and duration limits of animated GIF/WebP
+// files and renders the first frame of GIFs for the poster stage
+type animationStage struct{}
+
+func (animationStage) Name() string  { return "animation" }
+func (animationStage) Phase() string { return PhaseValidate }
+
+func (animationStage) Applies(job *PipelineJob) bool {
+	return job.Options.Animated != nil && (job.Ext == ".gif" || job.Ext == ".webp")
+}
+
+func (animationStage) Run(ctx context.Context, job *PipelineJob) error {
+	limits := *job.Options.Animated
+	animation, err := inspectAnimation(job.Data, job.Ext)
+	if err != nil {
+		return err
+	}
+	if err := checkAnimation(animation, limits); err != nil {
+		return err
+	}
+	// WebP has no stdlib decoder, so only GIFs get a poster. The poster is
+	// rendered from the original, before transform stages touch it.
+	if limits.Poster && job.Ext == ".gif" && animation.Frames > 1 {
+		if job.Poster, err = gifPoster(job.Data); err != nil {
+			return fmt.Errorf("%w: file could not be decoded", errInvalidImage)
+		}
+	}
+	return nil
+}
+
+// orientStage rotates JPEGs upright per their EXIF orientation. It runs
+// before colorStage and reencodeStage, which need or drop the EXIF and ICC
+// segments it keeps.
+type orientStage struct{}
+
+func (orientStage) Name() string  { return "orient" }
+func (orientStage) Phase() string { return PhaseTransform }
+
+func (orientStage) Applies(job *PipelineJob) bool {
+	return job.Options.Orient != nil && (job.Ext == ".jpg" || job.Ext == ".jpeg")
+}
+
+func (orientStage) Run(ctx context.Context, job *PipelineJob) error {
+	job.Data = autoOrient(job.Data, job.Ext, *job.Options.Orient)
+	return nil
+}
+
+// colorStage converts images to sRGB and strips their ICC profiles
+type colorStage struct{}
+
+func (colorStage) Name() string  { return "color" }
+func (colorStage) Phase() string { return PhaseTransform }
+
+func (colorStage) Applies(job *PipelineJob) bool {
+	return job.Options.Color != nil && hasColorProfiles(job.Ext)
+}
+
+func (colorStage) Run(ctx context.Context, job *PipelineJob) error {
+	job.Data = normalizeColor(job.Data, job.Ext, *job.Options.Color)
+	return nil
+}
+
+// reencodeStage decodes and re-encodes raster images (paranoid mode). SVG,
+// which can't be re-encoded, is rejected.
+type reencodeStage struct{}
+
+func (reencodeStage) Name() string  { return "reencode" }
+func (reencodeStage) Phase() string { return PhaseTransform }
+
+func (reencodeStage) Applies(job *PipelineJob) bool {
+	return job.Options.Reencode != nil
+}
+
+func (reencodeStage) Run(ctx context.Context, job *PipelineJob) error {
+	data, err := reencodeImage(job.Data, job.Ext, *job.Options.Reencode)
+	if err != nil {
+		return err
+	}
+	job.Data = data
+	return nil
+}
+
+// posterStage stores the poster rendered by animationStage next to the
+// object. The poster is a rendition of the original and isn't registered on
+// its own.
+type posterStage struct{}
+
+func (posterStage) Name() string  { return "poster" }
+func (posterStage) Phase() string { return PhasePersist }
+
+func (posterStage) Applies(job *PipelineJob) bool {
+	// Decided before the poster exists, so this only rules out files that can't have one
+	return job.Options.Animated != nil && job.Options.Animated.Poster && job.Ext == ".gif"
+}
+
+func (posterStage) Run(ctx context.Context, job *PipelineJob) error {
+	if job.Poster == nil {
+		return nil
+	}
+	name := posterName(job.Info.Name)
+	_, err := job.Backend.Put(ctx, name, bytes.NewReader(job.Poster), PutOptions{ContentType: "image/png"})
+	if err != nil {
+		return fmt.Errorf("failed to store poster of %s: %w", job.Info.Name, err)
+	}
+	job.Record.Metadata = mergeMetadata(job.Record.Metadata, map[string]string{"poster": name})
+	return nil
+}
+
+// phashStage computes the perceptual hash used by the near-duplicate search
+type phashStage struct{}
+
+func (phashStage) Name() string  { return "phash" }
+func (phashStage) Phase() string { return PhasePersist }
+
+func (phashStage) Applies(job *PipelineJob) bool {
+	return job.Options.PHash && isRasterExt(job.Ext)
+}
+
+func (phashStage) Run(ctx context.Context, job *PipelineJob) error {
+	job.Record.PHash = perceptualHash(job.Data, job.Options.PHashMax)
+	return nil
+}
+
+// eventStage publishes the upload event to the event sinks
+type eventStage struct{}
+
+func (eventStage) Name() string  { return "event" }
+func (eventStage) Phase() string { return PhaseNotify }
+
+func (eventStage) Applies(job *PipelineJob) bool {
+	return true
+}
+
+func (eventStage) Run(ctx context.Context, job *PipelineJob) error {
+	PublishEvent(AssetEvent{
+		Type:        EventUpload,
+		Bucket:      job.Backend.Bucket(),
+		Object:      job.Info.Name,
+		Size:        job.Info.Size,
+		ContentType: job.Info.ContentType,
+		Tenant:      job.Options.Tenant,
+		Uploader:    job.Options.Uploader,
+		LatencyMs:   float64(time.Since(job.Options.Started).Microseconds()) / 1000,
+	})
+	return nil
+}
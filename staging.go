@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// StagingConfig holds the staging prefix uploads are written under until published
+type StagingConfig struct {
+	Enabled bool
+	Prefix  string
+	// AutoPublish publishes uploads as soon as their processing stages
+	// succeed; without it they wait for POST /objects/{name}/publish
+	AutoPublish bool
+}
+
+// Staging keeps uploads under a prefix of their bucket while they are
+// processed and moves them to their final name when published, so a
+// half-processed image is never listed or served under its public name.
+// All methods are safe on a nil Staging, which stores uploads directly.
+type Staging struct {
+	prefix      string
+	autoPublish bool
+}
+
+// staging is the process-wide staging area; nil (uploads are stored in place) until set in main
+var staging *Staging
+
+// NewStaging returns nil when staging is disabled
+func NewStaging(cfg StagingConfig) *Staging {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &Staging{
+		prefix:      strings.TrimSuffix(cfg.Prefix, "/") + "/",
+		autoPublish: cfg.AutoPublish,
+	}
+}
+
+// Prefix returns the folder uploads under prefix are staged in
+func (s *Staging) Prefix(prefix string) string {
+	if s == nil {
+		return prefix
+	}
+	return s.prefix + prefix
+}
+
+// Hides reports whether name is a staged object, which must not be listed or served
+func (s *Staging) Hides(name string) bool {
+	return s != nil && strings.HasPrefix(name, s.prefix)
+}
+
+// hiddenObject reports whether an object is quarantined or staged
+func hiddenObject(name string) bool {
+	return quarantine.Hides(name) || staging.Hides(name)
+}
+
+// publish moves a staged object and its poster to their final names and
+// returns the updated record. collision applies to the final name as it
+// does to uploads. The catalog is left to the caller.
+func (s *Staging) publish(ctx context.Context, backend Backend, record AssetRecord, collision string) (AssetRecord, *ObjectInfo, error) {
+	final := strings.TrimPrefix(record.Name, s.prefix)
+	move := func(name string) (*ObjectInfo, error) {
+		return moveObject(ctx, backend, record.Name, backend, name, nil, nil, collision == CollisionSuffix || collision == CollisionReject)
+	}
+	var info *ObjectInfo
+	var err error
+	if collision == CollisionSuffix {
+		// The staged object is read from the start on every move
+		final, info, err = writeFreeObjectName(ctx, backend, final, move, func() error { return nil })
+	} else {
+		info, err = move(final)
+	}
+	if err != nil {
+		return record, nil, err
+	}
+
+	if poster := record.Metadata["poster"]; poster != "" {
+		// A poster left behind only costs storage, so it doesn't fail the publish
+		if _, err := moveObject(ctx, backend, poster, backend, posterName(final), nil, nil, false); err != nil {
+			traceLogf(ctx, "⚠️  Failed to publish poster %s of %s: %v", poster, final, err)
+			record.Metadata = mergeMetadata(record.Metadata, nil, "poster")
+		} else {
+			record.Metadata = mergeMetadata(record.Metadata, map[string]string{"poster": posterName(final)})
+		}
+	}
+	if info.Name == "" {
+		info.Name = final
+	}
+	record.Name, record.Size, record.ContentType = final, info.Size, info.ContentType
+	stagingPublishedTotal.WithLabelValues(backend.Bucket()).Inc()
+	return record, info, nil
+}
+
+// Publish moves a staged upload to its final name and updates its catalog
+// record. It fails with ErrObjectExists when collision forbids replacing an
+// object stored under that name since.
+func (s *Staging) Publish(ctx context.Context, backend Backend, name, collision string) (AssetRecord, error) {
+	if !s.Hides(name) {
+		return AssetRecord{}, ErrObjectNotFound
+	}
+	if err := checkDeletable(ctx, backend, name); err != nil {
+		return AssetRecord{}, err
+	}
+	record, ok := metadataStore.Get(backend.Bucket(), name)
+	if !ok {
+		record = AssetRecord{Bucket: backend.Bucket(), Name: name, Source: SourceUpload}
+	}
+
+	published, _, err := s.publish(ctx, backend, record, collision)
+	if err != nil {
+		return AssetRecord{}, err
+	}
+	if err := metadataStore.Delete(backend.Bucket(), name); err != nil {
+		traceLogf(ctx, "⚠️  Failed to remove %s from metadata store: %v", name, err)
+	}
+	if err := metadataStore.Put(published); err != nil {
+		traceLogf(ctx, "⚠️  Failed to register published %s in metadata store: %v", published.Name, err)
+	}
+	traceLogf(ctx, "📢 Published %s/%s as %s", backend.Bucket(), name, published.Name)
+	PublishEvent(AssetEvent{
+		Type:        EventPublish,
+		Bucket:      backend.Bucket(),
+		Object:      published.Name,
+		Size:        published.Size,
+		ContentType: published.ContentType,
+		Tenant:      published.Tenant,
+		Uploader:    published.Uploader,
+	})
+	return published, nil
+}
+
+// HandlePublish serves POST /objects/{name}/publish: it moves a staged upload,
+// named as in its upload response, to its final name. The collision policy
+// of the final name can be chosen with ?collision=.
+func HandlePublish(backend Backend, config *Config, mountPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "Method not allowed. Use POST.",
+			})
+			return
+		}
+
+		name, ok := objectPathName(r, mountPath, "/publish")
+		if !ok || !staging.Hides(name) || quarantine.Hides(name) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Not found. Use %s{staged name}/publish", mountPath),
+			})
+			return
+		}
+
+		collision, err := parseCollisionPolicy(r.URL.Query().Get("collision"), config.CollisionPolicy)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), serverWriteTimeout)
+		defer cancel()
+
+		record, err := staging.Publish(ctx, backend, name, collision)
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrObjectNotFound):
+				status = http.StatusNotFound
+			case errors.Is(err, ErrObjectExists):
+				status = http.StatusConflict
+			case errors.Is(err, ErrObjectHeld):
+				status = http.StatusLocked
+			}
+			log.Printf("⚠️  Failed to publish %s/%s: %v", backend.Bucket(), name, err)
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+
+		response := UploadResponse{
+			Success: true,
+			URL:     backend.PublicURL(record.Name),
+			Object:  record.Name,
+			Tags:    record.Tags,
+			Message: "Image published successfully",
+		}
+		if poster := record.Metadata["poster"]; poster != "" {
+			response.Poster = backend.PublicURL(poster)
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// StartupCheckConfig controls the credential and bucket checks run before serving
+type StartupCheckConfig struct {
+	Enabled bool
+	Timeout time.Duration // per bucket
+}
+
+// accessChecker is implemented by backends with a cheaper or more precise
+// access check than listing objects
+type accessChecker interface {
+	CheckAccess(ctx context.Context) (string, error)
+}
+
+// checkBackendAccess verifies the credentials and bucket of a backend. The
+// primary of a tee or failover backend is checked; a failing failover bucket
+// only gets a warning, since it isn't used until the primary has an outage.
+func checkBackendAccess(ctx context.Context, backend Backend) (string, error) {
+	if tee, ok := backend.(*TeeBackend); ok {
+		backend = tee.Backend
+	}
+	if failover, ok := backend.(*FailoverBackend); ok {
+		if _, err := checkBackendAccess(ctx, failover.failover); err != nil {
+			log.Printf("⚠️  Failover bucket %s is not usable: %v", failover.failover.Bucket(), err)
+		}
+		backend = failover.Backend
+	}
+	if checker, ok := backend.(accessChecker); ok {
+		return checker.CheckAccess(ctx)
+	}
+	// Listing a prefix that matches nothing verifies credentials and bucket access
+	if err := backend.List(ctx, "__startup__/", func(ObjectInfo) error { return nil }); err != nil {
+		return "", err
+	}
+	return "readable", nil
+}
+
+// explainAccessError turns a failed access check into a message saying what
+// to fix. identity is the service account in use, if known.
+func explainAccessError(bucket, identity string, err error) error {
+	as := ""
+	if identity != "" {
+		as = " as " + identity
+	}
+
+	var apiErr *googleapi.Error
+	var s3Err *s3StatusError
+	errors.As(err, &apiErr)
+	errors.As(err, &s3Err)
+	switch {
+	case errors.Is(err, storage.ErrBucketNotExist),
+		apiErr != nil && apiErr.Code == http.StatusNotFound,
+		s3Err != nil && s3Err.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("bucket %s not found%s: check the bucket name and that it is in the project of the credentials", bucket, as)
+	case apiErr != nil && apiErr.Code == http.StatusForbidden:
+		// GCS names the missing permission, e.g. "does not have storage.objects.list access"
+		return fmt.Errorf("access to bucket %s denied%s: %s; grant roles/storage.objectAdmin on the bucket", bucket, as, apiErr.Message)
+	case apiErr != nil && apiErr.Code == http.StatusUnauthorized:
+		return fmt.Errorf("credentials rejected for bucket %s%s: the key may be deleted or disabled: %s", bucket, as, apiErr.Message)
+	case s3Err != nil && (s3Err.StatusCode == http.StatusForbidden || s3Err.StatusCode == http.StatusUnauthorized):
+		return fmt.Errorf("access to bucket %s denied: check R2_ACCESS_KEY_ID, R2_SECRET_ACCESS_KEY and the token's bucket permissions: %s", bucket, s3Err.Status)
+	case strings.Contains(err.Error(), "oauth2") || strings.Contains(err.Error(), "credentials"):
+		return fmt.Errorf("failed to obtain an OAuth token for bucket %s%s: check GCS_AUTH_1, workload identity or the attached service account: %w", bucket, as, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("bucket %s did not answer in time: check network access to the storage API", bucket)
+	}
+	return fmt.Errorf("bucket %s is not accessible%s: %w", bucket, as, err)
+}
+
+// credentialIdentity returns the client_email of a service account key file
+func credentialIdentity(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	var key struct {
+		ClientEmail string `json:"client_email"`
+	}
+	json.Unmarshal(data, &key)
+	return key.ClientEmail
+}
+
+// runStartupChecks checks every bucket before the server accepts requests,
+// so wrong credentials, projects or permissions fail the deployment instead
+// of the first upload. The OAuth tokens fetched on the way are cached by the
+// clients, which saves the first requests that round trip.
+func runStartupChecks(cfg StartupCheckConfig, credentialsPath string, backends ...Backend) error {
+	identity := ""
+	if credentialsPath != "" {
+		identity = credentialIdentity(credentialsPath)
+	}
+	var problems []string
+	for _, backend := range backends {
+		if backend == nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+		start := time.Now()
+		detail, err := checkBackendAccess(ctx, backend)
+		cancel()
+		if err != nil {
+			problems = append(problems, explainAccessError(backend.Bucket(), identity, err).Error())
+			continue
+		}
+		log.Printf("🔑 Bucket %s: %s (%dms)", backend.Bucket(), detail, time.Since(start).Milliseconds())
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const topContentTypesLimit = 5
+
+// BucketStats summarizes the content of a bucket
+type BucketStats struct {
+	Bucket          string             `json:"bucket"`
+	Objects         int64              `json:"objects"`
+	TotalBytes      int64              `json:"totalBytes"`
+	UploadsLast24h  int64              `json:"uploadsLast24h"`
+	TopContentTypes []ContentTypeCount `json:"topContentTypes"`
+	ComputedAt      time.Time          `json:"computedAt"`
+}
+
+// ContentTypeCount is the number of objects of one content type
+type ContentTypeCount struct {
+	ContentType string `json:"contentType"`
+	Objects     int64  `json:"objects"`
+}
+
+// StatsResponse is returned by GET /stats
+type StatsResponse struct {
+	Buckets []BucketStats `json:"buckets"`
+}
+
+// statsRefreshTimeout bounds a listing that computes bucket statistics. It
+// runs detached from the request that started it, which may give up sooner.
+const statsRefreshTimeout = 10 * time.Minute
+
+// statsCache computes bucket statistics by listing and caches them for ttl,
+// since a full listing of a large bucket is slow and billed per request
+type statsCache struct {
+	ttl        time.Duration
+	mu         sync.Mutex
+	entries    map[string]*BucketStats
+	refreshing map[string]*statsRefresh // listings in progress, by bucket
+	stop       chan struct{}
+}
+
+// statsRefresh is one listing of a bucket; done is closed when it finished
+type statsRefresh struct {
+	done  chan struct{}
+	stats *BucketStats
+	err   error
+}
+
+func newStatsCache(ttl time.Duration) *statsCache {
+	return &statsCache{ttl: ttl, entries: map[string]*BucketStats{}, refreshing: map[string]*statsRefresh{}, stop: make(chan struct{})}
+}
+
+// Get returns cached statistics for the backend. Stale statistics are
+// returned at once while they are recomputed in the background; only the
+// first request for a bucket waits for the listing. Concurrent requests
+// share one listing, and requests for other buckets aren't held up by it.
+func (c *statsCache) Get(ctx context.Context, backend Backend) (*BucketStats, error) {
+	c.mu.Lock()
+	stats, ok := c.entries[backend.Bucket()]
+	if ok && time.Since(stats.ComputedAt) < c.ttl {
+		c.mu.Unlock()
+		return stats, nil
+	}
+	refresh := c.refreshing[backend.Bucket()]
+	if refresh == nil {
+		refresh = &statsRefresh{done: make(chan struct{})}
+		c.refreshing[backend.Bucket()] = refresh
+		go c.refresh(context.WithoutCancel(ctx), backend, refresh)
+	}
+	c.mu.Unlock()
+	if ok {
+		return stats, nil
+	}
+
+	select {
+	case <-refresh.done:
+		return refresh.stats, refresh.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// refresh lists the bucket and stores the statistics
+func (c *statsCache) refresh(ctx context.Context, backend Backend, refresh *statsRefresh) {
+	ctx, cancel := context.WithTimeout(ctx, statsRefreshTimeout)
+	defer cancel()
+	refresh.stats, refresh.err = computeBucketStats(ctx, backend)
+
+	c.mu.Lock()
+	if refresh.err == nil {
+		c.entries[backend.Bucket()] = refresh.stats
+	} else {
+		log.Printf("⚠️  Failed to compute stats of %s: %v", backend.Bucket(), refresh.err)
+	}
+	delete(c.refreshing, backend.Bucket())
+	c.mu.Unlock()
+	close(refresh.done)
+
+	if refresh.err == nil {
+		notifier.CheckQuota(refresh.stats)
+	}
+}
+
+// StartQuotaChecks computes the statistics of every backend every interval,
+// so quota notifications don't wait for someone to ask for /stats
+func (c *statsCache) StartQuotaChecks(backends map[string]Backend, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				// Stale statistics start a refresh, which checks the quota
+				// and logs failures when it's done
+				for _, backend := range backends {
+					ctx, cancel := context.WithTimeout(context.Background(), interval)
+					c.Get(ctx, backend)
+					cancel()
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends the quota checks
+func (c *statsCache) Stop() {
+	close(c.stop)
+}
+
+// computeBucketStats lists the whole bucket and aggregates object attributes
+func computeBucketStats(ctx context.Context, backend Backend) (*BucketStats, error) {
+	stats := &BucketStats{Bucket: backend.Bucket()}
+	since := time.Now().Add(-24 * time.Hour)
+	contentTypes := map[string]int64{}
+
+	err := backend.List(ctx, "", func(obj ObjectInfo) error {
+		stats.Objects++
+		stats.TotalBytes += obj.Size
+		if obj.Updated.After(since) {
+			stats.UploadsLast24h++
+		}
+
+		contentType := obj.ContentType
+		if contentType == "" {
+			// S3 listings don't include the content type, fall back to the extension
+			contentType = getContentType(strings.ToLower(filepath.Ext(obj.Name)))
+		}
+		contentTypes[contentType]++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for contentType, count := range contentTypes {
+		stats.TopContentTypes = append(stats.TopContentTypes, ContentTypeCount{ContentType: contentType, Objects: count})
+	}
+	sort.Slice(stats.TopContentTypes, func(i, j int) bool {
+		if stats.TopContentTypes[i].Objects != stats.TopContentTypes[j].Objects {
+			return stats.TopContentTypes[i].Objects > stats.TopContentTypes[j].Objects
+		}
+		return stats.TopContentTypes[i].ContentType < stats.TopContentTypes[j].ContentType
+	})
+	if len(stats.TopContentTypes) > topContentTypesLimit {
+		stats.TopContentTypes = stats.TopContentTypes[:topContentTypesLimit]
+	}
+
+	stats.ComputedAt = time.Now()
+	return stats, nil
+}
+
+// HandleStats returns usage statistics for every registered bucket (or ?bucket=name)
+func HandleStats(backends map[string]Backend, cache *statsCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "Method not allowed. Use GET.",
+			})
+			return
+		}
+
+		names := make([]string, 0, len(backends))
+		if bucket := r.URL.Query().Get("bucket"); bucket != "" {
+			if _, ok := backends[bucket]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   "Unknown bucket",
+				})
+				return
+			}
+			names = append(names, bucket)
+		} else {
+			for name := range backends {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+
+		response := StatsResponse{Buckets: []BucketStats{}}
+		for _, name := range names {
+			stats, err := cache.Get(r.Context(), backends[name])
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   fmt.Sprintf("Failed to compute stats for %s: %v", name, err),
+				})
+				return
+			}
+			response.Buckets = append(response.Buckets, *stats)
+		}
+
+		json.NewEncoder(w).Encode(response)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingListBackend counts listings and holds each one until release is closed
+type blockingListBackend struct {
+	*mockBackend
+	listings atomic.Int32
+	release  chan struct{}
+}
+
+func (b *blockingListBackend) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	b.listings.Add(1)
+	<-b.release
+	return b.mockBackend.List(ctx, prefix, fn)
+}
+
+func TestStatsCacheSharesListing(t *testing.T) {
+	backend := &blockingListBackend{mockBackend: newMockBackend(), release: make(chan struct{})}
+	backend.Put(context.Background(), "a.jpg", strings.NewReader("abc"), PutOptions{ContentType: "image/jpeg"})
+	cache := newStatsCache(time.Minute)
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if stats, err := cache.Get(context.Background(), backend); err != nil || stats.Objects != 1 {
+				t.Errorf("Get() = %+v, %v", stats, err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+	if n := backend.listings.Load(); n != 1 {
+		t.Errorf("%d listings, want 1", n)
+	}
+}
+
+func TestStatsCacheServesStale(t *testing.T) {
+	backend := &blockingListBackend{mockBackend: newMockBackend(), release: make(chan struct{})}
+	cache := newStatsCache(time.Minute)
+	stale := &BucketStats{Bucket: backend.Bucket(), Objects: 7, ComputedAt: time.Now().Add(-time.Hour)}
+	cache.entries[backend.Bucket()] = stale
+
+	// The listing is held, so this only returns because it doesn't wait for it
+	if stats, err := cache.Get(context.Background(), backend); stats != stale || err != nil {
+		t.Errorf("Get() = %+v, %v, want the stale stats", stats, err)
+	}
+	close(backend.release)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if stats, _ := cache.Get(context.Background(), backend); stats != stale {
+			if stats.Objects != 0 || backend.listings.Load() != 1 {
+				t.Errorf("refreshed stats = %+v after %d listings", stats, backend.listings.Load())
+			}
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Error("stats were not refreshed")
+}
+
+func TestStatsCacheFirstGetGivesUp(t *testing.T) {
+	backend := &blockingListBackend{mockBackend: newMockBackend(), release: make(chan struct{})}
+	defer close(backend.release)
+	cache := newStatsCache(time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := cache.Get(ctx, backend); err != context.DeadlineExceeded {
+		t.Errorf("Get() error = %v, want context.DeadlineExceeded", err)
+	}
+}
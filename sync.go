@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// syncStateFile is the default state file of the sync agent, in the watched
+// directory; hidden files are never uploaded
+const syncStateFile = ".gcb-sync.json"
+
+// Backoff of files whose upload failed, e.g. while the kiosk is offline
+const (
+	syncRetryBase = 10 * time.Second
+	syncRetryMax  = 10 * time.Minute
+)
+
+// syncedFile is what the sync agent remembers of a file it handled
+type syncedFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Error   string    `json:"error,omitempty"` // why the file was rejected; it's tried again once changed
+}
+
+// syncRetry schedules the next upload attempt of a failed file
+type syncRetry struct {
+	attempts int
+	next     time.Time
+}
+
+// syncAgent uploads the new and changed files of a local directory through
+// the upload pipeline, for kiosks and photo booths. Unchanged files are
+// recognized by size and modification time, then by content, so touching
+// or rewriting a file with the same bytes doesn't upload it again.
+type syncAgent struct {
+	dir       string
+	statePath string
+	settle    time.Duration // files modified more recently are still being written
+	backend   Backend
+	config    *Config
+	tenant    string
+	prefix    string
+
+	files   map[string]syncedFile // by path relative to dir
+	retries map[string]syncRetry
+}
+
+// loadSyncState reads the files handled by a previous run
+func loadSyncState(path string) (map[string]syncedFile, error) {
+	files := map[string]syncedFile{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return files, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return files, nil
+}
+
+// saveState writes the state atomically, so a crash leaves the previous one
+func (a *syncAgent) saveState() {
+	data, err := json.MarshalIndent(a.files, "", "  ")
+	if err == nil {
+		tmp := a.statePath + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, a.statePath)
+		}
+	}
+	if err != nil {
+		log.Printf("⚠️  Failed to save sync state: %v", err)
+	}
+}
+
+// scan uploads the settled files that are new or changed since they were
+// last handled, and whose retry is due
+func (a *syncAgent) scan(ctx context.Context) *ImportResult {
+	now := time.Now()
+	seen := map[string]bool{}
+	var pending []string
+	err := filepath.WalkDir(a.dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(entry.Name(), ".") && file != a.dir {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || hasPartialSuffix(entry.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(a.dir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		seen[rel] = true
+
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(now.Add(-a.settle)) {
+			return nil
+		}
+		if synced, ok := a.files[rel]; ok && synced.Size == info.Size() && synced.ModTime.Equal(info.ModTime()) {
+			return nil
+		}
+		if retry, ok := a.retries[rel]; ok && now.Before(retry.next) {
+			return nil
+		}
+		pending = append(pending, rel)
+		return nil
+	})
+	if err != nil {
+		log.Printf("⚠️  Failed to scan %s: %v", a.dir, err)
+	} else {
+		// Forget deleted files, so they are uploaded again if they come back
+		for rel := range a.files {
+			if !seen[rel] {
+				delete(a.files, rel)
+			}
+		}
+	}
+
+	im := newImporter(a.backend, a.config, a.tenant)
+	im.dedupe = true
+	im.prefix = a.prefix
+	for _, rel := range pending {
+		if ctx.Err() != nil {
+			break
+		}
+		a.syncFile(ctx, im, rel)
+	}
+	return im.finish()
+}
+
+// syncFile uploads one file unless its content was already uploaded
+func (a *syncAgent) syncFile(ctx context.Context, im *importer, rel string) {
+	file := filepath.Join(a.dir, filepath.FromSlash(rel))
+	info, err := os.Stat(file)
+	if err != nil {
+		return
+	}
+	synced := syncedFile{Size: info.Size(), ModTime: info.ModTime()}
+
+	// Other files (notes, thumbnails of the booth software) are remembered
+	// so they're only reported once
+	if err := validateUpload(path.Base(rel), info.Size(), a.config.MaxFileSize); err != nil {
+		synced.Error = err.Error()
+		a.files[rel] = synced
+		a.saveState()
+		log.Printf("⏭️  Skipping %s: %v", rel, err)
+		return
+	}
+
+	sum, err := fileSHA256(file)
+	if err != nil {
+		log.Printf("⚠️  Failed to read %s: %v", rel, err)
+		return
+	}
+	synced.SHA256 = sum
+	if previous, ok := a.files[rel]; ok && previous.SHA256 == sum && previous.Error == "" {
+		// Touched or rewritten with the same content
+		a.files[rel] = synced
+		a.saveState()
+		return
+	}
+
+	err = im.importFile(ctx, rel, info.Size(), func() (io.ReadCloser, error) {
+		return os.Open(file)
+	})
+	switch {
+	case err == nil:
+		delete(a.retries, rel)
+	case errors.Is(err, errInvalidImage):
+		delete(a.retries, rel)
+		synced.Error = err.Error()
+		log.Printf("⏭️  Skipping %s: %v", rel, err)
+	default:
+		retry := a.retries[rel]
+		retry.attempts++
+		backoff := min(syncRetryBase<<(retry.attempts-1), syncRetryMax)
+		retry.next = time.Now().Add(backoff)
+		a.retries[rel] = retry
+		log.Printf("❌ Failed to upload %s (attempt %d, retrying in %s): %v", rel, retry.attempts, backoff, err)
+		return
+	}
+	a.files[rel] = synced
+	a.saveState()
+}
+
+// fileSHA256 returns the hex SHA-256 of a file's content
+func fileSHA256(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// runSyncCommand implements the `sync` CLI subcommand
+func runSyncCommand(args []string) int {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	watch := flags.String("watch", "", "local directory to upload new and changed files from")
+	to := flags.String("to", "", "destination backend as driver:bucket (e.g. gcs:my-bucket)")
+	prefix := flags.String("prefix", "", "folder the files are stored under (e.g. ingest/)")
+	tenant := flags.String("tenant", "", "tenant recorded with the uploaded assets")
+	interval := flags.Duration("interval", 5*time.Second, "time between scans of the directory")
+	settle := flags.Duration("settle", 2*time.Second, "files modified more recently are still being written and wait for the next scan")
+	statePath := flags.String("state", "", "file remembering the uploaded files (default: "+syncStateFile+" in the watched directory)")
+	once := flags.Bool("once", false, "scan once and exit instead of watching")
+	flags.Parse(args)
+
+	if *watch == "" || *to == "" || *interval <= 0 {
+		fmt.Fprintln(os.Stderr, "usage: sync -watch dir -to driver:bucket [-prefix p] [-tenant t] [-interval 5s] [-settle 2s] [-state file] [-once]")
+		return 2
+	}
+	objectPrefix, err := cleanObjectPrefix(*prefix)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -prefix: %v\n", err)
+		return 2
+	}
+	if *statePath == "" {
+		*statePath = filepath.Join(*watch, syncStateFile)
+	}
+
+	config := LoadConfig()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	closeStores, err := openCommandStores(config)
+	if err != nil {
+		log.Printf("❌ %v", err)
+		return 1
+	}
+	defer closeStores()
+
+	dst, err := NewBackend(ctx, config, parseBackendSpec(config, *to))
+	if err != nil {
+		log.Printf("❌ Failed to open destination: %v", err)
+		return 1
+	}
+	defer dst.Close()
+
+	files, err := loadSyncState(*statePath)
+	if err != nil {
+		log.Printf("❌ Failed to load sync state: %v", err)
+		return 1
+	}
+	agent := &syncAgent{
+		dir:       *watch,
+		statePath: *statePath,
+		settle:    *settle,
+		backend:   dst,
+		config:    config,
+		tenant:    *tenant,
+		prefix:    objectPrefix,
+		files:     files,
+		retries:   map[string]syncRetry{},
+	}
+
+	log.Printf("🔄 Syncing %s to %s/%s", *watch, dst.Bucket(), objectPrefix)
+	for {
+		result := agent.scan(ctx)
+		if result.Imported+result.Deduplicated+result.Failed > 0 {
+			log.Printf("🔄 Uploaded %d, deduplicated %d, failed %d (%d bytes)", result.Imported, result.Deduplicated, result.Failed, result.Bytes)
+		}
+		if *once {
+			if result.Failed > 0 {
+				return 1
+			}
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			log.Printf("🔄 Sync stopped")
+			return 0
+		case <-time.After(*interval):
+		}
+	}
+}
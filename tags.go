@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// maxAssetTags bounds the tags of one asset
+const maxAssetTags = 32
+
+// errTooManyTags is returned when an asset would get more than maxAssetTags
+var errTooManyTags = fmt.Errorf("Too many tags: at most %d per asset", maxAssetTags)
+
+// tagPattern restricts tags to lowercase slugs such as "hero-banner"
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// normalizeTags lowercases and trims tags, drops empty ones and duplicates
+// and sorts the rest
+func normalizeTags(tags []string) ([]string, error) {
+	var normalized []string
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			continue
+		}
+		if !tagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("Invalid tag %q: use lowercase letters, digits, '-' or '_'", tag)
+		}
+		normalized = append(normalized, tag)
+	}
+	slices.Sort(normalized)
+	normalized = slices.Compact(normalized)
+	if len(normalized) > maxAssetTags {
+		return nil, errTooManyTags
+	}
+	return normalized, nil
+}
+
+// parseTags parses a comma-separated tag list, e.g. a form field
+func parseTags(value string) ([]string, error) {
+	return normalizeTags(strings.Split(value, ","))
+}
+
+// hasTags reports whether a record carries every one of tags
+func hasTags(record AssetRecord, tags []string) bool {
+	for _, tag := range tags {
+		if _, found := slices.BinarySearch(record.Tags, tag); !found {
+			return false
+		}
+	}
+	return true
+}
+
+// TagsRequest changes the tags of an asset. Tags, when present, replaces
+// them; Add and Remove are applied after.
+type TagsRequest struct {
+	Tags   *[]string `json:"tags,omitempty"`
+	Add    []string  `json:"add,omitempty"`
+	Remove []string  `json:"remove,omitempty"`
+}
+
+// TagsResponse lists the tags of an asset after a change
+type TagsResponse struct {
+	Success bool     `json:"success"`
+	Object  string   `json:"object,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// HandleObjectTags serves PATCH /objects/{name}/tags, changing the tags of an
+// asset in the metadata store
+func HandleObjectTags(backend Backend, mountPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodPatch {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(TagsResponse{
+				Success: false,
+				Error:   "Method not allowed. Use PATCH.",
+			})
+			return
+		}
+
+		name, ok := objectPathName(r, mountPath, "/tags")
+		if !ok || name == "" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(TagsResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Not found. Use %s{name}/tags", mountPath),
+			})
+			return
+		}
+
+		var req TagsRequest
+		if err := decodeJSONBody(w, r, &req, 64*1024); err != nil {
+			w.WriteHeader(err.Status)
+			json.NewEncoder(w).Encode(TagsResponse{
+				Success: false,
+				Error:   err.Message,
+			})
+			return
+		}
+		add, err := normalizeTags(req.Add)
+		if err == nil {
+			req.Remove, err = normalizeTags(req.Remove)
+		}
+		var replace []string
+		if err == nil && req.Tags != nil {
+			replace, err = normalizeTags(*req.Tags)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(TagsResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+
+		record, ok, err := metadataStore.Update(backend.Bucket(), name, func(record *AssetRecord) error {
+			if isQuarantineRecord(*record) {
+				return ErrObjectNotFound
+			}
+			tags := record.Tags
+			if req.Tags != nil {
+				tags = replace
+			}
+			tags = slices.DeleteFunc(append(slices.Clone(tags), add...), func(tag string) bool { return slices.Contains(req.Remove, tag) })
+			tags, err := normalizeTags(tags)
+			if err != nil {
+				return err
+			}
+			record.Tags = tags
+			return nil
+		})
+		switch {
+		case !ok || errors.Is(err, ErrObjectNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(TagsResponse{
+				Success: false,
+				Error:   "Object not found in the metadata store",
+			})
+			return
+		case errors.Is(err, errTooManyTags):
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(TagsResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		case err != nil:
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(TagsResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Failed to store tags: %v", err),
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(TagsResponse{Success: true, Object: record.Name, Tags: record.Tags})
+	}
+}
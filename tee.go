@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TeeBackend writes to the primary backend synchronously and mirrors every
+// write and delete to a secondary backend in the background. Pending mirror
+// operations are persisted in a queue directory so they survive restarts.
+// Reads are always served by the primary.
+type TeeBackend struct {
+	Backend
+	secondary Backend
+	queueDir  string
+	seq       atomic.Uint64
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// mirrorJob is a pending mirror operation persisted in the queue directory
+type mirrorJob struct {
+	Op          string    `json:"op"` // "put" or "delete"
+	Name        string    `json:"name"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+const (
+	mirrorOpPut    = "put"
+	mirrorOpDelete = "delete"
+
+	mirrorPollInterval = 10 * time.Second
+	mirrorMaxBackoff   = 10 * time.Minute
+)
+
+// NewTeeBackend wraps primary so that changes are mirrored to secondary
+func NewTeeBackend(primary, secondary Backend, queueDir string) (*TeeBackend, error) {
+	if err := os.MkdirAll(queueDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create mirror queue directory: %w", err)
+	}
+
+	t := &TeeBackend{
+		Backend:   primary,
+		secondary: secondary,
+		queueDir:  queueDir,
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go t.run()
+	return t, nil
+}
+
+// Put writes to the primary and queues a mirror copy
+func (t *TeeBackend) Put(ctx context.Context, name string, r io.Reader, opts PutOptions) (*ObjectInfo, error) {
+	info, err := t.Backend.Put(ctx, name, r, opts)
+	if err != nil {
+		return nil, err
+	}
+	// The mirror can't read an encrypted object back without the key, which
+	// isn't kept past the request
+	if customerKeyFromContext(ctx) != nil {
+		log.Printf("⚠️  Not mirroring %s: encrypted with a customer-supplied key", name)
+		return info, nil
+	}
+	t.enqueue(mirrorOpPut, name)
+	return info, nil
+}
+
+// Delete removes from the primary and queues the mirror delete
+func (t *TeeBackend) Delete(ctx context.Context, name string) error {
+	if err := t.Backend.Delete(ctx, name); err != nil {
+		return err
+	}
+	t.enqueue(mirrorOpDelete, name)
+	return nil
+}
+
+// BucketSettings returns the settings of the primary bucket when supported
+func (t *TeeBackend) BucketSettings(ctx context.Context) (*BucketSettings, error) {
+	manager, ok := t.Backend.(bucketSettingsManager)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return manager.BucketSettings(ctx)
+}
+
+// UpdateBucketSettings updates the settings of the primary bucket when supported
+func (t *TeeBackend) UpdateBucketSettings(ctx context.Context, settings BucketSettings) error {
+	manager, ok := t.Backend.(bucketSettingsManager)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return manager.UpdateBucketSettings(ctx, settings)
+}
+
+// RetentionPolicy returns the retention policy of the primary bucket when supported
+func (t *TeeBackend) RetentionPolicy(ctx context.Context) (*RetentionPolicy, error) {
+	manager, ok := t.Backend.(retentionManager)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return manager.RetentionPolicy(ctx)
+}
+
+// SetRetentionPolicy sets the retention policy of the primary bucket when supported
+func (t *TeeBackend) SetRetentionPolicy(ctx context.Context, period time.Duration) error {
+	manager, ok := t.Backend.(retentionManager)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return manager.SetRetentionPolicy(ctx, period)
+}
+
+// LockRetentionPolicy locks the retention policy of the primary bucket when supported
+func (t *TeeBackend) LockRetentionPolicy(ctx context.Context) error {
+	manager, ok := t.Backend.(retentionManager)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return manager.LockRetentionPolicy(ctx)
+}
+
+// ObjectRetention returns the holds of an object in the primary when supported
+func (t *TeeBackend) ObjectRetention(ctx context.Context, name string) (*ObjectRetention, error) {
+	manager, ok := t.Backend.(retentionManager)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return manager.ObjectRetention(ctx, name)
+}
+
+// SetTemporaryHold holds or releases an object in the primary when supported
+func (t *TeeBackend) SetTemporaryHold(ctx context.Context, name string, held bool) error {
+	manager, ok := t.Backend.(retentionManager)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return manager.SetTemporaryHold(ctx, name, held)
+}
+
+// OpenRange reads part of an object from the primary when supported
+func (t *TeeBackend) OpenRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	opener, ok := t.Backend.(rangeOpener)
+	if !ok {
+		return nil, nil, errors.ErrUnsupported
+	}
+	return opener.OpenRange(ctx, name, offset, length)
+}
+
+// UploadHeaders returns the headers required by the primary's signed upload URLs
+func (t *TeeBackend) UploadHeaders(opts SignOptions) map[string]string {
+	return signedUploadHeaders(t.Backend, opts)
+}
+
+// Close stops the mirror worker and closes both backends. Pending jobs stay
+// on disk and are picked up on the next start.
+func (t *TeeBackend) Close() error {
+	t.once.Do(func() { close(t.stop) })
+	<-t.done
+
+	err := t.secondary.Close()
+	if primaryErr := t.Backend.Close(); primaryErr != nil {
+		err = primaryErr
+	}
+	return err
+}
+
+// enqueue persists a mirror job and wakes the worker
+func (t *TeeBackend) enqueue(op, name string) {
+	job := mirrorJob{Op: op, Name: name, NextAttempt: time.Now()}
+	path := filepath.Join(t.queueDir, fmt.Sprintf("%020d-%06d.json", time.Now().UnixNano(), t.seq.Add(1)%1000000))
+	if err := writeMirrorJob(path, &job); err != nil {
+		// The primary write already succeeded, so only log: the object will be
+		// missing from the mirror until the next migration run.
+		log.Printf("⚠️  Failed to queue mirror %s of %s: %v", op, name, err)
+		mirrorErrorsTotal.WithLabelValues(t.secondary.Bucket(), "enqueue").Inc()
+		return
+	}
+
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run processes queued jobs until Close is called
+func (t *TeeBackend) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(mirrorPollInterval)
+	defer ticker.Stop()
+
+	for {
+		t.drain()
+		select {
+		case <-t.stop:
+			return
+		case <-t.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// drain processes every due job in the queue in order
+func (t *TeeBackend) drain() {
+	entries, err := os.ReadDir(t.queueDir)
+	if err != nil {
+		log.Printf("⚠️  Failed to read mirror queue: %v", err)
+		return
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".json" {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	mirrorQueueDepth.WithLabelValues(t.secondary.Bucket()).Set(float64(len(names)))
+
+	for _, name := range names {
+		select {
+		case <-t.stop:
+			return
+		default:
+		}
+
+		path := filepath.Join(t.queueDir, name)
+		job, err := readMirrorJob(path)
+		if err != nil {
+			log.Printf("⚠️  Dropping unreadable mirror job %s: %v", name, err)
+			os.Remove(path)
+			continue
+		}
+		if time.Now().Before(job.NextAttempt) {
+			continue
+		}
+
+		if err := t.mirror(job); err != nil {
+			job.Attempts++
+			job.LastError = err.Error()
+			job.NextAttempt = time.Now().Add(mirrorBackoff(job.Attempts))
+			mirrorErrorsTotal.WithLabelValues(t.secondary.Bucket(), job.Op).Inc()
+			log.Printf("⚠️  Mirror %s of %s failed (attempt %d): %v", job.Op, job.Name, job.Attempts, err)
+			if err := writeMirrorJob(path, job); err != nil {
+				log.Printf("⚠️  Failed to update mirror job %s: %v", name, err)
+			}
+			continue
+		}
+
+		os.Remove(path)
+		mirroredObjectsTotal.WithLabelValues(t.secondary.Bucket(), job.Op).Inc()
+	}
+}
+
+// mirror applies a single job to the secondary backend
+func (t *TeeBackend) mirror(job *mirrorJob) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	switch job.Op {
+	case mirrorOpPut:
+		reader, info, err := t.Backend.Open(ctx, job.Name)
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil // deleted from the primary in the meantime
+		}
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		_, err = t.secondary.Put(ctx, job.Name, reader, PutOptions{
+			ContentType:        info.ContentType,
+			ContentDisposition: info.ContentDisposition,
+			Metadata:           info.Metadata,
+			Size:               info.Size,
+		})
+		return err
+	case mirrorOpDelete:
+		if err := t.secondary.Delete(ctx, job.Name); err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return err
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown mirror operation %q", job.Op)
+	}
+}
+
+// mirrorBackoff returns the exponential retry delay for the given attempt
+func mirrorBackoff(attempts int) time.Duration {
+	delay := time.Second << min(attempts, 16)
+	if delay > mirrorMaxBackoff {
+		return mirrorMaxBackoff
+	}
+	return delay
+}
+
+func readMirrorJob(path string) (*mirrorJob, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var job mirrorJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// writeMirrorJob writes the job atomically so a crash never leaves a partial file
+func writeMirrorJob(path string, job *mirrorJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
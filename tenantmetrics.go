@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// tenantMetricLabel is the label carrying the X-Tenant-ID of business metrics
+const tenantMetricLabel = "tenant"
+
+// TenantMetricsConfig controls the tenant label of business metrics and
+// per-tenant scraping of /metrics
+type TenantMetricsConfig struct {
+	Tenants    []string // always labeled by name
+	MaxTenants int      // other tenants labeled as first seen, the rest count as "other"
+	// Tokens are "tenant=token" pairs: a bearer token that only scrapes the
+	// series of its tenant
+	Tokens []string
+}
+
+// metricTenants labels business metrics by tenant; nil (every tenant is "other") until set in main
+var metricTenants *OriginLabels
+
+// parseTenantTokens parses METRICS_TENANT_TOKENS into tokens per tenant
+func parseTenantTokens(entries []string) (map[string]string, error) {
+	tokens := map[string]string{}
+	for _, entry := range entries {
+		tenant, token, ok := strings.Cut(entry, "=")
+		tenant, token = strings.TrimSpace(tenant), strings.TrimSpace(token)
+		if !ok || tenant == "" || token == "" {
+			return nil, fmt.Errorf("%q is not tenant=token", entry)
+		}
+		if len(token) < minSigningKeyLength {
+			return nil, fmt.Errorf("token of %q must be at least %d characters", tenant, minSigningKeyLength)
+		}
+		tokens[tenant] = token
+	}
+	return tokens, nil
+}
+
+// tenantGatherer keeps the series labeled with the tenant; metric families
+// without a tenant label are left out, as they mix every tenant's traffic
+func tenantGatherer(gatherer prometheus.Gatherer, tenant string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := gatherer.Gather()
+		if err != nil {
+			return nil, err
+		}
+		kept := families[:0]
+		for _, family := range families {
+			var metrics []*dto.Metric
+			for _, metric := range family.GetMetric() {
+				for _, label := range metric.GetLabel() {
+					if label.GetName() == tenantMetricLabel && label.GetValue() == tenant {
+						metrics = append(metrics, metric)
+						break
+					}
+				}
+			}
+			if len(metrics) > 0 {
+				family.Metric = metrics
+				kept = append(kept, family)
+			}
+		}
+		return kept, nil
+	})
+}
+
+// HandleMetrics serves /metrics. Scrapers passing MetricsAuthMiddleware see
+// every series and may narrow them with ?tenant=; a tenant token only ever
+// sees the series of its tenant.
+func HandleMetrics(auth MetricsAuthConfig, tenantTokens map[string]string) http.Handler {
+	opts := promhttp.HandlerOpts{EnableOpenMetrics: true}
+	all := promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(prometheus.DefaultGatherer, opts))
+	tenantHandler := func(tenant string) http.Handler {
+		return promhttp.HandlerFor(tenantGatherer(prometheus.DefaultGatherer, tenant), opts)
+	}
+
+	protected := MetricsAuthMiddleware(auth)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tenant := r.URL.Query().Get("tenant"); tenant != "" {
+			tenantHandler(tenant).ServeHTTP(w, r)
+			return
+		}
+		all.ServeHTTP(w, r)
+	}))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			for tenant, tenantToken := range tenantTokens {
+				if subtle.ConstantTimeCompare([]byte(token), []byte(tenantToken)) == 1 {
+					tenantHandler(tenant).ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+		protected.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/googleapis/gax-go/v2/callctx"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// traceContext identifies the trace a request belongs to and the span of
+// the caller (load balancer, upstream service)
+type traceContext struct {
+	TraceID  string // 32 lowercase hex digits
+	ParentID string // 16 lowercase hex digits, empty when the trace started here
+	Sampled  bool
+}
+
+type traceContextKey struct{}
+
+// TraceMiddleware reads the W3C traceparent or Google X-Cloud-Trace-Context
+// header, or starts a new trace when neither is present, and makes it
+// available to logs, metrics and outgoing storage calls. The trace ID is
+// returned in X-Trace-Id so clients can quote it in bug reports.
+func TraceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace, ok := parseTraceparent(r.Header.Get("traceparent"))
+		if !ok {
+			trace, ok = parseCloudTraceContext(r.Header.Get("X-Cloud-Trace-Context"))
+		}
+		if !ok {
+			trace = traceContext{TraceID: randomHex(16)}
+		}
+
+		w.Header().Set("X-Trace-Id", trace.TraceID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), traceContextKey{}, trace)))
+	})
+}
+
+// traceFromContext returns the trace of the current request, if any
+func traceFromContext(ctx context.Context) (traceContext, bool) {
+	trace, ok := ctx.Value(traceContextKey{}).(traceContext)
+	return trace, ok
+}
+
+// parseTraceparent parses a W3C trace context header, e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+func parseTraceparent(header string) (traceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return traceContext{}, false
+	}
+	// Version 00 has exactly four fields; later versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return traceContext{}, false
+	}
+	traceID, parentID, flags := parts[1], parts[2], parts[3]
+	if !isTraceHex(traceID, 32) || !isTraceHex(parentID, 16) || !isTraceHex(flags, 2) {
+		return traceContext{}, false
+	}
+	flagBits, _ := strconv.ParseUint(flags, 16, 8)
+	return traceContext{TraceID: traceID, ParentID: parentID, Sampled: flagBits&1 == 1}, true
+}
+
+// parseCloudTraceContext parses a Google Cloud trace header, e.g.
+// "105445aa7843bc8bf206b12000100000/1;o=1", whose span ID is decimal
+func parseCloudTraceContext(header string) (traceContext, bool) {
+	value, options, _ := strings.Cut(strings.TrimSpace(header), ";")
+	traceID, spanID, _ := strings.Cut(value, "/")
+	traceID = strings.ToLower(traceID)
+	if !isTraceHex(traceID, 32) {
+		return traceContext{}, false
+	}
+
+	trace := traceContext{TraceID: traceID, Sampled: options == "o=1"}
+	if span, err := strconv.ParseUint(spanID, 10, 64); err == nil && span != 0 {
+		trace.ParentID = fmt.Sprintf("%016x", span)
+	}
+	return trace, true
+}
+
+// isTraceHex reports whether s is n lowercase hex digits and not all zeros,
+// which both formats reserve as invalid
+func isTraceHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	zero := true
+	for _, c := range s {
+		switch {
+		case c == '0':
+		case '1' <= c && c <= '9', 'a' <= c && c <= 'f':
+			zero = false
+		default:
+			return false
+		}
+	}
+	// The flags field is the one that may legitimately be 00
+	return !zero || n == 2
+}
+
+// randomHex returns n random bytes as hex
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// traceHeaders returns the headers that continue the request's trace in an
+// outgoing call, with a new span ID for the call
+func traceHeaders(ctx context.Context) map[string]string {
+	trace, ok := traceFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	spanID := randomHex(8)
+	span, _ := strconv.ParseUint(spanID, 16, 64)
+
+	flags, sampled := "00", "0"
+	if trace.Sampled {
+		flags, sampled = "01", "1"
+	}
+	return map[string]string{
+		"traceparent":           "00-" + trace.TraceID + "-" + spanID + "-" + flags,
+		"X-Cloud-Trace-Context": fmt.Sprintf("%s/%d;o=%s", trace.TraceID, span, sampled),
+	}
+}
+
+// withTraceHeaders attaches the trace headers to ctx for Google API calls,
+// which send the headers set with callctx
+func withTraceHeaders(ctx context.Context) context.Context {
+	headers := traceHeaders(ctx)
+	if headers == nil {
+		return ctx
+	}
+	keyvals := make([]string, 0, 2*len(headers))
+	for key, value := range headers {
+		keyvals = append(keyvals, key, value)
+	}
+	return callctx.SetHeaders(ctx, keyvals...)
+}
+
+// setTraceHeaders adds the trace headers to an outgoing HTTP request
+func setTraceHeaders(req *http.Request) {
+	for key, value := range traceHeaders(req.Context()) {
+		req.Header.Set(key, value)
+	}
+}
+
+// traceLogf logs like log.Printf, tagged with the request's trace ID so log
+// lines can be matched with the load balancer logs
+func traceLogf(ctx context.Context, format string, args ...any) {
+	if trace, ok := traceFromContext(ctx); ok {
+		format += " trace=" + trace.TraceID
+	}
+	log.Printf(format, args...)
+}
+
+// traceExemplar returns the exemplar labels linking a metric sample to the
+// request's trace, or nil
+func traceExemplar(ctx context.Context) prometheus.Labels {
+	trace, ok := traceFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return prometheus.Labels{"trace_id": trace.TraceID}
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tus protocol version and extensions served by HandleTus
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,creation-with-upload,expiration,termination"
+)
+
+// tusSweepInterval is how often expired uploads are looked for
+const tusSweepInterval = time.Minute
+
+// tusContentType is the content type of tus PATCH bodies
+const tusContentType = "application/offset+octet-stream"
+
+// tusIDPattern matches the IDs handed out by TusStore.create
+var tusIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// tusFileKeys are the Upload-Metadata keys describing the file, set by Uppy
+// and tus-js-client; they are never stored as object metadata
+var tusFileKeys = []string{"filename", "name", "type", "filetype", "relativePath"}
+
+// TusConfig holds the directory unfinished tus uploads are kept in
+type TusConfig struct {
+	Dir    string
+	Expiry time.Duration // unfinished uploads are removed after this long
+}
+
+// tusUpload is the state of one tus upload, stored next to its data. The
+// upload options are validated when the upload is created, so a client
+// doesn't send a whole file to learn that a tag is invalid.
+type tusUpload struct {
+	ID          string            `json:"id"`
+	Bucket      string            `json:"bucket"`
+	Length      int64             `json:"length"`
+	Offset      int64             `json:"offset"`
+	Filename    string            `json:"filename"`
+	RawMetadata string            `json:"rawMetadata,omitempty"` // Upload-Metadata as sent, returned by HEAD
+	Metadata    map[string]string `json:"metadata,omitempty"`    // object metadata
+	Tags        []string          `json:"tags,omitempty"`
+	Collision   string            `json:"collision"`
+	Disposition string            `json:"disposition,omitempty"`
+	Tenant      string            `json:"tenant,omitempty"`
+	Uploader    string            `json:"uploader,omitempty"`
+	Origin      string            `json:"origin,omitempty"`
+	Created     time.Time         `json:"created"`
+	Result      *UploadResponse   `json:"result,omitempty"` // set once the upload is stored
+}
+
+// TusStore keeps tus uploads on disk until they are complete, so a client
+// can resume an interrupted upload, even on a restarted instance sharing
+// the directory. Completed uploads keep their result until they expire.
+type TusStore struct {
+	dir    string
+	expiry time.Duration
+
+	mu        sync.Mutex
+	busy      map[string]bool // uploads receiving data
+	lastSweep time.Time
+}
+
+// NewTusStore creates the store, creating its directory when needed
+func NewTusStore(cfg TusConfig) (*TusStore, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create tus upload directory: %w", err)
+	}
+	return &TusStore{dir: cfg.Dir, expiry: cfg.Expiry, busy: map[string]bool{}}, nil
+}
+
+// dataPath and infoPath are the files of an upload
+func (s *TusStore) dataPath(id string) string { return filepath.Join(s.dir, id+".bin") }
+func (s *TusStore) infoPath(id string) string { return filepath.Join(s.dir, id+".json") }
+
+// create stores a new upload with no data yet and assigns its ID
+func (s *TusStore) create(upload *tusUpload) error {
+	token := make([]byte, 16)
+	rand.Read(token)
+	upload.ID = hex.EncodeToString(token)
+
+	data, err := os.OpenFile(s.dataPath(upload.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	data.Close()
+	if err := s.save(upload); err != nil {
+		os.Remove(s.dataPath(upload.ID))
+		return err
+	}
+	return nil
+}
+
+// load reads an upload, returning ErrObjectNotFound for unknown or expired IDs
+func (s *TusStore) load(id string) (*tusUpload, error) {
+	if !tusIDPattern.MatchString(id) {
+		return nil, ErrObjectNotFound
+	}
+	data, err := os.ReadFile(s.infoPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var upload tusUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, fmt.Errorf("corrupt tus upload %s: %w", id, err)
+	}
+	if s.expired(&upload) {
+		return nil, ErrObjectNotFound
+	}
+	return &upload, nil
+}
+
+// save writes the state of an upload atomically
+func (s *TusStore) save(upload *tusUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	tmp := s.infoPath(upload.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.infoPath(upload.ID))
+}
+
+// remove deletes an upload and its data
+func (s *TusStore) remove(id string) {
+	for _, path := range []string{s.dataPath(id), s.infoPath(id)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("⚠️  Failed to remove tus upload file %s: %v", path, err)
+		}
+	}
+}
+
+// acquire marks an upload as receiving data; it fails while another
+// request is writing to it
+func (s *TusStore) acquire(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.busy[id] {
+		return false
+	}
+	s.busy[id] = true
+	return true
+}
+
+// release ends the request holding an upload
+func (s *TusStore) release(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.busy, id)
+}
+
+// expires returns when an upload is removed
+func (s *TusStore) expires(upload *tusUpload) time.Time {
+	return upload.Created.Add(s.expiry)
+}
+
+// expired reports whether an upload is past its expiry
+func (s *TusStore) expired(upload *tusUpload) bool {
+	return s.expiry > 0 && time.Now().After(s.expires(upload))
+}
+
+// sweep removes expired uploads, at most once per tusSweepInterval
+func (s *TusStore) sweep() {
+	s.mu.Lock()
+	if s.expiry <= 0 || time.Since(s.lastSweep) < tusSweepInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastSweep = time.Now()
+	s.mu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return
+	}
+	for _, path := range paths {
+		id := strings.TrimSuffix(filepath.Base(path), ".json")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var upload tusUpload
+		if err := json.Unmarshal(data, &upload); err != nil || !s.expired(&upload) {
+			continue
+		}
+		if s.acquire(id) {
+			s.remove(id)
+			s.release(id)
+		}
+	}
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma-separated
+// pairs of a key and its base64 value, which may be left out
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("invalid Upload-Metadata: empty key")
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata: value of %s is not base64", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// HandleTus serves the tus resumable upload protocol (core, creation,
+// creation-with-upload, expiration and termination) under mountPath, as
+// used by Uppy's Tus plugin and tus-js-client:
+//
+//	POST   {mountPath}       creates an upload, Upload-Length and Upload-Metadata (filename, tags, ...)
+//	HEAD   {mountPath}{id}   returns the offset to resume from
+//	PATCH  {mountPath}{id}   appends data at Upload-Offset
+//	DELETE {mountPath}{id}   cancels the upload
+//	GET    {mountPath}{id}   returns the upload response once the file is stored
+//
+// A file is stored once its last byte arrives, through the same ingestion
+// pipeline as multipart uploads.
+func HandleTus(backend Backend, config *Config, store *TusStore, mountPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Tus-Resumable", tusVersion)
+
+		// Clients behind proxies dropping PATCH and DELETE send them as POST
+		method := r.Method
+		if override := r.Header.Get("X-HTTP-Method-Override"); override != "" && method == http.MethodPost {
+			method = strings.ToUpper(override)
+		}
+
+		if method != http.MethodGet && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			w.WriteHeader(http.StatusPreconditionFailed)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Unsupported tus version. Send Tus-Resumable: %s.", tusVersion),
+			})
+			return
+		}
+
+		id := strings.TrimPrefix(r.URL.Path, mountPath)
+		if id == "" {
+			if method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   "Method not allowed. Use POST.",
+				})
+				return
+			}
+			createTusUpload(w, r, backend, config, store, mountPath)
+			return
+		}
+
+		upload, err := store.load(id)
+		if err == nil && upload.Bucket != backend.Bucket() {
+			err = ErrObjectNotFound
+		}
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrObjectNotFound) {
+				status = http.StatusNotFound
+			}
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+
+		switch method {
+		case http.MethodHead:
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+			w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+			if upload.RawMetadata != "" {
+				w.Header().Set("Upload-Metadata", upload.RawMetadata)
+			}
+			w.WriteHeader(http.StatusOK)
+
+		case http.MethodPatch:
+			if r.Header.Get("Content-Type") != tusContentType {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   fmt.Sprintf("Content-Type must be %s", tusContentType),
+				})
+				return
+			}
+			offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+			if err != nil || offset != upload.Offset {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   fmt.Sprintf("Upload-Offset must be %d", upload.Offset),
+				})
+				return
+			}
+			if status, err := receiveTusUpload(w, r, backend, config, store, upload); err != nil {
+				if status != 0 {
+					w.WriteHeader(status)
+					json.NewEncoder(w).Encode(UploadResponse{
+						Success: false,
+						Error:   err.Error(),
+					})
+				}
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		case http.MethodDelete:
+			if !store.acquire(upload.ID) {
+				w.WriteHeader(http.StatusLocked)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   "The upload is receiving data",
+				})
+				return
+			}
+			store.remove(upload.ID)
+			store.release(upload.ID)
+			w.WriteHeader(http.StatusNoContent)
+
+		case http.MethodGet:
+			if upload.Result == nil {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   fmt.Sprintf("Upload incomplete: %d of %d bytes received", upload.Offset, upload.Length),
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(upload.Result)
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "Method not allowed. Use HEAD, PATCH, DELETE or GET.",
+			})
+		}
+	}
+}
+
+// createTusUpload handles the creation POST, which may carry the first data
+func createTusUpload(w http.ResponseWriter, r *http.Request, backend Backend, config *Config, store *TusStore, mountPath string) {
+	store.sweep()
+
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: false,
+			Error:   "Upload-Defer-Length is not supported, send Upload-Length",
+		})
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: false,
+			Error:   "Upload-Length must be the file size in bytes",
+		})
+		return
+	}
+	if length > config.MaxFileSize {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(config.MaxFileSize, 10))
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: false,
+			Error:   errUploadTooLarge.Error(),
+		})
+		return
+	}
+
+	upload, err := newTusUpload(r, config, length)
+	if err != nil {
+		if errors.Is(err, errInvalidImageType) {
+			abuseGuard.RecordStrike(trustedClientIP(r), StrikeInvalidUpload, 1)
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	upload.Bucket = backend.Bucket()
+	if err := store.create(upload); err != nil {
+		log.Printf("⚠️  Failed to create tus upload: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: false,
+			Error:   "Failed to create the upload",
+		})
+		return
+	}
+	w.Header().Set("Location", mountPath+upload.ID)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(config.MaxFileSize, 10))
+
+	// creation-with-upload: the request may already carry (part of) the file
+	if r.Header.Get("Content-Type") == tusContentType && r.ContentLength != 0 {
+		if status, err := receiveTusUpload(w, r, backend, config, store, upload); err != nil {
+			if status != 0 {
+				w.WriteHeader(status)
+				json.NewEncoder(w).Encode(UploadResponse{
+					Success: false,
+					Error:   err.Error(),
+				})
+			}
+			return
+		}
+	} else {
+		setTusOffsetHeaders(w, store, upload)
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// newTusUpload validates the headers of a creation request the way the form
+// fields of a multipart upload are
+func newTusUpload(r *http.Request, config *Config, length int64) (*tusUpload, error) {
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		return nil, err
+	}
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+	if filename == "" {
+		return nil, errors.New("Upload-Metadata must include the filename (or name)")
+	}
+	if err := validateUpload(filename, length, config.MaxFileSize); err != nil {
+		return nil, err
+	}
+
+	uploader, err := uploaderID(r)
+	if err != nil {
+		return nil, err
+	}
+	collision, err := parseCollisionPolicy(metadata["collision"], config.CollisionPolicy)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := parseTags(metadata["tags"])
+	if err != nil {
+		return nil, err
+	}
+	disposition, err := uploadDisposition(metadata[dispositionField], metadata[downloadNameField], filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// Other keys (title, alt, ...) are stored like multipart text fields
+	form := &multipart.Form{Value: map[string][]string{}}
+	for key, value := range metadata {
+		if !slices.Contains(tusFileKeys, key) {
+			form.Value[key] = []string{value}
+		}
+	}
+	objectMetadata, err := uploadFormMetadata(form, config.UploadForm.MetadataFields)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tusUpload{
+		Length:      length,
+		Filename:    filename,
+		RawMetadata: r.Header.Get("Upload-Metadata"),
+		Metadata:    objectMetadata,
+		Tags:        tags,
+		Collision:   collision,
+		Disposition: disposition,
+		Tenant:      r.Header.Get("X-Tenant-ID"),
+		Uploader:    uploader,
+		Origin:      requestOrigin(r),
+		Created:     time.Now(),
+	}, nil
+}
+
+// receiveTusUpload appends the request body to an upload and stores the file
+// once it is complete. It returns the status of a failure with its error, a
+// status of 0 when the client went away. Bytes beyond Upload-Length are
+// ignored.
+func receiveTusUpload(w http.ResponseWriter, r *http.Request, backend Backend, config *Config, store *TusStore, upload *tusUpload) (int, error) {
+	if !store.acquire(upload.ID) {
+		return http.StatusLocked, errors.New("The upload is already receiving data")
+	}
+	defer store.release(upload.ID)
+
+	// Large chunks outlive the server timeouts, see the route policies
+	ctx, cancel := context.WithTimeout(r.Context(), routeTimeout(r, serverWriteTimeout))
+	defer cancel()
+
+	// The data received so far is kept even when the client goes away, so it
+	// can resume from there
+	data, err := os.OpenFile(store.dataPath(upload.ID), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to open the upload: %w", err)
+	}
+	written, copyErr := io.Copy(data, &contextReader{ctx: ctx, r: io.LimitReader(r.Body, upload.Length-upload.Offset)})
+	if err := data.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	upload.Offset += written
+	if err := store.save(upload); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to save the upload: %w", err)
+	}
+	if copyErr != nil {
+		if uploadAborted(ctx, backend, "receiving a tus chunk") {
+			return 0, copyErr
+		}
+		return http.StatusInternalServerError, fmt.Errorf("failed to receive data: %w", copyErr)
+	}
+
+	// An upload whose storing failed is retried by sending an empty PATCH
+	if upload.Offset == upload.Length && upload.Result == nil {
+		if status, err := completeTusUpload(ctx, r, backend, config, store, upload); err != nil {
+			return status, err
+		}
+	}
+	setTusOffsetHeaders(w, store, upload)
+	if upload.Result != nil && upload.Result.URL != "" {
+		w.Header().Set("X-Object-URL", upload.Result.URL)
+	}
+	return 0, nil
+}
+
+// completeTusUpload runs a complete upload through the ingestion pipeline
+// and keeps the response for GET. Uploads that can never be stored are
+// removed; others stay for a retry.
+func completeTusUpload(ctx context.Context, r *http.Request, backend Backend, config *Config, store *TusStore, upload *tusUpload) (int, error) {
+	file, err := os.Open(store.dataPath(upload.ID))
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to open the upload: %w", err)
+	}
+	defer file.Close()
+
+	result, err := IngestImage(ctx, backend, file, IngestOptions{
+		Filename:    upload.Filename,
+		Size:        upload.Length,
+		MaxSize:     config.MaxFileSize,
+		Tenant:      upload.Tenant,
+		Uploader:    upload.Uploader,
+		Origin:      upload.Origin,
+		Source:      SourceUpload,
+		Started:     upload.Created,
+		Reencode:    config.reencodeOptions(),
+		PHash:       config.PerceptualHash,
+		PHashMax:    config.PHashMaxPixels,
+		Animated:    &config.Animation,
+		Color:       config.colorOptions(),
+		Orient:      config.orientOptions(),
+		Collision:   upload.Collision,
+		Dedupe:      config.Dedupe,
+		Metadata:    upload.Metadata,
+		Tags:        upload.Tags,
+		Disposition: upload.Disposition,
+	})
+	if err != nil {
+		if uploadAborted(ctx, backend, "storing "+upload.Filename) {
+			return 0, err
+		}
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrObjectExists):
+			status, err = http.StatusConflict, errors.New("An object with this name already exists")
+		case errors.Is(err, errStageTimeout):
+			status = http.StatusServiceUnavailable
+		case errors.Is(err, errInvalidImage) || errors.Is(err, errUploadTooLarge):
+			var rejection *PluginRejection
+			if errors.Is(err, errInvalidImage) && !errors.As(err, &rejection) {
+				abuseGuard.RecordStrike(trustedClientIP(r), StrikeInvalidUpload, 1)
+			}
+			status = http.StatusBadRequest
+		default:
+			err = fmt.Errorf("Failed to upload image: %w", err)
+		}
+		if status == http.StatusBadRequest || status == http.StatusConflict {
+			store.remove(upload.ID)
+		}
+		return status, err
+	}
+
+	response := UploadResponse{
+		Success:  true,
+		URL:      backend.PublicURL(result.Name),
+		Object:   result.Name,
+		Metadata: upload.Metadata,
+		Tags:     result.Record.Tags,
+		Message:  "Image uploaded successfully",
+	}
+	response.describeAsset(backend, result)
+	if result.Poster != "" {
+		response.Poster = backend.PublicURL(result.Poster)
+	}
+	if result.Staged {
+		response.URL, response.Poster = "", ""
+		response.Staged = true
+		response.Message = "Image staged, publish it with POST /objects/{name}/publish"
+	}
+	if result.Deduplicated {
+		response.Deduplicated = true
+		response.Message = "Identical image already stored"
+	}
+	if receipt, err := receiptSigner.Sign(result.Record); err != nil {
+		traceLogf(ctx, "⚠️  Failed to sign the receipt of %s: %v", result.Name, err)
+	} else {
+		response.Receipt = receipt
+	}
+
+	// The data is no longer needed, the result is kept until the upload expires
+	upload.Result = &response
+	if err := store.save(upload); err != nil {
+		traceLogf(ctx, "⚠️  Failed to save the result of tus upload %s: %v", upload.ID, err)
+	}
+	if err := os.Truncate(store.dataPath(upload.ID), 0); err != nil {
+		traceLogf(ctx, "⚠️  Failed to free tus upload %s: %v", upload.ID, err)
+	}
+	return 0, nil
+}
+
+// setTusOffsetHeaders sets the headers of a response acknowledging data
+func setTusOffsetHeaders(w http.ResponseWriter, store *TusStore, upload *tusUpload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if store.expiry > 0 {
+		w.Header().Set("Upload-Expires", store.expires(upload).UTC().Format(http.TimeFormat))
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPNG returns a small valid PNG image
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newTestTusHandler(t *testing.T) (http.HandlerFunc, *mockBackend) {
+	t.Helper()
+	store, err := NewTusStore(TusConfig{Dir: t.TempDir(), Expiry: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := newMockBackend()
+	return HandleTus(backend, &Config{MaxFileSize: 1 << 20}, store, "/upload/tus/"), backend
+}
+
+// tusRequest sends a tus request the way tus-js-client does
+func tusRequest(handler http.HandlerFunc, method, path string, header map[string]string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func tusMetadata(pairs ...string) string {
+	var encoded []string
+	for i := 0; i < len(pairs); i += 2 {
+		encoded = append(encoded, pairs[i]+" "+base64.StdEncoding.EncodeToString([]byte(pairs[i+1])))
+	}
+	return strings.Join(encoded, ",")
+}
+
+func TestTusResumedUpload(t *testing.T) {
+	handler, backend := newTestTusHandler(t)
+	file := testPNG(t)
+	half := len(file) / 2
+
+	// Uppy creates the upload with its first chunk
+	rec := tusRequest(handler, http.MethodPost, "/upload/tus/", map[string]string{
+		"Upload-Length":   strconv.Itoa(len(file)),
+		"Upload-Metadata": tusMetadata("filename", "cat.png", "filetype", "image/png"),
+		"Content-Type":    tusContentType,
+	}, file[:half])
+	location := rec.Header().Get("Location")
+	if rec.Code != http.StatusCreated || !strings.HasPrefix(location, "/upload/tus/") || rec.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Fatalf("create: status %d, Location %q, Upload-Offset %q: %s", rec.Code, location, rec.Header().Get("Upload-Offset"), rec.Body)
+	}
+
+	// After an interruption it asks where to resume
+	rec = tusRequest(handler, http.MethodHead, location, nil, nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Fatalf("HEAD: status %d, Upload-Offset %q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	rec = tusRequest(handler, http.MethodPatch, location, map[string]string{"Upload-Offset": "0", "Content-Type": tusContentType}, file)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("PATCH at a stale offset: status %d, want 409", rec.Code)
+	}
+	rec = tusRequest(handler, http.MethodGet, location, nil, nil)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("result of an incomplete upload: status %d, want 409", rec.Code)
+	}
+
+	rec = tusRequest(handler, http.MethodPatch, location, map[string]string{"Upload-Offset": strconv.Itoa(half), "Content-Type": tusContentType}, file[half:])
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != strconv.Itoa(len(file)) || rec.Header().Get("X-Object-URL") == "" {
+		t.Fatalf("last PATCH: status %d, headers %v: %s", rec.Code, rec.Header(), rec.Body)
+	}
+
+	rec = tusRequest(handler, http.MethodGet, location, nil, nil)
+	var result UploadResponse
+	json.NewDecoder(rec.Body).Decode(&result)
+	if rec.Code != http.StatusOK || !result.Success || result.Object == "" {
+		t.Fatalf("result: status %d, %+v", rec.Code, result)
+	}
+	// The mock backend only keeps attributes, which is enough to see the
+	// two chunks were stored as one file
+	info, err := backend.Stat(t.Context(), result.Object)
+	if err != nil || info.Size != int64(len(file)) || info.ContentType != "image/png" {
+		t.Errorf("stored %+v, %v, want the %d byte PNG", info, err, len(file))
+	}
+}
+
+func TestTusRejects(t *testing.T) {
+	handler, _ := newTestTusHandler(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/upload/tus/", nil)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusPreconditionFailed || rec.Header().Get("Tus-Version") != tusVersion {
+		t.Errorf("without Tus-Resumable: status %d, Tus-Version %q, want 412", rec.Code, rec.Header().Get("Tus-Version"))
+	}
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{"too large", map[string]string{"Upload-Length": strconv.Itoa(2 << 20), "Upload-Metadata": tusMetadata("filename", "cat.png")}, http.StatusRequestEntityTooLarge},
+		{"disallowed type", map[string]string{"Upload-Length": "10", "Upload-Metadata": tusMetadata("filename", "run.exe")}, http.StatusBadRequest},
+		{"no filename", map[string]string{"Upload-Length": "10", "Upload-Metadata": tusMetadata("filetype", "image/png")}, http.StatusBadRequest},
+		{"deferred length", map[string]string{"Upload-Defer-Length": "1", "Upload-Metadata": tusMetadata("filename", "cat.png")}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := tusRequest(handler, http.MethodPost, "/upload/tus/", tt.header, nil); rec.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+
+	if rec := tusRequest(handler, http.MethodHead, "/upload/tus/0123456789abcdef0123456789abcdef", nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown upload: status %d, want 404", rec.Code)
+	}
+}
+
+func TestCORSPreflightForUppy(t *testing.T) {
+	handler := CORSMiddleware([]string{"https://app.example.com"})(http.NotFoundHandler())
+	req := httptest.NewRequest(http.MethodOptions, "/upload/tus/", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPatch)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Fatalf("preflight: status %d, headers %v", rec.Code, rec.Header())
+	}
+	for header, want := range map[string][]string{
+		"Access-Control-Allow-Methods":  {"PATCH", "HEAD", "DELETE"},
+		"Access-Control-Allow-Headers":  {"Tus-Resumable", "Upload-Offset", "Upload-Metadata", "X-Requested-With"},
+		"Access-Control-Expose-Headers": {"Location", "Upload-Offset", "Tus-Resumable"},
+	} {
+		for _, value := range want {
+			if !strings.Contains(rec.Header().Get(header), value) {
+				t.Errorf("%s = %q, missing %s", header, rec.Header().Get(header), value)
+			}
+		}
+	}
+
+	req.Header.Set("Origin", "https://evil.example.com")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("other origin allowed: %q", got)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UploadMemoryConfig holds the budget for the request bodies uploads buffer
+type UploadMemoryConfig struct {
+	Budget       int64         // bytes of request bodies in flight at once, 0 disables the budget
+	QueueTimeout time.Duration // how long a request waits for room before getting 503
+	MaxQueue     int           // requests waiting at once; further ones get 503 right away
+}
+
+// Errors of UploadMemoryBudget.Acquire
+var (
+	errUploadMemoryQueueFull = errors.New("too many uploads waiting for memory")
+	errUploadMemoryTimeout   = errors.New("no memory freed up in time")
+)
+
+// memoryWaiter is a request queued for room in the budget
+type memoryWaiter struct {
+	size  int64
+	ready chan struct{} // closed once the size is granted
+}
+
+// UploadMemoryBudget caps the memory the bodies of concurrent uploads may
+// take: multipart forms, stage buffers and storage chunks all hold up to a
+// whole file. Requests reserve their body size before reading it and wait in
+// FIFO order when the budget is used up, so a large upload isn't starved by
+// small ones.
+type UploadMemoryBudget struct {
+	budget       int64
+	queueTimeout time.Duration
+	maxQueue     int
+
+	mu      sync.Mutex
+	inUse   int64
+	waiters []*memoryWaiter
+}
+
+// NewUploadMemoryBudget creates the budget; it returns nil when no budget is configured
+func NewUploadMemoryBudget(cfg UploadMemoryConfig) *UploadMemoryBudget {
+	if cfg.Budget <= 0 {
+		return nil
+	}
+	uploadMemoryBudgetBytes.Set(float64(cfg.Budget))
+	return &UploadMemoryBudget{
+		budget:       cfg.Budget,
+		queueTimeout: cfg.QueueTimeout,
+		maxQueue:     cfg.MaxQueue,
+	}
+}
+
+// Acquire reserves size bytes, waiting up to the queue timeout for room.
+// Sizes over the budget are reserved as the whole budget, so such an upload
+// runs alone instead of never. The caller must Release the returned size.
+func (b *UploadMemoryBudget) Acquire(ctx context.Context, size int64) (int64, error) {
+	size = min(size, b.budget)
+	b.mu.Lock()
+	if len(b.waiters) == 0 && b.inUse+size <= b.budget {
+		b.inUse += size
+		uploadMemoryInUseBytes.Set(float64(b.inUse))
+		b.mu.Unlock()
+		return size, nil
+	}
+	if len(b.waiters) >= b.maxQueue {
+		b.mu.Unlock()
+		return 0, errUploadMemoryQueueFull
+	}
+	waiter := &memoryWaiter{size: size, ready: make(chan struct{})}
+	b.waiters = append(b.waiters, waiter)
+	uploadMemoryQueued.Set(float64(len(b.waiters)))
+	b.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(b.queueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-waiter.ready:
+		uploadMemoryWaitSeconds.Observe(time.Since(start).Seconds())
+		return size, nil
+	case <-timer.C:
+		err = errUploadMemoryTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if i := slices.Index(b.waiters, waiter); i >= 0 {
+		b.waiters = slices.Delete(b.waiters, i, i+1)
+		// The requests behind this one may fit now
+		b.grant()
+		return 0, err
+	}
+	// Granted while giving up: hand the room back
+	b.inUse -= size
+	b.grant()
+	return 0, err
+}
+
+// Release returns the size of a finished request to the budget
+func (b *UploadMemoryBudget) Release(size int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inUse -= size
+	b.grant()
+}
+
+// grant hands room to the waiting requests in order, as long as they fit.
+// b.mu must be held.
+func (b *UploadMemoryBudget) grant() {
+	for len(b.waiters) > 0 && b.inUse+b.waiters[0].size <= b.budget {
+		b.inUse += b.waiters[0].size
+		close(b.waiters[0].ready)
+		b.waiters = b.waiters[1:]
+	}
+	uploadMemoryQueued.Set(float64(len(b.waiters)))
+	uploadMemoryInUseBytes.Set(float64(b.inUse))
+}
+
+// UploadMemoryMiddleware makes requests with a body reserve its size (the
+// size limit when the length isn't declared) before being served, and answers
+// 503 when no room frees up in time. It must wrap MinUploadRateMiddleware, so
+// the time spent queued doesn't count as a stalled upload.
+func UploadMemoryMiddleware(budget *UploadMemoryBudget, maxFileSize int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if budget == nil {
+			return next
+		}
+		retryAfter := strconv.Itoa(max(1, int(math.Ceil(budget.queueTimeout.Seconds()))))
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			size := r.ContentLength
+			if size < 0 {
+				size = maxFileSize
+			}
+			reserved, err := budget.Acquire(r.Context(), size)
+			if err != nil {
+				if r.Context().Err() != nil {
+					return
+				}
+				reason := "timeout"
+				if errors.Is(err, errUploadMemoryQueueFull) {
+					reason = "queue_full"
+				}
+				uploadMemoryRejectedTotal.WithLabelValues(reason).Inc()
+				log.Printf("🧠 Rejected %s %s (%d bytes): %v", r.Method, r.URL.Path, size, err)
+				w.Header().Set("Retry-After", retryAfter)
+				writeJSONBody(w, http.StatusServiceUnavailable, bodyTooManyUploads)
+				return
+			}
+			defer budget.Release(reserved)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The cache metrics are resolved once instead of on every lookup
+var (
+	signedURLCacheHits   = signedURLCacheTotal.WithLabelValues("hit")
+	signedURLCacheMisses = signedURLCacheTotal.WithLabelValues("miss")
+)
+
+// signedURLKey identifies interchangeable signed URLs
+type signedURLKey struct {
+	bucket      string
+	method      string
+	name        string
+	contentType string
+	expires     time.Duration
+	maxSize     int64
+	headers     string // canonical metadata and Cache-Control, see signedHeadersKey
+}
+
+type signedURLEntry struct {
+	key       signedURLKey
+	url       string
+	expiresAt time.Time
+}
+
+// signedURLCache is an LRU of generated GET signed URLs. V4 signing costs an
+// RSA signature per call, so a URL is handed out again as long as it stays
+// valid for at least minRemaining. Upload URLs are never cached: each names
+// a new object, and a PUT URL must not be handed to two clients. A nil cache
+// signs every request.
+type signedURLCache struct {
+	size         int
+	minRemaining time.Duration
+
+	mu      sync.Mutex
+	entries map[signedURLKey]*list.Element
+	order   *list.List // front = most recently used
+}
+
+// newSignedURLCache creates a cache holding up to size URLs, or nil when size is 0
+func newSignedURLCache(size int, minRemaining time.Duration) *signedURLCache {
+	if size <= 0 {
+		return nil
+	}
+	return &signedURLCache{
+		size:         size,
+		minRemaining: minRemaining,
+		entries:      map[signedURLKey]*list.Element{},
+		order:        list.New(),
+	}
+}
+
+// SignedURL returns a cached URL that is still valid long enough, or signs a
+// new one, and when the returned URL expires
+func (c *signedURLCache) SignedURL(backend Backend, method, name string, opts SignOptions) (string, time.Time, error) {
+	if c == nil || method != http.MethodGet || opts.Expires <= c.minRemaining {
+		expiresAt := time.Now().Add(opts.Expires)
+		url, err := backend.SignedURL(method, name, opts)
+		return url, expiresAt, err
+	}
+
+	key := signedURLKey{
+		bucket:      backend.Bucket(),
+		method:      method,
+		name:        name,
+		contentType: opts.ContentType,
+		expires:     opts.Expires,
+		maxSize:     opts.MaxSize,
+		headers:     signedHeadersKey(opts),
+	}
+
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*signedURLEntry)
+		if time.Until(entry.expiresAt) > c.minRemaining {
+			c.order.MoveToFront(elem)
+			c.mu.Unlock()
+			signedURLCacheHits.Inc()
+			return entry.url, entry.expiresAt, nil
+		}
+	}
+	c.mu.Unlock()
+	signedURLCacheMisses.Inc()
+
+	// Sign outside the lock; concurrent misses for the same key just both sign
+	expiresAt := time.Now().Add(opts.Expires)
+	url, err := backend.SignedURL(method, name, opts)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = &signedURLEntry{key: key, url: url, expiresAt: expiresAt}
+		c.order.MoveToFront(elem)
+		return url, expiresAt, nil
+	}
+	c.entries[key] = c.order.PushFront(&signedURLEntry{key: key, url: url, expiresAt: expiresAt})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*signedURLEntry).key)
+	}
+	return url, expiresAt, nil
+}
+
+// signedHeadersKey encodes the metadata and Cache-Control of opts in a
+// comparable form; URLs signed with different headers are not interchangeable
+func signedHeadersKey(opts SignOptions) string {
+	if len(opts.Metadata) == 0 && opts.CacheControl == "" {
+		return ""
+	}
+	keys := make([]string, 0, len(opts.Metadata))
+	for key := range opts.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(opts.CacheControl)
+	for _, key := range keys {
+		b.WriteByte('\n')
+		b.WriteString(key)
+		b.WriteByte(':')
+		b.WriteString(opts.Metadata[key])
+	}
+	return b.String()
+}
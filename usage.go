@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Origin labels of uploads that can't be attributed to a configured or
+// early-seen origin
+const (
+	usageNoOrigin    = "none"  // imports and other uploads outside a request
+	usageOtherOrigin = "other" // origins beyond the label limit
+)
+
+// maxUsagePeriod is the longest period the usage report covers
+const maxUsagePeriod = 366 * 24 * time.Hour
+
+// OriginLabels bounds the origins (or tenants) used as metric labels.
+// Configured values always get their own label, others only until the limit
+// is reached, so a client sending random headers can't blow up the series count.
+type OriginLabels struct {
+	known map[string]bool
+	limit int
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// usageOrigins labels upload metrics; nil (every origin is "other") until set in main
+var usageOrigins *OriginLabels
+
+// NewOriginLabels creates the labels for the known origins plus up to limit
+// others. "*" entries are ignored.
+func NewOriginLabels(known []string, limit int) *OriginLabels {
+	l := &OriginLabels{known: map[string]bool{}, limit: limit, seen: map[string]bool{}}
+	for _, origin := range known {
+		if origin != "" && origin != "*" {
+			l.known[origin] = true
+		}
+	}
+	return l
+}
+
+// Label returns the metric label of an origin
+func (l *OriginLabels) Label(origin string) string {
+	if origin == "" {
+		return usageNoOrigin
+	}
+	if l == nil {
+		return usageOtherOrigin
+	}
+	if l.known[origin] {
+		return origin
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.seen[origin] {
+		return origin
+	}
+	if len(l.seen) >= l.limit {
+		return usageOtherOrigin
+	}
+	l.seen[origin] = true
+	return origin
+}
+
+// requestOrigin identifies who an upload is billed to: the Origin header of
+// browser requests, the hostname the request was sent to otherwise
+func requestOrigin(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		return origin
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return strings.ToLower(host)
+}
+
+// recordUsage counts the bytes of a stored upload
+func recordUsage(bucket, origin, tenant string, size int64) {
+	originLabel, tenantLabel := usageOrigins.Label(origin), metricTenants.Label(tenant)
+	uploadedBytesTotal.WithLabelValues(bucket, originLabel, tenantLabel).Add(float64(size))
+	uploadSizeBytes.WithLabelValues(bucket, originLabel, tenantLabel).Observe(float64(size))
+}
+
+// parseUsagePeriod parses a period such as "30d", "12h" or "90m"
+func parseUsagePeriod(value string) (time.Duration, error) {
+	var period time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid period %q", value)
+		}
+		period = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if period, err = time.ParseDuration(value); err != nil {
+			return 0, fmt.Errorf("invalid period %q", value)
+		}
+	}
+	if period < time.Minute || period > maxUsagePeriod {
+		return 0, fmt.Errorf("period must be between 1m and %dd", maxUsagePeriod/(24*time.Hour))
+	}
+	return period, nil
+}
+
+// UsageEntry is the storage added by one origin and tenant in a bucket
+type UsageEntry struct {
+	Bucket  string `json:"bucket"`
+	Origin  string `json:"origin"`
+	Tenant  string `json:"tenant,omitempty"`
+	Objects int64  `json:"objects"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// UsageResponse is returned by GET /admin/usage
+type UsageResponse struct {
+	Success bool         `json:"success"`
+	Period  string       `json:"period,omitempty"`
+	Since   time.Time    `json:"since,omitzero"`
+	Objects int64        `json:"objects"`
+	Bytes   int64        `json:"bytes"`
+	Usage   []UsageEntry `json:"usage"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// usageReport sums the assets created since the given time by bucket, origin
+// and tenant, largest first. An empty bucket covers every bucket.
+func usageReport(since time.Time, bucket string) UsageResponse {
+	report := UsageResponse{Success: true, Since: since, Usage: []UsageEntry{}}
+	entries := map[UsageEntry]*UsageEntry{}
+	for _, record := range metadataStore.ListSince(since, bucket) {
+		origin := record.Origin
+		if origin == "" {
+			origin = usageNoOrigin
+		}
+		key := UsageEntry{Bucket: record.Bucket, Origin: origin, Tenant: record.Tenant}
+		entry, ok := entries[key]
+		if !ok {
+			entry = &key
+			entries[key] = entry
+		}
+		entry.Objects++
+		entry.Bytes += record.Size
+		report.Objects++
+		report.Bytes += record.Size
+	}
+
+	for _, entry := range entries {
+		report.Usage = append(report.Usage, *entry)
+	}
+	sort.Slice(report.Usage, func(i, j int) bool {
+		a, b := report.Usage[i], report.Usage[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Bucket+"/"+a.Origin+"/"+a.Tenant < b.Bucket+"/"+b.Origin+"/"+b.Tenant
+	})
+	return report
+}
+
+// HandleUsage serves GET /admin/usage?period=30d&bucket=, the storage added
+// per bucket, origin and tenant over the period, for internal billing
+func HandleUsage(backends map[string]Backend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(UsageResponse{
+				Success: false,
+				Error:   "Method not allowed. Use GET.",
+			})
+			return
+		}
+
+		query := r.URL.Query()
+		value := query.Get("period")
+		if value == "" {
+			value = "30d"
+		}
+		period, err := parseUsagePeriod(value)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(UsageResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+		bucket := query.Get("bucket")
+		if _, ok := backends[bucket]; bucket != "" && !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(UsageResponse{
+				Success: false,
+				Error:   "bucket must be a registered bucket",
+			})
+			return
+		}
+
+		report := usageReport(time.Now().UTC().Add(-period), bucket)
+		report.Period = value
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// uploaderHeader carries the end user an upload is made on behalf of. It is
+// set by the trusted client holding the API key, not by the end user.
+const uploaderHeader = "X-Uploader-Id"
+
+// maxUserUploads caps the uploads returned by GET /users/{id}/uploads
+const maxUserUploads = 1000
+
+// uploaderIDPattern allows user ids, emails and subject claims but no
+// characters that would break object metadata headers or log lines
+var uploaderIDPattern = regexp.MustCompile(`^[A-Za-z0-9._@:|+-]{1,128}$`)
+
+// uploaderID returns the validated uploader of a request, or "" when the
+// header is absent
+func uploaderID(r *http.Request) (string, error) {
+	id := strings.TrimSpace(r.Header.Get(uploaderHeader))
+	if id == "" {
+		return "", nil
+	}
+	if !uploaderIDPattern.MatchString(id) {
+		return "", fmt.Errorf("Invalid %s header", uploaderHeader)
+	}
+	return id, nil
+}
+
+// UserUploadsResponse lists the uploads of one user
+type UserUploadsResponse struct {
+	Uploader string        `json:"uploader"`
+	Count    int           `json:"count"`
+	Uploads  []AssetRecord `json:"uploads"`
+}
+
+// HandleUserUploads serves GET /users/{id}/uploads from the metadata store,
+// newest first. ?bucket= narrows the result to one bucket, ?limit= caps it.
+func HandleUserUploads(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: false,
+			Error:   "Method not allowed. Use GET.",
+		})
+		return
+	}
+
+	id := r.PathValue("id")
+	if !uploaderIDPattern.MatchString(id) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success: false,
+			Error:   "Not found. Use /users/{id}/uploads",
+		})
+		return
+	}
+
+	limit := maxUserUploads
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(UploadResponse{
+				Success: false,
+				Error:   "limit must be a positive integer",
+			})
+			return
+		}
+		limit = min(n, maxUserUploads)
+	}
+
+	uploads := metadataStore.ListByUploader(id, r.URL.Query().Get("bucket"), limit)
+	json.NewEncoder(w).Encode(UserUploadsResponse{
+		Uploader: id,
+		Count:    len(uploads),
+		Uploads:  uploads,
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+// Envelope is the response shape of every /v1 endpoint, so generated client
+// SDKs can decode all routes the same way. Exactly one of Data and Error is
+// set.
+type Envelope struct {
+	Data  any            `json:"data"`
+	Error *EnvelopeError `json:"error"`
+	Meta  EnvelopeMeta   `json:"meta"`
+}
+
+// EnvelopeError describes a failed request
+type EnvelopeError struct {
+	Code    string `json:"code"` // stable, machine-readable, e.g. not_found
+	Message string `json:"message"`
+}
+
+// EnvelopeMeta holds information about the response beyond its data
+type EnvelopeMeta struct {
+	NextPageToken string `json:"nextPageToken,omitempty"` // set when a listing has more pages
+}
+
+// envelopeErrorCodes maps HTTP statuses to error codes
+var envelopeErrorCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_argument",
+	http.StatusUnauthorized:          "unauthenticated",
+	http.StatusForbidden:             "permission_denied",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "already_exists",
+	http.StatusLocked:                "locked",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusUnprocessableEntity:   "invalid_argument",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// envelopeErrorCode returns the error code for an HTTP status
+func envelopeErrorCode(status int) string {
+	if code, ok := envelopeErrorCodes[status]; ok {
+		return code
+	}
+	if status >= 500 {
+		return "internal"
+	}
+	return "failed"
+}
+
+// V1Envelope serves a handler under /v1 by translating its response into
+// an Envelope: the "error" field becomes Error, "nextPageToken" moves to
+// Meta and the remaining fields (minus "success") become Data. A body that is
+// JSON but not an object, such as an array, becomes Data as it is. The
+// status code is kept.
+func V1Envelope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &envelopeRecorder{header: http.Header{}, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		for key, values := range rec.header {
+			if key != "Content-Type" && key != "Content-Length" {
+				w.Header()[key] = values
+			}
+		}
+
+		// Handlers may answer without a JSON body (e.g. a bare 429), or with
+		// an array or other value that has no fields to move
+		fields := map[string]any{}
+		var other json.RawMessage
+		if body := bytes.TrimSpace(rec.body.Bytes()); len(body) > 0 && body[0] == '{' {
+			decoder := json.NewDecoder(bytes.NewReader(body))
+			decoder.UseNumber()
+			decoder.Decode(&fields)
+		} else if json.Valid(body) {
+			other = body
+		}
+
+		envelope := Envelope{}
+		if rec.status >= 400 {
+			message, _ := fields["error"].(string)
+			if message == "" {
+				message = http.StatusText(rec.status)
+			}
+			envelope.Error = &EnvelopeError{Code: envelopeErrorCode(rec.status), Message: message}
+		} else {
+			if token, ok := fields["nextPageToken"].(string); ok {
+				envelope.Meta.NextPageToken = token
+			}
+			delete(fields, "nextPageToken")
+			delete(fields, "success")
+			delete(fields, "error")
+			envelope.Data = fields
+			if other != nil {
+				envelope.Data = other
+			}
+		}
+
+		writeJSON(w, rec.status, envelope)
+	})
+}
+
+// envelopeRecorder captures a response for V1Envelope
+type envelopeRecorder struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rec *envelopeRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *envelopeRecorder) WriteHeader(code int) {
+	if !rec.wroteHeader {
+		rec.status = code
+		rec.wroteHeader = true
+	}
+}
+
+func (rec *envelopeRecorder) Write(p []byte) (int, error) {
+	rec.wroteHeader = true
+	return rec.body.Write(p)
+}
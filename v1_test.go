@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestV1Envelope(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   string
+	}{
+		{http.StatusOK, `{"success":true,"name":"a.jpg","nextPageToken":"t"}`, `{"data":{"name":"a.jpg"},"error":null,"meta":{"nextPageToken":"t"}}`},
+		{http.StatusOK, `[{"name":"a.jpg"},{"name":"b.jpg"}]`, `{"data":[{"name":"a.jpg"},{"name":"b.jpg"}],"error":null,"meta":{}}`},
+		{http.StatusOK, "\"ok\"\n", `{"data":"ok","error":null,"meta":{}}`},
+		{http.StatusOK, `{"size":12345678901234567890}`, `{"data":{"size":12345678901234567890},"error":null,"meta":{}}`},
+		{http.StatusNoContent, "", `{"data":{},"error":null,"meta":{}}`},
+		{http.StatusNotFound, `{"success":false,"error":"Object not found"}`, `{"data":null,"error":{"code":"not_found","message":"Object not found"},"meta":{}}`},
+		{http.StatusTooManyRequests, "", `{"data":null,"error":{"code":"rate_limited","message":"Too Many Requests"},"meta":{}}`},
+	}
+	for _, tt := range tests {
+		handler := V1Envelope(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.body))
+		}))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/objects", nil))
+		if got := strings.TrimSpace(rec.Body.String()); rec.Code != tt.status || got != tt.want {
+			t.Errorf("%d %s: got %d %s, want %s", tt.status, tt.body, rec.Code, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"slices"
+)
+
+// crc32cTable is the Castagnoli table GCS checksums objects with
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errUploadVerification is returned when a stored object doesn't read back as written
+var errUploadVerification = errors.New("upload verification failed")
+
+// VerifyConfig selects the uploads read back after writing
+type VerifyConfig struct {
+	All     bool     // verify every upload
+	Tenants []string // tenants with strict integrity requirements, when not All
+}
+
+// UploadVerification decides which uploads are verified after writing. A
+// nil UploadVerification verifies nothing.
+type UploadVerification struct {
+	all     bool
+	tenants []string
+}
+
+// uploadVerification is the process-wide setting; nil (off) until set in main
+var uploadVerification *UploadVerification
+
+// NewUploadVerification returns nil when no upload is to be verified
+func NewUploadVerification(cfg VerifyConfig) *UploadVerification {
+	if !cfg.All && len(cfg.Tenants) == 0 {
+		return nil
+	}
+	return &UploadVerification{all: cfg.All, tenants: cfg.Tenants}
+}
+
+// Enabled reports whether uploads of the tenant are verified
+func (v *UploadVerification) Enabled(tenant string) bool {
+	if v == nil {
+		return false
+	}
+	return v.all || slices.Contains(v.tenants, tenant)
+}
+
+// verifyWrite reads back the attributes of a stored object and compares its
+// size and CRC32C with what was written. Backends that don't report a
+// CRC32C have the content read back instead. On a mismatch the object is
+// deleted, so no corrupt or partial copy stays behind.
+func verifyWrite(ctx context.Context, backend Backend, name string, size int64, crc uint32) error {
+	err := compareWrite(ctx, backend, name, size, crc)
+	if err == nil {
+		return nil
+	}
+	uploadVerificationFailuresTotal.WithLabelValues(backend.Bucket()).Inc()
+	if err := backend.Delete(ctx, name); err != nil && !errors.Is(err, ErrObjectNotFound) {
+		traceLogf(ctx, "⚠️  Failed to remove unverified object %s: %v", name, err)
+	}
+	return fmt.Errorf("%w: %v", errUploadVerification, err)
+}
+
+// compareWrite checks one stored object against the written size and CRC32C
+func compareWrite(ctx context.Context, backend Backend, name string, size int64, crc uint32) error {
+	info, err := backend.Stat(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to read back %s: %w", name, err)
+	}
+	if info.Size != size {
+		return fmt.Errorf("%s has %d bytes, %d were written", name, info.Size, size)
+	}
+	stored := info.CRC32C
+	if stored == 0 {
+		if stored, err = checksumCRC32C(ctx, backend, name); err != nil {
+			return fmt.Errorf("failed to read back %s: %w", name, err)
+		}
+	}
+	if stored != crc {
+		return fmt.Errorf("%s has CRC32C %08x, %08x was written", name, stored, crc)
+	}
+	return nil
+}
+
+// checksumCRC32C returns the CRC32C of an object's content
+func checksumCRC32C(ctx context.Context, backend Backend, name string) (uint32, error) {
+	reader, _, err := backend.Open(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	hasher := crc32.New(crc32cTable)
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return 0, err
+	}
+	return hasher.Sum32(), nil
+}
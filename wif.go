@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Default location of the projected ServiceAccount token in the pod
+const defaultWorkloadTokenPath = "/var/run/secrets/tokens/gcp-token"
+
+// WorkloadIdentityConfig exchanges a Kubernetes projected ServiceAccount
+// token for Google credentials through workload identity federation, so
+// clusters outside GKE don't need service account keys
+type WorkloadIdentityConfig struct {
+	Audience       string // full provider name: //iam.googleapis.com/projects/<number>/locations/global/workloadIdentityPools/<pool>/providers/<provider>
+	TokenPath      string // projected token file, re-read on every exchange
+	ServiceAccount string // optional, impersonated with the federated token
+}
+
+// Enabled reports whether workload identity federation is configured
+func (c WorkloadIdentityConfig) Enabled() bool {
+	return c.Audience != ""
+}
+
+// workloadIdentity is the federation config used by every Google API client.
+// It is set by LoadConfig, as clients are created in many places from just a
+// key file path.
+var workloadIdentity WorkloadIdentityConfig
+
+// credentialsJSON returns the external account credentials the Google
+// clients use to exchange the token with STS. The token file is read by the
+// client each time a token is due, so kubelet's rotations are picked up.
+func (c WorkloadIdentityConfig) credentialsJSON() ([]byte, error) {
+	if !strings.HasPrefix(c.Audience, "//iam.googleapis.com/") {
+		return nil, fmt.Errorf("WIF_AUDIENCE must be the full provider name starting with //iam.googleapis.com/, got %q", c.Audience)
+	}
+	if _, err := os.Stat(c.TokenPath); err != nil {
+		return nil, fmt.Errorf("projected ServiceAccount token: %w", err)
+	}
+
+	creds := map[string]any{
+		"type":               "external_account",
+		"audience":           c.Audience,
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+		"token_url":          "https://sts.googleapis.com/v1/token",
+		"credential_source": map[string]any{
+			"file":   c.TokenPath,
+			"format": map[string]string{"type": "text"},
+		},
+	}
+	if c.ServiceAccount != "" {
+		creds["service_account_impersonation_url"] = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/" + c.ServiceAccount + ":generateAccessToken"
+	}
+	return json.Marshal(creds)
+}